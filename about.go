@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// aboutLabel is the name below the zone apex the operator information is served at
+const aboutLabel = "_about"
+
+// aboutTTL is the TTL of the operator information records
+const aboutTTL = 3600
+
+// aboutInfo is the operator information of a zone: TXT and HINFO records at
+// _about.<zone>, and an RP record at the zone apex pointing to the contact
+// mailbox and to the TXT records
+type aboutInfo struct {
+	// About are the values of the TXT records of _about.<zone>, one record each
+	About    []string `toml:"about"`
+	HinfoCPU string   `toml:"hinfo_cpu"`
+	HinfoOS  string   `toml:"hinfo_os"`
+	// Contact is the mailbox of the RP record, where @ is substituted with .
+	Contact string `toml:"contact"`
+}
+
+// validateAbout checks the operator information of the zone
+func validateAbout(zone string, info aboutInfo) error {
+	for _, v := range append(info.About, info.HinfoCPU, info.HinfoOS) {
+		if len(v) > 255 {
+			return fmt.Errorf("the about and hinfo values of zone %s can't be longer than 255 characters", zone)
+		}
+	}
+	if info.Contact != "" {
+		if _, ok := dns.IsDomainName(info.Contact); !ok || strings.Contains(info.Contact, "@") {
+			return fmt.Errorf("contact %q of zone %s is not a valid mailbox name, substitute @ with .", info.Contact, zone)
+		}
+	}
+	return nil
+}
+
+// aboutRecords returns the operator information records of the zone
+func aboutRecords(zone string, info aboutInfo) []dns.RR {
+	zone = strings.ToLower(dns.Fqdn(zone))
+	name := aboutLabel + "." + zone
+	hdr := func(name string, rrtype uint16) dns.RR_Header {
+		return dns.RR_Header{Name: name, Rrtype: rrtype, Class: dns.ClassINET, Ttl: aboutTTL}
+	}
+	var rrs []dns.RR
+	for _, v := range info.About {
+		rrs = append(rrs, &dns.TXT{Hdr: hdr(name, dns.TypeTXT), Txt: []string{v}})
+	}
+	if info.HinfoCPU != "" || info.HinfoOS != "" {
+		rrs = append(rrs, &dns.HINFO{Hdr: hdr(name, dns.TypeHINFO), Cpu: info.HinfoCPU, Os: info.HinfoOS})
+	}
+	if info.Contact != "" {
+		// The RP record points to the TXT records, or to the root without them (RFC 1183)
+		txt := "."
+		if len(info.About) > 0 {
+			txt = name
+		}
+		rrs = append(rrs, &dns.RP{Hdr: hdr(zone, dns.TypeRP), Mbox: strings.ToLower(dns.Fqdn(info.Contact)), Txt: txt})
+	}
+	return rrs
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/BurntSushi/toml"
+	"github.com/miekg/dns"
+)
+
+func TestValidateAbout(t *testing.T) {
+	for i, test := range []struct {
+		info  aboutInfo
+		valid bool
+	}{
+		{aboutInfo{}, true},
+		{aboutInfo{About: []string{"Operated by Example Registry", "abuse: abuse@example.org"}, HinfoCPU: "acme-dns", Contact: "abuse.example.org"}, true},
+		{aboutInfo{About: []string{strings.Repeat("a", 256)}}, false},
+		{aboutInfo{HinfoOS: strings.Repeat("a", 256)}, false},
+		{aboutInfo{Contact: "abuse@example.org"}, false},
+	} {
+		if err := validateAbout("auth.example.org", test.info); test.valid != (err == nil) {
+			t.Errorf("Test %d: expected valid to be %t, got error %v", i, test.valid, err)
+		}
+	}
+}
+
+func TestAboutConfig(t *testing.T) {
+	var config DNSConfig
+	_, err := toml.Decode(`
+[general]
+domain = "auth.example.org"
+about = ["Operated by Example Registry"]
+contact = "abuse.example.org"
+
+[[zones]]
+domain = "acme.example.net"
+hinfo_cpu = "acme-dns"
+hinfo_os = "linux"
+`, &config)
+	if err != nil {
+		t.Fatalf("Could not decode the configuration: %v", err)
+	}
+	if len(config.General.About) != 1 || config.General.Contact != "abuse.example.org" {
+		t.Errorf("Expected the operator information of the general section, got %+v", config.General.aboutInfo)
+	}
+	if len(config.Zones) != 1 || config.Zones[0].HinfoCPU != "acme-dns" || config.Zones[0].HinfoOS != "linux" {
+		t.Errorf("Expected the operator information of the zone, got %+v", config.Zones)
+	}
+}
+
+func TestAboutAnswers(t *testing.T) {
+	config := Config
+	config.General.Domain = "auth.example.org"
+	config.General.ZoneFiles = nil
+	config.General.aboutInfo = aboutInfo{About: []string{"Operated by Example Registry"}, Contact: "abuse.example.org"}
+	config.Zones = []zoneConfig{{Domain: "acme.example.net", aboutInfo: aboutInfo{HinfoCPU: "acme-dns", HinfoOS: "linux", Contact: "hostmaster.example.net"}}}
+	server := NewDNSServer(DB, "", "udp", config.General.Domain)
+	server.ParseRecords(config)
+	udp := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53}
+	query := func(name string, qtype uint16) *dns.Msg {
+		req := new(dns.Msg)
+		req.SetQuestion(name, qtype)
+		w := &recordingWriter{local: udp}
+		server.handleRequest(w, req)
+		if w.msg == nil {
+			t.Fatalf("No response written for %s", name)
+		}
+		return w.msg
+	}
+
+	m := query("_about.auth.example.org.", dns.TypeTXT)
+	if len(m.Answer) != 1 || m.Answer[0].(*dns.TXT).Txt[0] != "Operated by Example Registry" || !m.Authoritative {
+		t.Errorf("Expected the about TXT record of the primary zone, got %v", m.Answer)
+	}
+	m = query("auth.example.org.", dns.TypeRP)
+	if len(m.Answer) != 1 || m.Answer[0].(*dns.RP).Mbox != "abuse.example.org." || m.Answer[0].(*dns.RP).Txt != "_about.auth.example.org." {
+		t.Errorf("Expected the RP record of the primary zone pointing to the about TXT record, got %v", m.Answer)
+	}
+	m = query("_about.acme.example.net.", dns.TypeHINFO)
+	if len(m.Answer) != 1 || m.Answer[0].(*dns.HINFO).Cpu != "acme-dns" || m.Answer[0].(*dns.HINFO).Os != "linux" {
+		t.Errorf("Expected the HINFO record of the further zone, got %v", m.Answer)
+	}
+	m = query("acme.example.net.", dns.TypeRP)
+	if len(m.Answer) != 1 || m.Answer[0].(*dns.RP).Txt != "." {
+		t.Errorf("Expected the RP record of the further zone without TXT records, got %v", m.Answer)
+	}
+	m = query("_about.acme.example.net.", dns.TypeTXT)
+	if m.Rcode != dns.RcodeSuccess || len(m.Answer) != 0 {
+		t.Errorf("Expected an empty answer for the TXT records of the further zone, got %s %v", dns.RcodeToString[m.Rcode], m.Answer)
+	}
+}
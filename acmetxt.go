@@ -3,6 +3,7 @@ package main
 import (
 	"encoding/json"
 	"net"
+	"strconv"
 
 	"github.com/google/uuid"
 	log "github.com/sirupsen/logrus"
@@ -13,15 +14,173 @@ type ACMETxt struct {
 	Username uuid.UUID
 	Password string
 	ACMETxtPost
-	AllowFrom cidrslice
+	AllowFrom    cidrslice          `json:"allowfrom"`
+	Description  string             `json:"-"`
+	Webhooks     []string           `json:"-"`
+	AllowedTypes []string           `json:"-"`
+	Tags         []string           `json:"-"`
+	Origin       registrationOrigin `json:"-"`
+	Disabled     bool               `json:"-"`
+	// Canary registrations are decoys whose credentials must never be used
+	Canary bool `json:"-"`
+	// WildcardRecords serves the records of the subdomain for the names below it
+	WildcardRecords bool `json:"-"`
+	// SubnetAnswers replace the A and AAAA records for the clients in their subnets
+	SubnetAnswers []subnetAnswer `json:"-"`
+	// PassVersion is the credential version the password was hashed with
+	PassVersion int `json:"-"`
+	// LastUpdate is the time of the latest TXT update, zero if never updated
+	LastUpdate int64 `json:"-"`
+	// LastActive is the time of the latest authenticated update, zero if never updated
+	LastActive int64 `json:"-"`
 }
 
+// registrationOrigin records who created a registration and from where, and the
+// zone it was created in
+type registrationOrigin struct {
+	CreatedBy   string `json:"created_by"`
+	CreatedFrom string `json:"created_from"`
+	CreatedAt   int64  `json:"created_at"`
+	Zone        string `json:"zone"`
+}
+
+// registrationSettings holds the settings of a registration that the account holder may modify
+type registrationSettings struct {
+	AllowFrom    cidrslice `json:"allowfrom"`
+	Description  string    `json:"description"`
+	Webhooks     []string  `json:"webhooks"`
+	AllowedTypes []string  `json:"allowed_types"`
+	Tags         []string  `json:"tags"`
+	// WildcardRecords serves the records for the names below the subdomain as
+	// well, like a *.<subdomain> wildcard
+	WildcardRecords bool `json:"wildcard_records"`
+	// SubnetAnswers are the addresses answered to the clients in their subnets,
+	// given in the EDNS Client Subnet option of the queries
+	SubnetAnswers []subnetAnswer `json:"subnet_answers"`
+}
+
+// subnetAnswer is the A and AAAA records answered to the clients in the subnet
+type subnetAnswer struct {
+	Subnet string   `json:"subnet"`
+	A      []string `json:"a"`
+	AAAA   []string `json:"aaaa"`
+}
+
+// recordTypes lists the record types that can be updated through the API
+var recordTypes = []string{"txt", "a", "aaaa", "cname", "mx", "srv", "caa"}
+
 // ACMETxtPost holds the DNS part of the ACMETxt struct
 type ACMETxtPost struct {
 	Subdomain  string   `json:"subdomain"`
 	Value      string   `json:"txt"`
+	Slot       *int     `json:"slot,omitempty"`
 	AValues    []string `json:"a"`
 	AAAAValues []string `json:"aaaa"`
+	// Wildcard pins the TXT value to the slot of the wildcard name when true, or of
+	// the base name when false, so that the two tokens of a certificate for both
+	// never evict each other
+	Wildcard *bool `json:"wildcard,omitempty"`
+	// CNAME is the target name the subdomain is an alias of, it replaces the A and
+	// AAAA records and shadows the TXT values
+	CNAME string `json:"cname,omitempty"`
+	// MXValues replace the mail exchangers of the subdomain
+	MXValues []mxRecord `json:"mx,omitempty"`
+	// SRVValues replace the service locations of the subdomain
+	SRVValues []srvRecord `json:"srv,omitempty"`
+	// CAAValues replace the certification authority authorization of the subdomain
+	CAAValues []caaRecord `json:"caa,omitempty"`
+	// TTL is the TTL of the records of the types the update sets, the default
+	// TTL is used when not given
+	TTL int `json:"ttl,omitempty"`
+	// CorrelationID is an optional client supplied identifier stored with the TXT
+	// value, to trace the issuance run that published it
+	CorrelationID string `json:"correlation_id,omitempty"`
+	// Records replace the records of their types stored in the generic rr table
+	Records []genericRecord `json:"records,omitempty"`
+	// ClearA, ClearAAAA, ClearCNAME, ClearMX, ClearSRV and ClearCAA remove the
+	// records of the type of the subdomain
+	ClearA     bool `json:"clear_a,omitempty"`
+	ClearAAAA  bool `json:"clear_aaaa,omitempty"`
+	ClearCNAME bool `json:"clear_cname,omitempty"`
+	ClearMX    bool `json:"clear_mx,omitempty"`
+	ClearSRV   bool `json:"clear_srv,omitempty"`
+	ClearCAA   bool `json:"clear_caa,omitempty"`
+	// ClearRecords remove the records of the generic types of the subdomain
+	ClearRecords []string `json:"clear_records,omitempty"`
+	// ClearTXT blanks the TXT slots holding the values, for the deletions of
+	// dynamic DNS updates
+	ClearTXT []string `json:"-"`
+}
+
+// wildcardSlot returns the TXT slot of the token of the wildcard name or the base name
+func wildcardSlot(wildcard bool) int {
+	if wildcard {
+		return 1
+	}
+	return 0
+}
+
+// mxRecord is a mail exchanger of a subdomain
+type mxRecord struct {
+	Priority int    `json:"priority"`
+	Target   string `json:"target"`
+}
+
+// String returns the record data in the zone file format
+func (m mxRecord) String() string {
+	return strconv.Itoa(m.Priority) + " " + m.Target
+}
+
+// mxStrings returns the record data of the mail exchangers
+func mxStrings(mxs []mxRecord) []string {
+	var values []string
+	for _, mx := range mxs {
+		values = append(values, mx.String())
+	}
+	return values
+}
+
+// srvRecord is a location of the service of a subdomain
+type srvRecord struct {
+	Priority int    `json:"priority"`
+	Weight   int    `json:"weight"`
+	Port     int    `json:"port"`
+	Target   string `json:"target"`
+}
+
+// String returns the record data in the zone file format
+func (s srvRecord) String() string {
+	return strconv.Itoa(s.Priority) + " " + strconv.Itoa(s.Weight) + " " + strconv.Itoa(s.Port) + " " + s.Target
+}
+
+// caaRecord is a certification authority authorization property of a subdomain
+type caaRecord struct {
+	Flags int    `json:"flags"`
+	Tag   string `json:"tag"`
+	Value string `json:"value"`
+}
+
+// String returns the record data in the zone file format
+func (c caaRecord) String() string {
+	return strconv.Itoa(c.Flags) + " " + c.Tag + " " + strconv.Quote(c.Value)
+}
+
+// caaStrings returns the record data of the authorization properties
+func caaStrings(caas []caaRecord) []string {
+	var values []string
+	for _, caa := range caas {
+		values = append(values, caa.String())
+	}
+	return values
+}
+
+// srvStrings returns the record data of the service locations
+func srvStrings(srvs []srvRecord) []string {
+	var values []string
+	for _, srv := range srvs {
+		values = append(values, srv.String())
+	}
+	return values
 }
 
 // cidrslice is a list of allowed cidr ranges
@@ -53,6 +212,53 @@ func (c *cidrslice) ValidEntries() []string {
 	return valid
 }
 
+// Settings returns the modifiable settings of the registration
+func (a ACMETxt) Settings() registrationSettings {
+	return registrationSettings{
+		AllowFrom:       a.AllowFrom,
+		Description:     a.Description,
+		Webhooks:        a.Webhooks,
+		AllowedTypes:    a.AllowedTypes,
+		Tags:            a.Tags,
+		WildcardRecords: a.WildcardRecords,
+		SubnetAnswers:   a.SubnetAnswers,
+	}.normalized()
+}
+
+// normalized returns the settings with sanitized CIDR masks and empty lists instead of nil
+func (s registrationSettings) normalized() registrationSettings {
+	s.AllowFrom = cidrslice(s.AllowFrom.ValidEntries())
+	s.Webhooks = nonNilStrings(s.Webhooks)
+	s.AllowedTypes = nonNilStrings(s.AllowedTypes)
+	s.Tags = nonNilStrings(s.Tags)
+	s.SubnetAnswers = nonNilSubnetAnswers(s.SubnetAnswers)
+	return s
+}
+
+// nonNilSubnetAnswers returns the subnet answers with empty lists instead of nil
+func nonNilSubnetAnswers(answers []subnetAnswer) []subnetAnswer {
+	normalized := make([]subnetAnswer, 0, len(answers))
+	for _, answer := range answers {
+		answer.A = nonNilStrings(answer.A)
+		answer.AAAA = nonNilStrings(answer.AAAA)
+		normalized = append(normalized, answer)
+	}
+	return normalized
+}
+
+// allowedType checks if the registration may update records of the type
+func (a ACMETxt) allowedType(rtype string) bool {
+	if len(a.AllowedTypes) == 0 {
+		return true
+	}
+	for _, t := range a.AllowedTypes {
+		if t == rtype {
+			return true
+		}
+	}
+	return false
+}
+
 // Check if IP belongs to an allowed net
 func (a ACMETxt) allowedFrom(ip string) bool {
 	remoteIP := net.ParseIP(ip)
@@ -60,7 +266,7 @@ func (a ACMETxt) allowedFrom(ip string) bool {
 	if len(a.AllowFrom.ValidEntries()) == 0 {
 		return true
 	}
-	log.WithFields(log.Fields{"ip": remoteIP}).Debug("Checking if update is permitted from IP")
+	apiLog.WithFields(log.Fields{"ip": remoteIP}).Debug("Checking if update is permitted from IP")
 	for _, v := range a.AllowFrom.ValidEntries() {
 		_, vnet, _ := net.ParseCIDR(v)
 		if vnet.Contains(remoteIP) {
@@ -85,6 +291,16 @@ func (a ACMETxt) allowedFromList(ips []string) bool {
 	return false
 }
 
+// hasTag checks if the registration is tagged with the tag
+func (a ACMETxt) hasTag(tag string) bool {
+	for _, t := range a.Tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
 func newACMETxt() ACMETxt {
 	var a = ACMETxt{}
 	password := generatePassword(40)
@@ -93,3 +309,12 @@ func newACMETxt() ACMETxt {
 	a.Subdomain = uuid.New().String()
 	return a
 }
+
+// lastSeen returns the time of the latest authenticated update, or the creation
+// time for registrations never updated since
+func (a ACMETxt) lastSeen() int64 {
+	if a.LastActive > a.Origin.CreatedAt {
+		return a.LastActive
+	}
+	return a.Origin.CreatedAt
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// additionalTypes are the answer types that can have the addresses of their target
+// names added to the additional section, by their name in the configuration
+var additionalTypes = map[string]uint16{
+	"ns":  dns.TypeNS,
+	"mx":  dns.TypeMX,
+	"srv": dns.TypeSRV,
+}
+
+// parseAdditional returns the answer types of the additional option
+func parseAdditional(names []string) (map[uint16]bool, error) {
+	types := make(map[uint16]bool)
+	for _, name := range names {
+		qtype, ok := additionalTypes[strings.ToLower(name)]
+		if !ok {
+			return nil, fmt.Errorf("unknown additional section type %q, must be ns, mx or srv", name)
+		}
+		types[qtype] = true
+	}
+	return types, nil
+}
+
+// additionalTarget returns the target name of an answer record with addresses
+// to add, or an empty string
+func (d *DNSServer) additionalTarget(rr dns.RR) string {
+	if !d.Additional[rr.Header().Rrtype] {
+		return ""
+	}
+	switch rec := rr.(type) {
+	case *dns.NS:
+		return rec.Ns
+	case *dns.MX:
+		return rec.Mx
+	case *dns.SRV:
+		return rec.Target
+	}
+	return ""
+}
+
+// addAdditional adds the A and AAAA records this server has of the target names
+// in the answer and of the name servers in the authority section to the additional
+// section. Other records are never added.
+func (d *DNSServer) addAdditional(m *dns.Msg) {
+	seen := make(map[string]bool)
+	for _, section := range [][]dns.RR{m.Answer, m.Ns} {
+		for _, rr := range section {
+			target := strings.ToLower(d.additionalTarget(rr))
+			if target == "" || target == "." || seen[target] {
+				continue
+			}
+			seen[target] = true
+			m.Extra = append(m.Extra, d.addresses(target)...)
+		}
+	}
+}
+
+// addresses returns the A and AAAA records of the name served by this server,
+// from the static records, the published API addresses and the registered subdomains
+func (d *DNSServer) addresses(name string) []dns.RR {
+	var rrs []dns.RR
+	subdomain := d.isRegistrationName(name)
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		q := dns.Question{Name: name, Qtype: qtype, Qclass: dns.ClassINET}
+		if domain, ok := d.lookupStatic(name); ok {
+			for _, rr := range domain.Records {
+				if rr.Header().Rrtype == qtype {
+					rrs = append(rrs, rr)
+				}
+			}
+		}
+		rrs = append(rrs, d.APIRecords.Records(q)...)
+		if !subdomain {
+			continue
+		}
+		var dynamic []dns.RR
+		if qtype == dns.TypeA {
+			dynamic, _ = d.answerA(q)
+		} else {
+			dynamic, _ = d.answerAAAA(q)
+		}
+		rrs = append(rrs, dynamic...)
+	}
+	return rrs
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestParseAdditional(t *testing.T) {
+	types, err := parseAdditional([]string{"NS", "srv"})
+	if err != nil || len(types) != 2 || !types[dns.TypeNS] || !types[dns.TypeSRV] {
+		t.Errorf("Expected the NS and SRV types, got %v %v", types, err)
+	}
+	if _, err = parseAdditional([]string{"txt"}); err == nil {
+		t.Errorf("Expected an error for an unknown type")
+	}
+}
+
+func TestAdditionalSection(t *testing.T) {
+	reg, err := DB.Register(cidrslice{}, registrationOrigin{}, ACMETxtPost{AValues: []string{"192.0.2.25"}, AAAAValues: []string{"2001:db8::25"}})
+	if err != nil {
+		t.Fatalf("Registration failed, got error [%v]", err)
+	}
+	mailhost := reg.Subdomain + ".auth.example.org."
+	other, err := DB.Register(cidrslice{}, registrationOrigin{}, ACMETxtPost{MXValues: []mxRecord{{10, mailhost}, {20, "mail.example.net."}}})
+	if err != nil {
+		t.Fatalf("Registration failed, got error [%v]", err)
+	}
+	config := Config
+	config.General.Domain = "auth.example.org"
+	config.General.Nsname = "auth.example.org"
+	config.General.StaticRecords = []string{
+		"auth.example.org. A 198.51.100.1",
+		"auth.example.org. NS auth.example.org.",
+		"auth.example.org. NS ns2.example.net.",
+	}
+	server := NewDNSServer(DB, "", "udp", config.General.Domain)
+	server.ParseRecords(config)
+
+	query := func(name string, qtype uint16) *dns.Msg {
+		m := new(dns.Msg)
+		m.SetQuestion(name, qtype)
+		server.readQuery(m)
+		return m
+	}
+	for i, test := range []struct {
+		additional []string
+		name       string
+		qtype      uint16
+		extra      []string
+	}{
+		{nil, "auth.example.org.", dns.TypeNS, nil},
+		{[]string{"ns"}, "auth.example.org.", dns.TypeNS, []string{"198.51.100.1"}},
+		{[]string{"ns"}, other.Subdomain + ".auth.example.org.", dns.TypeMX, nil},
+		// Only the addresses of the targets served here are added
+		{[]string{"mx"}, other.Subdomain + ".auth.example.org.", dns.TypeMX, []string{"192.0.2.25", "2001:db8::25"}},
+		{[]string{"ns", "mx"}, mailhost, dns.TypeA, nil},
+	} {
+		server.Additional, _ = parseAdditional(test.additional)
+		m := query(test.name, test.qtype)
+		var extra []string
+		for _, rr := range m.Extra {
+			switch rec := rr.(type) {
+			case *dns.A:
+				extra = append(extra, rec.A.String())
+			case *dns.AAAA:
+				extra = append(extra, rec.AAAA.String())
+			default:
+				extra = append(extra, rr.String())
+			}
+		}
+		if len(m.Answer) == 0 || !sameRecords(extra, test.extra) {
+			t.Errorf("Test %d: Expected the additional records %v, got %v with the answer %v", i, test.extra, extra, m.Answer)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+)
+
+var (
+	// errAdminExists is returned when creating an admin with a username already in use
+	errAdminExists = errors.New("admin already exists")
+	// errAdminNotFound is returned for operations on an admin that doesn't exist
+	errAdminNotFound = errors.New("admin not found")
+)
+
+// validAdminUsername checks that the username can be used with HTTP basic auth
+func validAdminUsername(username string) bool {
+	return username != "" && len(username) <= 64 && !strings.ContainsAny(username, ": \t\r\n")
+}
+
+// runAdminCommand runs the admin subcommands add, del, list and passwd. The password
+// of add and passwd is read from in with -password-stdin, or generated and written
+// to out otherwise.
+func runAdminCommand(db database, args []string, in io.Reader, out io.Writer) error {
+	usage := errors.New("usage: admin add|del|passwd [-password-stdin] <username> | admin list")
+	if len(args) == 0 {
+		return usage
+	}
+	if args[0] == "list" {
+		admins, err := db.ListAdmins()
+		if err != nil {
+			return err
+		}
+		for _, admin := range admins {
+			fmt.Fprintln(out, admin)
+		}
+		return nil
+	}
+	flags := flag.NewFlagSet("admin "+args[0], flag.ContinueOnError)
+	flags.SetOutput(out)
+	passwordStdin := flags.Bool("password-stdin", false, "read the password from the standard input")
+	if err := flags.Parse(args[1:]); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return usage
+	}
+	username := flags.Arg(0)
+	switch args[0] {
+	case "add", "passwd":
+		if !validAdminUsername(username) {
+			return fmt.Errorf("invalid admin username %q", username)
+		}
+		password, generated, err := adminPassword(*passwordStdin, in)
+		if err != nil {
+			return err
+		}
+		if args[0] == "add" {
+			err = db.CreateAdmin(username, password)
+		} else {
+			err = db.UpdateAdminPassword(username, password)
+		}
+		if err != nil {
+			return err
+		}
+		if generated {
+			fmt.Fprintf(out, "Password for %s: %s\n", username, password)
+		}
+		return nil
+	case "del":
+		return db.DeleteAdmin(username)
+	}
+	return usage
+}
+
+// adminPassword reads the password from the first line of in, or generates one
+func adminPassword(fromStdin bool, in io.Reader) (string, bool, error) {
+	if !fromStdin {
+		return generatePassword(40), true, nil
+	}
+	line, err := bufio.NewReader(in).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return "", false, err
+	}
+	password := strings.TrimRight(line, "\r\n")
+	if len(password) < 8 {
+		return "", false, errors.New("the password must be at least 8 characters")
+	}
+	return password, false, nil
+}
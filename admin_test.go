@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func testAdminCommand(t *testing.T, db database) {
+	var out bytes.Buffer
+	run := func(input string, args ...string) error {
+		out.Reset()
+		return runAdminCommand(db, args, strings.NewReader(input), &out)
+	}
+	if err := run("", "add", "carol"); err != nil {
+		t.Fatalf("Could not add admin: %v", err)
+	}
+	generated := strings.TrimSpace(strings.TrimPrefix(out.String(), "Password for carol: "))
+	if pass, _, err := db.GetAdminPassByUsername("carol"); err != nil || !correctPassword(generated, pass) {
+		t.Errorf("Expected the generated password to be stored, got error %v", err)
+	}
+	if err := run("", "add", "carol"); err != errAdminExists {
+		t.Errorf("Expected errAdminExists, got %v", err)
+	}
+	if err := run("", "add", "bad:name"); err == nil {
+		t.Errorf("Expected an error for an invalid username")
+	}
+	if err := run("correct horse battery staple\n", "add", "-password-stdin", "dave"); err != nil {
+		t.Fatalf("Could not add admin: %v", err)
+	}
+	if out.Len() != 0 {
+		t.Errorf("Expected no output for a password from stdin, got %q", out.String())
+	}
+	if err := run("", "list"); err != nil || !strings.Contains(out.String(), "carol\ndave\n") {
+		t.Errorf("Expected the admins to be listed, got %q, %v", out.String(), err)
+	}
+
+	if err := run("short\n", "passwd", "-password-stdin", "dave"); err == nil {
+		t.Errorf("Expected an error for a short password")
+	}
+	if err := run("new password for dave\n", "passwd", "-password-stdin", "dave"); err != nil {
+		t.Errorf("Could not change password: %v", err)
+	}
+	if pass, _, _ := db.GetAdminPassByUsername("dave"); !correctPassword("new password for dave", pass) {
+		t.Errorf("Expected the password to be changed")
+	}
+	if err := run("", "passwd", "nobody"); err != errAdminNotFound {
+		t.Errorf("Expected errAdminNotFound, got %v", err)
+	}
+
+	for _, username := range []string{"carol", "dave"} {
+		if err := run("", "del", username); err != nil {
+			t.Errorf("Could not delete admin: %v", err)
+		}
+	}
+	if err := run("", "del", "carol"); err != errAdminNotFound {
+		t.Errorf("Expected errAdminNotFound, got %v", err)
+	}
+	if _, _, err := db.GetAdminPassByUsername("carol"); err == nil {
+		t.Errorf("Expected the admin to be deleted")
+	}
+	if err := run("", "rename", "carol"); err == nil {
+		t.Errorf("Expected a usage error for an unknown subcommand")
+	}
+}
+
+func TestAdminCommand(t *testing.T) {
+	testAdminCommand(t, DB)
+}
+
+func TestAdminCommandMemory(t *testing.T) {
+	db, err := openBackend("memory", "")
+	if err != nil {
+		t.Fatalf("Could not open the memory backend: %v", err)
+	}
+	defer db.Close()
+	testAdminCommand(t, db)
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/google/uuid"
+	"github.com/julienschmidt/httprouter"
+	log "github.com/sirupsen/logrus"
+)
+
+// allowFromRequest is the body of the requests replacing the allowfrom list
+type allowFromRequest struct {
+	AllowFrom *cidrslice `json:"allowfrom"`
+}
+
+// webAllowFromPost replaces the allowfrom list of the authenticated registration.
+// The request must still come from an allowed address.
+func webAllowFromPost(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	user, ok := r.Context().Value(ACMETxtKey).(ACMETxt)
+	if !ok {
+		apiLog.WithFields(log.Fields{"error": "context"}).Error("Context error")
+		WriteJsonResponse(w, http.StatusInternalServerError, jsonError("context_error"))
+		return
+	}
+	replaceAllowFrom(w, r, user, "")
+}
+
+// webAdminAllowFromPost replaces the allowfrom list of any registration, for the
+// clients locked out by a change of their addresses
+func webAdminAllowFromPost(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	username, err := uuid.Parse(p.ByName("username"))
+	if err != nil {
+		WriteJsonResponse(w, http.StatusNotFound, jsonError("not_found"))
+		return
+	}
+	user, err := DB.GetByUsername(username)
+	if err != nil {
+		apiLog.WithFields(log.Fields{"error": err.Error(), "user": username.String()}).Debug("Registration not found")
+		WriteJsonResponse(w, http.StatusNotFound, jsonError("not_found"))
+		return
+	}
+	admin, _ := r.Context().Value(AdminKey).(string)
+	replaceAllowFrom(w, r, user, admin)
+}
+
+// replaceAllowFrom validates the posted allowfrom list like at registration, and
+// stores it in place of the current one
+func replaceAllowFrom(w http.ResponseWriter, r *http.Request, user ACMETxt, admin string) {
+	var req allowFromRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		WriteJsonResponse(w, http.StatusBadRequest, jsonFieldErrors("malformed_json_payload", decodeErrorDetails(err)))
+		return
+	}
+	if req.AllowFrom == nil {
+		WriteJsonResponse(w, http.StatusBadRequest, jsonFieldErrors("bad_request", []fieldError{{"allowfrom", "is required, an empty list allows all addresses"}}))
+		return
+	}
+	if details := validateAllowFrom(*req.AllowFrom); len(details) > 0 {
+		WriteJsonResponse(w, http.StatusBadRequest, jsonFieldErrors("invalid_allowfrom_cidr", details))
+		return
+	}
+	settings := user.Settings()
+	previous := allowFromList(settings.AllowFrom)
+	settings.AllowFrom = *req.AllowFrom
+	settings = settings.normalized()
+	if err := DB.UpdateSettings(user.Username, settings); err != nil {
+		apiLog.WithFields(log.Fields{"error": err.Error()}).Debug("Error while trying to update allowfrom")
+		WriteJsonResponse(w, http.StatusInternalServerError, jsonError("db_error"))
+		return
+	}
+	apiLog.WithFields(log.Fields{"user": user.Username.String(), "allowfrom": settings.AllowFrom.JSON(), "previous": previous, "admin": admin}).Info("Allowfrom list replaced")
+	// The trail keeps both lists, for tracing who could update the records when
+	auditRequest(r, "allowfrom_change", user.Subdomain, previous+" -> "+allowFromList(settings.AllowFrom))
+	resp, _ := json.Marshal(struct {
+		AllowFrom []string `json:"allowfrom"`
+	}{nonNilStrings(settings.AllowFrom.ValidEntries())})
+	WriteJsonResponse(w, http.StatusOK, resp)
+}
+
+// allowFromList returns the valid entries of the allowfrom list as a JSON array
+func allowFromList(c cidrslice) string {
+	out, _ := json.Marshal(nonNilStrings(c.ValidEntries()))
+	return string(out)
+}
+
+// whoamiResponse is the answer of the whoami endpoint
+type whoamiResponse struct {
+	IP string `json:"ip"`
+	// Addresses are the addresses checked against the allowfrom list, all the ones
+	// of the configured header
+	Addresses    []string            `json:"addresses"`
+	Registration *whoamiRegistration `json:"registration,omitempty"`
+}
+
+// whoamiRegistration tells if the registration of the credentials allows the client
+type whoamiRegistration struct {
+	Subdomain string   `json:"subdomain"`
+	AllowFrom []string `json:"allowfrom"`
+	Allowed   bool     `json:"allowed"`
+}
+
+// webWhoami returns the address of the client as seen by acme-dns, for debugging
+// allowfrom lists. With the credentials of a registration it also tells if the
+// address is allowed by its allowfrom list, without refusing the request if not.
+func webWhoami(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	resp := whoamiResponse{IP: getRequestIP(r), Addresses: []string{getRequestIP(r)}}
+	if Config.API.UseHeader {
+		resp.Addresses = getIPListFromHeader(r.Header.Get(Config.API.HeaderName))
+	}
+	if r.Header.Get("X-Api-User") != "" || r.Header.Get("X-Api-Key") != "" {
+		user, err := getUserFromRequest(r)
+		if err == errVerificationBusy {
+			writeVerificationBusy(w)
+			return
+		}
+		if err == errCanaryUsed {
+			authFailed(r, "", "canary_used")
+			WriteJsonResponse(w, http.StatusForbidden, jsonError("forbidden"))
+			return
+		}
+		if err != nil {
+			authFailed(r, "", "bad_credentials")
+			WriteJsonResponse(w, http.StatusUnauthorized, jsonError("unauthorized"))
+			return
+		}
+		resp.Registration = &whoamiRegistration{user.Subdomain, nonNilStrings(user.AllowFrom.ValidEntries()), updateAllowedFromIP(r, user)}
+	}
+	out, _ := json.Marshal(resp)
+	WriteJsonResponse(w, http.StatusOK, out)
+}
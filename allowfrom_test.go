@@ -0,0 +1,138 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestApiAllowFrom(t *testing.T) {
+	_ = setupRouter(false, false)
+	Audit, _ = newAuditLog(DB, "")
+	defer func() { Audit = nil }()
+	api := httprouter.New()
+	api.POST("/allowfrom", AuthForAccount(webAllowFromPost))
+	api.POST("/admin/registrations/:username/allowfrom", AuthForAdmin(webAdminAllowFromPost))
+	server := httptest.NewServer(api)
+	defer server.Close()
+	e := getExpect(t, server)
+
+	user, err := DB.Register(cidrslice{"10.0.0.0/8"}, registrationOrigin{}, ACMETxtPost{})
+	if err != nil {
+		t.Fatalf("Could not create new user, got error [%v]", err)
+	}
+	e.POST("/allowfrom").
+		WithJSON(map[string]interface{}{"allowfrom": []string{"192.0.2.0/24", "not a cidr"}}).
+		WithHeader("X-Api-User", user.Username.String()).
+		WithHeader("X-Api-Key", user.Password).
+		WithHeader("X-Forwarded-For", "10.1.2.3").
+		Expect().
+		Status(http.StatusBadRequest).
+		JSON().Object().
+		ValueEqual("error", "invalid_allowfrom_cidr")
+	e.POST("/allowfrom").
+		WithJSON(map[string]interface{}{}).
+		WithHeader("X-Api-User", user.Username.String()).
+		WithHeader("X-Api-Key", user.Password).
+		WithHeader("X-Forwarded-For", "10.1.2.3").
+		Expect().
+		Status(http.StatusBadRequest)
+	e.POST("/allowfrom").
+		WithJSON(map[string]interface{}{"allowfrom": []string{"192.0.2.0/24"}}).
+		WithHeader("X-Api-User", user.Username.String()).
+		WithHeader("X-Api-Key", user.Password).
+		WithHeader("X-Forwarded-For", "10.1.2.3").
+		Expect().
+		Status(http.StatusOK).
+		JSON().Object().
+		ValueEqual("allowfrom", []string{"192.0.2.0/24"})
+	// The old addresses are locked out now
+	e.POST("/allowfrom").
+		WithJSON(map[string]interface{}{"allowfrom": []string{"10.0.0.0/8"}}).
+		WithHeader("X-Api-User", user.Username.String()).
+		WithHeader("X-Api-Key", user.Password).
+		WithHeader("X-Forwarded-For", "10.1.2.3").
+		Expect().
+		Status(http.StatusForbidden)
+
+	hash, _ := bcrypt.GenerateFromPassword([]byte("hunter2"), 10)
+	if _, err := DB.(*acmedb).DB.Exec("INSERT INTO admins (Username, Password) values($1, $2)", "heidi", string(hash)); err != nil {
+		t.Fatalf("Could not create admin user [%v]", err)
+	}
+	e.POST("/admin/registrations/{username}/allowfrom", "00000000-0000-0000-0000-000000000000").
+		WithBasicAuth("heidi", "hunter2").
+		WithJSON(map[string]interface{}{"allowfrom": []string{}}).
+		Expect().
+		Status(http.StatusNotFound)
+	e.POST("/admin/registrations/{username}/allowfrom", user.Username.String()).
+		WithBasicAuth("heidi", "hunter2").
+		WithJSON(map[string]interface{}{"allowfrom": []string{}}).
+		Expect().
+		Status(http.StatusOK).
+		JSON().Object().
+		ValueEqual("allowfrom", []string{})
+	stored, err := DB.GetByUsername(user.Username)
+	if err != nil {
+		t.Fatalf("Could not get user: %v", err)
+	}
+	if len(stored.AllowFrom) != 0 || !stored.allowedFrom("10.1.2.3") {
+		t.Errorf("Expected the admin to clear the allowfrom list, got %v", stored.AllowFrom)
+	}
+	events, err := DB.GetAuditEvents(user.Subdomain, 10)
+	// The changes surround the refused attempt from the old addresses
+	if err != nil || len(events) != 3 {
+		t.Fatalf("Expected the two changes in the audit trail, got %v and error %v", events, err)
+	}
+	if events[0].Detail != `["192.0.2.0/24"] -> []` || events[0].Actor != "heidi" || events[2].Detail != `["10.0.0.0/8"] -> ["192.0.2.0/24"]` || events[2].Actor != user.Username.String() {
+		t.Errorf("Unexpected audit events %+v", events)
+	}
+}
+
+func TestApiWhoami(t *testing.T) {
+	_ = setupRouter(false, false)
+	api := httprouter.New()
+	api.GET("/whoami", webWhoami)
+	server := httptest.NewServer(api)
+	defer server.Close()
+	e := getExpect(t, server)
+
+	user, err := DB.Register(cidrslice{"10.0.0.0/8"}, registrationOrigin{}, ACMETxtPost{})
+	if err != nil {
+		t.Fatalf("Could not create new user, got error [%v]", err)
+	}
+	whoami := e.GET("/whoami").
+		WithHeader("X-Forwarded-For", "192.0.2.7, 10.1.2.3").
+		Expect().
+		Status(http.StatusOK).
+		JSON().Object()
+	whoami.ValueEqual("ip", "192.0.2.7")
+	whoami.ValueEqual("addresses", []string{"192.0.2.7", "10.1.2.3"})
+	whoami.NotContainsKey("registration")
+
+	e.GET("/whoami").
+		WithHeader("X-Api-User", user.Username.String()).
+		WithHeader("X-Api-Key", user.Password).
+		WithHeader("X-Forwarded-For", "192.0.2.7").
+		Expect().
+		Status(http.StatusOK).
+		JSON().Object().
+		Value("registration").Object().
+		ValueEqual("subdomain", user.Subdomain).
+		ValueEqual("allowfrom", []string{"10.0.0.0/8"}).
+		ValueEqual("allowed", false)
+	e.GET("/whoami").
+		WithHeader("X-Api-User", user.Username.String()).
+		WithHeader("X-Api-Key", user.Password).
+		WithHeader("X-Forwarded-For", "10.1.2.3").
+		Expect().
+		Status(http.StatusOK).
+		JSON().Path("$.registration.allowed").Equal(true)
+	e.GET("/whoami").
+		WithHeader("X-Api-User", user.Username.String()).
+		WithHeader("X-Api-Key", "wrongpasswordwrongpasswordwrongpassword1234").
+		Expect().
+		Status(http.StatusUnauthorized)
+}
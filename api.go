@@ -1,12 +1,14 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"io"
-	"net"
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/julienschmidt/httprouter"
 	log "github.com/sirupsen/logrus"
@@ -19,40 +21,113 @@ type RegResponse struct {
 	Fulldomain string   `json:"fulldomain"`
 	Subdomain  string   `json:"subdomain"`
 	Allowfrom  []string `json:"allowfrom"`
+	Txt        string   `json:"txt,omitempty"`
+	Slot       *int     `json:"slot,omitempty"`
+	A          []string `json:"a,omitempty"`
+	AAAA       []string `json:"aaaa,omitempty"`
+	registrationOrigin
+}
+
+// adminRegistration is a struct for a registration in the admin query response JSON
+type adminRegistration struct {
+	Username    string   `json:"username"`
+	Fulldomain  string   `json:"fulldomain"`
+	Subdomain   string   `json:"subdomain"`
+	Allowfrom   []string `json:"allowfrom"`
+	Description string   `json:"description"`
+	Tags        []string `json:"tags"`
+	Disabled    bool     `json:"disabled"`
+	Canary      bool     `json:"canary"`
+	LastUpdate  int64    `json:"last_update"`
+	LastActive  int64    `json:"last_active"`
+	registrationOrigin
+}
+
+func newAdminRegistration(reg ACMETxt) adminRegistration {
+	reg.Origin.Zone = registrationZone(reg)
+	return adminRegistration{reg.Username.String(), fullDomain(reg), reg.Subdomain, nonNilStrings(reg.AllowFrom.ValidEntries()), reg.Description, nonNilStrings(reg.Tags), reg.Disabled, reg.Canary, reg.LastUpdate, reg.LastActive, reg.Origin}
 }
 
 func webRegisterPost(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 	var err error
 	aTXT := ACMETxt{}
+	// The zone to register in, one of the served zones
+	var requested struct {
+		Zone string `json:"zone"`
+	}
 	bdata, _ := io.ReadAll(r.Body)
 	if len(bdata) > 0 {
 		err = json.Unmarshal(bdata, &aTXT)
+		if err == nil {
+			err = json.Unmarshal(bdata, &requested)
+		}
 		if err != nil {
-			WriteJsonResponse(w, http.StatusBadRequest, jsonError("malformed_json_payload"))
+			WriteJsonResponse(w, http.StatusBadRequest, jsonFieldErrors("malformed_json_payload", decodeErrorDetails(err)))
 			return
 		}
 	}
 
 	// Fail with malformed CIDR mask in allowfrom
-	err = aTXT.AllowFrom.isValid()
-	if err != nil {
-		WriteJsonResponse(w, http.StatusBadRequest, jsonError("invalid_allowfrom_cidr"))
+	details := validateAllowFrom(aTXT.AllowFrom)
+	if len(details) > 0 {
+		WriteJsonResponse(w, http.StatusBadRequest, jsonFieldErrors("invalid_allowfrom_cidr", details))
 		return
 	}
 
+	// Optional initial record values
+	code, details := validateRecordValues(&aTXT.ACMETxtPost)
+	if code != "" {
+		WriteJsonResponse(w, http.StatusBadRequest, jsonFieldErrors(code, details))
+		return
+	}
+
+	if requested.Zone != "" {
+		if _, ok := assignZone(requested.Zone); !ok {
+			WriteJsonResponse(w, http.StatusBadRequest, jsonFieldErrors("unknown_zone", []fieldError{{"zone", "must be one of the served zones"}}))
+			return
+		}
+	}
+
+	if Config.API.MaxRegistrations > 0 {
+		registrationCapMutex.Lock()
+		defer registrationCapMutex.Unlock()
+		reached, err := registrationCapReached()
+		if err != nil {
+			apiLog.WithFields(log.Fields{"error": err.Error()}).Error("Could not count registrations")
+			WriteJsonResponse(w, http.StatusInternalServerError, jsonError("db_error"))
+			return
+		}
+		if reached {
+			WriteJsonResponse(w, http.StatusServiceUnavailable, jsonError("registration_limit_reached"))
+			return
+		}
+	}
+
 	// Create new user
 	var nu ACMETxt
-	nu, err = DB.Register(aTXT.AllowFrom)
+	admin, _ := r.Context().Value(AdminKey).(string)
+	zone, _ := assignZone(requested.Zone)
+	origin := registrationOrigin{CreatedBy: admin, CreatedFrom: getRequestIP(r), Zone: zone}
+	nu, err = DB.Register(aTXT.AllowFrom, origin, aTXT.ACMETxtPost)
+	if err == errDatabaseBusy {
+		w.Header().Set("Retry-After", "1")
+		WriteJsonResponse(w, http.StatusServiceUnavailable, jsonError("database_busy"))
+		return
+	}
 	if err != nil {
-		log.WithFields(log.Fields{"error": err.Error()}).Debug("Error in registration")
+		apiLog.WithFields(log.Fields{"error": err.Error()}).Debug("Error in registration")
 		WriteJsonResponse(w, http.StatusInternalServerError, jsonError(fmt.Sprintf("%v", err)))
+		return
 	}
-	log.WithFields(log.Fields{"user": nu.Username.String()}).Debug("Created new user")
-	regStruct := RegResponse{nu.Username.String(), nu.Password, nu.Subdomain + "." + Config.General.Domain, nu.Subdomain, nu.AllowFrom.ValidEntries()}
+	apiLog.WithFields(log.Fields{"user": nu.Username.String(), "created_by": nu.Origin.CreatedBy, "created_from": nu.Origin.CreatedFrom}).Debug("Created new user")
+	runHooks(webhookEvent{"register", nu.Subdomain, nu.Value, nu.AValues, nu.AAAAValues, time.Now().Unix(), nu.CorrelationID, registrationZone(nu)})
+	auditRequest(r, "register", nu.Subdomain, "")
+	ZoneSerial.Bump("register", nu.Subdomain)
+	regStruct := RegResponse{nu.Username.String(), nu.Password, fullDomain(nu), nu.Subdomain, nu.AllowFrom.ValidEntries(), nu.Value, nu.Slot, nu.AValues, nu.AAAAValues, nu.Origin}
 	var reg []byte
 	reg, err = json.Marshal(regStruct)
 	if err != nil {
-		log.WithFields(log.Fields{"error": "json"}).Debug("Could not marshal JSON")
+		apiLog.WithFields(log.Fields{"error": "json"}).Debug("Could not marshal JSON")
 		WriteJsonResponse(w, http.StatusInternalServerError, jsonError("json_error"))
 	}
 	WriteJsonResponse(w, http.StatusCreated, reg)
@@ -62,60 +137,246 @@ func webUpdatePost(w http.ResponseWriter, r *http.Request, _ httprouter.Params)
 	// Get user
 	a, ok := r.Context().Value(ACMETxtKey).(ACMETxt)
 	if !ok {
-		log.WithFields(log.Fields{"error": "context"}).Error("Context error")
+		apiLog.WithFields(log.Fields{"error": "context"}).Error("Context error")
 	}
-	// NOTE: An invalid subdomain should not happen - the auth handler should
-	// reject POSTs with an invalid subdomain before this handler. Reject any
-	// invalid subdomains anyway as a matter of caution.
-	if !validSubdomain(a.Subdomain) {
-		log.WithFields(log.Fields{"error": "subdomain", "subdomain": a.Subdomain, "txt": a.Value}).Debug("Bad update data")
-		WriteJsonResponse(w, http.StatusBadRequest, jsonError("bad_subdomain"))
+	code, details := validateUpdatePost(&a.ACMETxtPost)
+	if code != "" {
+		apiLog.WithFields(log.Fields{"error": code, "subdomain": a.Subdomain, "txt": a.Value, "a": a.AValues, "aaaa": a.AAAAValues}).Debug("Bad update data")
+		WriteJsonResponse(w, http.StatusBadRequest, jsonFieldErrors(code, details))
 		return
 	}
-	if a.Value == "" && len(a.AValues) < 1 && len(a.AAAAValues) < 1 {
-		WriteJsonResponse(w, http.StatusBadRequest, jsonError("bad_txt"))
+	details = disallowedTypeDetails(a)
+	if len(details) > 0 {
+		apiLog.WithFields(log.Fields{"error": "record_type_not_allowed", "subdomain": a.Subdomain}).Debug("Record type not allowed for the registration")
+		WriteJsonResponse(w, http.StatusForbidden, jsonFieldErrors("record_type_not_allowed", details))
 		return
 	}
-	if a.Value != "" && !validTXT(a.Value) {
-		log.WithFields(log.Fields{"error": "txt", "subdomain": a.Subdomain, "txt": a.Value}).Debug("Bad update data")
-		WriteJsonResponse(w, http.StatusBadRequest, jsonError("bad_txt"))
+	if err := DB.MarkActive(a.Username); err != nil {
+		apiLog.WithFields(log.Fields{"error": err.Error(), "subdomain": a.Subdomain}).Error("Could not update the last active time")
+	}
+	if isProtected(a.Subdomain) {
+		holdForApproval(w, a)
 		return
 	}
-	for i := range a.AValues {
-		var ip net.IP
-		ip = net.ParseIP(a.AValues[i])
-		if ip != nil {
-			ip = ip.To4()
-		}
-		if ip == nil {
-			log.WithFields(log.Fields{"error": "a", "subdomain": a.Subdomain, "a": a.AValues[i]}).Debug("Bad update data")
-			WriteJsonResponse(w, http.StatusBadRequest, jsonError("bad_a"))
+	updated, err := DB.Update(a.ACMETxtPost)
+	if err == errDatabaseBusy {
+		w.Header().Set("Retry-After", "1")
+		WriteJsonResponse(w, http.StatusServiceUnavailable, jsonError("database_busy"))
+		return
+	}
+	if err != nil {
+		apiLog.WithFields(log.Fields{"error": err.Error()}).Debug("Error while trying to update record")
+		WriteJsonResponse(w, http.StatusInternalServerError, jsonError("db_error"))
+		return
+	}
+	apiLog.WithFields(log.Fields{"subdomain": a.Subdomain, "txt": a.Value, "correlation_id": a.CorrelationID}).Debug("TXT A AAAA updated")
+	event := webhookEvent{"update", a.Subdomain, a.Value, a.AValues, a.AAAAValues, time.Now().Unix(), a.CorrelationID, registrationZone(a)}
+	sendWebhooks(a.Webhooks, event)
+	runHooks(event)
+	ZoneSerial.Bump("update", a.Subdomain)
+	WriteJsonResponse(w, http.StatusOK, updateResponse(updated))
+	return
+}
+
+// updateResponse returns the response body of an applied update
+func updateResponse(a ACMETxtPost) []byte {
+	slot := ""
+	if a.Slot != nil {
+		slot = ", \"slot\": " + strconv.Itoa(*a.Slot)
+	}
+	// The CAA and generic record values may contain quotes
+	caa, _ := json.Marshal(strings.Join(caaStrings(a.CAAValues), ", "))
+	records, _ := json.Marshal(strings.Join(genericStrings(a.Records), ", "))
+	return []byte("{\"txt\": \"" + a.Value + "\"" + slot + ", \"a\": \"" + strings.Join(a.AValues, " ") + "\", \"aaaa\": \"" + strings.Join(a.AAAAValues, " ") + "\", \"cname\": \"" + a.CNAME + "\", \"mx\": \"" + strings.Join(mxStrings(a.MXValues), ", ") + "\", \"srv\": \"" + strings.Join(srvStrings(a.SRVValues), ", ") + "\", \"caa\": " + string(caa) + ", \"records\": " + string(records) + "}")
+}
+
+// webDeregister removes the authenticated registration with all the records of its subdomain
+func webDeregister(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	user, ok := r.Context().Value(ACMETxtKey).(ACMETxt)
+	if !ok {
+		apiLog.WithFields(log.Fields{"error": "context"}).Error("Context error")
+		WriteJsonResponse(w, http.StatusInternalServerError, jsonError("context_error"))
+		return
+	}
+	err := DB.DeleteRegistration(user.Username)
+	if err == errDatabaseBusy {
+		w.Header().Set("Retry-After", "1")
+		WriteJsonResponse(w, http.StatusServiceUnavailable, jsonError("database_busy"))
+		return
+	}
+	if err != nil {
+		apiLog.WithFields(log.Fields{"error": err.Error(), "subdomain": user.Subdomain}).Error("Error while deleting registration")
+		WriteJsonResponse(w, http.StatusInternalServerError, jsonError("db_error"))
+		return
+	}
+	apiLog.WithFields(log.Fields{"user": user.Username.String(), "subdomain": user.Subdomain}).Info("Registration deleted by the account holder")
+	ZoneSerial.Bump("deregister", user.Subdomain)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// webTXTSlots lists the TXT slots of the authenticated registration with the time
+// and the correlation ID of their latest update
+func webTXTSlots(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	user, ok := r.Context().Value(ACMETxtKey).(ACMETxt)
+	if !ok {
+		apiLog.WithFields(log.Fields{"error": "context"}).Error("Context error")
+		WriteJsonResponse(w, http.StatusInternalServerError, jsonError("context_error"))
+		return
+	}
+	slots, err := DB.GetTXTSlots(user.Subdomain)
+	if err != nil {
+		apiLog.WithFields(log.Fields{"error": err.Error(), "subdomain": user.Subdomain}).Error("Error while getting the TXT slots")
+		WriteJsonResponse(w, http.StatusInternalServerError, jsonError("db_error"))
+		return
+	}
+	if slots == nil {
+		slots = []txtSlot{}
+	}
+	out, _ := json.Marshal(slots)
+	WriteJsonResponse(w, http.StatusOK, out)
+}
+
+// webAdminRegistrations lists the registrations with their source attribution,
+// optionally filtered by the created_by and created_from query parameters
+func webAdminRegistrations(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	filter := registrationOrigin{
+		CreatedBy:   r.URL.Query().Get("created_by"),
+		CreatedFrom: r.URL.Query().Get("created_from"),
+	}
+	regs, err := DB.ListRegistrations(filter)
+	if err != nil {
+		apiLog.WithFields(log.Fields{"error": err.Error()}).Error("Error while listing registrations")
+		WriteJsonResponse(w, http.StatusInternalServerError, jsonError("db_error"))
+		return
+	}
+	resp := make([]adminRegistration, 0, len(regs))
+	for _, reg := range regs {
+		resp = append(resp, newAdminRegistration(reg))
+	}
+	out, err := json.Marshal(resp)
+	if err != nil {
+		apiLog.WithFields(log.Fields{"error": "json"}).Debug("Could not marshal JSON")
+		WriteJsonResponse(w, http.StatusInternalServerError, jsonError("json_error"))
+		return
+	}
+	WriteJsonResponse(w, http.StatusOK, out)
+}
+
+// webAdminInactive lists the registrations without authenticated updates during the
+// number of days given with the days query parameter, 90 by default
+func webAdminInactive(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	days := 90
+	if v := r.URL.Query().Get("days"); v != "" {
+		var err error
+		days, err = strconv.Atoi(v)
+		if err != nil || days < 0 {
+			WriteJsonResponse(w, http.StatusBadRequest, jsonFieldErrors("bad_request", []fieldError{{"days", "must be a non-negative number of days"}}))
 			return
 		}
-		a.AValues[i] = ip.String()
-	}
-	for i := range a.AAAAValues {
-		var ip6 net.IP
-		ip6 = net.ParseIP(a.AAAAValues[i])
-		if ip6 == nil || ip6.To4() != nil {
-			log.WithFields(log.Fields{"error": "aaaa", "subdomain": a.Subdomain, "aaaa": a.AAAAValues[i]}).Debug("Bad update data")
-			WriteJsonResponse(w, http.StatusBadRequest, jsonError("bad_aaaa"))
-			return
+	}
+	regs, err := DB.GetInactiveAccounts(time.Duration(days) * 24 * time.Hour)
+	if err != nil {
+		apiLog.WithFields(log.Fields{"error": err.Error()}).Error("Error while listing inactive registrations")
+		WriteJsonResponse(w, http.StatusInternalServerError, jsonError("db_error"))
+		return
+	}
+	resp := make([]adminRegistration, 0, len(regs))
+	for _, reg := range regs {
+		resp = append(resp, newAdminRegistration(reg))
+	}
+	out, _ := json.Marshal(resp)
+	WriteJsonResponse(w, http.StatusOK, out)
+}
+
+// disallowedTypeDetails returns details of the posted record types the registration may not update
+func disallowedTypeDetails(a ACMETxt) []fieldError {
+	var details []fieldError
+	if a.Value != "" && !a.allowedType("txt") {
+		details = append(details, fieldError{"txt", "record type not allowed for this registration"})
+	}
+	if (len(a.AValues) > 0 || a.ClearA) && !a.allowedType("a") {
+		details = append(details, fieldError{"a", "record type not allowed for this registration"})
+	}
+	if (len(a.AAAAValues) > 0 || a.ClearAAAA) && !a.allowedType("aaaa") {
+		details = append(details, fieldError{"aaaa", "record type not allowed for this registration"})
+	}
+	if (a.CNAME != "" || a.ClearCNAME) && !a.allowedType("cname") {
+		details = append(details, fieldError{"cname", "record type not allowed for this registration"})
+	}
+	if (len(a.MXValues) > 0 || a.ClearMX) && !a.allowedType("mx") {
+		details = append(details, fieldError{"mx", "record type not allowed for this registration"})
+	}
+	if (len(a.SRVValues) > 0 || a.ClearSRV) && !a.allowedType("srv") {
+		details = append(details, fieldError{"srv", "record type not allowed for this registration"})
+	}
+	if (len(a.CAAValues) > 0 || a.ClearCAA) && !a.allowedType("caa") {
+		details = append(details, fieldError{"caa", "record type not allowed for this registration"})
+	}
+	for _, t := range changedGenericTypes(a.ACMETxtPost) {
+		if rtype := strings.ToLower(t); !a.allowedType(rtype) {
+			details = append(details, fieldError{rtype, "record type not allowed for this registration"})
 		}
-		a.AAAAValues[i] = ip6.String()
 	}
-	err := DB.Update(a.ACMETxtPost)
+	return details
+}
+
+// webRegistrationPatch modifies the registration settings with a JSON Merge Patch (RFC 7396)
+func webRegistrationPatch(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	user, ok := r.Context().Value(ACMETxtKey).(ACMETxt)
+	if !ok {
+		apiLog.WithFields(log.Fields{"error": "context"}).Error("Context error")
+		WriteJsonResponse(w, http.StatusInternalServerError, jsonError("context_error"))
+		return
+	}
+	ctype := r.Header.Get("Content-Type")
+	if ctype != "" && !strings.HasPrefix(ctype, "application/merge-patch+json") && !strings.HasPrefix(ctype, "application/json") {
+		WriteJsonResponse(w, http.StatusUnsupportedMediaType, jsonError("unsupported_media_type"))
+		return
+	}
+	var patch interface{}
+	err := json.NewDecoder(r.Body).Decode(&patch)
 	if err != nil {
-		log.WithFields(log.Fields{"error": err.Error()}).Debug("Error while trying to update record")
+		WriteJsonResponse(w, http.StatusBadRequest, jsonFieldErrors("malformed_json_payload", decodeErrorDetails(err)))
+		return
+	}
+	if _, ok := patch.(map[string]interface{}); !ok {
+		WriteJsonResponse(w, http.StatusBadRequest, jsonFieldErrors("malformed_json_payload", []fieldError{{"", "merge patch must be a JSON object"}}))
+		return
+	}
+	// Apply the patch to the JSON representation of the current settings
+	var current interface{}
+	cur, _ := json.Marshal(user.Settings())
+	_ = json.Unmarshal(cur, &current)
+	patched, _ := json.Marshal(mergePatch(current, patch))
+	settings := registrationSettings{}
+	dec := json.NewDecoder(bytes.NewReader(patched))
+	dec.DisallowUnknownFields()
+	err = dec.Decode(&settings)
+	if err != nil {
+		WriteJsonResponse(w, http.StatusBadRequest, jsonFieldErrors("bad_settings", decodeErrorDetails(err)))
+		return
+	}
+	details := validateSettings(settings)
+	if len(details) > 0 {
+		WriteJsonResponse(w, http.StatusBadRequest, jsonFieldErrors("bad_settings", details))
+		return
+	}
+	settings = settings.normalized()
+	err = DB.UpdateSettings(user.Username, settings)
+	if err != nil {
+		apiLog.WithFields(log.Fields{"error": err.Error()}).Debug("Error while trying to update registration settings")
 		WriteJsonResponse(w, http.StatusInternalServerError, jsonError("db_error"))
 		return
 	}
-	log.WithFields(log.Fields{"subdomain": a.Subdomain, "txt": a.Value}).Debug("TXT A AAAA updated")
-	WriteJsonResponse(w, http.StatusOK, []byte("{\"txt\": \""+a.Value+"\", \"a\": \""+strings.Join(a.AValues, " ")+"\", \"aaaa\": \""+strings.Join(a.AAAAValues, " ")+"\"}"))
-	return
+	apiLog.WithFields(log.Fields{"user": user.Username.String()}).Debug("Registration settings updated")
+	resp, _ := json.Marshal(settings)
+	WriteJsonResponse(w, http.StatusOK, resp)
 }
 
 func WriteJsonResponse(w http.ResponseWriter, statusCode int, body []byte) {
+	if locale := w.Header().Get("Content-Language"); locale != "" && statusCode >= http.StatusBadRequest {
+		body = localizeError(locale, body)
+	}
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(statusCode)
 	_, _ = w.Write(body)
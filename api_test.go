@@ -13,6 +13,7 @@ import (
 	"github.com/google/uuid"
 	"github.com/julienschmidt/httprouter"
 	"github.com/rs/cors"
+	"golang.org/x/crypto/bcrypt"
 )
 
 // noAuth function to write ACMETxt model to context while not preforming any validation
@@ -66,12 +67,14 @@ func setupRouter(debug bool, noauth bool) http.Handler {
 	Config = dnscfg
 	c := cors.New(cors.Options{
 		AllowedOrigins:     Config.API.CorsOrigins,
-		AllowedMethods:     []string{"GET", "POST"},
+		AllowedMethods:     []string{"GET", "POST", "PATCH"},
 		OptionsPassthrough: false,
 		Debug:              Config.General.Debug,
 	})
 	api.POST("/register", webRegisterPost)
 	api.GET("/health", healthCheck)
+	api.PATCH("/registration", AuthForAccount(webRegistrationPatch))
+	api.GET("/admin/registrations", AuthForAdmin(webAdminRegistrations))
 	if noauth {
 		api.POST("/update", noAuth(webUpdatePost))
 	} else {
@@ -92,6 +95,7 @@ func TestApiRegister(t *testing.T) {
 		ContainsKey("subdomain").
 		ContainsKey("username").
 		ContainsKey("password").
+		ContainsKey("created_from").
 		NotContainsKey("error")
 
 	allowfrom := map[string][]interface{}{
@@ -178,9 +182,9 @@ func TestApiRegisterWithMockDB(t *testing.T) {
 	server := httptest.NewServer(router)
 	defer server.Close()
 	e := getExpect(t, server)
-	oldDb := DB.GetBackend()
+	oldDb := DB.(*acmedb).GetBackend()
 	db, mock, _ := sqlmock.New()
-	DB.SetBackend(db)
+	DB.(*acmedb).SetBackend(db)
 	defer db.Close()
 	mock.ExpectBegin()
 	mock.ExpectPrepare("INSERT INTO records").WillReturnError(errors.New("error"))
@@ -188,7 +192,7 @@ func TestApiRegisterWithMockDB(t *testing.T) {
 		Status(http.StatusInternalServerError).
 		JSON().Object().
 		ContainsKey("error")
-	DB.SetBackend(oldDb)
+	DB.(*acmedb).SetBackend(oldDb)
 }
 
 func TestApiUpdateWithInvalidSubdomain(t *testing.T) {
@@ -202,7 +206,7 @@ func TestApiUpdateWithInvalidSubdomain(t *testing.T) {
 	server := httptest.NewServer(router)
 	defer server.Close()
 	e := getExpect(t, server)
-	newUser, err := DB.Register(cidrslice{})
+	newUser, err := DB.Register(cidrslice{}, registrationOrigin{}, ACMETxtPost{})
 	if err != nil {
 		t.Errorf("Could not create new user, got error [%v]", err)
 	}
@@ -232,7 +236,7 @@ func TestApiUpdateWithInvalidTxt(t *testing.T) {
 	server := httptest.NewServer(router)
 	defer server.Close()
 	e := getExpect(t, server)
-	newUser, err := DB.Register(cidrslice{})
+	newUser, err := DB.Register(cidrslice{}, registrationOrigin{}, ACMETxtPost{})
 	if err != nil {
 		t.Errorf("Could not create new user, got error [%v]", err)
 	}
@@ -274,7 +278,7 @@ func TestApiUpdateWithCredentials(t *testing.T) {
 	server := httptest.NewServer(router)
 	defer server.Close()
 	e := getExpect(t, server)
-	newUser, err := DB.Register(cidrslice{})
+	newUser, err := DB.Register(cidrslice{}, registrationOrigin{}, ACMETxtPost{})
 	if err != nil {
 		t.Errorf("Could not create new user, got error [%v]", err)
 	}
@@ -307,9 +311,9 @@ func TestApiUpdateWithCredentialsMockDB(t *testing.T) {
 	server := httptest.NewServer(router)
 	defer server.Close()
 	e := getExpect(t, server)
-	oldDb := DB.GetBackend()
+	oldDb := DB.(*acmedb).GetBackend()
 	db, mock, _ := sqlmock.New()
-	DB.SetBackend(db)
+	DB.(*acmedb).SetBackend(db)
 	defer db.Close()
 	mock.ExpectBegin()
 	mock.ExpectPrepare("UPDATE records").WillReturnError(errors.New("error"))
@@ -319,7 +323,7 @@ func TestApiUpdateWithCredentialsMockDB(t *testing.T) {
 		Status(http.StatusInternalServerError).
 		JSON().Object().
 		ContainsKey("error")
-	DB.SetBackend(oldDb)
+	DB.(*acmedb).SetBackend(oldDb)
 }
 
 func TestApiManyUpdateWithCredentials(t *testing.T) {
@@ -330,20 +334,20 @@ func TestApiManyUpdateWithCredentials(t *testing.T) {
 	defer server.Close()
 	e := getExpect(t, server)
 	// User without defined CIDR masks
-	newUser, err := DB.Register(cidrslice{})
+	newUser, err := DB.Register(cidrslice{}, registrationOrigin{}, ACMETxtPost{})
 	if err != nil {
 		t.Errorf("Could not create new user, got error [%v]", err)
 	}
 
 	// User with defined allow from - CIDR masks, all invalid
 	// (httpexpect doesn't provide a way to mock remote ip)
-	newUserWithCIDR, err := DB.Register(cidrslice{"192.168.1.1/32", "invalid"})
+	newUserWithCIDR, err := DB.Register(cidrslice{"192.168.1.1/32", "invalid"}, registrationOrigin{}, ACMETxtPost{})
 	if err != nil {
 		t.Errorf("Could not create new user with CIDR, got error [%v]", err)
 	}
 
 	// Another user with valid CIDR mask to match the httpexpect default
-	newUserWithValidCIDR, err := DB.Register(cidrslice{"10.1.2.3/32", "invalid"})
+	newUserWithValidCIDR, err := DB.Register(cidrslice{"10.1.2.3/32", "invalid"}, registrationOrigin{}, ACMETxtPost{})
 	if err != nil {
 		t.Errorf("Could not create new user with a valid CIDR, got error [%v]", err)
 	}
@@ -388,17 +392,17 @@ func TestApiManyUpdateWithIpCheckHeaders(t *testing.T) {
 	// Use header checks from default header (X-Forwarded-For)
 	Config.API.UseHeader = true
 	// User without defined CIDR masks
-	newUser, err := DB.Register(cidrslice{})
+	newUser, err := DB.Register(cidrslice{}, registrationOrigin{}, ACMETxtPost{})
 	if err != nil {
 		t.Errorf("Could not create new user, got error [%v]", err)
 	}
 
-	newUserWithCIDR, err := DB.Register(cidrslice{"192.168.1.2/32", "invalid"})
+	newUserWithCIDR, err := DB.Register(cidrslice{"192.168.1.2/32", "invalid"}, registrationOrigin{}, ACMETxtPost{})
 	if err != nil {
 		t.Errorf("Could not create new user with CIDR, got error [%v]", err)
 	}
 
-	newUserWithIP6CIDR, err := DB.Register(cidrslice{"2002:c0a8::0/32"})
+	newUserWithIP6CIDR, err := DB.Register(cidrslice{"2002:c0a8::0/32"}, registrationOrigin{}, ACMETxtPost{})
 	if err != nil {
 		t.Errorf("Could not create a new user with IP6 CIDR, got error [%v]", err)
 	}
@@ -438,3 +442,333 @@ func TestApiHealthCheck(t *testing.T) {
 	e := getExpect(t, server)
 	e.GET("/health").Expect().Status(http.StatusOK)
 }
+
+func TestApiUpdateWithSlot(t *testing.T) {
+	validTxtData := "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"
+
+	router := setupRouter(false, false)
+	server := httptest.NewServer(router)
+	defer server.Close()
+	e := getExpect(t, server)
+	newUser, err := DB.Register(cidrslice{}, registrationOrigin{}, ACMETxtPost{})
+	if err != nil {
+		t.Errorf("Could not create new user, got error [%v]", err)
+	}
+	for _, test := range []struct {
+		slot   interface{}
+		status int
+	}{
+		{1, http.StatusOK},
+		{0, http.StatusOK},
+		{2, http.StatusBadRequest},
+		{-1, http.StatusBadRequest},
+	} {
+		updateJSON := map[string]interface{}{
+			"subdomain": newUser.Subdomain,
+			"txt":       validTxtData,
+			"slot":      test.slot}
+		response := e.POST("/update").
+			WithJSON(updateJSON).
+			WithHeader("X-Api-User", newUser.Username.String()).
+			WithHeader("X-Api-Key", newUser.Password).
+			WithHeader("X-Forwarded-For", "10.1.2.3").
+			Expect().
+			Status(test.status).
+			JSON().Object()
+		if test.status == http.StatusOK {
+			response.ValueEqual("slot", test.slot)
+		} else {
+			response.ValueEqual("error", "bad_slot")
+		}
+	}
+}
+
+func TestApiUpdateFieldErrors(t *testing.T) {
+	router := setupRouter(false, true)
+	server := httptest.NewServer(router)
+	defer server.Close()
+	e := getExpect(t, server)
+	updateJSON := map[string]interface{}{
+		"subdomain": "a097455b-52cc-4569-90c8-7a4b97c6eba8",
+		"txt":       "tooshortfortxt",
+		"a":         []string{"1.2.3.4", "not-an-ip"}}
+	response := e.POST("/update").
+		WithJSON(updateJSON).
+		Expect().
+		Status(http.StatusBadRequest).
+		JSON().Object().
+		ValueEqual("error", "bad_txt")
+	details := response.Value("details").Array()
+	details.Length().Equal(2)
+	details.Element(0).Object().ValueEqual("field", "txt")
+	details.Element(1).Object().ValueEqual("field", "a[1]")
+}
+
+func TestApiRegisterFieldErrors(t *testing.T) {
+	router := setupRouter(false, false)
+	server := httptest.NewServer(router)
+	defer server.Close()
+	e := getExpect(t, server)
+	allowfrom := map[string][]interface{}{
+		"allowfrom": []interface{}{"10.0.0.0/8", "1.2.3.4/33"}}
+	e.POST("/register").
+		WithJSON(allowfrom).
+		Expect().
+		Status(http.StatusBadRequest).
+		JSON().Object().
+		ValueEqual("error", "invalid_allowfrom_cidr").
+		Value("details").Array().Element(0).Object().
+		ValueEqual("field", "allowfrom[1]")
+
+	e.POST("/register").
+		WithBytes([]byte(`{"allowfrom": "1.1.1.1/32"}`)).
+		Expect().
+		Status(http.StatusBadRequest).
+		JSON().Object().
+		ValueEqual("error", "malformed_json_payload").
+		Value("details").Array().Element(0).Object().
+		ValueEqual("field", "allowfrom")
+}
+
+func TestApiRegistrationPatch(t *testing.T) {
+	router := setupRouter(false, false)
+	server := httptest.NewServer(router)
+	defer server.Close()
+	e := getExpect(t, server)
+	newUser, err := DB.Register(cidrslice{"10.1.2.3/32"}, registrationOrigin{}, ACMETxtPost{})
+	if err != nil {
+		t.Errorf("Could not create new user, got error [%v]", err)
+	}
+	patch := func(body string) *httpexpect.Response {
+		return e.PATCH("/registration").
+			WithBytes([]byte(body)).
+			WithHeader("Content-Type", "application/merge-patch+json").
+			WithHeader("X-Api-User", newUser.Username.String()).
+			WithHeader("X-Api-Key", newUser.Password).
+			WithHeader("X-Forwarded-For", "10.1.2.3").
+			Expect()
+	}
+
+	response := patch(`{"description": "web servers", "allowed_types": ["a"]}`).
+		Status(http.StatusOK).
+		JSON().Object()
+	response.ValueEqual("description", "web servers")
+	response.Value("allowed_types").Array().Elements("a")
+	response.Value("allowfrom").Array().Elements("10.1.2.3/32")
+
+	// TXT updates are no longer allowed for the registration
+	e.POST("/update").
+		WithJSON(map[string]interface{}{"subdomain": newUser.Subdomain, "txt": "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"}).
+		WithHeader("X-Api-User", newUser.Username.String()).
+		WithHeader("X-Api-Key", newUser.Password).
+		WithHeader("X-Forwarded-For", "10.1.2.3").
+		Expect().
+		Status(http.StatusForbidden).
+		JSON().Object().
+		ValueEqual("error", "record_type_not_allowed")
+
+	response = patch(`{"allowed_types": null, "allowfrom": ["10.1.2.0/24", "::1/128"]}`).
+		Status(http.StatusOK).
+		JSON().Object()
+	response.ValueEqual("description", "web servers")
+	response.Value("allowed_types").Array().Empty()
+	response.Value("allowfrom").Array().Elements("10.1.2.0/24", "::1/128")
+
+	patch(`{"allowfrom": ["invalid"]}`).
+		Status(http.StatusBadRequest).
+		JSON().Object().
+		ValueEqual("error", "bad_settings")
+	patch(`{"subdomain": "something-else"}`).
+		Status(http.StatusBadRequest).
+		JSON().Object().
+		ValueEqual("error", "bad_settings")
+	patch(`{"allowed_types": ["ptr"]}`).
+		Status(http.StatusBadRequest).
+		JSON().Object().
+		ValueEqual("error", "bad_settings")
+	patch(`{"webhooks": ["https://hooks.example.org/acme"]}`).
+		Status(http.StatusBadRequest).
+		JSON().Object().
+		ValueEqual("error", "bad_settings")
+	patch(`["not", "an", "object"]`).
+		Status(http.StatusBadRequest)
+
+	e.PATCH("/registration").
+		WithBytes([]byte(`{"description": "hijacked"}`)).
+		WithHeader("X-Api-User", newUser.Username.String()).
+		WithHeader("X-Api-Key", "xxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxx").
+		Expect().
+		Status(http.StatusUnauthorized)
+}
+
+func TestApiAdminRegistrations(t *testing.T) {
+	_ = setupRouter(false, false)
+	api := httprouter.New()
+	api.POST("/register", AuthForRegister(webRegisterPost))
+	api.GET("/admin/registrations", AuthForAdmin(webAdminRegistrations))
+	server := httptest.NewServer(api)
+	defer server.Close()
+	e := getExpect(t, server)
+
+	hash, _ := bcrypt.GenerateFromPassword([]byte("hunter2"), 10)
+	for _, admin := range []string{"alice", "bob"} {
+		if _, err := DB.(*acmedb).DB.Exec("INSERT INTO admins (Username, Password) values($1, $2)", admin, string(hash)); err != nil {
+			t.Fatalf("Could not create admin user [%v]", err)
+		}
+	}
+
+	register := func(admin string, ip string) *httpexpect.Object {
+		return e.POST("/register").
+			WithBasicAuth(admin, "hunter2").
+			WithHeader("X-Forwarded-For", ip+", 10.0.0.1").
+			Expect().
+			Status(http.StatusCreated).
+			JSON().Object()
+	}
+	first := register("alice", "192.0.2.10")
+	first.ValueEqual("created_by", "alice")
+	first.ValueEqual("created_from", "192.0.2.10")
+	register("alice", "192.0.2.11")
+	register("bob", "192.0.2.10")
+
+	e.POST("/register").
+		WithBasicAuth("alice", "wrong").
+		Expect().
+		Status(http.StatusUnauthorized)
+
+	regs := e.GET("/admin/registrations").
+		WithQuery("created_by", "alice").
+		WithBasicAuth("bob", "hunter2").
+		Expect().
+		Status(http.StatusOK).
+		JSON().Array()
+	regs.Length().Equal(2)
+	regs.Element(0).Object().NotContainsKey("password")
+
+	regs = e.GET("/admin/registrations").
+		WithQuery("created_by", "alice").
+		WithQuery("created_from", "192.0.2.10").
+		WithBasicAuth("bob", "hunter2").
+		Expect().
+		Status(http.StatusOK).
+		JSON().Array()
+	regs.Length().Equal(1)
+	regs.Element(0).Object().ValueEqual("subdomain", first.Value("subdomain").Raw())
+
+	e.GET("/admin/registrations").
+		Expect().
+		Status(http.StatusUnauthorized)
+}
+
+func TestApiRegisterWithValues(t *testing.T) {
+	router := setupRouter(false, false)
+	server := httptest.NewServer(router)
+	defer server.Close()
+	e := getExpect(t, server)
+	validTXT := "LHDhK3oGRvkiefQnx7OOczTY5Tic_xZ6HcMOc_gmtoM"
+	response := e.POST("/register").
+		WithJSON(map[string]interface{}{
+			"txt":  validTXT,
+			"slot": 1,
+			"a":    []string{"192.0.2.1"},
+			"aaaa": []string{"2001:0db8::0001"},
+		}).
+		Expect().
+		Status(http.StatusCreated).
+		JSON().Object()
+	response.ValueEqual("txt", validTXT)
+	response.ValueEqual("slot", 1)
+	response.Value("a").Array().Elements("192.0.2.1")
+	response.Value("aaaa").Array().Elements("2001:db8::1")
+
+	subdomain := response.Value("subdomain").String().Raw()
+	txts, err := DB.GetTXTForDomain(subdomain)
+	if err != nil || len(txts) != 2 || txts[0] != "" || txts[1] != validTXT {
+		t.Errorf("Expected preset TXT value in slot 1, got %v [%v]", txts, err)
+	}
+	aaaa, err := DB.GetAAAAForDomain(subdomain)
+	if err != nil || len(aaaa) != 1 || aaaa[0].String() != "2001:db8::1" {
+		t.Errorf("Expected preset AAAA value, got %v [%v]", aaaa, err)
+	}
+
+	response = e.POST("/register").
+		WithJSON(map[string]interface{}{"txt": "tooshort", "a": []string{"2001:db8::1"}}).
+		Expect().
+		Status(http.StatusBadRequest).
+		JSON().Object()
+	response.ValueEqual("error", "bad_txt")
+	response.Value("details").Array().Length().Equal(2)
+}
+
+func TestApiAdminInactive(t *testing.T) {
+	_ = setupRouter(false, false)
+	api := httprouter.New()
+	api.GET("/admin/inactive", AuthForAdmin(webAdminInactive))
+	server := httptest.NewServer(api)
+	defer server.Close()
+	e := getExpect(t, server)
+
+	hash, _ := bcrypt.GenerateFromPassword([]byte("hunter2"), 10)
+	if _, err := DB.(*acmedb).DB.Exec("INSERT INTO admins (Username, Password) values($1, $2)", "ivan", string(hash)); err != nil {
+		t.Fatalf("Could not create admin user [%v]", err)
+	}
+	user, _ := DB.Register(cidrslice{}, registrationOrigin{}, ACMETxtPost{})
+	_, _ = DB.(*acmedb).DB.Exec("UPDATE records SET CreatedAt=0 WHERE Username=$1", user.Username.String())
+
+	regs := e.GET("/admin/inactive").
+		WithQuery("days", "1").
+		WithBasicAuth("ivan", "hunter2").
+		Expect().
+		Status(http.StatusOK).
+		JSON().Array()
+	found := false
+	for _, reg := range regs.Iter() {
+		if reg.Object().Value("username").Raw() == user.Username.String() {
+			reg.Object().ValueEqual("last_active", 0)
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("Expected the registration to be listed as inactive")
+	}
+
+	e.GET("/admin/inactive").
+		WithQuery("days", "-1").
+		WithBasicAuth("ivan", "hunter2").
+		Expect().
+		Status(http.StatusBadRequest).
+		JSON().Object().
+		ValueEqual("error", "bad_request")
+}
+
+func TestApiDeregister(t *testing.T) {
+	_ = setupRouter(false, false)
+	api := httprouter.New()
+	api.DELETE("/register", AuthForAccount(webDeregister))
+	server := httptest.NewServer(api)
+	defer server.Close()
+	e := getExpect(t, server)
+	user, _ := DB.Register(cidrslice{}, registrationOrigin{}, ACMETxtPost{Value: "fffffffffffffffffffffffffffffffffffffffffff", AValues: []string{"198.51.100.40"}})
+
+	e.DELETE("/register").
+		WithHeader("X-Api-User", user.Username.String()).
+		WithHeader("X-Api-Key", "wrongwrongwrongwrongwrongwrongwrongwrong").
+		Expect().
+		Status(http.StatusUnauthorized)
+	e.DELETE("/register").
+		WithHeader("X-Api-User", user.Username.String()).
+		WithHeader("X-Api-Key", user.Password).
+		Expect().
+		Status(http.StatusNoContent)
+	if _, err := DB.GetByUsername(user.Username); err == nil {
+		t.Errorf("Expected the registration to be deleted")
+	}
+	if count, _ := DB.CountRecords(user.Subdomain); count != 0 {
+		t.Errorf("Expected the records of the subdomain to be deleted, got %d", count)
+	}
+	e.DELETE("/register").
+		WithHeader("X-Api-User", user.Username.String()).
+		WithHeader("X-Api-Key", user.Password).
+		Expect().
+		Status(http.StatusUnauthorized)
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+)
+
+// apiAddressPublisher serves the A and AAAA records of the domain the HTTP API is
+// reached at, so that the host record doesn't need to be kept in sync with the
+// configuration separately. The records are withdrawn while the API doesn't pass
+// its health check.
+type apiAddressPublisher struct {
+	name       string
+	configured []net.IP
+	healthURL  string
+	interval   time.Duration
+	client     *http.Client
+	// detect returns the public addresses of this host when none are configured
+	detect  func() []net.IP
+	mutex   sync.RWMutex
+	records []dns.RR
+	healthy bool
+	stop    chan struct{}
+}
+
+func newAPIAddressPublisher(config DNSConfig) *apiAddressPublisher {
+	name := config.API.Domain
+	if name == "" {
+		name = config.General.Domain
+	}
+	var configured []net.IP
+	for _, v := range config.API.PublicIPs {
+		if ip := net.ParseIP(v); ip != nil {
+			configured = append(configured, ip)
+		} else {
+			dnsLog.WithFields(log.Fields{"ip": v}).Warning("Ignoring invalid public IP address")
+		}
+	}
+	scheme := "https"
+	if config.API.TLS == "none" {
+		scheme = "http"
+	}
+	host := config.API.IP
+	if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+		host = "127.0.0.1"
+	}
+	interval := time.Duration(config.API.HealthInterval) * time.Second
+	if interval <= 0 {
+		interval = 30 * time.Second
+	}
+	return &apiAddressPublisher{
+		name:       strings.ToLower(dns.Fqdn(name)),
+		configured: configured,
+		healthURL:  scheme + "://" + net.JoinHostPort(host, config.API.Port) + "/health",
+		interval:   interval,
+		client: &http.Client{
+			Timeout: 5 * time.Second,
+			Transport: &http.Transport{
+				// The check connects to the local listener, which doesn't have a certificate for its address
+				TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+			},
+		},
+		detect: detectPublicIPs,
+		stop:   make(chan struct{}),
+	}
+}
+
+// detectPublicIPs returns the source addresses this host uses to reach the internet
+// that are publicly routable. Hosts behind NAT need the addresses configured.
+func detectPublicIPs() []net.IP {
+	var ips []net.IP
+	for _, target := range []struct{ network, addr string }{
+		{"udp4", "192.0.2.1:53"},
+		{"udp6", "[2001:db8::1]:53"},
+	} {
+		// Connecting a UDP socket only picks the route, nothing is sent
+		conn, err := net.Dial(target.network, target.addr)
+		if err != nil {
+			continue
+		}
+		ip := conn.LocalAddr().(*net.UDPAddr).IP
+		conn.Close()
+		if ip.IsGlobalUnicast() && !ip.IsPrivate() {
+			ips = append(ips, ip)
+		}
+	}
+	return ips
+}
+
+// serves tells if the publisher answers for the name
+func (p *apiAddressPublisher) serves(name string) bool {
+	return p != nil && strings.EqualFold(name, p.name)
+}
+
+// Records returns the published records of the type for the name of the query
+func (p *apiAddressPublisher) Records(q dns.Question) []dns.RR {
+	if !p.serves(q.Name) {
+		return nil
+	}
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	var rrs []dns.RR
+	for _, rr := range p.records {
+		if rr.Header().Rrtype == q.Qtype {
+			rr = dns.Copy(rr)
+			// Keep the case of the question
+			rr.Header().Name = q.Name
+			rrs = append(rrs, rr)
+		}
+	}
+	return rrs
+}
+
+// Run checks the health of the API and updates the records until stopped
+func (p *apiAddressPublisher) Run() {
+	dnsLog.WithFields(log.Fields{"domain": p.name, "health": p.healthURL}).Info("Publishing the addresses of the API")
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+	for {
+		p.refresh()
+		select {
+		case <-ticker.C:
+		case <-p.stop:
+			return
+		}
+	}
+}
+
+// Stop ends the update loop
+func (p *apiAddressPublisher) Stop() {
+	close(p.stop)
+}
+
+// refresh publishes the current addresses if the API is healthy, and withdraws
+// the records otherwise
+func (p *apiAddressPublisher) refresh() {
+	healthy := p.checkHealth()
+	var records []dns.RR
+	if healthy {
+		ips := p.configured
+		if len(ips) == 0 {
+			ips = p.detect()
+		}
+		for _, ip := range ips {
+			hdr := dns.RR_Header{Name: p.name, Class: dns.ClassINET, Ttl: 60}
+			if ip4 := ip.To4(); ip4 != nil {
+				hdr.Rrtype = dns.TypeA
+				records = append(records, &dns.A{Hdr: hdr, A: ip4})
+			} else {
+				hdr.Rrtype = dns.TypeAAAA
+				records = append(records, &dns.AAAA{Hdr: hdr, AAAA: ip})
+			}
+		}
+		if len(records) == 0 {
+			dnsLog.WithFields(log.Fields{"domain": p.name}).Warning("No public addresses found for the API, set public_ips")
+		}
+	}
+	p.mutex.Lock()
+	was := p.healthy
+	p.healthy = healthy
+	p.records = records
+	p.mutex.Unlock()
+	if healthy && !was {
+		dnsLog.WithFields(log.Fields{"domain": p.name, "records": len(records)}).Info("API is healthy, publishing its addresses")
+	} else if !healthy && was {
+		dnsLog.WithFields(log.Fields{"domain": p.name}).Warning("API failed its health check, withdrawing its addresses")
+	}
+}
+
+func (p *apiAddressPublisher) checkHealth() bool {
+	resp, err := p.client.Get(p.healthURL)
+	if err != nil {
+		dnsLog.WithFields(log.Fields{"error": err.Error()}).Debug("API health check failed")
+		return false
+	}
+	resp.Body.Close()
+	return resp.StatusCode == http.StatusOK
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestAPIAddressPublisher(t *testing.T) {
+	var status atomic.Int32
+	status.Store(http.StatusOK)
+	health := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(int(status.Load()))
+	}))
+	defer health.Close()
+
+	config := DNSConfig{
+		General: general{Domain: "auth.example.org"},
+		API:     httpapi{Port: "443", TLS: "none", PublicIPs: []string{"198.51.100.7", "2001:db8::7", "invalid"}},
+	}
+	p := newAPIAddressPublisher(config)
+	if p.healthURL != "http://127.0.0.1:443/health" {
+		t.Errorf("Unexpected health check URL %s", p.healthURL)
+	}
+	p.healthURL = health.URL + "/health"
+	server := NewDNSServer(DB, "", "udp", "auth.example.org")
+	server.APIRecords = p
+
+	lookup := func(qtype uint16) ([]dns.RR, int) {
+		rrs, rcode, _, _ := server.answer(dns.Question{Name: "Auth.Example.org.", Qtype: qtype, Qclass: dns.ClassINET})
+		return rrs, rcode
+	}
+	p.refresh()
+	if rrs, _ := lookup(dns.TypeA); len(rrs) != 1 || !rrs[0].(*dns.A).A.Equal(net.ParseIP("198.51.100.7")) || rrs[0].Header().Name != "Auth.Example.org." {
+		t.Errorf("Expected the configured A record, got %v", rrs)
+	}
+	if rrs, _ := lookup(dns.TypeAAAA); len(rrs) != 1 || !rrs[0].(*dns.AAAA).AAAA.Equal(net.ParseIP("2001:db8::7")) {
+		t.Errorf("Expected the configured AAAA record, got %v", rrs)
+	}
+
+	// Records are withdrawn while the API is unhealthy
+	status.Store(http.StatusServiceUnavailable)
+	p.refresh()
+	if rrs, rcode := lookup(dns.TypeA); len(rrs) != 0 || rcode != dns.RcodeSuccess {
+		t.Errorf("Expected an empty answer while unhealthy, got %v with %s", rrs, dns.RcodeToString[rcode])
+	}
+	status.Store(http.StatusOK)
+	p.refresh()
+	if rrs, _ := lookup(dns.TypeA); len(rrs) != 1 {
+		t.Errorf("Expected the records to be published again, got %v", rrs)
+	}
+}
+
+func TestAPIAddressPublisherDetect(t *testing.T) {
+	health := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer health.Close()
+	p := newAPIAddressPublisher(DNSConfig{API: httpapi{Domain: "api.example.org", IP: "0.0.0.0", Port: "443", TLS: "cert"}})
+	if p.healthURL != "https://127.0.0.1:443/health" || p.name != "api.example.org." {
+		t.Errorf("Unexpected publisher for %s with health check URL %s", p.name, p.healthURL)
+	}
+	p.healthURL = health.URL
+	p.detect = func() []net.IP { return []net.IP{net.ParseIP("203.0.113.9")} }
+	p.refresh()
+	rrs := p.Records(dns.Question{Name: "api.example.org.", Qtype: dns.TypeA})
+	if len(rrs) != 1 || !rrs[0].(*dns.A).A.Equal(net.ParseIP("203.0.113.9")) {
+		t.Errorf("Expected the detected address to be published, got %v", rrs)
+	}
+	if rrs = p.Records(dns.Question{Name: "other.example.org.", Qtype: dns.TypeA}); len(rrs) != 0 {
+		t.Errorf("Expected no records for other names, got %v", rrs)
+	}
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	log "github.com/sirupsen/logrus"
+)
+
+// pendingUpdate is an update of a protected subdomain waiting for approval
+type pendingUpdate struct {
+	ID        string      `json:"id"`
+	Subdomain string      `json:"subdomain"`
+	Update    ACMETxtPost `json:"update"`
+	Requested int64       `json:"requested"`
+	Expires   int64       `json:"expires"`
+	// token authenticates the decision of the approval webhook receiver
+	token string
+	// webhooks of the registration, notified once the update is applied
+	webhooks []string
+	// zone of the registration
+	zone string
+}
+
+// approvalEvent is the JSON payload POSTed to the approval webhook
+type approvalEvent struct {
+	Event string `json:"event"`
+	pendingUpdate
+	Token string `json:"token"`
+}
+
+// approvalDecision is the payload of the requests approving or rejecting an update
+type approvalDecision struct {
+	Approve bool   `json:"approve"`
+	Token   string `json:"token,omitempty"`
+}
+
+// approvalQueue holds the pending updates until they are decided on or expire
+type approvalQueue struct {
+	mutex   sync.Mutex
+	clock   clock
+	pending map[string]*pendingUpdate
+}
+
+// Approvals are the updates of protected subdomains waiting for approval
+var Approvals = newApprovalQueue(nil)
+
+func newApprovalQueue(c clock) *approvalQueue {
+	return &approvalQueue{
+		clock:   clockOrSystem(c),
+		pending: make(map[string]*pendingUpdate),
+	}
+}
+
+// isProtected checks if updates of the subdomain need approval
+func isProtected(subdomain string) bool {
+	for _, s := range Config.Approval.ProtectedSubdomains {
+		if s == subdomain {
+			return true
+		}
+	}
+	return false
+}
+
+// expire removes the expired updates, the caller must hold the mutex
+func (q *approvalQueue) expire() {
+	now := q.clock.Now().Unix()
+	for id, p := range q.pending {
+		if now >= p.Expires {
+			apiLog.WithFields(log.Fields{"id": id, "subdomain": p.Subdomain}).Info("Pending update expired without approval")
+			delete(q.pending, id)
+		}
+	}
+}
+
+// add queues the update of the registration and returns it
+func (q *approvalQueue) add(a ACMETxt) *pendingUpdate {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.expire()
+	now := q.clock.Now()
+	p := &pendingUpdate{
+		ID:        generatePassword(24),
+		Subdomain: a.Subdomain,
+		Update:    a.ACMETxtPost,
+		Requested: now.Unix(),
+		Expires:   now.Add(time.Duration(Config.Approval.Timeout) * time.Second).Unix(),
+		token:     generatePassword(40),
+		webhooks:  a.Webhooks,
+		zone:      registrationZone(a),
+	}
+	q.pending[p.ID] = p
+	return p
+}
+
+// list returns the pending updates, oldest first
+func (q *approvalQueue) list() []pendingUpdate {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.expire()
+	list := make([]pendingUpdate, 0, len(q.pending))
+	for _, p := range q.pending {
+		list = append(list, *p)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Requested != list[j].Requested {
+			return list[i].Requested < list[j].Requested
+		}
+		return list[i].ID < list[j].ID
+	})
+	return list
+}
+
+// take removes and returns the pending update. If token is not nil, it must
+// match the token sent to the approval webhook.
+func (q *approvalQueue) take(id string, token *string) (*pendingUpdate, bool) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.expire()
+	p, ok := q.pending[id]
+	if !ok {
+		return nil, false
+	}
+	if token != nil && subtle.ConstantTimeCompare([]byte(*token), []byte(p.token)) != 1 {
+		return nil, false
+	}
+	delete(q.pending, id)
+	return p, true
+}
+
+// restore puts back an update that could not be applied
+func (q *approvalQueue) restore(p *pendingUpdate) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.pending[p.ID] = p
+}
+
+// holdForApproval queues the update and notifies the approval webhook
+func holdForApproval(w http.ResponseWriter, a ACMETxt) {
+	p := Approvals.add(a)
+	apiLog.WithFields(log.Fields{"id": p.ID, "subdomain": p.Subdomain}).Info("Update of a protected subdomain held for approval")
+	if Config.Approval.Webhook != "" {
+		body, err := json.Marshal(approvalEvent{"approval_required", *p, p.token})
+		if err != nil {
+			apiLog.WithFields(log.Fields{"error": err.Error()}).Error("Could not marshal approval event")
+		} else {
+			go postWebhook(Config.Approval.Webhook, body)
+		}
+	}
+	out, _ := json.Marshal(p)
+	WriteJsonResponse(w, http.StatusAccepted, out)
+}
+
+// decideApproval applies or discards the pending update
+func decideApproval(w http.ResponseWriter, id string, token *string, approve bool, decidedBy string) {
+	p, ok := Approvals.take(id, token)
+	if !ok {
+		WriteJsonResponse(w, http.StatusNotFound, jsonError("not_found"))
+		return
+	}
+	status := "rejected"
+	if approve {
+		updated, err := DB.Update(p.Update)
+		if err != nil {
+			apiLog.WithFields(log.Fields{"error": err.Error(), "id": p.ID}).Error("Error while applying an approved update")
+			Approvals.restore(p)
+			WriteJsonResponse(w, http.StatusInternalServerError, jsonError("db_error"))
+			return
+		}
+		p.Update = updated
+		event := webhookEvent{"update", p.Subdomain, p.Update.Value, p.Update.AValues, p.Update.AAAAValues, time.Now().Unix(), p.Update.CorrelationID, p.zone}
+		sendWebhooks(p.webhooks, event)
+		runHooks(event)
+		ZoneSerial.Bump("approved_update", p.Subdomain)
+		status = "approved"
+	}
+	apiLog.WithFields(log.Fields{"id": p.ID, "subdomain": p.Subdomain, "status": status, "by": decidedBy}).Info("Pending update decided on")
+	out, _ := json.Marshal(struct {
+		Status string `json:"status"`
+		pendingUpdate
+	}{status, *p})
+	WriteJsonResponse(w, http.StatusOK, out)
+}
+
+// webAdminApprovals lists the pending updates
+func webAdminApprovals(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	out, _ := json.Marshal(Approvals.list())
+	WriteJsonResponse(w, http.StatusOK, out)
+}
+
+// webAdminApprovalDecision approves or rejects a pending update as an admin
+func webAdminApprovalDecision(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	var decision approvalDecision
+	if err := json.NewDecoder(r.Body).Decode(&decision); err != nil {
+		WriteJsonResponse(w, http.StatusBadRequest, jsonFieldErrors("malformed_json_payload", decodeErrorDetails(err)))
+		return
+	}
+	admin, _ := r.Context().Value(AdminKey).(string)
+	decideApproval(w, p.ByName("id"), nil, decision.Approve, admin)
+}
+
+// webApprovalDecision approves or rejects a pending update with the token sent to the approval webhook
+func webApprovalDecision(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	var decision approvalDecision
+	if err := json.NewDecoder(r.Body).Decode(&decision); err != nil {
+		WriteJsonResponse(w, http.StatusBadRequest, jsonFieldErrors("malformed_json_payload", decodeErrorDetails(err)))
+		return
+	}
+	decideApproval(w, p.ByName("id"), &decision.Token, decision.Approve, "webhook")
+}
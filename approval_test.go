@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gavv/httpexpect"
+	"github.com/julienschmidt/httprouter"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func setupApprovalRouter(t *testing.T, protected ACMETxt, webhook string) (*httpexpect.Expect, *frozenClock) {
+	_ = setupRouter(false, false)
+	Config.Approval = approval{ProtectedSubdomains: []string{protected.Subdomain}, Webhook: webhook, Timeout: 600}
+	clk := newFrozenClock(time.Unix(1700000000, 0))
+	oldApprovals := Approvals
+	Approvals = newApprovalQueue(clk)
+	t.Cleanup(func() {
+		Approvals = oldApprovals
+		Config.Approval = approval{}
+	})
+	api := httprouter.New()
+	api.POST("/update", AuthForUpdate(webUpdatePost))
+	api.GET("/admin/approvals", AuthForAdmin(webAdminApprovals))
+	api.POST("/admin/approvals/:id", AuthForAdmin(webAdminApprovalDecision))
+	api.POST("/approvals/:id", webApprovalDecision)
+	server := httptest.NewServer(api)
+	t.Cleanup(server.Close)
+	hash, _ := bcrypt.GenerateFromPassword([]byte("hunter2"), 10)
+	_, _ = DB.(*acmedb).DB.Exec("DELETE FROM admins WHERE Username=$1", "alice")
+	if _, err := DB.(*acmedb).DB.Exec("INSERT INTO admins (Username, Password) values($1, $2)", "alice", string(hash)); err != nil {
+		t.Fatalf("Could not create admin user [%v]", err)
+	}
+	return getExpect(t, server), clk
+}
+
+func postUpdate(e *httpexpect.Expect, reg ACMETxt, txt string) *httpexpect.Response {
+	return e.POST("/update").
+		WithJSON(map[string]string{"subdomain": reg.Subdomain, "txt": txt}).
+		WithHeader("X-Api-User", reg.Username.String()).
+		WithHeader("X-Api-Key", reg.Password).
+		Expect()
+}
+
+func TestApprovalWebhookReceiver(t *testing.T) {
+	events := make(chan approvalEvent, 1)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event approvalEvent
+		_ = json.NewDecoder(r.Body).Decode(&event)
+		events <- event
+	}))
+	defer receiver.Close()
+	_ = setupRouter(false, false)
+	protected, _ := DB.Register(cidrslice{}, registrationOrigin{}, ACMETxtPost{})
+	unprotected, _ := DB.Register(cidrslice{}, registrationOrigin{}, ACMETxtPost{})
+	e, _ := setupApprovalRouter(t, protected, receiver.URL)
+
+	validTXT := "LHDhK3oGRvkiefQnx7OOczTY5Tic_xZ6HcMOc_gmtoM"
+	postUpdate(e, unprotected, validTXT).Status(http.StatusOK)
+	pending := postUpdate(e, protected, validTXT).Status(http.StatusAccepted).JSON().Object()
+	id := pending.Value("id").String().Raw()
+	pending.NotContainsKey("token")
+	if txts, _ := DB.GetTXTForDomain(protected.Subdomain); txts[0] != "" {
+		t.Errorf("Expected the update to be held, got %v", txts)
+	}
+
+	var event approvalEvent
+	select {
+	case event = <-events:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Approval webhook was not delivered")
+	}
+	if event.Event != "approval_required" || event.ID != id || event.Update.Value != validTXT || event.Token == "" {
+		t.Errorf("Unexpected approval event %+v", event)
+	}
+
+	e.POST("/approvals/" + id).
+		WithJSON(approvalDecision{Approve: true, Token: "wrong"}).
+		Expect().
+		Status(http.StatusNotFound)
+	e.POST("/approvals/"+id).
+		WithJSON(approvalDecision{Approve: true, Token: event.Token}).
+		Expect().
+		Status(http.StatusOK).
+		JSON().Object().
+		ValueEqual("status", "approved")
+	if txts, _ := DB.GetTXTForDomain(protected.Subdomain); txts[0] != validTXT {
+		t.Errorf("Expected the approved update to be applied, got %v", txts)
+	}
+	// Decisions are final
+	e.POST("/approvals/" + id).
+		WithJSON(approvalDecision{Approve: true, Token: event.Token}).
+		Expect().
+		Status(http.StatusNotFound)
+}
+
+func TestApprovalByAdmin(t *testing.T) {
+	_ = setupRouter(false, false)
+	protected, _ := DB.Register(cidrslice{}, registrationOrigin{}, ACMETxtPost{})
+	e, clk := setupApprovalRouter(t, protected, "")
+
+	validTXT := "LHDhK3oGRvkiefQnx7OOczTY5Tic_xZ6HcMOc_gmtoM"
+	id := postUpdate(e, protected, validTXT).Status(http.StatusAccepted).JSON().Object().Value("id").String().Raw()
+	list := e.GET("/admin/approvals").
+		WithBasicAuth("alice", "hunter2").
+		Expect().
+		Status(http.StatusOK).
+		JSON().Array()
+	list.Length().Equal(1)
+	list.Element(0).Object().ValueEqual("subdomain", protected.Subdomain)
+
+	e.POST("/admin/approvals/" + id).
+		WithJSON(approvalDecision{Approve: true}).
+		Expect().
+		Status(http.StatusUnauthorized)
+	e.POST("/admin/approvals/"+id).
+		WithBasicAuth("alice", "hunter2").
+		WithJSON(approvalDecision{Approve: false}).
+		Expect().
+		Status(http.StatusOK).
+		JSON().Object().
+		ValueEqual("status", "rejected")
+	if txts, _ := DB.GetTXTForDomain(protected.Subdomain); txts[0] != "" {
+		t.Errorf("Expected the rejected update to be discarded, got %v", txts)
+	}
+
+	// Updates that aren't decided on in time are discarded
+	id = postUpdate(e, protected, validTXT).Status(http.StatusAccepted).JSON().Object().Value("id").String().Raw()
+	clk.Advance(601 * time.Second)
+	e.GET("/admin/approvals").
+		WithBasicAuth("alice", "hunter2").
+		Expect().
+		Status(http.StatusOK).
+		JSON().Array().
+		Empty()
+	e.POST("/admin/approvals/"+id).
+		WithBasicAuth("alice", "hunter2").
+		WithJSON(approvalDecision{Approve: true}).
+		Expect().
+		Status(http.StatusNotFound)
+}
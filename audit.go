@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	log "github.com/sirupsen/logrus"
+)
+
+// auditEvent is an entry of the audit trail
+type auditEvent struct {
+	Time      int64  `json:"time"`
+	Action    string `json:"action"`
+	Actor     string `json:"actor"`
+	SourceIP  string `json:"source_ip"`
+	Subdomain string `json:"subdomain"`
+	Detail    string `json:"detail"`
+}
+
+// maxAuditEvents is the highest number of events returned by the audit endpoint
+const maxAuditEvents = 1000
+
+// auditLog records the audit trail in the database and optionally as JSON lines
+// in a file. The trail is append-only, deregistrations leave the events of the
+// subdomain in place.
+type auditLog struct {
+	db   database
+	mu   sync.Mutex
+	file io.WriteCloser
+}
+
+// Audit is the audit trail, nil unless enabled
+var Audit *auditLog
+
+// newAuditLog returns the audit trail writing to the database and, if path is not
+// empty, appending to the file
+func newAuditLog(db database, path string) (*auditLog, error) {
+	a := &auditLog{db: db}
+	if path != "" {
+		f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+		if err != nil {
+			return nil, err
+		}
+		a.file = f
+	}
+	return a, nil
+}
+
+// Record adds the event to the trail. Failures are logged, the audited request
+// has already been answered.
+func (a *auditLog) Record(e auditEvent) {
+	if a == nil {
+		return
+	}
+	if err := a.db.AddAuditEvent(e); err != nil {
+		apiLog.WithFields(log.Fields{"error": err.Error(), "action": e.Action, "subdomain": e.Subdomain}).Error("Could not store the audit event")
+	}
+	if a.file == nil {
+		return
+	}
+	line, _ := json.Marshal(e)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, err := a.file.Write(append(line, '\n')); err != nil {
+		apiLog.WithFields(log.Fields{"error": err.Error(), "action": e.Action, "subdomain": e.Subdomain}).Error("Could not write the audit event")
+	}
+}
+
+// Close closes the audit file
+func (a *auditLog) Close() {
+	if a != nil && a.file != nil {
+		a.file.Close()
+	}
+}
+
+// requestActor returns who made the request: the authenticated admin or
+// registration, or else the username the credentials were given for
+func requestActor(r *http.Request) string {
+	if admin, ok := r.Context().Value(AdminKey).(string); ok {
+		return admin
+	}
+	if user, ok := r.Context().Value(ACMETxtKey).(ACMETxt); ok {
+		return user.Username.String()
+	}
+	if username, _, ok := r.BasicAuth(); ok {
+		return username
+	}
+	return r.Header.Get("X-Api-User")
+}
+
+// auditRequest records the action of the request in the audit trail
+func auditRequest(r *http.Request, action string, subdomain string, detail string) {
+	Audit.Record(auditEvent{
+		Time:      time.Now().Unix(),
+		Action:    action,
+		Actor:     requestActor(r),
+		SourceIP:  getRequestIP(r),
+		Subdomain: subdomain,
+		Detail:    detail,
+	})
+}
+
+// auditAuthFailure records a request rejected by the authentication middleware
+func auditAuthFailure(r *http.Request, subdomain string, reason string) {
+	auditRequest(r, "auth_failed", subdomain, reason)
+}
+
+// statusWriter keeps the status code of the response
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// audited returns middleware recording the successful requests changing data in
+// the audit trail, with the subdomain of the authenticated registration. It runs
+// after the authentication middleware.
+func audited(action string) middleware {
+	return func(handler httprouter.Handle) httprouter.Handle {
+		return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+			if Audit == nil || r.Method == http.MethodGet || r.Method == http.MethodHead {
+				handler(w, r, p)
+				return
+			}
+			sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+			handler(sw, r, p)
+			if sw.status >= http.StatusBadRequest {
+				return
+			}
+			var subdomain string
+			if user, ok := r.Context().Value(ACMETxtKey).(ACMETxt); ok {
+				subdomain = user.Subdomain
+			}
+			auditRequest(r, action, subdomain, r.Method+" "+r.URL.Path)
+		}
+	}
+}
+
+// webAdminAudit returns the latest events of the audit trail, newest first,
+// optionally only the ones of the subdomain given in the query
+func webAdminAudit(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	limit := 100
+	if value := r.URL.Query().Get("limit"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 1 || parsed > maxAuditEvents {
+			WriteJsonResponse(w, http.StatusBadRequest, jsonFieldErrors("bad_request", []fieldError{{"limit", "must be a number between 1 and " + strconv.Itoa(maxAuditEvents)}}))
+			return
+		}
+		limit = parsed
+	}
+	events, err := DB.GetAuditEvents(r.URL.Query().Get("subdomain"), limit)
+	if err != nil {
+		apiLog.WithFields(log.Fields{"error": err.Error()}).Error("Error while getting the audit events")
+		WriteJsonResponse(w, http.StatusInternalServerError, jsonError("db_error"))
+		return
+	}
+	if events == nil {
+		events = []auditEvent{}
+	}
+	out, _ := json.Marshal(events)
+	WriteJsonResponse(w, http.StatusOK, out)
+}
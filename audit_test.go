@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAuditTrail(t *testing.T) {
+	_ = setupRouter(false, false)
+	file := filepath.Join(t.TempDir(), "audit.log")
+	auditLog, err := newAuditLog(DB, file)
+	if err != nil {
+		t.Fatalf("Could not open the audit log: %v", err)
+	}
+	Audit = auditLog
+	defer func() {
+		Audit.Close()
+		Audit = nil
+	}()
+	api := newRouter()
+	api.POST("/register", webRegisterPost)
+	api.POST("/update", webUpdatePost, AuthForUpdate, audited("update"))
+	admin := api.Group("/admin", AuthForAdmin, audited("admin"))
+	admin.POST("/toggles", webAdminTogglesPost)
+	admin.GET("/audit", webAdminAudit)
+	server := httptest.NewServer(api)
+	defer server.Close()
+	e := getExpect(t, server)
+	if err := DB.CreateAdmin("auditor", "hunter2"); err != nil {
+		t.Fatalf("Could not create admin user [%v]", err)
+	}
+
+	reg := e.POST("/register").Expect().Status(http.StatusCreated).JSON().Object()
+	subdomain := reg.Value("subdomain").String().Raw()
+	update := map[string]interface{}{"subdomain": subdomain, "txt": "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"}
+	e.POST("/update").
+		WithJSON(update).
+		WithHeader("X-Api-User", reg.Value("username").String().Raw()).
+		WithHeader("X-Api-Key", reg.Value("password").String().Raw()).
+		WithHeader("X-Forwarded-For", "192.0.2.7").
+		Expect().
+		Status(http.StatusOK)
+	e.POST("/update").
+		WithJSON(update).
+		WithHeader("X-Api-User", reg.Value("username").String().Raw()).
+		WithHeader("X-Api-Key", "wrongpasswordwrongpasswordwrongpassword1234").
+		Expect().
+		Status(http.StatusUnauthorized)
+	e.POST("/admin/toggles").
+		WithBasicAuth("auditor", "hunter2").
+		WithJSON(map[string]bool{"read_only": false}).
+		Expect().
+		Status(http.StatusOK)
+
+	events := e.GET("/admin/audit").
+		WithBasicAuth("auditor", "hunter2").
+		WithQuery("subdomain", subdomain).
+		Expect().
+		Status(http.StatusOK).
+		JSON().Array()
+	events.Length().Equal(2)
+	events.Element(0).Object().
+		ValueEqual("action", "update").
+		ValueEqual("actor", reg.Value("username").String().Raw()).
+		ValueEqual("source_ip", "192.0.2.7").
+		ValueEqual("detail", "POST /update")
+	events.Element(1).Object().ValueEqual("action", "register")
+	e.GET("/admin/audit").
+		WithBasicAuth("auditor", "hunter2").
+		WithQuery("limit", "0").
+		Expect().
+		Status(http.StatusBadRequest)
+
+	f, err := os.Open(file)
+	if err != nil {
+		t.Fatalf("Could not open the audit file: %v", err)
+	}
+	defer f.Close()
+	var actions []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var event auditEvent
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			t.Fatalf("Invalid audit file line %q: %v", scanner.Text(), err)
+		}
+		actions = append(actions, event.Action+":"+event.Detail)
+	}
+	expected := []string{"register:", "update:POST /update", "auth_failed:bad_credentials", "admin:POST /admin/toggles"}
+	if len(actions) != len(expected) {
+		t.Fatalf("Expected audit file events %v, got %v", expected, actions)
+	}
+	for i := range expected {
+		if actions[i] != expected[i] {
+			t.Errorf("Expected audit file events %v, got %v", expected, actions)
+			break
+		}
+	}
+}
+
+func TestAuditEventsKV(t *testing.T) {
+	db, err := openBackend("memory", "")
+	if err != nil {
+		t.Fatalf("Could not open database: %v", err)
+	}
+	defer db.Close()
+	for i, subdomain := range []string{"one", "two", "one"} {
+		if err := db.AddAuditEvent(auditEvent{Time: int64(i), Action: "update", Subdomain: subdomain}); err != nil {
+			t.Fatalf("Could not add audit event: %v", err)
+		}
+	}
+	events, err := db.GetAuditEvents("one", 10)
+	if err != nil {
+		t.Fatalf("Could not get audit events: %v", err)
+	}
+	if len(events) != 2 || events[0].Time != 2 || events[1].Time != 0 {
+		t.Errorf("Expected the events of the subdomain newest first, got %v", events)
+	}
+	if events, _ = db.GetAuditEvents("", 2); len(events) != 2 || events[0].Time != 2 {
+		t.Errorf("Expected the latest two events, got %v", events)
+	}
+}
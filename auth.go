@@ -16,66 +16,121 @@ type key int
 // ACMETxtKey is a context key for ACMETxt struct
 const ACMETxtKey key = 0
 
+// AdminKey is a context key for the username of the authenticated admin
+const AdminKey key = 1
+
 // AuthForRegister middleware for register request
 func AuthForRegister(register httprouter.Handle) httprouter.Handle {
+	return AuthForAdmin(register)
+}
+
+// AuthForAdmin middleware authenticates an admin with HTTP basic auth and sets
+// the admin username to the request context
+func AuthForAdmin(handler httprouter.Handle) httprouter.Handle {
 	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
 		username, password, ok := r.BasicAuth()
 		if !ok {
+			authFailed(r, "", "missing_credentials")
 			WriteJsonResponse(w, http.StatusUnauthorized, jsonError("unauthorized"))
 			return
 		}
-		pass, err := DB.GetAdminPassByUsername(username)
+		pass, version, err := DB.GetAdminPassByUsername(username)
 		if err != nil {
-			log.WithFields(log.Fields{"error": err.Error()}).Error("Error while trying to get user")
-			// To protect against timed side channel (never gonna give you up)
-			correctPassword(password, "$2a$10$8JEFVNYYhLoBysjAxe2yBuXrkDojBQBkVpXEQgyQyjn43SvJ4vL36")
-			WriteJsonResponse(w, http.StatusUnauthorized, jsonError("unauthorized"))
+			apiLog.WithFields(log.Fields{"error": err.Error()}).Error("Error while trying to get user")
+			pass = dummyHash
+		}
+		ok, verr := verifyPassword(password, pass)
+		if verr == errVerificationBusy {
+			writeVerificationBusy(w)
 			return
 		}
-		if !correctPassword(password, pass) {
+		if err != nil || !ok {
+			authFailed(r, "", "bad_credentials")
 			WriteJsonResponse(w, http.StatusUnauthorized, jsonError("unauthorized"))
 			return
 		}
-		register(w, r, p)
+		upgradeAdminCredential(username, version, password)
+		recordAuthResult(r, true)
+		ctx := context.WithValue(r.Context(), AdminKey, username)
+		handler(w, r.WithContext(ctx), p)
 	}
 }
 
 // AuthForUpdate middleware for update request
 func AuthForUpdate(update httprouter.Handle) httprouter.Handle {
-	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	return AuthForAccount(func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		user, _ := r.Context().Value(ACMETxtKey).(ACMETxt)
 		postData := ACMETxt{}
-		user, err := getUserFromRequest(r)
-		if err != nil {
-			log.WithFields(log.Fields{"error": err.Error()}).Error("Error while trying to get user")
-			WriteJsonResponse(w, http.StatusUnauthorized, jsonError("unauthorized"))
-			return
-		}
-		if !updateAllowedFromIP(r, user) {
-			log.WithFields(log.Fields{"error": "ip_unauthorized"}).Error("Update not allowed from IP")
-			WriteJsonResponse(w, http.StatusForbidden, jsonError("forbidden"))
-			return
-		}
 		dec := json.NewDecoder(r.Body)
-		err = dec.Decode(&postData)
+		err := dec.Decode(&postData)
 		if err != nil {
-			log.WithFields(log.Fields{"error": "json_error", "string": err.Error()}).Error("Decode error")
-			WriteJsonResponse(w, http.StatusBadRequest, jsonError("bad_request"))
+			apiLog.WithFields(log.Fields{"error": "json_error", "string": err.Error()}).Error("Decode error")
+			WriteJsonResponse(w, http.StatusBadRequest, jsonFieldErrors("bad_request", decodeErrorDetails(err)))
 			return
 		}
 		if user.Subdomain != postData.Subdomain {
-			log.WithFields(log.Fields{"error": "subdomain_mismatch", "name": postData.Subdomain, "expected": user.Subdomain}).Error("Subdomain mismatch")
+			apiLog.WithFields(log.Fields{"error": "subdomain_mismatch", "name": postData.Subdomain, "expected": user.Subdomain}).Error("Subdomain mismatch")
+			auditAuthFailure(r, user.Subdomain, "subdomain_mismatch")
 			WriteJsonResponse(w, http.StatusForbidden, jsonError("forbidden"))
 			return
 		}
 		// Set user info to the decoded ACMETxt object
 		postData.Username = user.Username
 		postData.Password = user.Password
+		postData.Webhooks = user.Webhooks
+		postData.AllowedTypes = user.AllowedTypes
 		// Set the ACMETxt struct to context to pull in from update function
 		ctx := context.WithValue(r.Context(), ACMETxtKey, postData)
 		update(w, r.WithContext(ctx), p)
+	})
+}
+
+// AuthForAccount middleware authenticates the account holder with the API credentials
+// and the allowfrom list, and sets the stored ACMETxt struct to the request context
+func AuthForAccount(handler httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		user, err := getUserFromRequest(r)
+		if err == errVerificationBusy {
+			writeVerificationBusy(w)
+			return
+		}
+		if err == errCanaryUsed {
+			// Answer like a request from a disallowed address to not reveal the canary
+			authFailed(r, "", "canary_used")
+			WriteJsonResponse(w, http.StatusForbidden, jsonError("forbidden"))
+			return
+		}
+		if err != nil {
+			apiLog.WithFields(log.Fields{"error": err.Error()}).Error("Error while trying to get user")
+			authFailed(r, "", "bad_credentials")
+			WriteJsonResponse(w, http.StatusUnauthorized, jsonError("unauthorized"))
+			return
+		}
+		if !updateAllowedFromIP(r, user) {
+			apiLog.WithFields(log.Fields{"error": "ip_unauthorized"}).Error("Update not allowed from IP")
+			authFailed(r, user.Subdomain, "source_ip_not_allowed")
+			WriteJsonResponse(w, http.StatusForbidden, jsonError("forbidden"))
+			return
+		}
+		if user.Disabled {
+			apiLog.WithFields(log.Fields{"user": user.Username.String()}).Debug("Request for a disabled registration")
+			authFailed(r, user.Subdomain, "registration_disabled")
+			WriteJsonResponse(w, http.StatusForbidden, jsonError("registration_disabled"))
+			return
+		}
+		recordAuthResult(r, true)
+		ctx := context.WithValue(r.Context(), ACMETxtKey, user)
+		handler(w, r.WithContext(ctx), p)
 	}
 }
 
+// authFailed records a request whose credentials were refused in the audit trail
+// and the authentication metrics
+func authFailed(r *http.Request, subdomain string, reason string) {
+	recordAuthResult(r, false)
+	auditAuthFailure(r, subdomain, reason)
+}
+
 func getUserFromRequest(r *http.Request) (ACMETxt, error) {
 	uname := r.Header.Get("X-Api-User")
 	passwd := r.Header.Get("X-Api-Key")
@@ -86,13 +141,24 @@ func getUserFromRequest(r *http.Request) (ACMETxt, error) {
 	if validKey(passwd) {
 		dbuser, err := DB.GetByUsername(username)
 		if err != nil {
-			log.WithFields(log.Fields{"error": err.Error()}).Error("Error while trying to get user")
-			// To protect against timed side channel (never gonna give you up)
-			correctPassword(passwd, "$2a$10$8JEFVNYYhLoBysjAxe2yBuXrkDojBQBkVpXEQgyQyjn43SvJ4vL36")
-
+			apiLog.WithFields(log.Fields{"error": err.Error()}).Error("Error while trying to get user")
+			if _, err = verifyPassword(passwd, dummyHash); err != nil {
+				return ACMETxt{}, err
+			}
 			return ACMETxt{}, fmt.Errorf("Invalid username: %s", uname)
 		}
-		if correctPassword(passwd, dbuser.Password) {
+		if dbuser.Canary {
+			// Any use of the username means that the credentials have leaked
+			alertCanary(r, dbuser)
+			_, _ = verifyPassword(passwd, dbuser.Password)
+			return ACMETxt{}, errCanaryUsed
+		}
+		ok, err := verifyPassword(passwd, dbuser.Password)
+		if err != nil {
+			return ACMETxt{}, err
+		}
+		if ok {
+			upgradeCredential(dbuser.Username, dbuser.PassVersion, passwd)
 			return dbuser, nil
 		}
 		return ACMETxt{}, fmt.Errorf("Invalid password for user %s", uname)
@@ -100,6 +166,22 @@ func getUserFromRequest(r *http.Request) (ACMETxt, error) {
 	return ACMETxt{}, fmt.Errorf("Invalid key for user %s", uname)
 }
 
+// getRequestIP returns the address of the client, taken from the configured header if enabled
+func getRequestIP(r *http.Request) string {
+	if Config.API.UseHeader {
+		ips := getIPListFromHeader(r.Header.Get(Config.API.HeaderName))
+		if len(ips) > 0 {
+			return ips[0]
+		}
+		return ""
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
 func updateAllowedFromIP(r *http.Request, user ACMETxt) bool {
 	if Config.API.UseHeader {
 		ips := getIPListFromHeader(r.Header.Get(Config.API.HeaderName))
@@ -107,7 +189,7 @@ func updateAllowedFromIP(r *http.Request, user ACMETxt) bool {
 	}
 	host, _, err := net.SplitHostPort(r.RemoteAddr)
 	if err != nil {
-		log.WithFields(log.Fields{"error": err.Error(), "remoteaddr": r.RemoteAddr}).Error("Error while parsing remote address")
+		apiLog.WithFields(log.Fields{"error": err.Error(), "remoteaddr": r.RemoteAddr}).Error("Error while parsing remote address")
 		host = ""
 	}
 	return user.allowedFrom(host)
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	log "github.com/sirupsen/logrus"
+)
+
+// maxTrackedCredentials is the highest number of credentials with counters kept,
+// as failed attempts can name any number of usernames
+const maxTrackedCredentials = 10000
+
+// authCounters are the successful and failed authentication attempts
+type authCounters struct {
+	Success uint64 `json:"success"`
+	Failure uint64 `json:"failure"`
+}
+
+// credentialStats are the counters of a credential with its attempts within the
+// alert window
+type credentialStats struct {
+	authCounters
+	recent  []authAttempt
+	alerted time.Time
+}
+
+type authAttempt struct {
+	time time.Time
+	ok   bool
+}
+
+// authAlertEvent is the JSON payload POSTed to the authentication alert webhook
+type authAlertEvent struct {
+	Event      string `json:"event"`
+	Credential string `json:"credential"`
+	Endpoint   string `json:"endpoint"`
+	Remote     string `json:"remote"`
+	Attempts   int    `json:"attempts"`
+	Failures   int    `json:"failures"`
+	Window     int    `json:"window"`
+	Time       int64  `json:"time"`
+}
+
+// authMetrics counts the authentication attempts by endpoint and by credential,
+// and raises an alert when the share of failures of a single credential spikes,
+// like under brute force or from a broken client retrying on 401s
+type authMetrics struct {
+	clock       clock
+	window      time.Duration
+	minFailures int
+	ratio       float64
+	webhook     string
+	mutex       sync.Mutex
+	endpoints   map[string]*authCounters
+	credentials map[string]*credentialStats
+}
+
+// AuthMetrics are the authentication metrics of the API
+var AuthMetrics *authMetrics
+
+func newAuthMetrics(conf httpapi, c clock) *authMetrics {
+	return &authMetrics{
+		clock:       c,
+		window:      time.Duration(conf.AuthAlertWindow) * time.Second,
+		minFailures: conf.AuthAlertMinFailures,
+		ratio:       conf.AuthAlertRatio,
+		webhook:     conf.AuthAlertWebhook,
+		endpoints:   make(map[string]*authCounters),
+		credentials: make(map[string]*credentialStats),
+	}
+}
+
+// Record counts an attempt on the endpoint with the credential, returning the
+// attempts and failures within the window if they call for an alert. An alert is
+// raised at most once per window for each credential.
+func (m *authMetrics) Record(endpoint string, credential string, ok bool) (int, int, bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	now := clockOrSystem(m.clock).Now()
+	counters := m.endpoints[endpoint]
+	if counters == nil {
+		counters = &authCounters{}
+		m.endpoints[endpoint] = counters
+	}
+	counters.add(ok)
+	if credential == "" {
+		return 0, 0, false
+	}
+	stats := m.credentials[credential]
+	if stats == nil {
+		if len(m.credentials) >= maxTrackedCredentials {
+			m.forgetIdle(now)
+		}
+		if len(m.credentials) >= maxTrackedCredentials {
+			return 0, 0, false
+		}
+		stats = &credentialStats{}
+		m.credentials[credential] = stats
+	}
+	stats.add(ok)
+	stats.recent = append(stats.recent, authAttempt{now, ok})
+	stats.prune(now.Add(-m.window))
+	failures := stats.failures()
+	if ok || failures < m.minFailures || float64(failures) < m.ratio*float64(len(stats.recent)) {
+		return len(stats.recent), failures, false
+	}
+	if !stats.alerted.IsZero() && now.Sub(stats.alerted) < m.window {
+		return len(stats.recent), failures, false
+	}
+	stats.alerted = now
+	return len(stats.recent), failures, true
+}
+
+// forgetIdle drops the credentials without attempts within the window
+func (m *authMetrics) forgetIdle(now time.Time) {
+	for credential, stats := range m.credentials {
+		stats.prune(now.Add(-m.window))
+		if len(stats.recent) == 0 {
+			delete(m.credentials, credential)
+		}
+	}
+}
+
+func (c *authCounters) add(ok bool) {
+	if ok {
+		c.Success++
+	} else {
+		c.Failure++
+	}
+}
+
+// prune drops the attempts made before the time
+func (s *credentialStats) prune(before time.Time) {
+	i := 0
+	for i < len(s.recent) && s.recent[i].time.Before(before) {
+		i++
+	}
+	s.recent = s.recent[i:]
+}
+
+func (s *credentialStats) failures() int {
+	failures := 0
+	for _, a := range s.recent {
+		if !a.ok {
+			failures++
+		}
+	}
+	return failures
+}
+
+// recordAuthResult counts the authentication attempt of the request and raises an
+// alert if the credential fails too often
+func recordAuthResult(r *http.Request, ok bool) {
+	if AuthMetrics == nil {
+		return
+	}
+	endpoint, _ := r.Context().Value(RouteKey).(string)
+	credential := requestActor(r)
+	attempts, failures, alert := AuthMetrics.Record(endpoint, credential, ok)
+	if alert {
+		alertAuthFailures(r, authAlertEvent{"auth_failure_spike", credential, endpoint, getRequestIP(r), attempts, failures, int(AuthMetrics.window.Seconds()), time.Now().Unix()})
+	}
+}
+
+// alertAuthFailures reports the spike of authentication failures of a credential
+func alertAuthFailures(r *http.Request, event authAlertEvent) {
+	apiLog.WithFields(log.Fields{"credential": event.Credential, "endpoint": event.Endpoint, "remote": event.Remote, "attempts": event.Attempts, "failures": event.Failures}).Warning("Authentication failures of a credential spiked")
+	auditRequest(r, "auth_anomaly", "", fmt.Sprintf("%d of %d attempts failed within %ds", event.Failures, event.Attempts, event.Window))
+	if AuthMetrics.webhook == "" {
+		return
+	}
+	body, err := json.Marshal(event)
+	if err != nil {
+		apiLog.WithFields(log.Fields{"error": err.Error()}).Error("Could not marshal authentication alert")
+		return
+	}
+	go postWebhook(AuthMetrics.webhook, body)
+}
+
+// credentialMetrics are the counters of a credential reported by the admin API
+type credentialMetrics struct {
+	authCounters
+	RecentAttempts int  `json:"recent_attempts"`
+	RecentFailures int  `json:"recent_failures"`
+	Alerted        bool `json:"alerted"`
+}
+
+// Snapshot returns a copy of the counters by endpoint and by credential
+func (m *authMetrics) Snapshot() (map[string]authCounters, map[string]credentialMetrics) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	now := clockOrSystem(m.clock).Now()
+	endpoints := make(map[string]authCounters, len(m.endpoints))
+	for endpoint, c := range m.endpoints {
+		endpoints[endpoint] = *c
+	}
+	credentials := make(map[string]credentialMetrics, len(m.credentials))
+	for credential, stats := range m.credentials {
+		stats.prune(now.Add(-m.window))
+		credentials[credential] = credentialMetrics{
+			authCounters:   stats.authCounters,
+			RecentAttempts: len(stats.recent),
+			RecentFailures: stats.failures(),
+			Alerted:        !stats.alerted.IsZero() && now.Sub(stats.alerted) < m.window,
+		}
+	}
+	return endpoints, credentials
+}
+
+// webAdminAuthMetrics reports the authentication attempts by endpoint and by
+// credential since the start
+func webAdminAuthMetrics(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	if AuthMetrics == nil {
+		WriteJsonResponse(w, http.StatusNotFound, jsonError("not_found"))
+		return
+	}
+	endpoints, credentials := AuthMetrics.Snapshot()
+	var verifications *verificationMetrics
+	if Verifications != nil {
+		m := Verifications.Metrics()
+		verifications = &m
+	}
+	out, _ := json.Marshal(struct {
+		Window        int                          `json:"window"`
+		Endpoints     map[string]authCounters      `json:"endpoints"`
+		Credentials   map[string]credentialMetrics `json:"credentials"`
+		Verifications *verificationMetrics         `json:"verifications,omitempty"`
+	}{int(AuthMetrics.window.Seconds()), endpoints, credentials, verifications})
+	WriteJsonResponse(w, http.StatusOK, out)
+}
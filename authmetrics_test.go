@@ -0,0 +1,85 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestAuthMetricsAlert(t *testing.T) {
+	c := newFrozenClock(time.Unix(1700000000, 0))
+	m := newAuthMetrics(httpapi{AuthAlertWindow: 60, AuthAlertMinFailures: 3, AuthAlertRatio: 0.5}, c)
+
+	m.Record("POST /update", "user", true)
+	m.Record("POST /update", "user", true)
+	m.Record("POST /update", "user", false)
+	if _, _, alert := m.Record("POST /update", "user", false); alert {
+		t.Errorf("Expected no alert below the minimum number of failures")
+	}
+	attempts, failures, alert := m.Record("POST /update", "user", false)
+	if !alert || attempts != 5 || failures != 3 {
+		t.Errorf("Expected an alert for 3 of 5 failed attempts, got %v for %d of %d", alert, failures, attempts)
+	}
+	if _, _, alert = m.Record("POST /update", "user", false); alert {
+		t.Errorf("Expected a single alert within the window")
+	}
+	// Failures of other credentials don't count
+	if _, _, alert = m.Record("POST /update", "other", false); alert {
+		t.Errorf("Expected no alert for another credential")
+	}
+
+	// The attempts before the window are forgotten
+	c.Advance(2 * time.Minute)
+	m.Record("POST /update", "user", true)
+	m.Record("POST /update", "user", true)
+	m.Record("POST /update", "user", false)
+	m.Record("POST /update", "user", false)
+	if _, _, alert = m.Record("POST /update", "user", true); alert {
+		t.Errorf("Expected no alert for a successful attempt")
+	}
+
+	endpoints, credentials := m.Snapshot()
+	if got := endpoints["POST /update"]; got.Success != 5 || got.Failure != 7 {
+		t.Errorf("Expected 5 successful and 7 failed attempts on the endpoint, got %+v", got)
+	}
+	if got := credentials["user"]; got.Failure != 6 || got.RecentAttempts != 5 || got.RecentFailures != 2 || got.Alerted {
+		t.Errorf("Unexpected counters of the credential: %+v", got)
+	}
+}
+
+func TestAuthMetricsEndpoint(t *testing.T) {
+	_ = setupRouter(false, false)
+	AuthMetrics = newAuthMetrics(httpapi{AuthAlertWindow: 60, AuthAlertMinFailures: 2, AuthAlertRatio: 1}, nil)
+	defer func() { AuthMetrics = nil }()
+	api := newRouter()
+	api.POST("/update", webUpdatePost, AuthForUpdate)
+	api.Group("/admin", AuthForAdmin).GET("/auth/metrics", webAdminAuthMetrics)
+	server := httptest.NewServer(api)
+	defer server.Close()
+	e := getExpect(t, server)
+	if err := DB.CreateAdmin("metrics", "hunter2"); err != nil {
+		t.Fatalf("Could not create admin user [%v]", err)
+	}
+	reg, _ := DB.Register(cidrslice{}, registrationOrigin{}, ACMETxtPost{})
+
+	for i := 0; i < 2; i++ {
+		e.POST("/update").
+			WithJSON(map[string]string{"subdomain": reg.Subdomain, "txt": "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"}).
+			WithHeader("X-Api-User", reg.Username.String()).
+			WithHeader("X-Api-Key", "wrongpasswordwrongpasswordwrongpassword1234").
+			Expect().
+			Status(http.StatusUnauthorized)
+	}
+
+	metrics := e.GET("/admin/auth/metrics").
+		WithBasicAuth("metrics", "hunter2").
+		Expect().
+		Status(http.StatusOK).
+		JSON().Object()
+	metrics.ValueEqual("window", 60)
+	metrics.Value("endpoints").Object().Value("POST /update").Object().ValueEqual("success", 0).ValueEqual("failure", 2)
+	metrics.Value("credentials").Object().Value(reg.Username.String()).Object().
+		ValueEqual("recent_failures", 2).
+		ValueEqual("alerted", true)
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// BackendFactory returns a new, uninitialized database backend. The backend is
+// initialized with the engine name and connection string from the config by
+// calling its Init method.
+type BackendFactory func() database
+
+var (
+	backendsMutex sync.RWMutex
+	backends      = make(map[string]BackendFactory)
+)
+
+// RegisterBackend makes a database backend available under the engine name used
+// in the database section of the config. It panics if the name is already taken
+// or the factory is nil. The backends are part of this package, each one
+// registering itself from the init function of its file, as the database
+// interface can't be implemented outside of it.
+func RegisterBackend(name string, factory BackendFactory) {
+	backendsMutex.Lock()
+	defer backendsMutex.Unlock()
+	if factory == nil {
+		panic("acme-dns: RegisterBackend factory is nil")
+	}
+	if _, dup := backends[name]; dup {
+		panic("acme-dns: RegisterBackend called twice for backend " + name)
+	}
+	backends[name] = factory
+}
+
+// Backends returns a sorted list of the names of the registered backends
+func Backends() []string {
+	backendsMutex.RLock()
+	defer backendsMutex.RUnlock()
+	names := make([]string, 0, len(backends))
+	for name := range backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// newBackend returns a new, uninitialized backend for the engine
+func newBackend(engine string) (database, error) {
+	backendsMutex.RLock()
+	factory, ok := backends[engine]
+	backendsMutex.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown database engine %q, available engines: %v", engine, Backends())
+	}
+	return factory(), nil
+}
+
+// openBackend returns a backend for the engine initialized with the connection string
+func openBackend(engine string, connection string) (database, error) {
+	db, err := newBackend(engine)
+	if err != nil {
+		return nil, err
+	}
+	return db, db.Init(engine, connection)
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"testing"
+)
+
+// fakeBackend is a backend registered by the test, wrapping the test database
+type fakeBackend struct {
+	database
+	engine     string
+	connection string
+}
+
+func (f *fakeBackend) Init(engine string, connection string) error {
+	f.engine = engine
+	f.connection = connection
+	return nil
+}
+
+func TestRegisterBackend(t *testing.T) {
+	if _, err := newBackend("fake"); err != nil {
+		RegisterBackend("fake", func() database {
+			return &fakeBackend{database: DB}
+		})
+	}
+	db, err := openBackend("fake", "fake://connection")
+	if err != nil {
+		t.Fatalf("Could not open registered backend [%v]", err)
+	}
+	fake, ok := db.(*fakeBackend)
+	if !ok {
+		t.Fatalf("Expected the registered backend, got %T", db)
+	}
+	if fake.engine != "fake" || fake.connection != "fake://connection" {
+		t.Errorf("Expected the backend to be initialized with the config values")
+	}
+	found := false
+	for _, name := range Backends() {
+		if name == "fake" {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("Expected registered backend to be listed, got %v", Backends())
+	}
+}
+
+func TestBuiltinBackends(t *testing.T) {
+	for _, engine := range []string{"sqlite3", "postgres"} {
+		db, err := newBackend(engine)
+		if err != nil {
+			t.Errorf("Expected built-in backend %s, got error [%v]", engine, err)
+		}
+		if _, ok := db.(*acmedb); !ok {
+			t.Errorf("Expected SQL backend for %s, got %T", engine, db)
+		}
+	}
+	if _, err := newBackend("nonexistent"); err == nil {
+		t.Errorf("Expected error for an unknown backend")
+	}
+}
+
+func TestRegisterBackendTwice(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Errorf("Expected registering a backend twice to panic")
+		}
+	}()
+	RegisterBackend("sqlite3", newSQLBackend)
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	log "github.com/sirupsen/logrus"
+)
+
+// maxBatchUpdates is the highest number of updates in a batch
+const maxBatchUpdates = 100
+
+// batchUpdateRequest is the payload of the batch update endpoint
+type batchUpdateRequest struct {
+	Updates []ACMETxtPost `json:"updates"`
+}
+
+// prefixDetails prefixes the fields of the details with the position of the
+// update in the batch
+func prefixDetails(i int, details []fieldError) []fieldError {
+	prefixed := make([]fieldError, 0, len(details))
+	for _, d := range details {
+		prefixed = append(prefixed, fieldError{fmt.Sprintf("updates[%d].%s", i, d.Field), d.Message})
+	}
+	return prefixed
+}
+
+// validateBatch validates the updates of the batch like single updates, returning
+// the error code of the first invalid one with the details of all of them
+func validateBatch(user ACMETxt, updates []ACMETxtPost) (int, string, []fieldError) {
+	if len(updates) == 0 || len(updates) > maxBatchUpdates {
+		return http.StatusBadRequest, "bad_request", []fieldError{{"updates", fmt.Sprintf("must have between 1 and %d updates", maxBatchUpdates)}}
+	}
+	status, code := 0, ""
+	var details []fieldError
+	fail := func(s int, c string, d []fieldError) {
+		if code == "" {
+			status, code = s, c
+		}
+		details = append(details, d...)
+	}
+	txt := 0
+	for i := range updates {
+		if updates[i].Subdomain == "" {
+			updates[i].Subdomain = user.Subdomain
+		}
+		if updates[i].Subdomain != user.Subdomain {
+			return http.StatusForbidden, "forbidden", nil
+		}
+		if c, d := validateUpdatePost(&updates[i]); c != "" {
+			fail(http.StatusBadRequest, c, prefixDetails(i, d))
+			continue
+		}
+		op := user
+		op.ACMETxtPost = updates[i]
+		if d := disallowedTypeDetails(op); len(d) > 0 {
+			fail(http.StatusForbidden, "record_type_not_allowed", prefixDetails(i, d))
+		}
+		if updates[i].Value != "" {
+			txt++
+		}
+	}
+	// More values would overwrite the ones written earlier in the batch
+	if code == "" && txt > txtSlotCount() {
+		fail(http.StatusBadRequest, "bad_txt", []fieldError{{"updates", fmt.Sprintf("at most %d txt values can be set at once", txtSlotCount())}})
+	}
+	return status, code, details
+}
+
+// webUpdateBatchPost applies the updates of the authenticated registration in a
+// single transaction, so that either all of them or none take effect
+func webUpdateBatchPost(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	user, ok := r.Context().Value(ACMETxtKey).(ACMETxt)
+	if !ok {
+		apiLog.WithFields(log.Fields{"error": "context"}).Error("Context error")
+		WriteJsonResponse(w, http.StatusInternalServerError, jsonError("context_error"))
+		return
+	}
+	var req batchUpdateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		WriteJsonResponse(w, http.StatusBadRequest, jsonFieldErrors("malformed_json_payload", decodeErrorDetails(err)))
+		return
+	}
+	status, code, details := validateBatch(user, req.Updates)
+	if code != "" {
+		apiLog.WithFields(log.Fields{"error": code, "subdomain": user.Subdomain, "updates": len(req.Updates)}).Debug("Bad batch update data")
+		if details == nil {
+			WriteJsonResponse(w, status, jsonError(code))
+		} else {
+			WriteJsonResponse(w, status, jsonFieldErrors(code, details))
+		}
+		return
+	}
+	if isProtected(user.Subdomain) {
+		// Approvals are given to single updates
+		WriteJsonResponse(w, http.StatusForbidden, jsonError("approval_required"))
+		return
+	}
+	if err := DB.MarkActive(user.Username); err != nil {
+		apiLog.WithFields(log.Fields{"error": err.Error(), "subdomain": user.Subdomain}).Error("Could not update the last active time")
+	}
+	updated, err := DB.UpdateBatch(user.Subdomain, req.Updates)
+	if err == errDatabaseBusy {
+		w.Header().Set("Retry-After", "1")
+		WriteJsonResponse(w, http.StatusServiceUnavailable, jsonError("database_busy"))
+		return
+	}
+	if err != nil {
+		apiLog.WithFields(log.Fields{"error": err.Error(), "subdomain": user.Subdomain}).Debug("Error while trying to apply a batch update")
+		WriteJsonResponse(w, http.StatusInternalServerError, jsonError("db_error"))
+		return
+	}
+	apiLog.WithFields(log.Fields{"subdomain": user.Subdomain, "updates": len(updated)}).Debug("Batch update applied")
+	responses := make([][]byte, 0, len(updated))
+	for _, a := range updated {
+		event := webhookEvent{"update", a.Subdomain, a.Value, a.AValues, a.AAAAValues, time.Now().Unix(), a.CorrelationID, registrationZone(user)}
+		sendWebhooks(user.Webhooks, event)
+		runHooks(event)
+		responses = append(responses, updateResponse(a))
+	}
+	ZoneSerial.Bump("batch_update", user.Subdomain)
+	WriteJsonResponse(w, http.StatusOK, []byte("{\"updates\": ["+string(bytes.Join(responses, []byte(", ")))+"]}"))
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+	"sync/atomic"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// dummyHash is compared against when there is no stored hash, to protect against
+// timed side channel (never gonna give you up)
+const dummyHash = "$2a$10$8JEFVNYYhLoBysjAxe2yBuXrkDojBQBkVpXEQgyQyjn43SvJ4vL36"
+
+// errVerificationBusy is returned when the queue of the password verifications is full
+var errVerificationBusy = errors.New("too many password verifications queued")
+
+// Verifications is the worker pool verifying the passwords, nil to verify them
+// in the goroutine of the request
+var Verifications *verificationPool
+
+// verificationJob is a password waiting for a worker to compare it with the hash
+type verificationJob struct {
+	password string
+	hash     string
+	result   chan bool
+}
+
+// verificationPool compares the passwords with their bcrypt hashes with a fixed
+// number of workers, so that a burst of authentication attempts can't use all the
+// CPU and starve the DNS answers. Verifications arriving with the queue full are
+// refused instead of queued.
+type verificationPool struct {
+	workers  int
+	queue    chan verificationJob
+	busy     int64
+	verified uint64
+	rejected uint64
+	done     chan struct{}
+	wg       sync.WaitGroup
+}
+
+// newVerificationPool starts the workers, so that they're ready for the first
+// authentication attempt
+func newVerificationPool(workers int, queueSize int) *verificationPool {
+	if queueSize < 0 {
+		queueSize = 0
+	}
+	p := &verificationPool{
+		workers: workers,
+		queue:   make(chan verificationJob, queueSize),
+		done:    make(chan struct{}),
+	}
+	apiLog.WithFields(log.Fields{"workers": workers, "queue": queueSize}).Info("Starting password verification pool")
+	for i := 0; i < workers; i++ {
+		p.wg.Add(1)
+		go p.work()
+	}
+	return p
+}
+
+// Stop stops the workers, the queued verifications fail
+func (p *verificationPool) Stop() {
+	close(p.done)
+	p.wg.Wait()
+}
+
+func (p *verificationPool) work() {
+	defer p.wg.Done()
+	for {
+		select {
+		case job := <-p.queue:
+			atomic.AddInt64(&p.busy, 1)
+			job.result <- correctPassword(job.password, job.hash)
+			atomic.AddInt64(&p.busy, -1)
+			atomic.AddUint64(&p.verified, 1)
+		case <-p.done:
+			return
+		}
+	}
+}
+
+// Verify queues the comparison of the password with the hash and waits for its
+// result, errVerificationBusy if the queue is full
+func (p *verificationPool) Verify(password string, hash string) (bool, error) {
+	job := verificationJob{password, hash, make(chan bool, 1)}
+	select {
+	case p.queue <- job:
+	default:
+		rejected := atomic.AddUint64(&p.rejected, 1)
+		if rejected&(rejected-1) == 0 {
+			// Log with exponentially decreasing frequency during a burst
+			apiLog.WithFields(log.Fields{"rejected": rejected, "queue": cap(p.queue)}).Warn("Password verification queue full, refusing authentication attempts")
+		}
+		return false, errVerificationBusy
+	}
+	select {
+	case ok := <-job.result:
+		return ok, nil
+	case <-p.done:
+		return false, errVerificationBusy
+	}
+}
+
+// verificationMetrics is the saturation of the verification pool
+type verificationMetrics struct {
+	Workers       int    `json:"workers"`
+	Busy          int64  `json:"busy"`
+	QueueLength   int    `json:"queue_length"`
+	QueueCapacity int    `json:"queue_capacity"`
+	Verified      uint64 `json:"verified"`
+	Rejected      uint64 `json:"rejected"`
+}
+
+// Metrics returns the current saturation of the pool
+func (p *verificationPool) Metrics() verificationMetrics {
+	return verificationMetrics{
+		Workers:       p.workers,
+		Busy:          atomic.LoadInt64(&p.busy),
+		QueueLength:   len(p.queue),
+		QueueCapacity: cap(p.queue),
+		Verified:      atomic.LoadUint64(&p.verified),
+		Rejected:      atomic.LoadUint64(&p.rejected),
+	}
+}
+
+// verifyPassword compares the password with the hash in the verification pool if
+// enabled
+func verifyPassword(password string, hash string) (bool, error) {
+	if Verifications == nil {
+		return correctPassword(password, hash), nil
+	}
+	return Verifications.Verify(password, hash)
+}
+
+// writeVerificationBusy answers a request that couldn't be authenticated because
+// the verification queue was full
+func writeVerificationBusy(w http.ResponseWriter) {
+	w.Header().Set("Retry-After", "1")
+	WriteJsonResponse(w, http.StatusServiceUnavailable, jsonError("authentication_busy"))
+}
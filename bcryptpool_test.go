@@ -0,0 +1,67 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestVerificationPool(t *testing.T) {
+	hash, _ := bcrypt.GenerateFromPassword([]byte("hunter2"), bcrypt.MinCost)
+	pool := newVerificationPool(2, 4)
+	defer pool.Stop()
+	if ok, err := pool.Verify("hunter2", string(hash)); !ok || err != nil {
+		t.Errorf("Expected the correct password to verify, got %t and error %v", ok, err)
+	}
+	if ok, err := pool.Verify("hunter3", string(hash)); ok || err != nil {
+		t.Errorf("Expected the wrong password to fail, got %t and error %v", ok, err)
+	}
+	if m := pool.Metrics(); m.Workers != 2 || m.QueueCapacity != 4 || m.Verified != 2 || m.Rejected != 0 {
+		t.Errorf("Unexpected metrics %+v", m)
+	}
+
+	// Without workers the queue fills up
+	saturated := newVerificationPool(0, 1)
+	defer saturated.Stop()
+	saturated.queue <- verificationJob{"hunter2", string(hash), make(chan bool, 1)}
+	if _, err := saturated.Verify("hunter2", string(hash)); err != errVerificationBusy {
+		t.Errorf("Expected the verification to be refused with the queue full, got %v", err)
+	}
+	if m := saturated.Metrics(); m.QueueLength != 1 || m.Rejected != 1 {
+		t.Errorf("Expected the saturation in the metrics, got %+v", m)
+	}
+}
+
+func TestApiVerificationBusy(t *testing.T) {
+	_ = setupRouter(false, false)
+	user, err := DB.Register(cidrslice{}, registrationOrigin{}, ACMETxtPost{})
+	if err != nil {
+		t.Fatalf("Could not create new user, got error [%v]", err)
+	}
+	saturated := newVerificationPool(0, 0)
+	defer saturated.Stop()
+	oldVerifications := Verifications
+	Verifications = saturated
+	defer func() { Verifications = oldVerifications }()
+	api := httprouter.New()
+	api.POST("/allowfrom", AuthForAccount(webAllowFromPost))
+	server := httptest.NewServer(api)
+	defer server.Close()
+	e := getExpect(t, server)
+
+	e.POST("/allowfrom").
+		WithJSON(map[string]interface{}{"allowfrom": []string{}}).
+		WithHeader("X-Api-User", user.Username.String()).
+		WithHeader("X-Api-Key", user.Password).
+		Expect().
+		Status(http.StatusServiceUnavailable).
+		Header("Retry-After").Equal("1")
+	if AuthMetrics != nil {
+		if endpoints, _ := AuthMetrics.Snapshot(); endpoints["POST /allowfrom"].Failure != 0 {
+			t.Errorf("Expected the refused attempt not to count as a failure, got %+v", endpoints)
+		}
+	}
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/julienschmidt/httprouter"
+	log "github.com/sirupsen/logrus"
+)
+
+// bulkPreviewTTL is the time an admin has to confirm a previewed bulk operation
+const bulkPreviewTTL = 5 * time.Minute
+
+// bulkActions lists the supported bulk operations
+var bulkActions = []string{"disable", "enable", "rotate_keys", "delete"}
+
+// bulkFilter selects the registrations a bulk operation applies to. All the
+// set criteria must match.
+type bulkFilter struct {
+	CreatedBy   string `json:"created_by"`
+	CreatedFrom string `json:"created_from"`
+	Tag         string `json:"tag"`
+	// UnusedDays matches registrations without TXT updates for at least this many days
+	UnusedDays int `json:"unused_days"`
+}
+
+// bulkRequest is the payload of the bulk operation preview request
+type bulkRequest struct {
+	Action string     `json:"action"`
+	Filter bulkFilter `json:"filter"`
+}
+
+// bulkTarget is a registration affected by a bulk operation
+type bulkTarget struct {
+	Username   string `json:"username"`
+	Subdomain  string `json:"subdomain"`
+	Fulldomain string `json:"fulldomain"`
+	Password   string `json:"password,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+// bulkOperation is a previewed bulk operation waiting for confirmation
+type bulkOperation struct {
+	Admin   string
+	Action  string
+	Targets []bulkTarget
+	Expires time.Time
+}
+
+// bulkResponse is the response of both the preview and the confirm requests
+type bulkResponse struct {
+	Action        string       `json:"action"`
+	Confirm       string       `json:"confirm,omitempty"`
+	Expires       int64        `json:"expires,omitempty"`
+	Count         int          `json:"count"`
+	Registrations []bulkTarget `json:"registrations"`
+}
+
+// bulkOperations holds the previewed bulk operations until they are confirmed or expire
+type bulkOperations struct {
+	mutex      sync.Mutex
+	clock      clock
+	operations map[string]*bulkOperation
+}
+
+// bulkPreviews are the pending bulk operations of the API
+var bulkPreviews = newBulkOperations(nil)
+
+func newBulkOperations(c clock) *bulkOperations {
+	return &bulkOperations{
+		clock:      clockOrSystem(c),
+		operations: make(map[string]*bulkOperation),
+	}
+}
+
+// add stores the operation and returns the token confirming it
+func (b *bulkOperations) add(op *bulkOperation) string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	now := b.clock.Now()
+	for token, pending := range b.operations {
+		if now.After(pending.Expires) {
+			delete(b.operations, token)
+		}
+	}
+	op.Expires = now.Add(bulkPreviewTTL)
+	token := generatePassword(32)
+	b.operations[token] = op
+	return token
+}
+
+// take removes and returns the operation of the token if it was previewed by the admin
+// and has not expired
+func (b *bulkOperations) take(token string, admin string) (*bulkOperation, bool) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	op, ok := b.operations[token]
+	if !ok || op.Admin != admin {
+		return nil, false
+	}
+	delete(b.operations, token)
+	if b.clock.Now().After(op.Expires) {
+		return nil, false
+	}
+	return op, true
+}
+
+// empty checks if the filter has no criteria
+func (f bulkFilter) empty() bool {
+	return f.CreatedBy == "" && f.CreatedFrom == "" && f.Tag == "" && f.UnusedDays == 0
+}
+
+// matches checks the criteria not handled by ListRegistrations
+func (f bulkFilter) matches(a ACMETxt, now time.Time) bool {
+	if f.Tag != "" && !a.hasTag(f.Tag) {
+		return false
+	}
+	if f.UnusedDays > 0 {
+		lastUsed := a.LastUpdate
+		if a.Origin.CreatedAt > lastUsed {
+			lastUsed = a.Origin.CreatedAt
+		}
+		if now.Sub(time.Unix(lastUsed, 0)) < time.Duration(f.UnusedDays)*24*time.Hour {
+			return false
+		}
+	}
+	return true
+}
+
+// validateBulkRequest returns details of every invalid field of the request
+func validateBulkRequest(req bulkRequest) []fieldError {
+	var details []fieldError
+	known := false
+	for _, action := range bulkActions {
+		if req.Action == action {
+			known = true
+		}
+	}
+	if !known {
+		details = append(details, fieldError{"action", "must be one of disable, enable, rotate_keys, delete"})
+	}
+	if req.Filter.empty() {
+		details = append(details, fieldError{"filter", "at least one criterion is required"})
+	}
+	if req.Filter.UnusedDays < 0 {
+		details = append(details, fieldError{"filter.unused_days", "must not be negative"})
+	}
+	if req.Filter.Tag != "" && !validTag(req.Filter.Tag) {
+		details = append(details, fieldError{"filter.tag", "not a valid tag"})
+	}
+	return details
+}
+
+// webAdminBulkPreview lists the registrations a bulk operation would apply to and
+// returns a token for confirming it
+func webAdminBulkPreview(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	var req bulkRequest
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&req); err != nil {
+		WriteJsonResponse(w, http.StatusBadRequest, jsonFieldErrors("malformed_json_payload", decodeErrorDetails(err)))
+		return
+	}
+	if details := validateBulkRequest(req); len(details) > 0 {
+		WriteJsonResponse(w, http.StatusBadRequest, jsonFieldErrors("bad_bulk_request", details))
+		return
+	}
+	regs, err := DB.ListRegistrations(registrationOrigin{CreatedBy: req.Filter.CreatedBy, CreatedFrom: req.Filter.CreatedFrom})
+	if err != nil {
+		apiLog.WithFields(log.Fields{"error": err.Error()}).Error("Error while listing registrations")
+		WriteJsonResponse(w, http.StatusInternalServerError, jsonError("db_error"))
+		return
+	}
+	admin, _ := r.Context().Value(AdminKey).(string)
+	op := &bulkOperation{Admin: admin, Action: req.Action, Targets: []bulkTarget{}}
+	now := bulkPreviews.clock.Now()
+	for _, reg := range regs {
+		if req.Filter.matches(reg, now) {
+			op.Targets = append(op.Targets, bulkTarget{Username: reg.Username.String(), Subdomain: reg.Subdomain, Fulldomain: fullDomain(reg)})
+		}
+	}
+	token := bulkPreviews.add(op)
+	apiLog.WithFields(log.Fields{"admin": admin, "action": req.Action, "count": len(op.Targets)}).Info("Bulk operation previewed")
+	out, _ := json.Marshal(bulkResponse{req.Action, token, op.Expires.Unix(), len(op.Targets), op.Targets})
+	WriteJsonResponse(w, http.StatusOK, out)
+}
+
+// webAdminBulkConfirm runs a previewed bulk operation on the registrations listed in the preview
+func webAdminBulkConfirm(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	var req struct {
+		Confirm string `json:"confirm"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		WriteJsonResponse(w, http.StatusBadRequest, jsonFieldErrors("malformed_json_payload", decodeErrorDetails(err)))
+		return
+	}
+	admin, _ := r.Context().Value(AdminKey).(string)
+	op, ok := bulkPreviews.take(req.Confirm, admin)
+	if !ok {
+		WriteJsonResponse(w, http.StatusConflict, jsonError("invalid_confirmation"))
+		return
+	}
+	done := 0
+	for i := range op.Targets {
+		target := &op.Targets[i]
+		err := runBulkAction(op.Action, target)
+		if err != nil {
+			apiLog.WithFields(log.Fields{"error": err.Error(), "action": op.Action, "user": target.Username}).Error("Error in bulk operation")
+			target.Error = err.Error()
+			continue
+		}
+		done++
+	}
+	apiLog.WithFields(log.Fields{"admin": admin, "action": op.Action, "count": done, "failed": len(op.Targets) - done}).Info("Bulk operation confirmed")
+	if done > 0 && op.Action != "rotate_keys" {
+		// Disabled and deleted registrations are no longer served
+		ZoneSerial.Bump("bulk_"+op.Action, "")
+	}
+	out, _ := json.Marshal(bulkResponse{Action: op.Action, Count: done, Registrations: op.Targets})
+	WriteJsonResponse(w, http.StatusOK, out)
+}
+
+// runBulkAction applies the action to a single registration, setting the new
+// password to the target when rotating keys
+func runBulkAction(action string, target *bulkTarget) error {
+	username, err := uuid.Parse(target.Username)
+	if err != nil {
+		return err
+	}
+	switch action {
+	case "disable", "enable":
+		return DB.SetDisabled(username, action == "disable")
+	case "rotate_keys":
+		password := generatePassword(40)
+		if err = DB.SetPassword(username, password); err != nil {
+			return err
+		}
+		target.Password = password
+		return nil
+	case "delete":
+		return DB.DeleteRegistration(username)
+	}
+	return nil
+}
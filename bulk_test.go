@@ -0,0 +1,185 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gavv/httpexpect"
+	"github.com/julienschmidt/httprouter"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func setupBulkRouter(t *testing.T) (*httpexpect.Expect, *frozenClock) {
+	_ = setupRouter(false, false)
+	clk := withFrozenClock(t, time.Unix(1700000000, 0))
+	oldPreviews := bulkPreviews
+	bulkPreviews = newBulkOperations(clk)
+	t.Cleanup(func() { bulkPreviews = oldPreviews })
+	api := httprouter.New()
+	api.POST("/update", AuthForUpdate(webUpdatePost))
+	api.POST("/admin/bulk/preview", AuthForAdmin(webAdminBulkPreview))
+	api.POST("/admin/bulk/confirm", AuthForAdmin(webAdminBulkConfirm))
+	server := httptest.NewServer(api)
+	t.Cleanup(server.Close)
+	hash, _ := bcrypt.GenerateFromPassword([]byte("hunter2"), 10)
+	for _, admin := range []string{"alice", "bob"} {
+		_, _ = DB.(*acmedb).DB.Exec("DELETE FROM admins WHERE Username=$1", admin)
+		if _, err := DB.(*acmedb).DB.Exec("INSERT INTO admins (Username, Password) values($1, $2)", admin, string(hash)); err != nil {
+			t.Fatalf("Could not create admin user [%v]", err)
+		}
+	}
+	return getExpect(t, server), clk
+}
+
+func registerTagged(t *testing.T, tags ...string) ACMETxt {
+	reg, err := DB.Register(cidrslice{}, registrationOrigin{CreatedBy: "alice"}, ACMETxtPost{})
+	if err != nil {
+		t.Fatalf("Could not register [%v]", err)
+	}
+	if err = DB.UpdateSettings(reg.Username, registrationSettings{Tags: tags}); err != nil {
+		t.Fatalf("Could not tag the registration [%v]", err)
+	}
+	return reg
+}
+
+func bulkPreview(e *httpexpect.Expect, admin string, body map[string]interface{}) *httpexpect.Object {
+	return e.POST("/admin/bulk/preview").
+		WithBasicAuth(admin, "hunter2").
+		WithJSON(body).
+		Expect().
+		Status(http.StatusOK).
+		JSON().Object()
+}
+
+func TestApiBulkDisable(t *testing.T) {
+	e, _ := setupBulkRouter(t)
+	reg := registerTagged(t, "fleet-a")
+	registerTagged(t, "fleet-b")
+
+	preview := bulkPreview(e, "alice", map[string]interface{}{"action": "disable", "filter": map[string]interface{}{"tag": "fleet-a"}})
+	preview.ValueEqual("count", 1)
+	preview.Value("registrations").Array().Element(0).Object().ValueEqual("subdomain", reg.Subdomain)
+	token := preview.Value("confirm").String().Raw()
+
+	// Nothing is changed before the confirmation
+	if user, _ := DB.GetByUsername(reg.Username); user.Disabled {
+		t.Errorf("Expected the registration to stay enabled before the confirmation")
+	}
+	// Tokens are bound to the admin who previewed the operation
+	e.POST("/admin/bulk/confirm").
+		WithBasicAuth("bob", "hunter2").
+		WithJSON(map[string]string{"confirm": token}).
+		Expect().
+		Status(http.StatusConflict)
+
+	e.POST("/admin/bulk/confirm").
+		WithBasicAuth("alice", "hunter2").
+		WithJSON(map[string]string{"confirm": token}).
+		Expect().
+		Status(http.StatusOK).
+		JSON().Object().
+		ValueEqual("count", 1)
+	if user, _ := DB.GetByUsername(reg.Username); !user.Disabled {
+		t.Errorf("Expected the registration to be disabled")
+	}
+	e.POST("/update").
+		WithJSON(map[string]string{"subdomain": reg.Subdomain, "txt": "LHDhK3oGRvkiefQnx7OOczTY5Tic_xZ6HcMOc_gmtoM"}).
+		WithHeader("X-Api-User", reg.Username.String()).
+		WithHeader("X-Api-Key", reg.Password).
+		Expect().
+		Status(http.StatusForbidden).
+		JSON().Object().
+		ValueEqual("error", "registration_disabled")
+
+	// Tokens can be used only once
+	e.POST("/admin/bulk/confirm").
+		WithBasicAuth("alice", "hunter2").
+		WithJSON(map[string]string{"confirm": token}).
+		Expect().
+		Status(http.StatusConflict)
+}
+
+func TestApiBulkRotateKeys(t *testing.T) {
+	e, _ := setupBulkRouter(t)
+	reg := registerTagged(t, "fleet-a", "rotate")
+	token := bulkPreview(e, "alice", map[string]interface{}{"action": "rotate_keys", "filter": map[string]interface{}{"tag": "rotate"}}).
+		Value("confirm").String().Raw()
+	result := e.POST("/admin/bulk/confirm").
+		WithBasicAuth("alice", "hunter2").
+		WithJSON(map[string]string{"confirm": token}).
+		Expect().
+		Status(http.StatusOK).
+		JSON().Object()
+	password := result.Value("registrations").Array().Element(0).Object().Value("password").String().Raw()
+	user, err := DB.GetByUsername(reg.Username)
+	if err != nil {
+		t.Fatalf("Could not fetch the registration [%v]", err)
+	}
+	if correctPassword(reg.Password, user.Password) || !correctPassword(password, user.Password) {
+		t.Errorf("Expected the key to be replaced with the returned one")
+	}
+}
+
+func TestApiBulkDeleteUnused(t *testing.T) {
+	e, clk := setupBulkRouter(t)
+	active := registerTagged(t, "gc")
+	clk.Advance(20 * 24 * time.Hour)
+	stale := registerTagged(t, "gc")
+	clk.Advance(20 * 24 * time.Hour)
+	if _, err := DB.Update(ACMETxtPost{Subdomain: active.Subdomain, Value: "LHDhK3oGRvkiefQnx7OOczTY5Tic_xZ6HcMOc_gmtoM"}); err != nil {
+		t.Fatalf("Could not update [%v]", err)
+	}
+	clk.Advance(20 * 24 * time.Hour)
+
+	// The stale registration was created 40 days ago, the active one updated 20 days ago
+	preview := bulkPreview(e, "alice", map[string]interface{}{"action": "delete", "filter": map[string]interface{}{"tag": "gc", "unused_days": 30}})
+	preview.ValueEqual("count", 1)
+	preview.Value("registrations").Array().Element(0).Object().ValueEqual("subdomain", stale.Subdomain)
+	token := preview.Value("confirm").String().Raw()
+
+	// The confirmation expires
+	clk.Advance(bulkPreviewTTL + time.Second)
+	e.POST("/admin/bulk/confirm").
+		WithBasicAuth("alice", "hunter2").
+		WithJSON(map[string]string{"confirm": token}).
+		Expect().
+		Status(http.StatusConflict)
+
+	token = bulkPreview(e, "alice", map[string]interface{}{"action": "delete", "filter": map[string]interface{}{"tag": "gc", "unused_days": 30}}).
+		Value("confirm").String().Raw()
+	e.POST("/admin/bulk/confirm").
+		WithBasicAuth("alice", "hunter2").
+		WithJSON(map[string]string{"confirm": token}).
+		Expect().
+		Status(http.StatusOK).
+		JSON().Object().
+		ValueEqual("count", 1)
+	if _, err := DB.GetByUsername(stale.Username); err == nil {
+		t.Errorf("Expected the unused registration to be deleted")
+	}
+	if txts, _ := DB.GetTXTForDomain(stale.Subdomain); len(txts) != 0 {
+		t.Errorf("Expected the TXT records of the deleted registration to be gone, got %v", txts)
+	}
+	if _, err := DB.GetByUsername(active.Username); err != nil {
+		t.Errorf("Expected the recently updated registration to remain [%v]", err)
+	}
+}
+
+func TestApiBulkValidation(t *testing.T) {
+	e, _ := setupBulkRouter(t)
+	response := e.POST("/admin/bulk/preview").
+		WithBasicAuth("alice", "hunter2").
+		WithJSON(map[string]interface{}{"action": "explode", "filter": map[string]interface{}{}}).
+		Expect().
+		Status(http.StatusBadRequest).
+		JSON().Object()
+	response.ValueEqual("error", "bad_bulk_request")
+	response.Value("details").Array().Length().Equal(2)
+
+	e.POST("/admin/bulk/preview").
+		WithJSON(map[string]interface{}{"action": "disable", "filter": map[string]interface{}{"tag": "x"}}).
+		Expect().
+		Status(http.StatusUnauthorized)
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	log "github.com/sirupsen/logrus"
+)
+
+// errCanaryUsed is returned when a request is made with the credentials of a canary registration
+var errCanaryUsed = errors.New("canary credentials used")
+
+// canaryEvent is the JSON payload POSTed to the canary webhook
+type canaryEvent struct {
+	Event     string `json:"event"`
+	Username  string `json:"username"`
+	Subdomain string `json:"subdomain"`
+	Remote    string `json:"remote"`
+	UserAgent string `json:"user_agent"`
+	Path      string `json:"path"`
+	Time      int64  `json:"time"`
+}
+
+// alertCanary reports that the credentials of the canary registration were used in the request
+func alertCanary(r *http.Request, user ACMETxt) {
+	event := canaryEvent{"canary_triggered", user.Username.String(), user.Subdomain, getRequestIP(r), r.UserAgent(), r.URL.Path, time.Now().Unix()}
+	apiLog.WithFields(log.Fields{"user": event.Username, "subdomain": event.Subdomain, "remote": event.Remote, "user_agent": event.UserAgent, "path": event.Path}).Warning("Canary credentials used, the credentials have leaked")
+	if Config.API.CanaryWebhook == "" {
+		return
+	}
+	body, err := json.Marshal(event)
+	if err != nil {
+		apiLog.WithFields(log.Fields{"error": err.Error()}).Error("Could not marshal canary event")
+		return
+	}
+	go postWebhook(Config.API.CanaryWebhook, body)
+}
+
+// webAdminCreateCanary creates a canary registration with a generated TXT value. Its
+// credentials are meant to be planted among real ones to detect leaks.
+func webAdminCreateCanary(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	admin, _ := r.Context().Value(AdminKey).(string)
+	zone, _ := assignZone("")
+	origin := registrationOrigin{CreatedBy: admin, CreatedFrom: getRequestIP(r), Zone: zone}
+	// Canary values look like the key authorizations of real challenges
+	nu, err := DB.Register(cidrslice{}, origin, ACMETxtPost{Value: generatePassword(43)})
+	if err == nil {
+		err = DB.SetCanary(nu.Username, true)
+	}
+	if err != nil {
+		apiLog.WithFields(log.Fields{"error": err.Error()}).Error("Error while creating a canary registration")
+		WriteJsonResponse(w, http.StatusInternalServerError, jsonError("db_error"))
+		return
+	}
+	apiLog.WithFields(log.Fields{"user": nu.Username.String(), "created_by": admin}).Info("Created canary registration")
+	out, _ := json.Marshal(RegResponse{nu.Username.String(), nu.Password, fullDomain(nu), nu.Subdomain, nu.AllowFrom.ValidEntries(), nu.Value, nu.Slot, nu.AValues, nu.AAAAValues, nu.Origin})
+	WriteJsonResponse(w, http.StatusCreated, out)
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestCanaryCredentials(t *testing.T) {
+	events := make(chan canaryEvent, 2)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event canaryEvent
+		_ = json.NewDecoder(r.Body).Decode(&event)
+		events <- event
+	}))
+	defer receiver.Close()
+	_ = setupRouter(false, false)
+	Config.API.CanaryWebhook = receiver.URL
+	defer func() { Config.API.CanaryWebhook = "" }()
+	api := httprouter.New()
+	api.POST("/admin/canaries", AuthForAdmin(webAdminCreateCanary))
+	api.POST("/update", AuthForUpdate(webUpdatePost))
+	server := httptest.NewServer(api)
+	defer server.Close()
+	e := getExpect(t, server)
+	hash, _ := bcrypt.GenerateFromPassword([]byte("hunter2"), 10)
+	_, _ = DB.(*acmedb).DB.Exec("DELETE FROM admins WHERE Username=$1", "alice")
+	if _, err := DB.(*acmedb).DB.Exec("INSERT INTO admins (Username, Password) values($1, $2)", "alice", string(hash)); err != nil {
+		t.Fatalf("Could not create admin user [%v]", err)
+	}
+
+	canary := e.POST("/admin/canaries").
+		WithBasicAuth("alice", "hunter2").
+		Expect().
+		Status(http.StatusCreated).
+		JSON().Object()
+	subdomain := canary.Value("subdomain").String().Raw()
+	txt := canary.Value("txt").String().Raw()
+	if !validTXT(txt) {
+		t.Errorf("Expected a realistic canary TXT value, got %q", txt)
+	}
+	if txts, _ := DB.GetTXTForDomain(subdomain); len(txts) == 0 || txts[0] != txt {
+		t.Errorf("Expected the canary TXT value to be served, got %v", txts)
+	}
+
+	for _, password := range []string{canary.Value("password").String().Raw(), "xxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxx"} {
+		e.POST("/update").
+			WithJSON(map[string]string{"subdomain": subdomain, "txt": "LHDhK3oGRvkiefQnx7OOczTY5Tic_xZ6HcMOc_gmtoM"}).
+			WithHeader("X-Api-User", canary.Value("username").String().Raw()).
+			WithHeader("X-Api-Key", password).
+			WithHeader("X-Forwarded-For", "203.0.113.7").
+			WithHeader("User-Agent", "leaked-client/1.0").
+			Expect().
+			Status(http.StatusForbidden).
+			JSON().Object().
+			ValueEqual("error", "forbidden")
+		select {
+		case event := <-events:
+			if event.Event != "canary_triggered" || event.Subdomain != subdomain || event.Remote != "203.0.113.7" || event.UserAgent != "leaked-client/1.0" {
+				t.Errorf("Unexpected canary event %+v", event)
+			}
+		case <-time.After(5 * time.Second):
+			t.Errorf("Canary webhook was not delivered")
+		}
+	}
+	if txts, _ := DB.GetTXTForDomain(subdomain); txts[0] != txt {
+		t.Errorf("Expected the canary TXT value to remain, got %v", txts)
+	}
+}
@@ -2,33 +2,113 @@ package main
 
 import (
 	"context"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 
+	"github.com/caddyserver/certmagic"
 	"github.com/mholt/acmez/v2/acme"
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
 )
 
+// certCacheCleanInterval is how often expired certificates are removed from the
+// certificate cache of the API, and certCacheGracePeriod how long they're kept
+// after they expired
+const (
+	certCacheCleanInterval = 24 * time.Hour
+	certCacheGracePeriod   = 7 * 24 * time.Hour
+)
+
+// ownChallenges are the key authorizations of the pending DNS-01 challenges of the
+// API certificates by the name being validated, shared by the DNS servers
+type ownChallenges struct {
+	// names are the names in the zone the challenges are answered for, besides the
+	// domain itself
+	names    map[string]bool
+	mutex    sync.RWMutex
+	keyAuths map[string]string
+}
+
+func newOwnChallenges(config DNSConfig) *ownChallenges {
+	c := &ownChallenges{names: make(map[string]bool), keyAuths: make(map[string]string)}
+	zone := dns.Fqdn(strings.ToLower(config.General.Domain))
+	for _, name := range apiCertNames(config) {
+		if name := dns.Fqdn(name); dns.IsSubDomain(zone, name) {
+			c.names[name] = true
+		}
+	}
+	return c
+}
+
+// apiCertNames returns the names of the API certificates: the domain followed by
+// the alternative names
+func apiCertNames(config DNSConfig) []string {
+	names := []string{strings.ToLower(strings.TrimSuffix(config.General.Domain, "."))}
+	seen := map[string]bool{names[0]: true}
+	for _, name := range config.API.TLSAltNames {
+		name = strings.ToLower(strings.TrimSuffix(strings.TrimSpace(name), "."))
+		if name != "" && !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// serves tells if the challenges are answered at the _acme-challenge name of the
+// name, which the domain always is
+func (c *ownChallenges) serves(name string) bool {
+	return c != nil && c.names[name]
+}
+
+// keyAuthorizations returns the pending key authorizations in a stable order. The
+// CA accepts any of them, so names outside of the zone can alias their challenge
+// name to the one of the domain.
+func (c *ownChallenges) keyAuthorizations() []string {
+	if c == nil {
+		return nil
+	}
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	var keyAuths []string
+	for _, keyAuth := range c.keyAuths {
+		keyAuths = append(keyAuths, keyAuth)
+	}
+	sort.Strings(keyAuths)
+	return keyAuths
+}
+
+func (c *ownChallenges) set(name string, keyAuth string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if keyAuth == "" {
+		delete(c.keyAuths, name)
+	} else {
+		c.keyAuths[name] = keyAuth
+	}
+}
+
 // ChallengeProvider implements go-acme/lego Provider interface which is used for ACME DNS challenge handling
 type ChallengeProvider struct {
-	servers []*DNSServer
+	challenges *ownChallenges
 }
 
 // NewChallengeProvider creates a new instance of ChallengeProvider
 func NewChallengeProvider(servers []*DNSServer) ChallengeProvider {
-	return ChallengeProvider{servers: servers}
+	return ChallengeProvider{challenges: servers[0].OwnChallenges}
 }
 
 // Present is used for making the ACME DNS challenge token available for DNS
 func (c *ChallengeProvider) Present(ctx context.Context, challenge acme.Challenge) error {
-	for _, s := range c.servers {
-		s.PersonalKeyAuth = challenge.DNS01KeyAuthorization()
-	}
+	c.challenges.set(challenge.Identifier.Value, challenge.DNS01KeyAuthorization())
 	return nil
 }
 
 // CleanUp is called after the run to remove the ACME DNS challenge tokens from DNS records
-func (c *ChallengeProvider) CleanUp(ctx context.Context, _ acme.Challenge) error {
-	for _, s := range c.servers {
-		s.PersonalKeyAuth = ""
-	}
+func (c *ChallengeProvider) CleanUp(ctx context.Context, challenge acme.Challenge) error {
+	c.challenges.set(challenge.Identifier.Value, "")
 	return nil
 }
 
@@ -36,3 +116,21 @@ func (c *ChallengeProvider) CleanUp(ctx context.Context, _ acme.Challenge) error
 func (c *ChallengeProvider) Wait(_ context.Context, _ acme.Challenge) error {
 	return nil
 }
+
+// runCertCacheCleanup removes the expired certificates from the certificate cache
+// of the API now and then every day, as certmagic leaves the certificates of names
+// no longer managed behind
+func runCertCacheCleanup(storage certmagic.Storage) {
+	for {
+		err := certmagic.CleanStorage(context.Background(), storage, certmagic.CleanStorageOptions{
+			Interval:               certCacheCleanInterval,
+			OCSPStaples:            true,
+			ExpiredCerts:           true,
+			ExpiredCertGracePeriod: certCacheGracePeriod,
+		})
+		if err != nil {
+			log.WithFields(log.Fields{"error": err.Error()}).Warning("Could not clean the certificate cache")
+		}
+		time.Sleep(certCacheCleanInterval)
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/mholt/acmez/v2/acme"
+	"github.com/miekg/dns"
+)
+
+func TestAPICertNames(t *testing.T) {
+	config := DNSConfig{General: general{Domain: "Auth.Example.org."}, API: httpapi{TLSAltNames: []string{"api.auth.example.org", "acme-dns.example.com.", "auth.example.org", ""}}}
+	names := apiCertNames(config)
+	expected := []string{"auth.example.org", "api.auth.example.org", "acme-dns.example.com"}
+	if len(names) != len(expected) {
+		t.Fatalf("Expected names %v, got %v", expected, names)
+	}
+	for i := range expected {
+		if names[i] != expected[i] {
+			t.Errorf("Expected names %v, got %v", expected, names)
+		}
+	}
+}
+
+func TestOwnChallenges(t *testing.T) {
+	config := DNSConfig{General: general{Domain: "auth.example.org"}, API: httpapi{TLSAltNames: []string{"api.auth.example.org", "acme-dns.example.com"}}}
+	server := NewDNSServer(DB, "127.0.0.1:0", "udp", "auth.example.org")
+	server.OwnChallenges = newOwnChallenges(config)
+	provider := NewChallengeProvider([]*DNSServer{server})
+
+	challenge := func(name string, token string) acme.Challenge {
+		return acme.Challenge{Identifier: acme.Identifier{Type: "dns", Value: name}, KeyAuthorization: token}
+	}
+	_ = provider.Present(context.Background(), challenge("auth.example.org", "first"))
+	_ = provider.Present(context.Background(), challenge("acme-dns.example.com", "second"))
+
+	for i, test := range []struct {
+		name     string
+		own      bool
+		expected int
+	}{
+		{"_acme-challenge.auth.example.org.", true, 2},
+		{"_acme-challenge.api.auth.example.org.", true, 2},
+		// Names outside of the zone alias the challenge name of the domain
+		{"_acme-challenge.acme-dns.example.com.", false, 0},
+		{"_acme-challenge.other.auth.example.org.", false, 0},
+	} {
+		if own := server.isOwnChallenge(test.name); own != test.own {
+			t.Errorf("Test %d: Expected %s to be an own challenge: %t", i, test.name, test.own)
+			continue
+		}
+		if !test.own {
+			continue
+		}
+		rrs, _ := server.answerOwnChallenge(dns.Question{Name: test.name, Qtype: dns.TypeTXT, Qclass: dns.ClassINET})
+		if len(rrs) != test.expected {
+			t.Errorf("Test %d: Expected %d key authorizations, got %d", i, test.expected, len(rrs))
+		}
+	}
+
+	_ = provider.CleanUp(context.Background(), challenge("auth.example.org", "first"))
+	rrs, _ := server.answerOwnChallenge(dns.Question{Name: "_acme-challenge.auth.example.org.", Qtype: dns.TypeTXT, Qclass: dns.ClassINET})
+	if len(rrs) != 1 || rrs[0].(*dns.TXT).Txt[0] == "first" {
+		t.Errorf("Expected the cleaned up key authorization to be removed, got %v", rrs)
+	}
+}
@@ -0,0 +1,24 @@
+package main
+
+import "time"
+
+// clock is the source of the current time. It can be replaced in the DB and
+// nameserver layers to test time dependent behavior deterministically.
+type clock interface {
+	Now() time.Time
+}
+
+// systemClock is the clock used outside of tests
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+// clockOrSystem returns the clock, or the system clock if none was set
+func clockOrSystem(c clock) clock {
+	if c == nil {
+		return systemClock{}
+	}
+	return c
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// frozenClock is a clock that only moves when told to
+type frozenClock struct {
+	mutex sync.Mutex
+	now   time.Time
+}
+
+func newFrozenClock(t time.Time) *frozenClock {
+	return &frozenClock{now: t}
+}
+
+func (c *frozenClock) Now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.now
+}
+
+func (c *frozenClock) Advance(d time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// withFrozenClock sets a frozen clock to the database layer for the duration of the test
+func withFrozenClock(t *testing.T, start time.Time) *frozenClock {
+	adb := DB.(*acmedb)
+	clk := newFrozenClock(start)
+	oldClock := adb.Clock
+	adb.Clock = clk
+	t.Cleanup(func() { adb.Clock = oldClock })
+	return clk
+}
+
+func TestSlotRotationFrozenClock(t *testing.T) {
+	clk := withFrozenClock(t, time.Unix(1700000000, 0))
+	reg, err := DB.Register(cidrslice{}, registrationOrigin{}, ACMETxtPost{})
+	if err != nil {
+		t.Fatalf("Registration failed, got error [%v]", err)
+	}
+	for i, test := range []struct {
+		advance time.Duration
+		slot    int
+	}{
+		// Updates within the same second tie on LastUpdate, ties go to the lowest slot
+		{0, 0},
+		{0, 1},
+		{0, 0},
+		// Sub-second precision is not stored, so this is still a tie
+		{999 * time.Millisecond, 0},
+		// Both slots were last written in the same second, still a tie
+		{time.Millisecond, 0},
+		// Slot 0 is now a second newer than slot 1
+		{time.Second, 1},
+		{time.Hour, 0},
+	} {
+		clk.Advance(test.advance)
+		reg.Value = "___validation_token_received_from_the_ca___"
+		reg.Slot = nil
+		updated, err := DB.Update(reg.ACMETxtPost)
+		if err != nil {
+			t.Fatalf("Test %d: DB Update failed, got error: [%v]", i, err)
+		}
+		if *updated.Slot != test.slot {
+			t.Errorf("Test %d: Expected slot %d to be updated at %v, got %d", i, test.slot, clk.Now(), *updated.Slot)
+		}
+	}
+	var lastUpdate int64
+	_ = DB.(*acmedb).GetBackend().QueryRow(getSQLiteStmt("SELECT MAX(LastUpdate) FROM txt WHERE Subdomain=$1"), reg.Subdomain).Scan(&lastUpdate)
+	if lastUpdate != clk.Now().Unix() {
+		t.Errorf("Expected LastUpdate to be stored from the clock [%d], got [%d]", clk.Now().Unix(), lastUpdate)
+	}
+}
+
+func TestNegativeCacheExpiryBoundary(t *testing.T) {
+	clk := newFrozenClock(time.Unix(1700000000, 0))
+	c := newNegativeCache(30*time.Second, clk)
+	c.add("nonexistent")
+	clk.Advance(30 * time.Second)
+	if !c.has("nonexistent") {
+		t.Errorf("Entry should still be cached exactly at the expiry time")
+	}
+	clk.Advance(time.Nanosecond)
+	if c.has("nonexistent") {
+		t.Errorf("Entry should have expired after the TTL")
+	}
+}
+
+func TestSOASerialFrozenClock(t *testing.T) {
+	server := NewDNSServer(DB, "", "udp", "auth.example.org")
+	server.Clock = newFrozenClock(time.Date(2024, 2, 29, 23, 59, 59, 0, time.UTC))
+	server.ParseRecords(Config)
+	soa, ok := server.SOA.(*dns.SOA)
+	if !ok {
+		t.Fatalf("Expected SOA record, got %v", server.SOA)
+	}
+	if soa.Serial != 2024022923 {
+		t.Errorf("Expected SOA serial 2024022923, got %d", soa.Serial)
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"text/template"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+)
+
+// cnameProvider renders the instructions for creating the _acme-challenge CNAME
+// record at a DNS provider
+type cnameProvider struct {
+	format      string
+	description *template.Template
+	content     *template.Template
+}
+
+// cnameTemplateFuncs are available in the templates in addition to the record fields
+var cnameTemplateFuncs = template.FuncMap{
+	"json": func(s string) (string, error) {
+		b, err := json.Marshal(s)
+		return string(b), err
+	},
+	"trimdot": func(s string) string { return strings.TrimSuffix(s, ".") },
+}
+
+func newCNAMEProvider(format string, description string, content string) cnameProvider {
+	return cnameProvider{
+		format:      format,
+		description: template.Must(template.New("description").Funcs(cnameTemplateFuncs).Parse(description)),
+		content:     template.Must(template.New("content").Funcs(cnameTemplateFuncs).Parse(content)),
+	}
+}
+
+// cnameProviders are the supported providers by the name used in the provider query parameter
+var cnameProviders = map[string]cnameProvider{
+	"zonefile": newCNAMEProvider("text", "Record in BIND zone file format",
+		`{{.Name}} 300 IN CNAME {{.Target}}
+`),
+	"cloudflare": newCNAMEProvider("json", "Request body for POST https://api.cloudflare.com/client/v4/zones/{zone_id}/dns_records. The record must not be proxied.",
+		`{
+    "type": "CNAME",
+    "name": {{trimdot .Name | json}},
+    "content": {{trimdot .Target | json}},
+    "ttl": 300,
+    "proxied": false
+}
+`),
+	"route53": newCNAMEProvider("json", "Change batch for aws route53 change-resource-record-sets --hosted-zone-id {zone_id} --change-batch file://change.json",
+		`{
+    "Changes": [
+        {
+            "Action": "UPSERT",
+            "ResourceRecordSet": {
+                "Name": {{json .Name}},
+                "Type": "CNAME",
+                "TTL": 300,
+                "ResourceRecords": [{"Value": {{json .Target}}}]
+            }
+        }
+    ]
+}
+`),
+	"gandi": newCNAMEProvider("json", "Request body for PUT https://api.gandi.net/v5/livedns/domains/{{trimdot .Domain}}/records/_acme-challenge/CNAME, with the record name relative to the zone if the domain isn't the zone apex",
+		`{
+    "rrset_ttl": 300,
+    "rrset_values": [{{json .Target}}]
+}
+`),
+}
+
+// cnameRecord is the record the instructions are rendered for
+type cnameRecord struct {
+	Domain string
+	Name   string
+	Target string
+}
+
+// cnameInstructions are the rendered instructions for a provider
+type cnameInstructions struct {
+	Provider    string `json:"provider"`
+	Description string `json:"description"`
+	Format      string `json:"format"`
+	Content     string `json:"content"`
+}
+
+// render returns the instructions of the provider for the record
+func (p cnameProvider) render(name string, record cnameRecord) (cnameInstructions, error) {
+	var description, content bytes.Buffer
+	if err := p.description.Execute(&description, record); err != nil {
+		return cnameInstructions{}, err
+	}
+	if err := p.content.Execute(&content, record); err != nil {
+		return cnameInstructions{}, err
+	}
+	return cnameInstructions{name, description.String(), p.format, content.String()}, nil
+}
+
+// cnameDomain returns the domain the certificate is for in canonical form, with
+// a wildcard label removed, and whether it's a valid domain name
+func cnameDomain(domain string) (string, bool) {
+	domain = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(domain), "*."))
+	if domain == "" || strings.Contains(domain, "*") {
+		return "", false
+	}
+	if _, ok := dns.IsDomainName(domain); !ok || dns.CountLabel(domain) < 2 {
+		return "", false
+	}
+	return dns.Fqdn(domain), true
+}
+
+// webCNAMEInstructions returns the instructions for pointing the _acme-challenge
+// record of the domain in the domain query parameter to the subdomain of the
+// authenticated registration, for the provider query parameter or all providers
+func webCNAMEInstructions(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	user, _ := r.Context().Value(ACMETxtKey).(ACMETxt)
+	domain, ok := cnameDomain(r.URL.Query().Get("domain"))
+	if !ok {
+		WriteJsonResponse(w, http.StatusBadRequest, jsonFieldErrors("bad_request", []fieldError{{"domain", "must be a valid domain name"}}))
+		return
+	}
+	var names []string
+	if provider := r.URL.Query().Get("provider"); provider != "" {
+		if _, ok := cnameProviders[provider]; !ok {
+			WriteJsonResponse(w, http.StatusBadRequest, jsonFieldErrors("bad_request", []fieldError{{"provider", "unknown provider"}}))
+			return
+		}
+		names = []string{provider}
+	} else {
+		for name := range cnameProviders {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+	}
+	record := cnameRecord{
+		Domain: domain,
+		Name:   "_acme-challenge." + domain,
+		Target: dns.Fqdn(fullDomain(user)),
+	}
+	instructions := make([]cnameInstructions, 0, len(names))
+	for _, name := range names {
+		rendered, err := cnameProviders[name].render(name, record)
+		if err != nil {
+			apiLog.WithFields(log.Fields{"error": err.Error(), "provider": name}).Error("Could not render CNAME instructions")
+			WriteJsonResponse(w, http.StatusInternalServerError, jsonError("template_error"))
+			return
+		}
+		instructions = append(instructions, rendered)
+	}
+	out, _ := json.Marshal(struct {
+		Name         string              `json:"name"`
+		Target       string              `json:"target"`
+		Instructions []cnameInstructions `json:"instructions"`
+	}{record.Name, record.Target, instructions})
+	WriteJsonResponse(w, http.StatusOK, out)
+}
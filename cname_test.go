@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+func TestCNAMEDomain(t *testing.T) {
+	for i, test := range []struct {
+		input    string
+		expected string
+		valid    bool
+	}{
+		{"example.com", "example.com.", true},
+		{"*.Example.com.", "example.com.", true},
+		{" www.example.com ", "www.example.com.", true},
+		{"com", "", false},
+		{"", "", false},
+		{"a.*.example.com", "", false},
+		{"exa mple..com", "", false},
+	} {
+		domain, valid := cnameDomain(test.input)
+		if domain != test.expected || valid != test.valid {
+			t.Errorf("Test %d: Expected %q, %t, got %q, %t", i, test.expected, test.valid, domain, valid)
+		}
+	}
+}
+
+func TestCNAMETemplatesRender(t *testing.T) {
+	record := cnameRecord{"example.com.", "_acme-challenge.example.com.", "8e5700ea.auth.example.org."}
+	for name, provider := range cnameProviders {
+		rendered, err := provider.render(name, record)
+		if err != nil {
+			t.Errorf("Could not render %s: %v", name, err)
+			continue
+		}
+		if !strings.Contains(rendered.Content, "8e5700ea.auth.example.org") {
+			t.Errorf("Expected the %s instructions to contain the target, got %q", name, rendered.Content)
+		}
+		if rendered.Format == "json" && !json.Valid([]byte(rendered.Content)) {
+			t.Errorf("Expected the %s instructions to be valid JSON, got %q", name, rendered.Content)
+		}
+		if strings.Contains(rendered.Description, "{{") {
+			t.Errorf("Expected the %s description to be rendered, got %q", name, rendered.Description)
+		}
+	}
+}
+
+func TestApiCNAMEInstructions(t *testing.T) {
+	_ = setupRouter(false, false)
+	Config.General.Domain = "auth.example.org"
+	defer func() { Config.General.Domain = "" }()
+	api := httprouter.New()
+	api.GET("/cname", AuthForAccount(webCNAMEInstructions))
+	server := httptest.NewServer(api)
+	defer server.Close()
+	e := getExpect(t, server)
+	user, _ := DB.Register(cidrslice{}, registrationOrigin{}, ACMETxtPost{})
+
+	resp := e.GET("/cname").
+		WithQuery("domain", "*.example.com").
+		WithQuery("provider", "route53").
+		WithHeader("X-Api-User", user.Username.String()).
+		WithHeader("X-Api-Key", user.Password).
+		Expect().
+		Status(http.StatusOK).
+		JSON().Object()
+	resp.ValueEqual("name", "_acme-challenge.example.com.")
+	resp.ValueEqual("target", user.Subdomain+".auth.example.org.")
+	resp.Value("instructions").Array().Length().Equal(1)
+	resp.Value("instructions").Array().Element(0).Object().ValueEqual("provider", "route53")
+
+	e.GET("/cname").
+		WithQuery("domain", "example.com").
+		WithHeader("X-Api-User", user.Username.String()).
+		WithHeader("X-Api-Key", user.Password).
+		Expect().
+		Status(http.StatusOK).
+		JSON().Object().
+		Value("instructions").Array().Length().Equal(len(cnameProviders))
+
+	for _, query := range []map[string]string{{"domain": "invalid domain"}, {"domain": "example.com", "provider": "nonexistent"}} {
+		req := e.GET("/cname").
+			WithHeader("X-Api-User", user.Username.String()).
+			WithHeader("X-Api-Key", user.Password)
+		for k, v := range query {
+			req = req.WithQuery(k, v)
+		}
+		req.Expect().
+			Status(http.StatusBadRequest).
+			JSON().Object().
+			ValueEqual("error", "bad_request")
+	}
+
+	e.GET("/cname").
+		WithQuery("domain", "example.com").
+		Expect().
+		Status(http.StatusUnauthorized)
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+
+	"github.com/google/uuid"
+	"github.com/julienschmidt/httprouter"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// credentialScheme is a password hashing scheme, identified by the credential
+// version stored with each password hash
+type credentialScheme struct {
+	description string
+	cost        int
+}
+
+// credentialSchemes are the hashing schemes by credential version. Version 0 are
+// the hashes stored before the versions were recorded. New schemes are appended
+// and used for all new hashes, while credentials of older versions are rehashed
+// on their next successful authentication.
+var credentialSchemes = []credentialScheme{
+	{"bcrypt, unversioned", 10},
+	{"bcrypt, cost 10", 10},
+}
+
+// credentialVersion returns the version of the scheme new hashes are created with
+func credentialVersion() int {
+	return len(credentialSchemes) - 1
+}
+
+// hashPassword hashes the password with the current scheme
+func hashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), credentialSchemes[credentialVersion()].cost)
+	return string(hash), err
+}
+
+// upgradeCredential rehashes the password of an authenticated registration stored
+// with an outdated scheme. Failures are logged, the old hash keeps working.
+func upgradeCredential(u uuid.UUID, version int, password string) {
+	if version >= credentialVersion() {
+		return
+	}
+	if err := DB.RehashPassword(u, version, password); err != nil {
+		apiLog.WithFields(log.Fields{"error": err.Error(), "user": u.String()}).Error("Could not rehash credential")
+		return
+	}
+	apiLog.WithFields(log.Fields{"user": u.String(), "from": version, "to": credentialVersion()}).Debug("Rehashed credential")
+}
+
+// upgradeAdminCredential rehashes the password of an authenticated admin stored
+// with an outdated scheme
+func upgradeAdminCredential(username string, version int, password string) {
+	if version >= credentialVersion() {
+		return
+	}
+	if err := DB.RehashAdminPassword(username, version, password); err != nil {
+		apiLog.WithFields(log.Fields{"error": err.Error(), "admin": username}).Error("Could not rehash admin credential")
+		return
+	}
+	apiLog.WithFields(log.Fields{"admin": username, "from": version, "to": credentialVersion()}).Debug("Rehashed admin credential")
+}
+
+// credentialVersionCount is the number of credentials stored with a version
+type credentialVersionCount struct {
+	Version       int    `json:"version"`
+	Description   string `json:"description"`
+	Registrations int    `json:"registrations"`
+	Admins        int    `json:"admins"`
+}
+
+// credentialReport tells how many credentials remain on outdated schemes
+type credentialReport struct {
+	CurrentVersion int                      `json:"current_version"`
+	Outdated       int                      `json:"outdated"`
+	Versions       []credentialVersionCount `json:"versions"`
+}
+
+func newCredentialReport(registrations map[int]int, admins map[int]int) credentialReport {
+	report := credentialReport{CurrentVersion: credentialVersion(), Versions: []credentialVersionCount{}}
+	versions := map[int]*credentialVersionCount{}
+	count := func(counts map[int]int, admin bool) {
+		for version, n := range counts {
+			c, ok := versions[version]
+			if !ok {
+				c = &credentialVersionCount{Version: version, Description: "unknown"}
+				if version >= 0 && version < len(credentialSchemes) {
+					c.Description = credentialSchemes[version].description
+				}
+				versions[version] = c
+			}
+			if admin {
+				c.Admins += n
+			} else {
+				c.Registrations += n
+			}
+			if version < credentialVersion() {
+				report.Outdated += n
+			}
+		}
+	}
+	count(registrations, false)
+	count(admins, true)
+	for _, c := range versions {
+		report.Versions = append(report.Versions, *c)
+	}
+	sort.Slice(report.Versions, func(i, j int) bool {
+		return report.Versions[i].Version < report.Versions[j].Version
+	})
+	return report
+}
+
+// webAdminCredentials reports the number of credentials by hashing scheme
+func webAdminCredentials(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	registrations, admins, err := DB.CountCredentials()
+	if err != nil {
+		apiLog.WithFields(log.Fields{"error": err.Error()}).Error("Could not count credentials")
+		WriteJsonResponse(w, http.StatusInternalServerError, jsonError("db_error"))
+		return
+	}
+	out, _ := json.Marshal(newCredentialReport(registrations, admins))
+	WriteJsonResponse(w, http.StatusOK, out)
+}
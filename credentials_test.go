@@ -0,0 +1,136 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestCredentialUpgradeOnAuthentication(t *testing.T) {
+	_ = setupRouter(false, false)
+	api := httprouter.New()
+	api.POST("/update", AuthForUpdate(webUpdatePost))
+	api.GET("/admin/credentials", AuthForAdmin(webAdminCredentials))
+	server := httptest.NewServer(api)
+	defer server.Close()
+	e := getExpect(t, server)
+
+	// Credentials stored before the versions were recorded
+	hash, _ := bcrypt.GenerateFromPassword([]byte("hunter2"), 10)
+	if _, err := DB.(*acmedb).DB.Exec("INSERT INTO admins (Username, Password) values($1, $2)", "erin", string(hash)); err != nil {
+		t.Fatalf("Could not create admin user [%v]", err)
+	}
+	user, err := DB.Register(cidrslice{}, registrationOrigin{}, ACMETxtPost{})
+	if err != nil {
+		t.Fatalf("Could not create new user, got error [%v]", err)
+	}
+	if _, err = DB.(*acmedb).DB.Exec("UPDATE records SET PassVersion=0 WHERE Username=$1", user.Username.String()); err != nil {
+		t.Fatalf("Could not reset the credential version [%v]", err)
+	}
+	registrations, admins, err := DB.CountCredentials()
+	if err != nil || registrations[0] < 1 || admins[0] < 1 {
+		t.Fatalf("Expected outdated credentials to be counted, got %v %v %v", registrations, admins, err)
+	}
+	outdated := registrations[0] + admins[0]
+
+	e.POST("/update").
+		WithJSON(map[string]interface{}{"subdomain": user.Subdomain, "txt": "ccccccccccccccccccccccccccccccccccccccccccc"}).
+		WithHeader("X-Api-User", user.Username.String()).
+		WithHeader("X-Api-Key", user.Password).
+		Expect().
+		Status(http.StatusOK)
+	stored, err := DB.GetByUsername(user.Username)
+	if err != nil {
+		t.Fatalf("Could not get user: %v", err)
+	}
+	if stored.PassVersion != credentialVersion() || !correctPassword(user.Password, stored.Password) {
+		t.Errorf("Expected the API key to be rehashed to version %d, got %d", credentialVersion(), stored.PassVersion)
+	}
+
+	report := e.GET("/admin/credentials").
+		WithBasicAuth("erin", "hunter2").
+		Expect().
+		Status(http.StatusOK).
+		JSON().Object()
+	report.ValueEqual("current_version", credentialVersion())
+	// The request itself upgraded the admin
+	report.ValueEqual("outdated", outdated-2)
+	if pass, version, _ := DB.GetAdminPassByUsername("erin"); version != credentialVersion() || !correctPassword("hunter2", pass) {
+		t.Errorf("Expected the admin password to be rehashed to version %d, got %d", credentialVersion(), version)
+	}
+}
+
+func testRehashChangedCredential(t *testing.T, db database) {
+	user, err := db.Register(cidrslice{}, registrationOrigin{}, ACMETxtPost{})
+	if err != nil {
+		t.Fatalf("Could not create new user, got error [%v]", err)
+	}
+	if user.PassVersion != credentialVersion() {
+		t.Errorf("Expected new registrations to use version %d, got %d", credentialVersion(), user.PassVersion)
+	}
+	// A key rotated after the old one was authenticated must not be reverted
+	if err = db.SetPassword(user.Username, "rotated key"); err != nil {
+		t.Fatalf("Could not set password: %v", err)
+	}
+	if err = db.RehashPassword(user.Username, 0, user.Password); err != nil {
+		t.Fatalf("Could not rehash password: %v", err)
+	}
+	stored, _ := db.GetByUsername(user.Username)
+	if !correctPassword("rotated key", stored.Password) {
+		t.Errorf("Expected the rotated key to be kept")
+	}
+
+	if err = db.CreateAdmin("frank", "correct horse"); err != nil {
+		t.Fatalf("Could not add admin: %v", err)
+	}
+	defer db.DeleteAdmin("frank")
+	if err = db.RehashAdminPassword("frank", 0, "old password"); err != nil {
+		t.Fatalf("Could not rehash admin password: %v", err)
+	}
+	if pass, version, _ := db.GetAdminPassByUsername("frank"); version != credentialVersion() || !correctPassword("correct horse", pass) {
+		t.Errorf("Expected the current admin password to be kept")
+	}
+}
+
+func TestRehashChangedCredential(t *testing.T) {
+	testRehashChangedCredential(t, DB)
+}
+
+func TestRehashChangedCredentialMemory(t *testing.T) {
+	db, err := openBackend("memory", "")
+	if err != nil {
+		t.Fatalf("Could not open the memory backend: %v", err)
+	}
+	defer db.Close()
+	testRehashChangedCredential(t, db)
+
+	// Admins stored as the bare hash are at version 0
+	hash, _ := bcrypt.GenerateFromPassword([]byte("hunter2"), 10)
+	_ = db.(*kvdb).store.Set(kvAdminKey("grace"), hash, 0)
+	if _, version, err := db.GetAdminPassByUsername("grace"); err != nil || version != 0 {
+		t.Errorf("Expected a legacy admin at version 0, got %d, %v", version, err)
+	}
+	if err = db.RehashAdminPassword("grace", 0, "hunter2"); err != nil {
+		t.Fatalf("Could not rehash admin password: %v", err)
+	}
+	_, admins, _ := db.CountCredentials()
+	if admins[0] != 0 || admins[credentialVersion()] != 1 {
+		t.Errorf("Expected the admin at the current version, got %v", admins)
+	}
+}
+
+func TestNewCredentialReport(t *testing.T) {
+	report := newCredentialReport(map[int]int{0: 3, 1: 5}, map[int]int{0: 1, 7: 1})
+	if report.Outdated != 4 {
+		t.Errorf("Expected 4 outdated credentials, got %d", report.Outdated)
+	}
+	if len(report.Versions) != 3 || report.Versions[0].Registrations != 3 || report.Versions[0].Admins != 1 {
+		t.Errorf("Unexpected versions %+v", report.Versions)
+	}
+	if report.Versions[2].Description != "unknown" {
+		t.Errorf("Expected an unknown version to be described as such, got %q", report.Versions[2].Description)
+	}
+}
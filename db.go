@@ -7,18 +7,17 @@ import (
 	"fmt"
 	"net"
 	"regexp"
-	"strconv"
+	"strings"
 	"time"
 
 	"github.com/google/uuid"
 	_ "github.com/lib/pq"
 	_ "github.com/mattn/go-sqlite3"
 	log "github.com/sirupsen/logrus"
-	"golang.org/x/crypto/bcrypt"
 )
 
 // DBVersion shows the database version this code uses. This is used for update checks.
-var DBVersion = 1
+var DBVersion = len(migrations)
 
 var acmeTable = `
 	CREATE TABLE IF NOT EXISTS acmedns(
@@ -26,6 +25,12 @@ var acmeTable = `
 		Value TEXT
 	);`
 
+// recordColumns are the columns of the records table read by getModelFromRow. LastUpdate
+// is the time of the latest TXT update, or zero if the TXT records were never updated.
+var recordColumns = `Username, Password, Subdomain, AllowFrom, Description, Webhooks, AllowedTypes,
+	CreatedBy, CreatedFrom, CreatedAt, Zone, Tags, Disabled, Canary, Wildcard, SubnetAnswers, PassVersion, COALESCE(LastActive, 0),
+	COALESCE((SELECT MAX(LastUpdate) FROM txt WHERE txt.Subdomain=records.Subdomain), 0)`
+
 var adminTable = `
 	CREATE TABLE IF NOT EXISTS admins(
         Username TEXT UNIQUE NOT NULL PRIMARY KEY,
@@ -69,221 +74,480 @@ var aaaaTable = `
 		LastUpdate INT
 	);`
 
+var cnameTable = `
+    CREATE TABLE IF NOT EXISTS cname(
+		Subdomain TEXT UNIQUE NOT NULL,
+		Value   TEXT NOT NULL,
+		LastUpdate INT
+	);`
+
+var mxTable = `
+    CREATE TABLE IF NOT EXISTS mx(
+		Subdomain TEXT NOT NULL,
+		Priority INT NOT NULL,
+		Value   TEXT NOT NULL,
+		LastUpdate INT
+	);`
+
+var srvTable = `
+    CREATE TABLE IF NOT EXISTS srv(
+		Subdomain TEXT NOT NULL,
+		Priority INT NOT NULL,
+		Weight INT NOT NULL,
+		Port INT NOT NULL,
+		Value   TEXT NOT NULL,
+		LastUpdate INT
+	);`
+
+var caaTable = `
+    CREATE TABLE IF NOT EXISTS caa(
+		Subdomain TEXT NOT NULL,
+		Flags INT NOT NULL,
+		Tag TEXT NOT NULL,
+		Value   TEXT NOT NULL,
+		LastUpdate INT
+	);`
+
+var rrTable = `
+    CREATE TABLE IF NOT EXISTS rr(
+		Subdomain TEXT NOT NULL,
+		Type TEXT NOT NULL,
+		Content TEXT NOT NULL,
+		TTL INT NOT NULL,
+		LastUpdate INT
+	);`
+
+var ttlTable = `
+    CREATE TABLE IF NOT EXISTS ttl(
+		Subdomain TEXT NOT NULL,
+		Type TEXT NOT NULL,
+		TTL INT NOT NULL,
+		LastUpdate INT
+	);`
+
+var auditTable = `
+    CREATE TABLE IF NOT EXISTS audit(
+		Time INT NOT NULL,
+		Action TEXT NOT NULL,
+		Actor TEXT NOT NULL,
+		SourceIP TEXT NOT NULL,
+		Subdomain TEXT NOT NULL,
+		Detail TEXT NOT NULL
+	);`
+
+var auditTablePG = `
+    CREATE TABLE IF NOT EXISTS audit(
+		rowid SERIAL,
+		Time INT NOT NULL,
+		Action TEXT NOT NULL,
+		Actor TEXT NOT NULL,
+		SourceIP TEXT NOT NULL,
+		Subdomain TEXT NOT NULL,
+		Detail TEXT NOT NULL
+	);`
+
+var leaseTable = `
+	CREATE TABLE IF NOT EXISTS leases(
+		Name TEXT UNIQUE NOT NULL PRIMARY KEY,
+		Holder TEXT NOT NULL,
+		Expires INT NOT NULL
+	);`
+
+func init() {
+	RegisterBackend("sqlite3", newSQLBackend)
+	RegisterBackend("postgres", newSQLBackend)
+}
+
+// newSQLBackend returns a new database backend using database/sql
+func newSQLBackend() database {
+	return new(acmedb)
+}
+
 // getSQLiteStmt replaces all PostgreSQL prepared statement placeholders (eg. $1, $2) with SQLite variant "?"
 func getSQLiteStmt(s string) string {
-	re, _ := regexp.Compile(`\$[0-9]`)
+	re, _ := regexp.Compile(`\$[0-9]+`)
 	return re.ReplaceAllString(s, "?")
 }
 
+// stmt rewrites the placeholders of the query for the database engine in use
+func (d *acmedb) stmt(q string) string {
+	if d.engine == "sqlite3" {
+		return getSQLiteStmt(q)
+	}
+	return q
+}
+
+// configurePool sets the limits of the connection pool from the configuration
+func configurePool(db *sql.DB, engine string, connection string, conf dbsettings) {
+	if engine == "sqlite3" {
+		// Every connection to an in-memory database sees a database of its own, and
+		// SQLite allows a single writer unless more connections are configured
+		if conf.MaxOpenConns <= 0 || connection == ":memory:" || strings.Contains(connection, "mode=memory") {
+			db.SetMaxOpenConns(1)
+		} else {
+			db.SetMaxOpenConns(conf.MaxOpenConns)
+		}
+	} else if conf.MaxOpenConns > 0 {
+		db.SetMaxOpenConns(conf.MaxOpenConns)
+	}
+	if conf.MaxIdleConns > 0 {
+		db.SetMaxIdleConns(conf.MaxIdleConns)
+	}
+	if conf.ConnMaxLifetime > 0 {
+		db.SetConnMaxLifetime(time.Duration(conf.ConnMaxLifetime) * time.Second)
+	}
+}
+
 func (d *acmedb) Init(engine string, connection string) error {
-	d.Mutex.Lock()
-	defer d.Mutex.Unlock()
-	db, err := sql.Open(engine, connection)
+	driverName := engine
+	if engine == "sqlite3" {
+		driverName = sqliteDriver(Config.Database)
+	}
+	db, err := sql.Open(driverName, connection)
 	if err != nil {
 		return err
 	}
 	d.DB = db
-	// Check version first to try to catch old versions without version string
-	var versionString string
-	_ = d.DB.QueryRow("SELECT Value FROM acmedns WHERE Name='db_version'").Scan(&versionString)
-	if versionString == "" {
-		versionString = "0"
-	}
-	_, _ = d.DB.Exec(acmeTable)
-	_, _ = d.DB.Exec(adminTable)
-	_, _ = d.DB.Exec(userTable)
-	if Config.Database.Engine == "sqlite3" {
-		_, _ = d.DB.Exec(txtTable)
-	} else {
-		_, _ = d.DB.Exec(txtTablePG)
-	}
-	_, _ = d.DB.Exec(aTable)
-	_, _ = d.DB.Exec(aaaaTable)
-	// If everything is fine, handle db upgrade tasks
-	if err == nil {
-		err = d.checkDBUpgrades(versionString)
+	d.engine = engine
+	configurePool(db, engine, connection, Config.Database)
+	d.negCache = newNegativeCache(time.Duration(Config.Database.NegativeCacheTTL)*time.Second, d)
+	d.recordCache = newRecordCache(time.Duration(Config.Database.RecordCacheTTL)*time.Second, d)
+	d.snapshot = nil
+	if Config.Database.ServeStale {
+		d.snapshot = newStaleSnapshot()
 	}
-	if err == nil {
-		if versionString == "0" {
-			// No errors so we should now be in version 1
-			insversion := fmt.Sprintf("INSERT INTO acmedns (Name, Value) values('db_version', '%d')", DBVersion)
-			_, err = db.Exec(insversion)
-		}
+	if d.skipMigrations {
+		return nil
 	}
-	return err
-}
-
-func (d *acmedb) checkDBUpgrades(versionString string) error {
-	var err error
-	version, err := strconv.Atoi(versionString)
-	if err != nil {
+	if Config.Database.MigrateOnDemand {
+		err = d.checkSchema()
+		if errors.Is(err, errSchemaBehind) {
+			dbLog.WithFields(log.Fields{"error": err.Error()}).Warning("Database migrations are pending, apply them with POST /admin/db")
+			return nil
+		}
 		return err
 	}
-	if version != DBVersion {
-		return d.handleDBUpgrades(version)
+	if Config.Database.SkipMigrations {
+		return d.checkSchema()
 	}
-	return nil
-
+	_, err = d.migrate(false)
+	return err
 }
 
-func (d *acmedb) handleDBUpgrades(version int) error {
-	if version == 0 {
-		return d.handleDBUpgradeTo1()
+// txtSlotCount returns the number of TXT values served for each subdomain
+func txtSlotCount() int {
+	if Config.General.TXTSlots > 0 {
+		return Config.General.TXTSlots
 	}
-	return nil
+	return 2
 }
 
-func (d *acmedb) handleDBUpgradeTo1() error {
-	var err error
-	var subdomains []string
-	rows, err := d.DB.Query("SELECT Subdomain FROM records")
+// Create a row for each TXT slot of the subdomain to the txt table
+func (d *acmedb) NewTXTValuesInTransaction(tx *sql.Tx, subdomain string) error {
+	insSQL := `
+	INSERT INTO txt (Subdomain, Slot, LastUpdate) values($1, $2, 0)
+	`
+	insSQL = d.stmt(insSQL)
+	sm, err := tx.Prepare(insSQL)
 	if err != nil {
-		log.WithFields(log.Fields{"error": err.Error()}).Error("Error in DB upgrade")
 		return err
 	}
-	defer rows.Close()
-	for rows.Next() {
-		var subdomain string
-		err = rows.Scan(&subdomain)
+	defer sm.Close()
+	for slot := 0; slot < txtSlotCount(); slot++ {
+		_, err = sm.Exec(subdomain, slot)
 		if err != nil {
-			log.WithFields(log.Fields{"error": err.Error()}).Error("Error in DB upgrade while reading values")
 			return err
 		}
-		subdomains = append(subdomains, subdomain)
-	}
-	err = rows.Err()
-	if err != nil {
-		log.WithFields(log.Fields{"error": err.Error()}).Error("Error in DB upgrade while inserting values")
-		return err
-	}
-	tx, err := d.DB.Begin()
-	// Rollback if errored, commit if not
-	defer func() {
-		if err != nil {
-			_ = tx.Rollback()
-			return
-		}
-		_ = tx.Commit()
-	}()
-	_, _ = tx.Exec("DELETE FROM txt")
-	for _, subdomain := range subdomains {
-		if subdomain != "" {
-			// Insert two rows for each subdomain to txt table
-			err = d.NewTXTValuesInTransaction(tx, subdomain)
-			if err != nil {
-				log.WithFields(log.Fields{"error": err.Error()}).Error("Error in DB upgrade while inserting values")
-				return err
-			}
-		}
-	}
-	// SQLite doesn't support dropping columns
-	if Config.Database.Engine != "sqlite3" {
-		_, _ = tx.Exec("ALTER TABLE records DROP COLUMN IF EXISTS Value")
-		_, _ = tx.Exec("ALTER TABLE records DROP COLUMN IF EXISTS LastActive")
 	}
-	_, err = tx.Exec("UPDATE acmedns SET Value='1' WHERE Name='db_version'")
-	return err
+	return nil
 }
 
-// Create two rows for subdomain to the txt table
-func (d *acmedb) NewTXTValuesInTransaction(tx *sql.Tx, subdomain string) error {
-	var err error
-	instr := fmt.Sprintf("INSERT INTO txt (Subdomain, LastUpdate) values('%s', 0)", subdomain)
-	_, _ = tx.Exec(instr)
-	_, _ = tx.Exec(instr)
-	return err
+// Register creates a new registration, with the initial record values if any
+// given, in a single transaction.
+func (d *acmedb) Register(afrom cidrslice, origin registrationOrigin, values ACMETxtPost) (ACMETxt, error) {
+	var reg ACMETxt
+	err := d.retry("register", func() error {
+		var err error
+		reg, err = d.registerInTransaction(afrom, origin, values)
+		return err
+	})
+	return reg, err
 }
 
-func (d *acmedb) Register(afrom cidrslice) (ACMETxt, error) {
-	d.Mutex.Lock()
-	defer d.Mutex.Unlock()
-	var err error
+func (d *acmedb) registerInTransaction(afrom cidrslice, origin registrationOrigin, values ACMETxtPost) (a ACMETxt, err error) {
 	tx, err := d.DB.Begin()
+	if err != nil {
+		return a, err
+	}
 	// Rollback if errored, commit if not
 	defer func() {
 		if err != nil {
 			_ = tx.Rollback()
 			return
 		}
-		_ = tx.Commit()
+		err = tx.Commit()
 	}()
-	a := newACMETxt()
+	a = newACMETxt()
 	a.AllowFrom = cidrslice(afrom.ValidEntries())
-	passwordHash, err := bcrypt.GenerateFromPassword([]byte(a.Password), 10)
+	a.Origin = origin
+	a.Origin.CreatedAt = d.Now().Unix()
+	passwordHash, err := hashPassword(a.Password)
+	if err != nil {
+		return a, err
+	}
+	a.PassVersion = credentialVersion()
 	regSQL := `
     INSERT INTO records(
         Username,
         Password,
+        PassVersion,
         Subdomain,
-		AllowFrom) 
-        values($1, $2, $3, $4)`
-	if Config.Database.Engine == "sqlite3" {
-		regSQL = getSQLiteStmt(regSQL)
-	}
+		AllowFrom,
+		CreatedBy,
+		CreatedFrom,
+		CreatedAt,
+		Zone) 
+        values($1, $2, $3, $4, $5, $6, $7, $8, $9)`
+	regSQL = d.stmt(regSQL)
 	sm, err := tx.Prepare(regSQL)
 	if err != nil {
-		log.WithFields(log.Fields{"error": err.Error()}).Error("Database error in prepare")
+		dbLog.WithFields(log.Fields{"error": err.Error()}).Error("Database error in prepare")
 		return a, errors.New("SQL error")
 	}
 	defer sm.Close()
-	_, err = sm.Exec(a.Username.String(), passwordHash, a.Subdomain, a.AllowFrom.JSON())
+	_, err = sm.Exec(a.Username.String(), passwordHash, a.PassVersion, a.Subdomain, a.AllowFrom.JSON(), a.Origin.CreatedBy, a.Origin.CreatedFrom, a.Origin.CreatedAt, a.Origin.Zone)
 	if err == nil {
 		err = d.NewTXTValuesInTransaction(tx, a.Subdomain)
 	}
+	if err == nil {
+		values.Subdomain = a.Subdomain
+		values, err = d.setInitialValuesInTransaction(tx, values, a.Origin.CreatedAt)
+		a.ACMETxtPost = values
+	}
+	d.negCache.remove(a.Subdomain)
+	d.recordCache.remove(a.Subdomain)
 	return a, err
 }
 
-func (d *acmedb) GetAdminPassByUsername(username string) (string, error) {
-	d.Mutex.Lock()
-	defer d.Mutex.Unlock()
+// setInitialValuesInTransaction stores the record values of a new registration.
+// The TXT value goes to the first slot unless a slot is given.
+func (d *acmedb) setInitialValuesInTransaction(tx *sql.Tx, values ACMETxtPost, timenow int64) (ACMETxtPost, error) {
+	if values.Value != "" {
+		slot := 0
+		if values.Slot != nil {
+			slot = *values.Slot
+		}
+		if slot < 0 || slot >= txtSlotCount() {
+			return values, fmt.Errorf("invalid TXT slot: %d", slot)
+		}
+		updSQL := `
+	UPDATE txt SET Value=$1, LastUpdate=$2, CorrelationID=$3
+	WHERE Subdomain=$4 AND Slot=$5
+	`
+		updSQL = d.stmt(updSQL)
+		_, err := tx.Exec(updSQL, values.Value, timenow, values.CorrelationID, values.Subdomain, slot)
+		if err != nil {
+			return values, err
+		}
+		values.Slot = &slot
+	}
+	insertSQL := map[string]string{
+		"a":    "INSERT INTO a (Subdomain, Value, LastUpdate) values($1, $2, $3)",
+		"aaaa": "INSERT INTO aaaa (Subdomain, Value, LastUpdate) values($1, $2, $3)",
+	}
+	for table, ips := range map[string][]string{"a": values.AValues, "aaaa": values.AAAAValues} {
+		insSQL := d.stmt(insertSQL[table])
+		for _, ip := range ips {
+			_, err := tx.Exec(insSQL, values.Subdomain, ip, timenow)
+			if err != nil {
+				return values, err
+			}
+		}
+	}
+	if values.CNAME != "" {
+		insSQL := d.stmt("INSERT INTO cname (Subdomain, Value, LastUpdate) values($1, $2, $3)")
+		if _, err := tx.Exec(insSQL, values.Subdomain, values.CNAME, timenow); err != nil {
+			return values, err
+		}
+	}
+	insSQL := d.stmt("INSERT INTO mx (Subdomain, Priority, Value, LastUpdate) values($1, $2, $3, $4)")
+	for _, mx := range values.MXValues {
+		if _, err := tx.Exec(insSQL, values.Subdomain, mx.Priority, mx.Target, timenow); err != nil {
+			return values, err
+		}
+	}
+	insSQL = d.stmt("INSERT INTO srv (Subdomain, Priority, Weight, Port, Value, LastUpdate) values($1, $2, $3, $4, $5, $6)")
+	for _, srv := range values.SRVValues {
+		if _, err := tx.Exec(insSQL, values.Subdomain, srv.Priority, srv.Weight, srv.Port, srv.Target, timenow); err != nil {
+			return values, err
+		}
+	}
+	insSQL = d.stmt("INSERT INTO caa (Subdomain, Flags, Tag, Value, LastUpdate) values($1, $2, $3, $4, $5)")
+	for _, caa := range values.CAAValues {
+		if _, err := tx.Exec(insSQL, values.Subdomain, caa.Flags, caa.Tag, caa.Value, timenow); err != nil {
+			return values, err
+		}
+	}
+	insSQL = d.stmt("INSERT INTO rr (Subdomain, Type, Content, TTL, LastUpdate) values($1, $2, $3, $4, $5)")
+	for _, g := range values.Records {
+		if _, err := tx.Exec(insSQL, values.Subdomain, g.Type, g.Content, g.TTL, timenow); err != nil {
+			return values, err
+		}
+	}
+	return values, d.setTTLInTransaction(tx, values, timenow)
+}
+
+// setTTLInTransaction stores the TTL of the record types the update sets, and
+// removes the TTL of the types it replaces otherwise
+func (d *acmedb) setTTLInTransaction(tx *sql.Tx, a ACMETxtPost, timenow int64) error {
+	for _, rtype := range ttlReplacedTypes(a) {
+		if _, err := tx.Exec(d.stmt("DELETE FROM ttl WHERE Subdomain=$1 AND Type=$2"), a.Subdomain, rtype); err != nil {
+			return err
+		}
+	}
+	if a.TTL == 0 {
+		return nil
+	}
+	insSQL := d.stmt("INSERT INTO ttl (Subdomain, Type, TTL, LastUpdate) values($1, $2, $3, $4)")
+	for _, rtype := range ttlSetTypes(a) {
+		if _, err := tx.Exec(insSQL, a.Subdomain, rtype, a.TTL, timenow); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetAdminPassByUsername returns the password hash of the admin and its credential version
+func (d *acmedb) GetAdminPassByUsername(username string) (string, int, error) {
 	var results []string
+	var versions []int
 	getSQL := `
-	SELECT Password
+	SELECT Password, PassVersion
 	FROM admins
 	WHERE Username=$1 LIMIT 1
 	`
-	if Config.Database.Engine == "sqlite3" {
-		getSQL = getSQLiteStmt(getSQL)
-	}
+	getSQL = d.stmt(getSQL)
 
 	sm, err := d.DB.Prepare(getSQL)
 	if err != nil {
-		return "", err
+		return "", 0, err
 	}
 	defer sm.Close()
 	rows, err := sm.Query(username)
 	if err != nil {
-		return "", err
+		return "", 0, err
 	}
 	defer rows.Close()
 
 	// It will only be one row though
 	for rows.Next() {
 		var result string
-		err = rows.Scan(&result)
+		var version int
+		err = rows.Scan(&result, &version)
 		if err != nil {
-			return "", err
+			return "", 0, err
 		}
 		results = append(results, result)
+		versions = append(versions, version)
 	}
 	if len(results) > 0 {
-		return results[0], nil
+		return results[0], versions[0], nil
+	}
+	return "", 0, errAdminNotFound
+}
+
+// CreateAdmin adds an admin with the password, failing if the username is taken
+func (d *acmedb) CreateAdmin(username string, password string) error {
+	passwordHash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+	insSQL := `
+	INSERT INTO admins (Username, Password, PassVersion)
+	SELECT $1, $2, $3 WHERE NOT EXISTS (SELECT 1 FROM admins WHERE Username=$4)
+	`
+	insSQL = d.stmt(insSQL)
+	res, err := d.DB.Exec(insSQL, username, passwordHash, credentialVersion(), username)
+	if err != nil {
+		return err
+	}
+	affected, err := res.RowsAffected()
+	if err == nil && affected == 0 {
+		err = errAdminExists
+	}
+	return err
+}
+
+// DeleteAdmin removes the admin
+func (d *acmedb) DeleteAdmin(username string) error {
+	res, err := d.DB.Exec(d.stmt("DELETE FROM admins WHERE Username=$1"), username)
+	if err != nil {
+		return err
 	}
-	return "", errors.New("admin not found")
+	affected, err := res.RowsAffected()
+	if err == nil && affected == 0 {
+		err = errAdminNotFound
+	}
+	return err
+}
+
+// ListAdmins returns the usernames of the admins in alphabetical order
+func (d *acmedb) ListAdmins() ([]string, error) {
+	admins := []string{}
+	rows, err := d.DB.Query("SELECT Username FROM admins ORDER BY Username")
+	if err != nil {
+		return admins, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var username string
+		err = rows.Scan(&username)
+		if err != nil {
+			return admins, err
+		}
+		admins = append(admins, username)
+	}
+	return admins, rows.Err()
+}
+
+// UpdateAdminPassword replaces the password of the admin
+func (d *acmedb) UpdateAdminPassword(username string, password string) error {
+	passwordHash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+	updSQL := d.stmt("UPDATE admins SET Password=$1, PassVersion=$2 WHERE Username=$3")
+	res, err := d.DB.Exec(updSQL, passwordHash, credentialVersion(), username)
+	if err != nil {
+		return err
+	}
+	affected, err := res.RowsAffected()
+	if err == nil && affected == 0 {
+		err = errAdminNotFound
+	}
+	return err
+}
+
+// RehashAdminPassword stores the password of the admin hashed with the current
+// scheme, unless the credential was changed from the given version meanwhile
+func (d *acmedb) RehashAdminPassword(username string, version int, password string) error {
+	passwordHash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+	updSQL := d.stmt("UPDATE admins SET Password=$1, PassVersion=$2 WHERE Username=$3 AND PassVersion=$4")
+	_, err = d.DB.Exec(updSQL, passwordHash, credentialVersion(), username, version)
+	return err
 }
 
 func (d *acmedb) GetByUsername(u uuid.UUID) (ACMETxt, error) {
-	d.Mutex.Lock()
-	defer d.Mutex.Unlock()
 	var results []ACMETxt
 	getSQL := `
-	SELECT Username, Password, Subdomain, AllowFrom
+	SELECT ` + recordColumns + `
 	FROM records
 	WHERE Username=$1 LIMIT 1
 	`
-	if Config.Database.Engine == "sqlite3" {
-		getSQL = getSQLiteStmt(getSQL)
-	}
+	getSQL = d.stmt(getSQL)
 
 	sm, err := d.DB.Prepare(getSQL)
 	if err != nil {
@@ -310,99 +574,284 @@ func (d *acmedb) GetByUsername(u uuid.UUID) (ACMETxt, error) {
 	return ACMETxt{}, errors.New("no user")
 }
 
-func (d *acmedb) GetTXTForDomain(domain string) ([]string, error) {
-	d.Mutex.Lock()
-	defer d.Mutex.Unlock()
-	domain = sanitizeString(domain)
-	var txts []string
+// ListRegistrations returns the registrations matching the filter ordered by
+// creation time. Empty filter fields match all registrations.
+func (d *acmedb) ListRegistrations(filter registrationOrigin) ([]ACMETxt, error) {
+	results := []ACMETxt{}
+	var conditions []string
+	var args []interface{}
+	if filter.CreatedBy != "" {
+		args = append(args, filter.CreatedBy)
+		conditions = append(conditions, fmt.Sprintf("CreatedBy=$%d", len(args)))
+	}
+	if filter.CreatedFrom != "" {
+		args = append(args, filter.CreatedFrom)
+		conditions = append(conditions, fmt.Sprintf("CreatedFrom=$%d", len(args)))
+	}
 	getSQL := `
-	SELECT Value FROM txt WHERE Subdomain=$1 LIMIT 2
+	SELECT ` + recordColumns + `
+	FROM records
 	`
-	if Config.Database.Engine == "sqlite3" {
-		getSQL = getSQLiteStmt(getSQL)
-	}
-
-	sm, err := d.DB.Prepare(getSQL)
-	if err != nil {
-		return txts, err
+	if len(conditions) > 0 {
+		getSQL += "WHERE " + strings.Join(conditions, " AND ") + "\n"
 	}
-	defer sm.Close()
-	rows, err := sm.Query(domain)
+	getSQL += "ORDER BY CreatedAt, Subdomain"
+	getSQL = d.stmt(getSQL)
+	rows, err := d.DB.Query(getSQL, args...)
 	if err != nil {
-		return txts, err
+		return results, err
 	}
 	defer rows.Close()
-
 	for rows.Next() {
-		var rtxt string
-		err = rows.Scan(&rtxt)
+		txt, err := getModelFromRow(rows)
 		if err != nil {
-			return txts, err
+			return results, err
 		}
-		txts = append(txts, rtxt)
+		results = append(results, txt)
 	}
-	return txts, nil
+	return results, rows.Err()
 }
 
-func (d *acmedb) GetAForDomain(domain string) ([]net.IP, error) {
-	d.Mutex.Lock()
-	defer d.Mutex.Unlock()
-	domain = sanitizeString(domain)
-	var ips []net.IP
-	getSQL := `
-	SELECT Value FROM a WHERE Subdomain=$1 LIMIT 255
-	`
-	if Config.Database.Engine == "sqlite3" {
-		getSQL = getSQLiteStmt(getSQL)
-	}
-
-	sm, err := d.DB.Prepare(getSQL)
+// MarkActive sets the last active time of the registration to now
+func (d *acmedb) MarkActive(u uuid.UUID) error {
+	updSQL := d.stmt("UPDATE records SET LastActive=$1 WHERE Username=$2")
+	res, err := d.DB.Exec(updSQL, d.Now().Unix(), u.String())
 	if err != nil {
-		return ips, err
+		return err
 	}
-	defer sm.Close()
-	rows, err := sm.Query(domain)
+	affected, err := res.RowsAffected()
+	if err == nil && affected == 0 {
+		err = errors.New("no user")
+	}
+	return err
+}
+
+// GetInactiveAccounts returns the registrations without authenticated updates during
+// the last olderThan, least recently active first. Registrations created during that
+// time and canaries are left out.
+func (d *acmedb) GetInactiveAccounts(olderThan time.Duration) ([]ACMETxt, error) {
+	results := []ACMETxt{}
+	cutoff := d.Now().Add(-olderThan).Unix()
+	getSQL := `
+	SELECT ` + recordColumns + `
+	FROM records
+	WHERE COALESCE(LastActive, 0) < $1 AND CreatedAt < $2 AND Canary=0
+	ORDER BY CASE WHEN COALESCE(LastActive, 0) > CreatedAt THEN LastActive ELSE CreatedAt END, Subdomain
+	`
+	getSQL = d.stmt(getSQL)
+	rows, err := d.DB.Query(getSQL, cutoff, cutoff)
 	if err != nil {
-		return ips, err
+		return results, err
 	}
 	defer rows.Close()
-
 	for rows.Next() {
-		var ra string
-		var ip net.IP
-		err = rows.Scan(&ra)
+		txt, err := getModelFromRow(rows)
 		if err != nil {
-			return ips, err
-		}
-		ip = net.ParseIP(ra)
-		if ip != nil {
-			ip = ip.To4()
-		}
-		if ip == nil {
-			return ips, fmt.Errorf("invalid IPv4 address: %s", ra)
+			return results, err
 		}
-		ips = append(ips, ip)
+		results = append(results, txt)
 	}
-	return ips, nil
+	return results, rows.Err()
 }
 
-func (d *acmedb) GetAAAAForDomain(domain string) ([]net.IP, error) {
-	d.Mutex.Lock()
-	defer d.Mutex.Unlock()
+func (d *acmedb) GetTXTForDomain(domain string) ([]string, error) {
 	domain = sanitizeString(domain)
-	var ip6s []net.IP
-	getSQL := `
-	SELECT Value FROM aaaa WHERE Subdomain=$1 LIMIT 255
-	`
-	if Config.Database.Engine == "sqlite3" {
-		getSQL = getSQLiteStmt(getSQL)
+	d.stripes.RLock(domain)
+	defer d.stripes.RUnlock(domain)
+	if d.negCache.has(domain) {
+		return nil, nil
 	}
-
-	sm, err := d.DB.Prepare(getSQL)
+	if d.recordCache.enabled() {
+		records, err := d.cachedRecords(domain)
+		return records.TXT, err
+	}
+	txts, err := d.queryTXT(domain)
+	if err != nil {
+		if stale, ok := d.staleRecords(domain, err); ok {
+			return stale.TXT, nil
+		}
+	}
+	return txts, err
+}
+
+// GetTXTSlots returns the TXT slots of the subdomain with their latest updates
+func (d *acmedb) GetTXTSlots(domain string) ([]txtSlot, error) {
+	domain = sanitizeString(domain)
+	d.stripes.RLock(domain)
+	defer d.stripes.RUnlock(domain)
+	var slots []txtSlot
+	getSQL := `
+	SELECT Slot, Value, COALESCE(LastUpdate, 0), CorrelationID FROM txt WHERE Subdomain=$1 AND Slot < $2 ORDER BY Slot
+	`
+	rows, err := d.DB.Query(d.stmt(getSQL), domain, txtSlotCount())
+	if err != nil {
+		return slots, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var slot txtSlot
+		if err = rows.Scan(&slot.Slot, &slot.Value, &slot.LastUpdate, &slot.CorrelationID); err != nil {
+			return slots, err
+		}
+		slots = append(slots, slot)
+	}
+	return slots, rows.Err()
+}
+
+// GetLastUpdates returns the time of the latest update of each record type the
+// subdomain has records of, by the name of the type in the API
+func (d *acmedb) GetLastUpdates(domain string) (map[string]int64, error) {
+	domain = sanitizeString(domain)
+	d.stripes.RLock(domain)
+	defer d.stripes.RUnlock(domain)
+	updates := make(map[string]int64)
+	getSQL := `
+	SELECT 'txt', MAX(LastUpdate) FROM txt WHERE Subdomain=$1
+	UNION ALL SELECT 'a', MAX(LastUpdate) FROM a WHERE Subdomain=$2
+	UNION ALL SELECT 'aaaa', MAX(LastUpdate) FROM aaaa WHERE Subdomain=$3
+	UNION ALL SELECT 'cname', MAX(LastUpdate) FROM cname WHERE Subdomain=$4
+	UNION ALL SELECT 'mx', MAX(LastUpdate) FROM mx WHERE Subdomain=$5
+	UNION ALL SELECT 'srv', MAX(LastUpdate) FROM srv WHERE Subdomain=$6
+	UNION ALL SELECT 'caa', MAX(LastUpdate) FROM caa WHERE Subdomain=$7
+	UNION ALL SELECT Type, MAX(LastUpdate) FROM rr WHERE Subdomain=$8 GROUP BY Type
+	`
+	args := make([]interface{}, 8)
+	for i := range args {
+		args[i] = domain
+	}
+	rows, err := d.DB.Query(d.stmt(getSQL), args...)
+	if err != nil {
+		return updates, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var rtype string
+		var lastUpdate sql.NullInt64
+		if err = rows.Scan(&rtype, &lastUpdate); err != nil {
+			return updates, err
+		}
+		if lastUpdate.Valid && lastUpdate.Int64 > 0 {
+			updates[strings.ToLower(rtype)] = lastUpdate.Int64
+		}
+	}
+	return updates, rows.Err()
+}
+
+func (d *acmedb) queryTXT(domain string) ([]string, error) {
+	var txts []string
+	getSQL := `
+	SELECT Value FROM txt WHERE Subdomain=$1 AND Slot < $2 ORDER BY Slot
+	`
+	getSQL = d.stmt(getSQL)
+
+	sm, err := d.stmts.prepare(d.DB, getSQL)
+	if err != nil {
+		return txts, err
+	}
+	rows, err := sm.Query(domain, txtSlotCount())
+	if err != nil {
+		return txts, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var rtxt string
+		err = rows.Scan(&rtxt)
+		if err != nil {
+			return txts, err
+		}
+		txts = append(txts, rtxt)
+	}
+	return txts, nil
+}
+
+func (d *acmedb) GetAForDomain(domain string) ([]net.IP, error) {
+	domain = sanitizeString(domain)
+	d.stripes.RLock(domain)
+	defer d.stripes.RUnlock(domain)
+	if d.negCache.has(domain) {
+		return nil, nil
+	}
+	if d.recordCache.enabled() {
+		records, err := d.cachedRecords(domain)
+		return records.A, err
+	}
+	ips, err := d.queryA(domain)
+	if err != nil {
+		if stale, ok := d.staleRecords(domain, err); ok {
+			return stale.A, nil
+		}
+	}
+	return ips, err
+}
+
+func (d *acmedb) queryA(domain string) ([]net.IP, error) {
+	var ips []net.IP
+	getSQL := `
+	SELECT Value FROM a WHERE Subdomain=$1 LIMIT 255
+	`
+	getSQL = d.stmt(getSQL)
+
+	sm, err := d.stmts.prepare(d.DB, getSQL)
+	if err != nil {
+		return ips, err
+	}
+	rows, err := sm.Query(domain)
+	if err != nil {
+		return ips, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var ra string
+		var ip net.IP
+		err = rows.Scan(&ra)
+		if err != nil {
+			return ips, err
+		}
+		ip = net.ParseIP(ra)
+		if ip != nil {
+			ip = ip.To4()
+		}
+		if ip == nil {
+			return ips, fmt.Errorf("invalid IPv4 address: %s", ra)
+		}
+		ips = append(ips, ip)
+	}
+	return ips, nil
+}
+
+func (d *acmedb) GetAAAAForDomain(domain string) ([]net.IP, error) {
+	domain = sanitizeString(domain)
+	d.stripes.RLock(domain)
+	defer d.stripes.RUnlock(domain)
+	if d.negCache.has(domain) {
+		return nil, nil
+	}
+	if d.recordCache.enabled() {
+		records, err := d.cachedRecords(domain)
+		return records.AAAA, err
+	}
+	ip6s, err := d.queryAAAA(domain)
+	if err != nil {
+		if stale, ok := d.staleRecords(domain, err); ok {
+			return stale.AAAA, nil
+		}
+	}
+	return ip6s, err
+}
+
+func (d *acmedb) queryAAAA(domain string) ([]net.IP, error) {
+	var ip6s []net.IP
+	getSQL := `
+	SELECT Value FROM aaaa WHERE Subdomain=$1 LIMIT 255
+	`
+	getSQL = d.stmt(getSQL)
+
+	sm, err := d.stmts.prepare(d.DB, getSQL)
 	if err != nil {
 		return ip6s, err
 	}
-	defer sm.Close()
 	rows, err := sm.Query(domain)
 	if err != nil {
 		return ip6s, err
@@ -425,48 +874,413 @@ func (d *acmedb) GetAAAAForDomain(domain string) ([]net.IP, error) {
 	return ip6s, nil
 }
 
-func (d *acmedb) CountRecords(domain string) (count int, err error) {
-	d.Mutex.Lock()
-	defer d.Mutex.Unlock()
+// GetCNAMEForDomain returns the CNAME target of the subdomain, empty if it has none
+func (d *acmedb) GetCNAMEForDomain(domain string) (string, error) {
+	domain = sanitizeString(domain)
+	d.stripes.RLock(domain)
+	defer d.stripes.RUnlock(domain)
+	if d.negCache.has(domain) {
+		return "", nil
+	}
+	if d.recordCache.enabled() {
+		records, err := d.cachedRecords(domain)
+		return records.CNAME, err
+	}
+	target, err := d.queryCNAME(domain)
+	if err != nil {
+		if stale, ok := d.staleRecords(domain, err); ok {
+			return stale.CNAME, nil
+		}
+	}
+	return target, err
+}
+
+// GetWildcardForDomain tells if the records of the subdomain are served for the
+// names below it
+func (d *acmedb) GetWildcardForDomain(domain string) (bool, error) {
+	domain = sanitizeString(domain)
+	if d.negCache.has(domain) {
+		return false, nil
+	}
+	sm, err := d.stmts.prepare(d.DB, d.stmt("SELECT Wildcard FROM records WHERE Subdomain=$1"))
+	if err != nil {
+		return false, err
+	}
+	var wildcard int
+	err = sm.QueryRow(domain).Scan(&wildcard)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return wildcard == 1, err
+}
+
+// GetZoneForDomain returns the zone of the registration of the subdomain, or an
+// empty string if the subdomain isn't registered
+func (d *acmedb) GetZoneForDomain(domain string) (string, error) {
+	domain = sanitizeString(domain)
+	if d.negCache.has(domain) {
+		return "", nil
+	}
+	sm, err := d.stmts.prepare(d.DB, d.stmt("SELECT Zone FROM records WHERE Subdomain=$1"))
+	if err != nil {
+		return "", err
+	}
+	var reg ACMETxt
+	err = sm.QueryRow(domain).Scan(&reg.Origin.Zone)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return registrationZone(reg), nil
+}
+
+// GetSubnetAnswersForDomain returns the addresses the subdomain answers to the
+// clients in their subnets
+func (d *acmedb) GetSubnetAnswersForDomain(domain string) ([]subnetAnswer, error) {
+	domain = sanitizeString(domain)
+	if d.negCache.has(domain) {
+		return nil, nil
+	}
+	sm, err := d.stmts.prepare(d.DB, d.stmt("SELECT SubnetAnswers FROM records WHERE Subdomain=$1"))
+	if err != nil {
+		return nil, err
+	}
+	var value string
+	err = sm.QueryRow(domain).Scan(&value)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var answers []subnetAnswer
+	err = json.Unmarshal([]byte(value), &answers)
+	return answers, err
+}
+
+func (d *acmedb) queryCNAME(domain string) (string, error) {
+	sm, err := d.stmts.prepare(d.DB, d.stmt("SELECT Value FROM cname WHERE Subdomain=$1"))
+	if err != nil {
+		return "", err
+	}
+	var target string
+	err = sm.QueryRow(domain).Scan(&target)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return target, err
+}
+
+// GetMXForDomain returns the mail exchangers of the subdomain
+func (d *acmedb) GetMXForDomain(domain string) ([]mxRecord, error) {
+	domain = sanitizeString(domain)
+	d.stripes.RLock(domain)
+	defer d.stripes.RUnlock(domain)
+	if d.negCache.has(domain) {
+		return nil, nil
+	}
+	if d.recordCache.enabled() {
+		records, err := d.cachedRecords(domain)
+		return records.MX, err
+	}
+	mxs, err := d.queryMX(domain)
+	if err != nil {
+		if stale, ok := d.staleRecords(domain, err); ok {
+			return stale.MX, nil
+		}
+	}
+	return mxs, err
+}
+
+func (d *acmedb) queryMX(domain string) ([]mxRecord, error) {
+	var mxs []mxRecord
+	sm, err := d.stmts.prepare(d.DB, d.stmt("SELECT Priority, Value FROM mx WHERE Subdomain=$1 ORDER BY Priority, Value LIMIT 255"))
+	if err != nil {
+		return mxs, err
+	}
+	rows, err := sm.Query(domain)
+	if err != nil {
+		return mxs, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var mx mxRecord
+		if err = rows.Scan(&mx.Priority, &mx.Target); err != nil {
+			return mxs, err
+		}
+		mxs = append(mxs, mx)
+	}
+	return mxs, rows.Err()
+}
+
+// GetSRVForDomain returns the service locations of the subdomain
+func (d *acmedb) GetSRVForDomain(domain string) ([]srvRecord, error) {
+	domain = sanitizeString(domain)
+	d.stripes.RLock(domain)
+	defer d.stripes.RUnlock(domain)
+	if d.negCache.has(domain) {
+		return nil, nil
+	}
+	if d.recordCache.enabled() {
+		records, err := d.cachedRecords(domain)
+		return records.SRV, err
+	}
+	srvs, err := d.querySRV(domain)
+	if err != nil {
+		if stale, ok := d.staleRecords(domain, err); ok {
+			return stale.SRV, nil
+		}
+	}
+	return srvs, err
+}
+
+func (d *acmedb) querySRV(domain string) ([]srvRecord, error) {
+	var srvs []srvRecord
+	sm, err := d.stmts.prepare(d.DB, d.stmt("SELECT Priority, Weight, Port, Value FROM srv WHERE Subdomain=$1 ORDER BY Priority, Weight DESC, Port, Value LIMIT 255"))
+	if err != nil {
+		return srvs, err
+	}
+	rows, err := sm.Query(domain)
+	if err != nil {
+		return srvs, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var srv srvRecord
+		if err = rows.Scan(&srv.Priority, &srv.Weight, &srv.Port, &srv.Target); err != nil {
+			return srvs, err
+		}
+		srvs = append(srvs, srv)
+	}
+	return srvs, rows.Err()
+}
+
+// GetCAAForDomain returns the certification authority authorization of the subdomain
+func (d *acmedb) GetCAAForDomain(domain string) ([]caaRecord, error) {
+	domain = sanitizeString(domain)
+	d.stripes.RLock(domain)
+	defer d.stripes.RUnlock(domain)
+	if d.negCache.has(domain) {
+		return nil, nil
+	}
+	if d.recordCache.enabled() {
+		records, err := d.cachedRecords(domain)
+		return records.CAA, err
+	}
+	caas, err := d.queryCAA(domain)
+	if err != nil {
+		if stale, ok := d.staleRecords(domain, err); ok {
+			return stale.CAA, nil
+		}
+	}
+	return caas, err
+}
+
+func (d *acmedb) queryCAA(domain string) ([]caaRecord, error) {
+	var caas []caaRecord
+	sm, err := d.stmts.prepare(d.DB, d.stmt("SELECT Flags, Tag, Value FROM caa WHERE Subdomain=$1 ORDER BY Tag, Value, Flags LIMIT 255"))
+	if err != nil {
+		return caas, err
+	}
+	rows, err := sm.Query(domain)
+	if err != nil {
+		return caas, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var caa caaRecord
+		if err = rows.Scan(&caa.Flags, &caa.Tag, &caa.Value); err != nil {
+			return caas, err
+		}
+		caas = append(caas, caa)
+	}
+	return caas, rows.Err()
+}
+
+// GetTTLForDomain returns the TTL set for the record types of the subdomain
+func (d *acmedb) GetTTLForDomain(domain string) (map[string]int, error) {
 	domain = sanitizeString(domain)
+	d.stripes.RLock(domain)
+	defer d.stripes.RUnlock(domain)
+	if d.negCache.has(domain) {
+		return nil, nil
+	}
+	if d.recordCache.enabled() {
+		records, err := d.cachedRecords(domain)
+		return records.TTL, err
+	}
+	ttls, err := d.queryTTL(domain)
+	if err != nil {
+		if stale, ok := d.staleRecords(domain, err); ok {
+			return stale.TTL, nil
+		}
+	}
+	return ttls, err
+}
+
+func (d *acmedb) queryTTL(domain string) (map[string]int, error) {
+	ttls := make(map[string]int)
+	sm, err := d.stmts.prepare(d.DB, d.stmt("SELECT Type, TTL FROM ttl WHERE Subdomain=$1"))
+	if err != nil {
+		return ttls, err
+	}
+	rows, err := sm.Query(domain)
+	if err != nil {
+		return ttls, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var rtype string
+		var ttl int
+		if err = rows.Scan(&rtype, &ttl); err != nil {
+			return ttls, err
+		}
+		ttls[rtype] = ttl
+	}
+	return ttls, rows.Err()
+}
+
+// GetRecordsForDomain returns the records of the subdomain stored in the generic rr table
+func (d *acmedb) GetRecordsForDomain(domain string) ([]genericRecord, error) {
+	domain = sanitizeString(domain)
+	d.stripes.RLock(domain)
+	defer d.stripes.RUnlock(domain)
+	if d.negCache.has(domain) {
+		return nil, nil
+	}
+	if d.recordCache.enabled() {
+		records, err := d.cachedRecords(domain)
+		return records.RR, err
+	}
+	records, err := d.queryRecords(domain)
+	if err != nil {
+		if stale, ok := d.staleRecords(domain, err); ok {
+			return stale.RR, nil
+		}
+	}
+	return records, err
+}
+
+func (d *acmedb) queryRecords(domain string) ([]genericRecord, error) {
+	var records []genericRecord
+	sm, err := d.stmts.prepare(d.DB, d.stmt("SELECT Type, Content, TTL FROM rr WHERE Subdomain=$1 ORDER BY Type, Content LIMIT 255"))
+	if err != nil {
+		return records, err
+	}
+	rows, err := sm.Query(domain)
+	if err != nil {
+		return records, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var g genericRecord
+		if err = rows.Scan(&g.Type, &g.Content, &g.TTL); err != nil {
+			return records, err
+		}
+		records = append(records, g)
+	}
+	return records, rows.Err()
+}
+
+// GetSubdomainsForAddress returns the subdomains with an A or AAAA record of the address
+func (d *acmedb) GetSubdomainsForAddress(ip net.IP) ([]string, error) {
+	var subdomains []string
+	getSQL := `
+	SELECT DISTINCT Subdomain FROM aaaa WHERE Value=$1 ORDER BY Subdomain
+	`
+	if ip.To4() != nil {
+		getSQL = `
+	SELECT DISTINCT Subdomain FROM a WHERE Value=$1 ORDER BY Subdomain
+	`
+	}
+	getSQL = d.stmt(getSQL)
+
+	sm, err := d.stmts.prepare(d.DB, getSQL)
+	if err != nil {
+		return subdomains, err
+	}
+	rows, err := sm.Query(ip.String())
+	if err != nil {
+		return subdomains, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var subdomain string
+		err = rows.Scan(&subdomain)
+		if err != nil {
+			return subdomains, err
+		}
+		subdomains = append(subdomains, subdomain)
+	}
+	return subdomains, rows.Err()
+}
+
+func (d *acmedb) CountRecords(domain string) (int, error) {
+	domain = sanitizeString(domain)
+	d.stripes.RLock(domain)
+	defer d.stripes.RUnlock(domain)
+	if d.negCache.has(domain) {
+		return 0, nil
+	}
+	if d.recordCache.enabled() {
+		records, err := d.cachedRecords(domain)
+		if err == nil && records.count() == 0 && d.negCache.enabled() {
+			err = d.cacheIfNonexistent(domain)
+		}
+		return records.count(), err
+	}
+	count, err := d.countRecords(domain)
+	if err != nil {
+		if stale, ok := d.staleRecords(domain, err); ok {
+			return stale.count(), nil
+		}
+	}
+	return count, err
+}
+
+func (d *acmedb) countRecords(domain string) (count int, err error) {
 	countTXTSQL := `
-	SELECT COUNT(*) FROM txt WHERE Subdomain=$1 AND Value != ''
+	SELECT COUNT(*) FROM txt WHERE Subdomain=$1 AND Slot < $2 AND Value != ''
+	`
+	if Config.General.EmptyTXT == "serve" {
+		// Empty slots count as a single record, like servedTXT answers them
+		countTXTSQL = `
+	SELECT COALESCE(SUM(CASE WHEN Value != '' THEN 1 ELSE 0 END) + MAX(CASE WHEN Value = '' THEN 1 ELSE 0 END), 0)
+	FROM txt WHERE Subdomain=$1 AND Slot < $2
 	`
+	}
 	countASQL := `
 	SELECT COUNT(*) FROM a WHERE Subdomain=$1
 	`
 	countAAAASQL := `
 	SELECT COUNT(*) FROM aaaa WHERE Subdomain=$1
 	`
-	if Config.Database.Engine == "sqlite3" {
-		countTXTSQL = getSQLiteStmt(countTXTSQL)
-		countASQL = getSQLiteStmt(countASQL)
-		countAAAASQL = getSQLiteStmt(countAAAASQL)
-	}
+	countTXTSQL = d.stmt(countTXTSQL)
+	countASQL = d.stmt(countASQL)
+	countAAAASQL = d.stmt(countAAAASQL)
 
 	var countTXTStmt *sql.Stmt
-	countTXTStmt, err = d.DB.Prepare(countTXTSQL)
+	countTXTStmt, err = d.stmts.prepare(d.DB, countTXTSQL)
 	if err != nil {
 		return
 	}
-	defer countTXTStmt.Close()
 
 	var countAStmt *sql.Stmt
-	countAStmt, err = d.DB.Prepare(countASQL)
+	countAStmt, err = d.stmts.prepare(d.DB, countASQL)
 	if err != nil {
 		return
 	}
-	defer countAStmt.Close()
 
 	var countAAAAStmt *sql.Stmt
-	countAAAAStmt, err = d.DB.Prepare(countAAAASQL)
+	countAAAAStmt, err = d.stmts.prepare(d.DB, countAAAASQL)
 	if err != nil {
 		return
 	}
-	defer countAAAAStmt.Close()
 
 	var countTXTRows *sql.Rows
-	countTXTRows, err = countTXTStmt.Query(domain)
+	countTXTRows, err = countTXTStmt.Query(domain, txtSlotCount())
 	if err != nil {
 		return
 	}
@@ -505,44 +1319,388 @@ func (d *acmedb) CountRecords(domain string) (count int, err error) {
 		var c int
 		err = countAAAARows.Scan(&c)
 		if err != nil {
-			return
+			return
+		}
+		count += c
+	}
+
+	var cname string
+	cname, err = d.queryCNAME(domain)
+	if err != nil {
+		return
+	}
+	if cname != "" {
+		count++
+	}
+
+	var mxs []mxRecord
+	mxs, err = d.queryMX(domain)
+	if err != nil {
+		return
+	}
+	count += len(mxs)
+
+	var srvs []srvRecord
+	srvs, err = d.querySRV(domain)
+	if err != nil {
+		return
+	}
+	count += len(srvs)
+
+	var caas []caaRecord
+	caas, err = d.queryCAA(domain)
+	if err != nil {
+		return
+	}
+	count += len(caas)
+
+	var generic []genericRecord
+	generic, err = d.queryRecords(domain)
+	if err != nil {
+		return
+	}
+	count += len(generic)
+
+	if count == 0 && d.negCache.enabled() {
+		err = d.cacheIfNonexistent(domain)
+	}
+	return
+}
+
+// ClearStaleTXT blanks the TXT values last updated before olderThan ago and
+// returns their number
+func (d *acmedb) ClearStaleTXT(olderThan time.Duration) (int, error) {
+	cutoff := d.Now().Add(-olderThan).Unix()
+	var subdomains []string
+	rows, err := d.DB.Query(d.stmt("SELECT DISTINCT Subdomain FROM txt WHERE Value<>'' AND LastUpdate < $1"), cutoff)
+	if err != nil {
+		return 0, err
+	}
+	for rows.Next() {
+		var subdomain string
+		if err = rows.Scan(&subdomain); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		subdomains = append(subdomains, subdomain)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+	cleared := 0
+	for _, subdomain := range subdomains {
+		n, err := d.clearStaleTXT(subdomain, cutoff)
+		if err != nil {
+			return cleared, err
+		}
+		cleared += n
+	}
+	return cleared, nil
+}
+
+func (d *acmedb) clearStaleTXT(subdomain string, cutoff int64) (int, error) {
+	d.stripes.Lock(subdomain)
+	defer d.stripes.Unlock(subdomain)
+	updSQL := d.stmt("UPDATE txt SET Value='', CorrelationID='' WHERE Subdomain=$1 AND Value<>'' AND LastUpdate < $2")
+	res, err := d.DB.Exec(updSQL, subdomain, cutoff)
+	if err != nil {
+		return 0, err
+	}
+	d.recordCache.remove(subdomain)
+	affected, err := res.RowsAffected()
+	return int(affected), err
+}
+
+// cacheIfNonexistent adds the subdomain to the negative cache if it isn't registered
+func (d *acmedb) cacheIfNonexistent(domain string) error {
+	existsSQL := `
+	SELECT COUNT(*) FROM records WHERE Subdomain=$1
+	`
+	existsSQL = d.stmt(existsSQL)
+	var c int
+	err := d.DB.QueryRow(existsSQL, domain).Scan(&c)
+	if err != nil {
+		return err
+	}
+	if c == 0 {
+		d.negCache.add(domain)
+	}
+	return nil
+}
+
+// cachedRecords returns the records of the subdomain from the record cache,
+// loading them from the database on a cache miss.
+func (d *acmedb) cachedRecords(domain string) (recordSet, error) {
+	if records, ok := d.recordCache.get(domain); ok {
+		return records, nil
+	}
+	// Lookups don't wait for the updates, the records loaded while one is applied
+	// are left out of the cache
+	generation := d.recordCache.generation()
+	records, err := d.loadRecords(domain)
+	if err != nil {
+		if stale, ok := d.staleRecords(domain, err); ok {
+			return stale, nil
+		}
+		return records, err
+	}
+	d.recordCache.add(domain, records, generation)
+	return records, nil
+}
+
+// loadRecords queries all the record values of the subdomain
+func (d *acmedb) loadRecords(domain string) (recordSet, error) {
+	var records recordSet
+	var err error
+	records.TXT, err = d.queryTXT(domain)
+	if err != nil {
+		return records, err
+	}
+	records.A, err = d.queryA(domain)
+	if err != nil {
+		return records, err
+	}
+	records.AAAA, err = d.queryAAAA(domain)
+	if err != nil {
+		return records, err
+	}
+	records.CNAME, err = d.queryCNAME(domain)
+	if err != nil {
+		return records, err
+	}
+	records.MX, err = d.queryMX(domain)
+	if err != nil {
+		return records, err
+	}
+	records.SRV, err = d.querySRV(domain)
+	if err != nil {
+		return records, err
+	}
+	records.CAA, err = d.queryCAA(domain)
+	if err != nil {
+		return records, err
+	}
+	records.RR, err = d.queryRecords(domain)
+	if err != nil {
+		return records, err
+	}
+	records.TTL, err = d.queryTTL(domain)
+	return records, err
+}
+
+// WarmUp loads the records of subdomains updated after since into the record
+// cache and returns the number of subdomains loaded.
+func (d *acmedb) WarmUp(since time.Time) (int, error) {
+	if !d.recordCache.enabled() {
+		return 0, nil
+	}
+	getSQL := `
+	SELECT Subdomain FROM txt WHERE LastUpdate >= $1 AND Value != ''
+	UNION SELECT Subdomain FROM a WHERE LastUpdate >= $2
+	UNION SELECT Subdomain FROM aaaa WHERE LastUpdate >= $3
+	UNION SELECT Subdomain FROM cname WHERE LastUpdate >= $4
+	UNION SELECT Subdomain FROM mx WHERE LastUpdate >= $5
+	UNION SELECT Subdomain FROM srv WHERE LastUpdate >= $6
+	UNION SELECT Subdomain FROM caa WHERE LastUpdate >= $7
+	UNION SELECT Subdomain FROM rr WHERE LastUpdate >= $8
+	`
+	getSQL = d.stmt(getSQL)
+	rows, err := d.DB.Query(getSQL, since.Unix(), since.Unix(), since.Unix(), since.Unix(), since.Unix(), since.Unix(), since.Unix(), since.Unix())
+	if err != nil {
+		return 0, err
+	}
+	var subdomains []string
+	for rows.Next() && len(subdomains) < recordCacheMaxEntries {
+		var subdomain string
+		if err = rows.Scan(&subdomain); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		subdomains = append(subdomains, subdomain)
+	}
+	rows.Close()
+	for i, subdomain := range subdomains {
+		d.stripes.RLock(subdomain)
+		generation := d.recordCache.generation()
+		records, err := d.loadRecords(subdomain)
+		if err == nil {
+			d.recordCache.add(subdomain, records, generation)
+		}
+		d.stripes.RUnlock(subdomain)
+		if err != nil {
+			return i, err
+		}
+	}
+	return len(subdomains), nil
+}
+
+// staleRecords returns the last known good records of the subdomain when
+// serving stale data is enabled and the database query failed with err.
+func (d *acmedb) staleRecords(domain string, err error) (recordSet, bool) {
+	records, ok := d.snapshot.get(domain)
+	if !ok {
+		return records, false
+	}
+	dbLog.WithFields(log.Fields{"error": err.Error(), "subdomain": domain, "age": d.snapshot.age(d.Now()).String()}).Warning("Database query failed, serving stale data")
+	return records, true
+}
+
+// RefreshSnapshot reloads the stale data snapshot from the database
+func (d *acmedb) RefreshSnapshot() error {
+	if !d.snapshot.enabled() {
+		return nil
+	}
+	records := make(map[string]recordSet)
+	getSQL := map[string]string{
+		"txt":   "SELECT Subdomain, Value FROM txt WHERE Slot < $1 ORDER BY Subdomain, Slot",
+		"a":     "SELECT Subdomain, Value FROM a ORDER BY Subdomain",
+		"aaaa":  "SELECT Subdomain, Value FROM aaaa ORDER BY Subdomain",
+		"cname": "SELECT Subdomain, Value FROM cname ORDER BY Subdomain",
+		"mx":    "SELECT Subdomain, Value, Priority FROM mx ORDER BY Subdomain, Priority, Value",
+		"srv":   "SELECT Subdomain, Value, Priority, Weight, Port FROM srv ORDER BY Subdomain, Priority, Weight DESC, Port, Value",
+		"caa":   "SELECT Subdomain, Value, Flags, Tag FROM caa ORDER BY Subdomain, Tag, Value, Flags",
+		"rr":    "SELECT Subdomain, Content, TTL, Type FROM rr ORDER BY Subdomain, Type, Content",
+		"ttl":   "SELECT Subdomain, Type, TTL FROM ttl ORDER BY Subdomain",
+	}
+	for _, table := range append(append([]string{}, recordTypes...), "rr", "ttl") {
+		q := getSQL[table]
+		q = d.stmt(q)
+		var args []interface{}
+		if table == "txt" {
+			args = append(args, txtSlotCount())
+		}
+		rows, err := d.DB.Query(q, args...)
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+			var subdomain, value string
+			var priority, weight, port, flags, ttl int
+			var tag, rtype string
+			dest := []interface{}{&subdomain, &value}
+			switch table {
+			case "mx":
+				dest = append(dest, &priority)
+			case "srv":
+				dest = append(dest, &priority, &weight, &port)
+			case "caa":
+				dest = append(dest, &flags, &tag)
+			case "rr":
+				dest = append(dest, &ttl, &rtype)
+			case "ttl":
+				dest = append(dest, &ttl)
+			}
+			if err = rows.Scan(dest...); err != nil {
+				rows.Close()
+				return err
+			}
+			r, ok := records[subdomain]
+			if !ok && len(records) >= staleSnapshotMaxSubdomains {
+				continue
+			}
+			switch table {
+			case "txt":
+				r.TXT = append(r.TXT, value)
+			case "a":
+				if ip := net.ParseIP(value).To4(); ip != nil {
+					r.A = append(r.A, ip)
+				}
+			case "aaaa":
+				if ip := net.ParseIP(value); ip != nil {
+					r.AAAA = append(r.AAAA, ip)
+				}
+			case "cname":
+				r.CNAME = value
+			case "mx":
+				r.MX = append(r.MX, mxRecord{priority, value})
+			case "srv":
+				r.SRV = append(r.SRV, srvRecord{priority, weight, port, value})
+			case "caa":
+				r.CAA = append(r.CAA, caaRecord{flags, tag, value})
+			case "rr":
+				r.RR = append(r.RR, genericRecord{rtype, value, ttl})
+			case "ttl":
+				if r.TTL == nil {
+					r.TTL = make(map[string]int)
+				}
+				r.TTL[value] = ttl
+			}
+			records[subdomain] = r
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return err
 		}
-		count += c
 	}
+	d.snapshot.replace(records, d.Now())
+	return nil
+}
 
-	return
+// Update stores the posted values for the subdomain. When no TXT slot is given,
+// the least recently updated one is overwritten. The returned ACMETxtPost has
+// the slot used for the TXT value filled in.
+func (d *acmedb) Update(a ACMETxtPost) (ACMETxtPost, error) {
+	d.stripes.Lock(a.Subdomain)
+	defer d.stripes.Unlock(a.Subdomain)
+	// Invalidated once committed, the cache is filled without the lock
+	defer d.recordCache.remove(a.Subdomain)
+	var updated ACMETxtPost
+	err := d.retry("update", func() error {
+		var err error
+		updated, err = d.updateInTransaction(a)
+		return err
+	})
+	return updated, err
 }
 
-func (d *acmedb) Update(a ACMETxtPost) error {
-	d.Mutex.Lock()
-	defer d.Mutex.Unlock()
+// updateInTransaction writes the values of a to all the record tables in a single transaction
+func (d *acmedb) updateInTransaction(a ACMETxtPost) (ACMETxtPost, error) {
+	tx, err := d.DB.Begin()
+	if err != nil {
+		return a, err
+	}
+	// Rollback is a no-op after a successful commit
+	defer func() { _ = tx.Rollback() }()
+	if a, err = d.updateTx(tx, a, d.Now().Unix()); err != nil {
+		return a, err
+	}
+	return a, tx.Commit()
+}
+
+// updateTx writes the values of a to the record tables in the transaction
+func (d *acmedb) updateTx(tx *sql.Tx, a ACMETxtPost, timenow int64) (ACMETxtPost, error) {
 	var err error
 	// Data in a is already sanitized
-	timenow := time.Now().Unix()
-
+	for _, value := range a.ClearTXT {
+		_, err = tx.Exec(d.stmt("UPDATE txt SET Value='', CorrelationID='' WHERE Subdomain=$1 AND Value=$2"), a.Subdomain, value)
+		if err != nil {
+			return a, err
+		}
+	}
 	if a.Value != "" {
-		updSQL := `
-	UPDATE txt SET Value=$1, LastUpdate=$2
-	WHERE rowid=(
-		SELECT rowid FROM txt WHERE Subdomain=$3 ORDER BY LastUpdate LIMIT 1)
-	`
-		if Config.Database.Engine == "sqlite3" {
-			updSQL = getSQLiteStmt(updSQL)
+		var slot int
+		if a.Slot != nil {
+			slot = *a.Slot
+		} else {
+			slot, err = d.nextTXTSlot(tx, a.Subdomain)
+			if err != nil {
+				return a, err
+			}
 		}
-
-		var sm *sql.Stmt
-		sm, err = d.DB.Prepare(updSQL)
-		if err != nil {
-			return err
+		if slot < 0 || slot >= txtSlotCount() {
+			return a, fmt.Errorf("invalid TXT slot: %d", slot)
 		}
-		defer sm.Close()
-		_, err = sm.Exec(a.Value, timenow, a.Subdomain)
+		err = d.setTXTSlot(tx, a.Subdomain, slot, a.Value, a.CorrelationID, timenow)
 		if err != nil {
-			return err
+			return a, err
 		}
+		a.Slot = &slot
 	}
 
-	if len(a.AValues) > 0 {
+	// The values replace the current ones, and clearing leaves none
+	if len(a.AValues) > 0 || a.ClearA {
 		deleteSQL := `
 	DELETE FROM a
 	WHERE Subdomain=$1
@@ -554,36 +1712,34 @@ func (d *acmedb) Update(a ACMETxtPost) error {
         LastUpdate) 
         values($1, $2, $3)
 	`
-		if Config.Database.Engine == "sqlite3" {
-			deleteSQL = getSQLiteStmt(deleteSQL)
-			insertSQL = getSQLiteStmt(insertSQL)
-		}
+		deleteSQL = d.stmt(deleteSQL)
+		insertSQL = d.stmt(insertSQL)
 
 		var deleteStmt *sql.Stmt
-		deleteStmt, err = d.DB.Prepare(deleteSQL)
+		deleteStmt, err = tx.Prepare(deleteSQL)
 		if err != nil {
-			return err
+			return a, err
 		}
 		defer deleteStmt.Close()
 		var insertStmt *sql.Stmt
-		insertStmt, err = d.DB.Prepare(insertSQL)
+		insertStmt, err = tx.Prepare(insertSQL)
 		if err != nil {
-			return err
+			return a, err
 		}
 		defer insertStmt.Close()
 		_, err = deleteStmt.Exec(a.Subdomain)
 		if err != nil {
-			return err
+			return a, err
 		}
 		for i := range a.AValues {
 			_, err = insertStmt.Exec(a.Subdomain, a.AValues[i], timenow)
 			if err != nil {
-				return err
+				return a, err
 			}
 		}
 	}
 
-	if len(a.AAAAValues) > 0 {
+	if len(a.AAAAValues) > 0 || a.ClearAAAA {
 		deleteSQL := `
 	DELETE FROM aaaa
 	WHERE Subdomain=$1
@@ -595,67 +1751,617 @@ func (d *acmedb) Update(a ACMETxtPost) error {
         LastUpdate) 
         values($1, $2, $3)
 	`
-		if Config.Database.Engine == "sqlite3" {
-			deleteSQL = getSQLiteStmt(deleteSQL)
-			insertSQL = getSQLiteStmt(insertSQL)
-		}
+		deleteSQL = d.stmt(deleteSQL)
+		insertSQL = d.stmt(insertSQL)
 
 		var deleteStmt *sql.Stmt
-		deleteStmt, err = d.DB.Prepare(deleteSQL)
+		deleteStmt, err = tx.Prepare(deleteSQL)
 		if err != nil {
-			return err
+			return a, err
 		}
 		defer deleteStmt.Close()
 		var insertStmt *sql.Stmt
-		insertStmt, err = d.DB.Prepare(insertSQL)
+		insertStmt, err = tx.Prepare(insertSQL)
 		if err != nil {
-			return err
+			return a, err
 		}
 		defer insertStmt.Close()
 		_, err = deleteStmt.Exec(a.Subdomain)
 		if err != nil {
-			return err
+			return a, err
 		}
 		for i := range a.AAAAValues {
 			_, err = insertStmt.Exec(a.Subdomain, a.AAAAValues[i], timenow)
 			if err != nil {
-				return err
+				return a, err
 			}
 		}
 	}
 
-	return nil
+	if len(a.MXValues) > 0 || a.ClearMX {
+		if _, err = tx.Exec(d.stmt("DELETE FROM mx WHERE Subdomain=$1"), a.Subdomain); err != nil {
+			return a, err
+		}
+		insSQL := d.stmt("INSERT INTO mx (Subdomain, Priority, Value, LastUpdate) values($1, $2, $3, $4)")
+		for _, mx := range a.MXValues {
+			if _, err = tx.Exec(insSQL, a.Subdomain, mx.Priority, mx.Target, timenow); err != nil {
+				return a, err
+			}
+		}
+	}
+
+	if len(a.SRVValues) > 0 || a.ClearSRV {
+		if _, err = tx.Exec(d.stmt("DELETE FROM srv WHERE Subdomain=$1"), a.Subdomain); err != nil {
+			return a, err
+		}
+		insSQL := d.stmt("INSERT INTO srv (Subdomain, Priority, Weight, Port, Value, LastUpdate) values($1, $2, $3, $4, $5, $6)")
+		for _, srv := range a.SRVValues {
+			if _, err = tx.Exec(insSQL, a.Subdomain, srv.Priority, srv.Weight, srv.Port, srv.Target, timenow); err != nil {
+				return a, err
+			}
+		}
+	}
+
+	if len(a.CAAValues) > 0 || a.ClearCAA {
+		if _, err = tx.Exec(d.stmt("DELETE FROM caa WHERE Subdomain=$1"), a.Subdomain); err != nil {
+			return a, err
+		}
+		insSQL := d.stmt("INSERT INTO caa (Subdomain, Flags, Tag, Value, LastUpdate) values($1, $2, $3, $4, $5)")
+		for _, caa := range a.CAAValues {
+			if _, err = tx.Exec(insSQL, a.Subdomain, caa.Flags, caa.Tag, caa.Value, timenow); err != nil {
+				return a, err
+			}
+		}
+	}
+
+	for _, rtype := range changedGenericTypes(a) {
+		if _, err = tx.Exec(d.stmt("DELETE FROM rr WHERE Subdomain=$1 AND Type=$2"), a.Subdomain, rtype); err != nil {
+			return a, err
+		}
+	}
+	insSQL := d.stmt("INSERT INTO rr (Subdomain, Type, Content, TTL, LastUpdate) values($1, $2, $3, $4, $5)")
+	for _, g := range a.Records {
+		if _, err = tx.Exec(insSQL, a.Subdomain, g.Type, g.Content, g.TTL, timenow); err != nil {
+			return a, err
+		}
+	}
+
+	// A CNAME can't coexist with other records, setting either replaces the other
+	if a.CNAME != "" || a.ClearCNAME || len(a.AValues) > 0 || len(a.AAAAValues) > 0 || len(a.MXValues) > 0 || len(a.SRVValues) > 0 || len(a.CAAValues) > 0 || len(a.Records) > 0 {
+		if _, err = tx.Exec(d.stmt("DELETE FROM cname WHERE Subdomain=$1"), a.Subdomain); err != nil {
+			return a, err
+		}
+	}
+	if a.CNAME != "" {
+		for _, delSQL := range []string{
+			"DELETE FROM a WHERE Subdomain=$1",
+			"DELETE FROM aaaa WHERE Subdomain=$1",
+			"DELETE FROM mx WHERE Subdomain=$1",
+			"DELETE FROM srv WHERE Subdomain=$1",
+			"DELETE FROM caa WHERE Subdomain=$1",
+			"DELETE FROM rr WHERE Subdomain=$1",
+		} {
+			if _, err = tx.Exec(d.stmt(delSQL), a.Subdomain); err != nil {
+				return a, err
+			}
+		}
+		insSQL := d.stmt("INSERT INTO cname (Subdomain, Value, LastUpdate) values($1, $2, $3)")
+		if _, err = tx.Exec(insSQL, a.Subdomain, a.CNAME, timenow); err != nil {
+			return a, err
+		}
+	}
+	if err = d.setTTLInTransaction(tx, a, timenow); err != nil {
+		return a, err
+	}
+	return a, nil
+}
+
+// UpdateBatch applies the updates of the subdomain in order in a single
+// transaction, so that either all or none of them take effect
+func (d *acmedb) UpdateBatch(subdomain string, updates []ACMETxtPost) ([]ACMETxtPost, error) {
+	d.stripes.Lock(subdomain)
+	defer d.stripes.Unlock(subdomain)
+	// Invalidated once committed, the cache is filled without the lock
+	defer d.recordCache.remove(subdomain)
+	var updated []ACMETxtPost
+	err := d.retry("batch update", func() error {
+		var err error
+		updated, err = d.updateBatchInTransaction(updates)
+		return err
+	})
+	return updated, err
+}
+
+// ChangeValues applies the updates change returns for the current TXT, A and AAAA
+// values of the subdomain in a single transaction. The values are read from the
+// database while holding the lock of the subdomain, so that concurrent changes
+// aren't lost.
+func (d *acmedb) ChangeValues(subdomain string, change valueChange) ([]ACMETxtPost, error) {
+	d.stripes.Lock(subdomain)
+	defer d.stripes.Unlock(subdomain)
+	defer d.recordCache.remove(subdomain)
+	var updated []ACMETxtPost
+	err := d.retry("change values", func() error {
+		current, err := d.currentValues(subdomain)
+		if err != nil {
+			return err
+		}
+		updates, err := change(current)
+		if err != nil || len(updates) == 0 {
+			updated = nil
+			return err
+		}
+		updated, err = d.updateBatchInTransaction(updates)
+		return err
+	})
+	return updated, err
+}
+
+// currentValues returns the TXT, A and AAAA values of the subdomain, bypassing the caches
+func (d *acmedb) currentValues(subdomain string) (map[uint16][]string, error) {
+	txts, err := d.queryTXT(subdomain)
+	if err != nil {
+		return nil, err
+	}
+	a, err := d.queryA(subdomain)
+	if err != nil {
+		return nil, err
+	}
+	aaaa, err := d.queryAAAA(subdomain)
+	if err != nil {
+		return nil, err
+	}
+	return valuesByType(txts, a, aaaa), nil
+}
+
+func (d *acmedb) updateBatchInTransaction(updates []ACMETxtPost) ([]ACMETxtPost, error) {
+	tx, err := d.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	// Rollback is a no-op after a successful commit
+	defer func() { _ = tx.Rollback() }()
+	timenow := d.Now().Unix()
+	updated := make([]ACMETxtPost, 0, len(updates))
+	for _, a := range updates {
+		if a, err = d.updateTx(tx, a, timenow); err != nil {
+			return nil, err
+		}
+		updated = append(updated, a)
+	}
+	return updated, tx.Commit()
+}
+
+// nextTXTSlot returns the TXT slot that should be overwritten next for the subdomain:
+// the lowest slot without a row or a value, or the least recently updated one.
+func (d *acmedb) nextTXTSlot(q sqlQueryer, subdomain string) (int, error) {
+	slotSQL := `
+	SELECT Slot, Value, LastUpdate FROM txt WHERE Subdomain=$1 AND Slot < $2 ORDER BY Slot
+	`
+	slotSQL = d.stmt(slotSQL)
+	rows, err := q.Query(slotSQL, subdomain, txtSlotCount())
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+	lastUpdates := make(map[int]int64)
+	empty := make(map[int]bool)
+	for rows.Next() {
+		var slot int
+		var value string
+		var lastUpdate sql.NullInt64
+		err = rows.Scan(&slot, &value, &lastUpdate)
+		if err != nil {
+			return 0, err
+		}
+		lastUpdates[slot] = lastUpdate.Int64
+		empty[slot] = value == ""
+	}
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+	next := 0
+	for slot := 0; slot < txtSlotCount(); slot++ {
+		lastUpdate, ok := lastUpdates[slot]
+		if !ok || empty[slot] {
+			return slot, nil
+		}
+		if lastUpdate < lastUpdates[next] {
+			next = slot
+		}
+	}
+	return next, nil
+}
+
+// setTXTSlot writes the value and its correlation ID to the TXT slot of the
+// subdomain, creating the row if needed
+func (d *acmedb) setTXTSlot(q sqlQueryer, subdomain string, slot int, value string, correlationID string, timenow int64) error {
+	updSQL := `
+	UPDATE txt SET Value=$1, LastUpdate=$2, CorrelationID=$3
+	WHERE Subdomain=$4 AND Slot=$5
+	`
+	insSQL := `
+	INSERT INTO txt (Subdomain, Slot, Value, LastUpdate, CorrelationID) values($1, $2, $3, $4, $5)
+	`
+	updSQL = d.stmt(updSQL)
+	insSQL = d.stmt(insSQL)
+	res, err := q.Exec(updSQL, value, timenow, correlationID, subdomain, slot)
+	if err != nil {
+		return err
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		_, err = q.Exec(insSQL, subdomain, slot, value, timenow, correlationID)
+	}
+	return err
 }
 
 func getModelFromRow(r *sql.Rows) (ACMETxt, error) {
 	txt := ACMETxt{}
 	afrom := ""
+	webhooks := ""
+	allowedTypes := ""
+	tags := ""
+	subnetAnswers := ""
 	err := r.Scan(
 		&txt.Username,
 		&txt.Password,
 		&txt.Subdomain,
-		&afrom)
+		&afrom,
+		&txt.Description,
+		&webhooks,
+		&allowedTypes,
+		&txt.Origin.CreatedBy,
+		&txt.Origin.CreatedFrom,
+		&txt.Origin.CreatedAt,
+		&txt.Origin.Zone,
+		&tags,
+		&txt.Disabled,
+		&txt.Canary,
+		&txt.WildcardRecords,
+		&subnetAnswers,
+		&txt.PassVersion,
+		&txt.LastActive,
+		&txt.LastUpdate)
 	if err != nil {
-		log.WithFields(log.Fields{"error": err.Error()}).Error("Row scan error")
+		dbLog.WithFields(log.Fields{"error": err.Error()}).Error("Row scan error")
 	}
 
 	cslice := cidrslice{}
 	err = json.Unmarshal([]byte(afrom), &cslice)
 	if err != nil {
-		log.WithFields(log.Fields{"error": err.Error()}).Error("JSON unmarshall error")
+		dbLog.WithFields(log.Fields{"error": err.Error()}).Error("JSON unmarshall error")
+		return txt, err
 	}
 	txt.AllowFrom = cslice
+	err = json.Unmarshal([]byte(webhooks), &txt.Webhooks)
+	if err != nil {
+		dbLog.WithFields(log.Fields{"error": err.Error()}).Error("JSON unmarshall error")
+		return txt, err
+	}
+	err = json.Unmarshal([]byte(allowedTypes), &txt.AllowedTypes)
+	if err != nil {
+		dbLog.WithFields(log.Fields{"error": err.Error()}).Error("JSON unmarshall error")
+		return txt, err
+	}
+	err = json.Unmarshal([]byte(tags), &txt.Tags)
+	if err != nil {
+		dbLog.WithFields(log.Fields{"error": err.Error()}).Error("JSON unmarshall error")
+		return txt, err
+	}
+	err = json.Unmarshal([]byte(subnetAnswers), &txt.SubnetAnswers)
+	if err != nil {
+		dbLog.WithFields(log.Fields{"error": err.Error()}).Error("JSON unmarshall error")
+	}
 	return txt, err
 }
 
+// UpdateSettings replaces the mutable settings of the registration
+func (d *acmedb) UpdateSettings(u uuid.UUID, settings registrationSettings) error {
+	updSQL := `
+	UPDATE records SET AllowFrom=$1, Description=$2, Webhooks=$3, AllowedTypes=$4, Tags=$5, Wildcard=$6, SubnetAnswers=$7
+	WHERE Username=$8
+	`
+	updSQL = d.stmt(updSQL)
+	webhooks, err := json.Marshal(nonNilStrings(settings.Webhooks))
+	if err != nil {
+		return err
+	}
+	allowedTypes, err := json.Marshal(nonNilStrings(settings.AllowedTypes))
+	if err != nil {
+		return err
+	}
+	tags, err := json.Marshal(nonNilStrings(settings.Tags))
+	if err != nil {
+		return err
+	}
+	subnetAnswers, err := json.Marshal(nonNilSubnetAnswers(settings.SubnetAnswers))
+	if err != nil {
+		return err
+	}
+	sm, err := d.DB.Prepare(updSQL)
+	if err != nil {
+		return err
+	}
+	defer sm.Close()
+	wildcard := 0
+	if settings.WildcardRecords {
+		wildcard = 1
+	}
+	res, err := sm.Exec(settings.AllowFrom.JSON(), settings.Description, string(webhooks), string(allowedTypes), string(tags), wildcard, string(subnetAnswers), u.String())
+	if err != nil {
+		return err
+	}
+	affected, err := res.RowsAffected()
+	if err == nil && affected == 0 {
+		err = errors.New("no user")
+	}
+	return err
+}
+
+// SetDisabled disables or re-enables the registration
+func (d *acmedb) SetDisabled(u uuid.UUID, disabled bool) error {
+	updSQL := d.stmt("UPDATE records SET Disabled=$1 WHERE Username=$2")
+	value := 0
+	if disabled {
+		value = 1
+	}
+	res, err := d.DB.Exec(updSQL, value, u.String())
+	if err != nil {
+		return err
+	}
+	affected, err := res.RowsAffected()
+	if err == nil && affected == 0 {
+		err = errors.New("no user")
+	}
+	return err
+}
+
+// SetCanary marks the registration as a canary, or a regular registration
+func (d *acmedb) SetCanary(u uuid.UUID, canary bool) error {
+	updSQL := d.stmt("UPDATE records SET Canary=$1 WHERE Username=$2")
+	value := 0
+	if canary {
+		value = 1
+	}
+	res, err := d.DB.Exec(updSQL, value, u.String())
+	if err != nil {
+		return err
+	}
+	affected, err := res.RowsAffected()
+	if err == nil && affected == 0 {
+		err = errors.New("no user")
+	}
+	return err
+}
+
+// SetPassword replaces the API key of the registration
+func (d *acmedb) SetPassword(u uuid.UUID, password string) error {
+	passwordHash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+	updSQL := d.stmt("UPDATE records SET Password=$1, PassVersion=$2 WHERE Username=$3")
+	res, err := d.DB.Exec(updSQL, passwordHash, credentialVersion(), u.String())
+	if err != nil {
+		return err
+	}
+	affected, err := res.RowsAffected()
+	if err == nil && affected == 0 {
+		err = errors.New("no user")
+	}
+	return err
+}
+
+// RehashPassword stores the API key of the registration hashed with the current
+// scheme, unless the key was changed from the given version meanwhile
+func (d *acmedb) RehashPassword(u uuid.UUID, version int, password string) error {
+	passwordHash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+	updSQL := d.stmt("UPDATE records SET Password=$1, PassVersion=$2 WHERE Username=$3 AND PassVersion=$4")
+	_, err = d.DB.Exec(updSQL, passwordHash, credentialVersion(), u.String(), version)
+	return err
+}
+
+// CountCredentials returns the number of registrations and admins by credential version
+func (d *acmedb) CountCredentials() (map[int]int, map[int]int, error) {
+	registrations, err := d.countVersions("SELECT PassVersion, COUNT(*) FROM records GROUP BY PassVersion")
+	if err != nil {
+		return nil, nil, err
+	}
+	admins, err := d.countVersions("SELECT PassVersion, COUNT(*) FROM admins GROUP BY PassVersion")
+	return registrations, admins, err
+}
+
+func (d *acmedb) countVersions(query string) (map[int]int, error) {
+	counts := map[int]int{}
+	rows, err := d.DB.Query(query)
+	if err != nil {
+		return counts, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var version, count int
+		if err = rows.Scan(&version, &count); err != nil {
+			return counts, err
+		}
+		counts[version] = count
+	}
+	return counts, rows.Err()
+}
+
+// DeleteRegistration removes the registration and all the records of its subdomain
+func (d *acmedb) DeleteRegistration(u uuid.UUID) error {
+	var subdomain string
+	err := d.DB.QueryRow(d.stmt("SELECT Subdomain FROM records WHERE Username=$1"), u.String()).Scan(&subdomain)
+	if err == sql.ErrNoRows {
+		return errors.New("no user")
+	}
+	if err != nil {
+		return err
+	}
+	d.stripes.Lock(subdomain)
+	defer d.stripes.Unlock(subdomain)
+	defer d.recordCache.remove(subdomain)
+	return d.retry("delete", func() error {
+		return d.deleteInTransaction(u, subdomain)
+	})
+}
+
+func (d *acmedb) deleteInTransaction(u uuid.UUID, subdomain string) (err error) {
+	tx, err := d.DB.Begin()
+	if err != nil {
+		return err
+	}
+	// Rollback if errored, commit if not
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+			return
+		}
+		err = tx.Commit()
+	}()
+	for _, delSQL := range []string{
+		"DELETE FROM txt WHERE Subdomain=$1",
+		"DELETE FROM a WHERE Subdomain=$1",
+		"DELETE FROM aaaa WHERE Subdomain=$1",
+		"DELETE FROM cname WHERE Subdomain=$1",
+		"DELETE FROM mx WHERE Subdomain=$1",
+		"DELETE FROM srv WHERE Subdomain=$1",
+		"DELETE FROM caa WHERE Subdomain=$1",
+		"DELETE FROM rr WHERE Subdomain=$1",
+		"DELETE FROM ttl WHERE Subdomain=$1",
+	} {
+		_, err = tx.Exec(d.stmt(delSQL), subdomain)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = tx.Exec(d.stmt("DELETE FROM records WHERE Username=$1"), u.String())
+	return err
+}
+
+// AcquireLease takes or renews the named lease for the holder. It returns false if
+// the lease is currently held by somebody else and hasn't expired yet.
+func (d *acmedb) AcquireLease(name string, holder string, duration time.Duration) (bool, error) {
+	now := d.Now()
+	insSQL := `
+	INSERT INTO leases (Name, Holder, Expires)
+	SELECT $1, $2, $3 WHERE NOT EXISTS (SELECT 1 FROM leases WHERE Name=$4)
+	`
+	updSQL := `
+	UPDATE leases SET Holder=$1, Expires=$2
+	WHERE Name=$3 AND (Holder=$4 OR Expires < $5)
+	`
+	insSQL = d.stmt(insSQL)
+	updSQL = d.stmt(updSQL)
+	expires := now.Add(duration).Unix()
+	res, err := d.DB.Exec(insSQL, name, holder, expires, name)
+	if err != nil {
+		return false, err
+	}
+	affected, err := res.RowsAffected()
+	if err != nil || affected > 0 {
+		return affected > 0, err
+	}
+	res, err = d.DB.Exec(updSQL, holder, expires, name, holder, now.Unix())
+	if err != nil {
+		return false, err
+	}
+	affected, err = res.RowsAffected()
+	return affected > 0, err
+}
+
+// ReleaseLease gives up the named lease if it's held by the holder
+func (d *acmedb) ReleaseLease(name string, holder string) error {
+	delSQL := "DELETE FROM leases WHERE Name=$1 AND Holder=$2"
+	delSQL = d.stmt(delSQL)
+	_, err := d.DB.Exec(delSQL, name, holder)
+	return err
+}
+
+// GetSetting returns the value of the named setting in the acmedns table, and
+// whether it has been stored
+func (d *acmedb) GetSetting(name string) (string, bool, error) {
+	var value string
+	err := d.DB.QueryRow(d.stmt("SELECT Value FROM acmedns WHERE Name=$1"), name).Scan(&value)
+	if err == sql.ErrNoRows {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	return value, true, nil
+}
+
+// SetSetting stores the value of the named setting in the acmedns table
+func (d *acmedb) SetSetting(name string, value string) error {
+	res, err := d.DB.Exec(d.stmt("UPDATE acmedns SET Value=$1 WHERE Name=$2"), value, name)
+	if err != nil {
+		return err
+	}
+	if affected, err := res.RowsAffected(); err != nil || affected > 0 {
+		return err
+	}
+	_, err = d.DB.Exec(d.stmt("INSERT INTO acmedns (Name, Value) values($1, $2)"), name, value)
+	return err
+}
+
+// AddAuditEvent appends the event to the audit table
+func (d *acmedb) AddAuditEvent(e auditEvent) error {
+	_, err := d.DB.Exec(d.stmt("INSERT INTO audit (Time, Action, Actor, SourceIP, Subdomain, Detail) values($1, $2, $3, $4, $5, $6)"),
+		e.Time, e.Action, e.Actor, e.SourceIP, e.Subdomain, e.Detail)
+	return err
+}
+
+// GetAuditEvents returns the latest events of the audit table, newest first, only
+// the ones of the subdomain unless it's empty
+func (d *acmedb) GetAuditEvents(subdomain string, limit int) ([]auditEvent, error) {
+	var events []auditEvent
+	query := "SELECT Time, Action, Actor, SourceIP, Subdomain, Detail FROM audit"
+	args := []interface{}{}
+	if subdomain != "" {
+		query += " WHERE Subdomain=$1"
+		args = append(args, subdomain)
+	}
+	query += fmt.Sprintf(" ORDER BY Time DESC, rowid DESC LIMIT $%d", len(args)+1)
+	rows, err := d.DB.Query(d.stmt(query), append(args, limit)...)
+	if err != nil {
+		return events, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var e auditEvent
+		if err = rows.Scan(&e.Time, &e.Action, &e.Actor, &e.SourceIP, &e.Subdomain, &e.Detail); err != nil {
+			return events, err
+		}
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
+
+// Now returns the current time from the clock of the database layer
+func (d *acmedb) Now() time.Time {
+	return clockOrSystem(d.Clock).Now()
+}
+
 func (d *acmedb) Close() {
+	d.stmts.close()
 	d.DB.Close()
 }
 
+// GetBackend returns the underlying database/sql handle
 func (d *acmedb) GetBackend() *sql.DB {
 	return d.DB
 }
 
+// SetBackend replaces the underlying database/sql handle, it must not be called
+// while other operations are running
 func (d *acmedb) SetBackend(backend *sql.DB) {
 	d.DB = backend
 }
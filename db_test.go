@@ -4,8 +4,15 @@ import (
 	"database/sql"
 	"database/sql/driver"
 	"errors"
+	"fmt"
 	"github.com/erikstmartin/go-testdb"
+	"github.com/google/uuid"
+	"os"
+	"reflect"
+	"strconv"
+	"sync"
 	"testing"
+	"time"
 )
 
 type testResult struct {
@@ -43,7 +50,7 @@ func TestDBInit(t *testing.T) {
 
 func TestRegisterNoCIDR(t *testing.T) {
 	// Register tests
-	_, err := DB.Register(cidrslice{})
+	_, err := DB.Register(cidrslice{}, registrationOrigin{}, ACMETxtPost{})
 	if err != nil {
 		t.Errorf("Registration failed, got error [%v]", err)
 	}
@@ -58,7 +65,7 @@ func TestRegisterMany(t *testing.T) {
 		{cidrslice{"1.1.1./32", "1922.168.42.42/8", "1.1.1.1/33", "1.2.3.4/"}, cidrslice{}},
 		{cidrslice{"7.6.5.4/32", "invalid", "1.0.0.1/2"}, cidrslice{"7.6.5.4/32", "1.0.0.1/2"}},
 	} {
-		user, err := DB.Register(test.input)
+		user, err := DB.Register(test.input, registrationOrigin{}, ACMETxtPost{})
 		if err != nil {
 			t.Errorf("Test %d: Got error from register method: [%v]", i, err)
 		}
@@ -78,7 +85,7 @@ func TestRegisterMany(t *testing.T) {
 
 func TestGetByUsername(t *testing.T) {
 	// Create  reg to refer to
-	reg, err := DB.Register(cidrslice{})
+	reg, err := DB.Register(cidrslice{}, registrationOrigin{}, ACMETxtPost{})
 	if err != nil {
 		t.Errorf("Registration failed, got error [%v]", err)
 	}
@@ -103,14 +110,14 @@ func TestGetByUsername(t *testing.T) {
 }
 
 func TestPrepareErrors(t *testing.T) {
-	reg, _ := DB.Register(cidrslice{})
+	reg, _ := DB.Register(cidrslice{}, registrationOrigin{}, ACMETxtPost{})
 	tdb, err := sql.Open("testdb", "")
 	if err != nil {
 		t.Errorf("Got error: %v", err)
 	}
-	oldDb := DB.GetBackend()
-	DB.SetBackend(tdb)
-	defer DB.SetBackend(oldDb)
+	oldDb := DB.(*acmedb).GetBackend()
+	DB.(*acmedb).SetBackend(tdb)
+	defer DB.(*acmedb).SetBackend(oldDb)
 	defer testdb.Reset()
 
 	_, err = DB.GetByUsername(reg.Username)
@@ -125,7 +132,7 @@ func TestPrepareErrors(t *testing.T) {
 }
 
 func TestQueryExecErrors(t *testing.T) {
-	reg, _ := DB.Register(cidrslice{})
+	reg, _ := DB.Register(cidrslice{}, registrationOrigin{}, ACMETxtPost{})
 	testdb.SetExecWithArgsFunc(func(query string, args []driver.Value) (result driver.Result, err error) {
 		return testResult{1, 0}, errors.New("Prepared query error")
 	})
@@ -141,10 +148,10 @@ func TestQueryExecErrors(t *testing.T) {
 	if err != nil {
 		t.Errorf("Got error: %v", err)
 	}
-	oldDb := DB.GetBackend()
+	oldDb := DB.(*acmedb).GetBackend()
 
-	DB.SetBackend(tdb)
-	defer DB.SetBackend(oldDb)
+	DB.(*acmedb).SetBackend(tdb)
+	defer DB.(*acmedb).SetBackend(oldDb)
 
 	_, err = DB.GetByUsername(reg.Username)
 	if err == nil {
@@ -156,12 +163,12 @@ func TestQueryExecErrors(t *testing.T) {
 		t.Errorf("Expected error from exec in GetByDomain, but got none")
 	}
 
-	_, err = DB.Register(cidrslice{})
+	_, err = DB.Register(cidrslice{}, registrationOrigin{}, ACMETxtPost{})
 	if err == nil {
 		t.Errorf("Expected error from exec in Register, but got none")
 	}
 	reg.Value = "xxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxx"
-	err = DB.Update(reg.ACMETxtPost)
+	_, err = DB.Update(reg.ACMETxtPost)
 	if err == nil {
 		t.Errorf("Expected error from exec in Update, but got none")
 	}
@@ -169,7 +176,7 @@ func TestQueryExecErrors(t *testing.T) {
 }
 
 func TestQueryScanErrors(t *testing.T) {
-	reg, _ := DB.Register(cidrslice{})
+	reg, _ := DB.Register(cidrslice{}, registrationOrigin{}, ACMETxtPost{})
 
 	testdb.SetExecWithArgsFunc(func(query string, args []driver.Value) (result driver.Result, err error) {
 		return testResult{1, 0}, errors.New("Prepared query error")
@@ -186,10 +193,10 @@ func TestQueryScanErrors(t *testing.T) {
 	if err != nil {
 		t.Errorf("Got error: %v", err)
 	}
-	oldDb := DB.GetBackend()
+	oldDb := DB.(*acmedb).GetBackend()
 
-	DB.SetBackend(tdb)
-	defer DB.SetBackend(oldDb)
+	DB.(*acmedb).SetBackend(tdb)
+	defer DB.(*acmedb).SetBackend(oldDb)
 
 	_, err = DB.GetByUsername(reg.Username)
 	if err == nil {
@@ -198,7 +205,7 @@ func TestQueryScanErrors(t *testing.T) {
 }
 
 func TestBadDBValues(t *testing.T) {
-	reg, _ := DB.Register(cidrslice{})
+	reg, _ := DB.Register(cidrslice{}, registrationOrigin{}, ACMETxtPost{})
 
 	testdb.SetQueryWithArgsFunc(func(query string, args []driver.Value) (result driver.Rows, err error) {
 		columns := []string{"Username", "Password", "Subdomain", "Value", "LastActive"}
@@ -211,10 +218,10 @@ func TestBadDBValues(t *testing.T) {
 	if err != nil {
 		t.Errorf("Got error: %v", err)
 	}
-	oldDb := DB.GetBackend()
+	oldDb := DB.(*acmedb).GetBackend()
 
-	DB.SetBackend(tdb)
-	defer DB.SetBackend(oldDb)
+	DB.(*acmedb).SetBackend(tdb)
+	defer DB.(*acmedb).SetBackend(oldDb)
 
 	_, err = DB.GetByUsername(reg.Username)
 	if err == nil {
@@ -229,7 +236,7 @@ func TestBadDBValues(t *testing.T) {
 
 func TestGetTXTForDomain(t *testing.T) {
 	// Create  reg to refer to
-	reg, err := DB.Register(cidrslice{})
+	reg, err := DB.Register(cidrslice{}, registrationOrigin{}, ACMETxtPost{})
 	if err != nil {
 		t.Errorf("Registration failed, got error [%v]", err)
 	}
@@ -238,10 +245,10 @@ func TestGetTXTForDomain(t *testing.T) {
 	txtval2 := "___validation_token_received_YEAH_the_ca___"
 
 	reg.Value = txtval1
-	_ = DB.Update(reg.ACMETxtPost)
+	_, _ = DB.Update(reg.ACMETxtPost)
 
 	reg.Value = txtval2
-	_ = DB.Update(reg.ACMETxtPost)
+	_, _ = DB.Update(reg.ACMETxtPost)
 
 	regDomainSlice, err := DB.GetTXTForDomain(reg.Subdomain)
 	if err != nil {
@@ -277,7 +284,7 @@ func TestGetTXTForDomain(t *testing.T) {
 
 func TestUpdate(t *testing.T) {
 	// Create  reg to refer to
-	reg, err := DB.Register(cidrslice{})
+	reg, err := DB.Register(cidrslice{}, registrationOrigin{}, ACMETxtPost{})
 	if err != nil {
 		t.Errorf("Registration failed, got error [%v]", err)
 	}
@@ -294,8 +301,902 @@ func TestUpdate(t *testing.T) {
 	regUser.Password = "nevergonnagiveyouup"
 	regUser.Value = validTXT
 
-	err = DB.Update(regUser.ACMETxtPost)
+	_, err = DB.Update(regUser.ACMETxtPost)
 	if err != nil {
 		t.Errorf("DB Update failed, got error: [%v]", err)
 	}
 }
+
+func TestUpdateBatch(t *testing.T) {
+	reg, err := DB.Register(cidrslice{}, registrationOrigin{}, ACMETxtPost{AValues: []string{"192.0.2.1"}})
+	if err != nil {
+		t.Fatalf("Registration failed, got error [%v]", err)
+	}
+	badSlot := 99
+	_, err = DB.UpdateBatch(reg.Subdomain, []ACMETxtPost{
+		{Subdomain: reg.Subdomain, AValues: []string{"192.0.2.2"}},
+		{Subdomain: reg.Subdomain, Value: "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa", Slot: &badSlot},
+	})
+	if err == nil {
+		t.Fatalf("Expected the batch to fail")
+	}
+	if ips, _ := DB.GetAForDomain(reg.Subdomain); len(ips) != 1 || ips[0].String() != "192.0.2.1" {
+		t.Errorf("Expected the failed batch to be rolled back, got %v", ips)
+	}
+
+	updated, err := DB.UpdateBatch(reg.Subdomain, []ACMETxtPost{
+		{Subdomain: reg.Subdomain, Value: "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"},
+		{Subdomain: reg.Subdomain, Value: "bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb"},
+		{Subdomain: reg.Subdomain, ClearA: true},
+	})
+	if err != nil || len(updated) != 3 {
+		t.Fatalf("Batch update failed, got %v, error [%v]", updated, err)
+	}
+	if *updated[0].Slot == *updated[1].Slot {
+		t.Errorf("Expected the TXT values of the batch in different slots")
+	}
+	txts, _ := DB.GetTXTForDomain(reg.Subdomain)
+	if len(txts) != 2 || txts[0] == txts[1] {
+		t.Errorf("Expected both TXT values to be served, got %v", txts)
+	}
+	if ips, _ := DB.GetAForDomain(reg.Subdomain); len(ips) != 0 {
+		t.Errorf("Expected the A records to be cleared, got %v", ips)
+	}
+}
+
+func TestNegativeCacheLookups(t *testing.T) {
+	adb := DB.(*acmedb)
+	oldCache := adb.negCache
+	adb.negCache = newNegativeCache(time.Minute, nil)
+	defer func() { adb.negCache = oldCache }()
+
+	count, err := DB.CountRecords("does-not-exist-either")
+	if err != nil {
+		t.Errorf("Got unexpected error from CountRecords: %v", err)
+	}
+	if count != 0 {
+		t.Errorf("Expected no records, got %d", count)
+	}
+	if !adb.negCache.has("does-not-exist-either") {
+		t.Errorf("Expected nonexistent subdomain to be cached")
+	}
+
+	reg, err := DB.Register(cidrslice{}, registrationOrigin{}, ACMETxtPost{})
+	if err != nil {
+		t.Errorf("Registration failed, got error [%v]", err)
+	}
+	_, _ = DB.CountRecords(reg.Subdomain)
+	if adb.negCache.has(reg.Subdomain) {
+		t.Errorf("Registered subdomain should not be cached as nonexistent")
+	}
+
+	// Cached lookups should not touch the database at all
+	testdb.SetQueryWithArgsFunc(func(query string, args []driver.Value) (result driver.Rows, err error) {
+		return nil, errors.New("database should not be queried")
+	})
+	defer testdb.Reset()
+	tdb, _ := sql.Open("testdb", "")
+	oldDb := DB.(*acmedb).GetBackend()
+	DB.(*acmedb).SetBackend(tdb)
+	defer DB.(*acmedb).SetBackend(oldDb)
+	if _, err = DB.GetTXTForDomain("does-not-exist-either"); err != nil {
+		t.Errorf("Expected cached answer, but got error [%v]", err)
+	}
+	if _, err = DB.CountRecords("does-not-exist-either"); err != nil {
+		t.Errorf("Expected cached answer, but got error [%v]", err)
+	}
+}
+
+func TestTXTSlotRotation(t *testing.T) {
+	reg, err := DB.Register(cidrslice{}, registrationOrigin{}, ACMETxtPost{})
+	if err != nil {
+		t.Errorf("Registration failed, got error [%v]", err)
+	}
+	for i, test := range []struct {
+		value string
+		slot  *int
+		used  int
+	}{
+		{"___validation_token_received_from_the_ca_1", nil, 0},
+		{"___validation_token_received_from_the_ca_2", nil, 1},
+		{"___validation_token_received_from_the_ca_3", intPtr(1), 1},
+		{"___validation_token_received_from_the_ca_4", intPtr(0), 0},
+	} {
+		reg.Value = test.value
+		reg.Slot = test.slot
+		updated, err := DB.Update(reg.ACMETxtPost)
+		if err != nil {
+			t.Fatalf("Test %d: DB Update failed, got error: [%v]", i, err)
+		}
+		if updated.Slot == nil || *updated.Slot != test.used {
+			t.Errorf("Test %d: Expected slot %d to be used, got %v", i, test.used, updated.Slot)
+		}
+		// Make sure the next automatic update doesn't see a LastUpdate tie
+		_, _ = DB.(*acmedb).GetBackend().Exec(getSQLiteStmt("UPDATE txt SET LastUpdate=LastUpdate-10 WHERE Subdomain=$1 AND Slot!=$2"), reg.Subdomain, test.used)
+	}
+	txts, err := DB.GetTXTForDomain(reg.Subdomain)
+	if err != nil {
+		t.Errorf("Could not get TXT values, got error [%v]", err)
+	}
+	expected := []string{"___validation_token_received_from_the_ca_4", "___validation_token_received_from_the_ca_3"}
+	if len(txts) != len(expected) {
+		t.Fatalf("Expected %d TXT values, got %d", len(expected), len(txts))
+	}
+	for i := range expected {
+		if txts[i] != expected[i] {
+			t.Errorf("Expected TXT value %s in slot %d, got %s", expected[i], i, txts[i])
+		}
+	}
+
+	reg.Slot = intPtr(txtSlotCount())
+	if _, err = DB.Update(reg.ACMETxtPost); err == nil {
+		t.Errorf("Expected error for out of range slot, but got none")
+	}
+}
+
+func TestTXTSlotsConfigured(t *testing.T) {
+	Config.General.TXTSlots = 3
+	defer func() { Config.General.TXTSlots = 0 }()
+	reg, err := DB.Register(cidrslice{}, registrationOrigin{}, ACMETxtPost{})
+	if err != nil {
+		t.Errorf("Registration failed, got error [%v]", err)
+	}
+	for i := 0; i < 3; i++ {
+		reg.Value = fmt.Sprintf("___validation_token_received_from_the_ca_%d", i)
+		reg.Slot = nil
+		updated, err := DB.Update(reg.ACMETxtPost)
+		if err != nil {
+			t.Fatalf("DB Update failed, got error: [%v]", err)
+		}
+		if *updated.Slot != i {
+			t.Errorf("Expected slot %d to be used, got %d", i, *updated.Slot)
+		}
+	}
+	txts, _ := DB.GetTXTForDomain(reg.Subdomain)
+	if len(txts) != 3 {
+		t.Errorf("Expected 3 TXT values, got %d", len(txts))
+	}
+}
+
+func TestDBUpgradeFrom1(t *testing.T) {
+	tmpfile, err := os.CreateTemp("", "acmedns-upgrade")
+	if err != nil {
+		t.Fatalf("Could not create temporary file")
+	}
+	tmpfile.Close()
+	defer os.Remove(tmpfile.Name())
+
+	olddb, err := sql.Open("sqlite3", tmpfile.Name())
+	if err != nil {
+		t.Fatalf("Could not open database: %v", err)
+	}
+	for _, stmt := range []string{
+		acmeTable, adminTable, userTable, txtTable, aTable, aaaaTable,
+		"INSERT INTO acmedns (Name, Value) values('db_version', '1')",
+		"INSERT INTO records (Username, Password, Subdomain, AllowFrom) values('u1', 'p', 'sub1', '[]')",
+		"INSERT INTO txt (Subdomain, Value, LastUpdate) values('sub1', 'first', 10)",
+		"INSERT INTO txt (Subdomain, Value, LastUpdate) values('sub2', 'other', 10)",
+		"INSERT INTO txt (Subdomain, Value, LastUpdate) values('sub1', 'second', 5)",
+	} {
+		if _, err = olddb.Exec(stmt); err != nil {
+			t.Fatalf("Could not set up version 1 database: %v", err)
+		}
+	}
+	olddb.Close()
+
+	upgraded := new(acmedb)
+	err = upgraded.Init("sqlite3", tmpfile.Name())
+	if err != nil {
+		t.Fatalf("Database upgrade failed: %v", err)
+	}
+	defer upgraded.Close()
+	var version string
+	_ = upgraded.DB.QueryRow("SELECT Value FROM acmedns WHERE Name='db_version'").Scan(&version)
+	if version != strconv.Itoa(DBVersion) {
+		t.Errorf("Expected database version %d, got %s", DBVersion, version)
+	}
+	txts, err := upgraded.GetTXTForDomain("sub1")
+	if err != nil {
+		t.Errorf("Could not get TXT values, got error [%v]", err)
+	}
+	if len(txts) != 2 || txts[0] != "first" || txts[1] != "second" {
+		t.Errorf("Expected TXT values in insertion order, got %v", txts)
+	}
+	next, _ := upgraded.nextTXTSlot(upgraded.DB, "sub1")
+	if next != 1 {
+		t.Errorf("Expected the least recently updated slot 1 to be next, got %d", next)
+	}
+}
+
+func intPtr(i int) *int {
+	return &i
+}
+
+func TestUpdateSettings(t *testing.T) {
+	reg, err := DB.Register(cidrslice{"10.0.0.0/8"}, registrationOrigin{}, ACMETxtPost{})
+	if err != nil {
+		t.Errorf("Registration failed, got error [%v]", err)
+	}
+	settings := reg.Settings()
+	settings.Description = "staging web servers"
+	settings.AllowedTypes = []string{"txt"}
+	settings.AllowFrom = cidrslice{"192.168.0.0/16"}
+	err = DB.UpdateSettings(reg.Username, settings)
+	if err != nil {
+		t.Errorf("Could not update settings, got error [%v]", err)
+	}
+	res, err := DB.GetByUsername(reg.Username)
+	if err != nil {
+		t.Errorf("Could not get test user, got error [%v]", err)
+	}
+	if res.Description != "staging web servers" {
+		t.Errorf("Expected description to be updated, got [%s]", res.Description)
+	}
+	if len(res.AllowedTypes) != 1 || res.AllowedTypes[0] != "txt" {
+		t.Errorf("Expected allowed types to be updated, got %v", res.AllowedTypes)
+	}
+	if len(res.AllowFrom) != 1 || res.AllowFrom[0] != "192.168.0.0/16" {
+		t.Errorf("Expected allowfrom to be updated, got %v", res.AllowFrom)
+	}
+	if res.Webhooks == nil || len(res.Webhooks) != 0 {
+		t.Errorf("Expected empty webhook list, got %v", res.Webhooks)
+	}
+
+	if err = DB.UpdateSettings(uuid.New(), settings); err == nil {
+		t.Errorf("Expected error when updating settings of nonexistent user")
+	}
+}
+
+func TestRegistrationOrigin(t *testing.T) {
+	withFrozenClock(t, time.Unix(1700000000, 0))
+	origin := registrationOrigin{CreatedBy: "origin-admin", CreatedFrom: "192.0.2.1"}
+	reg, err := DB.Register(cidrslice{}, origin, ACMETxtPost{})
+	if err != nil {
+		t.Fatalf("Registration failed, got error [%v]", err)
+	}
+	res, err := DB.GetByUsername(reg.Username)
+	if err != nil {
+		t.Fatalf("Could not get test user, got error [%v]", err)
+	}
+	origin.CreatedAt = 1700000000
+	if res.Origin != origin {
+		t.Errorf("Expected origin %v, got %v", origin, res.Origin)
+	}
+	regs, err := DB.ListRegistrations(registrationOrigin{CreatedBy: "origin-admin"})
+	if err != nil {
+		t.Errorf("Could not list registrations, got error [%v]", err)
+	}
+	if len(regs) != 1 || regs[0].Subdomain != reg.Subdomain {
+		t.Errorf("Expected only the registration by origin-admin, got %v", regs)
+	}
+}
+
+func TestRegisterWithValues(t *testing.T) {
+	values := ACMETxtPost{Value: "LHDhK3oGRvkiefQnx7OOczTY5Tic_xZ6HcMOc_gmtoM", AValues: []string{"192.0.2.1", "192.0.2.2"}}
+	reg, err := DB.Register(cidrslice{}, registrationOrigin{}, values)
+	if err != nil {
+		t.Fatalf("Registration failed, got error [%v]", err)
+	}
+	if reg.Slot == nil || *reg.Slot != 0 {
+		t.Errorf("Expected the TXT value to be stored in slot 0")
+	}
+	count, err := DB.CountRecords(reg.Subdomain)
+	if err != nil || count != 3 {
+		t.Errorf("Expected 3 records, got %d [%v]", count, err)
+	}
+
+	// The registration is rolled back with invalid initial values
+	before, _ := DB.ListRegistrations(registrationOrigin{})
+	if _, err = DB.Register(cidrslice{}, registrationOrigin{}, ACMETxtPost{Value: "x", Slot: intPtr(5)}); err == nil {
+		t.Errorf("Expected error for an invalid TXT slot")
+	}
+	after, _ := DB.ListRegistrations(registrationOrigin{})
+	if len(after) != len(before) {
+		t.Errorf("Expected failed registration to be rolled back")
+	}
+}
+
+func TestConfigurePool(t *testing.T) {
+	for i, test := range []struct {
+		engine     string
+		connection string
+		conf       dbsettings
+		maxOpen    int
+	}{
+		{"sqlite3", ":memory:", dbsettings{}, 1},
+		{"sqlite3", ":memory:", dbsettings{MaxOpenConns: 8}, 1},
+		{"sqlite3", "file:test?mode=memory", dbsettings{MaxOpenConns: 8}, 1},
+		{"sqlite3", "/var/lib/acme-dns/acme-dns.db", dbsettings{}, 1},
+		{"sqlite3", "/var/lib/acme-dns/acme-dns.db", dbsettings{MaxOpenConns: 8}, 8},
+		{"postgres", "postgres://localhost/acmedns", dbsettings{}, 0},
+		{"postgres", "postgres://localhost/acmedns", dbsettings{MaxOpenConns: 20}, 20},
+	} {
+		db, _ := sql.Open("sqlite3", ":memory:")
+		configurePool(db, test.engine, test.connection, test.conf)
+		if got := db.Stats().MaxOpenConnections; got != test.maxOpen {
+			t.Errorf("Test %d: Expected at most %d open connections, got %d", i, test.maxOpen, got)
+		}
+		db.Close()
+	}
+}
+
+// BenchmarkParallelLookups measures uncached TXT lookups of different subdomains
+// running in parallel, over a single connection and over a pool of connections
+func BenchmarkParallelLookups(b *testing.B) {
+	tmpfile, err := os.CreateTemp("", "acmedns-bench")
+	if err != nil {
+		b.Fatalf("Could not create temporary file")
+	}
+	tmpfile.Close()
+	defer os.Remove(tmpfile.Name())
+	oldSettings := Config.Database
+	defer func() { Config.Database = oldSettings }()
+	var subdomains []string
+	for _, conns := range []int{1, 8} {
+		b.Run(fmt.Sprintf("conns=%d", conns), func(b *testing.B) {
+			Config.Database = dbsettings{MaxOpenConns: conns}
+			d := new(acmedb)
+			if err := d.Init("sqlite3", tmpfile.Name()); err != nil {
+				b.Fatalf("Could not open database: %v", err)
+			}
+			defer d.Close()
+			for len(subdomains) < 64 {
+				reg, err := d.Register(cidrslice{}, registrationOrigin{}, ACMETxtPost{})
+				if err != nil {
+					b.Fatalf("Registration failed, got error [%v]", err)
+				}
+				subdomains = append(subdomains, reg.Subdomain)
+			}
+			b.SetParallelism(4)
+			var n int64
+			var mu sync.Mutex
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				mu.Lock()
+				subdomain := subdomains[n%int64(len(subdomains))]
+				n++
+				mu.Unlock()
+				for pb.Next() {
+					_, _ = d.GetTXTForDomain(subdomain)
+				}
+			})
+		})
+	}
+}
+
+func TestQuotedValuesNotInjected(t *testing.T) {
+	adb := DB.(*acmedb)
+	subdomain := "x', 0, 0); DROP TABLE records; --"
+	tx, err := adb.DB.Begin()
+	if err != nil {
+		t.Fatalf("Could not begin transaction: %v", err)
+	}
+	err = adb.NewTXTValuesInTransaction(tx, subdomain)
+	if err != nil {
+		_ = tx.Rollback()
+		t.Fatalf("Could not create TXT slots, got error [%v]", err)
+	}
+	_ = tx.Commit()
+	defer func() { _, _ = adb.DB.Exec(adb.stmt("DELETE FROM txt WHERE Subdomain=$1"), subdomain) }()
+	var count int
+	_ = adb.DB.QueryRow(adb.stmt("SELECT COUNT(*) FROM txt WHERE Subdomain=$1"), subdomain).Scan(&count)
+	if count != txtSlotCount() {
+		t.Errorf("Expected %d TXT slots for the quoted subdomain, got %d", txtSlotCount(), count)
+	}
+	if _, err = adb.DB.Exec("SELECT COUNT(*) FROM records"); err != nil {
+		t.Errorf("Expected the records table to remain, got error [%v]", err)
+	}
+
+	origin := registrationOrigin{CreatedBy: "o'brien\"; --", CreatedFrom: "' OR '1'='1"}
+	reg, err := DB.Register(cidrslice{}, origin, ACMETxtPost{})
+	if err != nil {
+		t.Fatalf("Registration failed, got error [%v]", err)
+	}
+	regs, err := DB.ListRegistrations(registrationOrigin{CreatedFrom: "' OR '1'='1"})
+	if err != nil || len(regs) != 1 || regs[0].Subdomain != reg.Subdomain || regs[0].Origin.CreatedBy != origin.CreatedBy {
+		t.Errorf("Expected only the registration with the quoted origin, got %v, %v", regs, err)
+	}
+}
+
+func testInactiveAccounts(t *testing.T, db database, clk *frozenClock) {
+	active, _ := db.Register(cidrslice{}, registrationOrigin{}, ACMETxtPost{})
+	idle, _ := db.Register(cidrslice{}, registrationOrigin{}, ACMETxtPost{})
+	canary, _ := db.Register(cidrslice{}, registrationOrigin{}, ACMETxtPost{})
+	_ = db.SetCanary(canary.Username, true)
+	clk.Advance(24 * time.Hour)
+	if err := db.MarkActive(idle.Username); err != nil {
+		t.Fatalf("Could not mark active: %v", err)
+	}
+	clk.Advance(24 * time.Hour)
+	if err := db.MarkActive(active.Username); err != nil {
+		t.Fatalf("Could not mark active: %v", err)
+	}
+	clk.Advance(time.Minute)
+	recent, _ := db.Register(cidrslice{}, registrationOrigin{}, ACMETxtPost{})
+	clk.Advance(time.Hour)
+
+	for i, test := range []struct {
+		olderThan time.Duration
+		expected  []ACMETxt
+	}{
+		{30 * time.Minute, []ACMETxt{idle, active, recent}},
+		{2 * time.Hour, []ACMETxt{idle}},
+		{48 * time.Hour, []ACMETxt{}},
+	} {
+		inactive, err := db.GetInactiveAccounts(test.olderThan)
+		if err != nil {
+			t.Fatalf("Test %d: Could not get inactive accounts: %v", i, err)
+		}
+		if len(inactive) != len(test.expected) {
+			t.Errorf("Test %d: Expected %d inactive accounts, got %d", i, len(test.expected), len(inactive))
+			continue
+		}
+		for j := range inactive {
+			if inactive[j].Username != test.expected[j].Username {
+				t.Errorf("Test %d: Expected %s at %d, got %s", i, test.expected[j].Subdomain, j, inactive[j].Subdomain)
+			}
+		}
+	}
+	stored, _ := db.GetByUsername(active.Username)
+	if stored.LastActive != clk.Now().Add(-time.Hour-time.Minute).Unix() {
+		t.Errorf("Unexpected last active time %d", stored.LastActive)
+	}
+	if err := db.MarkActive(uuid.New()); err == nil {
+		t.Errorf("Expected an error for a nonexistent registration")
+	}
+}
+
+func TestInactiveAccounts(t *testing.T) {
+	clk := newFrozenClock(time.Unix(1700000000, 0))
+	d := &acmedb{Clock: clk}
+	if err := d.Init("sqlite3", tempDatabase(t)); err != nil {
+		t.Fatalf("Could not initialize database: %v", err)
+	}
+	defer d.Close()
+	testInactiveAccounts(t, d, clk)
+}
+
+func TestInactiveAccountsMemory(t *testing.T) {
+	db, err := openBackend("memory", "")
+	if err != nil {
+		t.Fatalf("Could not open the memory backend: %v", err)
+	}
+	defer db.Close()
+	clk := newFrozenClock(time.Unix(1700000000, 0))
+	db.(*kvdb).Clock = clk
+	testInactiveAccounts(t, db, clk)
+}
+
+func testClearAddresses(t *testing.T, db database) {
+	reg, err := db.Register(cidrslice{}, registrationOrigin{}, ACMETxtPost{AValues: []string{"192.0.2.1"}, AAAAValues: []string{"2001:db8::1"}})
+	if err != nil {
+		t.Fatalf("Could not register: %v", err)
+	}
+	// Empty values leave the records as they are
+	if _, err = db.Update(ACMETxtPost{Subdomain: reg.Subdomain, AValues: []string{}}); err != nil {
+		t.Fatalf("Could not update: %v", err)
+	}
+	if ips, _ := db.GetAForDomain(reg.Subdomain); len(ips) != 1 {
+		t.Errorf("Expected the A record to be kept, got %v", ips)
+	}
+	if _, err = db.Update(ACMETxtPost{Subdomain: reg.Subdomain, ClearA: true}); err != nil {
+		t.Fatalf("Could not clear the A records: %v", err)
+	}
+	if ips, _ := db.GetAForDomain(reg.Subdomain); len(ips) != 0 {
+		t.Errorf("Expected no A records, got %v", ips)
+	}
+	if ips, _ := db.GetAAAAForDomain(reg.Subdomain); len(ips) != 1 {
+		t.Errorf("Expected the AAAA record to be kept, got %v", ips)
+	}
+	if _, err = db.Update(ACMETxtPost{Subdomain: reg.Subdomain, ClearAAAA: true}); err != nil {
+		t.Fatalf("Could not clear the AAAA records: %v", err)
+	}
+	if ips, _ := db.GetAAAAForDomain(reg.Subdomain); len(ips) != 0 {
+		t.Errorf("Expected no AAAA records, got %v", ips)
+	}
+	// Clearing again is not an error
+	if _, err = db.Update(ACMETxtPost{Subdomain: reg.Subdomain, ClearA: true, ClearAAAA: true}); err != nil {
+		t.Errorf("Could not clear the records again: %v", err)
+	}
+}
+
+func TestClearAddresses(t *testing.T) {
+	testClearAddresses(t, DB)
+}
+
+func TestClearAddressesMemory(t *testing.T) {
+	db, err := openBackend("memory", "")
+	if err != nil {
+		t.Fatalf("Could not open the memory backend: %v", err)
+	}
+	defer db.Close()
+	testClearAddresses(t, db)
+}
+
+func testChangeValues(t *testing.T, db database) {
+	reg, err := db.Register(cidrslice{}, registrationOrigin{}, ACMETxtPost{})
+	if err != nil {
+		t.Fatalf("Could not register: %v", err)
+	}
+	// Concurrent changes each add their own address, none of them is lost
+	var wg sync.WaitGroup
+	for i := 1; i <= 8; i++ {
+		wg.Add(1)
+		go func(ip string) {
+			defer wg.Done()
+			ops := []transactionOperation{{Op: "add", Type: "a", Values: []string{ip}}}
+			_, err := db.ChangeValues(reg.Subdomain, func(current map[uint16][]string) ([]ACMETxtPost, error) {
+				return valueUpdates(reg.Subdomain, current, applyOperations(current, ops)), nil
+			})
+			if err != nil {
+				t.Errorf("Could not change the values: %v", err)
+			}
+		}(fmt.Sprintf("192.0.2.%d", i))
+	}
+	wg.Wait()
+	if a, _ := db.GetAForDomain(reg.Subdomain); len(a) != 8 {
+		t.Errorf("Expected all the 8 added addresses, got %v", a)
+	}
+	// Errors of the change leave the values untouched
+	errChange := errors.New("refused")
+	if _, err = db.ChangeValues(reg.Subdomain, func(map[uint16][]string) ([]ACMETxtPost, error) {
+		return nil, errChange
+	}); err != errChange {
+		t.Errorf("Expected the error of the change, got %v", err)
+	}
+}
+
+func TestChangeValues(t *testing.T) {
+	testChangeValues(t, DB)
+}
+
+func TestChangeValuesMemory(t *testing.T) {
+	db, err := openBackend("memory", "")
+	if err != nil {
+		t.Fatalf("Could not open the memory backend: %v", err)
+	}
+	defer db.Close()
+	testChangeValues(t, db)
+}
+
+func testCNAMERecords(t *testing.T, db database) {
+	reg, err := db.Register(cidrslice{}, registrationOrigin{}, ACMETxtPost{CNAME: "first.example.net."})
+	if err != nil {
+		t.Fatalf("Could not register: %v", err)
+	}
+	if target, _ := db.GetCNAMEForDomain(reg.Subdomain); target != "first.example.net." {
+		t.Errorf("Expected the initial CNAME, got %q", target)
+	}
+	if _, err = db.Update(ACMETxtPost{Subdomain: reg.Subdomain, AValues: []string{"192.0.2.1"}, AAAAValues: []string{"2001:db8::1"}}); err != nil {
+		t.Fatalf("Could not update: %v", err)
+	}
+	if target, _ := db.GetCNAMEForDomain(reg.Subdomain); target != "" {
+		t.Errorf("Expected the addresses to replace the CNAME, got %q", target)
+	}
+	if _, err = db.Update(ACMETxtPost{Subdomain: reg.Subdomain, CNAME: "second.example.net."}); err != nil {
+		t.Fatalf("Could not update: %v", err)
+	}
+	target, _ := db.GetCNAMEForDomain(reg.Subdomain)
+	a, _ := db.GetAForDomain(reg.Subdomain)
+	aaaa, _ := db.GetAAAAForDomain(reg.Subdomain)
+	if target != "second.example.net." || len(a) != 0 || len(aaaa) != 0 {
+		t.Errorf("Expected the CNAME to replace the addresses, got %q %v %v", target, a, aaaa)
+	}
+	if count, _ := db.CountRecords(reg.Subdomain); count != 1 {
+		t.Errorf("Expected the CNAME to be counted, got %d", count)
+	}
+	if _, err = db.Update(ACMETxtPost{Subdomain: reg.Subdomain, ClearCNAME: true}); err != nil {
+		t.Fatalf("Could not clear the CNAME: %v", err)
+	}
+	if target, _ := db.GetCNAMEForDomain(reg.Subdomain); target != "" {
+		t.Errorf("Expected no CNAME, got %q", target)
+	}
+}
+
+func TestCNAMERecords(t *testing.T) {
+	testCNAMERecords(t, DB)
+}
+
+func TestCNAMERecordsMemory(t *testing.T) {
+	db, err := openBackend("memory", "")
+	if err != nil {
+		t.Fatalf("Could not open the memory backend: %v", err)
+	}
+	defer db.Close()
+	testCNAMERecords(t, db)
+}
+
+func testMXRecords(t *testing.T, db database) {
+	reg, err := db.Register(cidrslice{}, registrationOrigin{}, ACMETxtPost{MXValues: []mxRecord{{10, "mail.example.net."}}})
+	if err != nil {
+		t.Fatalf("Could not register: %v", err)
+	}
+	if mxs, _ := db.GetMXForDomain(reg.Subdomain); !reflect.DeepEqual(mxs, []mxRecord{{10, "mail.example.net."}}) {
+		t.Errorf("Expected the initial MX, got %v", mxs)
+	}
+	if _, err = db.Update(ACMETxtPost{Subdomain: reg.Subdomain, MXValues: []mxRecord{{5, "primary.example.net."}, {20, "backup.example.net."}}}); err != nil {
+		t.Fatalf("Could not update: %v", err)
+	}
+	expected := []mxRecord{{5, "primary.example.net."}, {20, "backup.example.net."}}
+	if mxs, _ := db.GetMXForDomain(reg.Subdomain); !reflect.DeepEqual(mxs, expected) {
+		t.Errorf("Expected the MX records to be replaced, got %v", mxs)
+	}
+	if count, _ := db.CountRecords(reg.Subdomain); count != 2 {
+		t.Errorf("Expected the MX records to be counted, got %d", count)
+	}
+	// Other updates keep the mail exchangers
+	if _, err = db.Update(ACMETxtPost{Subdomain: reg.Subdomain, AValues: []string{"192.0.2.1"}}); err != nil {
+		t.Fatalf("Could not update: %v", err)
+	}
+	if mxs, _ := db.GetMXForDomain(reg.Subdomain); !reflect.DeepEqual(mxs, expected) {
+		t.Errorf("Expected the MX records to be kept, got %v", mxs)
+	}
+	if _, err = db.Update(ACMETxtPost{Subdomain: reg.Subdomain, CNAME: "host.example.net."}); err != nil {
+		t.Fatalf("Could not update: %v", err)
+	}
+	if mxs, _ := db.GetMXForDomain(reg.Subdomain); len(mxs) != 0 {
+		t.Errorf("Expected the CNAME to replace the MX records, got %v", mxs)
+	}
+	if _, err = db.Update(ACMETxtPost{Subdomain: reg.Subdomain, MXValues: []mxRecord{{0, "."}}}); err != nil {
+		t.Fatalf("Could not update: %v", err)
+	}
+	if target, _ := db.GetCNAMEForDomain(reg.Subdomain); target != "" {
+		t.Errorf("Expected the MX records to replace the CNAME, got %q", target)
+	}
+	if _, err = db.Update(ACMETxtPost{Subdomain: reg.Subdomain, ClearMX: true}); err != nil {
+		t.Fatalf("Could not clear the MX records: %v", err)
+	}
+	if mxs, _ := db.GetMXForDomain(reg.Subdomain); len(mxs) != 0 {
+		t.Errorf("Expected no MX records, got %v", mxs)
+	}
+}
+
+func TestMXRecords(t *testing.T) {
+	testMXRecords(t, DB)
+}
+
+func TestMXRecordsMemory(t *testing.T) {
+	db, err := openBackend("memory", "")
+	if err != nil {
+		t.Fatalf("Could not open the memory backend: %v", err)
+	}
+	defer db.Close()
+	testMXRecords(t, db)
+}
+
+func testSRVRecords(t *testing.T, db database) {
+	reg, err := db.Register(cidrslice{}, registrationOrigin{}, ACMETxtPost{SRVValues: []srvRecord{{10, 5, 25565, "game.example.net."}}})
+	if err != nil {
+		t.Fatalf("Could not register: %v", err)
+	}
+	if srvs, _ := db.GetSRVForDomain(reg.Subdomain); !reflect.DeepEqual(srvs, []srvRecord{{10, 5, 25565, "game.example.net."}}) {
+		t.Errorf("Expected the initial SRV, got %v", srvs)
+	}
+	expected := []srvRecord{{10, 60, 5060, "sip1.example.net."}, {10, 20, 5060, "sip2.example.net."}, {20, 0, 5061, "backup.example.net."}}
+	if _, err = db.Update(ACMETxtPost{Subdomain: reg.Subdomain, SRVValues: expected}); err != nil {
+		t.Fatalf("Could not update: %v", err)
+	}
+	if srvs, _ := db.GetSRVForDomain(reg.Subdomain); !reflect.DeepEqual(srvs, expected) {
+		t.Errorf("Expected the SRV records to be replaced, got %v", srvs)
+	}
+	if count, _ := db.CountRecords(reg.Subdomain); count != 3 {
+		t.Errorf("Expected the SRV records to be counted, got %d", count)
+	}
+	if _, err = db.Update(ACMETxtPost{Subdomain: reg.Subdomain, CNAME: "host.example.net."}); err != nil {
+		t.Fatalf("Could not update: %v", err)
+	}
+	if srvs, _ := db.GetSRVForDomain(reg.Subdomain); len(srvs) != 0 {
+		t.Errorf("Expected the CNAME to replace the SRV records, got %v", srvs)
+	}
+	if _, err = db.Update(ACMETxtPost{Subdomain: reg.Subdomain, SRVValues: expected[:1]}); err != nil {
+		t.Fatalf("Could not update: %v", err)
+	}
+	if target, _ := db.GetCNAMEForDomain(reg.Subdomain); target != "" {
+		t.Errorf("Expected the SRV records to replace the CNAME, got %q", target)
+	}
+	if _, err = db.Update(ACMETxtPost{Subdomain: reg.Subdomain, ClearSRV: true}); err != nil {
+		t.Fatalf("Could not clear the SRV records: %v", err)
+	}
+	if srvs, _ := db.GetSRVForDomain(reg.Subdomain); len(srvs) != 0 {
+		t.Errorf("Expected no SRV records, got %v", srvs)
+	}
+}
+
+func testCAARecords(t *testing.T, db database) {
+	reg, err := db.Register(cidrslice{}, registrationOrigin{}, ACMETxtPost{CAAValues: []caaRecord{{0, "issue", "letsencrypt.org"}}})
+	if err != nil {
+		t.Fatalf("Could not register: %v", err)
+	}
+	if caas, _ := db.GetCAAForDomain(reg.Subdomain); !reflect.DeepEqual(caas, []caaRecord{{0, "issue", "letsencrypt.org"}}) {
+		t.Errorf("Expected the initial CAA, got %v", caas)
+	}
+	expected := []caaRecord{{0, "iodef", "mailto:security@example.com"}, {0, "issue", "ca.example.net; account=1234"}, {128, "issuewild", ";"}}
+	if _, err = db.Update(ACMETxtPost{Subdomain: reg.Subdomain, CAAValues: expected}); err != nil {
+		t.Fatalf("Could not update: %v", err)
+	}
+	if caas, _ := db.GetCAAForDomain(reg.Subdomain); !reflect.DeepEqual(caas, expected) {
+		t.Errorf("Expected the CAA records to be replaced, got %v", caas)
+	}
+	if count, _ := db.CountRecords(reg.Subdomain); count != 3 {
+		t.Errorf("Expected the CAA records to be counted, got %d", count)
+	}
+	if _, err = db.Update(ACMETxtPost{Subdomain: reg.Subdomain, CNAME: "host.example.net."}); err != nil {
+		t.Fatalf("Could not update: %v", err)
+	}
+	if caas, _ := db.GetCAAForDomain(reg.Subdomain); len(caas) != 0 {
+		t.Errorf("Expected the CNAME to replace the CAA records, got %v", caas)
+	}
+	if _, err = db.Update(ACMETxtPost{Subdomain: reg.Subdomain, CAAValues: expected[:1]}); err != nil {
+		t.Fatalf("Could not update: %v", err)
+	}
+	if target, _ := db.GetCNAMEForDomain(reg.Subdomain); target != "" {
+		t.Errorf("Expected the CAA records to replace the CNAME, got %q", target)
+	}
+	if _, err = db.Update(ACMETxtPost{Subdomain: reg.Subdomain, ClearCAA: true}); err != nil {
+		t.Fatalf("Could not clear the CAA records: %v", err)
+	}
+	if caas, _ := db.GetCAAForDomain(reg.Subdomain); len(caas) != 0 {
+		t.Errorf("Expected no CAA records, got %v", caas)
+	}
+}
+
+func testGenericRecords(t *testing.T, db database) {
+	tlsa := genericRecord{"TLSA", "3 1 1 abababababababababababababababababababababababababababababababab", 300}
+	reg, err := db.Register(cidrslice{}, registrationOrigin{}, ACMETxtPost{Records: []genericRecord{tlsa}})
+	if err != nil {
+		t.Fatalf("Could not register: %v", err)
+	}
+	if records, _ := db.GetRecordsForDomain(reg.Subdomain); !reflect.DeepEqual(records, []genericRecord{tlsa}) {
+		t.Errorf("Expected the initial TLSA, got %v", records)
+	}
+	sshfp := genericRecord{"SSHFP", "4 2 ABABABABABABABABABABABABABABABABABABABABABABABABABABABABABABABAB", 1}
+	if _, err = db.Update(ACMETxtPost{Subdomain: reg.Subdomain, Records: []genericRecord{sshfp}}); err != nil {
+		t.Fatalf("Could not update: %v", err)
+	}
+	if records, _ := db.GetRecordsForDomain(reg.Subdomain); !reflect.DeepEqual(records, []genericRecord{sshfp, tlsa}) {
+		t.Errorf("Expected only the records of the posted type to be replaced, got %v", records)
+	}
+	if count, _ := db.CountRecords(reg.Subdomain); count != 2 {
+		t.Errorf("Expected the generic records to be counted, got %d", count)
+	}
+	if _, err = db.Update(ACMETxtPost{Subdomain: reg.Subdomain, ClearRecords: []string{"TLSA"}}); err != nil {
+		t.Fatalf("Could not clear the TLSA records: %v", err)
+	}
+	if records, _ := db.GetRecordsForDomain(reg.Subdomain); !reflect.DeepEqual(records, []genericRecord{sshfp}) {
+		t.Errorf("Expected the TLSA records to be cleared, got %v", records)
+	}
+	if _, err = db.Update(ACMETxtPost{Subdomain: reg.Subdomain, CNAME: "host.example.net."}); err != nil {
+		t.Fatalf("Could not update: %v", err)
+	}
+	if records, _ := db.GetRecordsForDomain(reg.Subdomain); len(records) != 0 {
+		t.Errorf("Expected the CNAME to replace the generic records, got %v", records)
+	}
+	if _, err = db.Update(ACMETxtPost{Subdomain: reg.Subdomain, Records: []genericRecord{tlsa}}); err != nil {
+		t.Fatalf("Could not update: %v", err)
+	}
+	if target, _ := db.GetCNAMEForDomain(reg.Subdomain); target != "" {
+		t.Errorf("Expected the generic records to replace the CNAME, got %q", target)
+	}
+}
+
+func TestGenericRecords(t *testing.T) {
+	testGenericRecords(t, DB)
+}
+
+func TestGenericRecordsMemory(t *testing.T) {
+	db, err := openBackend("memory", "")
+	if err != nil {
+		t.Fatalf("Could not open the memory backend: %v", err)
+	}
+	defer db.Close()
+	testGenericRecords(t, db)
+}
+
+func testTXTCorrelationID(t *testing.T, db database) {
+	reg, err := db.Register(cidrslice{}, registrationOrigin{}, ACMETxtPost{})
+	if err != nil {
+		t.Fatalf("Could not register: %v", err)
+	}
+	slot := 1
+	if _, err = db.Update(ACMETxtPost{Subdomain: reg.Subdomain, Value: "LHDhK3oGRvkiefQnx7OOczTY5Tic_xZ6HcMOc_gmtoM", Slot: &slot, CorrelationID: "run-42"}); err != nil {
+		t.Fatalf("Could not update: %v", err)
+	}
+	slots, err := db.GetTXTSlots(reg.Subdomain)
+	if err != nil || len(slots) != 2 {
+		t.Fatalf("Expected two TXT slots, got %v %v", slots, err)
+	}
+	if slots[1].Value != "LHDhK3oGRvkiefQnx7OOczTY5Tic_xZ6HcMOc_gmtoM" || slots[1].CorrelationID != "run-42" || slots[1].LastUpdate == 0 {
+		t.Errorf("Expected the correlation ID to be stored with the TXT value, got %+v", slots[1])
+	}
+	if slots[0].CorrelationID != "" {
+		t.Errorf("Expected no correlation ID in the other slot, got %+v", slots[0])
+	}
+	// Updates without a correlation ID clear the previous one of the slot
+	if _, err = db.Update(ACMETxtPost{Subdomain: reg.Subdomain, Value: "XHDhK3oGRvkiefQnx7OOczTY5Tic_xZ6HcMOc_gmtoM", Slot: &slot}); err != nil {
+		t.Fatalf("Could not update: %v", err)
+	}
+	if slots, _ = db.GetTXTSlots(reg.Subdomain); len(slots) != 2 || slots[1].CorrelationID != "" {
+		t.Errorf("Expected the correlation ID to be replaced, got %+v", slots)
+	}
+}
+
+func TestTXTCorrelationID(t *testing.T) {
+	testTXTCorrelationID(t, DB)
+}
+
+func TestTXTCorrelationIDMemory(t *testing.T) {
+	db, err := openBackend("memory", "")
+	if err != nil {
+		t.Fatalf("Could not open the memory backend: %v", err)
+	}
+	defer db.Close()
+	testTXTCorrelationID(t, db)
+}
+
+func testRecordTTL(t *testing.T, db database) {
+	reg, err := db.Register(cidrslice{}, registrationOrigin{}, ACMETxtPost{AValues: []string{"192.0.2.1"}, TTL: 300})
+	if err != nil {
+		t.Fatalf("Could not register: %v", err)
+	}
+	if ttls, _ := db.GetTTLForDomain(reg.Subdomain); !reflect.DeepEqual(ttls, map[string]int{"a": 300}) {
+		t.Errorf("Expected the initial TTL, got %v", ttls)
+	}
+	if _, err = db.Update(ACMETxtPost{Subdomain: reg.Subdomain, MXValues: []mxRecord{{10, "mail.example.net."}}, AAAAValues: []string{"2001:db8::1"}, TTL: 3600}); err != nil {
+		t.Fatalf("Could not update: %v", err)
+	}
+	if ttls, _ := db.GetTTLForDomain(reg.Subdomain); !reflect.DeepEqual(ttls, map[string]int{"a": 300, "aaaa": 3600, "mx": 3600}) {
+		t.Errorf("Expected the TTL of the updated types, got %v", ttls)
+	}
+	// Values posted without a TTL get the default TTL again
+	if _, err = db.Update(ACMETxtPost{Subdomain: reg.Subdomain, AValues: []string{"192.0.2.2"}, ClearMX: true}); err != nil {
+		t.Fatalf("Could not update: %v", err)
+	}
+	if ttls, _ := db.GetTTLForDomain(reg.Subdomain); !reflect.DeepEqual(ttls, map[string]int{"aaaa": 3600}) {
+		t.Errorf("Expected the TTL of the replaced types to be removed, got %v", ttls)
+	}
+	if _, err = db.Update(ACMETxtPost{Subdomain: reg.Subdomain, CNAME: "host.example.net.", TTL: 60}); err != nil {
+		t.Fatalf("Could not update: %v", err)
+	}
+	if ttls, _ := db.GetTTLForDomain(reg.Subdomain); !reflect.DeepEqual(ttls, map[string]int{"cname": 60}) {
+		t.Errorf("Expected the CNAME to replace the TTL of the other types, got %v", ttls)
+	}
+}
+
+func TestRecordTTL(t *testing.T) {
+	testRecordTTL(t, DB)
+}
+
+func TestRecordTTLMemory(t *testing.T) {
+	db, err := openBackend("memory", "")
+	if err != nil {
+		t.Fatalf("Could not open the memory backend: %v", err)
+	}
+	defer db.Close()
+	testRecordTTL(t, db)
+}
+
+func TestCAARecords(t *testing.T) {
+	testCAARecords(t, DB)
+}
+
+func TestCAARecordsMemory(t *testing.T) {
+	db, err := openBackend("memory", "")
+	if err != nil {
+		t.Fatalf("Could not open the memory backend: %v", err)
+	}
+	defer db.Close()
+	testCAARecords(t, db)
+}
+
+func TestSRVRecords(t *testing.T) {
+	testSRVRecords(t, DB)
+}
+
+func TestSRVRecordsMemory(t *testing.T) {
+	db, err := openBackend("memory", "")
+	if err != nil {
+		t.Fatalf("Could not open the memory backend: %v", err)
+	}
+	defer db.Close()
+	testSRVRecords(t, db)
+}
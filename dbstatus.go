@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+
+	"github.com/julienschmidt/httprouter"
+	log "github.com/sirupsen/logrus"
+)
+
+// migrationInfo is a migration in the admin API responses
+type migrationInfo struct {
+	Version     int    `json:"version"`
+	Description string `json:"description"`
+}
+
+// schemaStatus is the state of the database schema reported by the admin API
+type schemaStatus struct {
+	Engine           string          `json:"engine"`
+	SchemaVersion    int             `json:"schema_version"`
+	SupportedVersion int             `json:"supported_version"`
+	Pending          []migrationInfo `json:"pending_migrations"`
+	LastMigration    int64           `json:"last_migration,omitempty"`
+	MigrateOnDemand  bool            `json:"migrate_on_demand"`
+	Applied          []migrationInfo `json:"applied_migrations,omitempty"`
+}
+
+// schemaMigrator is implemented by the database backends with a schema
+type schemaMigrator interface {
+	SchemaStatus() (schemaStatus, error)
+	Migrate() ([]migration, error)
+}
+
+// migrateMutex keeps the migrations requested through the API from running
+// concurrently in the instance
+var migrateMutex sync.Mutex
+
+// migrationInfos returns the migrations for the admin API responses
+func migrationInfos(list []migration) []migrationInfo {
+	infos := make([]migrationInfo, 0, len(list))
+	for _, m := range list {
+		infos = append(infos, migrationInfo{m.version, m.description})
+	}
+	return infos
+}
+
+// SchemaStatus returns the version of the schema and the pending migrations
+func (d *acmedb) SchemaStatus() (schemaStatus, error) {
+	status := schemaStatus{Engine: d.engine, SupportedVersion: DBVersion, Pending: []migrationInfo{}}
+	version, recorded, err := d.schemaVersion()
+	if err != nil {
+		return status, err
+	}
+	status.SchemaVersion = version
+	if version < DBVersion {
+		status.Pending = migrationInfos(migrations[version:])
+	}
+	if recorded {
+		if status.LastMigration, err = d.lastMigration(); err != nil {
+			return status, err
+		}
+	}
+	return status, nil
+}
+
+// Migrate applies the pending migrations and returns them
+func (d *acmedb) Migrate() ([]migration, error) {
+	migrateMutex.Lock()
+	defer migrateMutex.Unlock()
+	return d.migrate(false)
+}
+
+// webAdminDB reports the database engine, the version of its schema and the
+// pending migrations
+func webAdminDB(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	migrator, ok := DB.(schemaMigrator)
+	if !ok {
+		out, _ := json.Marshal(schemaStatus{Engine: Config.Database.Engine, Pending: []migrationInfo{}})
+		WriteJsonResponse(w, http.StatusOK, out)
+		return
+	}
+	status, err := migrator.SchemaStatus()
+	if err != nil {
+		apiLog.WithFields(log.Fields{"error": err.Error()}).Error("Could not read the database schema version")
+		WriteJsonResponse(w, http.StatusInternalServerError, jsonError("db_error"))
+		return
+	}
+	status.MigrateOnDemand = Config.Database.MigrateOnDemand
+	out, _ := json.Marshal(status)
+	WriteJsonResponse(w, http.StatusOK, out)
+}
+
+// webAdminDBMigrate applies the pending migrations, for the instances starting
+// with migrate_on_demand
+func webAdminDBMigrate(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	migrator, ok := DB.(schemaMigrator)
+	if !ok {
+		WriteJsonResponse(w, http.StatusConflict, jsonError("no_schema"))
+		return
+	}
+	admin, _ := r.Context().Value(AdminKey).(string)
+	applied, err := migrator.Migrate()
+	if err != nil {
+		apiLog.WithFields(log.Fields{"error": err.Error(), "admin": admin, "applied": len(applied)}).Error("Database migration failed")
+		WriteJsonResponse(w, http.StatusInternalServerError, jsonError("migration_failed"))
+		return
+	}
+	apiLog.WithFields(log.Fields{"admin": admin, "applied": len(applied)}).Info("Applied the database migrations")
+	status, err := migrator.SchemaStatus()
+	if err != nil {
+		apiLog.WithFields(log.Fields{"error": err.Error()}).Error("Could not read the database schema version")
+		WriteJsonResponse(w, http.StatusInternalServerError, jsonError("db_error"))
+		return
+	}
+	status.MigrateOnDemand = Config.Database.MigrateOnDemand
+	status.Applied = migrationInfos(applied)
+	out, _ := json.Marshal(status)
+	WriteJsonResponse(w, http.StatusOK, out)
+}
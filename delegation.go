@@ -0,0 +1,240 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+)
+
+// Delegation is the delegation health monitor of this instance, nil if disabled
+var Delegation *delegationMonitor
+
+// delegationStatus is the result of the latest delegation check
+type delegationStatus struct {
+	Healthy  bool     `json:"healthy"`
+	Problems []string `json:"problems,omitempty"`
+	Checked  int64    `json:"checked"`
+}
+
+// delegationEvent is the JSON payload POSTed to the delegation webhook
+type delegationEvent struct {
+	Event    string   `json:"event"`
+	Domain   string   `json:"domain"`
+	Problems []string `json:"problems,omitempty"`
+	Time     int64    `json:"time"`
+}
+
+// delegationMonitor periodically checks that the parent zone delegates the domain
+// to the configured name server, with glue matching the configured records. A broken
+// delegation stops all issuance without any errors showing up in acme-dns itself.
+type delegationMonitor struct {
+	domain   string
+	nsname   string
+	glue     []string
+	interval time.Duration
+	webhook  string
+	// parentServers returns the addresses of the name servers of the parent zone
+	parentServers func(parent string) ([]string, error)
+	mutex         sync.Mutex
+	status        delegationStatus
+	stop          chan struct{}
+}
+
+func newDelegationMonitor(config DNSConfig, domains *staticRecords) *delegationMonitor {
+	m := &delegationMonitor{
+		domain:        strings.ToLower(dns.Fqdn(config.General.Domain)),
+		nsname:        strings.ToLower(dns.Fqdn(config.General.Nsname)),
+		interval:      time.Duration(config.Delegation.Interval) * time.Second,
+		webhook:       config.Delegation.Webhook,
+		parentServers: lookupParentServers,
+		// Assume a working delegation until proven otherwise, so that the first failure alerts
+		status: delegationStatus{Healthy: true},
+		stop:   make(chan struct{}),
+	}
+	// Glue is only needed for a name server inside the delegated domain
+	if dns.IsSubDomain(m.domain, m.nsname) {
+		glue, _ := domains.Get(m.nsname)
+		for _, rr := range glue.Records {
+			switch rec := rr.(type) {
+			case *dns.A:
+				m.glue = append(m.glue, rec.A.String())
+			case *dns.AAAA:
+				m.glue = append(m.glue, rec.AAAA.String())
+			}
+		}
+	}
+	return m
+}
+
+// lookupParentServers resolves the name servers of the parent zone with the system resolver
+func lookupParentServers(parent string) ([]string, error) {
+	nss, err := net.LookupNS(parent)
+	if err != nil {
+		return nil, err
+	}
+	var servers []string
+	for _, ns := range nss {
+		addrs, err := net.LookupHost(ns.Host)
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			servers = append(servers, net.JoinHostPort(addr, "53"))
+		}
+	}
+	if len(servers) == 0 {
+		return nil, fmt.Errorf("no addresses for the name servers of %s", parent)
+	}
+	return servers, nil
+}
+
+// Status returns the result of the latest check
+func (m *delegationMonitor) Status() delegationStatus {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.status
+}
+
+// Run checks the delegation at the configured interval until stopped
+func (m *delegationMonitor) Run() {
+	log.WithFields(log.Fields{"domain": m.domain, "interval": m.interval.String()}).Info("Starting delegation monitor")
+	ticker := time.NewTicker(m.interval)
+	defer ticker.Stop()
+	for {
+		m.tick()
+		select {
+		case <-ticker.C:
+		case <-m.stop:
+			return
+		}
+	}
+}
+
+// Stop ends the monitoring loop
+func (m *delegationMonitor) Stop() {
+	close(m.stop)
+}
+
+func (m *delegationMonitor) tick() {
+	problems := m.check()
+	status := delegationStatus{Healthy: len(problems) == 0, Problems: problems, Checked: time.Now().Unix()}
+	m.mutex.Lock()
+	was := m.status.Healthy
+	m.status = status
+	m.mutex.Unlock()
+	if !status.Healthy {
+		log.WithFields(log.Fields{"domain": m.domain, "problems": strings.Join(problems, "; ")}).Error("Delegation of the domain is broken")
+	}
+	if status.Healthy && !was {
+		log.WithFields(log.Fields{"domain": m.domain}).Info("Delegation of the domain is restored")
+	}
+	if status.Healthy != was && m.webhook != "" {
+		event := delegationEvent{"delegation_restored", m.domain, nil, status.Checked}
+		if !status.Healthy {
+			event = delegationEvent{"delegation_broken", m.domain, problems, status.Checked}
+		}
+		body, err := json.Marshal(event)
+		if err != nil {
+			log.WithFields(log.Fields{"error": err.Error()}).Error("Could not marshal delegation event")
+			return
+		}
+		go postWebhook(m.webhook, body)
+	}
+}
+
+// check queries each name server of the parent zone for the delegation of the domain
+// and returns the problems found
+func (m *delegationMonitor) check() []string {
+	labels := dns.SplitDomainName(m.domain)
+	if len(labels) < 2 {
+		return []string{"the domain has no parent zone to check"}
+	}
+	parent := dns.Fqdn(strings.Join(labels[1:], "."))
+	servers, err := m.parentServers(parent)
+	if err != nil {
+		return []string{fmt.Sprintf("could not find the name servers of %s: %v", parent, err)}
+	}
+	var problems []string
+	var unreachable []string
+	for _, server := range servers {
+		nameservers, glue, err := m.queryDelegation(server)
+		if err != nil {
+			unreachable = append(unreachable, fmt.Sprintf("%s: %v", server, err))
+			continue
+		}
+		if len(nameservers) == 0 {
+			problems = append(problems, fmt.Sprintf("%s: no delegation for %s", server, m.domain))
+			continue
+		}
+		if !containsString(nameservers, m.nsname) {
+			problems = append(problems, fmt.Sprintf("%s: delegated to %v instead of %s", server, nameservers, m.nsname))
+			continue
+		}
+		if len(m.glue) > 0 && !sameRecords(glue, m.glue) {
+			problems = append(problems, fmt.Sprintf("%s: glue for %s is %v, expected %v", server, m.nsname, glue, m.glue))
+		}
+	}
+	// Single unreachable servers of the parent zone don't affect resolution
+	if len(unreachable) == len(servers) {
+		problems = append(problems, unreachable...)
+	}
+	return problems
+}
+
+// queryDelegation returns the name servers the parent zone server delegates the domain
+// to, and the glue addresses it gives for the configured name server
+func (m *delegationMonitor) queryDelegation(server string) ([]string, []string, error) {
+	msg := new(dns.Msg)
+	msg.SetQuestion(m.domain, dns.TypeNS)
+	msg.RecursionDesired = false
+	in, err := dns.Exchange(msg, server)
+	if err != nil {
+		return nil, nil, err
+	}
+	var nameservers []string
+	var glue []string
+	for _, rr := range append(in.Answer, in.Ns...) {
+		if ns, ok := rr.(*dns.NS); ok && strings.EqualFold(ns.Hdr.Name, m.domain) {
+			nameservers = append(nameservers, strings.ToLower(ns.Ns))
+		}
+	}
+	for _, rr := range in.Extra {
+		if !strings.EqualFold(rr.Header().Name, m.nsname) {
+			continue
+		}
+		switch rec := rr.(type) {
+		case *dns.A:
+			glue = append(glue, rec.A.String())
+		case *dns.AAAA:
+			glue = append(glue, rec.AAAA.String())
+		}
+	}
+	return nameservers, glue, nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// webAdminDelegation returns the result of the latest delegation check
+func webAdminDelegation(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	if Delegation == nil {
+		WriteJsonResponse(w, http.StatusNotFound, jsonError("delegation_monitor_disabled"))
+		return
+	}
+	out, _ := json.Marshal(Delegation.Status())
+	WriteJsonResponse(w, http.StatusOK, out)
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// fakeParent is a name server of the parent zone answering with a referral
+type fakeParent struct {
+	mutex sync.Mutex
+	ns    string
+	glue  string
+}
+
+func (p *fakeParent) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	m := new(dns.Msg)
+	m.SetReply(r)
+	if p.ns != "" {
+		ns, _ := dns.NewRR("auth.example.org. 3600 IN NS " + p.ns)
+		m.Ns = append(m.Ns, ns)
+	}
+	if p.glue != "" {
+		glue, _ := dns.NewRR("auth.example.org. 3600 IN A " + p.glue)
+		m.Extra = append(m.Extra, glue)
+	}
+	_ = w.WriteMsg(m)
+}
+
+func (p *fakeParent) set(ns string, glue string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.ns = ns
+	p.glue = glue
+}
+
+func startFakeParent(t *testing.T) (*fakeParent, string) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Could not listen: %v", err)
+	}
+	parent := &fakeParent{}
+	var wg sync.WaitGroup
+	wg.Add(1)
+	server := &dns.Server{PacketConn: conn, Handler: parent, NotifyStartedFunc: wg.Done}
+	go func() { _ = server.ActivateAndServe() }()
+	wg.Wait()
+	t.Cleanup(func() { _ = server.Shutdown() })
+	return parent, conn.LocalAddr().String()
+}
+
+func TestDelegationMonitor(t *testing.T) {
+	events := make(chan delegationEvent, 2)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event delegationEvent
+		_ = json.NewDecoder(r.Body).Decode(&event)
+		events <- event
+	}))
+	defer receiver.Close()
+	parent, addr := startFakeParent(t)
+
+	config := DNSConfig{
+		General:    general{Domain: "auth.example.org", Nsname: "auth.example.org"},
+		Delegation: delegation{Interval: 60, Webhook: receiver.URL},
+	}
+	glue, _ := dns.NewRR("auth.example.org. A 198.51.100.1")
+	records := newStaticRecords()
+	records.Add(glue)
+	m := newDelegationMonitor(config, records)
+	m.parentServers = func(name string) ([]string, error) {
+		if name != "example.org." {
+			t.Errorf("Expected the parent zone example.org., got %s", name)
+		}
+		return []string{addr}, nil
+	}
+
+	for i, test := range []struct {
+		ns      string
+		glue    string
+		problem string
+	}{
+		{"auth.example.org.", "198.51.100.1", ""},
+		{"", "", "no delegation"},
+		{"ns1.other.example.", "", "delegated to [ns1.other.example.]"},
+		{"auth.example.org.", "198.51.100.2", "glue for auth.example.org. is [198.51.100.2]"},
+	} {
+		parent.set(test.ns, test.glue)
+		problems := m.check()
+		if test.problem == "" && len(problems) != 0 {
+			t.Errorf("Test %d: Expected no problems, got %v", i, problems)
+		}
+		if test.problem != "" && (len(problems) != 1 || !strings.Contains(problems[0], test.problem)) {
+			t.Errorf("Test %d: Expected problem %q, got %v", i, test.problem, problems)
+		}
+	}
+
+	// Alerts are sent when the state changes only
+	parent.set("", "")
+	m.tick()
+	m.tick()
+	if m.Status().Healthy {
+		t.Errorf("Expected the delegation to be reported broken")
+	}
+	parent.set("auth.example.org.", "198.51.100.1")
+	m.tick()
+	if !m.Status().Healthy {
+		t.Errorf("Expected the delegation to be reported healthy, got %+v", m.Status())
+	}
+	for _, expected := range []string{"delegation_broken", "delegation_restored"} {
+		select {
+		case event := <-events:
+			if event.Event != expected || event.Domain != "auth.example.org." {
+				t.Errorf("Expected a %s event, got %+v", expected, event)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Delegation webhook was not delivered")
+		}
+	}
+	select {
+	case event := <-events:
+		t.Errorf("Unexpected event %+v", event)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestDelegationUnreachableParent(t *testing.T) {
+	_, addr := startFakeParent(t)
+	m := newDelegationMonitor(DNSConfig{General: general{Domain: "auth.example.org", Nsname: "ns1.example.net"}}, newStaticRecords())
+	if len(m.glue) != 0 {
+		t.Errorf("Expected no glue to be checked for a name server outside the domain")
+	}
+	// An unreachable server among working ones isn't a problem
+	m.parentServers = func(string) ([]string, error) { return []string{"127.0.0.1:1", addr}, nil }
+	problems := m.check()
+	if len(problems) != 1 || !strings.Contains(problems[0], "no delegation") {
+		t.Errorf("Expected only the delegation problem, got %v", problems)
+	}
+	m.parentServers = func(string) ([]string, error) { return []string{"127.0.0.1:1"}, nil }
+	if problems = m.check(); len(problems) != 1 || !strings.HasPrefix(problems[0], "127.0.0.1:1") {
+		t.Errorf("Expected the unreachable server to be reported, got %v", problems)
+	}
+}
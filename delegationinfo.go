@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+)
+
+// delegationInfo is everything needed outside of acme-dns to recreate the
+// deployment: the records for the parent zone and the records of the API names
+// outside of the zone, as zone file lines
+type delegationInfo struct {
+	Zone        string   `json:"zone"`
+	Nameservers []string `json:"nameservers"`
+	Glue        []string `json:"glue"`
+	DS          []string `json:"ds"`
+	APINames    []string `json:"api_names"`
+	APIRecords  []string `json:"api_records"`
+	Warnings    []string `json:"warnings,omitempty"`
+}
+
+// newDelegationInfo generates the delegation info from the records served with
+// the configuration and from the DNSSEC keys
+func newDelegationInfo(config DNSConfig, keys []*dnssecKey) delegationInfo {
+	server := NewDNSServer(nil, "", "udp", config.General.Domain)
+	server.ParseRecords(config)
+	info := delegationInfo{
+		Zone:        server.Domain,
+		Nameservers: []string{},
+		Glue:        []string{},
+		DS:          []string{},
+		APINames:    apiCertNames(config),
+		APIRecords:  []string{},
+	}
+	records, _ := server.Domains.Get(server.Domain)
+	for _, rr := range records.Records {
+		ns, ok := rr.(*dns.NS)
+		if !ok {
+			continue
+		}
+		info.Nameservers = append(info.Nameservers, ns.String())
+		// Glue is only needed for the name servers inside the zone
+		if !dns.IsSubDomain(server.Domain, ns.Ns) {
+			continue
+		}
+		glue := configuredAddresses(server.Domains, ns.Ns)
+		if len(glue) == 0 {
+			info.Warnings = append(info.Warnings, fmt.Sprintf("%s is inside the zone but has no A or AAAA records for glue", ns.Ns))
+		}
+		for _, rr := range glue {
+			info.Glue = append(info.Glue, rr.String())
+		}
+	}
+	if len(info.Nameservers) == 0 {
+		info.Warnings = append(info.Warnings, "no NS records, set nsname or nameservers")
+	}
+	if config.DNSSEC.Enabled {
+		for _, k := range keys {
+			if k.Role == roleKSK {
+				info.DS = append(info.DS, k.dnskey.ToDS(dns.SHA256).String())
+			}
+		}
+		if len(info.DS) == 0 {
+			info.Warnings = append(info.Warnings, "DNSSEC is enabled but there are no keys yet, run acme-dns dnssec keygen")
+		}
+	}
+	letsencrypt := config.API.TLS == "letsencrypt" || config.API.TLS == "letsencryptstaging"
+	for _, name := range info.APINames {
+		fqdn := dns.Fqdn(name)
+		if dns.IsSubDomain(server.Domain, fqdn) {
+			// Published addresses are added by the health check of the API
+			if len(configuredAddresses(server.Domains, fqdn)) == 0 && !config.API.PublishAddress {
+				info.Warnings = append(info.Warnings, fmt.Sprintf("the API name %s has no A or AAAA records", fqdn))
+			}
+			continue
+		}
+		// The address of the API outside of the zone is managed elsewhere, only
+		// the challenges of the certificate are answered by acme-dns
+		if letsencrypt {
+			info.APIRecords = append(info.APIRecords, fmt.Sprintf("_acme-challenge.%s\tCNAME\t_acme-challenge.%s", fqdn, server.Domain))
+		}
+	}
+	return info
+}
+
+// configuredAddresses returns the A and AAAA records of the name among the
+// records configured for the zone, leaving out the registered subdomains
+func configuredAddresses(domains *staticRecords, name string) []dns.RR {
+	var rrs []dns.RR
+	records, _ := domains.Get(strings.ToLower(name))
+	for _, rr := range records.Records {
+		if t := rr.Header().Rrtype; t == dns.TypeA || t == dns.TypeAAAA {
+			rrs = append(rrs, rr)
+		}
+	}
+	return rrs
+}
+
+// writeDelegationInfo writes the delegation info as a commented zone file
+func writeDelegationInfo(info delegationInfo, out io.Writer) {
+	section := func(comment string, lines []string) {
+		if len(lines) == 0 {
+			return
+		}
+		fmt.Fprintf(out, "; %s\n", comment)
+		for _, line := range lines {
+			fmt.Fprintln(out, line)
+		}
+		fmt.Fprintln(out)
+	}
+	section("Delegation of "+info.Zone+" in the parent zone", info.Nameservers)
+	section("Glue of the name servers inside the zone", info.Glue)
+	section("DS records of the key signing keys, for the parent zone", info.DS)
+	fmt.Fprintf(out, "; Names of the API: %s\n\n", strings.Join(info.APINames, ", "))
+	section("Records of the API names outside of the zone", info.APIRecords)
+	for _, warning := range info.Warnings {
+		fmt.Fprintf(out, "; WARNING: %s\n", warning)
+	}
+}
+
+// runDelegationInfo prints the delegation info of the configuration, as JSON or
+// as a commented zone file
+func runDelegationInfo(config DNSConfig, store dnssecKeyStore, jsonOutput bool, out io.Writer) error {
+	var keys []*dnssecKey
+	if config.DNSSEC.Enabled {
+		var err error
+		if keys, err = store.Load(); err != nil {
+			return err
+		}
+	}
+	info := newDelegationInfo(config, keys)
+	if jsonOutput {
+		encoder := json.NewEncoder(out)
+		encoder.SetIndent("", "    ")
+		return encoder.Encode(info)
+	}
+	writeDelegationInfo(info, out)
+	return nil
+}
+
+// webAdminDelegationInfo returns the delegation info of the running configuration
+func webAdminDelegationInfo(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	var keys []*dnssecKey
+	if Config.DNSSEC.Enabled {
+		var err error
+		if keys, err = newDNSSECKeyStore(Config.DNSSEC, DB).Load(); err != nil {
+			apiLog.WithFields(log.Fields{"error": err.Error()}).Error("Could not load the DNSSEC keys")
+			WriteJsonResponse(w, http.StatusInternalServerError, jsonError("db_error"))
+			return
+		}
+	}
+	out, _ := json.Marshal(newDelegationInfo(Config, keys))
+	WriteJsonResponse(w, http.StatusOK, out)
+}
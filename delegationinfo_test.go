@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDelegationInfo(t *testing.T) {
+	config := Config
+	config.General.Domain = "auth.example.org"
+	config.General.Nsname = "ns1.auth.example.org"
+	config.General.Nameservers = []string{"ns1.auth.example.org", "ns2.auth.example.org", "ns.example.net"}
+	config.General.StaticRecords = []string{
+		"auth.example.org. A 198.51.100.1",
+		"ns1.auth.example.org. A 198.51.100.1",
+		"ns1.auth.example.org. AAAA 2001:db8::1",
+	}
+	config.General.ZoneFiles = nil
+	config.API.TLS = "letsencrypt"
+	config.API.TLSAltNames = []string{"api.auth.example.org", "acme-dns.example.com"}
+	config.DNSSEC = testDNSSECConfig(t.TempDir())
+	keys, err := generateKeySet(config.General.Domain, config.DNSSEC, time.Now())
+	if err != nil {
+		t.Fatalf("Could not generate the keys: %v", err)
+	}
+
+	info := newDelegationInfo(config, keys)
+	if info.Zone != "auth.example.org." || len(info.Nameservers) != 3 {
+		t.Errorf("Expected the three name servers of auth.example.org., got %v", info.Nameservers)
+	}
+	if len(info.Glue) != 2 || !strings.HasPrefix(info.Glue[0], "ns1.auth.example.org.") || !strings.HasPrefix(info.Glue[1], "ns1.auth.example.org.") {
+		t.Errorf("Expected the A and AAAA glue of ns1, got %v", info.Glue)
+	}
+	if len(info.DS) != 1 || !strings.Contains(info.DS[0], "\tDS\t") {
+		t.Errorf("Expected the DS record of the KSK, got %v", info.DS)
+	}
+	if len(info.APIRecords) != 1 || info.APIRecords[0] != "_acme-challenge.acme-dns.example.com.\tCNAME\t_acme-challenge.auth.example.org." {
+		t.Errorf("Expected the challenge alias of the API name outside of the zone, got %v", info.APIRecords)
+	}
+	// ns2 has no glue and api has no address
+	if len(info.Warnings) != 2 {
+		t.Errorf("Expected two warnings, got %v", info.Warnings)
+	}
+
+	config.DNSSEC.Enabled = false
+	config.API.TLS = "cert"
+	info = newDelegationInfo(config, keys)
+	if len(info.DS) != 0 || len(info.APIRecords) != 0 {
+		t.Errorf("Expected no DS records and no challenge aliases, got %v and %v", info.DS, info.APIRecords)
+	}
+}
+
+func TestRunDelegationInfo(t *testing.T) {
+	config := Config
+	config.General.Domain = "auth.example.org"
+	config.General.Nsname = "ns1.auth.example.org"
+	config.General.Nameservers = nil
+	config.General.StaticRecords = []string{"ns1.auth.example.org. A 198.51.100.1"}
+	config.General.ZoneFiles = nil
+	config.DNSSEC = testDNSSECConfig(t.TempDir())
+	store := newDNSSECKeyStore(config.DNSSEC, nil)
+
+	var out bytes.Buffer
+	if err := runDelegationInfo(config, store, false, &out); err != nil {
+		t.Fatalf("Could not generate the delegation info: %v", err)
+	}
+	for _, expected := range []string{
+		"; Delegation of auth.example.org. in the parent zone\nauth.example.org.\t",
+		"\tNS\tns1.auth.example.org.\n",
+		"ns1.auth.example.org.\t",
+		"\tA\t198.51.100.1\n",
+		"; WARNING: DNSSEC is enabled but there are no keys yet",
+	} {
+		if !strings.Contains(out.String(), expected) {
+			t.Errorf("Expected %q in the output:\n%s", expected, out.String())
+		}
+	}
+
+	out.Reset()
+	if err := runDelegationInfo(config, store, true, &out); err != nil || !strings.Contains(out.String(), `"zone": "auth.example.org."`) {
+		t.Errorf("Expected the delegation info as JSON, got %q and %v", out.String(), err)
+	}
+}
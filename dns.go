@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"github.com/miekg/dns"
 	log "github.com/sirupsen/logrus"
+	"net"
 	"strings"
 	"time"
 )
@@ -15,105 +16,509 @@ type Records struct {
 
 // DNSServer is the main struct for acme-dns DNS server
 type DNSServer struct {
-	DB              database
-	Domain          string
-	Server          *dns.Server
-	SOA             dns.RR
-	PersonalKeyAuth string
-	Domains         map[string]Records
+	DB     database
+	Domain string
+	Server *dns.Server
+	SOA    dns.RR
+	Clock  clock
+	// OwnChallenges are the pending DNS-01 challenges of the API certificates
+	OwnChallenges *ownChallenges
+	// Domains are the static records, shared by the servers and safe to change at runtime
+	Domains *staticRecords
+	// Zones are the further zones served with the registrations besides Domain
+	Zones []string
+	// StrictTXT are the zones serving the TXT values of the registrations at their
+	// exact names only
+	StrictTXT []string
+	// MaxUDPSize limits the size of UDP responses, larger answers are truncated
+	MaxUDPSize int
+	// AutoPTR answers PTR queries in the hosted reverse zones for the A and AAAA records
+	AutoPTR bool
+	// AuthorityNS adds the NS records of the zone to the authority section of the
+	// positive answers
+	AuthorityNS bool
+	// ClientSubnet answers the addresses of the subnet answers of the registrations
+	// to the clients in their subnets
+	ClientSubnet bool
+	// Additional are the answer types with the addresses of their targets added to
+	// the additional section, which is left empty otherwise
+	Additional map[uint16]bool
+	// APIRecords publishes the addresses of the HTTP API, nil if disabled
+	APIRecords *apiAddressPublisher
+	// Tap captures the queries and responses in the dnstap format, nil if disabled
+	Tap *dnstapLogger
+	// Stats counts the queries and responses for the statistics channel, nil if disabled
+	Stats *dnsStatistics
+	// UDPPool answers the queries of UDP servers with a bounded number of workers,
+	// nil to answer each query in a goroutine of its own
+	UDPPool *udpWorkerPool
+	// DNSSEC signs the answers of the zone for queries with the DO bit, nil if disabled
+	DNSSEC *dnssecSigner
+	// TCPLimit bounds the connections open at once to the TCP listeners, nil for
+	// no limit
+	TCPLimit *tcpConnLimit
+	// SigningAudit counts the answers that would be signed, nil unless the DNSSEC
+	// audit mode is on
+	SigningAudit *dnssecAudit
+	// TSIG are the keys accepted for signed requests, nil if none are configured
+	TSIG *tsigKeyring
+	// RRL limits the rate of the UDP responses to each client subnet, nil if disabled
+	RRL *responseRateLimiter
+	// QueryLimit limits the rate of the queries of each client address, nil if disabled
+	QueryLimit *queryRateLimiter
 }
 
 // NewDNSServer parses the DNS records from config and returns a new DNSServer struct
 func NewDNSServer(db database, addr string, proto string, domain string) *DNSServer {
 	var server DNSServer
-	server.Server = &dns.Server{Addr: addr, Net: proto}
+	server.Server = &dns.Server{Addr: addr, Net: proto, MsgAcceptFunc: acceptMsg}
 	if !strings.HasSuffix(domain, ".") {
 		domain = domain + "."
 	}
 	server.Domain = strings.ToLower(domain)
 	server.DB = db
-	server.PersonalKeyAuth = ""
-	server.Domains = make(map[string]Records)
+	server.Domains = newStaticRecords()
 	return &server
 }
 
+// dnsProtocols returns the network protocols to serve for the configured protocol
+func dnsProtocols(proto string) []string {
+	if !strings.HasPrefix(proto, "both") {
+		return []string{proto}
+	}
+	// Serve both udp and tcp, keeping the address family
+	suffix := strings.TrimPrefix(proto, "both")
+	return []string{"udp" + suffix, "tcp" + suffix}
+}
+
+// dnsListener is an address served with a network protocol
+type dnsListener struct {
+	addr  string
+	proto string
+}
+
+// dnsListeners returns the addresses and protocols the nameserver listens on,
+// with the DNS-over-TLS listener last
+func dnsListeners(config DNSConfig) []dnsListener {
+	var listeners []dnsListener
+	listen := append([]string{config.General.Listen}, config.General.AdditionalListen...)
+	for _, addr := range listen {
+		for _, proto := range dnsProtocols(config.General.Proto) {
+			listeners = append(listeners, dnsListener{addr, proto})
+		}
+	}
+	if config.General.TLSListen != "" {
+		listeners = append(listeners, dnsListener{config.General.TLSListen, "tcp-tls"})
+	}
+	return listeners
+}
+
+// newDNSServers returns a DNSServer for each of the listen addresses and protocols in
+// the config. The servers share the records parsed from the config.
+func newDNSServers(db database, config DNSConfig) []*DNSServer {
+	var servers []*DNSServer
+	var apiRecords *apiAddressPublisher
+	if config.API.PublishAddress {
+		apiRecords = newAPIAddressPublisher(config)
+	}
+	var stats *dnsStatistics
+	if config.Statistics.Listen != "" {
+		stats = newDNSStatistics(nil)
+	}
+	var pool *udpWorkerPool
+	if config.General.UDPWorkers > 0 {
+		pool = newUDPWorkerPool(config.General.UDPWorkers, config.General.UDPQueueSize, config.General.UDPDropPolicy, stats)
+		if stats != nil {
+			stats.UDPPool = pool
+		}
+	}
+	var tcpLimit *tcpConnLimit
+	if config.General.TCPMaxConnections > 0 {
+		tcpLimit = newTCPConnLimit(config.General.TCPMaxConnections, stats)
+	}
+	var audit *dnssecAudit
+	if config.DNSSEC.Audit && !config.DNSSEC.Enabled {
+		audit = newDNSSECAudit(config.General.Domain, config.DNSSEC, nil)
+		if stats != nil {
+			stats.SigningAudit = audit
+		}
+	}
+	var tap *dnstapLogger
+	if config.Dnstap.Output != "" {
+		var err error
+		if tap, err = newDnstapLogger(config.Dnstap); err != nil {
+			dnsLog.WithFields(log.Fields{"error": err.Error()}).Error("Dnstap capture disabled")
+		}
+	}
+	var rrl *responseRateLimiter
+	if config.RRL.ResponsesPerSecond > 0 {
+		rrl = newResponseRateLimiter(config.RRL, nil)
+	}
+	var queryLimit *queryRateLimiter
+	if config.RateLimit.QueriesPerSecond > 0 {
+		queryLimit = newQueryRateLimiter(config.RateLimit, nil)
+	}
+	challenges := newOwnChallenges(config)
+	// The keys were validated with the configuration
+	keyring, _ := newTSIGKeyring(config.TSIG.Keys)
+	for _, listener := range dnsListeners(config) {
+		server := NewDNSServer(db, listener.addr, listener.proto, config.General.Domain)
+		server.MaxUDPSize = config.General.MaxUDPSize
+		server.AutoPTR = config.General.AutoPTR
+		server.AuthorityNS = config.General.AuthorityNS
+		server.ClientSubnet = config.General.ClientSubnet
+		server.Additional, _ = parseAdditional(config.General.Additional)
+		server.APIRecords = apiRecords
+		server.Tap = tap
+		server.Stats = stats
+		server.SigningAudit = audit
+		server.OwnChallenges = challenges
+		server.RRL = rrl
+		server.QueryLimit = queryLimit
+		if keyring != nil && len(keyring.secrets) > 0 {
+			server.TSIG = keyring
+			server.Server.TsigSecret = keyring.secrets
+		}
+		if strings.HasPrefix(listener.proto, "udp") {
+			server.UDPPool = pool
+		} else {
+			idle := time.Duration(config.General.TCPIdleTimeout) * time.Second
+			server.Server.IdleTimeout = func() time.Duration { return idle }
+			server.TCPLimit = tcpLimit
+		}
+		if len(servers) == 0 {
+			server.ParseRecords(config)
+		} else {
+			// No need to parse records from config again
+			server.Domains = servers[0].Domains
+			server.SOA = servers[0].SOA
+			server.Zones = servers[0].Zones
+			server.StrictTXT = servers[0].StrictTXT
+		}
+		servers = append(servers, server)
+	}
+	return servers
+}
+
 // Start starts the DNSServer
 func (d *DNSServer) Start(errorChannel chan error) {
-	// DNS server part
-	dns.HandleFunc(".", d.handleRequest)
-	log.WithFields(log.Fields{"addr": d.Server.Addr, "proto": d.Server.Net}).Info("Listening DNS")
-	err := d.Server.ListenAndServe()
+	// DNS server part, each server answers with its own handler as several may run
+	d.Server.Handler = dns.HandlerFunc(d.handleRequest)
+	if d.UDPPool != nil {
+		d.Server.Handler = d.UDPPool.Handler(d.handleRequest)
+	}
+	dnsLog.WithFields(log.Fields{"addr": d.Server.Addr, "proto": d.Server.Net}).Info("Listening DNS")
+	var err error
+	if d.TCPLimit != nil {
+		if d.Server.Listener, err = d.listenLimited(); err == nil {
+			err = d.Server.ActivateAndServe()
+		}
+	} else {
+		err = d.Server.ListenAndServe()
+	}
 	if err != nil {
 		errorChannel <- err
 	}
 }
 
-// ParseRecords parses a slice of DNS record string
+// ParseRecords parses the static records, name servers and SOA records of the zones
 func (d *DNSServer) ParseRecords(config DNSConfig) {
-	for _, v := range config.General.StaticRecords {
-		rr, err := dns.NewRR(strings.ToLower(v))
+	d.Zones = nil
+	for _, zone := range config.Zones {
+		d.Zones = append(d.Zones, strings.ToLower(dns.Fqdn(zone.Domain)))
+	}
+	d.StrictTXT = nil
+	for _, zone := range servedZones(config) {
+		if zone.StrictTXT {
+			d.StrictTXT = append(d.StrictTXT, strings.ToLower(dns.Fqdn(zone.Domain)))
+		}
+	}
+	// Create serial
+	serial := clockOrSystem(d.Clock).Now().Format("2006010215")
+	for i, zone := range servedZones(config) {
+		soa := d.parseZone(zone, serial)
+		if i == 0 && soa != nil {
+			d.SOA = soa
+		}
+	}
+	d.loadZoneFiles(config.General.ZoneFiles)
+}
+
+// parseZone adds the static records, name servers and SOA record of the zone, and
+// returns the SOA record
+func (d *DNSServer) parseZone(zone zoneConfig, serial string) dns.RR {
+	var rrs []dns.RR
+	for _, v := range zone.StaticRecords {
+		parsed, err := parseStaticRecord(v)
 		if err != nil {
-			log.WithFields(log.Fields{"error": err.Error(), "rr": v}).Warning("Could not parse RR from config")
+			dnsLog.WithFields(log.Fields{"error": err.Error(), "rr": v}).Warning("Could not parse RR from config")
 			continue
 		}
-		// Add parsed RR
-		d.appendRR(rr)
+		rrs = append(rrs, parsed...)
 	}
-	// Create serial
-	serial := time.Now().Format("2006010215")
+	if zone.RecordsFile != "" {
+		fileRRs, err := loadRecordsFile(zone.RecordsFile, zone.Domain)
+		if err != nil {
+			dnsLog.WithFields(log.Fields{"error": err.Error(), "file": zone.RecordsFile}).Error("Could not load records file")
+		} else {
+			rrs = append(rrs, fileRRs...)
+		}
+	}
+	d.Domains.Add(rrs...)
+	d.Domains.Add(zoneNS(zone, rrs)...)
+	d.Domains.Add(aboutRecords(zone.Domain, zone.aboutInfo)...)
 	// Add SOA
-	SOAstring := fmt.Sprintf("%s. SOA %s. %s. %s 28800 7200 604800 86400", strings.ToLower(config.General.Domain), strings.ToLower(config.General.Nsname), strings.ToLower(config.General.Nsadmin), serial)
+	timers := zone.soaTimers.or(defaultSOATimers)
+	SOAstring := fmt.Sprintf("%s. SOA %s. %s. %s %d %d %d %d", normalizeZone(zone.Domain), strings.ToLower(zone.Nsname), strings.ToLower(zone.Nsadmin), serial, timers.Refresh, timers.Retry, timers.Expire, timers.Minimum)
 	soarr, err := dns.NewRR(SOAstring)
 	if err != nil {
-		log.WithFields(log.Fields{"error": err.Error(), "soa": SOAstring}).Error("Error while adding SOA record")
-	} else {
-		d.appendRR(soarr)
-		d.SOA = soarr
-	}
-}
-
-func (d *DNSServer) appendRR(rr dns.RR) {
-	addDomain := rr.Header().Name
-	_, ok := d.Domains[addDomain]
-	if !ok {
-		d.Domains[addDomain] = Records{[]dns.RR{rr}}
-	} else {
-		drecs := d.Domains[addDomain]
-		drecs.Records = append(drecs.Records, rr)
-		d.Domains[addDomain] = drecs
+		dnsLog.WithFields(log.Fields{"error": err.Error(), "soa": SOAstring}).Error("Error while adding SOA record")
+		return nil
 	}
-	log.WithFields(log.Fields{"recordtype": dns.TypeToString[rr.Header().Rrtype], "domain": addDomain}).Debug("Adding new record to domain")
+	d.Domains.Add(soarr)
+	return soarr
 }
 
 func (d *DNSServer) handleRequest(w dns.ResponseWriter, r *dns.Msg) {
+	received := clockOrSystem(d.Clock).Now()
+	if !d.QueryLimit.Allow(w, r, d.Stats) {
+		return
+	}
 	m := new(dns.Msg)
 	m.SetReply(r)
 
+	tsig := r.IsTsig()
+	if tsig != nil {
+		if tsigError := d.TSIG.verify(w, tsig); tsigError != dns.RcodeSuccess {
+			dnsLog.WithFields(log.Fields{"key": tsig.Hdr.Name, "error": dns.RcodeToString[tsigError]}).Debug("TSIG verification failed")
+			writeTSIGError(w, m, tsig, tsigError)
+			d.Stats.Record(w, r, m, clockOrSystem(d.Clock).Now().Sub(received))
+			if d.Tap != nil {
+				d.Tap.LogExchange(w, r, m, received, clockOrSystem(d.Clock).Now())
+			}
+			return
+		}
+	}
+	// Zone transfers and dynamic updates are refused outright without a TSIG key,
+	// zone transfers aren't served yet
+	query := r.Opcode == dns.OpcodeQuery
+	if requiresTSIG(r) {
+		query = false
+		switch {
+		case tsig == nil:
+			m.MsgHdr.Rcode = dns.RcodeRefused
+		case r.Opcode == dns.OpcodeUpdate:
+			m.MsgHdr.Rcode = d.handleUpdate(w, r, tsig.Hdr.Name)
+		default:
+			m.MsgHdr.Rcode = dns.RcodeNotImplemented
+		}
+	}
+
 	// handle edns0
 	opt := r.IsEdns0()
-	if opt != nil {
+	if countOPT(r) > 1 {
+		// More than one OPT record is a format error (RFC 6891 section 6.1.1)
+		m.MsgHdr.Rcode = dns.RcodeFormatError
+	} else if opt != nil {
 		if opt.Version() != 0 {
 			// Only EDNS0 is standardized
 			m.MsgHdr.Rcode = dns.RcodeBadVers
-			m.SetEdns0(512, false)
+			m.SetEdns0(uint16(d.udpSize()), false)
 		} else {
 			// We can safely do this as we know that we're not setting other OPT RRs within acme-dns.
-			m.SetEdns0(512, false)
-			if r.Opcode == dns.OpcodeQuery {
+			dnssecOK := opt.Do() && d.DNSSEC != nil
+			m.SetEdns0(uint16(d.udpSize()), dnssecOK)
+			if query {
 				d.readQuery(m)
+				if d.ClientSubnet {
+					d.answerClientSubnet(w, r, m)
+				}
+				if d.SigningAudit != nil {
+					d.auditSigning(m, opt.Do())
+				}
+				if dnssecOK {
+					d.secure(m)
+				}
 			}
 		}
 	} else {
-		if r.Opcode == dns.OpcodeQuery {
+		if query {
 			d.readQuery(m)
+			if d.ClientSubnet {
+				d.answerClientSubnet(w, r, m)
+			}
+			if d.SigningAudit != nil {
+				d.auditSigning(m, false)
+			}
 		}
 	}
+	limit := d.responseSizeLimit(w, r)
+	if tsig != nil {
+		// Leave room for the signature of the response
+		limit -= tsigLen(tsig)
+	}
+	truncate(m, limit)
+	// Truncate disables compression for messages that fit without it
+	m.Compress = true
+	// Signed requests come from the holders of a key, not from spoofed addresses
+	if tsig == nil {
+		switch d.RRL.Check(w) {
+		case rrlDrop:
+			d.Stats.RecordRateLimited("RateDropped")
+			return
+		case rrlSlip:
+			slipResponse(m)
+			d.Stats.RecordRateLimited("RateSlipped")
+		}
+	}
+	if tsig != nil {
+		// The server signs responses carrying a TSIG record with its key
+		m.SetTsig(tsig.Hdr.Name, tsig.Algorithm, tsig.Fudge, clockOrSystem(d.Clock).Now().Unix())
+	}
 	_ = w.WriteMsg(m)
+	d.Stats.Record(w, r, m, clockOrSystem(d.Clock).Now().Sub(received))
+	if d.Tap != nil {
+		d.Tap.LogExchange(w, r, m, received, clockOrSystem(d.Clock).Now())
+	}
+}
+
+// udpSize returns the configured maximum UDP response size
+func (d *DNSServer) udpSize() int {
+	if d.MaxUDPSize < dns.MinMsgSize {
+		return dns.MinMsgSize
+	}
+	if d.MaxUDPSize > dns.MaxMsgSize {
+		return dns.MaxMsgSize
+	}
+	return d.MaxUDPSize
+}
+
+// responseSizeLimit returns the maximum size of the response to r, based on the
+// transport, the EDNS0 buffer size of the client and the configured UDP limit
+func (d *DNSServer) responseSizeLimit(w dns.ResponseWriter, r *dns.Msg) int {
+	if _, ok := w.LocalAddr().(*net.TCPAddr); ok {
+		return dns.MaxMsgSize
+	}
+	size := dns.MinMsgSize
+	if opt := r.IsEdns0(); opt != nil && int(opt.UDPSize()) > size {
+		size = int(opt.UDPSize())
+	}
+	if size > d.udpSize() {
+		size = d.udpSize()
+	}
+	return size
+}
+
+// truncate fits the response in the size limit, setting TC if records had to be
+// left out. If the answer or authority section doesn't fit, all the records are
+// left out rather than sending partial RRsets, which some resolvers use as the
+// complete answer instead of retrying over TCP.
+func truncate(m *dns.Msg, limit int) {
+	answers, authority := len(m.Answer), len(m.Ns)
+	m.Truncate(limit)
+	if len(m.Answer) == answers && len(m.Ns) == authority {
+		return
+	}
+	clearRecords(m)
+}
+
+// clearRecords removes all the records of the response but the OPT record
+func clearRecords(m *dns.Msg) {
+	m.Answer, m.Ns = nil, nil
+	opt := m.IsEdns0()
+	m.Extra = nil
+	if opt != nil {
+		m.Extra = []dns.RR{opt}
+	}
+}
+
+// countOPT returns the number of OPT records of the message
+func countOPT(r *dns.Msg) int {
+	count := 0
+	for _, rr := range r.Extra {
+		if rr.Header().Rrtype == dns.TypeOPT {
+			count++
+		}
+	}
+	return count
+}
+
+// zoneSOA returns the SOA record of the primary zone with the current serial
+func (d *DNSServer) zoneSOA() dns.RR {
+	if soa := d.soaOf(d.Domain); soa != nil {
+		return soa
+	}
+	return d.SOA
+}
+
+// zoneNS returns the NS records of the zone for the configured name servers, or
+// for nsname if none are configured, leaving out the ones in the static records
+func zoneNS(config zoneConfig, static []dns.RR) []dns.RR {
+	names := config.Nameservers
+	if len(names) == 0 && config.Nsname != "" {
+		names = []string{config.Nsname}
+	}
+	zone := strings.ToLower(dns.Fqdn(config.Domain))
+	var rrs []dns.RR
+	for _, name := range names {
+		ns := &dns.NS{
+			Hdr: dns.RR_Header{Name: zone, Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: 3600},
+			Ns:  strings.ToLower(dns.Fqdn(name)),
+		}
+		duplicate := false
+		for _, rr := range append(static[:len(static):len(static)], rrs...) {
+			if dns.IsDuplicate(rr, ns) {
+				duplicate = true
+				break
+			}
+		}
+		if !duplicate {
+			rrs = append(rrs, ns)
+		}
+	}
+	return rrs
+}
+
+// authorityNS returns the NS records of the zone for the authority section of the
+// answer to the question, none for the supplementary zones and the NS answers of
+// the zone itself
+func (d *DNSServer) authorityNS(q dns.Question) []dns.RR {
+	zone := d.Domain
+	if extra := d.extraZone(q.Name); extra != "" {
+		zone = extra
+	}
+	if d.supplementaryZone(q.Name) != nil || (q.Qtype == dns.TypeNS && strings.EqualFold(q.Name, zone)) {
+		return nil
+	}
+	var rrs []dns.RR
+	if records, ok := d.Domains.Get(zone); ok {
+		for _, rr := range records.Records {
+			if rr.Header().Rrtype == dns.TypeNS {
+				rrs = append(rrs, rr)
+			}
+		}
+	}
+	return rrs
+}
+
+// secure signs the answer, unless it's for a supplementary zone, which has keys of
+// its own if any, or for a further zone, as the keys are those of the primary zone
+func (d *DNSServer) secure(m *dns.Msg) {
+	if len(m.Question) == 0 || d.supplementaryZone(m.Question[0].Name) != nil || d.extraZone(m.Question[0].Name) != "" {
+		return
+	}
+	d.DNSSEC.Secure(m, d.zoneSOA())
 }
 
 func (d *DNSServer) readQuery(m *dns.Msg) {
 	var authoritative = false
+	soa := d.zoneSOA()
 	for _, que := range m.Question {
+		if zone := d.supplementaryZone(que.Name); zone != nil {
+			soa = zone
+		} else if zone := d.extraZone(que.Name); zone != "" && d.soaOf(zone) != nil {
+			soa = d.soaOf(zone)
+		}
 		if rr, rc, auth, err := d.answer(que); err == nil {
 			if auth {
 				authoritative = auth
@@ -124,16 +529,23 @@ func (d *DNSServer) readQuery(m *dns.Msg) {
 	}
 	m.MsgHdr.Authoritative = authoritative
 	if authoritative {
-		if m.MsgHdr.Rcode == dns.RcodeNameError {
-			m.Ns = append(m.Ns, d.SOA)
+		// Names that don't exist and names without records of the type get the
+		// SOA record, for the resolvers to know how long to cache the answer
+		if (m.MsgHdr.Rcode == dns.RcodeNameError || (m.MsgHdr.Rcode == dns.RcodeSuccess && len(m.Answer) == 0)) && soa != nil {
+			m.Ns = append(m.Ns, negativeSOA(soa))
+		} else if d.AuthorityNS && len(m.Answer) > 0 {
+			m.Ns = append(m.Ns, d.authorityNS(m.Question[0])...)
 		}
 	}
+	if len(d.Additional) > 0 {
+		d.addAdditional(m)
+	}
 }
 
 func (d *DNSServer) getRecord(q dns.Question) ([]dns.RR, error) {
 	var rr []dns.RR
 	var cnames []dns.RR
-	domain, ok := d.Domains[strings.ToLower(q.Name)]
+	domain, ok := d.lookupStatic(q.Name)
 	if !ok {
 		return rr, fmt.Errorf("No records for domain %s", q.Name)
 	}
@@ -156,8 +568,22 @@ func (d *DNSServer) answeringForDomain(name string) bool {
 	if d.Domain == strings.ToLower(name) {
 		return true
 	}
-	_, ok := d.Domains[strings.ToLower(name)]
-	return ok
+	_, ok := d.lookupStatic(name)
+	return ok || d.APIRecords.serves(name)
+}
+
+// lookupStatic returns the static records of the name, or those synthesized
+// from a static wildcard. The names of the registrations exist, so the wildcard
+// of the zone apex never covers them or the names below them.
+func (d *DNSServer) lookupStatic(name string) (Records, bool) {
+	if records, ok := d.Domains.Get(name); ok {
+		return records, true
+	}
+	records, encloser, ok := d.Domains.Wildcard(name)
+	if !ok || encloser == d.Domain || encloser == d.extraZone(encloser) {
+		return Records{}, false
+	}
+	return records, true
 }
 
 func (d *DNSServer) isAuthoritative(q dns.Question) bool {
@@ -182,7 +608,7 @@ func (d *DNSServer) isOwnChallenge(name string) bool {
 			if !strings.HasSuffix(domain, ".") {
 				domain = domain + "."
 			}
-			if domain == d.Domain {
+			if domain == d.Domain || d.OwnChallenges.serves(domain) {
 				return true
 			}
 		}
@@ -191,6 +617,16 @@ func (d *DNSServer) isOwnChallenge(name string) bool {
 }
 
 func (d *DNSServer) answer(q dns.Question) ([]dns.RR, int, bool, error) {
+	if d.supplementaryZone(q.Name) != nil {
+		return d.answerZoneFile(q)
+	}
+	if owner := d.wildcardOwner(q.Name); owner != "" {
+		return d.answerWildcard(q, owner)
+	}
+	if !d.inRegistrationZone(q.Name) {
+		dnsLog.WithFields(log.Fields{"qtype": dns.TypeToString[q.Qtype], "domain": q.Name}).Debug("Answering question for a registration of another zone")
+		return nil, dns.RcodeNameError, d.isAuthoritative(q), nil
+	}
 	var rcode int
 	var err error
 	var authoritative = d.isAuthoritative(q)
@@ -198,6 +634,11 @@ func (d *DNSServer) answer(q dns.Question) ([]dns.RR, int, bool, error) {
 		rcode = dns.RcodeNameError
 	}
 	r, _ := d.getRecord(q)
+	if cname, err := d.answerCNAME(q); err == nil && len(cname) > 0 {
+		// The alias is the only record of the subdomain, resolvers follow it for any type
+		dnsLog.WithFields(log.Fields{"qtype": dns.TypeToString[q.Qtype], "domain": q.Name}).Debug("Answering question for aliased domain")
+		return append(r, cname...), dns.RcodeSuccess, authoritative, nil
+	}
 	switch q.Qtype {
 	case dns.TypeTXT:
 		var txtRRs []dns.RR
@@ -216,6 +657,7 @@ func (d *DNSServer) answer(q dns.Question) ([]dns.RR, int, bool, error) {
 		if err == nil {
 			r = append(r, aRRs...)
 		}
+		r = append(r, d.APIRecords.Records(q)...)
 		break
 	case dns.TypeAAAA:
 		var aaaaRRs []dns.RR
@@ -223,48 +665,108 @@ func (d *DNSServer) answer(q dns.Question) ([]dns.RR, int, bool, error) {
 		if err == nil {
 			r = append(r, aaaaRRs...)
 		}
+		r = append(r, d.APIRecords.Records(q)...)
+		break
+	case dns.TypeMX:
+		var mxRRs []dns.RR
+		mxRRs, err = d.answerMX(q)
+		if err == nil {
+			r = append(r, mxRRs...)
+		}
+		break
+	case dns.TypeSRV:
+		var srvRRs []dns.RR
+		srvRRs, err = d.answerSRV(q)
+		if err == nil {
+			r = append(r, srvRRs...)
+		}
+		break
+	case dns.TypeCAA:
+		var caaRRs []dns.RR
+		caaRRs, err = d.answerCAA(q)
+		if err == nil {
+			r = append(r, caaRRs...)
+		}
+		break
+	case dns.TypeDNSKEY:
+		r = append(r, d.DNSSEC.DNSKEYs(q)...)
+		break
+	case dns.TypePTR:
+		var ptrRRs []dns.RR
+		ptrRRs, err = d.answerPTR(q)
+		if err == nil {
+			r = append(r, ptrRRs...)
+		}
 		break
 	default:
+		if rtype, ok := genericQtype(q.Qtype); ok {
+			var genericRRs []dns.RR
+			genericRRs, err = d.answerGeneric(q, rtype)
+			if err == nil {
+				r = append(r, genericRRs...)
+			}
+		}
 	}
 	if len(r) > 0 || d.countRecords(q) > 0 {
 		// Make sure that we return NOERROR if there were dynamic records for the domain
 		rcode = dns.RcodeSuccess
 	}
-	log.WithFields(log.Fields{"qtype": dns.TypeToString[q.Qtype], "domain": q.Name, "rcode": dns.RcodeToString[rcode]}).Debug("Answering question for domain")
+	dnsLog.WithFields(log.Fields{"qtype": dns.TypeToString[q.Qtype], "domain": q.Name, "rcode": dns.RcodeToString[rcode]}).Debug("Answering question for domain")
 	return r, rcode, authoritative, nil
 }
 
 func (d *DNSServer) answerTXT(q dns.Question) ([]dns.RR, error) {
 	var ra []dns.RR
+	if d.strictTXT(q.Name) && !d.isRegistrationName(strings.ToLower(q.Name)) {
+		// The values are only served for the challenges of the registered name
+		return ra, nil
+	}
 	subdomain := sanitizeDomainQuestion(q.Name)
 	atxt, err := d.DB.GetTXTForDomain(subdomain)
 	if err != nil {
-		log.WithFields(log.Fields{"error": err.Error()}).Debug("Error while trying to get record")
+		dnsLog.WithFields(log.Fields{"error": err.Error()}).Debug("Error while trying to get record")
 		return ra, err
 	}
-	for _, v := range atxt {
-		if len(v) > 0 {
-			r := new(dns.TXT)
-			r.Hdr = dns.RR_Header{Name: q.Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 1}
-			r.Txt = append(r.Txt, v)
-			ra = append(ra, r)
-		}
+	ttl := d.recordTTL(subdomain, "txt")
+	for _, v := range servedTXT(atxt) {
+		r := new(dns.TXT)
+		r.Hdr = dns.RR_Header{Name: q.Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: ttl}
+		r.Txt = append(r.Txt, v)
+		ra = append(ra, r)
 	}
 	return ra, nil
 }
 
+// servedTXT returns the TXT values answered for the values of the TXT slots. Empty
+// slots are left out, or with empty_txt = "serve" answered with a single empty
+// value, as an RRset can't hold the same record twice.
+func servedTXT(slots []string) []string {
+	var served []string
+	empty := false
+	for _, v := range slots {
+		if v != "" {
+			served = append(served, v)
+		} else if Config.General.EmptyTXT == "serve" && !empty {
+			served = append(served, v)
+			empty = true
+		}
+	}
+	return served
+}
+
 func (d *DNSServer) answerA(q dns.Question) ([]dns.RR, error) {
 	var ra []dns.RR
 	subdomain := sanitizeDomainQuestion(q.Name)
 	aip, err := d.DB.GetAForDomain(subdomain)
 	if err != nil {
-		log.WithFields(log.Fields{"error": err.Error()}).Debug("Error while trying to get record")
+		dnsLog.WithFields(log.Fields{"error": err.Error()}).Debug("Error while trying to get record")
 		return ra, err
 	}
+	ttl := d.recordTTL(subdomain, "a")
 	for _, v := range aip {
 		if len(v) > 0 {
 			r := new(dns.A)
-			r.Hdr = dns.RR_Header{Name: q.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 1}
+			r.Hdr = dns.RR_Header{Name: q.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: ttl}
 			r.A = v
 			ra = append(ra, r)
 		}
@@ -277,13 +779,14 @@ func (d *DNSServer) answerAAAA(q dns.Question) ([]dns.RR, error) {
 	subdomain := sanitizeDomainQuestion(q.Name)
 	aip6, err := d.DB.GetAAAAForDomain(subdomain)
 	if err != nil {
-		log.WithFields(log.Fields{"error": err.Error()}).Debug("Error while trying to get record")
+		dnsLog.WithFields(log.Fields{"error": err.Error()}).Debug("Error while trying to get record")
 		return ra, err
 	}
+	ttl := d.recordTTL(subdomain, "aaaa")
 	for _, v := range aip6 {
 		if len(v) > 0 {
 			r := new(dns.AAAA)
-			r.Hdr = dns.RR_Header{Name: q.Name, Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: 1}
+			r.Hdr = dns.RR_Header{Name: q.Name, Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: ttl}
 			r.AAAA = v
 			ra = append(ra, r)
 		}
@@ -291,20 +794,144 @@ func (d *DNSServer) answerAAAA(q dns.Question) ([]dns.RR, error) {
 	return ra, nil
 }
 
+func (d *DNSServer) answerCNAME(q dns.Question) ([]dns.RR, error) {
+	if d.isOwnChallenge(q.Name) {
+		return nil, nil
+	}
+	subdomain := sanitizeDomainQuestion(q.Name)
+	target, err := d.DB.GetCNAMEForDomain(subdomain)
+	if err != nil {
+		dnsLog.WithFields(log.Fields{"error": err.Error()}).Debug("Error while trying to get record")
+		return nil, err
+	}
+	if target == "" {
+		return nil, nil
+	}
+	ttl := d.recordTTL(subdomain, "cname")
+	r := new(dns.CNAME)
+	r.Hdr = dns.RR_Header{Name: q.Name, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: ttl}
+	r.Target = target
+	return []dns.RR{r}, nil
+}
+
+func (d *DNSServer) answerMX(q dns.Question) ([]dns.RR, error) {
+	var ra []dns.RR
+	subdomain := sanitizeDomainQuestion(q.Name)
+	mxs, err := d.DB.GetMXForDomain(subdomain)
+	if err != nil {
+		dnsLog.WithFields(log.Fields{"error": err.Error()}).Debug("Error while trying to get record")
+		return ra, err
+	}
+	ttl := d.recordTTL(subdomain, "mx")
+	for _, v := range mxs {
+		r := new(dns.MX)
+		r.Hdr = dns.RR_Header{Name: q.Name, Rrtype: dns.TypeMX, Class: dns.ClassINET, Ttl: ttl}
+		r.Preference = uint16(v.Priority)
+		r.Mx = v.Target
+		ra = append(ra, r)
+	}
+	return ra, nil
+}
+
+func (d *DNSServer) answerSRV(q dns.Question) ([]dns.RR, error) {
+	var ra []dns.RR
+	subdomain := sanitizeDomainQuestion(q.Name)
+	srvs, err := d.DB.GetSRVForDomain(subdomain)
+	if err != nil {
+		dnsLog.WithFields(log.Fields{"error": err.Error()}).Debug("Error while trying to get record")
+		return ra, err
+	}
+	ttl := d.recordTTL(subdomain, "srv")
+	for _, v := range srvs {
+		r := new(dns.SRV)
+		r.Hdr = dns.RR_Header{Name: q.Name, Rrtype: dns.TypeSRV, Class: dns.ClassINET, Ttl: ttl}
+		r.Priority = uint16(v.Priority)
+		r.Weight = uint16(v.Weight)
+		r.Port = uint16(v.Port)
+		r.Target = v.Target
+		ra = append(ra, r)
+	}
+	return ra, nil
+}
+
+func (d *DNSServer) answerCAA(q dns.Question) ([]dns.RR, error) {
+	var ra []dns.RR
+	subdomain := sanitizeDomainQuestion(q.Name)
+	caas, err := d.DB.GetCAAForDomain(subdomain)
+	if err != nil {
+		dnsLog.WithFields(log.Fields{"error": err.Error()}).Debug("Error while trying to get record")
+		return ra, err
+	}
+	ttl := d.recordTTL(subdomain, "caa")
+	for _, v := range caas {
+		r := new(dns.CAA)
+		r.Hdr = dns.RR_Header{Name: q.Name, Rrtype: dns.TypeCAA, Class: dns.ClassINET, Ttl: ttl}
+		r.Flag = uint8(v.Flags)
+		r.Tag = v.Tag
+		r.Value = v.Value
+		ra = append(ra, r)
+	}
+	return ra, nil
+}
+
+// answerGeneric answers with the records of the type stored in the generic rr table
+func (d *DNSServer) answerGeneric(q dns.Question, rtype string) ([]dns.RR, error) {
+	var ra []dns.RR
+	subdomain := sanitizeDomainQuestion(q.Name)
+	records, err := d.DB.GetRecordsForDomain(subdomain)
+	if err != nil {
+		dnsLog.WithFields(log.Fields{"error": err.Error()}).Debug("Error while trying to get record")
+		return ra, err
+	}
+	for _, v := range records {
+		if v.Type != rtype {
+			continue
+		}
+		r, err := newGenericRR(q.Name, v)
+		if err != nil {
+			dnsLog.WithFields(log.Fields{"error": err.Error(), "type": v.Type}).Error("Invalid stored record")
+			continue
+		}
+		ra = append(ra, r)
+	}
+	return ra, nil
+}
+
+// recordTTL returns the TTL the records of the type of the subdomain are served with
+func (d *DNSServer) recordTTL(subdomain string, rtype string) uint32 {
+	ttls, err := d.DB.GetTTLForDomain(subdomain)
+	if err != nil {
+		dnsLog.WithFields(log.Fields{"error": err.Error()}).Debug("Error while trying to get the TTL")
+	}
+	if ttl, ok := ttls[rtype]; ok {
+		return uint32(ttl)
+	}
+	return uint32(minTTL())
+}
+
 func (d *DNSServer) countRecords(q dns.Question) (count int) {
 	subdomain := sanitizeDomainQuestion(q.Name)
 	var err error
 	count, err = d.DB.CountRecords(subdomain)
 	if err != nil {
-		log.WithFields(log.Fields{"error": err.Error()}).Debug("Error while trying to count records")
+		dnsLog.WithFields(log.Fields{"error": err.Error()}).Debug("Error while trying to count records")
 	}
 	return
 }
 
-// answerOwnChallenge answers to ACME challenge for acme-dns own certificate
+// answerOwnChallenge answers to ACME challenge for acme-dns own certificate, with
+// the key authorizations of all the names of the API certificates being validated
 func (d *DNSServer) answerOwnChallenge(q dns.Question) ([]dns.RR, error) {
-	r := new(dns.TXT)
-	r.Hdr = dns.RR_Header{Name: q.Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 1}
-	r.Txt = append(r.Txt, d.PersonalKeyAuth)
-	return []dns.RR{r}, nil
+	keyAuths := d.OwnChallenges.keyAuthorizations()
+	if len(keyAuths) == 0 {
+		keyAuths = []string{""}
+	}
+	var rrs []dns.RR
+	for _, keyAuth := range keyAuths {
+		r := new(dns.TXT)
+		r.Hdr = dns.RR_Header{Name: q.Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 1}
+		r.Txt = append(r.Txt, keyAuth)
+		rrs = append(rrs, r)
+	}
+	return rrs, nil
 }
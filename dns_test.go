@@ -1,11 +1,24 @@
 package main
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"database/sql"
 	"database/sql/driver"
+	"encoding/pem"
 	"errors"
 	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/erikstmartin/go-testdb"
 	"github.com/miekg/dns"
@@ -60,10 +73,10 @@ func TestQuestionDBError(t *testing.T) {
 	if err != nil {
 		t.Errorf("Got error: %v", err)
 	}
-	oldDb := DB.GetBackend()
+	oldDb := DB.(*acmedb).GetBackend()
 
-	DB.SetBackend(tdb)
-	defer DB.SetBackend(oldDb)
+	DB.(*acmedb).SetBackend(tdb)
+	defer DB.(*acmedb).SetBackend(oldDb)
 
 	q := dns.Question{Name: dns.Fqdn("whatever.tld"), Qtype: dns.TypeTXT, Qclass: dns.ClassINET}
 	_, err = dnsserver.answerTXT(q)
@@ -199,13 +212,13 @@ func TestResolveTXT(t *testing.T) {
 	resolv := resolver{server: "127.0.0.1:15353"}
 	validTXT := "______________valid_response_______________"
 
-	atxt, err := DB.Register(cidrslice{})
+	atxt, err := DB.Register(cidrslice{}, registrationOrigin{}, ACMETxtPost{})
 	if err != nil {
 		t.Errorf("Could not initiate db record: [%v]", err)
 		return
 	}
 	atxt.Value = validTXT
-	err = DB.Update(atxt.ACMETxtPost)
+	_, err = DB.Update(atxt.ACMETxtPost)
 	if err != nil {
 		t.Errorf("Could not update db record: [%v]", err)
 		return
@@ -256,6 +269,187 @@ func TestResolveTXT(t *testing.T) {
 	}
 }
 
+func TestCountRecordsEmptyTXT(t *testing.T) {
+	defer func(mode string) { Config.General.EmptyTXT = mode }(Config.General.EmptyTXT)
+	// The TXT slots of a new registration are empty
+	reg, err := DB.Register(cidrslice{}, registrationOrigin{}, ACMETxtPost{})
+	if err != nil {
+		t.Fatalf("Could not register: %v", err)
+	}
+	for i, test := range []struct {
+		mode     string
+		expected int
+	}{
+		{"omit", 0},
+		{"serve", 1},
+	} {
+		Config.General.EmptyTXT = test.mode
+		count, err := DB.(*acmedb).countRecords(reg.Subdomain)
+		if err != nil {
+			t.Fatalf("Test %d: could not count the records: %v", i, err)
+		}
+		if count != test.expected {
+			t.Errorf("Test %d: expected %d records with empty_txt = %q, got %d", i, test.expected, test.mode, count)
+		}
+	}
+}
+
+func TestServedTXT(t *testing.T) {
+	defer func(mode string) { Config.General.EmptyTXT = mode }(Config.General.EmptyTXT)
+	for i, test := range []struct {
+		mode     string
+		slots    []string
+		expected []string
+	}{
+		{"omit", []string{"", "value", ""}, []string{"value"}},
+		{"omit", []string{"", ""}, nil},
+		{"serve", []string{"", "value", ""}, []string{"", "value"}},
+		{"serve", []string{"", ""}, []string{""}},
+	} {
+		Config.General.EmptyTXT = test.mode
+		if got := servedTXT(test.slots); fmt.Sprint(got) != fmt.Sprint(test.expected) || len(got) != len(test.expected) {
+			t.Errorf("Test %d: expected %q, got %q", i, test.expected, got)
+		}
+	}
+}
+
+func TestResolveAliasedSubdomain(t *testing.T) {
+	resolv := resolver{server: "127.0.0.1:15353"}
+	reg, err := DB.Register(cidrslice{}, registrationOrigin{}, ACMETxtPost{AValues: []string{"192.0.2.1"}})
+	if err != nil {
+		t.Fatalf("Could not register: %v", err)
+	}
+	if _, err = DB.Update(ACMETxtPost{Subdomain: reg.Subdomain, Value: "______________valid_response_______________", CNAME: "host.example.net."}); err != nil {
+		t.Fatalf("Could not update: %v", err)
+	}
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeTXT, dns.TypeCNAME} {
+		answer, err := resolv.lookup(reg.Subdomain+".auth.example.org", qtype)
+		if err != nil {
+			t.Fatalf("Expected an answer for %s, got %v", dns.TypeToString[qtype], err)
+		}
+		if len(answer.Answer) != 1 || answer.Answer[0].(*dns.CNAME).Target != "host.example.net." {
+			t.Errorf("Expected only the CNAME record for %s, got %v", dns.TypeToString[qtype], answer.Answer)
+		}
+	}
+
+	// Addresses replace the alias
+	if _, err = DB.Update(ACMETxtPost{Subdomain: reg.Subdomain, AValues: []string{"192.0.2.2"}}); err != nil {
+		t.Fatalf("Could not update: %v", err)
+	}
+	answer, err := resolv.lookup(reg.Subdomain+".auth.example.org", dns.TypeA)
+	if err != nil || len(answer.Answer) != 1 || answer.Answer[0].(*dns.A).A.String() != "192.0.2.2" {
+		t.Errorf("Expected the A record, got %v, %v", answer, err)
+	}
+}
+
+func TestResolveMX(t *testing.T) {
+	resolv := resolver{server: "127.0.0.1:15353"}
+	reg, err := DB.Register(cidrslice{}, registrationOrigin{}, ACMETxtPost{MXValues: []mxRecord{{20, "backup.example.net."}, {10, "mail.example.net."}}})
+	if err != nil {
+		t.Fatalf("Could not register: %v", err)
+	}
+	answer, err := resolv.lookup(reg.Subdomain+".auth.example.org", dns.TypeMX)
+	if err != nil {
+		t.Fatalf("Expected an answer, got %v", err)
+	}
+	if len(answer.Answer) != 2 {
+		t.Fatalf("Expected 2 MX records, got %v", answer.Answer)
+	}
+	for i, expected := range []mxRecord{{10, "mail.example.net."}, {20, "backup.example.net."}} {
+		mx, ok := answer.Answer[i].(*dns.MX)
+		if !ok || int(mx.Preference) != expected.Priority || mx.Mx != expected.Target {
+			t.Errorf("Expected %v, got %v", expected, answer.Answer[i])
+		}
+	}
+	// The subdomain exists for the other types
+	answer, err = resolv.lookup(reg.Subdomain+".auth.example.org", dns.TypeA)
+	if err != nil || answer.Rcode != dns.RcodeSuccess || len(answer.Answer) != 0 {
+		t.Errorf("Expected an empty NOERROR answer, got %v, %v", answer, err)
+	}
+}
+
+func TestResolveSRV(t *testing.T) {
+	resolv := resolver{server: "127.0.0.1:15353"}
+	reg, err := DB.Register(cidrslice{}, registrationOrigin{}, ACMETxtPost{SRVValues: []srvRecord{{10, 5, 5060, "sip.example.net."}}})
+	if err != nil {
+		t.Fatalf("Could not register: %v", err)
+	}
+	answer, err := resolv.lookup(reg.Subdomain+".auth.example.org", dns.TypeSRV)
+	if err != nil {
+		t.Fatalf("Expected an answer, got %v", err)
+	}
+	if len(answer.Answer) != 1 {
+		t.Fatalf("Expected a SRV record, got %v", answer.Answer)
+	}
+	srv, ok := answer.Answer[0].(*dns.SRV)
+	if !ok || srv.Priority != 10 || srv.Weight != 5 || srv.Port != 5060 || srv.Target != "sip.example.net." {
+		t.Errorf("Unexpected SRV record %v", answer.Answer[0])
+	}
+}
+
+func TestResolveCAA(t *testing.T) {
+	resolv := resolver{server: "127.0.0.1:15353"}
+	reg, err := DB.Register(cidrslice{}, registrationOrigin{}, ACMETxtPost{CAAValues: []caaRecord{{128, "issue", "letsencrypt.org"}}})
+	if err != nil {
+		t.Fatalf("Could not register: %v", err)
+	}
+	answer, err := resolv.lookup(reg.Subdomain+".auth.example.org", dns.TypeCAA)
+	if err != nil {
+		t.Fatalf("Expected an answer, got %v", err)
+	}
+	if len(answer.Answer) != 1 {
+		t.Fatalf("Expected a CAA record, got %v", answer.Answer)
+	}
+	caa, ok := answer.Answer[0].(*dns.CAA)
+	if !ok || caa.Flag != 128 || caa.Tag != "issue" || caa.Value != "letsencrypt.org" {
+		t.Errorf("Unexpected CAA record %v", answer.Answer[0])
+	}
+}
+
+func TestResolveGeneric(t *testing.T) {
+	resolv := resolver{server: "127.0.0.1:15353"}
+	reg, err := DB.Register(cidrslice{}, registrationOrigin{}, ACMETxtPost{Records: []genericRecord{{"TLSA", "3 1 1 abababababababababababababababababababababababababababababababab", 300}}})
+	if err != nil {
+		t.Fatalf("Could not register: %v", err)
+	}
+	answer, err := resolv.lookup(reg.Subdomain+".auth.example.org", dns.TypeTLSA)
+	if err != nil {
+		t.Fatalf("Expected an answer, got %v", err)
+	}
+	if len(answer.Answer) != 1 {
+		t.Fatalf("Expected a TLSA record, got %v", answer.Answer)
+	}
+	tlsa, ok := answer.Answer[0].(*dns.TLSA)
+	if !ok || tlsa.Usage != 3 || tlsa.Selector != 1 || tlsa.MatchingType != 1 || tlsa.Certificate != "abababababababababababababababababababababababababababababababab" || tlsa.Hdr.Ttl != 300 {
+		t.Errorf("Unexpected TLSA record %v", answer.Answer[0])
+	}
+	// Other generic types of the subdomain answer NOERROR without records
+	answer, err = resolv.lookup(reg.Subdomain+".auth.example.org", dns.TypeSSHFP)
+	if err != nil || answer.Rcode != dns.RcodeSuccess || len(answer.Answer) != 0 {
+		t.Errorf("Expected an empty NOERROR answer, got %v, %v", answer, err)
+	}
+}
+
+func TestResolveWithTTL(t *testing.T) {
+	resolv := resolver{server: "127.0.0.1:15353"}
+	reg, err := DB.Register(cidrslice{}, registrationOrigin{}, ACMETxtPost{AValues: []string{"192.0.2.1"}, AAAAValues: []string{"2001:db8::1"}})
+	if err != nil {
+		t.Fatalf("Could not register: %v", err)
+	}
+	if _, err = DB.Update(ACMETxtPost{Subdomain: reg.Subdomain, AValues: []string{"192.0.2.1"}, TTL: 600}); err != nil {
+		t.Fatalf("Could not update: %v", err)
+	}
+	for qtype, ttl := range map[uint16]uint32{dns.TypeA: 600, dns.TypeAAAA: 1} {
+		answer, err := resolv.lookup(reg.Subdomain+".auth.example.org", qtype)
+		if err != nil || len(answer.Answer) != 1 {
+			t.Fatalf("Expected a %s record, got %v, %v", dns.TypeToString[qtype], answer, err)
+		}
+		if answer.Answer[0].Header().Ttl != ttl {
+			t.Errorf("Expected the %s record with TTL %d, got %d", dns.TypeToString[qtype], ttl, answer.Answer[0].Header().Ttl)
+		}
+	}
+}
+
 func TestCaseInsensitiveResolveA(t *testing.T) {
 	resolv := resolver{server: "127.0.0.1:15353"}
 	answer, err := resolv.lookup("aUtH.eXAmpLe.org", dns.TypeA)
@@ -279,3 +473,354 @@ func TestCaseInsensitiveResolveSOA(t *testing.T) {
 		t.Error("No SOA answer for DNS query")
 	}
 }
+
+// recordingWriter is a dns.ResponseWriter storing the written message
+type recordingWriter struct {
+	dns.ResponseWriter
+	local  net.Addr
+	remote net.Addr
+	msg    *dns.Msg
+}
+
+func (w *recordingWriter) LocalAddr() net.Addr {
+	return w.local
+}
+
+func (w *recordingWriter) RemoteAddr() net.Addr {
+	return w.remote
+}
+
+func (w *recordingWriter) WriteMsg(m *dns.Msg) error {
+	w.msg = m
+	return nil
+}
+
+func TestTruncation(t *testing.T) {
+	reg, err := DB.Register(cidrslice{}, registrationOrigin{}, ACMETxtPost{})
+	if err != nil {
+		t.Fatalf("Registration failed, got error [%v]", err)
+	}
+	for i := 0; i < 255; i++ {
+		reg.AValues = append(reg.AValues, fmt.Sprintf("192.0.2.%d", i))
+	}
+	if _, err = DB.Update(reg.ACMETxtPost); err != nil {
+		t.Fatalf("DB Update failed, got error: [%v]", err)
+	}
+	server := NewDNSServer(DB, "", "udp", "auth.example.org")
+	server.ParseRecords(Config)
+	udp := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53}
+	tcp := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53}
+	// header, the question and the OPT record take a fixed amount of space,
+	// every compressed A record takes 16 bytes
+	const header = 12
+	question := 1 + len(reg.Subdomain) + len(".auth.example.org.") + 4
+	const opt = 11
+
+	for i, test := range []struct {
+		local      net.Addr
+		ednsSize   uint16
+		maxUDPSize int
+		answers    int
+		truncated  bool
+	}{
+		// A partial RRset is never sent, TC tells the client to retry over TCP
+		{udp, 0, 1232, 0, true},
+		{udp, 512, 1232, 0, true},
+		{udp, 4096, 0, 0, true},
+		{udp, 4096, 1232, 0, true},
+		{udp, 1024, 4096, 0, true},
+		{udp, 4096, 4096, 0, true},
+		{udp, 8192, 8192, 255, false},
+		{tcp, 0, 1232, 255, false},
+		{tcp, 4096, 512, 255, false},
+	} {
+		server.MaxUDPSize = test.maxUDPSize
+		req := new(dns.Msg)
+		req.SetQuestion(reg.Subdomain+".auth.example.org.", dns.TypeA)
+		if test.ednsSize > 0 {
+			req.SetEdns0(test.ednsSize, false)
+		}
+		w := &recordingWriter{local: test.local}
+		server.handleRequest(w, req)
+		if w.msg == nil {
+			t.Fatalf("Test %d: No response written", i)
+		}
+		if len(w.msg.Answer) != test.answers {
+			t.Errorf("Test %d: Expected %d answers, got %d", i, test.answers, len(w.msg.Answer))
+		}
+		if w.msg.Truncated != test.truncated {
+			t.Errorf("Test %d: Expected TC to be %t", i, test.truncated)
+		}
+		if !w.msg.Compress {
+			t.Errorf("Test %d: Expected response to be compressed", i)
+		}
+		packed, err := w.msg.Pack()
+		if err != nil {
+			t.Fatalf("Test %d: Could not pack response [%v]", i, err)
+		}
+		expected := header + question + 16*len(w.msg.Answer)
+		if test.ednsSize > 0 {
+			expected += opt
+		}
+		if len(packed) != expected {
+			t.Errorf("Test %d: Expected compressed response of %d bytes, got %d", i, expected, len(packed))
+		}
+	}
+}
+
+func TestDNSProtocols(t *testing.T) {
+	for i, test := range []struct {
+		proto    string
+		expected []string
+	}{
+		{"both", []string{"udp", "tcp"}},
+		{"both4", []string{"udp4", "tcp4"}},
+		{"both6", []string{"udp6", "tcp6"}},
+		{"udp", []string{"udp"}},
+		{"tcp6", []string{"tcp6"}},
+	} {
+		if got := dnsProtocols(test.proto); fmt.Sprint(got) != fmt.Sprint(test.expected) {
+			t.Errorf("Test %d: Expected %v, got %v", i, test.expected, got)
+		}
+	}
+}
+
+func TestAdditionalListen(t *testing.T) {
+	config := Config
+	config.General.Listen = "127.0.0.1:15355"
+	config.General.AdditionalListen = []string{"127.0.0.1:15356"}
+	config.General.Proto = "both"
+	config.General.Domain = "auth.example.org"
+	config.General.StaticRecords = []string{"auth.example.org. A 192.168.1.100"}
+	servers := newDNSServers(DB, config)
+	if len(servers) != 4 {
+		t.Fatalf("Expected a server for each address and protocol, got %d", len(servers))
+	}
+	var wg sync.WaitGroup
+	for _, server := range servers {
+		wg.Add(1)
+		server.Server.NotifyStartedFunc = wg.Done
+		go server.Start(make(chan error, 1))
+	}
+	wg.Wait()
+	defer func() {
+		for _, server := range servers {
+			_ = server.Server.Shutdown()
+		}
+	}()
+	for _, addr := range []string{"127.0.0.1:15355", "127.0.0.1:15356"} {
+		r := resolver{server: addr}
+		answer, err := r.lookup("auth.example.org", dns.TypeA)
+		if err != nil {
+			t.Errorf("Lookup from %s failed: %v", addr, err)
+			continue
+		}
+		if len(answer.Answer) == 0 {
+			t.Errorf("Expected an answer from %s", addr)
+		}
+	}
+}
+
+func TestZoneNS(t *testing.T) {
+	config := Config
+	config.General.Domain = "auth.example.org"
+	config.General.Nsname = "ns1.auth.example.org"
+	config.General.StaticRecords = []string{
+		"auth.example.org. A 198.51.100.1",
+		"ns1.auth.example.org. A 198.51.100.1",
+		"ns2.auth.example.org. A 198.51.100.2",
+		"auth.example.org. NS ns1.auth.example.org.",
+	}
+	for i, test := range []struct {
+		nameservers []string
+		expected    []string
+	}{
+		// The NS records of the static records aren't repeated
+		{nil, []string{"ns1.auth.example.org."}},
+		{[]string{"ns1.auth.example.org", "NS2.auth.example.org."}, []string{"ns1.auth.example.org.", "ns2.auth.example.org."}},
+	} {
+		config.General.Nameservers = test.nameservers
+		server := NewDNSServer(DB, "", "udp", config.General.Domain)
+		server.ParseRecords(config)
+		m := new(dns.Msg)
+		m.SetQuestion("auth.example.org.", dns.TypeNS)
+		server.readQuery(m)
+		var ns []string
+		for _, rr := range m.Answer {
+			ns = append(ns, rr.(*dns.NS).Ns)
+		}
+		if !sameRecords(ns, test.expected) {
+			t.Errorf("Test %d: Expected the name servers %v, got %v", i, test.expected, ns)
+		}
+	}
+}
+
+func TestAuthorityNS(t *testing.T) {
+	config := Config
+	config.General.Domain = "auth.example.org"
+	config.General.Nsname = "ns1.auth.example.org"
+	config.General.Nameservers = []string{"ns1.auth.example.org", "ns2.auth.example.org"}
+	config.General.StaticRecords = []string{
+		"auth.example.org. A 198.51.100.1",
+		"ns1.auth.example.org. A 198.51.100.1",
+		"ns2.auth.example.org. A 198.51.100.2",
+	}
+	server := NewDNSServer(DB, "", "udp", config.General.Domain)
+	server.ParseRecords(config)
+	server.AuthorityNS = true
+	server.Additional, _ = parseAdditional([]string{"ns"})
+
+	for i, test := range []struct {
+		name      string
+		qtype     uint16
+		authority int
+		extra     int
+	}{
+		{"auth.example.org.", dns.TypeA, 2, 2},
+		// The NS answer of the zone has the name servers already
+		{"auth.example.org.", dns.TypeNS, 0, 2},
+		// Names that don't exist get the SOA record
+		{"nonexistent.auth.example.org.", dns.TypeA, 1, 0},
+	} {
+		m := new(dns.Msg)
+		m.SetQuestion(test.name, test.qtype)
+		server.readQuery(m)
+		if len(m.Ns) != test.authority || len(m.Extra) != test.extra {
+			t.Errorf("Test %d: Expected %d authority and %d additional records, got %v and %v", i, test.authority, test.extra, m.Ns, m.Extra)
+		}
+	}
+}
+
+// writeTestCertificate writes a self-signed certificate for the name and its key
+// to PEM files, and returns their paths with the pool trusting the certificate
+func writeTestCertificate(t *testing.T, name string) (string, string, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Could not generate a key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Could not create a certificate: %v", err)
+	}
+	keyDER, _ := x509.MarshalECPrivateKey(key)
+	certFile := filepath.Join(t.TempDir(), "fullchain.pem")
+	keyFile := filepath.Join(t.TempDir(), "privkey.pem")
+	_ = os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600)
+	_ = os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600)
+	cert, _ := x509.ParseCertificate(der)
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return certFile, keyFile, pool
+}
+
+func TestDNSOverTLS(t *testing.T) {
+	config := Config
+	config.General.Listen = "127.0.0.1:15355"
+	config.General.AdditionalListen = nil
+	config.General.TLSListen = "127.0.0.1:15359"
+	config.General.Proto = "udp"
+	config.General.Domain = "auth.example.org"
+	config.General.StaticRecords = []string{"auth.example.org. A 192.168.1.100"}
+	config.API.TLS = "cert"
+	config.API.TLSCertFullchain, config.API.TLSCertPrivkey, _ = writeTestCertificate(t, "auth.example.org")
+	_, _, pool := writeTestCertificate(t, "auth.example.org")
+	if _, err := prepareConfig(config); err != nil {
+		t.Fatalf("Expected the configuration to be valid, got %v", err)
+	}
+
+	servers := newDNSServers(DB, config)
+	if len(servers) != 2 || servers[1].Server.Net != "tcp-tls" || servers[1].Server.Addr != "127.0.0.1:15359" {
+		t.Fatalf("Expected the DNS-over-TLS server last")
+	}
+	getCertificate, err := apiCertificate(config, servers)
+	if err != nil {
+		t.Fatalf("Could not load the certificate: %v", err)
+	}
+	server := servers[1]
+	server.Server.TLSConfig = &tls.Config{MinVersion: tls.VersionTLS12, GetCertificate: getCertificate}
+	var wg sync.WaitGroup
+	wg.Add(1)
+	server.Server.NotifyStartedFunc = wg.Done
+	go server.Start(make(chan error, 1))
+	wg.Wait()
+	defer func() { _ = server.Server.Shutdown() }()
+
+	m := new(dns.Msg)
+	m.SetQuestion("auth.example.org.", dns.TypeA)
+	// The certificate of the API is served, another certificate isn't trusted
+	client := &dns.Client{Net: "tcp-tls", TLSConfig: &tls.Config{ServerName: "auth.example.org", RootCAs: pool}}
+	if _, _, err = client.Exchange(m, "127.0.0.1:15359"); err == nil {
+		t.Errorf("Expected the certificate to be verified")
+	}
+	certificate, _ := getCertificate(nil)
+	leaf, _ := x509.ParseCertificate(certificate.Certificate[0])
+	trusted := x509.NewCertPool()
+	trusted.AddCert(leaf)
+	client.TLSConfig.RootCAs = trusted
+	r, _, err := client.Exchange(m, "127.0.0.1:15359")
+	if err != nil {
+		t.Fatalf("DNS-over-TLS query failed: %v", err)
+	}
+	if len(r.Answer) != 1 {
+		t.Errorf("Expected an answer, got %v", r.Answer)
+	}
+
+	config.API.TLS = "none"
+	if _, err = prepareConfig(config); err == nil {
+		t.Errorf("Expected an error for the DNS-over-TLS listener without a certificate")
+	}
+}
+
+func TestTruncationOfTXTRecords(t *testing.T) {
+	reg, err := DB.Register(cidrslice{}, registrationOrigin{}, ACMETxtPost{})
+	if err != nil {
+		t.Fatalf("Registration failed, got error [%v]", err)
+	}
+	for _, value := range []string{"LHDhK3oGRvkiefQnx7OOczTY5Tic_xZ6HcMOc_gmtoM", "tnYAy4oX-5tkvfQ6tP6n_4GArtf0Ds5V7gpp_qLsyJo"} {
+		if _, err = DB.Update(ACMETxtPost{Subdomain: reg.Subdomain, Value: value}); err != nil {
+			t.Fatalf("DB Update failed, got error: [%v]", err)
+		}
+	}
+	server := NewDNSServer(DB, "", "udp", "auth.example.org")
+	server.ParseRecords(Config)
+	req := new(dns.Msg)
+	req.SetQuestion(reg.Subdomain+".auth.example.org.", dns.TypeTXT)
+	req.SetEdns0(4096, false)
+	w := &recordingWriter{local: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53}}
+
+	// Both tokens fit in the size advertised by the client
+	server.MaxUDPSize = 1232
+	server.handleRequest(w, req)
+	if len(w.msg.Answer) != 2 || w.msg.Truncated {
+		t.Fatalf("Expected both TXT values without TC, got %v", w.msg)
+	}
+	if opt := w.msg.IsEdns0(); opt == nil || opt.UDPSize() != 1232 {
+		t.Errorf("Expected the configured UDP size to be advertised, got %v", opt)
+	}
+
+	// When only some of the values fit, none are sent
+	m := w.msg.Copy()
+	for len(m.Answer) < 12 {
+		m.Answer = append(m.Answer, dns.Copy(m.Answer[0]))
+	}
+	truncate(m, dns.MinMsgSize)
+	if len(m.Answer) != 0 || !m.Truncated || m.IsEdns0() == nil {
+		t.Errorf("Expected an empty answer with TC and the OPT record, got %v", m)
+	}
+
+	// More than one OPT record is a format error
+	req.Extra = append(req.Extra, req.Extra[0])
+	server.handleRequest(w, req)
+	if w.msg.Rcode != dns.RcodeFormatError || len(w.msg.Answer) != 0 {
+		t.Errorf("Expected FORMERR for a request with two OPT records, got %v", w.msg)
+	}
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+)
+
+// dnssecAlgorithms are the supported signing algorithms with their key sizes
+var dnssecAlgorithms = map[string]struct {
+	algorithm uint8
+	bits      int
+}{
+	"ECDSAP256SHA256": {dns.ECDSAP256SHA256, 256},
+	"ECDSAP384SHA384": {dns.ECDSAP384SHA384, 384},
+	"ED25519":         {dns.ED25519, 256},
+}
+
+// typeNXNAME marks the NSEC records of names that don't exist in compact denial
+// of existence (RFC 9824)
+const typeNXNAME uint16 = 128
+
+// dnssecSigner signs the answers of the served zone online, with the active key
+// signing key for the DNSKEY records and the active zone signing key for the rest.
+// Names that don't exist, and types that don't exist at a name, are denied with a
+// single NSEC record generated for the query name, so that no zone walking is
+// possible and the denial doesn't depend on the other names in the zone.
+type dnssecSigner struct {
+	zone     string
+	validity time.Duration
+	clock    clock
+	// mutex guards the keys, replaced when they are rolled over
+	mutex sync.RWMutex
+	keys  []*dnssecKey
+}
+
+// newDNSSECSigner returns the signer of the zone with the keys
+func newDNSSECSigner(zone string, conf dnssecConfig, keys []*dnssecKey) (*dnssecSigner, error) {
+	s := &dnssecSigner{zone: strings.ToLower(dns.Fqdn(zone)), validity: time.Duration(conf.SignatureValidity) * time.Second}
+	if err := s.SetKeys(keys); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// loadDNSSECSigner returns the signer of the zone with the keys of the store,
+// generating the keys the first time
+func loadDNSSECSigner(zone string, conf dnssecConfig, store dnssecKeyStore) (*dnssecSigner, error) {
+	keys, err := store.Load()
+	if err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 {
+		if keys, err = generateKeySet(zone, conf, time.Now()); err != nil {
+			return nil, err
+		}
+		if err = store.Save(keys); err != nil {
+			return nil, err
+		}
+		dnsLog.WithFields(log.Fields{"storage": conf.KeyStorage}).Info("Generated DNSSEC keys")
+	}
+	return newDNSSECSigner(zone, conf, keys)
+}
+
+// SetKeys replaces the keys of the signer, which needs an active key for each role
+func (s *dnssecSigner) SetKeys(keys []*dnssecKey) error {
+	for _, role := range []string{roleKSK, roleZSK} {
+		if activeKey(keys, role) == nil {
+			return fmt.Errorf("no active DNSSEC %s", role)
+		}
+	}
+	for _, k := range keys {
+		if !strings.EqualFold(k.dnskey.Hdr.Name, s.zone) {
+			return fmt.Errorf("DNSSEC key %d is a key of %s, not of %s", k.dnskey.KeyTag(), k.dnskey.Hdr.Name, s.zone)
+		}
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.keys = keys
+	return nil
+}
+
+// activeKey returns the active key of the role, the one signing
+func (s *dnssecSigner) activeKey(role string) *dnssecKey {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return activeKey(s.keys, role)
+}
+
+// DS returns the DS record of the active key signing key, to be published in the
+// parent zone
+func (s *dnssecSigner) DS() *dns.DS {
+	return s.activeKey(roleKSK).dnskey.ToDS(dns.SHA256)
+}
+
+// inZone tells if the name is in the signed zone
+func (s *dnssecSigner) inZone(name string) bool {
+	return dns.IsSubDomain(s.zone, strings.ToLower(name))
+}
+
+// DNSKEYs returns the published keys of the zone for a DNSKEY query of the apex,
+// including the keys waiting to sign and the ones no longer signing during a
+// rollover
+func (s *dnssecSigner) DNSKEYs(q dns.Question) []dns.RR {
+	if s == nil || !strings.EqualFold(q.Name, s.zone) {
+		return nil
+	}
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	var rrs []dns.RR
+	for _, k := range s.keys {
+		rr := dns.Copy(k.dnskey)
+		rr.Header().Name = q.Name
+		rrs = append(rrs, rr)
+	}
+	return rrs
+}
+
+// denialTypes returns the types an NSEC record at the name of a NODATA answer
+// lists. The types acme-dns might serve at the name are listed, except for the
+// queried one, so that resolvers synthesizing answers from the NSEC record never
+// deny a record that exists.
+func (s *dnssecSigner) denialTypes(name string, qtype uint16) []uint16 {
+	types := []uint16{dns.TypeA, dns.TypeAAAA, dns.TypeMX, dns.TypeTXT, dns.TypeSRV, dns.TypeCAA, dns.TypePTR, dns.TypeRRSIG, dns.TypeNSEC}
+	for name := range genericTypes {
+		types = append(types, dns.StringToType[name])
+	}
+	if strings.EqualFold(name, s.zone) {
+		types = append(types, dns.TypeNS, dns.TypeSOA, dns.TypeDNSKEY)
+	}
+	var listed []uint16
+	for _, t := range types {
+		if t != qtype {
+			listed = append(listed, t)
+		}
+	}
+	sort.Slice(listed, func(i, j int) bool { return listed[i] < listed[j] })
+	return listed
+}
+
+// deny adds the NSEC record proving the negative answer for the question to the
+// authority section. Names that don't exist are answered with NOERROR and an NSEC
+// record listing only the NXNAME type, following compact denial of existence.
+func (s *dnssecSigner) deny(m *dns.Msg, q dns.Question, soa dns.RR) {
+	ttl := soa.Header().Ttl
+	if minttl := soa.(*dns.SOA).Minttl; minttl < ttl {
+		ttl = minttl
+	}
+	nsec := &dns.NSEC{
+		Hdr:        dns.RR_Header{Name: q.Name, Rrtype: dns.TypeNSEC, Class: dns.ClassINET, Ttl: ttl},
+		NextDomain: "\\000." + q.Name,
+	}
+	if m.Rcode == dns.RcodeNameError {
+		m.Rcode = dns.RcodeSuccess
+		nsec.TypeBitMap = []uint16{dns.TypeRRSIG, dns.TypeNSEC, typeNXNAME}
+	} else {
+		nsec.TypeBitMap = s.denialTypes(q.Name, q.Qtype)
+	}
+	hasSOA := false
+	for _, rr := range m.Ns {
+		if rr.Header().Rrtype == dns.TypeSOA {
+			hasSOA = true
+		}
+	}
+	if !hasSOA {
+		m.Ns = append(m.Ns, soa)
+	}
+	m.Ns = append(m.Ns, nsec)
+}
+
+// Secure adds the denial of existence to negative answers in the zone and signs
+// the records of the zone in the response
+func (s *dnssecSigner) Secure(m *dns.Msg, soa dns.RR) {
+	if len(m.Question) == 0 || !m.Authoritative || !s.inZone(m.Question[0].Name) {
+		return
+	}
+	negative := m.Rcode == dns.RcodeNameError || (m.Rcode == dns.RcodeSuccess && len(m.Answer) == 0)
+	if negative && soa != nil {
+		s.deny(m, m.Question[0], soa)
+	}
+	m.Answer = s.signSection(m.Answer)
+	m.Ns = s.signSection(m.Ns)
+	m.Extra = s.signSection(m.Extra)
+}
+
+// signSection returns the records of the section followed by the signatures of
+// their RRsets in the zone
+func (s *dnssecSigner) signSection(rrs []dns.RR) []dns.RR {
+	type rrsetKey struct {
+		name  string
+		rtype uint16
+	}
+	var order []rrsetKey
+	rrsets := make(map[rrsetKey][]dns.RR)
+	for _, rr := range rrs {
+		h := rr.Header()
+		if h.Rrtype == dns.TypeOPT || h.Rrtype == dns.TypeRRSIG || !s.inZone(h.Name) {
+			continue
+		}
+		k := rrsetKey{strings.ToLower(h.Name), h.Rrtype}
+		if _, ok := rrsets[k]; !ok {
+			order = append(order, k)
+		}
+		rrsets[k] = append(rrsets[k], rr)
+	}
+	signed := rrs
+	for _, k := range order {
+		if sig, err := s.sign(rrsets[k]); err == nil {
+			signed = append(signed, sig)
+		} else {
+			dnsLog.WithFields(log.Fields{"error": err.Error(), "domain": k.name, "qtype": dns.TypeToString[k.rtype]}).Error("Could not sign RRset")
+		}
+	}
+	return signed
+}
+
+// sign returns the signature of the RRset, with the key signing key for the
+// DNSKEY records and the zone signing key otherwise
+func (s *dnssecSigner) sign(rrset []dns.RR) (*dns.RRSIG, error) {
+	signing := s.activeKey(roleZSK)
+	if rrset[0].Header().Rrtype == dns.TypeDNSKEY {
+		signing = s.activeKey(roleKSK)
+	}
+	key, priv := signing.dnskey, signing.signer
+	now := clockOrSystem(s.clock).Now()
+	sig := &dns.RRSIG{
+		Hdr:        dns.RR_Header{Name: rrset[0].Header().Name, Rrtype: dns.TypeRRSIG, Class: dns.ClassINET, Ttl: rrset[0].Header().Ttl},
+		Algorithm:  key.Algorithm,
+		SignerName: s.zone,
+		KeyTag:     key.KeyTag(),
+		// Allow for clocks of resolvers lagging behind
+		Inception:  uint32(now.Add(-time.Hour).Unix()),
+		Expiration: uint32(now.Add(s.validity).Unix()),
+	}
+	if err := sig.Sign(priv, rrset); err != nil {
+		return nil, err
+	}
+	return sig, nil
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func testDNSSECConfig(dir string) dnssecConfig {
+	return dnssecConfig{Enabled: true, KeyDir: dir, KeyStorage: "disk", Algorithm: "ECDSAP256SHA256", SignatureValidity: 3600, RolloverDelay: 3600}
+}
+
+// verifySection checks that every RRset of the section is signed with a valid
+// signature and returns the records by type
+func verifySection(t *testing.T, signer *dnssecSigner, section []dns.RR) map[uint16][]dns.RR {
+	t.Helper()
+	rrsets := make(map[uint16][]dns.RR)
+	sigs := make(map[uint16]*dns.RRSIG)
+	for _, rr := range section {
+		if sig, ok := rr.(*dns.RRSIG); ok {
+			sigs[sig.TypeCovered] = sig
+			continue
+		}
+		rrsets[rr.Header().Rrtype] = append(rrsets[rr.Header().Rrtype], rr)
+	}
+	for rtype, rrset := range rrsets {
+		sig, ok := sigs[rtype]
+		if !ok {
+			t.Errorf("No signature for the %s RRset", dns.TypeToString[rtype])
+			continue
+		}
+		key := signer.activeKey(roleZSK)
+		if rtype == dns.TypeDNSKEY {
+			key = signer.activeKey(roleKSK)
+		}
+		if err := sig.Verify(key.dnskey, rrset); err != nil {
+			t.Errorf("Invalid signature for the %s RRset: %v", dns.TypeToString[rtype], err)
+		}
+		if !sig.ValidityPeriod(signer.clock.Now()) {
+			t.Errorf("Signature for the %s RRset is not valid now", dns.TypeToString[rtype])
+		}
+	}
+	return rrsets
+}
+
+func TestDNSSECSigning(t *testing.T) {
+	signer, err := loadDNSSECSigner("auth.example.org", testDNSSECConfig(t.TempDir()), &diskKeyStore{t.TempDir()})
+	if err != nil {
+		t.Fatalf("Could not generate the keys: %v", err)
+	}
+	signer.clock = systemClock{}
+	server := NewDNSServer(DB, "", "udp", "auth.example.org")
+	// Other tests replace the configuration, use the records parsed at startup
+	server.Domains = dnsserver.Domains
+	server.SOA = dnsserver.SOA
+	server.MaxUDPSize = 4096
+	server.DNSSEC = signer
+	reg, err := DB.Register(cidrslice{}, registrationOrigin{}, ACMETxtPost{})
+	if err != nil {
+		t.Fatalf("Registration failed, got error [%v]", err)
+	}
+	reg.Value = "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"
+	if _, err = DB.Update(reg.ACMETxtPost); err != nil {
+		t.Fatalf("DB Update failed, got error: [%v]", err)
+	}
+	query := func(name string, qtype uint16, do bool) *dns.Msg {
+		req := new(dns.Msg)
+		req.SetQuestion(name, qtype)
+		req.SetEdns0(4096, do)
+		w := &recordingWriter{local: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53}}
+		server.handleRequest(w, req)
+		return w.msg
+	}
+	subdomain := reg.Subdomain + ".auth.example.org."
+
+	for _, test := range []struct {
+		name  string
+		qtype uint16
+	}{
+		{"auth.example.org.", dns.TypeA},
+		{"auth.example.org.", dns.TypeSOA},
+		{"auth.example.org.", dns.TypeDNSKEY},
+		{subdomain, dns.TypeTXT},
+	} {
+		m := query(test.name, test.qtype, true)
+		if m.Rcode != dns.RcodeSuccess || !m.IsEdns0().Do() {
+			t.Errorf("Expected a NOERROR response with DO for %s %s, got %v", test.name, dns.TypeToString[test.qtype], m)
+		}
+		if answers := verifySection(t, signer, m.Answer); len(answers[test.qtype]) == 0 {
+			t.Errorf("Expected %s records for %s, got %v", dns.TypeToString[test.qtype], test.name, m.Answer)
+		}
+	}
+
+	// Names that don't exist
+	m := query("nonexistent.auth.example.org.", dns.TypeA, true)
+	if m.Rcode != dns.RcodeSuccess || len(m.Answer) != 0 {
+		t.Errorf("Expected an empty NOERROR response, got %v", m)
+	}
+	authority := verifySection(t, signer, m.Ns)
+	if len(authority[dns.TypeSOA]) != 1 || len(authority[dns.TypeNSEC]) != 1 {
+		t.Fatalf("Expected SOA and NSEC records, got %v", m.Ns)
+	}
+	nsec := authority[dns.TypeNSEC][0].(*dns.NSEC)
+	if nsec.Hdr.Name != "nonexistent.auth.example.org." || !strings.HasPrefix(nsec.NextDomain, "\\000.nonexistent") {
+		t.Errorf("Unexpected NSEC record %v", nsec)
+	}
+	if len(nsec.TypeBitMap) != 3 || nsec.TypeBitMap[2] != typeNXNAME {
+		t.Errorf("Expected the NXNAME type in the NSEC record, got %v", nsec.TypeBitMap)
+	}
+	if _, err := m.Pack(); err != nil {
+		t.Errorf("Could not pack the response: %v", err)
+	}
+
+	// Types that don't exist at the name
+	m = query(subdomain, dns.TypeMX, true)
+	authority = verifySection(t, signer, m.Ns)
+	if len(authority[dns.TypeNSEC]) != 1 {
+		t.Fatalf("Expected an NSEC record, got %v", m.Ns)
+	}
+	nsec = authority[dns.TypeNSEC][0].(*dns.NSEC)
+	hasType := func(rtype uint16) bool {
+		for _, t := range nsec.TypeBitMap {
+			if t == rtype {
+				return true
+			}
+		}
+		return false
+	}
+	if hasType(dns.TypeMX) || hasType(dns.TypeCNAME) || hasType(dns.TypeNS) || !hasType(dns.TypeTXT) {
+		t.Errorf("Unexpected types in the NSEC record %v", nsec.TypeBitMap)
+	}
+
+	// Resolvers not asking for DNSSEC get the usual answers
+	m = query("nonexistent.auth.example.org.", dns.TypeA, false)
+	if m.Rcode != dns.RcodeNameError || len(m.Ns) != 1 || m.IsEdns0().Do() {
+		t.Errorf("Expected an unsigned NXDOMAIN response, got %v", m)
+	}
+}
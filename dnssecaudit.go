@@ -0,0 +1,297 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+)
+
+// SigningAudit counts the answers that would be signed while DNSSEC is disabled,
+// nil unless the audit mode is on
+var SigningAudit *dnssecAudit
+
+// signingCostSamples is the number of signatures timed to estimate the cost of
+// signing with an algorithm
+const signingCostSamples = 50
+
+// dnssecAudit counts the answers of the zone that online signing would sign, and
+// the signatures it would make, without keys or signing, so that the algorithm
+// and the signing capacity can be planned before DNSSEC is enabled
+type dnssecAudit struct {
+	zone      string
+	algorithm string
+	clock     clock
+	boot      time.Time
+	mutex     sync.Mutex
+	// answers are the authoritative answers of the zone, dnssecOK those to
+	// queries with the DO bit, the only ones that are signed
+	answers  uint64
+	dnssecOK uint64
+	denials  uint64
+	// kskSignatures are the signatures of the DNSKEY RRset, made with the key
+	// signing key, and counted in signatures too
+	signatures    uint64
+	kskSignatures uint64
+	byType        map[string]uint64
+	// minute is the start of the current minute, counted to find the busiest one
+	minute      time.Time
+	minuteCount uint64
+	peakMinute  uint64
+	// costs are the measured times to sign an RRset by algorithm
+	costsOnce sync.Once
+	costs     map[string]time.Duration
+}
+
+// dnssecAuditAlgorithm is the estimated signing load of an algorithm
+type dnssecAuditAlgorithm struct {
+	Algorithm               string  `json:"algorithm"`
+	Configured              bool    `json:"configured"`
+	MicrosecondsPerSig      float64 `json:"microseconds_per_signature"`
+	EstimatedCPUSeconds     float64 `json:"estimated_cpu_seconds"`
+	EstimatedPeakCPUPercent float64 `json:"estimated_peak_cpu_percent"`
+}
+
+// dnssecAuditReport is the state of the audit reported by the admin API
+type dnssecAuditReport struct {
+	Since                   int64                  `json:"since"`
+	Answers                 uint64                 `json:"answers"`
+	DNSSECOKAnswers         uint64                 `json:"dnssec_ok_answers"`
+	Denials                 uint64                 `json:"denials"`
+	Signatures              uint64                 `json:"signatures"`
+	KSKSignatures           uint64                 `json:"ksk_signatures"`
+	SignaturesByType        map[string]uint64      `json:"signatures_by_type"`
+	SignaturesPerSecond     float64                `json:"signatures_per_second"`
+	PeakSignaturesPerSecond float64                `json:"peak_signatures_per_second"`
+	Algorithms              []dnssecAuditAlgorithm `json:"algorithms"`
+}
+
+func newDNSSECAudit(zone string, conf dnssecConfig, c clock) *dnssecAudit {
+	now := clockOrSystem(c).Now()
+	return &dnssecAudit{
+		zone:      strings.ToLower(dns.Fqdn(zone)),
+		algorithm: strings.ToUpper(conf.Algorithm),
+		clock:     c,
+		boot:      now,
+		byType:    make(map[string]uint64),
+		minute:    now.Truncate(time.Minute),
+	}
+}
+
+// auditSigning counts the signatures the answer would get, skipping the zones
+// secure leaves unsigned
+func (d *DNSServer) auditSigning(m *dns.Msg, dnssecOK bool) {
+	if len(m.Question) == 0 || d.supplementaryZone(m.Question[0].Name) != nil || d.extraZone(m.Question[0].Name) != "" {
+		return
+	}
+	d.SigningAudit.Record(m, d.zoneSOA(), dnssecOK)
+}
+
+// Record counts the answer, and the signatures Secure would add to it for a
+// query with the DO bit
+func (a *dnssecAudit) Record(m *dns.Msg, soa dns.RR, dnssecOK bool) {
+	if len(m.Question) == 0 || !m.Authoritative || !dns.IsSubDomain(a.zone, strings.ToLower(m.Question[0].Name)) {
+		return
+	}
+	q := m.Question[0]
+	// Without keys the DNSKEY query of the apex gets a NODATA answer, signing
+	// answers it with the DNSKEY RRset signed by the key signing key instead
+	dnskey := q.Qtype == dns.TypeDNSKEY && strings.EqualFold(q.Name, a.zone)
+	var types []uint16
+	if dnssecOK {
+		types = append(types, a.rrsetTypes(m.Answer)...)
+		if dnskey {
+			types = append(types, dns.TypeDNSKEY)
+		} else {
+			types = append(types, a.rrsetTypes(m.Ns)...)
+		}
+		types = append(types, a.rrsetTypes(m.Extra)...)
+	}
+	negative := !dnskey && (m.Rcode == dns.RcodeNameError || (m.Rcode == dns.RcodeSuccess && len(m.Answer) == 0))
+	denial := dnssecOK && negative && soa != nil
+	if denial {
+		// deny adds the SOA record when missing and the NSEC record
+		hasSOA := false
+		for _, rr := range m.Ns {
+			if rr.Header().Rrtype == dns.TypeSOA {
+				hasSOA = true
+			}
+		}
+		if !hasSOA {
+			types = append(types, dns.TypeSOA)
+		}
+		types = append(types, dns.TypeNSEC)
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	now := clockOrSystem(a.clock).Now()
+	if minute := now.Truncate(time.Minute); !minute.Equal(a.minute) {
+		a.minute, a.minuteCount = minute, 0
+	}
+	a.answers++
+	if !dnssecOK {
+		return
+	}
+	a.dnssecOK++
+	if denial {
+		a.denials++
+	}
+	for _, t := range types {
+		a.signatures++
+		if t == dns.TypeDNSKEY {
+			a.kskSignatures++
+		}
+		a.byType[dns.TypeToString[t]]++
+	}
+	a.minuteCount += uint64(len(types))
+	a.peakMinute = max(a.peakMinute, a.minuteCount)
+	dnsLog.WithFields(log.Fields{"domain": q.Name, "qtype": dns.TypeToString[q.Qtype], "signatures": len(types)}).Debug("Answer would be signed with DNSSEC")
+}
+
+// rrsetTypes returns the type of each RRset of the zone in the section, the ones
+// signSection signs
+func (a *dnssecAudit) rrsetTypes(rrs []dns.RR) []uint16 {
+	type rrsetKey struct {
+		name  string
+		rtype uint16
+	}
+	seen := make(map[rrsetKey]bool)
+	var types []uint16
+	for _, rr := range rrs {
+		h := rr.Header()
+		if h.Rrtype == dns.TypeOPT || h.Rrtype == dns.TypeRRSIG || !dns.IsSubDomain(a.zone, strings.ToLower(h.Name)) {
+			continue
+		}
+		k := rrsetKey{strings.ToLower(h.Name), h.Rrtype}
+		if !seen[k] {
+			seen[k] = true
+			types = append(types, h.Rrtype)
+		}
+	}
+	return types
+}
+
+// signingCosts times the signing of an RRset with a throwaway key of each of the
+// supported algorithms, once
+func (a *dnssecAudit) signingCosts() map[string]time.Duration {
+	a.costsOnce.Do(func() {
+		a.costs = make(map[string]time.Duration)
+		rrset := []dns.RR{&dns.TXT{
+			Hdr: dns.RR_Header{Name: "_acme-challenge." + a.zone, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 1},
+			Txt: []string{"LHDhK3oGRvkiefQnx7OOczTY5Tic_xZ6HcMOc_gmtoM"},
+		}}
+		for name := range dnssecAlgorithms {
+			cost, err := measureSigningCost(a.zone, name, rrset)
+			if err != nil {
+				dnsLog.WithFields(log.Fields{"error": err.Error(), "algorithm": name}).Error("Could not measure the cost of DNSSEC signing")
+				continue
+			}
+			a.costs[name] = cost
+		}
+	})
+	return a.costs
+}
+
+// measureSigningCost returns the average time to sign the RRset with a new key of
+// the algorithm
+func measureSigningCost(zone string, algorithm string, rrset []dns.RR) (time.Duration, error) {
+	conf := dnssecConfig{Algorithm: algorithm, SignatureValidity: 604800}
+	keys, err := generateKeySet(zone, conf, time.Now())
+	if err != nil {
+		return 0, err
+	}
+	signer, err := newDNSSECSigner(zone, conf, keys)
+	if err != nil {
+		return 0, err
+	}
+	start := time.Now()
+	for i := 0; i < signingCostSamples; i++ {
+		if _, err = signer.sign(rrset); err != nil {
+			return 0, err
+		}
+	}
+	return time.Since(start) / signingCostSamples, nil
+}
+
+// Report returns the counters and the estimated signing load of each algorithm
+func (a *dnssecAudit) Report() dnssecAuditReport {
+	costs := a.signingCosts()
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	report := dnssecAuditReport{
+		Since:            a.boot.Unix(),
+		Answers:          a.answers,
+		DNSSECOKAnswers:  a.dnssecOK,
+		Denials:          a.denials,
+		Signatures:       a.signatures,
+		KSKSignatures:    a.kskSignatures,
+		SignaturesByType: make(map[string]uint64, len(a.byType)),
+		// The busiest minute, for a capacity to plan for that isn't swayed by a single burst
+		PeakSignaturesPerSecond: float64(a.peakMinute) / 60,
+		Algorithms:              []dnssecAuditAlgorithm{},
+	}
+	for t, v := range a.byType {
+		report.SignaturesByType[t] = v
+	}
+	if elapsed := clockOrSystem(a.clock).Now().Sub(a.boot).Seconds(); elapsed > 0 {
+		report.SignaturesPerSecond = float64(a.signatures) / elapsed
+	}
+	for name, cost := range costs {
+		report.Algorithms = append(report.Algorithms, dnssecAuditAlgorithm{
+			Algorithm:               name,
+			Configured:              name == a.algorithm,
+			MicrosecondsPerSig:      float64(cost) / float64(time.Microsecond),
+			EstimatedCPUSeconds:     float64(a.signatures) * cost.Seconds(),
+			EstimatedPeakCPUPercent: report.PeakSignaturesPerSecond * cost.Seconds() * 100,
+		})
+	}
+	sort.Slice(report.Algorithms, func(i, j int) bool { return report.Algorithms[i].Algorithm < report.Algorithms[j].Algorithm })
+	return report
+}
+
+// writeMetrics writes the counters of the audit in the Prometheus text format
+func (a *dnssecAudit) writeMetrics(w io.Writer) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	for _, c := range []struct {
+		name  string
+		help  string
+		value uint64
+	}{
+		{"acmedns_dnssec_audit_answers_total", "Authoritative answers of the zone.", a.answers},
+		{"acmedns_dnssec_audit_dnssec_ok_answers_total", "Authoritative answers of the zone to queries with the DO bit, which would be signed.", a.dnssecOK},
+		{"acmedns_dnssec_audit_denials_total", "Negative answers which would get an NSEC record.", a.denials},
+	} {
+		_, _ = fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n%s %d\n", c.name, c.help, c.name, c.name, c.value)
+	}
+	name := "acmedns_dnssec_audit_signatures_total"
+	_, _ = fmt.Fprintf(w, "# HELP %s Signatures which would be made online by RRset type.\n# TYPE %s counter\n", name, name)
+	types := make([]string, 0, len(a.byType))
+	for t := range a.byType {
+		types = append(types, t)
+	}
+	sort.Strings(types)
+	for _, t := range types {
+		_, _ = fmt.Fprintf(w, "%s{type=%q} %d\n", name, t, a.byType[t])
+	}
+}
+
+// webAdminDNSSECAudit reports the answers and signatures counted by the DNSSEC
+// audit mode, with the estimated signing load of each algorithm
+func webAdminDNSSECAudit(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	if SigningAudit == nil {
+		WriteJsonResponse(w, http.StatusNotFound, jsonError("not_found"))
+		return
+	}
+	out, _ := json.Marshal(SigningAudit.Report())
+	WriteJsonResponse(w, http.StatusOK, out)
+}
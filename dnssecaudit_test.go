@@ -0,0 +1,105 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/miekg/dns"
+)
+
+func TestDNSSECAudit(t *testing.T) {
+	signer, err := loadDNSSECSigner("auth.example.org", testDNSSECConfig(t.TempDir()), &diskKeyStore{t.TempDir()})
+	if err != nil {
+		t.Fatalf("Could not generate the keys: %v", err)
+	}
+	signer.clock = systemClock{}
+	newServer := func() *DNSServer {
+		server := NewDNSServer(DB, "", "udp", "auth.example.org")
+		server.Domains = dnsserver.Domains
+		server.SOA = dnsserver.SOA
+		server.MaxUDPSize = 4096
+		return server
+	}
+	signing, auditing := newServer(), newServer()
+	signing.DNSSEC = signer
+	audit := newDNSSECAudit("auth.example.org", dnssecConfig{Algorithm: "ED25519"}, nil)
+	auditing.SigningAudit = audit
+	reg, err := DB.Register(cidrslice{}, registrationOrigin{}, ACMETxtPost{})
+	if err != nil {
+		t.Fatalf("Registration failed, got error [%v]", err)
+	}
+	reg.Value = "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"
+	if _, err = DB.Update(reg.ACMETxtPost); err != nil {
+		t.Fatalf("DB Update failed, got error: [%v]", err)
+	}
+	query := func(server *DNSServer, name string, qtype uint16, do bool) *dns.Msg {
+		req := new(dns.Msg)
+		req.SetQuestion(name, qtype)
+		req.SetEdns0(4096, do)
+		w := &recordingWriter{local: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53}}
+		server.handleRequest(w, req)
+		return w.msg
+	}
+
+	// The audit counts as many signatures as the signer makes
+	for _, test := range []struct {
+		name  string
+		qtype uint16
+	}{
+		{"auth.example.org.", dns.TypeSOA},
+		{"auth.example.org.", dns.TypeDNSKEY},
+		{reg.Subdomain + ".auth.example.org.", dns.TypeTXT},
+		{reg.Subdomain + ".auth.example.org.", dns.TypeA},
+		{"nonexistent.auth.example.org.", dns.TypeTXT},
+	} {
+		signed := 0
+		m := query(signing, test.name, test.qtype, true)
+		for _, rr := range append(m.Answer, m.Ns...) {
+			if rr.Header().Rrtype == dns.TypeRRSIG {
+				signed++
+			}
+		}
+		before := audit.Report().Signatures
+		m = query(auditing, test.name, test.qtype, true)
+		for _, rr := range append(m.Answer, m.Ns...) {
+			if rr.Header().Rrtype == dns.TypeRRSIG || rr.Header().Rrtype == dns.TypeNSEC {
+				t.Errorf("Expected the audited answer to be unsigned, got %v", rr)
+			}
+		}
+		if counted := audit.Report().Signatures - before; counted != uint64(signed) {
+			t.Errorf("Expected %d signatures for %s %s, counted %d", signed, test.name, dns.TypeToString[test.qtype], counted)
+		}
+	}
+	query(auditing, reg.Subdomain+".auth.example.org.", dns.TypeTXT, false)
+
+	report := audit.Report()
+	if report.Answers != 6 || report.DNSSECOKAnswers != 5 || report.Denials != 2 || report.KSKSignatures != 1 {
+		t.Errorf("Unexpected counters %+v", report)
+	}
+	if report.SignaturesByType["NSEC"] != 2 || report.SignaturesByType["TXT"] != 1 {
+		t.Errorf("Unexpected signatures by type %v", report.SignaturesByType)
+	}
+	if report.PeakSignaturesPerSecond <= 0 {
+		t.Errorf("Expected a peak signing rate, got %v", report.PeakSignaturesPerSecond)
+	}
+	if len(report.Algorithms) != len(dnssecAlgorithms) {
+		t.Fatalf("Expected an estimate for each algorithm, got %v", report.Algorithms)
+	}
+	for _, a := range report.Algorithms {
+		if a.MicrosecondsPerSig <= 0 || a.EstimatedCPUSeconds <= 0 || a.Configured != (a.Algorithm == "ED25519") {
+			t.Errorf("Unexpected estimate %+v", a)
+		}
+	}
+
+	stats := newDNSStatistics(nil)
+	stats.SigningAudit = audit
+	metrics := httptest.NewRecorder()
+	stats.serveMetrics(metrics, httptest.NewRequest(http.MethodGet, "/metrics", nil), httprouter.Params{})
+	if !strings.Contains(metrics.Body.String(), "acmedns_dnssec_audit_signatures_total{type=\"NSEC\"} 2\n") {
+		t.Errorf("Expected the audit counters in the metrics, got %s", metrics.Body.String())
+	}
+}
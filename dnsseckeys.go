@@ -0,0 +1,401 @@
+package main
+
+import (
+	"crypto"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+)
+
+// Roles of the DNSSEC keys
+const (
+	roleKSK = "ksk"
+	roleZSK = "zsk"
+)
+
+// States of the DNSSEC keys. Published keys are in the DNSKEY RRset waiting to
+// take over signing, retired keys stay in it until the signatures made with them
+// have expired from the caches of the resolvers.
+const (
+	keyActive    = "active"
+	keyPublished = "published"
+	keyRetired   = "retired"
+)
+
+// dnssecKeySetting is the name of the setting holding the keys in the database
+const dnssecKeySetting = "dnssec_keys"
+
+// dnssecKey is a DNSSEC key with its place in the rollovers
+type dnssecKey struct {
+	Role  string `json:"role"`
+	State string `json:"state"`
+	// Changed is the time the key got its current state
+	Changed int64  `json:"changed"`
+	Public  string `json:"public"`
+	Private string `json:"private"`
+
+	dnskey *dns.DNSKEY
+	signer crypto.Signer
+}
+
+// newDNSSECKey generates a key of the role for the zone
+func newDNSSECKey(zone string, role string, state string, algorithm string, now time.Time) (*dnssecKey, error) {
+	alg, ok := dnssecAlgorithms[strings.ToUpper(algorithm)]
+	if !ok {
+		return nil, fmt.Errorf("unsupported DNSSEC algorithm %q", algorithm)
+	}
+	flags := uint16(dns.ZONE)
+	if role == roleKSK {
+		flags |= dns.SEP
+	}
+	key := &dns.DNSKEY{
+		Hdr:       dns.RR_Header{Name: strings.ToLower(dns.Fqdn(zone)), Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 3600},
+		Flags:     flags,
+		Protocol:  3,
+		Algorithm: alg.algorithm,
+	}
+	priv, err := key.Generate(alg.bits)
+	if err != nil {
+		return nil, err
+	}
+	return &dnssecKey{
+		Role:    role,
+		State:   state,
+		Changed: now.Unix(),
+		Public:  key.String(),
+		Private: key.PrivateKeyString(priv),
+		dnskey:  key,
+		signer:  priv.(crypto.Signer),
+	}, nil
+}
+
+// parse reads the DNSKEY record and the private key of the stored key
+func (k *dnssecKey) parse() error {
+	rr, err := dns.NewRR(k.Public)
+	if err != nil {
+		return err
+	}
+	key, ok := rr.(*dns.DNSKEY)
+	if !ok {
+		return fmt.Errorf("not a DNSKEY record: %s", k.Public)
+	}
+	priv, err := key.ReadPrivateKey(strings.NewReader(k.Private), "")
+	if err != nil {
+		return fmt.Errorf("DNSSEC key %d: %v", key.KeyTag(), err)
+	}
+	signer, ok := priv.(crypto.Signer)
+	if !ok {
+		return fmt.Errorf("DNSSEC key %d is not a signing key", key.KeyTag())
+	}
+	k.dnskey, k.signer = key, signer
+	return nil
+}
+
+// activeKey returns the active key of the role
+func activeKey(keys []*dnssecKey, role string) *dnssecKey {
+	for _, k := range keys {
+		if k.Role == role && k.State == keyActive {
+			return k
+		}
+	}
+	return nil
+}
+
+// keyInState returns the first key of the role in the state
+func keyInState(keys []*dnssecKey, role string, state string) *dnssecKey {
+	for _, k := range keys {
+		if k.Role == role && k.State == state {
+			return k
+		}
+	}
+	return nil
+}
+
+// generateKeySet generates an active key signing key and zone signing key
+func generateKeySet(zone string, conf dnssecConfig, now time.Time) ([]*dnssecKey, error) {
+	var keys []*dnssecKey
+	for _, role := range []string{roleKSK, roleZSK} {
+		k, err := newDNSSECKey(zone, role, keyActive, conf.Algorithm, now)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, k)
+	}
+	return keys, nil
+}
+
+// startZSKRollover publishes a new zone signing key, which takes over signing
+// after the rollover delay
+func startZSKRollover(keys []*dnssecKey, zone string, conf dnssecConfig, now time.Time) ([]*dnssecKey, error) {
+	if keyInState(keys, roleZSK, keyPublished) != nil {
+		return keys, errors.New("a zone signing key rollover is already in progress")
+	}
+	k, err := newDNSSECKey(zone, roleZSK, keyPublished, conf.Algorithm, now)
+	if err != nil {
+		return keys, err
+	}
+	return append(keys, k), nil
+}
+
+// advanceRollover moves the zone signing key rollover on once the delay of its
+// current step has passed: the published key takes over signing, and the retired
+// key is removed. A rollover is started when the active key has reached its
+// lifetime. It reports whether the keys changed.
+func advanceRollover(keys []*dnssecKey, zone string, conf dnssecConfig, now time.Time) ([]*dnssecKey, bool, error) {
+	delay := int64(conf.RolloverDelay)
+	changed := false
+	if published := keyInState(keys, roleZSK, keyPublished); published != nil && now.Unix()-published.Changed >= delay {
+		if active := activeKey(keys, roleZSK); active != nil {
+			active.State, active.Changed = keyRetired, now.Unix()
+		}
+		published.State, published.Changed = keyActive, now.Unix()
+		changed = true
+	}
+	var kept []*dnssecKey
+	for _, k := range keys {
+		if k.Role == roleZSK && k.State == keyRetired && now.Unix()-k.Changed >= delay {
+			changed = true
+			continue
+		}
+		kept = append(kept, k)
+	}
+	keys = kept
+	active := activeKey(keys, roleZSK)
+	if conf.ZSKLifetime > 0 && active != nil && now.Unix()-active.Changed >= int64(conf.ZSKLifetime) && keyInState(keys, roleZSK, keyPublished) == nil {
+		var err error
+		if keys, err = startZSKRollover(keys, zone, conf, now); err != nil {
+			return keys, changed, err
+		}
+		changed = true
+	}
+	return keys, changed, nil
+}
+
+// dnssecKeyStore keeps the DNSSEC keys
+type dnssecKeyStore interface {
+	// Load returns the stored keys, none if they haven't been generated yet
+	Load() ([]*dnssecKey, error)
+	Save([]*dnssecKey) error
+}
+
+// newDNSSECKeyStore returns the configured key store
+func newDNSSECKeyStore(conf dnssecConfig, db database) dnssecKeyStore {
+	if conf.KeyStorage == "database" {
+		return &dbKeyStore{db}
+	}
+	return &diskKeyStore{conf.KeyDir}
+}
+
+// parseKeys decodes the stored keys
+func parseKeys(data []byte) ([]*dnssecKey, error) {
+	var keys []*dnssecKey
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return nil, err
+	}
+	for _, k := range keys {
+		if err := k.parse(); err != nil {
+			return nil, err
+		}
+	}
+	return keys, nil
+}
+
+// diskKeyStore keeps the keys in keys.json in the key directory, which must only
+// be accessible by the user running acme-dns
+type diskKeyStore struct {
+	dir string
+}
+
+func (s *diskKeyStore) file() string {
+	return filepath.Join(s.dir, "keys.json")
+}
+
+func (s *diskKeyStore) Load() ([]*dnssecKey, error) {
+	info, err := os.Stat(s.file())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if info.Mode().Perm()&0o077 != 0 {
+		return nil, fmt.Errorf("%s must not be accessible by other users, its permissions are %v", s.file(), info.Mode().Perm())
+	}
+	data, err := os.ReadFile(s.file())
+	if err != nil {
+		return nil, err
+	}
+	keys, err := parseKeys(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", s.file(), err)
+	}
+	return keys, nil
+}
+
+func (s *diskKeyStore) Save(keys []*dnssecKey) error {
+	data, err := json.MarshalIndent(keys, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(s.dir, 0o700); err != nil {
+		return err
+	}
+	// Replace the file at once, so that a crash never leaves it half written
+	tmp := s.file() + ".tmp"
+	if err = os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.file())
+}
+
+// dbKeyStore keeps the keys in the database, for instances sharing it
+type dbKeyStore struct {
+	db database
+}
+
+func (s *dbKeyStore) Load() ([]*dnssecKey, error) {
+	value, stored, err := s.db.GetSetting(dnssecKeySetting)
+	if err != nil || !stored {
+		return nil, err
+	}
+	return parseKeys([]byte(value))
+}
+
+func (s *dbKeyStore) Save(keys []*dnssecKey) error {
+	data, err := json.Marshal(keys)
+	if err != nil {
+		return err
+	}
+	return s.db.SetSetting(dnssecKeySetting, string(data))
+}
+
+// dnssecRollerInterval is how often the keys are checked for rollovers
+const dnssecRollerInterval = 10 * time.Minute
+
+// dnssecRoller rolls the zone signing keys over on schedule and picks up the keys
+// changed with the dnssec command or by other instances sharing the database
+type dnssecRoller struct {
+	signer *dnssecSigner
+	store  dnssecKeyStore
+	conf   dnssecConfig
+	clock  clock
+	stop   chan struct{}
+}
+
+func newDNSSECRoller(signer *dnssecSigner, store dnssecKeyStore, conf dnssecConfig) *dnssecRoller {
+	return &dnssecRoller{signer: signer, store: store, conf: conf, stop: make(chan struct{})}
+}
+
+// Run checks the keys periodically until stopped
+func (r *dnssecRoller) Run() {
+	ticker := time.NewTicker(dnssecRollerInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			r.tick()
+		case <-r.stop:
+			return
+		}
+	}
+}
+
+// Stop stops the roller
+func (r *dnssecRoller) Stop() {
+	close(r.stop)
+}
+
+func (r *dnssecRoller) tick() {
+	keys, err := r.store.Load()
+	if err != nil {
+		dnsLog.WithFields(log.Fields{"error": err.Error()}).Error("Could not load the DNSSEC keys")
+		return
+	}
+	// Instances on standby leave the rollovers to the primary
+	if Standby == nil || Standby.IsPrimary() {
+		var changed bool
+		keys, changed, err = advanceRollover(keys, r.signer.zone, r.conf, clockOrSystem(r.clock).Now())
+		if err != nil {
+			dnsLog.WithFields(log.Fields{"error": err.Error()}).Error("Could not roll the DNSSEC keys over")
+			return
+		}
+		if changed {
+			if err = r.store.Save(keys); err != nil {
+				dnsLog.WithFields(log.Fields{"error": err.Error()}).Error("Could not store the DNSSEC keys")
+				return
+			}
+			dnsLog.WithFields(log.Fields{"keys": describeKeys(keys)}).Info("Advanced the DNSSEC key rollover")
+		}
+	}
+	if err = r.signer.SetKeys(keys); err != nil {
+		dnsLog.WithFields(log.Fields{"error": err.Error()}).Error("Could not use the DNSSEC keys")
+	}
+}
+
+// describeKeys returns the key tags, roles and states of the keys for logging
+func describeKeys(keys []*dnssecKey) []string {
+	var described []string
+	for _, k := range keys {
+		described = append(described, fmt.Sprintf("%d %s %s", k.dnskey.KeyTag(), k.Role, k.State))
+	}
+	return described
+}
+
+// runDNSSECCommand runs a subcommand managing the DNSSEC keys: keygen generates
+// the keys, rollover starts a zone signing key rollover and export-ds prints the
+// DS record for the parent zone
+func runDNSSECCommand(conf DNSConfig, store dnssecKeyStore, args []string, out io.Writer) error {
+	if len(args) == 0 {
+		return errors.New("usage: acme-dns dnssec keygen|rollover|export-ds")
+	}
+	zone := conf.General.Domain
+	keys, err := store.Load()
+	if err != nil {
+		return err
+	}
+	switch args[0] {
+	case "keygen":
+		if len(keys) > 0 {
+			return errors.New("the DNSSEC keys already exist")
+		}
+		if keys, err = generateKeySet(zone, conf.DNSSEC, time.Now()); err != nil {
+			return err
+		}
+		if err = store.Save(keys); err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "Generated the DNSSEC keys %s\n", strings.Join(describeKeys(keys), ", "))
+	case "rollover":
+		if len(keys) == 0 {
+			return errors.New("no DNSSEC keys, run acme-dns dnssec keygen first")
+		}
+		if keys, err = startZSKRollover(keys, zone, conf.DNSSEC, time.Now()); err != nil {
+			return err
+		}
+		if err = store.Save(keys); err != nil {
+			return err
+		}
+		published := keyInState(keys, roleZSK, keyPublished)
+		fmt.Fprintf(out, "Published the zone signing key %d, signing with it after %d seconds\n", published.dnskey.KeyTag(), conf.DNSSEC.RolloverDelay)
+	case "export-ds":
+		if len(keys) == 0 {
+			return errors.New("no DNSSEC keys, run acme-dns dnssec keygen first")
+		}
+		for _, k := range keys {
+			if k.Role == roleKSK {
+				fmt.Fprintln(out, k.dnskey.ToDS(dns.SHA256).String())
+			}
+		}
+	default:
+		return fmt.Errorf("unknown dnssec command %q", args[0])
+	}
+	return nil
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestDNSSECKeyStores(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "keys")
+	disk := &diskKeyStore{dir}
+	if keys, err := disk.Load(); err != nil || len(keys) != 0 {
+		t.Fatalf("Expected no keys before the first start, got %v, %v", keys, err)
+	}
+	signer, err := loadDNSSECSigner("auth.example.org", testDNSSECConfig(dir), disk)
+	if err != nil {
+		t.Fatalf("Could not generate the keys: %v", err)
+	}
+	if ksk := signer.activeKey(roleKSK).dnskey; ksk.Flags != 257 || ksk.Algorithm != dns.ECDSAP256SHA256 {
+		t.Errorf("Unexpected key signing key %v", ksk)
+	}
+	info, err := os.Stat(filepath.Join(dir, "keys.json"))
+	if err != nil || info.Mode().Perm() != 0o600 {
+		t.Errorf("Expected the key file to only be accessible by the user, got %v, %v", info, err)
+	}
+	reloaded, err := loadDNSSECSigner("auth.example.org", testDNSSECConfig(dir), disk)
+	if err != nil {
+		t.Fatalf("Could not load the keys: %v", err)
+	}
+	if reloaded.activeKey(roleZSK).dnskey.KeyTag() != signer.activeKey(roleZSK).dnskey.KeyTag() {
+		t.Errorf("Expected the stored keys to be loaded")
+	}
+	if _, err = loadDNSSECSigner("other.example.org", testDNSSECConfig(dir), disk); err == nil {
+		t.Errorf("Expected an error for keys of another zone")
+	}
+	if err = os.Chmod(filepath.Join(dir, "keys.json"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = disk.Load(); err == nil {
+		t.Errorf("Expected an error for a key file readable by other users")
+	}
+
+	db, err := openBackend("memory", "")
+	if err != nil {
+		t.Fatalf("Could not open database: %v", err)
+	}
+	defer db.Close()
+	store := newDNSSECKeyStore(dnssecConfig{KeyStorage: "database"}, db)
+	keys, err := generateKeySet("auth.example.org", testDNSSECConfig(""), time.Now())
+	if err != nil {
+		t.Fatalf("Could not generate the keys: %v", err)
+	}
+	if err = store.Save(keys); err != nil {
+		t.Fatalf("Could not store the keys: %v", err)
+	}
+	loaded, err := store.Load()
+	if err != nil || len(loaded) != 2 || loaded[1].dnskey.KeyTag() != keys[1].dnskey.KeyTag() || loaded[1].signer == nil {
+		t.Errorf("Expected the stored keys, got %v, %v", loaded, err)
+	}
+}
+
+func TestDNSSECRollover(t *testing.T) {
+	conf := testDNSSECConfig("")
+	conf.ZSKLifetime = 1000
+	conf.RolloverDelay = 100
+	start := time.Unix(1700000000, 0)
+	keys, err := generateKeySet("auth.example.org", conf, start)
+	if err != nil {
+		t.Fatalf("Could not generate the keys: %v", err)
+	}
+	oldZSK := activeKey(keys, roleZSK).dnskey.KeyTag()
+	signer, err := newDNSSECSigner("auth.example.org", conf, keys)
+	if err != nil {
+		t.Fatalf("Could not create the signer: %v", err)
+	}
+	advance := func(seconds int64, changes bool) {
+		t.Helper()
+		var changed bool
+		keys, changed, err = advanceRollover(keys, "auth.example.org", conf, start.Add(time.Duration(seconds)*time.Second))
+		if err != nil || changed != changes {
+			t.Fatalf("After %d seconds: expected changes %t, got %t, %v", seconds, changes, changed, err)
+		}
+		if err = signer.SetKeys(keys); err != nil {
+			t.Fatalf("Could not set the keys: %v", err)
+		}
+	}
+	dnskeys := func() int {
+		return len(signer.DNSKEYs(dns.Question{Name: "auth.example.org.", Qtype: dns.TypeDNSKEY}))
+	}
+
+	advance(500, false)
+	// The new key is published before it signs
+	advance(1000, true)
+	if dnskeys() != 3 || signer.activeKey(roleZSK).dnskey.KeyTag() != oldZSK {
+		t.Errorf("Expected the new key to be published while the old one signs")
+	}
+	if _, err := startZSKRollover(keys, "auth.example.org", conf, start); err == nil {
+		t.Errorf("Expected an error for a rollover in progress")
+	}
+	advance(1050, false)
+	advance(1100, true)
+	if dnskeys() != 3 || signer.activeKey(roleZSK).dnskey.KeyTag() == oldZSK {
+		t.Errorf("Expected the new key to sign while the old one stays published")
+	}
+	advance(1200, true)
+	if dnskeys() != 2 || keyInState(keys, roleZSK, keyRetired) != nil {
+		t.Errorf("Expected the old key to be removed")
+	}
+	// The lifetime of the new key counts from its activation
+	advance(2099, false)
+	advance(2100, true)
+}
+
+func TestDNSSECCommand(t *testing.T) {
+	conf := DNSConfig{General: general{Domain: "auth.example.org"}, DNSSEC: testDNSSECConfig(t.TempDir())}
+	store := newDNSSECKeyStore(conf.DNSSEC, nil)
+	run := func(args ...string) (string, error) {
+		var out bytes.Buffer
+		err := runDNSSECCommand(conf, store, args, &out)
+		return out.String(), err
+	}
+	if _, err := run("export-ds"); err == nil {
+		t.Errorf("Expected an error exporting the DS record without keys")
+	}
+	if out, err := run("keygen"); err != nil || !strings.Contains(out, "ksk active") {
+		t.Fatalf("Could not generate the keys: %q, %v", out, err)
+	}
+	if _, err := run("keygen"); err == nil {
+		t.Errorf("Expected an error generating the keys again")
+	}
+	out, err := run("export-ds")
+	if err != nil {
+		t.Fatalf("Could not export the DS record: %v", err)
+	}
+	ds, err := dns.NewRR(out)
+	if err != nil || ds.Header().Rrtype != dns.TypeDS || ds.(*dns.DS).DigestType != dns.SHA256 {
+		t.Errorf("Expected a SHA-256 DS record, got %q", out)
+	}
+	if out, err = run("rollover"); err != nil || !strings.Contains(out, "Published the zone signing key") {
+		t.Errorf("Could not start a rollover: %q, %v", out, err)
+	}
+	if _, err = run("rollover"); err == nil {
+		t.Errorf("Expected an error for a rollover in progress")
+	}
+	if _, err = run("rotate"); err == nil {
+		t.Errorf("Expected an error for an unknown command")
+	}
+
+	// The running server picks up the rollover started with the command
+	keys, _ := store.Load()
+	signer, err := newDNSSECSigner("auth.example.org", conf.DNSSEC, keys[:2])
+	if err != nil {
+		t.Fatalf("Could not create the signer: %v", err)
+	}
+	roller := newDNSSECRoller(signer, store, conf.DNSSEC)
+	roller.clock = newFrozenClock(time.Now().Add(2 * time.Hour))
+	roller.tick()
+	if signer.activeKey(roleZSK).dnskey.KeyTag() != keys[2].dnskey.KeyTag() {
+		t.Errorf("Expected the published key to sign after the rollover delay")
+	}
+}
@@ -0,0 +1,394 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+)
+
+// dnstapContentType is the Frame Streams content type of dnstap messages
+const dnstapContentType = "protobuf:dnstap.Dnstap"
+
+// Frame Streams control frame types and fields
+const (
+	fstrmControlAccept = 0x01
+	fstrmControlStart  = 0x02
+	fstrmControlStop   = 0x03
+	fstrmControlReady  = 0x04
+	fstrmControlFinish = 0x05
+
+	fstrmFieldContentType = 0x01
+)
+
+// dnstap message types, socket families and protocols from dnstap.proto
+const (
+	dnstapTypeMessage = 1
+
+	dnstapAuthQuery    = 1
+	dnstapAuthResponse = 2
+
+	dnstapFamilyInet  = 1
+	dnstapFamilyInet6 = 2
+
+	dnstapProtocolUDP = 1
+	dnstapProtocolTCP = 2
+)
+
+// dnstapTimeout limits the time the handshakes with a dnstap receiver may take
+const dnstapTimeout = 5 * time.Second
+
+// dnstapLogger captures the DNS queries and responses in the dnstap format, and
+// writes them to a file or to a Frame Streams receiver listening on a socket.
+// Messages are queued, and dropped when the output can't keep up, so that a slow
+// receiver never delays the answers.
+type dnstapLogger struct {
+	network  string
+	address  string
+	identity []byte
+	messages chan []byte
+	dropped  atomic.Uint64
+	stop     chan struct{}
+	stopped  chan struct{}
+}
+
+func newDnstapLogger(config dnstapConfig) (*dnstapLogger, error) {
+	network, address, ok := strings.Cut(config.Output, ":")
+	if !ok || address == "" || (network != "file" && network != "unix" && network != "tcp") {
+		return nil, fmt.Errorf("invalid dnstap output %q, expected file:, unix: or tcp: followed by the path or address", config.Output)
+	}
+	identity := config.Identity
+	if identity == "" {
+		identity, _ = os.Hostname()
+	}
+	size := config.BufferSize
+	if size <= 0 {
+		size = 1024
+	}
+	return &dnstapLogger{
+		network:  network,
+		address:  address,
+		identity: []byte(identity),
+		messages: make(chan []byte, size),
+		stop:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}, nil
+}
+
+// LogExchange queues the query received by the server and its response
+func (t *dnstapLogger) LogExchange(w dns.ResponseWriter, query *dns.Msg, response *dns.Msg, received time.Time, sent time.Time) {
+	if t == nil {
+		return
+	}
+	queryMsg, err := query.Pack()
+	if err != nil {
+		return
+	}
+	msg := dnstapMessage{
+		queryTime:    received,
+		queryMessage: queryMsg,
+	}
+	msg.setAddresses(w.RemoteAddr(), w.LocalAddr())
+	msg.kind = dnstapAuthQuery
+	t.enqueue(msg.encode(t.identity))
+	if msg.responseMessage, err = response.Pack(); err != nil {
+		return
+	}
+	msg.kind = dnstapAuthResponse
+	msg.responseTime = sent
+	t.enqueue(msg.encode(t.identity))
+}
+
+func (t *dnstapLogger) enqueue(frame []byte) {
+	select {
+	case t.messages <- frame:
+	default:
+		t.dropped.Add(1)
+	}
+}
+
+// Run writes the queued messages until stopped, reconnecting to the receiver
+// when the output fails
+func (t *dnstapLogger) Run() {
+	defer close(t.stopped)
+	dnsLog.WithFields(log.Fields{"output": t.network + ":" + t.address}).Info("Writing dnstap messages")
+	retry := time.NewTimer(0)
+	defer retry.Stop()
+	for {
+		select {
+		case <-t.stop:
+			return
+		case <-retry.C:
+		}
+		out, err := t.open()
+		if err != nil {
+			// Messages are dropped until the receiver is back
+			dnsLog.WithFields(log.Fields{"error": err.Error(), "output": t.network + ":" + t.address}).Warning("Could not open dnstap output")
+			retry.Reset(10 * time.Second)
+			continue
+		}
+		err = t.write(out)
+		if err == nil {
+			return
+		}
+		if t.network == "file" {
+			// Reopening would overwrite the messages already written
+			dnsLog.WithFields(log.Fields{"error": err.Error(), "output": t.network + ":" + t.address}).Error("Could not write dnstap messages, capture stopped")
+			<-t.stop
+			return
+		}
+		dnsLog.WithFields(log.Fields{"error": err.Error(), "output": t.network + ":" + t.address}).Warning("Could not write dnstap messages")
+		retry.Reset(time.Second)
+	}
+}
+
+// Stop flushes the queued messages and closes the output
+func (t *dnstapLogger) Stop() {
+	close(t.stop)
+	<-t.stopped
+	if dropped := t.dropped.Load(); dropped > 0 {
+		dnsLog.WithFields(log.Fields{"dropped": dropped}).Warning("Dnstap messages were dropped while the output was too slow")
+	}
+}
+
+// dnstapOutput is an open output, bidirectional for the Frame Streams receivers
+// listening on sockets
+type dnstapOutput struct {
+	conn          io.ReadWriteCloser
+	bidirectional bool
+}
+
+func (t *dnstapLogger) open() (*dnstapOutput, error) {
+	if t.network == "file" {
+		f, err := os.OpenFile(t.address, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+		if err != nil {
+			return nil, err
+		}
+		return &dnstapOutput{conn: f}, nil
+	}
+	conn, err := net.DialTimeout(t.network, t.address, dnstapTimeout)
+	if err != nil {
+		return nil, err
+	}
+	out := &dnstapOutput{conn: conn, bidirectional: true}
+	// Agree on the content type before starting the stream
+	_ = conn.SetDeadline(time.Now().Add(dnstapTimeout))
+	if err = writeControlFrame(conn, fstrmControlReady); err == nil {
+		err = expectControlFrame(conn, fstrmControlAccept)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	_ = conn.SetDeadline(time.Time{})
+	return out, nil
+}
+
+// write writes a stream of the queued messages to the output, and returns nil
+// once stopped, or the error that broke the stream
+func (t *dnstapLogger) write(out *dnstapOutput) error {
+	defer out.conn.Close()
+	if err := writeControlFrame(out.conn, fstrmControlStart); err != nil {
+		return err
+	}
+	for {
+		select {
+		case frame := <-t.messages:
+			if err := writeDataFrame(out.conn, frame); err != nil {
+				return err
+			}
+		case <-t.stop:
+			for len(t.messages) > 0 {
+				if err := writeDataFrame(out.conn, <-t.messages); err != nil {
+					return nil
+				}
+			}
+			if err := writeControlFrame(out.conn, fstrmControlStop); err != nil || !out.bidirectional {
+				return nil
+			}
+			if conn, ok := out.conn.(net.Conn); ok {
+				_ = conn.SetDeadline(time.Now().Add(dnstapTimeout))
+			}
+			_ = expectControlFrame(out.conn, fstrmControlFinish)
+			return nil
+		}
+	}
+}
+
+// writeDataFrame writes a Frame Streams data frame
+func writeDataFrame(w io.Writer, payload []byte) error {
+	frame := binary.BigEndian.AppendUint32(nil, uint32(len(payload)))
+	_, err := w.Write(append(frame, payload...))
+	return err
+}
+
+// writeControlFrame writes a Frame Streams control frame, with the dnstap content
+// type unless it's a STOP or FINISH frame
+func writeControlFrame(w io.Writer, control uint32) error {
+	payload := binary.BigEndian.AppendUint32(nil, control)
+	if control != fstrmControlStop && control != fstrmControlFinish {
+		payload = binary.BigEndian.AppendUint32(payload, fstrmFieldContentType)
+		payload = binary.BigEndian.AppendUint32(payload, uint32(len(dnstapContentType)))
+		payload = append(payload, dnstapContentType...)
+	}
+	frame := binary.BigEndian.AppendUint32(nil, 0)
+	frame = binary.BigEndian.AppendUint32(frame, uint32(len(payload)))
+	_, err := w.Write(append(frame, payload...))
+	return err
+}
+
+// readFrame reads a Frame Streams frame, and returns the type and the content
+// type of control frames, or the payload of data frames
+func readFrame(r io.Reader) (control uint32, payload []byte, err error) {
+	var header [4]byte
+	if _, err = io.ReadFull(r, header[:]); err != nil {
+		return 0, nil, err
+	}
+	length := binary.BigEndian.Uint32(header[:])
+	isControl := length == 0
+	if isControl {
+		if _, err = io.ReadFull(r, header[:]); err != nil {
+			return 0, nil, err
+		}
+		length = binary.BigEndian.Uint32(header[:])
+	}
+	if length > dns.MaxMsgSize*4 {
+		return 0, nil, errors.New("dnstap frame too large")
+	}
+	payload = make([]byte, length)
+	if _, err = io.ReadFull(r, payload); err != nil {
+		return 0, nil, err
+	}
+	if !isControl {
+		return 0, payload, nil
+	}
+	if len(payload) < 4 {
+		return 0, nil, errors.New("truncated dnstap control frame")
+	}
+	control = binary.BigEndian.Uint32(payload)
+	var contentType []byte
+	for fields := payload[4:]; len(fields) >= 8; {
+		field, size := binary.BigEndian.Uint32(fields), binary.BigEndian.Uint32(fields[4:])
+		if uint32(len(fields)-8) < size {
+			return 0, nil, errors.New("truncated dnstap control frame")
+		}
+		if field == fstrmFieldContentType {
+			contentType = fields[8 : 8+size]
+		}
+		fields = fields[8+size:]
+	}
+	return control, contentType, nil
+}
+
+// expectControlFrame reads a control frame of the type from the receiver
+func expectControlFrame(r io.Reader, expected uint32) error {
+	control, contentType, err := readFrame(r)
+	if err != nil {
+		return err
+	}
+	if control != expected {
+		return fmt.Errorf("unexpected dnstap control frame %d", control)
+	}
+	if expected == fstrmControlAccept && !bytes.Equal(contentType, []byte(dnstapContentType)) {
+		return fmt.Errorf("dnstap receiver doesn't accept %s", dnstapContentType)
+	}
+	return nil
+}
+
+// dnstapMessage is the Message of dnstap.proto for an authoritative query or response
+type dnstapMessage struct {
+	kind            uint64
+	family          uint64
+	protocol        uint64
+	queryAddress    net.IP
+	queryPort       int
+	responseAddress net.IP
+	responsePort    int
+	queryTime       time.Time
+	queryMessage    []byte
+	responseTime    time.Time
+	responseMessage []byte
+}
+
+// setAddresses sets the addresses of the client and the server from the addresses
+// of the connection
+func (m *dnstapMessage) setAddresses(remote net.Addr, local net.Addr) {
+	m.protocol = dnstapProtocolUDP
+	switch addr := remote.(type) {
+	case *net.UDPAddr:
+		m.queryAddress, m.queryPort = addr.IP, addr.Port
+	case *net.TCPAddr:
+		m.protocol = dnstapProtocolTCP
+		m.queryAddress, m.queryPort = addr.IP, addr.Port
+	}
+	switch addr := local.(type) {
+	case *net.UDPAddr:
+		m.responseAddress, m.responsePort = addr.IP, addr.Port
+	case *net.TCPAddr:
+		m.responseAddress, m.responsePort = addr.IP, addr.Port
+	}
+	m.family = dnstapFamilyInet6
+	if ip4 := m.queryAddress.To4(); ip4 != nil {
+		m.family = dnstapFamilyInet
+		m.queryAddress = ip4
+		m.responseAddress = m.responseAddress.To4()
+	}
+}
+
+// encode returns the protobuf encoding of the Dnstap message wrapping m
+func (m *dnstapMessage) encode(identity []byte) []byte {
+	var msg []byte
+	msg = appendProtoVarint(msg, 1, m.kind)
+	msg = appendProtoVarint(msg, 2, m.family)
+	msg = appendProtoVarint(msg, 3, m.protocol)
+	if m.queryAddress != nil {
+		msg = appendProtoBytes(msg, 4, m.queryAddress)
+	}
+	if m.responseAddress != nil {
+		msg = appendProtoBytes(msg, 5, m.responseAddress)
+	}
+	msg = appendProtoVarint(msg, 6, uint64(m.queryPort))
+	msg = appendProtoVarint(msg, 7, uint64(m.responsePort))
+	msg = appendProtoVarint(msg, 8, uint64(m.queryTime.Unix()))
+	msg = appendProtoFixed32(msg, 9, uint32(m.queryTime.Nanosecond()))
+	msg = appendProtoBytes(msg, 10, m.queryMessage)
+	if m.kind == dnstapAuthResponse {
+		msg = appendProtoVarint(msg, 12, uint64(m.responseTime.Unix()))
+		msg = appendProtoFixed32(msg, 13, uint32(m.responseTime.Nanosecond()))
+		msg = appendProtoBytes(msg, 14, m.responseMessage)
+	}
+	var tap []byte
+	tap = appendProtoBytes(tap, 1, identity)
+	tap = appendProtoBytes(tap, 2, []byte("acme-dns"))
+	tap = appendProtoBytes(tap, 14, msg)
+	tap = appendProtoVarint(tap, 15, dnstapTypeMessage)
+	return tap
+}
+
+// appendProtoVarint appends a varint field in the protobuf wire format
+func appendProtoVarint(b []byte, field int, v uint64) []byte {
+	b = binary.AppendUvarint(b, uint64(field)<<3)
+	return binary.AppendUvarint(b, v)
+}
+
+// appendProtoBytes appends a length delimited field in the protobuf wire format
+func appendProtoBytes(b []byte, field int, v []byte) []byte {
+	b = binary.AppendUvarint(b, uint64(field)<<3|2)
+	b = binary.AppendUvarint(b, uint64(len(v)))
+	return append(b, v...)
+}
+
+// appendProtoFixed32 appends a fixed32 field in the protobuf wire format
+func appendProtoFixed32(b []byte, field int, v uint32) []byte {
+	b = binary.AppendUvarint(b, uint64(field)<<3|5)
+	return binary.LittleEndian.AppendUint32(b, v)
+}
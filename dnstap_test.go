@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// protoFields decodes the fields of a protobuf message into their raw values,
+// varints and fixed32 values being returned as their integer value
+func protoFields(t *testing.T, b []byte) map[int]interface{} {
+	t.Helper()
+	fields := make(map[int]interface{})
+	for len(b) > 0 {
+		tag, n := binary.Uvarint(b)
+		b = b[n:]
+		switch tag & 7 {
+		case 0:
+			v, n := binary.Uvarint(b)
+			fields[int(tag>>3)] = v
+			b = b[n:]
+		case 2:
+			size, n := binary.Uvarint(b)
+			fields[int(tag>>3)] = b[n : n+int(size)]
+			b = b[n+int(size):]
+		case 5:
+			fields[int(tag>>3)] = uint64(binary.LittleEndian.Uint32(b))
+			b = b[4:]
+		default:
+			t.Fatalf("Unexpected wire type %d", tag&7)
+		}
+	}
+	return fields
+}
+
+// startTappedServer starts a DNS server capturing its traffic to the dnstap
+// output, and returns its address and the capture
+func startTappedServer(t *testing.T, output string) (string, *dnstapLogger) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Could not listen [%v]", err)
+	}
+	config := Config
+	config.General.Listen = conn.LocalAddr().String()
+	config.General.AdditionalListen = nil
+	config.General.Proto = "udp"
+	config.General.Domain = "auth.example.org"
+	config.Dnstap = dnstapConfig{Output: output, Identity: "test-node"}
+	conn.Close()
+	server := newDNSServers(DB, config)[0]
+	if server.Tap == nil {
+		t.Fatalf("Expected the dnstap capture to be enabled")
+	}
+	go server.Tap.Run()
+	started := make(chan struct{})
+	server.Server.NotifyStartedFunc = func() { close(started) }
+	go server.Start(make(chan error, 1))
+	t.Cleanup(func() { _ = server.Server.Shutdown() })
+	<-started
+	return config.General.Listen, server.Tap
+}
+
+// checkTappedExchange checks the dnstap messages of a query for the name
+func checkTappedExchange(t *testing.T, frames [][]byte, name string) {
+	t.Helper()
+	if len(frames) != 2 {
+		t.Fatalf("Expected a query and a response message, got %d messages", len(frames))
+	}
+	for i, kind := range []uint64{dnstapAuthQuery, dnstapAuthResponse} {
+		tap := protoFields(t, frames[i])
+		if !bytes.Equal(tap[1].([]byte), []byte("test-node")) || tap[15] != uint64(dnstapTypeMessage) {
+			t.Errorf("Message %d: Unexpected dnstap envelope %v", i, tap)
+		}
+		msg := protoFields(t, tap[14].([]byte))
+		if msg[1] != kind || msg[2] != uint64(dnstapFamilyInet) || msg[3] != uint64(dnstapProtocolUDP) {
+			t.Errorf("Message %d: Unexpected message fields %v", i, msg)
+		}
+		if !net.IP(msg[4].([]byte)).Equal(net.IPv4(127, 0, 0, 1)) || msg[6] == uint64(0) || msg[7] == uint64(0) {
+			t.Errorf("Message %d: Unexpected addresses %v", i, msg)
+		}
+		query := new(dns.Msg)
+		if err := query.Unpack(msg[10].([]byte)); err != nil || query.Question[0].Name != name {
+			t.Errorf("Message %d: Unexpected query message [%v]", i, err)
+		}
+		_, hasResponse := msg[14]
+		if hasResponse != (kind == dnstapAuthResponse) {
+			t.Errorf("Message %d: Response message should only be in the response", i)
+		}
+		if hasResponse {
+			response := new(dns.Msg)
+			if err := response.Unpack(msg[14].([]byte)); err != nil || !response.Response || response.Rcode != dns.RcodeNameError {
+				t.Errorf("Message %d: Unexpected response message [%v]", i, err)
+			}
+		}
+	}
+}
+
+func TestDnstapFileOutput(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "acme-dns.dnstap")
+	addr, tap := startTappedServer(t, "file:"+path)
+	msg := new(dns.Msg)
+	msg.SetQuestion("nonexistent.auth.example.org.", dns.TypeTXT)
+	if _, _, err := new(dns.Client).Exchange(msg, addr); err != nil {
+		t.Fatalf("Got unexpected error [%v]", err)
+	}
+	tap.Stop()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Could not read dnstap file [%v]", err)
+	}
+	r := bytes.NewReader(data)
+	control, contentType, err := readFrame(r)
+	if err != nil || control != fstrmControlStart || string(contentType) != dnstapContentType {
+		t.Fatalf("Expected a START frame with the dnstap content type, got %d %q [%v]", control, contentType, err)
+	}
+	var frames [][]byte
+	for {
+		control, payload, err := readFrame(r)
+		if err != nil {
+			t.Fatalf("Got unexpected error [%v]", err)
+		}
+		if control == fstrmControlStop {
+			break
+		}
+		frames = append(frames, payload)
+	}
+	if r.Len() != 0 {
+		t.Errorf("Expected the stream to end with the STOP frame")
+	}
+	checkTappedExchange(t, frames, "nonexistent.auth.example.org.")
+}
+
+func TestDnstapSocketOutput(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dnstap.sock")
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatalf("Could not listen [%v]", err)
+	}
+	defer listener.Close()
+	received := make(chan [][]byte, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		var frames [][]byte
+		for {
+			control, payload, err := readFrame(conn)
+			if err != nil {
+				return
+			}
+			switch {
+			case control == fstrmControlReady:
+				_ = writeControlFrame(conn, fstrmControlAccept)
+			case control == fstrmControlStop:
+				_ = writeControlFrame(conn, fstrmControlFinish)
+				received <- frames
+				return
+			case control == 0:
+				frames = append(frames, payload)
+			}
+		}
+	}()
+
+	addr, tap := startTappedServer(t, "unix:"+path)
+	msg := new(dns.Msg)
+	msg.SetQuestion("other.auth.example.org.", dns.TypeA)
+	if _, _, err := new(dns.Client).Exchange(msg, addr); err != nil {
+		t.Fatalf("Got unexpected error [%v]", err)
+	}
+	// Let the stream start and the messages through before stopping
+	time.Sleep(100 * time.Millisecond)
+	tap.Stop()
+	select {
+	case frames := <-received:
+		checkTappedExchange(t, frames, "other.auth.example.org.")
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Receiver didn't get the stream")
+	}
+}
+
+func TestDnstapInvalidOutput(t *testing.T) {
+	for _, output := range []string{"/var/log/acme-dns.dnstap", "udp:127.0.0.1:6000", "file:"} {
+		if _, err := newDnstapLogger(dnstapConfig{Output: output}); err == nil {
+			t.Errorf("Expected an error for dnstap output %q", output)
+		}
+	}
+}
+
+func TestDnstapDropsWhenFull(t *testing.T) {
+	tap, err := newDnstapLogger(dnstapConfig{Output: "file:/nonexistent", BufferSize: 2})
+	if err != nil {
+		t.Fatalf("Got unexpected error [%v]", err)
+	}
+	for i := 0; i < 5; i++ {
+		tap.enqueue([]byte{byte(i)})
+	}
+	if dropped := tap.dropped.Load(); dropped != 3 {
+		t.Errorf("Expected 3 dropped messages, got %d", dropped)
+	}
+}
@@ -0,0 +1,391 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+)
+
+// updateTypes are the record types dynamic updates can change, by their names in
+// the allowed types of the registrations
+var updateTypes = map[uint16]string{
+	dns.TypeTXT:  "txt",
+	dns.TypeA:    "a",
+	dns.TypeAAAA: "aaaa",
+}
+
+// errUpdateRefused is returned by the changes of dynamic updates that are refused
+var errUpdateRefused = errors.New("dynamic update refused")
+
+// acceptMsg accepts dynamic updates in addition to the messages accepted by
+// default, which are queries and notifies with a single question
+func acceptMsg(dh dns.Header) dns.MsgAcceptAction {
+	response := dh.Bits&(1<<15) != 0
+	if opcode := int(dh.Bits>>11) & 0xF; opcode == dns.OpcodeUpdate && !response {
+		// The zone section holds a single zone
+		if dh.Qdcount != 1 {
+			return dns.MsgReject
+		}
+		return dns.MsgAccept
+	}
+	return dns.DefaultMsgAcceptFunc(dh)
+}
+
+// handleUpdate applies an RFC 2136 dynamic update signed with the TSIG key to the
+// records of the registration of the key, and returns the rcode of the response.
+// Only the name of the registration can be checked and changed.
+func (d *DNSServer) handleUpdate(w dns.ResponseWriter, r *dns.Msg, key string) int {
+	if len(r.Question) != 1 || r.Question[0].Qtype != dns.TypeSOA {
+		return dns.RcodeFormatError
+	}
+	if !d.servesZone(r.Question[0].Name) {
+		return dns.RcodeNotAuth
+	}
+	account, ok := d.TSIG.account(key)
+	if !ok {
+		dnsLog.WithFields(log.Fields{"key": key}).Debug("Dynamic update signed with a key without an account")
+		return dns.RcodeRefused
+	}
+	user, err := d.DB.GetByUsername(account)
+	if err != nil {
+		dnsLog.WithFields(log.Fields{"key": key, "error": err.Error()}).Warning("Could not get the registration of the TSIG key")
+		return dns.RcodeRefused
+	}
+	host, _, _ := net.SplitHostPort(w.RemoteAddr().String())
+	switch {
+	case user.Disabled || user.Canary:
+		dnsLog.WithFields(log.Fields{"key": key, "subdomain": user.Subdomain}).Warning("Dynamic update of a disabled registration")
+		return dns.RcodeRefused
+	case !user.allowedFrom(host):
+		dnsLog.WithFields(log.Fields{"key": key, "subdomain": user.Subdomain, "remote": host}).Warning("Dynamic update from an address not allowed for the registration")
+		return dns.RcodeRefused
+	case isProtected(user.Subdomain):
+		// Holding the update for approval needs the HTTP API
+		dnsLog.WithFields(log.Fields{"key": key, "subdomain": user.Subdomain}).Info("Dynamic update of a protected subdomain refused")
+		return dns.RcodeRefused
+	}
+	zone := dns.Fqdn(registrationZone(user))
+	if !strings.EqualFold(dns.Fqdn(r.Question[0].Name), zone) {
+		// The registration is updated in its own zone only
+		return dns.RcodeNotAuth
+	}
+	switch {
+	case readOnlyToggle.Enabled():
+		// Like the API requests changing data, refused for maintenance
+		dnsLog.WithFields(log.Fields{"key": key, "subdomain": user.Subdomain}).Info("Dynamic update refused in read-only mode")
+		return dns.RcodeRefused
+	case !Standby.IsPrimary():
+		dnsLog.WithFields(log.Fields{"key": key, "subdomain": user.Subdomain}).Info("Dynamic update refused on standby")
+		return dns.RcodeRefused
+	}
+	name := user.Subdomain + "." + zone
+	if rcode := d.checkUpdatePrerequisites(r.Answer, zone, name); rcode != dns.RcodeSuccess {
+		return rcode
+	}
+	if rcode := d.checkUpdates(r.Ns, zone, name, user); rcode != dns.RcodeSuccess {
+		return rcode
+	}
+	updates, err := d.DB.ChangeValues(user.Subdomain, func(current map[uint16][]string) ([]ACMETxtPost, error) {
+		updates := applyUpdates(user, current, r.Ns)
+		if len(updates) == 0 {
+			return nil, nil
+		}
+		if wait := UpdateThrottle.Wait(user.Subdomain); wait > 0 {
+			dnsLog.WithFields(log.Fields{"key": key, "subdomain": user.Subdomain, "wait": wait.String()}).Debug("Dynamic update within the minimum update interval")
+			return nil, errUpdateRefused
+		}
+		for i := range updates {
+			if code, details := validateRecordValues(&updates[i]); code != "" {
+				dnsLog.WithFields(log.Fields{"subdomain": user.Subdomain, "error": code, "details": details}).Debug("Bad dynamic update data")
+				return nil, errUpdateRefused
+			}
+		}
+		return updates, nil
+	})
+	if err == errUpdateRefused {
+		return dns.RcodeRefused
+	}
+	if err != nil {
+		dnsLog.WithFields(log.Fields{"subdomain": user.Subdomain, "error": err.Error()}).Error("Could not apply a dynamic update")
+		return dns.RcodeServerFailure
+	}
+	if len(updates) == 0 {
+		return dns.RcodeSuccess
+	}
+	UpdateThrottle.Updated(user.Subdomain)
+	if err = d.DB.MarkActive(user.Username); err != nil {
+		dnsLog.WithFields(log.Fields{"error": err.Error(), "subdomain": user.Subdomain}).Error("Could not update the last active time")
+	}
+	dnsLog.WithFields(log.Fields{"key": key, "subdomain": user.Subdomain}).Debug("Dynamic update applied")
+	Audit.Record(auditEvent{
+		Time:      time.Now().Unix(),
+		Action:    "update",
+		Actor:     user.Username.String(),
+		SourceIP:  host,
+		Subdomain: user.Subdomain,
+		Detail:    "DNS UPDATE signed with " + key,
+	})
+	event := webhookEvent{"update", user.Subdomain, updates[0].Value, updates[0].AValues, updates[0].AAAAValues, time.Now().Unix(), "", registrationZone(user)}
+	sendWebhooks(user.Webhooks, event)
+	runHooks(event)
+	ZoneSerial.Bump("update", user.Subdomain)
+	return dns.RcodeSuccess
+}
+
+// checkUpdatePrerequisites checks the prerequisite section of the update against
+// the records of the name in the zone (RFC 2136 section 3.2)
+func (d *DNSServer) checkUpdatePrerequisites(prereqs []dns.RR, zone string, name string) int {
+	expected := make(map[uint16][]dns.RR)
+	for _, rr := range prereqs {
+		h := rr.Header()
+		if h.Ttl != 0 {
+			return dns.RcodeFormatError
+		}
+		if !dns.IsSubDomain(zone, strings.ToLower(h.Name)) {
+			return dns.RcodeNotZone
+		}
+		if !strings.EqualFold(h.Name, name) {
+			return dns.RcodeRefused
+		}
+		switch h.Class {
+		case dns.ClassANY:
+			if h.Rdlength != 0 {
+				return dns.RcodeFormatError
+			}
+			if h.Rrtype == dns.TypeANY {
+				if d.countRecords(dns.Question{Name: name}) == 0 {
+					return dns.RcodeNameError
+				}
+			} else if len(d.rrset(name, h.Rrtype)) == 0 {
+				return dns.RcodeNXRrset
+			}
+		case dns.ClassNONE:
+			if h.Rdlength != 0 {
+				return dns.RcodeFormatError
+			}
+			if h.Rrtype == dns.TypeANY {
+				if d.countRecords(dns.Question{Name: name}) > 0 {
+					return dns.RcodeYXDomain
+				}
+			} else if len(d.rrset(name, h.Rrtype)) > 0 {
+				return dns.RcodeYXRrset
+			}
+		case dns.ClassINET:
+			expected[h.Rrtype] = append(expected[h.Rrtype], rr)
+		default:
+			return dns.RcodeFormatError
+		}
+	}
+	// The RRsets must match the values given exactly
+	for rrtype, rrs := range expected {
+		if !sameRRs(d.rrset(name, rrtype), rrs) {
+			return dns.RcodeNXRrset
+		}
+	}
+	return dns.RcodeSuccess
+}
+
+// checkUpdates prescans the update section (RFC 2136 section 3.4.1), allowing
+// only changes of the types the registration may update at its own name
+func (d *DNSServer) checkUpdates(updates []dns.RR, zone string, name string, user ACMETxt) int {
+	for _, rr := range updates {
+		h := rr.Header()
+		if !dns.IsSubDomain(zone, strings.ToLower(h.Name)) {
+			return dns.RcodeNotZone
+		}
+		switch h.Class {
+		case dns.ClassINET:
+			if h.Rrtype == dns.TypeANY || h.Rrtype == dns.TypeAXFR || h.Rrtype == dns.TypeIXFR {
+				return dns.RcodeFormatError
+			}
+		case dns.ClassANY:
+			if h.Ttl != 0 || h.Rdlength != 0 || h.Rrtype == dns.TypeAXFR || h.Rrtype == dns.TypeIXFR {
+				return dns.RcodeFormatError
+			}
+		case dns.ClassNONE:
+			if h.Ttl != 0 || h.Rrtype == dns.TypeANY || h.Rrtype == dns.TypeAXFR || h.Rrtype == dns.TypeIXFR {
+				return dns.RcodeFormatError
+			}
+		default:
+			return dns.RcodeFormatError
+		}
+		rtype, ok := updateTypes[h.Rrtype]
+		if !strings.EqualFold(h.Name, name) || (!ok && h.Rrtype != dns.TypeANY) || (ok && !user.allowedType(rtype)) {
+			dnsLog.WithFields(log.Fields{"subdomain": user.Subdomain, "name": h.Name, "type": dns.TypeToString[h.Rrtype]}).Debug("Dynamic update of a record not allowed for the registration")
+			return dns.RcodeRefused
+		}
+	}
+	return dns.RcodeSuccess
+}
+
+// rrset returns the records of the type answered for the name
+func (d *DNSServer) rrset(name string, rrtype uint16) []dns.RR {
+	var rrs []dns.RR
+	answer, _, _, _ := d.answer(dns.Question{Name: name, Qtype: rrtype, Qclass: dns.ClassINET})
+	for _, rr := range answer {
+		if rr.Header().Rrtype == rrtype {
+			rrs = append(rrs, rr)
+		}
+	}
+	return rrs
+}
+
+// sameRRs tells if the two sets of records hold the same data
+func sameRRs(a []dns.RR, b []dns.RR) bool {
+	contains := func(rrs []dns.RR, rr dns.RR) bool {
+		for _, r := range rrs {
+			if dns.IsDuplicate(r, rr) {
+				return true
+			}
+		}
+		return false
+	}
+	for _, rr := range a {
+		if !contains(b, rr) {
+			return false
+		}
+	}
+	for _, rr := range b {
+		if !contains(a, rr) {
+			return false
+		}
+	}
+	return true
+}
+
+// valueChange returns the database updates changing the current TXT, A and AAAA
+// values of a subdomain
+type valueChange func(current map[uint16][]string) ([]ACMETxtPost, error)
+
+// valuesByType returns the set TXT values and the addresses by record type
+func valuesByType(txts []string, a []net.IP, aaaa []net.IP) map[uint16][]string {
+	values := make(map[uint16][]string)
+	for _, txt := range txts {
+		if txt != "" {
+			values[dns.TypeTXT] = append(values[dns.TypeTXT], txt)
+		}
+	}
+	for rrtype, ips := range map[uint16][]net.IP{dns.TypeA: a, dns.TypeAAAA: aaaa} {
+		for _, ip := range ips {
+			if len(ip) > 0 {
+				values[rrtype] = append(values[rrtype], ip.String())
+			}
+		}
+	}
+	return values
+}
+
+// updateValue returns the value of the record as stored for the subdomain
+func updateValue(rr dns.RR) string {
+	switch v := rr.(type) {
+	case *dns.TXT:
+		return strings.Join(v.Txt, "")
+	case *dns.A:
+		return v.A.String()
+	case *dns.AAAA:
+		return v.AAAA.String()
+	}
+	return ""
+}
+
+// applyUpdates applies the prescanned update section in order to the current
+// values, and returns the database updates making the changes
+func applyUpdates(user ACMETxt, current map[uint16][]string, rrs []dns.RR) []ACMETxtPost {
+	values := copyValues(current)
+	for _, rr := range rrs {
+		h := rr.Header()
+		switch h.Class {
+		case dns.ClassINET:
+			if value := updateValue(rr); !containsString(values[h.Rrtype], value) {
+				values[h.Rrtype] = append(values[h.Rrtype], value)
+			}
+		case dns.ClassNONE:
+			values[h.Rrtype] = removeString(values[h.Rrtype], updateValue(rr))
+		case dns.ClassANY:
+			for rrtype, rtype := range updateTypes {
+				if (h.Rrtype == dns.TypeANY && user.allowedType(rtype)) || h.Rrtype == rrtype {
+					values[rrtype] = nil
+				}
+			}
+		}
+	}
+	return valueUpdates(user.Subdomain, current, values)
+}
+
+// copyValues returns a copy of the values by record type
+func copyValues(current map[uint16][]string) map[uint16][]string {
+	values := make(map[uint16][]string)
+	for rrtype, v := range current {
+		values[rrtype] = append([]string{}, v...)
+	}
+	return values
+}
+
+// removeString returns the list without the value
+func removeString(list []string, value string) []string {
+	var kept []string
+	for _, v := range list {
+		if v != value {
+			kept = append(kept, v)
+		}
+	}
+	return kept
+}
+
+// valueUpdates returns the database updates changing the current TXT, A and AAAA
+// values of the subdomain to the new ones. The first update clears the deleted
+// TXT values and replaces the addresses, each added TXT value takes a slot of
+// its own.
+func valueUpdates(subdomain string, current map[uint16][]string, values map[uint16][]string) []ACMETxtPost {
+	first := ACMETxtPost{Subdomain: subdomain}
+	var added []string
+	for _, v := range current[dns.TypeTXT] {
+		if !containsString(values[dns.TypeTXT], v) {
+			first.ClearTXT = append(first.ClearTXT, v)
+		}
+	}
+	for _, v := range values[dns.TypeTXT] {
+		if !containsString(current[dns.TypeTXT], v) {
+			added = append(added, v)
+		}
+	}
+	changedA := !sameStrings(current[dns.TypeA], values[dns.TypeA])
+	changedAAAA := !sameStrings(current[dns.TypeAAAA], values[dns.TypeAAAA])
+	if len(first.ClearTXT) == 0 && len(added) == 0 && !changedA && !changedAAAA {
+		return nil
+	}
+	if changedA {
+		first.AValues = values[dns.TypeA]
+		first.ClearA = len(first.AValues) == 0
+	}
+	if changedAAAA {
+		first.AAAAValues = values[dns.TypeAAAA]
+		first.ClearAAAA = len(first.AAAAValues) == 0
+	}
+	updates := []ACMETxtPost{first}
+	for i, v := range added {
+		if i == 0 {
+			updates[0].Value = v
+			continue
+		}
+		updates = append(updates, ACMETxtPost{Subdomain: subdomain, Value: v})
+	}
+	return updates
+}
+
+// sameStrings tells if the two lists hold the same values in any order
+func sameStrings(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for _, v := range a {
+		if !containsString(b, v) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestDynamicUpdate(t *testing.T) {
+	reg, err := DB.Register(cidrslice{}, registrationOrigin{Zone: "auth.example.org"}, ACMETxtPost{})
+	if err != nil {
+		t.Fatalf("Could not register: %v", err)
+	}
+	other, _ := DB.Register(cidrslice{}, registrationOrigin{Zone: "auth.example.org"}, ACMETxtPost{})
+	config := Config
+	config.General.Listen = "127.0.0.1:15358"
+	config.General.AdditionalListen = nil
+	config.General.Proto = "tcp"
+	config.General.Domain = "auth.example.org"
+	config.General.StaticRecords = []string{"auth.example.org. A 192.168.1.100"}
+	config.TSIG.Keys = []tsigKey{
+		{"router.", "hmac-sha256", testTSIGSecret, reg.Username.String()},
+		{"transfer.", "hmac-sha256", testTSIGSecret, ""},
+	}
+	servers := newDNSServers(DB, config)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	servers[0].Server.NotifyStartedFunc = wg.Done
+	go servers[0].Start(make(chan error, 1))
+	wg.Wait()
+	defer func() { _ = servers[0].Server.Shutdown() }()
+
+	name := reg.Subdomain + ".auth.example.org."
+	first := "LHDhK3oGRvkiefQnx7OOczTY5Tic_xZ6HcMOc_gmtoM"
+	second := "tnYAy4oX-5tkvfQ6tP6n_4GArtf0Ds5V7gpp_qLsyJo"
+	rr := func(s string) dns.RR {
+		parsed, err := dns.NewRR(s)
+		if err != nil {
+			t.Fatalf("Could not parse %s: %v", s, err)
+		}
+		return parsed
+	}
+	client := &dns.Client{Net: "tcp", TsigSecret: map[string]string{"router.": testTSIGSecret, "transfer.": testTSIGSecret}}
+	for i, test := range []struct {
+		key    string
+		zone   string
+		prereq func(*dns.Msg)
+		update func(*dns.Msg)
+		rcode  int
+		txt    []string
+		a      []string
+	}{
+		{"router.", "auth.example.org.", nil, func(m *dns.Msg) {
+			m.Insert([]dns.RR{rr(name + " 60 IN TXT " + first), rr(name + " 60 IN A 10.0.0.1")})
+		}, dns.RcodeSuccess, []string{first}, []string{"10.0.0.1"}},
+		// The old value is replaced, the addresses are kept
+		{"router.", "auth.example.org.", func(m *dns.Msg) {
+			m.Used([]dns.RR{rr(name + " 0 IN TXT " + first)})
+		}, func(m *dns.Msg) {
+			m.Remove([]dns.RR{rr(name + " 0 IN TXT " + first)})
+			m.Insert([]dns.RR{rr(name + " 60 IN TXT " + second)})
+		}, dns.RcodeSuccess, []string{second}, []string{"10.0.0.1"}},
+		// The prerequisite doesn't hold anymore
+		{"router.", "auth.example.org.", func(m *dns.Msg) {
+			m.Used([]dns.RR{rr(name + " 0 IN TXT " + first)})
+		}, func(m *dns.Msg) {
+			m.RemoveRRset([]dns.RR{rr(name + " 0 IN TXT \"\"")})
+		}, dns.RcodeNXRrset, []string{second}, []string{"10.0.0.1"}},
+		{"router.", "auth.example.org.", nil, func(m *dns.Msg) {
+			m.RemoveRRset([]dns.RR{rr(name + " 0 IN A 0.0.0.0")})
+		}, dns.RcodeSuccess, []string{second}, nil},
+		// Only the records of the registration of the key can be changed
+		{"router.", "auth.example.org.", nil, func(m *dns.Msg) {
+			m.Insert([]dns.RR{rr(other.Subdomain + ".auth.example.org. 60 IN A 10.0.0.2")})
+		}, dns.RcodeRefused, []string{second}, nil},
+		{"router.", "auth.example.org.", nil, func(m *dns.Msg) {
+			m.Insert([]dns.RR{rr(name + " 60 IN MX 10 mail.example.org.")})
+		}, dns.RcodeRefused, []string{second}, nil},
+		{"transfer.", "auth.example.org.", nil, func(m *dns.Msg) {
+			m.Insert([]dns.RR{rr(name + " 60 IN A 10.0.0.3")})
+		}, dns.RcodeRefused, []string{second}, nil},
+		{"router.", "example.com.", nil, func(m *dns.Msg) {
+			m.Insert([]dns.RR{rr(name + " 60 IN A 10.0.0.3")})
+		}, dns.RcodeNotAuth, []string{second}, nil},
+		{"router.", "auth.example.org.", nil, func(m *dns.Msg) {
+			m.Insert([]dns.RR{rr("www.example.com. 60 IN A 10.0.0.3")})
+		}, dns.RcodeNotZone, []string{second}, nil},
+		// TXT values are ACME tokens, as with the HTTP API
+		{"router.", "auth.example.org.", nil, func(m *dns.Msg) {
+			m.Insert([]dns.RR{rr(name + " 60 IN TXT \"not a token\"")})
+		}, dns.RcodeRefused, []string{second}, nil},
+	} {
+		m := new(dns.Msg)
+		m.SetUpdate(test.zone)
+		if test.prereq != nil {
+			test.prereq(m)
+		}
+		test.update(m)
+		m.SetTsig(test.key, dns.HmacSHA256, 300, time.Now().Unix())
+		r, _, err := client.Exchange(m, "127.0.0.1:15358")
+		if r == nil {
+			t.Fatalf("Test %d: No response: %v", i, err)
+		}
+		// NOTAUTH responses can't be verified by the client
+		if err != nil && test.rcode != dns.RcodeNotAuth {
+			t.Errorf("Test %d: Expected a valid signature of the response, got %v", i, err)
+		}
+		if r.Rcode != test.rcode {
+			t.Errorf("Test %d: Expected rcode %s, got %s", i, dns.RcodeToString[test.rcode], dns.RcodeToString[r.Rcode])
+		}
+		txts, _ := DB.GetTXTForDomain(reg.Subdomain)
+		if served := servedTXT(txts); !sameStrings(served, test.txt) {
+			t.Errorf("Test %d: Expected TXT values %v, got %v", i, test.txt, served)
+		}
+		ips, _ := DB.GetAForDomain(reg.Subdomain)
+		var a []string
+		for _, ip := range ips {
+			a = append(a, ip.String())
+		}
+		if !sameStrings(a, test.a) {
+			t.Errorf("Test %d: Expected A values %v, got %v", i, test.a, a)
+		}
+	}
+	if ips, _ := DB.GetAForDomain(other.Subdomain); len(ips) != 0 {
+		t.Errorf("Expected the records of the other registration to be unchanged, got %v", ips)
+	}
+}
+
+// signedAddressUpdate returns a function applying an update of the A record of a new
+// registration signed with its TSIG key, and the registration
+func signedAddressUpdate(t *testing.T) (func() int, ACMETxt) {
+	reg, err := DB.Register(cidrslice{}, registrationOrigin{Zone: "auth.example.org"}, ACMETxtPost{})
+	if err != nil {
+		t.Fatalf("Could not register: %v", err)
+	}
+	config := Config
+	config.General.Domain = "auth.example.org"
+	config.General.AdditionalListen = nil
+	config.TSIG.Keys = []tsigKey{{"router.", "hmac-sha256", testTSIGSecret, reg.Username.String()}}
+	server := newDNSServers(DB, config)[0]
+	return func() int {
+		m := new(dns.Msg)
+		m.SetUpdate("auth.example.org.")
+		m.Insert([]dns.RR{&dns.A{Hdr: dns.RR_Header{Name: reg.Subdomain + ".auth.example.org.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60}, A: net.ParseIP("10.0.0.1")}})
+		w := &recordingWriter{remote: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5353}}
+		return server.handleUpdate(w, m, "router.")
+	}, reg
+}
+
+func TestDynamicUpdateReadOnly(t *testing.T) {
+	update, reg := signedAddressUpdate(t)
+	readOnlyToggle.set(true)
+	defer readOnlyToggle.set(false)
+	if rcode := update(); rcode != dns.RcodeRefused {
+		t.Errorf("Expected the update to be refused in read-only mode, got %s", dns.RcodeToString[rcode])
+	}
+	if ips, _ := DB.GetAForDomain(reg.Subdomain); len(ips) != 0 {
+		t.Errorf("Expected the records to be unchanged, got %v", ips)
+	}
+}
+
+func TestDynamicUpdateStandby(t *testing.T) {
+	update, reg := signedAddressUpdate(t)
+	oldStandby := Standby
+	defer func() { Standby = oldStandby }()
+	Standby = newStandbyCoordinator(DB, standby{NodeName: "update-node", LeaseDuration: 30})
+	if rcode := update(); rcode != dns.RcodeRefused {
+		t.Errorf("Expected the update to be refused on standby, got %s", dns.RcodeToString[rcode])
+	}
+	if ips, _ := DB.GetAForDomain(reg.Subdomain); len(ips) != 0 {
+		t.Errorf("Expected the records to be unchanged, got %v", ips)
+	}
+	Standby.primary.Store(true)
+	if rcode := update(); rcode != dns.RcodeSuccess {
+		t.Errorf("Expected the update to be applied by the primary, got %s", dns.RcodeToString[rcode])
+	}
+}
+
+func TestApplyUpdatesAddsTXTInSlots(t *testing.T) {
+	user := ACMETxt{ACMETxtPost: ACMETxtPost{Subdomain: "sub"}, AllowedTypes: []string{"txt"}}
+	current := map[uint16][]string{dns.TypeTXT: {"old"}, dns.TypeA: {"10.0.0.1"}}
+	updates := applyUpdates(user, current, []dns.RR{
+		&dns.TXT{Hdr: dns.RR_Header{Name: "sub.auth.example.org.", Rrtype: dns.TypeTXT, Class: dns.ClassANY}},
+		&dns.TXT{Hdr: dns.RR_Header{Name: "sub.auth.example.org.", Rrtype: dns.TypeTXT, Class: dns.ClassINET}, Txt: []string{"one"}},
+		&dns.TXT{Hdr: dns.RR_Header{Name: "sub.auth.example.org.", Rrtype: dns.TypeTXT, Class: dns.ClassINET}, Txt: []string{"two"}},
+		// Deleting all the records leaves the types the registration can't update
+		&dns.ANY{Hdr: dns.RR_Header{Name: "sub.auth.example.org.", Rrtype: dns.TypeANY, Class: dns.ClassANY}},
+		&dns.TXT{Hdr: dns.RR_Header{Name: "sub.auth.example.org.", Rrtype: dns.TypeTXT, Class: dns.ClassINET}, Txt: []string{"three"}},
+	})
+	if len(updates) != 1 {
+		t.Fatalf("Expected a single update, got %+v", updates)
+	}
+	if updates[0].Value != "three" || len(updates[0].ClearTXT) != 1 || updates[0].ClearTXT[0] != "old" || updates[0].ClearA {
+		t.Errorf("Unexpected update %+v", updates[0])
+	}
+
+	updates = applyUpdates(user, current, []dns.RR{
+		&dns.TXT{Hdr: dns.RR_Header{Name: "sub.auth.example.org.", Rrtype: dns.TypeTXT, Class: dns.ClassINET}, Txt: []string{"one"}},
+		&dns.TXT{Hdr: dns.RR_Header{Name: "sub.auth.example.org.", Rrtype: dns.TypeTXT, Class: dns.ClassINET}, Txt: []string{"two"}},
+	})
+	if len(updates) != 2 || updates[0].Value != "one" || updates[1].Value != "two" || len(updates[0].ClearTXT) != 0 {
+		t.Errorf("Expected each added value in an update of its own, got %+v", updates)
+	}
+	if updates = applyUpdates(user, current, []dns.RR{&dns.TXT{Hdr: dns.RR_Header{Name: "sub.auth.example.org.", Rrtype: dns.TypeTXT, Class: dns.ClassINET}, Txt: []string{"old"}}}); updates != nil {
+		t.Errorf("Expected no changes for an existing value, got %+v", updates)
+	}
+}
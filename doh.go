@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+)
+
+// dohPath is the path of the DNS-over-HTTPS endpoint
+const dohPath = "/dns-query"
+
+// dohContentType is the media type of DNS messages over HTTPS
+const dohContentType = "application/dns-message"
+
+// DoHServer answers the DNS-over-HTTPS queries of the API, nil if disabled
+var DoHServer *DNSServer
+
+// dohWriter collects the response of the nameserver to a DNS-over-HTTPS query
+type dohWriter struct {
+	local  net.Addr
+	remote net.Addr
+	msg    []byte
+}
+
+func (w *dohWriter) LocalAddr() net.Addr  { return w.local }
+func (w *dohWriter) RemoteAddr() net.Addr { return w.remote }
+
+func (w *dohWriter) WriteMsg(m *dns.Msg) error {
+	packed, err := m.Pack()
+	if err != nil {
+		return err
+	}
+	w.msg = packed
+	return nil
+}
+
+func (w *dohWriter) Write(b []byte) (int, error) {
+	w.msg = append([]byte{}, b...)
+	return len(b), nil
+}
+
+func (w *dohWriter) Close() error { return nil }
+
+// TsigStatus fails the signed queries, the secrets are known to the DNS servers only
+func (w *dohWriter) TsigStatus() error { return dns.ErrSecret }
+
+func (w *dohWriter) TsigTimersOnly(bool) {}
+func (w *dohWriter) Hijack()             {}
+
+// webDNSQuery answers RFC 8484 DNS-over-HTTPS queries, sent base64url encoded in
+// the dns parameter of GET requests or as the body of POST requests
+func webDNSQuery(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	if DoHServer == nil {
+		WriteJsonResponse(w, http.StatusNotFound, jsonError("not_found"))
+		return
+	}
+	var packed []byte
+	var err error
+	if r.Method == http.MethodPost {
+		if r.Header.Get("Content-Type") != dohContentType {
+			WriteJsonResponse(w, http.StatusUnsupportedMediaType, jsonError("unsupported_media_type"))
+			return
+		}
+		packed, err = io.ReadAll(http.MaxBytesReader(w, r.Body, dns.MaxMsgSize))
+	} else {
+		packed, err = base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns"))
+	}
+	query := new(dns.Msg)
+	if err == nil {
+		err = query.Unpack(packed)
+	}
+	if err != nil || len(packed) == 0 {
+		apiLog.WithFields(log.Fields{"remote": getRequestIP(r)}).Debug("Malformed DNS-over-HTTPS query")
+		WriteJsonResponse(w, http.StatusBadRequest, jsonError("bad_request"))
+		return
+	}
+	writer := &dohWriter{local: &net.TCPAddr{}, remote: &net.TCPAddr{IP: net.ParseIP(getRequestIP(r))}}
+	if local, ok := r.Context().Value(http.LocalAddrContextKey).(*net.TCPAddr); ok {
+		writer.local = local
+	}
+	DoHServer.handleRequest(writer, query)
+	if writer.msg == nil {
+		WriteJsonResponse(w, http.StatusInternalServerError, jsonError("context_error"))
+		return
+	}
+	response := new(dns.Msg)
+	if err = response.Unpack(writer.msg); err == nil {
+		if ttl, ok := dohMaxAge(response); ok {
+			w.Header().Set("Cache-Control", "max-age="+strconv.Itoa(int(ttl)))
+		}
+	}
+	w.Header().Set("Content-Type", dohContentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(writer.msg)))
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(writer.msg)
+}
+
+// dohMaxAge returns the time the response can be cached for, the lowest TTL of its
+// records, or of the SOA record and its minimum TTL for negative answers
+func dohMaxAge(m *dns.Msg) (uint32, bool) {
+	var ttl uint32
+	found := false
+	lower := func(t uint32) {
+		if !found || t < ttl {
+			ttl = t
+			found = true
+		}
+	}
+	for _, rr := range append(m.Answer[:len(m.Answer):len(m.Answer)], m.Ns...) {
+		lower(rr.Header().Ttl)
+		if soa, ok := rr.(*dns.SOA); ok {
+			lower(soa.Minttl)
+		}
+	}
+	return ttl, found
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestDNSOverHTTPS(t *testing.T) {
+	config := Config
+	config.General.Domain = "auth.example.org"
+	config.General.StaticRecords = []string{
+		"auth.example.org. A 192.168.1.100",
+		"auth.example.org. SOA ns1.auth.example.org. admin.example.org. 2023111422 28800 7200 604800 86400",
+	}
+	DoHServer = NewDNSServer(DB, "", "udp", config.General.Domain)
+	DoHServer.ParseRecords(config)
+	defer func() { DoHServer = nil }()
+
+	query := func(name string, qtype uint16) []byte {
+		m := new(dns.Msg)
+		m.SetQuestion(name, qtype)
+		packed, _ := m.Pack()
+		return packed
+	}
+	for i, test := range []struct {
+		method      string
+		contentType string
+		body        []byte
+		status      int
+		rcode       int
+		answers     int
+		maxAge      string
+	}{
+		{http.MethodGet, "", query("auth.example.org.", dns.TypeA), http.StatusOK, dns.RcodeSuccess, 1, "max-age=3600"},
+		{http.MethodPost, dohContentType, query("auth.example.org.", dns.TypeA), http.StatusOK, dns.RcodeSuccess, 1, "max-age=3600"},
+		// Negative answers are cached for the minimum TTL of the SOA record
+		{http.MethodGet, "", query("none.auth.example.org.", dns.TypeA), http.StatusOK, dns.RcodeNameError, 0, "max-age=3600"},
+		{http.MethodPost, "application/json", query("auth.example.org.", dns.TypeA), http.StatusUnsupportedMediaType, 0, 0, ""},
+		{http.MethodPost, dohContentType, []byte("not a query"), http.StatusBadRequest, 0, 0, ""},
+		{http.MethodGet, "", nil, http.StatusBadRequest, 0, 0, ""},
+	} {
+		var req *http.Request
+		if test.method == http.MethodGet {
+			req = httptest.NewRequest(test.method, dohPath+"?dns="+base64.RawURLEncoding.EncodeToString(test.body), nil)
+		} else {
+			req = httptest.NewRequest(test.method, dohPath, bytes.NewReader(test.body))
+			req.Header.Set("Content-Type", test.contentType)
+		}
+		w := httptest.NewRecorder()
+		webDNSQuery(w, req, nil)
+		if w.Code != test.status {
+			t.Errorf("Test %d: Expected status %d, got %d", i, test.status, w.Code)
+			continue
+		}
+		if test.status != http.StatusOK {
+			continue
+		}
+		if ct := w.Header().Get("Content-Type"); ct != dohContentType {
+			t.Errorf("Test %d: Expected content type %s, got %s", i, dohContentType, ct)
+		}
+		if cc := w.Header().Get("Cache-Control"); cc != test.maxAge {
+			t.Errorf("Test %d: Expected Cache-Control %q, got %q", i, test.maxAge, cc)
+		}
+		r := new(dns.Msg)
+		if err := r.Unpack(w.Body.Bytes()); err != nil {
+			t.Fatalf("Test %d: Could not unpack the response: %v", i, err)
+		}
+		if r.Rcode != test.rcode || len(r.Answer) != test.answers {
+			t.Errorf("Test %d: Expected rcode %s with %d answers, got %s with %d", i, dns.RcodeToString[test.rcode], test.answers, dns.RcodeToString[r.Rcode], len(r.Answer))
+		}
+	}
+
+	DoHServer = nil
+	w := httptest.NewRecorder()
+	webDNSQuery(w, httptest.NewRequest(http.MethodGet, dohPath+"?dns="+base64.RawURLEncoding.EncodeToString(query("auth.example.org.", dns.TypeA)), nil), nil)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected status 404 when disabled, got %d", w.Code)
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+)
+
+// maxSubnetAnswers is the maximum number of subnets a registration answers for
+const maxSubnetAnswers = 64
+
+// clientSubnetOption returns the EDNS Client Subnet option of the query, nil if
+// there is none
+func clientSubnetOption(opt *dns.OPT) *dns.EDNS0_SUBNET {
+	if opt == nil {
+		return nil
+	}
+	for _, o := range opt.Option {
+		if ecs, ok := o.(*dns.EDNS0_SUBNET); ok {
+			return ecs
+		}
+	}
+	return nil
+}
+
+// matchSubnetAnswer returns the answer of the most specific subnet containing the
+// client subnet, and the prefix length of that subnet. Subnets longer than the
+// prefix the client revealed don't match, as the client may be outside of them.
+func matchSubnetAnswer(answers []subnetAnswer, ip net.IP, prefix int) (subnetAnswer, int, bool) {
+	var match subnetAnswer
+	matchOnes := -1
+	for _, answer := range answers {
+		_, subnet, err := net.ParseCIDR(answer.Subnet)
+		if err != nil {
+			continue
+		}
+		ones, bits := subnet.Mask.Size()
+		if (bits == 32) != (ip.To4() != nil) || ones > prefix || !subnet.Contains(ip) {
+			continue
+		}
+		if ones > matchOnes {
+			match, matchOnes = answer, ones
+		}
+	}
+	return match, matchOnes, matchOnes >= 0
+}
+
+// answerClientSubnet replaces the A or AAAA records of the registration in the
+// answer with the addresses of the subnet of the client, taken from the EDNS
+// Client Subnet option of the query (RFC 7871), or the address of the querying
+// resolver without one. The option is echoed with the scope the answer is valid for.
+func (d *DNSServer) answerClientSubnet(w dns.ResponseWriter, r *dns.Msg, m *dns.Msg) {
+	ecs := clientSubnetOption(r.IsEdns0())
+	ip, prefix := addrIP(w.RemoteAddr()), 128
+	if ecs != nil {
+		ip, prefix = ecs.Address, int(ecs.SourceNetmask)
+	}
+	if ip != nil && ip.To4() != nil {
+		ip = ip.To4()
+		prefix = min(prefix, 32)
+	}
+	scope := 0
+	if len(m.Question) == 1 && ip != nil && (m.Question[0].Qtype == dns.TypeA || m.Question[0].Qtype == dns.TypeAAAA) {
+		scope = d.replaceSubnetAnswers(m, ip, prefix)
+	}
+	if ecs == nil {
+		return
+	}
+	if opt := m.IsEdns0(); opt != nil {
+		opt.Option = append(opt.Option, &dns.EDNS0_SUBNET{
+			Code:          dns.EDNS0SUBNET,
+			Family:        ecs.Family,
+			SourceNetmask: ecs.SourceNetmask,
+			SourceScope:   uint8(scope),
+			Address:       ecs.Address,
+		})
+	}
+}
+
+// replaceSubnetAnswers replaces the addresses of the answer with those of the
+// subnet of the client, and returns the scope prefix length of the answer, zero
+// if it's the same for every client
+func (d *DNSServer) replaceSubnetAnswers(m *dns.Msg, ip net.IP, prefix int) int {
+	q := m.Question[0]
+	subdomain := sanitizeDomainQuestion(q.Name)
+	if owner := d.wildcardOwner(q.Name); owner != "" {
+		subdomain = sanitizeDomainQuestion(owner)
+	}
+	var ttl uint32
+	found := false
+	for _, rr := range m.Answer {
+		if rr.Header().Rrtype == q.Qtype && strings.EqualFold(rr.Header().Name, q.Name) {
+			ttl, found = rr.Header().Ttl, true
+			break
+		}
+	}
+	if !found {
+		return 0
+	}
+	answers, err := d.DB.GetSubnetAnswersForDomain(subdomain)
+	if err != nil {
+		dnsLog.WithFields(log.Fields{"error": err.Error(), "subdomain": subdomain}).Debug("Error while trying to get the subnet answers")
+		return 0
+	}
+	if len(answers) == 0 {
+		return 0
+	}
+	answer, scope, ok := matchSubnetAnswer(answers, ip, prefix)
+	if !ok {
+		// The default addresses are answered to the whole subnet of the client
+		return prefix
+	}
+	addresses := answer.A
+	if q.Qtype == dns.TypeAAAA {
+		addresses = answer.AAAA
+	}
+	if len(addresses) == 0 {
+		return scope
+	}
+	var rrs []dns.RR
+	for _, rr := range m.Answer {
+		if rr.Header().Rrtype != q.Qtype || !strings.EqualFold(rr.Header().Name, q.Name) {
+			rrs = append(rrs, rr)
+		}
+	}
+	hdr := dns.RR_Header{Name: q.Name, Rrtype: q.Qtype, Class: dns.ClassINET, Ttl: ttl}
+	for _, v := range addresses {
+		if q.Qtype == dns.TypeA {
+			rrs = append(rrs, &dns.A{Hdr: hdr, A: net.ParseIP(v).To4()})
+		} else {
+			rrs = append(rrs, &dns.AAAA{Hdr: hdr, AAAA: net.ParseIP(v)})
+		}
+	}
+	m.Answer = rrs
+	dnsLog.WithFields(log.Fields{"qtype": dns.TypeToString[q.Qtype], "domain": q.Name, "subnet": answer.Subnet}).Debug("Answering question with the addresses of the client subnet")
+	return scope
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestMatchSubnetAnswer(t *testing.T) {
+	answers := []subnetAnswer{
+		{Subnet: "10.0.0.0/8", A: []string{"192.0.2.1"}},
+		{Subnet: "10.1.0.0/16", A: []string{"192.0.2.2"}},
+		{Subnet: "2001:db8::/32", AAAA: []string{"2001:db8::1"}},
+	}
+	for i, test := range []struct {
+		ip     string
+		prefix int
+		subnet string
+		scope  int
+	}{
+		{"10.1.2.0", 24, "10.1.0.0/16", 16},
+		{"10.2.0.0", 24, "10.0.0.0/8", 8},
+		// The client revealed too little to tell if it's in 10.1.0.0/16
+		{"10.1.0.0", 12, "10.0.0.0/8", 8},
+		{"2001:db8:1::", 48, "2001:db8::/32", 32},
+		{"192.0.2.0", 24, "", -1},
+	} {
+		answer, scope, ok := matchSubnetAnswer(answers, net.ParseIP(test.ip).To16(), test.prefix)
+		if ok != (test.subnet != "") || answer.Subnet != test.subnet || scope != test.scope {
+			t.Errorf("Test %d: expected %q with scope %d, got %q with scope %d", i, test.subnet, test.scope, answer.Subnet, scope)
+		}
+	}
+	if details := validateSubnetAnswers([]subnetAnswer{{Subnet: "10.0.0.0/33", A: []string{"2001:db8::1"}}, {Subnet: "10.0.0.0/8"}}); len(details) != 3 {
+		t.Errorf("Expected 3 invalid fields, got %v", details)
+	}
+}
+
+func TestClientSubnetAnswers(t *testing.T) {
+	reg, err := DB.Register(cidrslice{}, registrationOrigin{}, ACMETxtPost{AValues: []string{"198.51.100.1"}})
+	if err != nil {
+		t.Fatalf("Registration failed, got error [%v]", err)
+	}
+	settings := reg.Settings()
+	settings.SubnetAnswers = []subnetAnswer{{Subnet: "10.0.0.0/8", A: []string{"10.1.2.3", "10.1.2.4"}}}
+	if err = DB.UpdateSettings(reg.Username, settings); err != nil {
+		t.Fatalf("Could not update the settings, got error [%v]", err)
+	}
+	config := Config
+	config.General.Domain = "auth.example.org"
+	config.General.ZoneFiles = nil
+	config.General.StaticRecords = nil
+	config.Zones = nil
+	server := NewDNSServer(DB, "", "udp", config.General.Domain)
+	server.ParseRecords(config)
+	server.ClientSubnet = true
+	name := reg.Subdomain + ".auth.example.org."
+	var remote net.Addr
+	query := func(subnet string, prefix uint8) *dns.Msg {
+		req := new(dns.Msg)
+		req.SetQuestion(name, dns.TypeA)
+		req.SetEdns0(1232, false)
+		if subnet != "" {
+			opt := req.IsEdns0()
+			opt.Option = append(opt.Option, &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: prefix, Address: net.ParseIP(subnet)})
+		}
+		w := &recordingWriter{local: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53}, remote: remote}
+		server.handleRequest(w, req)
+		if w.msg == nil {
+			t.Fatalf("No response written for %s", subnet)
+		}
+		return w.msg
+	}
+	scope := func(m *dns.Msg) int {
+		if ecs := clientSubnetOption(m.IsEdns0()); ecs != nil {
+			return int(ecs.SourceScope)
+		}
+		return -1
+	}
+
+	m := query("10.20.30.0", 24)
+	if len(m.Answer) != 2 || m.Answer[0].(*dns.A).A.String() != "10.1.2.3" || scope(m) != 8 {
+		t.Errorf("Expected the addresses of the subnet with scope 8, got %v with scope %d", m.Answer, scope(m))
+	}
+	m = query("192.0.2.0", 24)
+	if len(m.Answer) != 1 || m.Answer[0].(*dns.A).A.String() != "198.51.100.1" || scope(m) != 24 {
+		t.Errorf("Expected the default address with scope 24, got %v with scope %d", m.Answer, scope(m))
+	}
+	m = query("", 0)
+	if len(m.Answer) != 1 || m.Answer[0].(*dns.A).A.String() != "198.51.100.1" || scope(m) != -1 {
+		t.Errorf("Expected the default address without the option, got %v", m)
+	}
+	// Without the option the address of the resolver is the client
+	remote = &net.UDPAddr{IP: net.IPv4(10, 9, 9, 9), Port: 5353}
+	m = query("", 0)
+	if len(m.Answer) != 2 || scope(m) != -1 {
+		t.Errorf("Expected the addresses of the subnet of the resolver, got %v", m)
+	}
+	server.ClientSubnet = false
+	m = query("10.20.30.0", 24)
+	if len(m.Answer) != 1 || m.Answer[0].(*dns.A).A.String() != "198.51.100.1" || scope(m) != -1 {
+		t.Errorf("Expected the subnet answers to be ignored when disabled, got %v", m)
+	}
+}
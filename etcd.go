@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+func init() {
+	RegisterBackend("etcd", newEtcdBackend)
+}
+
+// newEtcdBackend returns a database backend storing the data in an etcd v3 cluster
+func newEtcdBackend() database {
+	return &kvdb{
+		open: func(connection string) (kvStore, error) {
+			return newEtcdStore(connection)
+		},
+		txtTTL: time.Duration(Config.Database.TXTExpiry) * time.Second,
+	}
+}
+
+// etcdStore is a kvStore using the JSON gateway of the etcd v3 API. All the keys are
+// under kvKeyPrefix, so that changes can be followed by watching the prefix.
+type etcdStore struct {
+	mutex     sync.Mutex
+	client    *http.Client
+	endpoints []string
+	username  string
+	password  string
+	token     string
+}
+
+// etcdKeyValue is a key-value pair in the responses of etcd
+type etcdKeyValue struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// etcdPut is the put request of etcd, also used as a transaction operation
+type etcdPut struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+	Lease string `json:"lease,omitempty"`
+}
+
+// newEtcdStore connects to the cluster given by a comma separated list of endpoint
+// URLs, with the credentials of the first one used for authentication
+func newEtcdStore(connection string) (*etcdStore, error) {
+	s := &etcdStore{client: &http.Client{Timeout: 5 * time.Second}}
+	for _, endpoint := range strings.Split(connection, ",") {
+		u, err := url.Parse(strings.TrimSpace(endpoint))
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("invalid etcd endpoint %q", endpoint)
+		}
+		if u.User != nil && s.username == "" {
+			s.username = u.User.Username()
+			s.password, _ = u.User.Password()
+		}
+		s.endpoints = append(s.endpoints, u.Scheme+"://"+u.Host)
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if err := s.authenticate(); err != nil {
+		return nil, err
+	}
+	// Check that the cluster is reachable
+	var resp struct{}
+	if err := s.call("/v3/kv/range", map[string]string{"key": etcdEncode(kvKeyPrefix)}, &resp); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func etcdEncode(s string) string {
+	return base64.StdEncoding.EncodeToString([]byte(s))
+}
+
+// etcdPrefixEnd returns the end of the key range starting with prefix
+func etcdPrefixEnd(prefix string) string {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return string(end[:i+1])
+		}
+	}
+	// Every key is greater than or equal to \x00
+	return "\x00"
+}
+
+// authenticate gets a token for the configured user, the caller must hold the mutex
+func (s *etcdStore) authenticate() error {
+	s.token = ""
+	if s.username == "" {
+		return nil
+	}
+	var resp struct {
+		Token string `json:"token"`
+	}
+	err := s.post("/v3/auth/authenticate", map[string]string{"name": s.username, "password": s.password}, &resp)
+	s.token = resp.Token
+	return err
+}
+
+// call sends the request, authenticating again once if the token has expired
+func (s *etcdStore) call(path string, req interface{}, resp interface{}) error {
+	err := s.post(path, req, resp)
+	if err != nil && s.username != "" && strings.Contains(err.Error(), "invalid auth token") {
+		if err = s.authenticate(); err == nil {
+			err = s.post(path, req, resp)
+		}
+	}
+	return err
+}
+
+// post sends the request to the first endpoint that answers
+func (s *etcdStore) post(path string, req interface{}, resp interface{}) error {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	err = errors.New("etcd: no endpoints")
+	for _, endpoint := range s.endpoints {
+		var r *http.Request
+		r, err = http.NewRequest(http.MethodPost, endpoint+path, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		r.Header.Set("Content-Type", "application/json")
+		if s.token != "" {
+			r.Header.Set("Authorization", s.token)
+		}
+		var res *http.Response
+		res, err = s.client.Do(r)
+		if err != nil {
+			// Try the next member of the cluster
+			continue
+		}
+		defer res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			var e struct {
+				Message string `json:"message"`
+			}
+			_ = json.NewDecoder(res.Body).Decode(&e)
+			return fmt.Errorf("etcd: %s: %s", res.Status, e.Message)
+		}
+		return json.NewDecoder(res.Body).Decode(resp)
+	}
+	return err
+}
+
+// grant returns a lease expiring after ttl, or an empty lease if ttl is zero
+func (s *etcdStore) grant(ttl time.Duration) (string, error) {
+	if ttl <= 0 {
+		return "", nil
+	}
+	// Leases have a granularity of a second
+	seconds := int64((ttl + time.Second - 1) / time.Second)
+	var resp struct {
+		ID string `json:"ID"`
+	}
+	err := s.call("/v3/lease/grant", map[string]int64{"TTL": seconds}, &resp)
+	return resp.ID, err
+}
+
+func (s *etcdStore) Get(key string) ([]byte, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var resp struct {
+		Kvs []etcdKeyValue `json:"kvs"`
+	}
+	if err := s.call("/v3/kv/range", map[string]string{"key": etcdEncode(key)}, &resp); err != nil {
+		return nil, err
+	}
+	if len(resp.Kvs) == 0 {
+		return nil, errKeyNotFound
+	}
+	return base64.StdEncoding.DecodeString(resp.Kvs[0].Value)
+}
+
+func (s *etcdStore) Set(key string, value []byte, ttl time.Duration) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	lease, err := s.grant(ttl)
+	if err != nil {
+		return err
+	}
+	var resp struct{}
+	return s.call("/v3/kv/put", etcdPut{etcdEncode(key), base64.StdEncoding.EncodeToString(value), lease}, &resp)
+}
+
+func (s *etcdStore) SetNX(key string, value []byte, ttl time.Duration) (bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	lease, err := s.grant(ttl)
+	if err != nil {
+		return false, err
+	}
+	// The key doesn't exist if it was never created
+	txn := map[string]interface{}{
+		"compare": []map[string]string{{"key": etcdEncode(key), "target": "CREATE", "result": "EQUAL", "create_revision": "0"}},
+		"success": []map[string]etcdPut{{"request_put": {etcdEncode(key), base64.StdEncoding.EncodeToString(value), lease}}},
+	}
+	var resp struct {
+		Succeeded bool `json:"succeeded"`
+	}
+	err = s.call("/v3/kv/txn", txn, &resp)
+	return resp.Succeeded, err
+}
+
+// etcdValueEquals compares the value of the key in a transaction
+func etcdValueEquals(key string, value []byte) []map[string]string {
+	return []map[string]string{{"key": etcdEncode(key), "target": "VALUE", "result": "EQUAL", "value": base64.StdEncoding.EncodeToString(value)}}
+}
+
+func (s *etcdStore) SetIf(key string, expected []byte, value []byte, ttl time.Duration) (bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	lease, err := s.grant(ttl)
+	if err != nil {
+		return false, err
+	}
+	txn := map[string]interface{}{
+		"compare": etcdValueEquals(key, expected),
+		"success": []map[string]etcdPut{{"request_put": {etcdEncode(key), base64.StdEncoding.EncodeToString(value), lease}}},
+	}
+	var resp struct {
+		Succeeded bool `json:"succeeded"`
+	}
+	err = s.call("/v3/kv/txn", txn, &resp)
+	return resp.Succeeded, err
+}
+
+func (s *etcdStore) Delete(key string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var resp struct{}
+	return s.call("/v3/kv/deleterange", map[string]string{"key": etcdEncode(key)}, &resp)
+}
+
+func (s *etcdStore) DeleteIf(key string, expected []byte) (bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	txn := map[string]interface{}{
+		"compare": etcdValueEquals(key, expected),
+		"success": []map[string]map[string]string{{"request_delete_range": {"key": etcdEncode(key)}}},
+	}
+	var resp struct {
+		Succeeded bool `json:"succeeded"`
+	}
+	err := s.call("/v3/kv/txn", txn, &resp)
+	return resp.Succeeded, err
+}
+
+func (s *etcdStore) Keys(prefix string) ([]string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	req := map[string]interface{}{"key": etcdEncode(prefix), "range_end": etcdEncode(etcdPrefixEnd(prefix)), "keys_only": true}
+	var resp struct {
+		Kvs []etcdKeyValue `json:"kvs"`
+	}
+	if err := s.call("/v3/kv/range", req, &resp); err != nil {
+		return nil, err
+	}
+	keys := make([]string, 0, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		key, err := base64.StdEncoding.DecodeString(kv.Key)
+		if err != nil {
+			return keys, err
+		}
+		keys = append(keys, string(key))
+	}
+	return keys, nil
+}
+
+func (s *etcdStore) Close() error {
+	s.client.CloseIdleConnections()
+	return nil
+}
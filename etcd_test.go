@@ -0,0 +1,224 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeEtcd implements the subset of the etcd v3 JSON gateway used by etcdStore
+type fakeEtcd struct {
+	mutex   sync.Mutex
+	values  map[string]string
+	leases  map[string]string
+	expired map[string]bool
+	nextID  int
+	token   string
+}
+
+func newFakeEtcd(t *testing.T, auth bool) (*fakeEtcd, *httptest.Server) {
+	f := &fakeEtcd{values: map[string]string{}, leases: map[string]string{}, expired: map[string]bool{}}
+	server := httptest.NewServer(http.HandlerFunc(f.serve))
+	t.Cleanup(server.Close)
+	if auth {
+		f.token = "secret-token"
+	}
+	return f, server
+}
+
+func decodeB64(s string) string {
+	b, _ := base64.StdEncoding.DecodeString(s)
+	return string(b)
+}
+
+// expireLease expires the lease the key is attached to
+func (f *fakeEtcd) expireLease(key string) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if lease := f.leases[key]; lease != "" {
+		f.expired[lease] = true
+	}
+}
+
+func (f *fakeEtcd) hasLease(key string) bool {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.leases[key] != ""
+}
+
+func (f *fakeEtcd) put(key string, value string, lease string) {
+	f.values[key] = value
+	f.leases[key] = lease
+}
+
+func (f *fakeEtcd) serve(w http.ResponseWriter, r *http.Request) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	var req map[string]interface{}
+	_ = json.NewDecoder(r.Body).Decode(&req)
+	str := func(k string) string { s, _ := req[k].(string); return s }
+	if r.URL.Path == "/v3/auth/authenticate" {
+		if str("name") != "root" || str("password") != "hunter2" {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(`{"message": "etcdserver: authentication failed, invalid user ID or password"}`))
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]string{"token": f.token})
+		return
+	}
+	if f.token != "" && r.Header.Get("Authorization") != f.token {
+		w.WriteHeader(http.StatusUnauthorized)
+		_, _ = w.Write([]byte(`{"message": "etcdserver: user name is empty"}`))
+		return
+	}
+	for key, lease := range f.leases {
+		if f.expired[lease] {
+			delete(f.values, key)
+			delete(f.leases, key)
+		}
+	}
+	var resp interface{} = map[string]interface{}{}
+	switch r.URL.Path {
+	case "/v3/lease/grant":
+		f.nextID++
+		resp = map[string]string{"ID": strconv.Itoa(f.nextID)}
+	case "/v3/kv/range":
+		key := decodeB64(str("key"))
+		var kvs []map[string]string
+		if end := str("range_end"); end != "" {
+			for k := range f.values {
+				if k >= key && k < decodeB64(end) {
+					kvs = append(kvs, map[string]string{"key": base64.StdEncoding.EncodeToString([]byte(k))})
+				}
+			}
+		} else if v, ok := f.values[key]; ok {
+			kvs = append(kvs, map[string]string{"key": str("key"), "value": v})
+		}
+		if len(kvs) > 0 {
+			resp = map[string]interface{}{"kvs": kvs}
+		}
+	case "/v3/kv/put":
+		f.put(decodeB64(str("key")), str("value"), str("lease"))
+	case "/v3/kv/deleterange":
+		delete(f.values, decodeB64(str("key")))
+		delete(f.leases, decodeB64(str("key")))
+	case "/v3/kv/txn":
+		compare := req["compare"].([]interface{})[0].(map[string]interface{})
+		key := decodeB64(compare["key"].(string))
+		value, exists := f.values[key]
+		if compare["target"] == "VALUE" && (!exists || value != compare["value"]) || compare["target"] == "CREATE" && exists {
+			resp = map[string]interface{}{}
+			break
+		}
+		op := req["success"].([]interface{})[0].(map[string]interface{})
+		if put, ok := op["request_put"].(map[string]interface{}); ok {
+			lease, _ := put["lease"].(string)
+			f.put(decodeB64(put["key"].(string)), put["value"].(string), lease)
+		} else if del, ok := op["request_delete_range"].(map[string]interface{}); ok {
+			delete(f.values, decodeB64(del["key"].(string)))
+			delete(f.leases, decodeB64(del["key"].(string)))
+		}
+		resp = map[string]interface{}{"succeeded": true}
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
+func TestEtcdPrefixEnd(t *testing.T) {
+	for prefix, end := range map[string]string{"acmedns:": "acmedns;", "a\xff": "b", "\xff": "\x00"} {
+		if got := etcdPrefixEnd(prefix); got != end {
+			t.Errorf("Expected the range end of %q to be %q, got %q", prefix, end, got)
+		}
+	}
+}
+
+func TestEtcdConnection(t *testing.T) {
+	_, server := newFakeEtcd(t, true)
+	if _, err := newEtcdStore("etcd://localhost:2379"); err == nil {
+		t.Errorf("Expected an error for an invalid endpoint")
+	}
+	withCredentials := strings.Replace(server.URL, "http://", "http://root:wrong@", 1)
+	if _, err := newEtcdStore(withCredentials); err == nil || !strings.Contains(err.Error(), "authentication failed") {
+		t.Errorf("Expected an authentication error, got %v", err)
+	}
+	// Unreachable members of the cluster are skipped
+	withCredentials = strings.Replace(server.URL, "http://", "http://root:hunter2@", 1)
+	s, err := newEtcdStore("http://127.0.0.1:1," + withCredentials)
+	if err != nil {
+		t.Fatalf("Could not connect: %v", err)
+	}
+	defer s.Close()
+	if err = s.Set("k", []byte("v"), 0); err != nil {
+		t.Errorf("Could not set a key: %v", err)
+	}
+	if v, err := s.Get("k"); err != nil || string(v) != "v" {
+		t.Errorf("Expected to read back the value, got %q, %v", v, err)
+	}
+}
+
+func TestEtcdBackend(t *testing.T) {
+	f, server := newFakeEtcd(t, false)
+	db := newEtcdBackend().(*kvdb)
+	db.txtTTL = time.Hour
+	if err := db.Init("etcd", server.URL); err != nil {
+		t.Fatalf("Could not initialize the etcd backend: %v", err)
+	}
+	defer db.Close()
+
+	reg, err := db.Register(cidrslice{}, registrationOrigin{CreatedBy: "alice"}, ACMETxtPost{AAAAValues: []string{"2001:db8::1"}})
+	if err != nil {
+		t.Fatalf("Could not register: %v", err)
+	}
+	validTXT := "______________valid_response_______________"
+	if _, err = db.Update(ACMETxtPost{Subdomain: reg.Subdomain, Value: validTXT}); err != nil {
+		t.Fatalf("Could not update: %v", err)
+	}
+	if !f.hasLease(kvTXTKey(reg.Subdomain, 0)) {
+		t.Errorf("Expected the TXT value to be attached to a lease")
+	}
+	if txts, err := db.GetTXTForDomain(reg.Subdomain); err != nil || txts[0] != validTXT {
+		t.Errorf("Expected the updated TXT value, got %v, %v", txts, err)
+	}
+	f.expireLease(kvTXTKey(reg.Subdomain, 0))
+	if txts, _ := db.GetTXTForDomain(reg.Subdomain); txts[0] != "" {
+		t.Errorf("Expected the TXT value to expire with its lease, got %v", txts)
+	}
+	if ips, err := db.GetAAAAForDomain(reg.Subdomain); err != nil || len(ips) != 1 {
+		t.Errorf("Expected the preset AAAA record, got %v, %v", ips, err)
+	}
+	if regs, err := db.ListRegistrations(registrationOrigin{CreatedBy: "alice"}); err != nil || len(regs) != 1 {
+		t.Errorf("Expected a registration by alice, got %v, %v", regs, err)
+	}
+	if ok, err := db.AcquireLease("primary", "a", time.Minute); !ok || err != nil {
+		t.Errorf("Expected to acquire the lease, got %v, %v", ok, err)
+	}
+	if ok, _ := db.AcquireLease("primary", "b", time.Minute); ok {
+		t.Errorf("Expected the lease to be held by another instance")
+	}
+	if err = db.ReleaseLease("primary", "b"); err != nil {
+		t.Errorf("Could not release the lease: %v", err)
+	}
+	if ok, _ := db.AcquireLease("primary", "a", time.Minute); !ok {
+		t.Errorf("Expected the holder to renew the lease")
+	}
+	if err = db.ReleaseLease("primary", "a"); err != nil {
+		t.Errorf("Could not release the lease: %v", err)
+	}
+	if ok, _ := db.AcquireLease("primary", "b", time.Minute); !ok {
+		t.Errorf("Expected to acquire the released lease")
+	}
+	if err = db.DeleteRegistration(reg.Username); err != nil {
+		t.Errorf("Could not delete the registration: %v", err)
+	}
+	if txts, _ := db.GetTXTForDomain(reg.Subdomain); txts != nil {
+		t.Errorf("Expected the deleted subdomain to have no TXT values, got %v", txts)
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/miekg/dns"
+)
+
+// responseSizeBuckets are the upper bounds of the DNS response size histogram in
+// bytes, around the common UDP payload sizes
+var responseSizeBuckets = []float64{64, 128, 256, 512, 1232, 2048, 4096, 16384, 65535}
+
+// latencyBuckets are the upper bounds of the DNS handler latency histogram in seconds
+var latencyBuckets = []float64{0.0001, 0.00025, 0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1}
+
+// histogramKey are the labels of a histogram series
+type histogramKey struct {
+	qtype string
+	rcode string
+}
+
+// histogram counts observations in buckets like a Prometheus histogram. The
+// counts are per bucket, made cumulative when written out.
+type histogram struct {
+	buckets []float64
+	counts  []uint64
+	sum     float64
+	count   uint64
+}
+
+func newHistogram(buckets []float64) *histogram {
+	return &histogram{buckets: buckets, counts: make([]uint64, len(buckets))}
+}
+
+func (h *histogram) observe(v float64) {
+	for i, bound := range h.buckets {
+		if v <= bound {
+			h.counts[i]++
+			break
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+// observeHistogram adds an observation to the series of the labels, creating it
+func observeHistogram(series map[histogramKey]*histogram, buckets []float64, key histogramKey, v float64) {
+	h, ok := series[key]
+	if !ok {
+		h = newHistogram(buckets)
+		series[key] = h
+	}
+	h.observe(v)
+}
+
+// recordHistograms adds the size and the handling time of a response to the
+// histograms of the query type and rcode. Called with the mutex held.
+func (s *dnsStatistics) recordHistograms(qtype uint16, rcode int, size int, elapsed time.Duration) {
+	key := histogramKey{qtypeLabel(qtype), rcodeLabel(rcode)}
+	observeHistogram(s.sizes, responseSizeBuckets, key, float64(size))
+	observeHistogram(s.latencies, latencyBuckets, key, elapsed.Seconds())
+}
+
+func qtypeLabel(qtype uint16) string {
+	if name, ok := dns.TypeToString[qtype]; ok {
+		return name
+	}
+	return "TYPE" + strconv.Itoa(int(qtype))
+}
+
+func rcodeLabel(rcode int) string {
+	if name, ok := dns.RcodeToString[rcode]; ok {
+		return name
+	}
+	return "RCODE" + strconv.Itoa(rcode)
+}
+
+// serveMetrics answers with the histograms in the Prometheus text format
+func (s *dnsStatistics) serveMetrics(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	writeHistograms(w, "acmedns_dns_response_size_bytes", "Size of the DNS responses by query type and rcode.", s.sizes)
+	writeHistograms(w, "acmedns_dns_handler_duration_seconds", "Time taken to answer the DNS requests by query type and rcode.", s.latencies)
+	if s.SigningAudit != nil {
+		s.SigningAudit.writeMetrics(w)
+	}
+}
+
+// writeHistograms writes the series of a histogram sorted by their labels
+func writeHistograms(w io.Writer, name string, help string, series map[histogramKey]*histogram) {
+	keys := make([]histogramKey, 0, len(series))
+	for key := range series {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].qtype != keys[j].qtype {
+			return keys[i].qtype < keys[j].qtype
+		}
+		return keys[i].rcode < keys[j].rcode
+	})
+	_, _ = fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", name, help, name)
+	for _, key := range keys {
+		h := series[key]
+		labels := fmt.Sprintf("qtype=%q,rcode=%q", key.qtype, key.rcode)
+		var cumulative uint64
+		for i, bound := range h.buckets {
+			cumulative += h.counts[i]
+			_, _ = fmt.Fprintf(w, "%s_bucket{%s,le=\"%s\"} %d\n", name, labels, strconv.FormatFloat(bound, 'g', -1, 64), cumulative)
+		}
+		_, _ = fmt.Fprintf(w, "%s_bucket{%s,le=\"+Inf\"} %d\n", name, labels, h.count)
+		_, _ = fmt.Fprintf(w, "%s_sum{%s} %s\n", name, labels, strconv.FormatFloat(h.sum, 'g', -1, 64))
+		_, _ = fmt.Fprintf(w, "%s_count{%s} %d\n", name, labels, h.count)
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// hookCommand returns the configured command for the event, if any
+func hookCommand(event string) []string {
+	switch event {
+	case "register":
+		return Config.Hooks.OnRegister
+	case "update":
+		return Config.Hooks.OnUpdate
+	}
+	return nil
+}
+
+// runHooks runs the command configured for the event in the background
+func runHooks(event webhookEvent) {
+	command := hookCommand(event.Event)
+	if len(command) == 0 {
+		return
+	}
+	timeout := time.Duration(Config.Hooks.Timeout) * time.Second
+	go func() {
+		if err := runHook(command, event, timeout); err != nil {
+			log.WithFields(log.Fields{"error": err.Error(), "command": command[0], "event": event.Event, "subdomain": event.Subdomain}).Warning("Hook command failed")
+		}
+	}()
+}
+
+// runHook runs the command with the details of the event in ACMEDNS_ environment
+// variables and as JSON on the standard input, killing it after the timeout
+func runHook(command []string, event webhookEvent, timeout time.Duration) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, command[0], command[1:]...)
+	cmd.Env = append(os.Environ(),
+		"ACMEDNS_EVENT="+event.Event,
+		"ACMEDNS_SUBDOMAIN="+event.Subdomain,
+		"ACMEDNS_FULLDOMAIN="+event.Subdomain+"."+event.Zone,
+		"ACMEDNS_ZONE="+event.Zone,
+		"ACMEDNS_TXT="+event.TXT,
+		"ACMEDNS_A="+strings.Join(event.AValues, " "),
+		"ACMEDNS_AAAA="+strings.Join(event.AAAAValues, " "),
+		"ACMEDNS_TIME="+strconv.FormatInt(event.Time, 10),
+		"ACMEDNS_CORRELATION_ID="+event.CorrelationID,
+	)
+	cmd.Stdin = bytes.NewReader(body)
+	// Don't wait for children of the command keeping the output open after it's killed
+	cmd.WaitDelay = time.Second
+	out, err := cmd.CombinedOutput()
+	if ctx.Err() == context.DeadlineExceeded {
+		return ctx.Err()
+	}
+	if err != nil && len(out) > 0 {
+		log.WithFields(log.Fields{"command": command[0], "output": string(out)}).Debug("Hook command output")
+	}
+	return err
+}
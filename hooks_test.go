@@ -0,0 +1,43 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRunHook(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "hook.out")
+	command := []string{"/bin/sh", "-c", `printf '%s|%s|%s|%s|%s|' "$ACMEDNS_EVENT" "$ACMEDNS_SUBDOMAIN" "$ACMEDNS_FULLDOMAIN" "$ACMEDNS_TXT" "$ACMEDNS_A" > "$1"; cat >> "$1"`, "hook", out}
+	event := webhookEvent{"update", "sub", "LHDhK3oGRvkiefQnx7OOczTY5Tic_xZ6HcMOc_gmtoM", []string{"192.0.2.1", "192.0.2.2"}, nil, 1700000000, "", "auth.example.org"}
+	if err := runHook(command, event, 5*time.Second); err != nil {
+		t.Fatalf("Hook failed: %v", err)
+	}
+	got, _ := os.ReadFile(out)
+	expected := `update|sub|sub.auth.example.org|LHDhK3oGRvkiefQnx7OOczTY5Tic_xZ6HcMOc_gmtoM|192.0.2.1 192.0.2.2|{"event":"update","subdomain":"sub"`
+	if !strings.HasPrefix(string(got), expected) {
+		t.Errorf("Expected the hook to get the event details, got %q", got)
+	}
+
+	if err := runHook([]string{"/bin/sh", "-c", "exit 3"}, event, 5*time.Second); err == nil {
+		t.Errorf("Expected an error for a failing hook")
+	}
+	start := time.Now()
+	if err := runHook([]string{"/bin/sh", "-c", "sleep 10"}, event, 100*time.Millisecond); err == nil {
+		t.Errorf("Expected an error for a hook running past the timeout")
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Errorf("Expected the hook to be killed at the timeout")
+	}
+}
+
+func TestHookCommand(t *testing.T) {
+	oldHooks := Config.Hooks
+	defer func() { Config.Hooks = oldHooks }()
+	Config.Hooks = hooks{OnRegister: []string{"/bin/true"}}
+	if len(hookCommand("register")) != 1 || len(hookCommand("update")) != 0 || len(hookCommand("other")) != 0 {
+		t.Errorf("Unexpected hook commands for the config %+v", Config.Hooks)
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// parseHTTPRedirect checks the way the plain HTTP listener answers, "redirect" by
+// default
+func parseHTTPRedirect(mode string) (string, error) {
+	switch mode {
+	case "":
+		return "redirect", nil
+	case "redirect", "upgrade":
+		return mode, nil
+	}
+	return "", fmt.Errorf("unknown http_redirect_mode %q, must be redirect or upgrade", mode)
+}
+
+// httpsURL returns the HTTPS URL of the API for the plain HTTP request
+func httpsURL(r *http.Request, port string) string {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if host == "" {
+		host = Config.General.Domain
+	}
+	if port != "" && port != "443" {
+		host = net.JoinHostPort(host, port)
+	}
+	u := url.URL{Scheme: "https", Host: host, Path: r.URL.Path, RawQuery: r.URL.RawQuery}
+	return u.String()
+}
+
+// httpsRedirect answers the plain HTTP requests with a redirect to the HTTPS API,
+// or with 426 Upgrade Required in the upgrade mode. The redirect keeps the method
+// and the body of the request, but clients shouldn't send their credentials in
+// the clear in the first place, so the upgrade mode refuses them instead.
+func httpsRedirect(mode string, port string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		target := httpsURL(r, port)
+		apiLog.WithFields(log.Fields{"method": r.Method, "path": r.URL.Path, "remote": r.RemoteAddr, "target": target}).Debug("Plain HTTP request to the API")
+		w.Header().Set("Location", target)
+		if mode == "upgrade" {
+			w.Header().Set("Upgrade", "TLS/1.2, HTTP/1.1")
+			w.Header().Set("Connection", "Upgrade")
+			WriteJsonResponse(w, http.StatusUpgradeRequired, jsonError("https_required"))
+			return
+		}
+		WriteJsonResponse(w, http.StatusPermanentRedirect, jsonError("https_required"))
+	})
+}
+
+// startHTTPRedirect runs the plain HTTP listener pointing the clients to the HTTPS API
+func startHTTPRedirect(errChan chan error, config DNSConfig) {
+	host := config.API.IP + ":" + config.API.HTTPRedirectPort
+	srv := &http.Server{
+		Addr:              host,
+		Handler:           localeGate(config.API.Locale, httpsRedirect(config.API.HTTPRedirectMode, config.API.Port)),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	log.WithFields(log.Fields{"host": host, "mode": config.API.HTTPRedirectMode}).Info("Listening HTTP for redirects to HTTPS")
+	if err := srv.ListenAndServe(); err != nil {
+		errChan <- err
+	}
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHTTPSRedirect(t *testing.T) {
+	for i, test := range []struct {
+		mode     string
+		port     string
+		target   string
+		status   int
+		location string
+	}{
+		{"redirect", "443", "http://auth.example.org/update?x=1", http.StatusPermanentRedirect, "https://auth.example.org/update?x=1"},
+		{"redirect", "8443", "http://auth.example.org:8080/register", http.StatusPermanentRedirect, "https://auth.example.org:8443/register"},
+		{"upgrade", "443", "http://auth.example.org/update", http.StatusUpgradeRequired, "https://auth.example.org/update"},
+	} {
+		r := httptest.NewRequest("POST", test.target, nil)
+		w := httptest.NewRecorder()
+		localeGate("en", httpsRedirect(test.mode, test.port)).ServeHTTP(w, r)
+		if w.Code != test.status || w.Header().Get("Location") != test.location {
+			t.Errorf("Test %d: expected %d to %s, got %d to %s", i, test.status, test.location, w.Code, w.Header().Get("Location"))
+		}
+		if test.mode == "upgrade" && w.Header().Get("Upgrade") == "" {
+			t.Errorf("Test %d: expected the Upgrade header", i)
+		}
+	}
+	if _, err := parseHTTPRedirect("refuse"); err == nil {
+		t.Errorf("Expected an error for an unknown mode")
+	}
+}
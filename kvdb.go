@@ -0,0 +1,1299 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+)
+
+// errKeyNotFound is returned by key-value stores for missing and expired keys
+var errKeyNotFound = errors.New("key not found")
+
+// kvStore is a key-value store the kvdb backend keeps its data in
+type kvStore interface {
+	// Get returns the value of the key, or errKeyNotFound
+	Get(key string) ([]byte, error)
+	// Set stores the value, expiring it after ttl unless ttl is zero
+	Set(key string, value []byte, ttl time.Duration) error
+	// SetNX stores the value only if the key doesn't exist, reporting if it was stored
+	SetNX(key string, value []byte, ttl time.Duration) (bool, error)
+	// SetIf stores the value only if the key holds expected, reporting if it was stored
+	SetIf(key string, expected []byte, value []byte, ttl time.Duration) (bool, error)
+	// Delete removes the key
+	Delete(key string) error
+	// DeleteIf removes the key only if it holds expected, reporting if it was removed
+	DeleteIf(key string, expected []byte) (bool, error)
+	// Keys returns all the keys starting with prefix
+	Keys(prefix string) ([]string, error)
+	Close() error
+}
+
+// kvKeyPrefix namespaces the keys of acme-dns in a shared store
+const kvKeyPrefix = "acmedns:"
+
+// kvUser is the stored form of a registration
+type kvUser struct {
+	Username     string             `json:"username"`
+	Password     string             `json:"password"`
+	Subdomain    string             `json:"subdomain"`
+	AllowFrom    cidrslice          `json:"allowfrom"`
+	Description  string             `json:"description"`
+	Webhooks     []string           `json:"webhooks"`
+	AllowedTypes []string           `json:"allowed_types"`
+	Tags         []string           `json:"tags"`
+	Origin       registrationOrigin `json:"origin"`
+	Disabled     bool               `json:"disabled"`
+	Canary       bool               `json:"canary"`
+	Wildcard     bool               `json:"wildcard"`
+	// SubnetAnswers are missing from the users stored before they were added
+	SubnetAnswers []subnetAnswer `json:"subnet_answers,omitempty"`
+	PassVersion   int            `json:"pass_version"`
+	LastActive    int64          `json:"last_active"`
+}
+
+// kvAdmin is the stored form of an admin. Admins created before credential
+// versions were recorded are stored as the bare password hash.
+type kvAdmin struct {
+	Password    string `json:"password"`
+	PassVersion int    `json:"pass_version"`
+}
+
+// kvTXT is the stored form of a TXT slot
+type kvTXT struct {
+	Value         string `json:"value"`
+	LastUpdate    int64  `json:"last_update"`
+	CorrelationID string `json:"correlation_id,omitempty"`
+}
+
+// kvdb is a database backend on top of a key-value store. Registrations are
+// stored as JSON documents, with the record values of each subdomain in keys
+// of their own so that TXT values can expire independently.
+type kvdb struct {
+	store   kvStore
+	stripes stripedLock
+	Clock   clock
+	// open connects to the store using the connection string from config
+	open func(connection string) (kvStore, error)
+	// txtTTL is the time TXT values are kept after an update, zero keeps them forever
+	txtTTL time.Duration
+}
+
+func (d *kvdb) Init(engine string, connection string) error {
+	store, err := d.open(connection)
+	if err != nil {
+		return err
+	}
+	d.store = store
+	return nil
+}
+
+// Now returns the current time from the clock of the database layer
+func (d *kvdb) Now() time.Time {
+	return clockOrSystem(d.Clock).Now()
+}
+
+func kvUserKey(u string) string {
+	return kvKeyPrefix + "user:" + u
+}
+
+func kvSubdomainKey(subdomain string) string {
+	return kvKeyPrefix + "subdomain:" + subdomain
+}
+
+func kvTXTKey(subdomain string, slot int) string {
+	return fmt.Sprintf("%stxt:%s:%d", kvKeyPrefix, subdomain, slot)
+}
+
+func kvRecordKey(rtype string, subdomain string) string {
+	return kvKeyPrefix + rtype + ":" + subdomain
+}
+
+func kvAdminKey(username string) string {
+	return kvKeyPrefix + "admin:" + username
+}
+
+func kvLeaseKey(name string) string {
+	return kvKeyPrefix + "lease:" + name
+}
+
+func kvSettingKey(name string) string {
+	return kvKeyPrefix + "setting:" + name
+}
+
+// getJSON decodes the JSON value of the key to v
+func (d *kvdb) getJSON(key string, v interface{}) error {
+	value, err := d.store.Get(key)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(value, v)
+}
+
+// setJSON stores v as JSON to the key
+func (d *kvdb) setJSON(key string, v interface{}, ttl time.Duration) error {
+	value, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return d.store.Set(key, value, ttl)
+}
+
+func (u kvUser) model() (ACMETxt, error) {
+	username, err := uuid.Parse(u.Username)
+	if err != nil {
+		return ACMETxt{}, err
+	}
+	a := ACMETxt{
+		Username:        username,
+		Password:        u.Password,
+		AllowFrom:       u.AllowFrom,
+		Description:     u.Description,
+		Webhooks:        nonNilStrings(u.Webhooks),
+		AllowedTypes:    nonNilStrings(u.AllowedTypes),
+		Tags:            nonNilStrings(u.Tags),
+		Origin:          u.Origin,
+		Disabled:        u.Disabled,
+		Canary:          u.Canary,
+		WildcardRecords: u.Wildcard,
+		SubnetAnswers:   nonNilSubnetAnswers(u.SubnetAnswers),
+		PassVersion:     u.PassVersion,
+		LastActive:      u.LastActive,
+	}
+	a.Subdomain = u.Subdomain
+	return a, nil
+}
+
+// registration returns the model of the stored registration with the time of its latest TXT update
+func (d *kvdb) registration(u kvUser) (ACMETxt, error) {
+	a, err := u.model()
+	if err != nil {
+		return a, err
+	}
+	slots, err := d.txtSlots(a.Subdomain)
+	for _, txt := range slots {
+		if txt != nil && txt.LastUpdate > a.LastUpdate {
+			a.LastUpdate = txt.LastUpdate
+		}
+	}
+	return a, err
+}
+
+// modifyUser applies modify to the stored registration while holding the lock of
+// its subdomain, the same lock Register and DeleteRegistration take, so that
+// concurrent modifications aren't lost and deleted registrations stay deleted
+func (d *kvdb) modifyUser(u uuid.UUID, modify func(*kvUser)) error {
+	get := func() (kvUser, error) {
+		var user kvUser
+		err := d.getJSON(kvUserKey(u.String()), &user)
+		if err == errKeyNotFound {
+			return user, errors.New("no user")
+		}
+		return user, err
+	}
+	user, err := get()
+	if err != nil {
+		return err
+	}
+	d.stripes.Lock(user.Subdomain)
+	defer d.stripes.Unlock(user.Subdomain)
+	// Read again, the registration may have changed or been deleted meanwhile
+	if user, err = get(); err != nil {
+		return err
+	}
+	modify(&user)
+	return d.setJSON(kvUserKey(u.String()), user, 0)
+}
+
+func (d *kvdb) Register(afrom cidrslice, origin registrationOrigin, values ACMETxtPost) (ACMETxt, error) {
+	a := newACMETxt()
+	a.AllowFrom = cidrslice(afrom.ValidEntries())
+	a.Origin = origin
+	a.Origin.CreatedAt = d.Now().Unix()
+	if values.Slot != nil && (*values.Slot < 0 || *values.Slot >= txtSlotCount()) {
+		return a, fmt.Errorf("invalid TXT slot: %d", *values.Slot)
+	}
+	passwordHash, err := hashPassword(a.Password)
+	if err != nil {
+		return a, err
+	}
+	a.PassVersion = credentialVersion()
+	user := kvUser{
+		Username:     a.Username.String(),
+		Password:     passwordHash,
+		PassVersion:  a.PassVersion,
+		Subdomain:    a.Subdomain,
+		AllowFrom:    a.AllowFrom,
+		Webhooks:     []string{},
+		AllowedTypes: []string{},
+		Origin:       a.Origin,
+	}
+	d.stripes.Lock(a.Subdomain)
+	defer d.stripes.Unlock(a.Subdomain)
+	// The subdomain is claimed first to not overwrite the values of an existing one
+	created, err := d.store.SetNX(kvSubdomainKey(a.Subdomain), []byte(user.Username), 0)
+	if err != nil {
+		return a, err
+	}
+	if !created {
+		return a, errors.New("subdomain already exists")
+	}
+	values.Subdomain = a.Subdomain
+	values, err = d.update(values, a.Origin.CreatedAt)
+	if err == nil {
+		a.ACMETxtPost = values
+		err = d.setJSON(kvUserKey(user.Username), user, 0)
+	}
+	if err != nil {
+		// Nothing of the failed registration is left behind
+		if delErr := d.deleteKeys(kvRegistrationKeys(user)); delErr != nil {
+			dbLog.WithFields(log.Fields{"error": delErr.Error(), "subdomain": a.Subdomain}).Error("Could not remove a failed registration")
+		}
+		return a, err
+	}
+	return a, nil
+}
+
+func (d *kvdb) GetAdminPassByUsername(username string) (string, int, error) {
+	value, err := d.store.Get(kvAdminKey(username))
+	if err == errKeyNotFound {
+		return "", 0, errAdminNotFound
+	}
+	if err != nil {
+		return "", 0, err
+	}
+	if !strings.HasPrefix(string(value), "{") {
+		return string(value), 0, nil
+	}
+	var admin kvAdmin
+	err = json.Unmarshal(value, &admin)
+	return admin.Password, admin.PassVersion, err
+}
+
+// newKVAdmin returns the stored form of the admin with the password hashed
+func newKVAdmin(password string) ([]byte, error) {
+	passwordHash, err := hashPassword(password)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(kvAdmin{Password: passwordHash, PassVersion: credentialVersion()})
+}
+
+func (d *kvdb) CreateAdmin(username string, password string) error {
+	admin, err := newKVAdmin(password)
+	if err != nil {
+		return err
+	}
+	ok, err := d.store.SetNX(kvAdminKey(username), admin, 0)
+	if err == nil && !ok {
+		err = errAdminExists
+	}
+	return err
+}
+
+func (d *kvdb) DeleteAdmin(username string) error {
+	if _, _, err := d.GetAdminPassByUsername(username); err != nil {
+		return err
+	}
+	return d.store.Delete(kvAdminKey(username))
+}
+
+func (d *kvdb) ListAdmins() ([]string, error) {
+	prefix := kvAdminKey("")
+	keys, err := d.store.Keys(prefix)
+	if err != nil {
+		return nil, err
+	}
+	admins := make([]string, 0, len(keys))
+	for _, key := range keys {
+		admins = append(admins, strings.TrimPrefix(key, prefix))
+	}
+	sort.Strings(admins)
+	return admins, nil
+}
+
+func (d *kvdb) UpdateAdminPassword(username string, password string) error {
+	if _, _, err := d.GetAdminPassByUsername(username); err != nil {
+		return err
+	}
+	admin, err := newKVAdmin(password)
+	if err != nil {
+		return err
+	}
+	return d.store.Set(kvAdminKey(username), admin, 0)
+}
+
+func (d *kvdb) RehashAdminPassword(username string, version int, password string) error {
+	_, current, err := d.GetAdminPassByUsername(username)
+	if err != nil || current != version {
+		return err
+	}
+	admin, err := newKVAdmin(password)
+	if err != nil {
+		return err
+	}
+	return d.store.Set(kvAdminKey(username), admin, 0)
+}
+
+func (d *kvdb) GetByUsername(u uuid.UUID) (ACMETxt, error) {
+	var user kvUser
+	err := d.getJSON(kvUserKey(u.String()), &user)
+	if err == errKeyNotFound {
+		return ACMETxt{}, errors.New("no user")
+	}
+	if err != nil {
+		return ACMETxt{}, err
+	}
+	return d.registration(user)
+}
+
+func (d *kvdb) ListRegistrations(filter registrationOrigin) ([]ACMETxt, error) {
+	results := []ACMETxt{}
+	keys, err := d.store.Keys(kvUserKey(""))
+	if err != nil {
+		return results, err
+	}
+	for _, key := range keys {
+		var user kvUser
+		err = d.getJSON(key, &user)
+		if err == errKeyNotFound {
+			continue
+		}
+		if err != nil {
+			return results, err
+		}
+		if filter.CreatedBy != "" && user.Origin.CreatedBy != filter.CreatedBy {
+			continue
+		}
+		if filter.CreatedFrom != "" && user.Origin.CreatedFrom != filter.CreatedFrom {
+			continue
+		}
+		a, err := d.registration(user)
+		if err != nil {
+			return results, err
+		}
+		results = append(results, a)
+	}
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Origin.CreatedAt != results[j].Origin.CreatedAt {
+			return results[i].Origin.CreatedAt < results[j].Origin.CreatedAt
+		}
+		return results[i].Subdomain < results[j].Subdomain
+	})
+	return results, nil
+}
+
+func (d *kvdb) MarkActive(u uuid.UUID) error {
+	now := d.Now().Unix()
+	return d.modifyUser(u, func(user *kvUser) {
+		user.LastActive = now
+	})
+}
+
+func (d *kvdb) GetInactiveAccounts(olderThan time.Duration) ([]ACMETxt, error) {
+	cutoff := d.Now().Add(-olderThan).Unix()
+	regs, err := d.ListRegistrations(registrationOrigin{})
+	if err != nil {
+		return regs, err
+	}
+	results := []ACMETxt{}
+	for _, reg := range regs {
+		if reg.lastSeen() < cutoff && !reg.Canary {
+			results = append(results, reg)
+		}
+	}
+	sort.SliceStable(results, func(i, j int) bool {
+		return results[i].lastSeen() < results[j].lastSeen()
+	})
+	return results, nil
+}
+
+func (d *kvdb) UpdateSettings(u uuid.UUID, settings registrationSettings) error {
+	return d.modifyUser(u, func(user *kvUser) {
+		user.AllowFrom = cidrslice(settings.AllowFrom.ValidEntries())
+		user.Description = settings.Description
+		user.Webhooks = nonNilStrings(settings.Webhooks)
+		user.AllowedTypes = nonNilStrings(settings.AllowedTypes)
+		user.Tags = nonNilStrings(settings.Tags)
+		user.Wildcard = settings.WildcardRecords
+		user.SubnetAnswers = nonNilSubnetAnswers(settings.SubnetAnswers)
+	})
+}
+
+func (d *kvdb) SetDisabled(u uuid.UUID, disabled bool) error {
+	return d.modifyUser(u, func(user *kvUser) {
+		user.Disabled = disabled
+	})
+}
+
+func (d *kvdb) SetCanary(u uuid.UUID, canary bool) error {
+	return d.modifyUser(u, func(user *kvUser) {
+		user.Canary = canary
+	})
+}
+
+func (d *kvdb) SetPassword(u uuid.UUID, password string) error {
+	passwordHash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+	return d.modifyUser(u, func(user *kvUser) {
+		user.Password = passwordHash
+		user.PassVersion = credentialVersion()
+	})
+}
+
+func (d *kvdb) RehashPassword(u uuid.UUID, version int, password string) error {
+	passwordHash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+	return d.modifyUser(u, func(user *kvUser) {
+		if user.PassVersion == version {
+			user.Password = passwordHash
+			user.PassVersion = credentialVersion()
+		}
+	})
+}
+
+func (d *kvdb) CountCredentials() (map[int]int, map[int]int, error) {
+	registrations := map[int]int{}
+	admins := map[int]int{}
+	keys, err := d.store.Keys(kvUserKey(""))
+	if err != nil {
+		return registrations, admins, err
+	}
+	for _, key := range keys {
+		var user kvUser
+		err = d.getJSON(key, &user)
+		if err == errKeyNotFound {
+			continue
+		}
+		if err != nil {
+			return registrations, admins, err
+		}
+		registrations[user.PassVersion]++
+	}
+	usernames, err := d.ListAdmins()
+	if err != nil {
+		return registrations, admins, err
+	}
+	for _, username := range usernames {
+		_, version, err := d.GetAdminPassByUsername(username)
+		if err == errAdminNotFound {
+			continue
+		}
+		if err != nil {
+			return registrations, admins, err
+		}
+		admins[version]++
+	}
+	return registrations, admins, nil
+}
+
+func (d *kvdb) DeleteRegistration(u uuid.UUID) error {
+	var user kvUser
+	err := d.getJSON(kvUserKey(u.String()), &user)
+	if err == errKeyNotFound {
+		return errors.New("no user")
+	}
+	if err != nil {
+		return err
+	}
+	d.stripes.Lock(user.Subdomain)
+	defer d.stripes.Unlock(user.Subdomain)
+	return d.deleteKeys(kvRegistrationKeys(user))
+}
+
+// kvRegistrationKeys returns the keys of the registration and its records. The
+// subdomain goes first so that it stops resolving even if a later delete fails.
+func kvRegistrationKeys(user kvUser) []string {
+	keys := []string{kvSubdomainKey(user.Subdomain), kvUserKey(user.Username)}
+	for slot := 0; slot < txtSlotCount(); slot++ {
+		keys = append(keys, kvTXTKey(user.Subdomain, slot))
+	}
+	return append(keys, kvRecordKey("a", user.Subdomain), kvRecordKey("aaaa", user.Subdomain), kvRecordKey("cname", user.Subdomain), kvRecordKey("mx", user.Subdomain), kvRecordKey("srv", user.Subdomain), kvRecordKey("caa", user.Subdomain), kvRecordKey("rr", user.Subdomain), kvRecordKey("ttl", user.Subdomain), kvRecordKey("updated", user.Subdomain))
+}
+
+// deleteKeys removes the keys in order, stopping at the first error
+func (d *kvdb) deleteKeys(keys []string) error {
+	for _, key := range keys {
+		if err := d.store.Delete(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *kvdb) AcquireLease(name string, holder string, duration time.Duration) (bool, error) {
+	acquired, err := d.store.SetNX(kvLeaseKey(name), []byte(holder), duration)
+	if err != nil || acquired {
+		return acquired, err
+	}
+	// Renew the lease only while it is still ours
+	renewed, err := d.store.SetIf(kvLeaseKey(name), []byte(holder), []byte(holder), duration)
+	if err != nil || renewed {
+		return renewed, err
+	}
+	// Expired in between, try again once
+	return d.store.SetNX(kvLeaseKey(name), []byte(holder), duration)
+}
+
+func (d *kvdb) ReleaseLease(name string, holder string) error {
+	_, err := d.store.DeleteIf(kvLeaseKey(name), []byte(holder))
+	return err
+}
+
+func (d *kvdb) GetSetting(name string) (string, bool, error) {
+	value, err := d.store.Get(kvSettingKey(name))
+	if err == errKeyNotFound {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	return string(value), true, nil
+}
+
+func (d *kvdb) SetSetting(name string, value string) error {
+	return d.store.Set(kvSettingKey(name), []byte(value), 0)
+}
+
+// kvAuditKey returns a key for an audit event, sorting in the order of recording
+func kvAuditKey(t time.Time) string {
+	return fmt.Sprintf("%saudit:%020d:%s", kvKeyPrefix, t.UnixNano(), uuid.New())
+}
+
+func (d *kvdb) AddAuditEvent(e auditEvent) error {
+	value, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	return d.store.Set(kvAuditKey(d.Now()), value, 0)
+}
+
+func (d *kvdb) GetAuditEvents(subdomain string, limit int) ([]auditEvent, error) {
+	var events []auditEvent
+	keys, err := d.store.Keys(kvKeyPrefix + "audit:")
+	if err != nil {
+		return events, err
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(keys)))
+	for _, key := range keys {
+		if len(events) == limit {
+			break
+		}
+		var e auditEvent
+		err = d.getJSON(key, &e)
+		if err == errKeyNotFound {
+			continue
+		}
+		if err != nil {
+			return events, err
+		}
+		if subdomain != "" && e.Subdomain != subdomain {
+			continue
+		}
+		events = append(events, e)
+	}
+	return events, nil
+}
+
+// getLastUpdates returns the update times stored for the record types of the
+// subdomain, other than TXT
+func (d *kvdb) getLastUpdates(domain string) (map[string]int64, error) {
+	updates := make(map[string]int64)
+	err := d.getJSON(kvRecordKey("updated", domain), &updates)
+	if err == errKeyNotFound {
+		return updates, nil
+	}
+	return updates, err
+}
+
+func (d *kvdb) GetLastUpdates(domain string) (map[string]int64, error) {
+	domain = sanitizeString(domain)
+	d.stripes.RLock(domain)
+	defer d.stripes.RUnlock(domain)
+	updates, err := d.getLastUpdates(domain)
+	if err != nil {
+		return updates, err
+	}
+	slots, err := d.txtSlots(domain)
+	if err != nil {
+		return updates, err
+	}
+	for _, txt := range slots {
+		if txt != nil && txt.LastUpdate > updates["txt"] {
+			updates["txt"] = txt.LastUpdate
+		}
+	}
+	return updates, nil
+}
+
+// setLastUpdates records the time of the update for the record types it sets, and
+// forgets the types it removes
+func (d *kvdb) setLastUpdates(a ACMETxtPost, timenow int64) error {
+	set := ttlSetTypes(a)
+	removed := ttlReplacedTypes(a)
+	for _, g := range a.Records {
+		set = append(set, strings.ToLower(g.Type))
+	}
+	for _, rtype := range a.ClearRecords {
+		removed = append(removed, strings.ToLower(rtype))
+	}
+	if len(set) == 0 && len(removed) == 0 {
+		return nil
+	}
+	updates, err := d.getLastUpdates(a.Subdomain)
+	if err != nil {
+		return err
+	}
+	if a.CNAME != "" {
+		// The CNAME record replaces all the other records
+		updates = make(map[string]int64)
+	}
+	for _, rtype := range removed {
+		delete(updates, rtype)
+	}
+	for _, rtype := range set {
+		updates[rtype] = timenow
+	}
+	// The TXT slots have update times of their own
+	delete(updates, "txt")
+	if len(updates) > 0 {
+		return d.setJSON(kvRecordKey("updated", a.Subdomain), updates, 0)
+	}
+	return d.store.Delete(kvRecordKey("updated", a.Subdomain))
+}
+
+// registered checks if the subdomain exists
+func (d *kvdb) registered(domain string) (bool, error) {
+	_, err := d.store.Get(kvSubdomainKey(domain))
+	if err == errKeyNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// txtSlots returns the stored TXT slots of the subdomain, missing and expired slots are nil
+func (d *kvdb) txtSlots(domain string) ([]*kvTXT, error) {
+	slots := make([]*kvTXT, txtSlotCount())
+	for slot := range slots {
+		var txt kvTXT
+		err := d.getJSON(kvTXTKey(domain, slot), &txt)
+		if err == errKeyNotFound {
+			continue
+		}
+		if err != nil {
+			return slots, err
+		}
+		slots[slot] = &txt
+	}
+	return slots, nil
+}
+
+// GetTXTSlots returns the TXT slots of the subdomain with their latest updates.
+// Slots that were never written are returned empty.
+func (d *kvdb) GetTXTSlots(domain string) ([]txtSlot, error) {
+	domain = sanitizeString(domain)
+	d.stripes.RLock(domain)
+	defer d.stripes.RUnlock(domain)
+	stored, err := d.txtSlots(domain)
+	if err != nil {
+		return nil, err
+	}
+	var slots []txtSlot
+	for i, txt := range stored {
+		slot := txtSlot{Slot: i}
+		if txt != nil {
+			slot.Value = txt.Value
+			slot.LastUpdate = txt.LastUpdate
+			slot.CorrelationID = txt.CorrelationID
+		}
+		slots = append(slots, slot)
+	}
+	return slots, nil
+}
+
+func (d *kvdb) GetTXTForDomain(domain string) ([]string, error) {
+	domain = sanitizeString(domain)
+	d.stripes.RLock(domain)
+	defer d.stripes.RUnlock(domain)
+	var txts []string
+	if ok, err := d.registered(domain); !ok {
+		return txts, err
+	}
+	slots, err := d.txtSlots(domain)
+	if err != nil {
+		return txts, err
+	}
+	for _, txt := range slots {
+		if txt == nil {
+			txts = append(txts, "")
+			continue
+		}
+		txts = append(txts, txt.Value)
+	}
+	return txts, nil
+}
+
+// getIPs returns the IP addresses stored for the subdomain
+func (d *kvdb) getIPs(rtype string, domain string) ([]net.IP, error) {
+	var ips []net.IP
+	var values []string
+	err := d.getJSON(kvRecordKey(rtype, domain), &values)
+	if err == errKeyNotFound {
+		return ips, nil
+	}
+	if err != nil {
+		return ips, err
+	}
+	for _, v := range values {
+		ip := net.ParseIP(v)
+		if ip != nil && rtype == "a" {
+			ip = ip.To4()
+		}
+		if ip == nil {
+			return ips, fmt.Errorf("invalid IP address: %s", v)
+		}
+		ips = append(ips, ip)
+	}
+	return ips, nil
+}
+
+func (d *kvdb) GetAForDomain(domain string) ([]net.IP, error) {
+	domain = sanitizeString(domain)
+	d.stripes.RLock(domain)
+	defer d.stripes.RUnlock(domain)
+	return d.getIPs("a", domain)
+}
+
+func (d *kvdb) GetAAAAForDomain(domain string) ([]net.IP, error) {
+	domain = sanitizeString(domain)
+	d.stripes.RLock(domain)
+	defer d.stripes.RUnlock(domain)
+	return d.getIPs("aaaa", domain)
+}
+
+// getCNAME returns the CNAME target of the subdomain, empty if it has none
+func (d *kvdb) getCNAME(domain string) (string, error) {
+	var target string
+	err := d.getJSON(kvRecordKey("cname", domain), &target)
+	if err == errKeyNotFound {
+		return "", nil
+	}
+	return target, err
+}
+
+func (d *kvdb) GetCNAMEForDomain(domain string) (string, error) {
+	domain = sanitizeString(domain)
+	d.stripes.RLock(domain)
+	defer d.stripes.RUnlock(domain)
+	return d.getCNAME(domain)
+}
+
+// GetWildcardForDomain tells if the records of the subdomain are served for the
+// names below it
+func (d *kvdb) GetWildcardForDomain(domain string) (bool, error) {
+	domain = sanitizeString(domain)
+	username, err := d.store.Get(kvSubdomainKey(domain))
+	if err == errKeyNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	var user kvUser
+	if err = d.getJSON(kvUserKey(string(username)), &user); err == errKeyNotFound {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return user.Wildcard, nil
+}
+
+// GetZoneForDomain returns the zone of the registration of the subdomain, or an
+// empty string if the subdomain isn't registered
+func (d *kvdb) GetZoneForDomain(domain string) (string, error) {
+	domain = sanitizeString(domain)
+	username, err := d.store.Get(kvSubdomainKey(domain))
+	if err == errKeyNotFound {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	var user kvUser
+	if err = d.getJSON(kvUserKey(string(username)), &user); err == errKeyNotFound {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+	return registrationZone(ACMETxt{Origin: user.Origin}), nil
+}
+
+// GetSubnetAnswersForDomain returns the addresses the subdomain answers to the
+// clients in their subnets
+func (d *kvdb) GetSubnetAnswersForDomain(domain string) ([]subnetAnswer, error) {
+	domain = sanitizeString(domain)
+	username, err := d.store.Get(kvSubdomainKey(domain))
+	if err == errKeyNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var user kvUser
+	if err = d.getJSON(kvUserKey(string(username)), &user); err == errKeyNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return user.SubnetAnswers, nil
+}
+
+// getMX returns the mail exchangers of the subdomain
+func (d *kvdb) getMX(domain string) ([]mxRecord, error) {
+	var mxs []mxRecord
+	err := d.getJSON(kvRecordKey("mx", domain), &mxs)
+	if err == errKeyNotFound {
+		return nil, nil
+	}
+	return mxs, err
+}
+
+func (d *kvdb) GetMXForDomain(domain string) ([]mxRecord, error) {
+	domain = sanitizeString(domain)
+	d.stripes.RLock(domain)
+	defer d.stripes.RUnlock(domain)
+	return d.getMX(domain)
+}
+
+// getSRV returns the service locations of the subdomain
+func (d *kvdb) getSRV(domain string) ([]srvRecord, error) {
+	var srvs []srvRecord
+	err := d.getJSON(kvRecordKey("srv", domain), &srvs)
+	if err == errKeyNotFound {
+		return nil, nil
+	}
+	return srvs, err
+}
+
+func (d *kvdb) GetSRVForDomain(domain string) ([]srvRecord, error) {
+	domain = sanitizeString(domain)
+	d.stripes.RLock(domain)
+	defer d.stripes.RUnlock(domain)
+	return d.getSRV(domain)
+}
+
+// getCAA returns the certification authority authorization of the subdomain
+func (d *kvdb) getCAA(domain string) ([]caaRecord, error) {
+	var caas []caaRecord
+	err := d.getJSON(kvRecordKey("caa", domain), &caas)
+	if err == errKeyNotFound {
+		return nil, nil
+	}
+	return caas, err
+}
+
+func (d *kvdb) GetCAAForDomain(domain string) ([]caaRecord, error) {
+	domain = sanitizeString(domain)
+	d.stripes.RLock(domain)
+	defer d.stripes.RUnlock(domain)
+	return d.getCAA(domain)
+}
+
+// getTTL returns the TTL set for the record types of the subdomain
+func (d *kvdb) getTTL(domain string) (map[string]int, error) {
+	ttls := make(map[string]int)
+	err := d.getJSON(kvRecordKey("ttl", domain), &ttls)
+	if err == errKeyNotFound {
+		return ttls, nil
+	}
+	return ttls, err
+}
+
+func (d *kvdb) GetTTLForDomain(domain string) (map[string]int, error) {
+	domain = sanitizeString(domain)
+	d.stripes.RLock(domain)
+	defer d.stripes.RUnlock(domain)
+	return d.getTTL(domain)
+}
+
+// getRecords returns the records of the generic types of the subdomain
+func (d *kvdb) getRecords(domain string) ([]genericRecord, error) {
+	var records []genericRecord
+	err := d.getJSON(kvRecordKey("rr", domain), &records)
+	if err == errKeyNotFound {
+		return nil, nil
+	}
+	return records, err
+}
+
+func (d *kvdb) GetRecordsForDomain(domain string) ([]genericRecord, error) {
+	domain = sanitizeString(domain)
+	d.stripes.RLock(domain)
+	defer d.stripes.RUnlock(domain)
+	return d.getRecords(domain)
+}
+
+// GetSubdomainsForAddress returns the subdomains with an A or AAAA record of the address.
+// The stores have no index by value, so the records of all the subdomains are read.
+func (d *kvdb) GetSubdomainsForAddress(ip net.IP) ([]string, error) {
+	rtype := "aaaa"
+	if ip.To4() != nil {
+		rtype = "a"
+	}
+	prefix := kvRecordKey(rtype, "")
+	keys, err := d.store.Keys(prefix)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(keys)
+	var subdomains []string
+	for _, key := range keys {
+		subdomain := strings.TrimPrefix(key, prefix)
+		ips, err := d.getIPs(rtype, subdomain)
+		if err != nil {
+			return subdomains, err
+		}
+		for _, v := range ips {
+			if v.Equal(ip) {
+				subdomains = append(subdomains, subdomain)
+				break
+			}
+		}
+	}
+	return subdomains, nil
+}
+
+func (d *kvdb) CountRecords(domain string) (int, error) {
+	domain = sanitizeString(domain)
+	d.stripes.RLock(domain)
+	defer d.stripes.RUnlock(domain)
+	slots, err := d.txtSlots(domain)
+	if err != nil {
+		return 0, err
+	}
+	values := make([]string, len(slots))
+	for i, txt := range slots {
+		if txt != nil {
+			values[i] = txt.Value
+		}
+	}
+	count := len(servedTXT(values))
+	for _, rtype := range []string{"a", "aaaa"} {
+		ips, err := d.getIPs(rtype, domain)
+		if err != nil {
+			return 0, err
+		}
+		count += len(ips)
+	}
+	target, err := d.getCNAME(domain)
+	if err != nil {
+		return 0, err
+	}
+	if target != "" {
+		count++
+	}
+	mxs, err := d.getMX(domain)
+	if err != nil {
+		return 0, err
+	}
+	srvs, err := d.getSRV(domain)
+	if err != nil {
+		return 0, err
+	}
+	caas, err := d.getCAA(domain)
+	if err != nil {
+		return 0, err
+	}
+	generic, err := d.getRecords(domain)
+	if err != nil {
+		return 0, err
+	}
+	return count + len(mxs) + len(srvs) + len(caas) + len(generic), nil
+}
+
+// ClearStaleTXT removes the TXT values last updated before olderThan ago and
+// returns their number
+func (d *kvdb) ClearStaleTXT(olderThan time.Duration) (int, error) {
+	cutoff := d.Now().Add(-olderThan).Unix()
+	prefix := kvKeyPrefix + "txt:"
+	keys, err := d.store.Keys(prefix)
+	if err != nil {
+		return 0, err
+	}
+	cleared := 0
+	for _, key := range keys {
+		name := strings.TrimPrefix(key, prefix)
+		i := strings.LastIndex(name, ":")
+		if i < 0 {
+			continue
+		}
+		subdomain := name[:i]
+		d.stripes.Lock(subdomain)
+		var txt kvTXT
+		err = d.getJSON(key, &txt)
+		if err == nil && txt.Value != "" && txt.LastUpdate < cutoff {
+			err = d.store.Delete(key)
+			if err == nil {
+				cleared++
+			}
+		}
+		d.stripes.Unlock(subdomain)
+		if err != nil && err != errKeyNotFound {
+			return cleared, err
+		}
+	}
+	return cleared, nil
+}
+
+// Update stores the posted values for the subdomain. When no TXT slot is given,
+// an empty or expired slot is used, or else the least recently updated one.
+func (d *kvdb) Update(a ACMETxtPost) (ACMETxtPost, error) {
+	d.stripes.Lock(a.Subdomain)
+	defer d.stripes.Unlock(a.Subdomain)
+	return d.update(a, d.Now().Unix())
+}
+
+// UpdateBatch applies the updates of the subdomain in order while holding the lock
+// of the subdomain. The key-value stores have no transactions, so an error from
+// the store can leave the updates before it applied.
+func (d *kvdb) UpdateBatch(subdomain string, updates []ACMETxtPost) ([]ACMETxtPost, error) {
+	d.stripes.Lock(subdomain)
+	defer d.stripes.Unlock(subdomain)
+	return d.updateBatch(updates)
+}
+
+// ChangeValues applies the updates change returns for the current TXT, A and AAAA
+// values of the subdomain, read while holding the lock of the subdomain
+func (d *kvdb) ChangeValues(subdomain string, change valueChange) ([]ACMETxtPost, error) {
+	d.stripes.Lock(subdomain)
+	defer d.stripes.Unlock(subdomain)
+	slots, err := d.txtSlots(subdomain)
+	if err != nil {
+		return nil, err
+	}
+	var txts []string
+	for _, txt := range slots {
+		if txt != nil {
+			txts = append(txts, txt.Value)
+		}
+	}
+	a, err := d.getIPs("a", subdomain)
+	if err != nil {
+		return nil, err
+	}
+	aaaa, err := d.getIPs("aaaa", subdomain)
+	if err != nil {
+		return nil, err
+	}
+	updates, err := change(valuesByType(txts, a, aaaa))
+	if err != nil || len(updates) == 0 {
+		return nil, err
+	}
+	return d.updateBatch(updates)
+}
+
+// updateBatch applies the updates in order, the lock of the subdomain is held by the caller
+func (d *kvdb) updateBatch(updates []ACMETxtPost) ([]ACMETxtPost, error) {
+	timenow := d.Now().Unix()
+	updated := make([]ACMETxtPost, 0, len(updates))
+	for _, a := range updates {
+		a, err := d.update(a, timenow)
+		if err != nil {
+			return nil, err
+		}
+		updated = append(updated, a)
+	}
+	return updated, nil
+}
+
+func (d *kvdb) update(a ACMETxtPost, timenow int64) (ACMETxtPost, error) {
+	if len(a.ClearTXT) > 0 {
+		slots, err := d.txtSlots(a.Subdomain)
+		if err != nil {
+			return a, err
+		}
+		for slot, txt := range slots {
+			if txt == nil || !containsString(a.ClearTXT, txt.Value) {
+				continue
+			}
+			if err = d.store.Delete(kvTXTKey(a.Subdomain, slot)); err != nil && err != errKeyNotFound {
+				return a, err
+			}
+		}
+	}
+	if a.Value != "" {
+		slots, err := d.txtSlots(a.Subdomain)
+		if err != nil {
+			return a, err
+		}
+		var slot int
+		if a.Slot != nil {
+			slot = *a.Slot
+		} else {
+			slot = nextKVTXTSlot(slots)
+		}
+		if slot < 0 || slot >= txtSlotCount() {
+			return a, fmt.Errorf("invalid TXT slot: %d", slot)
+		}
+		err = d.setJSON(kvTXTKey(a.Subdomain, slot), kvTXT{a.Value, timenow, a.CorrelationID}, d.txtTTL)
+		if err != nil {
+			return a, err
+		}
+		a.Slot = &slot
+	}
+	if len(a.AValues) > 0 {
+		if err := d.setJSON(kvRecordKey("a", a.Subdomain), a.AValues, 0); err != nil {
+			return a, err
+		}
+	} else if a.ClearA {
+		if err := d.store.Delete(kvRecordKey("a", a.Subdomain)); err != nil {
+			return a, err
+		}
+	}
+	if len(a.AAAAValues) > 0 {
+		if err := d.setJSON(kvRecordKey("aaaa", a.Subdomain), a.AAAAValues, 0); err != nil {
+			return a, err
+		}
+	} else if a.ClearAAAA {
+		if err := d.store.Delete(kvRecordKey("aaaa", a.Subdomain)); err != nil {
+			return a, err
+		}
+	}
+	if len(a.MXValues) > 0 {
+		if err := d.setJSON(kvRecordKey("mx", a.Subdomain), a.MXValues, 0); err != nil {
+			return a, err
+		}
+	} else if a.ClearMX {
+		if err := d.store.Delete(kvRecordKey("mx", a.Subdomain)); err != nil {
+			return a, err
+		}
+	}
+	if len(a.SRVValues) > 0 {
+		if err := d.setJSON(kvRecordKey("srv", a.Subdomain), a.SRVValues, 0); err != nil {
+			return a, err
+		}
+	} else if a.ClearSRV {
+		if err := d.store.Delete(kvRecordKey("srv", a.Subdomain)); err != nil {
+			return a, err
+		}
+	}
+	if len(a.CAAValues) > 0 {
+		if err := d.setJSON(kvRecordKey("caa", a.Subdomain), a.CAAValues, 0); err != nil {
+			return a, err
+		}
+	} else if a.ClearCAA {
+		if err := d.store.Delete(kvRecordKey("caa", a.Subdomain)); err != nil {
+			return a, err
+		}
+	}
+	if changed := changedGenericTypes(a); len(changed) > 0 {
+		// Only the records of the changed types are replaced
+		stored, err := d.getRecords(a.Subdomain)
+		if err != nil {
+			return a, err
+		}
+		var records []genericRecord
+		for _, g := range stored {
+			kept := true
+			for _, rtype := range changed {
+				if g.Type == rtype {
+					kept = false
+				}
+			}
+			if kept {
+				records = append(records, g)
+			}
+		}
+		records = append(records, a.Records...)
+		sort.Slice(records, func(i, j int) bool {
+			if records[i].Type != records[j].Type {
+				return records[i].Type < records[j].Type
+			}
+			return records[i].Content < records[j].Content
+		})
+		if len(records) > 0 {
+			err = d.setJSON(kvRecordKey("rr", a.Subdomain), records, 0)
+		} else {
+			err = d.store.Delete(kvRecordKey("rr", a.Subdomain))
+		}
+		if err != nil {
+			return a, err
+		}
+	}
+	// A CNAME can't coexist with other records, setting either replaces the other
+	if a.CNAME != "" {
+		for _, rtype := range []string{"a", "aaaa", "mx", "srv", "caa", "rr"} {
+			if err := d.store.Delete(kvRecordKey(rtype, a.Subdomain)); err != nil {
+				return a, err
+			}
+		}
+		if err := d.setJSON(kvRecordKey("cname", a.Subdomain), a.CNAME, 0); err != nil {
+			return a, err
+		}
+	} else if a.ClearCNAME || len(a.AValues) > 0 || len(a.AAAAValues) > 0 || len(a.MXValues) > 0 || len(a.SRVValues) > 0 || len(a.CAAValues) > 0 || len(a.Records) > 0 {
+		if err := d.store.Delete(kvRecordKey("cname", a.Subdomain)); err != nil {
+			return a, err
+		}
+	}
+	if replaced := ttlReplacedTypes(a); len(replaced) > 0 {
+		ttls, err := d.getTTL(a.Subdomain)
+		if err != nil {
+			return a, err
+		}
+		for _, rtype := range replaced {
+			delete(ttls, rtype)
+		}
+		if a.TTL != 0 {
+			for _, rtype := range ttlSetTypes(a) {
+				ttls[rtype] = a.TTL
+			}
+		}
+		if len(ttls) > 0 {
+			err = d.setJSON(kvRecordKey("ttl", a.Subdomain), ttls, 0)
+		} else {
+			err = d.store.Delete(kvRecordKey("ttl", a.Subdomain))
+		}
+		if err != nil {
+			return a, err
+		}
+	}
+	if err := d.setLastUpdates(a, timenow); err != nil {
+		return a, err
+	}
+	return a, nil
+}
+
+// nextKVTXTSlot returns the lowest empty slot, or the least recently updated one
+func nextKVTXTSlot(slots []*kvTXT) int {
+	for slot, txt := range slots {
+		if txt == nil {
+			return slot
+		}
+	}
+	next := 0
+	for slot, txt := range slots {
+		if txt.LastUpdate < slots[next].LastUpdate {
+			next = slot
+		}
+	}
+	return next
+}
+
+func (d *kvdb) Close() {
+	if d.store == nil {
+		return
+	}
+	if err := d.store.Close(); err != nil {
+		dbLog.WithFields(log.Fields{"error": err.Error()}).Error("Error while closing the key-value store")
+	}
+}
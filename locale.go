@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// defaultLocale is the locale used for the descriptions missing from the catalog
+// of the selected locale
+const defaultLocale = "en"
+
+// builtinCatalogs are the descriptions of the API error codes shipped with acme-dns
+var builtinCatalogs = map[string]map[string]string{
+	"en": {
+		"approval_required":           "Updates to this subdomain have to be approved first.",
+		"bad_a":                       "The A record values are not valid IPv4 addresses.",
+		"bad_aaaa":                    "The AAAA record values are not valid IPv6 addresses.",
+		"bad_bulk_request":            "The bulk request is not valid.",
+		"bad_caa":                     "The CAA record values are not valid.",
+		"bad_cname":                   "The CNAME target is not a valid domain name.",
+		"bad_correlation_id":          "The correlation ID is not valid.",
+		"bad_mx":                      "The MX record values are not valid.",
+		"bad_records":                 "The records are not valid.",
+		"bad_request":                 "The request is not valid.",
+		"bad_settings":                "The settings are not valid.",
+		"bad_slot":                    "The TXT slot does not exist.",
+		"bad_srv":                     "The SRV record values are not valid.",
+		"bad_subdomain":               "The subdomain is not valid.",
+		"bad_ttl":                     "The TTL is out of the allowed range.",
+		"bad_txt":                     "The TXT value is not a valid ACME challenge token.",
+		"bad_wildcard":                "The wildcard flag can only be used with a TXT value and at least two TXT slots.",
+		"context_error":               "The request could not be processed.",
+		"database_busy":               "The database is busy, retry the request.",
+		"db_error":                    "The database could not process the request.",
+		"delegation_monitor_disabled": "The delegation monitor is not enabled.",
+		"forbidden":                   "The request is not allowed.",
+		"invalid_allowfrom_cidr":      "The allowed networks are not valid CIDR ranges.",
+		"invalid_confirmation":        "The confirmation does not match.",
+		"json_error":                  "The response could not be encoded.",
+		"malformed_json_payload":      "The request payload is not valid JSON.",
+		"method_not_allowed":          "The endpoint does not support the request method.",
+		"not_found":                   "The requested resource does not exist.",
+		"read_only":                   "The API is in read-only mode for maintenance, retry later.",
+		"record_type_not_allowed":     "The record type is not allowed for this registration.",
+		"registration_disabled":       "Registration is disabled.",
+		"registration_limit_reached":  "No more registrations are accepted.",
+		"standby":                     "This instance is on standby, use the primary instance.",
+		"template_error":              "The template could not be applied.",
+		"unauthorized":                "The credentials are missing or not valid.",
+		"unknown_toggle":              "The runtime toggle does not exist.",
+		"unknown_zone":                "The zone is not served by this instance.",
+		"unsupported_media_type":      "The request content type is not supported.",
+		"update_too_frequent":         "The subdomain was updated too recently, retry later.",
+		"authentication_busy":         "Too many authentication attempts are being processed, retry later.",
+		"https_required":              "The API is only served over HTTPS, send the request to the https:// URL in the Location header.",
+		"no_schema":                   "The database engine has no schema to migrate.",
+		"migration_failed":            "The database migration failed, see the log of the instance.",
+	},
+	"de": {
+		"approval_required":           "Änderungen dieser Subdomain müssen zuerst genehmigt werden.",
+		"bad_a":                       "Die Werte des A-Eintrags sind keine gültigen IPv4-Adressen.",
+		"bad_aaaa":                    "Die Werte des AAAA-Eintrags sind keine gültigen IPv6-Adressen.",
+		"bad_bulk_request":            "Die Sammelanfrage ist ungültig.",
+		"bad_caa":                     "Die Werte des CAA-Eintrags sind ungültig.",
+		"bad_cname":                   "Das Ziel des CNAME-Eintrags ist kein gültiger Domainname.",
+		"bad_correlation_id":          "Die Korrelations-ID ist ungültig.",
+		"bad_mx":                      "Die Werte des MX-Eintrags sind ungültig.",
+		"bad_records":                 "Die Einträge sind ungültig.",
+		"bad_request":                 "Die Anfrage ist ungültig.",
+		"bad_settings":                "Die Einstellungen sind ungültig.",
+		"bad_slot":                    "Der TXT-Slot existiert nicht.",
+		"bad_srv":                     "Die Werte des SRV-Eintrags sind ungültig.",
+		"bad_subdomain":               "Die Subdomain ist ungültig.",
+		"bad_ttl":                     "Die TTL liegt außerhalb des erlaubten Bereichs.",
+		"bad_txt":                     "Der TXT-Wert ist kein gültiges ACME-Challenge-Token.",
+		"bad_wildcard":                "Das Wildcard-Flag kann nur mit einem TXT-Wert und mindestens zwei TXT-Slots verwendet werden.",
+		"context_error":               "Die Anfrage konnte nicht verarbeitet werden.",
+		"database_busy":               "Die Datenbank ist ausgelastet, bitte die Anfrage wiederholen.",
+		"db_error":                    "Die Datenbank konnte die Anfrage nicht verarbeiten.",
+		"delegation_monitor_disabled": "Die Überwachung der Delegation ist nicht aktiviert.",
+		"forbidden":                   "Die Anfrage ist nicht erlaubt.",
+		"invalid_allowfrom_cidr":      "Die erlaubten Netze sind keine gültigen CIDR-Bereiche.",
+		"invalid_confirmation":        "Die Bestätigung stimmt nicht überein.",
+		"json_error":                  "Die Antwort konnte nicht kodiert werden.",
+		"malformed_json_payload":      "Der Inhalt der Anfrage ist kein gültiges JSON.",
+		"method_not_allowed":          "Der Endpunkt unterstützt die Methode der Anfrage nicht.",
+		"not_found":                   "Die angefragte Ressource existiert nicht.",
+		"read_only":                   "Die API ist wegen Wartungsarbeiten schreibgeschützt, bitte später erneut versuchen.",
+		"record_type_not_allowed":     "Der Eintragstyp ist für diese Registrierung nicht erlaubt.",
+		"registration_disabled":       "Die Registrierung ist deaktiviert.",
+		"registration_limit_reached":  "Es werden keine weiteren Registrierungen angenommen.",
+		"standby":                     "Diese Instanz ist im Standby, bitte die primäre Instanz verwenden.",
+		"template_error":              "Die Vorlage konnte nicht angewendet werden.",
+		"unauthorized":                "Die Zugangsdaten fehlen oder sind ungültig.",
+		"unknown_toggle":              "Der Laufzeitschalter existiert nicht.",
+		"unknown_zone":                "Die Zone wird von dieser Instanz nicht bedient.",
+		"unsupported_media_type":      "Der Inhaltstyp der Anfrage wird nicht unterstützt.",
+		"update_too_frequent":         "Die Subdomain wurde vor zu kurzer Zeit aktualisiert, bitte später erneut versuchen.",
+		"authentication_busy":         "Es werden zu viele Anmeldeversuche verarbeitet, bitte später erneut versuchen.",
+		"https_required":              "Die API ist nur über HTTPS erreichbar, bitte die Anfrage an die https://-URL im Location-Header senden.",
+		"no_schema":                   "Die Datenbank-Engine hat kein Schema zum Migrieren.",
+		"migration_failed":            "Die Datenbankmigration ist fehlgeschlagen, siehe das Log der Instanz.",
+	},
+}
+
+// messageCatalogs are the descriptions of the error codes by locale, the built-in
+// ones merged with the ones loaded from the configured directory
+var messageCatalogs = builtinCatalogs
+
+// loadMessageCatalogs reads the catalogs from the <locale>.json files of the
+// directory, each a JSON object of descriptions by error code. The descriptions
+// override the built-in ones of the same locale.
+func loadMessageCatalogs(dir string) (map[string]map[string]string, error) {
+	catalogs := make(map[string]map[string]string)
+	for locale, messages := range builtinCatalogs {
+		catalogs[locale] = make(map[string]string)
+		for code, message := range messages {
+			catalogs[locale][code] = message
+		}
+	}
+	if dir == "" {
+		return catalogs, nil
+	}
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		var messages map[string]string
+		if err := json.Unmarshal(data, &messages); err != nil {
+			return nil, fmt.Errorf("message catalog %s: %v", file, err)
+		}
+		locale := strings.ToLower(strings.TrimSuffix(filepath.Base(file), ".json"))
+		if catalogs[locale] == nil {
+			catalogs[locale] = make(map[string]string)
+		}
+		for code, message := range messages {
+			catalogs[locale][code] = message
+		}
+	}
+	return catalogs, nil
+}
+
+// setupMessageCatalogs loads the message catalogs and checks that the configured
+// locale has one
+func setupMessageCatalogs(conf httpapi) error {
+	catalogs, err := loadMessageCatalogs(conf.MessageCatalogDir)
+	if err != nil {
+		return err
+	}
+	if conf.Locale != "" && catalogs[strings.ToLower(conf.Locale)] == nil {
+		return fmt.Errorf("no message catalog for locale %q", conf.Locale)
+	}
+	messageCatalogs = catalogs
+	return nil
+}
+
+// negotiateLocale returns the locale of the Accept-Language header with the highest
+// quality that has a catalog, falling back to the configured locale
+func negotiateLocale(header string, fallback string) string {
+	type weighted struct {
+		tag string
+		q   float64
+	}
+	var tags []weighted
+	for _, part := range strings.Split(header, ",") {
+		fields := strings.Split(part, ";")
+		tag := strings.ToLower(strings.TrimSpace(fields[0]))
+		if tag == "" {
+			continue
+		}
+		q := 1.0
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if v, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					q = v
+				}
+			}
+		}
+		if q > 0 {
+			tags = append(tags, weighted{tag, q})
+		}
+	}
+	sort.SliceStable(tags, func(i, j int) bool { return tags[i].q > tags[j].q })
+	for _, t := range tags {
+		if t.tag == "*" {
+			break
+		}
+		if messageCatalogs[t.tag] != nil {
+			return t.tag
+		}
+		// de-AT falls back to de
+		if primary, _, found := strings.Cut(t.tag, "-"); found && messageCatalogs[primary] != nil {
+			return primary
+		}
+	}
+	return strings.ToLower(fallback)
+}
+
+// localeGate selects the locale of the error descriptions from the Accept-Language
+// header of the request, announcing it in the Content-Language header of the
+// response for WriteJsonResponse to pick up
+func localeGate(locale string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if selected := negotiateLocale(r.Header.Get("Accept-Language"), locale); selected != "" {
+			w.Header().Set("Content-Language", selected)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// describeError returns the description of the error code in the locale, or in
+// the default locale if the catalog of the locale doesn't have one
+func describeError(locale string, code string) string {
+	if message, ok := messageCatalogs[locale][code]; ok {
+		return message
+	}
+	return messageCatalogs[defaultLocale][code]
+}
+
+// localizeError adds the description of the error code to an error response body,
+// right after the code. Bodies without a known error code are returned as is.
+func localizeError(locale string, body []byte) []byte {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return body
+	}
+	var code string
+	if err := json.Unmarshal(fields["error"], &code); err != nil {
+		return body
+	}
+	description := describeError(locale, code)
+	if description == "" {
+		return body
+	}
+	quoted, _ := json.Marshal(description)
+	var out bytes.Buffer
+	fmt.Fprintf(&out, "{\"error\": %s, \"description\": %s", fields["error"], quoted)
+	keys := make([]string, 0, len(fields))
+	for key := range fields {
+		if key != "error" && key != "description" {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Fprintf(&out, ", %q: %s", key, fields[key])
+	}
+	out.WriteString("}")
+	return out.Bytes()
+}
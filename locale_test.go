@@ -0,0 +1,98 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestNegotiateLocale(t *testing.T) {
+	for i, test := range []struct {
+		header   string
+		fallback string
+		expected string
+	}{
+		{"", "", ""},
+		{"", "de", "de"},
+		{"de", "", "de"},
+		{"de-AT, en;q=0.5", "en", "de"},
+		{"fr, en;q=0.8, de;q=0.9", "", "de"},
+		{"fr", "en", "en"},
+		{"de;q=0, en;q=0.1", "", "en"},
+		{"*", "de", "de"},
+	} {
+		if locale := negotiateLocale(test.header, test.fallback); locale != test.expected {
+			t.Errorf("Test %d: expected locale %q for %q, got %q", i, test.expected, test.header, locale)
+		}
+	}
+}
+
+func TestLocalizeError(t *testing.T) {
+	for i, test := range []struct {
+		locale   string
+		body     string
+		expected string
+	}{
+		{"de", `{"error": "unauthorized"}`, `{"error": "unauthorized", "description": "Die Zugangsdaten fehlen oder sind ungültig."}`},
+		{"en", `{"error":"bad_txt","details":[{"field":"txt","message":"too short"}]}`, `{"error": "bad_txt", "description": "The TXT value is not a valid ACME challenge token.", "details": [{"field":"txt","message":"too short"}]}`},
+		{"xx", `{"error": "forbidden"}`, `{"error": "forbidden", "description": "The request is not allowed."}`},
+		{"de", `{"error": "no_such_code"}`, `{"error": "no_such_code"}`},
+		{"de", `{"ready": false}`, `{"ready": false}`},
+	} {
+		if body := string(localizeError(test.locale, []byte(test.body))); body != test.expected {
+			t.Errorf("Test %d: expected %s, got %s", i, test.expected, body)
+		}
+	}
+}
+
+func TestLocaleGate(t *testing.T) {
+	handler := localeGate("", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		WriteJsonResponse(w, http.StatusForbidden, jsonError("forbidden"))
+	}))
+	for _, test := range []struct {
+		acceptLanguage string
+		expected       string
+	}{
+		{"", `{"error": "forbidden"}`},
+		{"de-DE", `{"error": "forbidden", "description": "Die Anfrage ist nicht erlaubt."}`},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/update", nil)
+		req.Header.Set("Accept-Language", test.acceptLanguage)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Body.String() != test.expected {
+			t.Errorf("Expected %s for %q, got %s", test.expected, test.acceptLanguage, rec.Body.String())
+		}
+	}
+}
+
+func TestLoadMessageCatalogs(t *testing.T) {
+	defer func() { messageCatalogs = builtinCatalogs }()
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "fr.json"), []byte(`{"forbidden": "La requête n'est pas autorisée."}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "de.json"), []byte(`{"forbidden": "Verboten."}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := setupMessageCatalogs(httpapi{Locale: "fr", MessageCatalogDir: dir}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if d := describeError("fr", "forbidden"); d != "La requête n'est pas autorisée." {
+		t.Errorf("Expected the loaded description, got %q", d)
+	}
+	if d := describeError("fr", "unauthorized"); d != builtinCatalogs["en"]["unauthorized"] {
+		t.Errorf("Expected the English description for codes missing from the catalog, got %q", d)
+	}
+	if d := describeError("de", "forbidden"); d != "Verboten." {
+		t.Errorf("Expected the loaded description to override the built-in one, got %q", d)
+	}
+	if builtinCatalogs["de"]["forbidden"] == "Verboten." {
+		t.Errorf("Expected the built-in catalog to be left as is")
+	}
+	if err := setupMessageCatalogs(httpapi{Locale: "it"}); err == nil {
+		t.Errorf("Expected an error for a locale without a catalog")
+	}
+}
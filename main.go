@@ -7,24 +7,34 @@ import (
 	"context"
 	"crypto/tls"
 	"flag"
+	"fmt"
 	stdlog "log"
 	"net/http"
 	"os"
-	"strings"
+	"os/signal"
 	"syscall"
+	"time"
 
 	"github.com/caddyserver/certmagic"
 	legolog "github.com/go-acme/lego/v3/log"
-	"github.com/julienschmidt/httprouter"
 	"github.com/rs/cors"
 	log "github.com/sirupsen/logrus"
 )
 
+// version is stamped at release builds with -ldflags "-X main.version=<version>"
+var version = "dev"
+
 func main() {
 	// Created files are not world writable
 	syscall.Umask(0077)
 	configPtr := flag.String("c", "/etc/acme-dns/config.cfg", "config file location")
+	versionPtr := flag.Bool("version", false, "print the version and exit")
 	flag.Parse()
+	if *versionPtr {
+		fmt.Println("acme-dns " + version)
+		return
+	}
+	log.WithFields(log.Fields{"version": version}).Info("Starting acme-dns")
 	// Read global config
 	var err error
 	if fileIsAccessible(*configPtr) {
@@ -42,11 +52,113 @@ func main() {
 		os.Exit(1)
 	}
 
-	setupLogging(Config.Logconfig.Format, Config.Logconfig.Level)
+	setupLogging(Config.Logconfig)
+
+	if flag.Arg(0) == "migrate" {
+		migrateFlags := flag.NewFlagSet("migrate", flag.ExitOnError)
+		dryRun := migrateFlags.Bool("dry-run", false, "list the pending migrations without applying them")
+		_ = migrateFlags.Parse(flag.Args()[1:])
+		if err = runMigrations(Config.Database.Engine, Config.Database.Connection, *dryRun, os.Stdout); err != nil {
+			log.Errorf("Could not migrate database [%v]", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if flag.Arg(0) == "init-db" {
+		if err = runInitDB(Config.Database.Engine, Config.Database.Connection, os.Stdout); err != nil {
+			log.Errorf("Could not initialize database [%v]", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if flag.Arg(0) == "dnssec" {
+		var keyDB database
+		if Config.DNSSEC.KeyStorage == "database" {
+			if keyDB, err = openBackend(Config.Database.Engine, Config.Database.Connection); err != nil {
+				log.Errorf("Could not open database [%v]", err)
+				os.Exit(1)
+			}
+			defer keyDB.Close()
+		}
+		if err = runDNSSECCommand(Config, newDNSSECKeyStore(Config.DNSSEC, keyDB), flag.Args()[1:], os.Stdout); err != nil {
+			log.Errorf("DNSSEC command failed [%v]", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if flag.Arg(0) == "delegation-info" {
+		infoFlags := flag.NewFlagSet("delegation-info", flag.ExitOnError)
+		jsonOutput := infoFlags.Bool("json", false, "print the delegation info as JSON")
+		_ = infoFlags.Parse(flag.Args()[1:])
+		var keyDB database
+		if Config.DNSSEC.Enabled && Config.DNSSEC.KeyStorage == "database" {
+			if keyDB, err = openBackend(Config.Database.Engine, Config.Database.Connection); err != nil {
+				log.Errorf("Could not open database [%v]", err)
+				os.Exit(1)
+			}
+			defer keyDB.Close()
+		}
+		if err = runDelegationInfo(Config, newDNSSECKeyStore(Config.DNSSEC, keyDB), *jsonOutput, os.Stdout); err != nil {
+			log.Errorf("Could not generate the delegation info [%v]", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if flag.Arg(0) == "admin" {
+		adminDB, err := openBackend(Config.Database.Engine, Config.Database.Connection)
+		if err != nil {
+			log.Errorf("Could not open database [%v]", err)
+			os.Exit(1)
+		}
+		err = runAdminCommand(adminDB, flag.Args()[1:], os.Stdin, os.Stdout)
+		adminDB.Close()
+		if err != nil {
+			log.Errorf("Admin command failed [%v]", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if flag.Arg(0) == "zone" {
+		if err = runZoneCommand(Config, flag.Args()[1:], os.Stdout); err != nil {
+			log.Errorf("Zone command failed [%v]", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if flag.Arg(0) == "verify-zone" {
+		verifyFlags := flag.NewFlagSet("verify-zone", flag.ExitOnError)
+		server := verifyFlags.String("server", Config.General.Listen, "address of the DNS server to verify")
+		_ = verifyFlags.Parse(flag.Args()[1:])
+		// Compare the answers against the database contents instead of cached data
+		Config.Database.RecordCacheTTL = 0
+		Config.Database.NegativeCacheTTL = 0
+		Config.Database.ServeStale = false
+		verifyDB, err := openBackend(Config.Database.Engine, Config.Database.Connection)
+		if err != nil {
+			log.Errorf("Could not open database [%v]", err)
+			os.Exit(1)
+		}
+		err = runVerifyZone(verifyDB, *server, Config.General.Domain, os.Stdout)
+		verifyDB.Close()
+		if err != nil {
+			log.Errorf("Zone verification failed [%v]", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	// The API is only started once the database is migrated and the nameserver
+	// listens, so that the records it accepts can actually be served
+	Startup = newStartupTracker(startupPhases(Config)...)
 
 	// Open database
-	newDB := new(acmedb)
-	err = newDB.Init(Config.Database.Engine, Config.Database.Connection)
+	newDB, err := openBackend(Config.Database.Engine, Config.Database.Connection)
 	if err != nil {
 		log.Errorf("Could not open database [%v]", err)
 		os.Exit(1)
@@ -54,54 +166,214 @@ func main() {
 		log.Info("Connected to database")
 	}
 	DB = newDB
+	Startup.Complete("database")
 	defer DB.Close()
 
+	if err = loadRuntimeToggles(DB, Config.API); err != nil {
+		log.Errorf("Could not load the runtime toggles [%v]", err)
+		os.Exit(1)
+	}
+
+	if err = setupMessageCatalogs(Config.API); err != nil {
+		log.Errorf("Could not load the message catalogs [%v]", err)
+		os.Exit(1)
+	}
+
+	if Config.Audit.Enabled {
+		if Audit, err = newAuditLog(DB, Config.Audit.File); err != nil {
+			log.Errorf("Could not open the audit file [%v]", err)
+			os.Exit(1)
+		}
+		defer Audit.Close()
+	}
+
+	AuthMetrics = newAuthMetrics(Config.API, nil)
+	if Config.API.VerifyWorkers > 0 {
+		Verifications = newVerificationPool(Config.API.VerifyWorkers, Config.API.VerifyQueueSize)
+		defer Verifications.Stop()
+	}
+
+	stopReplication, err := startReplication(DB, Config.Replication)
+	if err != nil {
+		log.Errorf("Could not start the replication [%v]", err)
+		os.Exit(1)
+	}
+	defer stopReplication()
+
+	if Config.Database.WarmUpHours > 0 {
+		warmUpCache(DB, time.Duration(Config.Database.WarmUpHours)*time.Hour)
+	}
+
+	if Config.Database.ServeStale {
+		stopRefresh := runSnapshotRefresh(DB, time.Duration(Config.Database.StaleRefresh)*time.Second)
+		defer close(stopRefresh)
+	}
+
+	if Config.Standby.Enabled {
+		Standby = newStandbyCoordinator(DB, Config.Standby)
+		go Standby.Run()
+		defer Standby.Stop()
+	}
+
 	// Error channel for servers
 	errChan := make(chan error, 1)
 
-	// DNS server
-	dnsservers := make([]*DNSServer, 0)
-	if strings.HasPrefix(Config.General.Proto, "both") {
-		// Handle the case where DNS server should be started for both udp and tcp
-		udpProto := "udp"
-		tcpProto := "tcp"
-		if strings.HasSuffix(Config.General.Proto, "4") {
-			udpProto += "4"
-			tcpProto += "4"
-		} else if strings.HasSuffix(Config.General.Proto, "6") {
-			udpProto += "6"
-			tcpProto += "6"
-		}
-		dnsServerUDP := NewDNSServer(DB, Config.General.Listen, udpProto, Config.General.Domain)
-		dnsservers = append(dnsservers, dnsServerUDP)
-		dnsServerUDP.ParseRecords(Config)
-		dnsServerTCP := NewDNSServer(DB, Config.General.Listen, tcpProto, Config.General.Domain)
-		dnsservers = append(dnsservers, dnsServerTCP)
-		// No need to parse records from config again
-		dnsServerTCP.Domains = dnsServerUDP.Domains
-		dnsServerTCP.SOA = dnsServerUDP.SOA
-		go dnsServerUDP.Start(errChan)
-		go dnsServerTCP.Start(errChan)
-	} else {
-		dnsServer := NewDNSServer(DB, Config.General.Listen, Config.General.Proto, Config.General.Domain)
-		dnsservers = append(dnsservers, dnsServer)
-		dnsServer.ParseRecords(Config)
+	// DNS servers
+	dnsservers := newDNSServers(DB, Config)
+	if Config.DNSSEC.Enabled {
+		store := newDNSSECKeyStore(Config.DNSSEC, DB)
+		signer, err := loadDNSSECSigner(Config.General.Domain, Config.DNSSEC, store)
+		if err != nil {
+			log.Errorf("Could not load the DNSSEC keys [%v]", err)
+			os.Exit(1)
+		}
+		log.WithFields(log.Fields{"ds": signer.DS().String()}).Info("Signing the zone with DNSSEC")
+		for _, dnsServer := range dnsservers {
+			dnsServer.DNSSEC = signer
+		}
+		roller := newDNSSECRoller(signer, store, Config.DNSSEC)
+		go roller.Run()
+		defer roller.Stop()
+	} else if Config.DNSSEC.Audit {
+		SigningAudit = dnsservers[0].SigningAudit
+		log.Info("Counting the answers DNSSEC would sign, served by /admin/dnssec/audit")
+	}
+	if Config.API.MinUpdateInterval > 0 {
+		UpdateThrottle = newUpdateThrottle(time.Duration(Config.API.MinUpdateInterval)*time.Second, nil)
+	}
+	if dnsservers[0].SOA != nil {
+		ZoneSerial = newZoneSerial(dnsservers[0].Domains, dnsservers[0].SOA, nil)
+	}
+	// The UDP servers share the worker pool
+	for _, dnsServer := range dnsservers {
+		if dnsServer.UDPPool != nil {
+			dnsServer.UDPPool.Run()
+			defer dnsServer.UDPPool.Stop()
+			break
+		}
+	}
+	// The certificate of the API is also served by the DNS-over-TLS listener
+	getCertificate, err := apiCertificate(Config, dnsservers)
+	if err != nil {
+		log.Errorf("Could not set up the TLS certificate [%v]", err)
+		os.Exit(1)
+	}
+	for _, dnsServer := range dnsservers {
+		if dnsServer.Server.Net == "tcp-tls" {
+			dnsServer.Server.TLSConfig = &tls.Config{MinVersion: tls.VersionTLS12, GetCertificate: getCertificate}
+		}
+	}
+	for _, dnsServer := range dnsservers {
+		phase := dnsStartupPhase(dnsServer.Server.Net, dnsServer.Server.Addr)
+		dnsServer.Server.NotifyStartedFunc = func() { Startup.Complete(phase) }
 		go dnsServer.Start(errChan)
 	}
 
-	// HTTP API
-	go startHTTPAPI(errChan, Config, dnsservers)
+	if dnsservers[0].APIRecords != nil {
+		go dnsservers[0].APIRecords.Run()
+		defer dnsservers[0].APIRecords.Stop()
+	}
+
+	if dnsservers[0].Stats != nil {
+		go startStatistics(errChan, Config.Statistics.Listen, dnsservers[0].Stats)
+	}
+
+	if dnsservers[0].Tap != nil {
+		go dnsservers[0].Tap.Run()
+		defer dnsservers[0].Tap.Stop()
+	}
 
-	// block waiting for error
+	if Config.Maintenance.Interval > 0 {
+		maintenance := newMaintainer(DB, Config.Maintenance)
+		go maintenance.Run()
+		defer maintenance.Stop()
+	}
+
+	if Config.Delegation.Interval > 0 {
+		Delegation = newDelegationMonitor(Config, dnsservers[0].Domains)
+		go Delegation.Run()
+		defer Delegation.Stop()
+	}
+
+	if Config.API.DoH {
+		DoHServer = dnsservers[0]
+	}
+
+	// HTTP API, once all the startup phases have completed
+	log.WithFields(log.Fields{"pending": Startup.Pending()}).Info("Waiting for the startup phases before starting the API")
+	select {
+	case <-Startup.Done():
+	case err = <-errChan:
+		log.WithFields(log.Fields{"pending": Startup.Pending()}).Error("Startup failed, the API is not started")
+		log.Fatal(err)
+	}
+	go startHTTPAPI(errChan, Config, getCertificate)
+	if Config.API.HTTPRedirectPort != "" && getCertificate != nil {
+		go startHTTPRedirect(errChan, Config)
+	}
+
+	// block waiting for error or a signal to stop
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
 	for {
-		err = <-errChan
-		if err != nil {
-			log.Fatal(err)
+		select {
+		case err = <-errChan:
+			if err != nil {
+				log.Fatal(err)
+			}
+		case sig := <-stop:
+			log.WithFields(log.Fields{"signal": sig.String(), "timeout": Config.General.TCPDrainTimeout}).Info("Shutting down, draining the DNS listeners")
+			drainDNSServers(dnsservers, time.Duration(Config.General.TCPDrainTimeout)*time.Second)
+			return
 		}
 	}
 }
 
-func startHTTPAPI(errChan chan error, config DNSConfig, dnsservers []*DNSServer) {
+// newAPIRouter returns the router of the HTTP API with all the endpoints
+func newAPIRouter() *apiRouter {
+	api := newRouter()
+	api.POST("/register", webRegisterPost, registrationGate, AuthForRegister)
+	api.POST("/update", webUpdatePost, AuthForUpdate, throttled, audited("update"))
+	api.POST("/update/batch", webUpdateBatchPost, AuthForAccount, throttled, audited("update"))
+	api.POST("/transaction", webTransactionPost, AuthForAccount, throttled, audited("update"))
+	api.DELETE("/register", webDeregister, AuthForAccount, audited("deregister"))
+	api.PATCH("/registration", webRegistrationPatch, AuthForAccount, audited("registration_change"))
+	api.POST("/allowfrom", webAllowFromPost, AuthForAccount)
+	api.GET("/cname", webCNAMEInstructions, AuthForAccount)
+	api.GET("/txt", webTXTSlots, AuthForAccount)
+	api.GET("/records", webRecords, AuthForAccount)
+	api.GET("/whoami", webWhoami)
+	api.POST("/approvals/:id", webApprovalDecision, audited("approval_decision"))
+	api.GET(dohPath, webDNSQuery)
+	api.POST(dohPath, webDNSQuery)
+	api.GET("/health", healthCheck)
+	api.GET("/readyz", readinessCheck)
+
+	admin := api.Group("/admin", AuthForAdmin, audited("admin"))
+	admin.GET("/registrations", webAdminRegistrations)
+	admin.GET("/inactive", webAdminInactive)
+	admin.POST("/registrations/:username/allowfrom", webAdminAllowFromPost)
+	admin.POST("/bulk/preview", webAdminBulkPreview)
+	admin.POST("/bulk/confirm", webAdminBulkConfirm)
+	admin.POST("/canaries", webAdminCreateCanary)
+	admin.GET("/approvals", webAdminApprovals)
+	admin.POST("/approvals/:id", webAdminApprovalDecision)
+	admin.GET("/delegation", webAdminDelegation)
+	admin.GET("/delegation/info", webAdminDelegationInfo)
+	admin.GET("/credentials", webAdminCredentials)
+	admin.GET("/capacity", webAdminCapacity)
+	admin.GET("/toggles", webAdminToggles)
+	admin.POST("/toggles", webAdminTogglesPost)
+	admin.GET("/audit", webAdminAudit)
+	admin.GET("/zone/serial", webAdminZoneSerial)
+	admin.GET("/auth/metrics", webAdminAuthMetrics)
+	admin.GET("/db", webAdminDB)
+	admin.POST("/db", webAdminDBMigrate)
+	admin.GET("/dnssec/audit", webAdminDNSSECAudit)
+	return api
+}
+
+func startHTTPAPI(errChan chan error, config DNSConfig, getCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error)) {
 	// Setup http logger
 	logger := log.New()
 	logwriter := logger.Writer()
@@ -112,10 +384,10 @@ func startHTTPAPI(errChan chan error, config DNSConfig, dnsservers []*DNSServer)
 	// Lego
 	legolog.Logger = logger
 
-	api := httprouter.New()
+	api := newAPIRouter()
 	c := cors.New(cors.Options{
 		AllowedOrigins:     Config.API.CorsOrigins,
-		AllowedMethods:     []string{"GET", "POST"},
+		AllowedMethods:     []string{"GET", "POST", "PATCH", "DELETE"},
 		OptionsPassthrough: false,
 		Debug:              Config.General.Debug,
 	})
@@ -123,33 +395,78 @@ func startHTTPAPI(errChan chan error, config DNSConfig, dnsservers []*DNSServer)
 		// Logwriter for saner log output
 		c.Log = stdlog.New(logwriter, "", 0)
 	}
-	if !Config.API.DisableRegistration {
-		api.POST("/register", AuthForRegister(webRegisterPost))
-	}
-	api.POST("/update", AuthForUpdate(webUpdatePost))
-	api.GET("/health", healthCheck)
 
 	host := Config.API.IP + ":" + Config.API.Port
+	var handler http.Handler = api
+	if policy := newUserAgentPolicy(Config.API); policy != nil {
+		handler = userAgentGate(policy, handler)
+	}
+	handler = readOnlyGate(handler)
+	if Standby != nil {
+		handler = standbyGate(Standby, handler)
+	}
+	handler = localeGate(Config.API.Locale, handler)
 
 	// TLS specific general settings
 	cfg := &tls.Config{
-		MinVersion: tls.VersionTLS12,
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: getCertificate,
+	}
+	var err error
+	if getCertificate != nil {
+		srv := &http.Server{
+			Addr:      host,
+			Handler:   c.Handler(handler),
+			TLSConfig: cfg,
+			ErrorLog:  stdlog.New(logwriter, "", 0),
+		}
+		fields := log.Fields{"host": host}
+		if config.API.TLS != "cert" {
+			fields["domains"] = apiCertNames(config)
+		}
+		log.WithFields(fields).Info("Listening HTTPS")
+		err = srv.ListenAndServeTLS("", "")
+	} else {
+		log.WithFields(log.Fields{"host": host}).Info("Listening HTTP")
+		err = http.ListenAndServe(host, c.Handler(handler))
+	}
+	if err != nil {
+		errChan <- err
+	}
+}
+
+// apiCertificate returns the function getting the certificate of the API for the
+// TLS handshakes, nil when the API is served over plain HTTP. The DNS-over-TLS
+// listener is served with the same certificate.
+func apiCertificate(config DNSConfig, dnsservers []*DNSServer) (func(*tls.ClientHelloInfo) (*tls.Certificate, error), error) {
+	switch config.API.TLS {
+	case "cert":
+		cert, err := tls.LoadX509KeyPair(config.API.TLSCertFullchain, config.API.TLSCertPrivkey)
+		if err != nil {
+			return nil, err
+		}
+		return func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return &cert, nil
+		}, nil
+	case "letsencrypt", "letsencryptstaging":
+	default:
+		return nil, nil
 	}
 	provider := NewChallengeProvider(dnsservers)
-	storage := certmagic.FileStorage{Path: Config.API.ACMECacheDir}
+	storage := certmagic.FileStorage{Path: config.API.ACMECacheDir}
 
 	// Set up certmagic for getting certificate for acme-dns api
 	certmagic.DefaultACME.DNS01Solver = &provider
 	certmagic.DefaultACME.Agreed = true
-	if Config.API.TLS == "letsencrypt" {
+	if config.API.TLS == "letsencrypt" {
 		certmagic.DefaultACME.CA = certmagic.LetsEncryptProductionCA
 	} else {
 		certmagic.DefaultACME.CA = certmagic.LetsEncryptStagingCA
 	}
-	certmagic.DefaultACME.Email = Config.API.NotificationEmail
+	certmagic.DefaultACME.Email = config.API.NotificationEmail
 	magicConf := certmagic.NewDefault()
 	magicConf.Storage = &storage
-	magicConf.DefaultServerName = Config.General.Domain
+	magicConf.DefaultServerName = config.General.Domain
 
 	magicCache := certmagic.NewCache(certmagic.CacheOptions{
 		GetConfigForCert: func(cert certmagic.Certificate) (*certmagic.Config, error) {
@@ -158,53 +475,9 @@ func startHTTPAPI(errChan chan error, config DNSConfig, dnsservers []*DNSServer)
 	})
 
 	magic := certmagic.New(magicCache, *magicConf)
-	var err error
-	switch Config.API.TLS {
-	case "letsencryptstaging":
-		err = magic.ManageAsync(context.Background(), []string{Config.General.Domain})
-		if err != nil {
-			errChan <- err
-			return
-		}
-		cfg.GetCertificate = magic.GetCertificate
-
-		srv := &http.Server{
-			Addr:      host,
-			Handler:   c.Handler(api),
-			TLSConfig: cfg,
-			ErrorLog:  stdlog.New(logwriter, "", 0),
-		}
-		log.WithFields(log.Fields{"host": host, "domain": Config.General.Domain}).Info("Listening HTTPS")
-		err = srv.ListenAndServeTLS("", "")
-	case "letsencrypt":
-		err = magic.ManageAsync(context.Background(), []string{Config.General.Domain})
-		if err != nil {
-			errChan <- err
-			return
-		}
-		cfg.GetCertificate = magic.GetCertificate
-		srv := &http.Server{
-			Addr:      host,
-			Handler:   c.Handler(api),
-			TLSConfig: cfg,
-			ErrorLog:  stdlog.New(logwriter, "", 0),
-		}
-		log.WithFields(log.Fields{"host": host, "domain": Config.General.Domain}).Info("Listening HTTPS")
-		err = srv.ListenAndServeTLS("", "")
-	case "cert":
-		srv := &http.Server{
-			Addr:      host,
-			Handler:   c.Handler(api),
-			TLSConfig: cfg,
-			ErrorLog:  stdlog.New(logwriter, "", 0),
-		}
-		log.WithFields(log.Fields{"host": host}).Info("Listening HTTPS")
-		err = srv.ListenAndServeTLS(Config.API.TLSCertFullchain, Config.API.TLSCertPrivkey)
-	default:
-		log.WithFields(log.Fields{"host": host}).Info("Listening HTTP")
-		err = http.ListenAndServe(host, c.Handler(api))
-	}
-	if err != nil {
-		errChan <- err
+	if err := magic.ManageAsync(context.Background(), apiCertNames(config)); err != nil {
+		return nil, err
 	}
+	go runCertCacheCleanup(&storage)
+	return magic.GetCertificate, nil
 }
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// maintainer periodically purges the registrations unused for longer than the
+// account retention, and blanks the TXT values older than the TXT retention, so
+// that neither abandoned credentials nor old challenge tokens linger forever.
+type maintainer struct {
+	db               database
+	interval         time.Duration
+	accountRetention time.Duration
+	txtRetention     time.Duration
+	stop             chan struct{}
+}
+
+func newMaintainer(db database, conf maintenance) *maintainer {
+	return &maintainer{
+		db:               db,
+		interval:         time.Duration(conf.Interval) * time.Second,
+		accountRetention: time.Duration(conf.AccountRetention) * 24 * time.Hour,
+		txtRetention:     time.Duration(conf.TXTRetention) * time.Hour,
+		stop:             make(chan struct{}),
+	}
+}
+
+// Run does the maintenance at the configured interval until stopped
+func (m *maintainer) Run() {
+	log.WithFields(log.Fields{"interval": m.interval.String(), "account_retention": m.accountRetention.String(), "txt_retention": m.txtRetention.String()}).Info("Starting database maintenance")
+	ticker := time.NewTicker(m.interval)
+	defer ticker.Stop()
+	for {
+		// Standby instances leave the maintenance to the primary
+		if Standby.IsPrimary() {
+			m.runOnce()
+		}
+		select {
+		case <-ticker.C:
+		case <-m.stop:
+			return
+		}
+	}
+}
+
+// Stop ends the maintenance loop
+func (m *maintainer) Stop() {
+	close(m.stop)
+}
+
+// runOnce purges the unused registrations and blanks the stale TXT values, and
+// returns their numbers
+func (m *maintainer) runOnce() (int, int) {
+	purged := 0
+	if m.accountRetention > 0 {
+		regs, err := m.db.GetInactiveAccounts(m.accountRetention)
+		if err != nil {
+			log.WithFields(log.Fields{"error": err.Error()}).Error("Could not list unused registrations")
+		}
+		for _, reg := range regs {
+			if err = m.db.DeleteRegistration(reg.Username); err != nil {
+				log.WithFields(log.Fields{"error": err.Error(), "subdomain": reg.Subdomain}).Error("Could not delete unused registration")
+				continue
+			}
+			log.WithFields(log.Fields{"subdomain": reg.Subdomain, "last_active": reg.LastActive}).Info("Deleted unused registration")
+			purged++
+		}
+	}
+	blanked := 0
+	if m.txtRetention > 0 {
+		var err error
+		blanked, err = m.db.ClearStaleTXT(m.txtRetention)
+		if err != nil {
+			log.WithFields(log.Fields{"error": err.Error()}).Error("Could not blank stale TXT values")
+		}
+	}
+	if purged > 0 || blanked > 0 {
+		log.WithFields(log.Fields{"registrations": purged, "txt": blanked}).Info("Database maintenance done")
+		ZoneSerial.Bump("maintenance", "")
+	}
+	return purged, blanked
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func testMaintenance(t *testing.T, db database, clk *frozenClock) {
+	m := newMaintainer(db, maintenance{Interval: 3600, AccountRetention: 30, TXTRetention: 24})
+	unused, _ := db.Register(cidrslice{}, registrationOrigin{}, ACMETxtPost{})
+	used, _ := db.Register(cidrslice{}, registrationOrigin{}, ACMETxtPost{})
+	clk.Advance(29 * 24 * time.Hour)
+	_ = db.MarkActive(used.Username)
+	if _, err := db.Update(ACMETxtPost{Subdomain: used.Subdomain, Value: "ddddddddddddddddddddddddddddddddddddddddddd"}); err != nil {
+		t.Fatalf("Could not update: %v", err)
+	}
+	clk.Advance(23 * time.Hour)
+	if purged, blanked := m.runOnce(); purged != 0 || blanked != 0 {
+		t.Errorf("Expected nothing to be cleaned up yet, got %d registrations and %d TXT values", purged, blanked)
+	}
+	if count, _ := db.CountRecords(used.Subdomain); count != 1 {
+		t.Errorf("Expected the TXT value to be kept, got %d records", count)
+	}
+
+	clk.Advance(2 * 24 * time.Hour)
+	if purged, blanked := m.runOnce(); purged != 1 || blanked != 1 {
+		t.Errorf("Expected 1 registration and 1 TXT value to be cleaned up, got %d and %d", purged, blanked)
+	}
+	if _, err := db.GetByUsername(unused.Username); err == nil {
+		t.Errorf("Expected the unused registration to be deleted")
+	}
+	if _, err := db.GetByUsername(used.Username); err != nil {
+		t.Errorf("Expected the used registration to be kept, got %v", err)
+	}
+	if count, _ := db.CountRecords(used.Subdomain); count != 0 {
+		t.Errorf("Expected the stale TXT value to be blanked, got %d records", count)
+	}
+}
+
+func TestMaintenance(t *testing.T) {
+	clk := newFrozenClock(time.Unix(1700000000, 0))
+	d := &acmedb{Clock: clk}
+	if err := d.Init("sqlite3", tempDatabase(t)); err != nil {
+		t.Fatalf("Could not initialize database: %v", err)
+	}
+	defer d.Close()
+	testMaintenance(t, d, clk)
+}
+
+func TestMaintenanceMemory(t *testing.T) {
+	db, err := openBackend("memory", "")
+	if err != nil {
+		t.Fatalf("Could not open the memory backend: %v", err)
+	}
+	defer db.Close()
+	clk := newFrozenClock(time.Unix(1700000000, 0))
+	db.(*kvdb).Clock = clk
+	testMaintenance(t, db, clk)
+}
+
+func TestMaintenanceDisabledRetention(t *testing.T) {
+	clk := newFrozenClock(time.Unix(1700000000, 0))
+	d := &acmedb{Clock: clk}
+	if err := d.Init("sqlite3", tempDatabase(t)); err != nil {
+		t.Fatalf("Could not initialize database: %v", err)
+	}
+	defer d.Close()
+	reg, _ := d.Register(cidrslice{}, registrationOrigin{}, ACMETxtPost{Value: "eeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeee"})
+	clk.Advance(365 * 24 * time.Hour)
+	if purged, blanked := newMaintainer(d, maintenance{Interval: 60}).runOnce(); purged != 0 || blanked != 0 {
+		t.Errorf("Expected nothing to be cleaned up without retention, got %d and %d", purged, blanked)
+	}
+	if count, _ := d.CountRecords(reg.Subdomain); count != 1 {
+		t.Errorf("Expected the records to be kept, got %d", count)
+	}
+}
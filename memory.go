@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+	"time"
+)
+
+func init() {
+	RegisterBackend("memory", newMemoryBackend)
+}
+
+// newMemoryBackend returns a database backend keeping all the data in process
+// memory, lost when the process exits
+func newMemoryBackend() database {
+	return &kvdb{
+		open: func(string) (kvStore, error) {
+			return newMemoryStore(nil), nil
+		},
+		txtTTL: time.Duration(Config.Database.TXTExpiry) * time.Second,
+	}
+}
+
+// memoryEntry is a value of the memory store with its expiry time
+type memoryEntry struct {
+	value   []byte
+	expires time.Time
+}
+
+// memoryStore is a kvStore in a map. Expired keys are skipped, and removed when keys are listed.
+type memoryStore struct {
+	mutex   sync.RWMutex
+	clock   clock
+	entries map[string]memoryEntry
+}
+
+func newMemoryStore(c clock) *memoryStore {
+	return &memoryStore{
+		clock:   clockOrSystem(c),
+		entries: make(map[string]memoryEntry),
+	}
+}
+
+// live checks if the entry has not expired
+func (s *memoryStore) live(e memoryEntry) bool {
+	return e.expires.IsZero() || s.clock.Now().Before(e.expires)
+}
+
+func (s *memoryStore) entry(value []byte, ttl time.Duration) memoryEntry {
+	e := memoryEntry{value: append([]byte(nil), value...)}
+	if ttl > 0 {
+		e.expires = s.clock.Now().Add(ttl)
+	}
+	return e
+}
+
+func (s *memoryStore) Get(key string) ([]byte, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	e, ok := s.entries[key]
+	if !ok || !s.live(e) {
+		return nil, errKeyNotFound
+	}
+	return append([]byte(nil), e.value...), nil
+}
+
+func (s *memoryStore) Set(key string, value []byte, ttl time.Duration) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.entries[key] = s.entry(value, ttl)
+	return nil
+}
+
+func (s *memoryStore) SetNX(key string, value []byte, ttl time.Duration) (bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if e, ok := s.entries[key]; ok && s.live(e) {
+		return false, nil
+	}
+	s.entries[key] = s.entry(value, ttl)
+	return true, nil
+}
+
+func (s *memoryStore) SetIf(key string, expected []byte, value []byte, ttl time.Duration) (bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if e, ok := s.entries[key]; !ok || !s.live(e) || !bytes.Equal(e.value, expected) {
+		return false, nil
+	}
+	s.entries[key] = s.entry(value, ttl)
+	return true, nil
+}
+
+func (s *memoryStore) Delete(key string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.entries, key)
+	return nil
+}
+
+func (s *memoryStore) DeleteIf(key string, expected []byte) (bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if e, ok := s.entries[key]; !ok || !s.live(e) || !bytes.Equal(e.value, expected) {
+		return false, nil
+	}
+	delete(s.entries, key)
+	return true, nil
+}
+
+func (s *memoryStore) Keys(prefix string) ([]string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var keys []string
+	for key, e := range s.entries {
+		if !s.live(e) {
+			delete(s.entries, key)
+			continue
+		}
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
+
+func (s *memoryStore) Close() error {
+	return nil
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// failingUserStore is a memory store failing to store the registrations
+type failingUserStore struct {
+	*memoryStore
+}
+
+func (s failingUserStore) Set(key string, value []byte, ttl time.Duration) error {
+	if strings.HasPrefix(key, kvUserKey("")) {
+		return errors.New("store failure")
+	}
+	return s.memoryStore.Set(key, value, ttl)
+}
+
+func TestMemoryStoreExpiry(t *testing.T) {
+	clk := newFrozenClock(time.Unix(1700000000, 0))
+	s := newMemoryStore(clk)
+	_ = s.Set("a", []byte("1"), time.Minute)
+	_ = s.Set("b", []byte("2"), 0)
+	if ok, _ := s.SetNX("a", []byte("3"), 0); ok {
+		t.Errorf("Expected SetNX to keep the existing value")
+	}
+	clk.Advance(time.Minute)
+	if _, err := s.Get("a"); err != errKeyNotFound {
+		t.Errorf("Expected the value to expire, got %v", err)
+	}
+	if v, err := s.Get("b"); err != nil || string(v) != "2" {
+		t.Errorf("Expected the value without TTL to remain, got %q, %v", v, err)
+	}
+	if ok, _ := s.SetNX("a", []byte("3"), 0); !ok {
+		t.Errorf("Expected SetNX to replace the expired value")
+	}
+	if keys, _ := s.Keys(""); len(keys) != 2 {
+		t.Errorf("Expected 2 keys, got %v", keys)
+	}
+}
+
+func TestMemoryBackendLeaseTakeover(t *testing.T) {
+	clk := newFrozenClock(time.Unix(1700000000, 0))
+	db := &kvdb{open: func(string) (kvStore, error) { return newMemoryStore(clk), nil }}
+	if err := db.Init("memory", ""); err != nil {
+		t.Fatalf("Could not open the backend: %v", err)
+	}
+	defer db.Close()
+	if ok, err := db.AcquireLease("primary", "a", time.Minute); !ok || err != nil {
+		t.Fatalf("Expected to acquire the lease, got %v, %v", ok, err)
+	}
+	clk.Advance(time.Minute)
+	if ok, _ := db.AcquireLease("primary", "b", time.Minute); !ok {
+		t.Fatalf("Expected to acquire the expired lease")
+	}
+	// The previous holder can neither renew nor release the lease it lost
+	if ok, _ := db.AcquireLease("primary", "a", time.Minute); ok {
+		t.Errorf("Expected the lease to be held by another instance")
+	}
+	if err := db.ReleaseLease("primary", "a"); err != nil {
+		t.Errorf("Could not release the lease: %v", err)
+	}
+	if ok, _ := db.AcquireLease("primary", "b", time.Minute); !ok {
+		t.Errorf("Expected the new holder to renew the lease")
+	}
+	if v, err := db.store.Get(kvLeaseKey("primary")); err != nil || string(v) != "b" {
+		t.Errorf("Expected the lease to be held by b, got %q, %v", v, err)
+	}
+}
+
+func TestMemoryBackend(t *testing.T) {
+	oldDB := DB
+	defer func() { DB = oldDB }()
+	db, err := openBackend("memory", "")
+	if err != nil {
+		t.Fatalf("Could not open the memory backend: %v", err)
+	}
+	defer db.Close()
+	DB = db
+
+	api := httprouter.New()
+	api.POST("/register", webRegisterPost)
+	api.POST("/update", AuthForUpdate(webUpdatePost))
+	server := httptest.NewServer(api)
+	defer server.Close()
+	e := getExpect(t, server)
+
+	reg := e.POST("/register").
+		WithJSON(map[string]interface{}{"a": []string{"192.0.2.1"}}).
+		Expect().
+		Status(http.StatusCreated).
+		JSON().Object()
+	subdomain := reg.Value("subdomain").String().Raw()
+	validTXT := "LHDhK3oGRvkiefQnx7OOczTY5Tic_xZ6HcMOc_gmtoM"
+	e.POST("/update").
+		WithJSON(map[string]string{"subdomain": subdomain, "txt": validTXT}).
+		WithHeader("X-Api-User", reg.Value("username").String().Raw()).
+		WithHeader("X-Api-Key", reg.Value("password").String().Raw()).
+		Expect().
+		Status(http.StatusOK)
+
+	txts, err := DB.GetTXTForDomain(subdomain)
+	if err != nil || len(txts) != txtSlotCount() || txts[0] != validTXT {
+		t.Errorf("Expected the updated TXT value, got %v, %v", txts, err)
+	}
+	if count, err := DB.CountRecords(subdomain); err != nil || count != 2 {
+		t.Errorf("Expected 2 records, got %d, %v", count, err)
+	}
+}
+
+func TestMemoryBackendSubdomainsForAddress(t *testing.T) {
+	db, err := openBackend("memory", "")
+	if err != nil {
+		t.Fatalf("Could not open the memory backend: %v", err)
+	}
+	defer db.Close()
+	first, _ := db.Register(cidrslice{}, registrationOrigin{}, ACMETxtPost{AValues: []string{"192.0.2.1"}})
+	_, _ = db.Register(cidrslice{}, registrationOrigin{}, ACMETxtPost{AValues: []string{"192.0.2.2"}, AAAAValues: []string{"2001:db8::1"}})
+	subdomains, err := db.GetSubdomainsForAddress(net.ParseIP("192.0.2.1"))
+	if err != nil || len(subdomains) != 1 || subdomains[0] != first.Subdomain {
+		t.Errorf("Expected [%s], got %v, %v", first.Subdomain, subdomains, err)
+	}
+	if subdomains, _ = db.GetSubdomainsForAddress(net.ParseIP("2001:db8::2")); len(subdomains) != 0 {
+		t.Errorf("Expected no subdomains, got %v", subdomains)
+	}
+}
+
+func TestMemoryBackendFailedRegistration(t *testing.T) {
+	store := failingUserStore{newMemoryStore(nil)}
+	db := &kvdb{open: func(string) (kvStore, error) { return store, nil }}
+	if err := db.Init("memory", ""); err != nil {
+		t.Fatalf("Could not open the backend: %v", err)
+	}
+	defer db.Close()
+	reg, err := db.Register(cidrslice{}, registrationOrigin{}, ACMETxtPost{AValues: []string{"192.0.2.1"}})
+	if err == nil {
+		t.Fatalf("Expected the registration to fail")
+	}
+	if keys, _ := store.Keys(kvKeyPrefix); len(keys) != 0 {
+		t.Errorf("Expected nothing of the failed registration to be left, got %v", keys)
+	}
+	if _, err = db.GetByUsername(reg.Username); err == nil {
+		t.Errorf("Expected the failed registration not to authenticate")
+	}
+}
+
+// gatedUserStore is a memory store pausing after the next read of a registration
+// once armed, until the gate is opened
+type gatedUserStore struct {
+	*memoryStore
+	armed   atomic.Bool
+	reading chan struct{}
+	gate    chan struct{}
+}
+
+func (s *gatedUserStore) arm() {
+	s.reading = make(chan struct{})
+	s.gate = make(chan struct{})
+	s.armed.Store(true)
+}
+
+func (s *gatedUserStore) Get(key string) ([]byte, error) {
+	value, err := s.memoryStore.Get(key)
+	if strings.HasPrefix(key, kvUserKey("")) && s.armed.CompareAndSwap(true, false) {
+		close(s.reading)
+		<-s.gate
+	}
+	return value, err
+}
+
+func TestMemoryBackendConcurrentModifications(t *testing.T) {
+	store := &gatedUserStore{memoryStore: newMemoryStore(nil)}
+	db := &kvdb{open: func(string) (kvStore, error) { return store, nil }}
+	if err := db.Init("memory", ""); err != nil {
+		t.Fatalf("Could not open the backend: %v", err)
+	}
+	defer db.Close()
+	reg, err := db.Register(cidrslice{}, registrationOrigin{}, ACMETxtPost{})
+	if err != nil {
+		t.Fatalf("Could not register: %v", err)
+	}
+	// markActive starts marking the registration active, pausing at its first read,
+	// and returns a function letting it finish
+	markActive := func() func() error {
+		store.arm()
+		done := make(chan error)
+		go func() { done <- db.MarkActive(reg.Username) }()
+		<-store.reading
+		return func() error {
+			close(store.gate)
+			return <-done
+		}
+	}
+
+	// The activity of an update doesn't revert a credential reset made meanwhile
+	password := generatePassword(40)
+	finish := markActive()
+	if err = db.SetPassword(reg.Username, password); err != nil {
+		t.Fatalf("Could not set the password: %v", err)
+	}
+	if err = finish(); err != nil {
+		t.Fatalf("Could not mark the registration active: %v", err)
+	}
+	user, err := db.GetByUsername(reg.Username)
+	if err != nil {
+		t.Fatalf("Could not get the registration: %v", err)
+	}
+	if !correctPassword(password, user.Password) {
+		t.Errorf("Expected the new password to be kept")
+	}
+	if user.LastActive == 0 {
+		t.Errorf("Expected the activity to be recorded")
+	}
+
+	// Deleted registrations aren't recreated by their activity
+	finish = markActive()
+	if err = db.DeleteRegistration(reg.Username); err != nil {
+		t.Fatalf("Could not delete the registration: %v", err)
+	}
+	if err = finish(); err == nil {
+		t.Errorf("Expected marking a deleted registration active to fail")
+	}
+	if _, err = db.GetByUsername(reg.Username); err == nil {
+		t.Errorf("Expected the deleted registration to stay deleted")
+	}
+}
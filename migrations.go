@@ -0,0 +1,371 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// errSchemaBehind is returned by checkSchema for a database with pending migrations
+var errSchemaBehind = errors.New("run acme-dns migrate first")
+
+// migration is a single schema change of the SQL backends. The change runs in a
+// transaction of its own, together with recording the new schema version.
+type migration struct {
+	version     int
+	description string
+	up          func(d *acmedb, tx *sql.Tx) error
+}
+
+// migrations are the schema changes in the order they are applied. Existing
+// migrations must not be changed, new ones are appended with the next version.
+var migrations = []migration{
+	{1, "Move TXT values to the txt table", migrateTXTTable},
+	{2, "Number the TXT slots", migrateTXTSlots},
+	{3, "Add registration settings", addColumns(
+		"ALTER TABLE records ADD COLUMN Description TEXT NOT NULL DEFAULT ''",
+		"ALTER TABLE records ADD COLUMN Webhooks TEXT NOT NULL DEFAULT '[]'",
+		"ALTER TABLE records ADD COLUMN AllowedTypes TEXT NOT NULL DEFAULT '[]'",
+	)},
+	{4, "Add registration source attribution", addColumns(
+		"ALTER TABLE records ADD COLUMN CreatedBy TEXT NOT NULL DEFAULT ''",
+		"ALTER TABLE records ADD COLUMN CreatedFrom TEXT NOT NULL DEFAULT ''",
+		"ALTER TABLE records ADD COLUMN CreatedAt INT NOT NULL DEFAULT 0",
+	)},
+	{5, "Add registration tags and the disabled flag", addColumns(
+		"ALTER TABLE records ADD COLUMN Tags TEXT NOT NULL DEFAULT '[]'",
+		"ALTER TABLE records ADD COLUMN Disabled INT NOT NULL DEFAULT 0",
+	)},
+	{6, "Add the canary flag", addColumns(
+		"ALTER TABLE records ADD COLUMN Canary INT NOT NULL DEFAULT 0",
+	)},
+	{7, "Add credential versions", addColumns(
+		"ALTER TABLE records ADD COLUMN PassVersion INT NOT NULL DEFAULT 0",
+		"ALTER TABLE admins ADD COLUMN PassVersion INT NOT NULL DEFAULT 0",
+	)},
+	{8, "Add the last active time", addLastActive},
+	{9, "Add the cname table", addColumns(cnameTable)},
+	{10, "Add the mx table", addColumns(mxTable)},
+	{11, "Add the srv table", addColumns(srvTable)},
+	{12, "Add the caa table", addColumns(caaTable)},
+	{13, "Add the generic rr table", addColumns(rrTable)},
+	{14, "Add correlation IDs of TXT values", addColumns(
+		"ALTER TABLE txt ADD COLUMN CorrelationID TEXT NOT NULL DEFAULT ''",
+	)},
+	{15, "Add the ttl table", addColumns(ttlTable)},
+	{16, "Add the audit table", addAuditTable},
+	{17, "Add the zones of registrations", addColumns(
+		"ALTER TABLE records ADD COLUMN Zone TEXT NOT NULL DEFAULT ''",
+	)},
+	{18, "Add the wildcard flag of registrations", addColumns(
+		"ALTER TABLE records ADD COLUMN Wildcard INT NOT NULL DEFAULT 0",
+	)},
+	{19, "Add the subnet answers of registrations", addColumns(
+		"ALTER TABLE records ADD COLUMN SubnetAnswers TEXT NOT NULL DEFAULT '[]'",
+	)},
+}
+
+// addColumns returns a migration running the ALTER TABLE or CREATE TABLE statements
+func addColumns(statements ...string) func(d *acmedb, tx *sql.Tx) error {
+	return func(d *acmedb, tx *sql.Tx) error {
+		for _, stmt := range statements {
+			if _, err := tx.Exec(stmt); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// migrateTXTTable creates the rows of the txt table for the subdomains of databases
+// that kept the TXT value in the records table
+func migrateTXTTable(d *acmedb, tx *sql.Tx) error {
+	var subdomains []string
+	rows, err := tx.Query("SELECT Subdomain FROM records")
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var subdomain string
+		if err = rows.Scan(&subdomain); err != nil {
+			rows.Close()
+			return err
+		}
+		subdomains = append(subdomains, subdomain)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	if _, err = tx.Exec("DELETE FROM txt"); err != nil {
+		return err
+	}
+	insSQL := d.stmt("INSERT INTO txt (Subdomain, LastUpdate) values($1, 0)")
+	for _, subdomain := range subdomains {
+		if subdomain == "" {
+			continue
+		}
+		// Insert two rows for each subdomain to txt table
+		for i := 0; i < 2; i++ {
+			if _, err = tx.Exec(insSQL, subdomain); err != nil {
+				return err
+			}
+		}
+	}
+	// SQLite doesn't support dropping columns
+	if d.engine != "sqlite3" {
+		for _, stmt := range []string{
+			"ALTER TABLE records DROP COLUMN IF EXISTS Value",
+			"ALTER TABLE records DROP COLUMN IF EXISTS LastActive",
+		} {
+			if _, err = tx.Exec(stmt); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// addAuditTable creates the audit table, numbering the rows on PostgreSQL like
+// SQLite does, to keep the order of events recorded within the same second
+func addAuditTable(d *acmedb, tx *sql.Tx) error {
+	table := auditTable
+	if d.engine != "sqlite3" {
+		table = auditTablePG
+	}
+	_, err := tx.Exec(table)
+	return err
+}
+
+// addLastActive adds the LastActive column to the records table. SQLite databases
+// created before the first migration still have the column of the original schema,
+// which keeps the times of activity until then.
+func addLastActive(d *acmedb, tx *sql.Tx) error {
+	if d.engine == "sqlite3" {
+		var exists int
+		err := tx.QueryRow("SELECT COUNT(*) FROM pragma_table_info('records') WHERE name='LastActive'").Scan(&exists)
+		if err != nil || exists > 0 {
+			return err
+		}
+	}
+	_, err := tx.Exec("ALTER TABLE records ADD COLUMN LastActive INT NOT NULL DEFAULT 0")
+	return err
+}
+
+// migrateTXTSlots adds an explicit slot number to the txt rows. Existing rows are
+// numbered per subdomain in their insertion order.
+func migrateTXTSlots(d *acmedb, tx *sql.Tx) error {
+	_, err := tx.Exec("ALTER TABLE txt ADD COLUMN Slot INT NOT NULL DEFAULT 0")
+	if err != nil {
+		return err
+	}
+	type txtRow struct {
+		rowid     int64
+		subdomain string
+	}
+	var txtRows []txtRow
+	rows, err := tx.Query("SELECT rowid, Subdomain FROM txt ORDER BY Subdomain, rowid")
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var r txtRow
+		if err = rows.Scan(&r.rowid, &r.subdomain); err != nil {
+			rows.Close()
+			return err
+		}
+		txtRows = append(txtRows, r)
+	}
+	rows.Close()
+	updSQL := d.stmt("UPDATE txt SET Slot=$1 WHERE rowid=$2")
+	slot := 0
+	for i, r := range txtRows {
+		if i > 0 && txtRows[i-1].subdomain != r.subdomain {
+			slot = 0
+		}
+		if _, err = tx.Exec(updSQL, slot, r.rowid); err != nil {
+			return err
+		}
+		slot++
+	}
+	return nil
+}
+
+// schemaVersion returns the version of the database schema, and whether it has
+// been recorded. Databases older than the version tracking are at version 0.
+func (d *acmedb) schemaVersion() (int, bool, error) {
+	var versionString string
+	err := d.DB.QueryRow("SELECT Value FROM acmedns WHERE Name='db_version'").Scan(&versionString)
+	if err != nil {
+		// The acmedns table doesn't exist before the first migration
+		return 0, false, nil
+	}
+	version, err := strconv.Atoi(versionString)
+	if err != nil {
+		return 0, true, fmt.Errorf("invalid database version %q", versionString)
+	}
+	return version, true, nil
+}
+
+// createTables creates the tables missing from the database in their original form,
+// to be brought up to date by the migrations
+func (d *acmedb) createTables() error {
+	txt := txtTable
+	if d.engine != "sqlite3" {
+		txt = txtTablePG
+	}
+	for _, table := range []string{acmeTable, adminTable, userTable, txt, aTable, aaaaTable, leaseTable} {
+		if _, err := d.DB.Exec(table); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrate applies the pending migrations and returns them. With dryRun set, the
+// pending migrations are returned without changing the database.
+func (d *acmedb) migrate(dryRun bool) ([]migration, error) {
+	version, recorded, err := d.schemaVersion()
+	if err != nil {
+		return nil, err
+	}
+	if version > DBVersion {
+		return nil, fmt.Errorf("database version %d is newer than the version %d supported by this acme-dns", version, DBVersion)
+	}
+	pending := migrations[version:]
+	if dryRun {
+		return pending, nil
+	}
+	if err = d.createTables(); err != nil {
+		return nil, err
+	}
+	if !recorded {
+		if _, err = d.DB.Exec(d.stmt("INSERT INTO acmedns (Name, Value) values('db_version', $1)"), "0"); err != nil {
+			return nil, err
+		}
+	}
+	for i, m := range pending {
+		if err = d.applyMigration(m); err != nil {
+			dbLog.WithFields(log.Fields{"error": err.Error(), "version": m.version}).Error("Error in DB upgrade")
+			return pending[:i], fmt.Errorf("database migration %d (%s) failed: %w", m.version, m.description, err)
+		}
+		dbLog.WithFields(log.Fields{"version": m.version, "description": m.description}).Info("Applied database migration")
+	}
+	return pending, nil
+}
+
+func (d *acmedb) applyMigration(m migration) (err error) {
+	tx, err := d.DB.Begin()
+	if err != nil {
+		return err
+	}
+	// Rollback if errored, commit if not
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+			return
+		}
+		err = tx.Commit()
+	}()
+	if err = m.up(d, tx); err != nil {
+		return err
+	}
+	if _, err = tx.Exec(d.stmt("UPDATE acmedns SET Value=$1 WHERE Name='db_version'"), strconv.Itoa(m.version)); err != nil {
+		return err
+	}
+	if _, err = tx.Exec("DELETE FROM acmedns WHERE Name='db_migrated_at'"); err != nil {
+		return err
+	}
+	_, err = tx.Exec(d.stmt("INSERT INTO acmedns (Name, Value) values('db_migrated_at', $1)"), strconv.FormatInt(d.Now().Unix(), 10))
+	return err
+}
+
+// lastMigration returns the time the latest migration was applied, 0 if unknown
+// as the migrations before the time was recorded don't have it
+func (d *acmedb) lastMigration() (int64, error) {
+	var value string
+	err := d.DB.QueryRow("SELECT Value FROM acmedns WHERE Name='db_migrated_at'").Scan(&value)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(value, 10, 64)
+}
+
+// checkSchema makes sure the database schema is at the version of this acme-dns,
+// for instances leaving the migrations to the migrate and init-db commands
+func (d *acmedb) checkSchema() error {
+	version, recorded, err := d.schemaVersion()
+	if err != nil {
+		return err
+	}
+	if !recorded {
+		return fmt.Errorf("the database has not been initialized, run acme-dns init-db first")
+	}
+	if version < DBVersion {
+		return fmt.Errorf("database version %d is older than the version %d required by this acme-dns, %w", version, DBVersion, errSchemaBehind)
+	}
+	if version > DBVersion {
+		return fmt.Errorf("database version %d is newer than the version %d supported by this acme-dns", version, DBVersion)
+	}
+	return nil
+}
+
+// runInitDB runs the init-db command, creating the schema of an empty database.
+// A database that has already been initialized is left as it is, so that the
+// command can be run on every start of a deployment.
+func runInitDB(engine string, connection string, out io.Writer) error {
+	if engine != "sqlite3" && engine != "postgres" {
+		fmt.Fprintf(out, "The %s engine has no schema to initialize\n", engine)
+		return nil
+	}
+	d := &acmedb{skipMigrations: true}
+	if err := d.Init(engine, connection); err != nil {
+		return err
+	}
+	defer d.Close()
+	version, recorded, err := d.schemaVersion()
+	if err != nil {
+		return err
+	}
+	if recorded {
+		fmt.Fprintf(out, "The database is already initialized at version %d\n", version)
+		return nil
+	}
+	if _, err = d.migrate(false); err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "Initialized the database at version %d\n", DBVersion)
+	return nil
+}
+
+// runMigrations runs the migrate command, bringing the schema of the configured
+// database up to date or listing the pending migrations with dryRun
+func runMigrations(engine string, connection string, dryRun bool, out io.Writer) error {
+	if engine != "sqlite3" && engine != "postgres" {
+		fmt.Fprintf(out, "The %s engine has no schema to migrate\n", engine)
+		return nil
+	}
+	d := &acmedb{skipMigrations: true}
+	if err := d.Init(engine, connection); err != nil {
+		return err
+	}
+	defer d.Close()
+	applied, err := d.migrate(dryRun)
+	verb := "Applied"
+	if dryRun {
+		verb = "Pending"
+	}
+	for _, m := range applied {
+		fmt.Fprintf(out, "%s migration %d: %s\n", verb, m.version, m.description)
+	}
+	if err == nil && len(applied) == 0 {
+		fmt.Fprintf(out, "The database is up to date at version %d\n", DBVersion)
+	}
+	return err
+}
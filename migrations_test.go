@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestMigrationsOrdered(t *testing.T) {
+	for i, m := range migrations {
+		if m.version != i+1 {
+			t.Errorf("Expected migration %d to have version %d, got %d", i, i+1, m.version)
+		}
+		if m.description == "" || m.up == nil {
+			t.Errorf("Migration %d is incomplete", m.version)
+		}
+	}
+	if DBVersion != len(migrations) {
+		t.Errorf("Expected DBVersion %d, got %d", len(migrations), DBVersion)
+	}
+}
+
+func tempDatabase(t *testing.T) string {
+	tmpfile, err := os.CreateTemp("", "acmedns-migrate")
+	if err != nil {
+		t.Fatalf("Could not create temporary file")
+	}
+	tmpfile.Close()
+	t.Cleanup(func() { os.Remove(tmpfile.Name()) })
+	return tmpfile.Name()
+}
+
+func TestMigrateDryRun(t *testing.T) {
+	file := tempDatabase(t)
+	olddb, err := sql.Open("sqlite3", file)
+	if err != nil {
+		t.Fatalf("Could not open database: %v", err)
+	}
+	for _, stmt := range []string{
+		acmeTable, adminTable, userTable, txtTable,
+		"INSERT INTO acmedns (Name, Value) values('db_version', '1')",
+		"INSERT INTO records (Username, Password, Subdomain, AllowFrom) values('u1', 'p', 'sub1', '[]')",
+	} {
+		if _, err = olddb.Exec(stmt); err != nil {
+			t.Fatalf("Could not set up version 1 database: %v", err)
+		}
+	}
+	olddb.Close()
+
+	var out bytes.Buffer
+	if err = runMigrations("sqlite3", file, true, &out); err != nil {
+		t.Fatalf("Dry run failed: %v", err)
+	}
+	if !strings.Contains(out.String(), "Pending migration 2:") || strings.Contains(out.String(), "migration 1:") {
+		t.Errorf("Unexpected dry run output %q", out.String())
+	}
+	d := &acmedb{skipMigrations: true}
+	if err = d.Init("sqlite3", file); err != nil {
+		t.Fatalf("Could not open database: %v", err)
+	}
+	version, _, _ := d.schemaVersion()
+	d.Close()
+	if version != 1 {
+		t.Errorf("Expected the dry run to leave the database at version 1, got %d", version)
+	}
+
+	out.Reset()
+	if err = runMigrations("sqlite3", file, false, &out); err != nil {
+		t.Fatalf("Migration failed: %v", err)
+	}
+	if strings.Count(out.String(), "Applied migration") != DBVersion-1 {
+		t.Errorf("Unexpected migration output %q", out.String())
+	}
+	out.Reset()
+	if err = runMigrations("sqlite3", file, true, &out); err != nil {
+		t.Fatalf("Dry run failed: %v", err)
+	}
+	if !strings.Contains(out.String(), "up to date") {
+		t.Errorf("Expected the database to be up to date, got %q", out.String())
+	}
+}
+
+func TestMigrateFreshDatabase(t *testing.T) {
+	d := new(acmedb)
+	if err := d.Init("sqlite3", tempDatabase(t)); err != nil {
+		t.Fatalf("Could not initialize database: %v", err)
+	}
+	defer d.Close()
+	version, recorded, err := d.schemaVersion()
+	if err != nil || !recorded || version != DBVersion {
+		t.Errorf("Expected database version %d, got %d (recorded %t, error %v)", DBVersion, version, recorded, err)
+	}
+	if _, err = d.Register(cidrslice{}, registrationOrigin{}, ACMETxtPost{}); err != nil {
+		t.Errorf("Could not register on a migrated database: %v", err)
+	}
+}
+
+func TestMigrateNewerDatabase(t *testing.T) {
+	file := tempDatabase(t)
+	d := new(acmedb)
+	if err := d.Init("sqlite3", file); err != nil {
+		t.Fatalf("Could not initialize database: %v", err)
+	}
+	_, _ = d.DB.Exec("UPDATE acmedns SET Value=? WHERE Name='db_version'", DBVersion+1)
+	d.Close()
+	if err := new(acmedb).Init("sqlite3", file); err == nil {
+		t.Errorf("Expected an error for a database newer than this version")
+	}
+}
+
+func TestAddLastActiveKeepsOriginalColumn(t *testing.T) {
+	file := tempDatabase(t)
+	olddb, err := sql.Open("sqlite3", file)
+	if err != nil {
+		t.Fatalf("Could not open database: %v", err)
+	}
+	// The records table of databases created before the first migration
+	for _, stmt := range []string{
+		"CREATE TABLE records(Username TEXT UNIQUE NOT NULL PRIMARY KEY, Password TEXT NOT NULL, Subdomain TEXT UNIQUE NOT NULL, Value TEXT, LastActive INT, AllowFrom TEXT)",
+		"INSERT INTO records (Username, Password, Subdomain, Value, LastActive, AllowFrom) values('u1', 'p', 'sub1', '', 1500000000, '[]')",
+	} {
+		if _, err = olddb.Exec(stmt); err != nil {
+			t.Fatalf("Could not set up version 0 database: %v", err)
+		}
+	}
+	olddb.Close()
+
+	d := new(acmedb)
+	if err = d.Init("sqlite3", file); err != nil {
+		t.Fatalf("Could not migrate database: %v", err)
+	}
+	defer d.Close()
+	var lastActive int64
+	if err = d.DB.QueryRow("SELECT LastActive FROM records WHERE Username='u1'").Scan(&lastActive); err != nil || lastActive != 1500000000 {
+		t.Errorf("Expected the original last active time to be kept, got %d, %v", lastActive, err)
+	}
+}
+
+func TestInitDB(t *testing.T) {
+	file := tempDatabase(t)
+	var out bytes.Buffer
+	if err := runInitDB("sqlite3", file, &out); err != nil {
+		t.Fatalf("Could not initialize database: %v", err)
+	}
+	if !strings.Contains(out.String(), "Initialized the database") {
+		t.Errorf("Unexpected init-db output %q", out.String())
+	}
+	d := &acmedb{skipMigrations: true}
+	if err := d.Init("sqlite3", file); err != nil {
+		t.Fatalf("Could not open database: %v", err)
+	}
+	version, _, _ := d.schemaVersion()
+	// An initialized database isn't touched by init-db, even if it's behind
+	_, _ = d.DB.Exec("UPDATE acmedns SET Value='1' WHERE Name='db_version'")
+	d.Close()
+	if version != DBVersion {
+		t.Errorf("Expected database version %d, got %d", DBVersion, version)
+	}
+	out.Reset()
+	if err := runInitDB("sqlite3", file, &out); err != nil {
+		t.Fatalf("Could not run init-db again: %v", err)
+	}
+	if !strings.Contains(out.String(), "already initialized at version 1") {
+		t.Errorf("Unexpected init-db output %q", out.String())
+	}
+	out.Reset()
+	if err := runInitDB("memory", "", &out); err != nil || !strings.Contains(out.String(), "no schema") {
+		t.Errorf("Unexpected init-db output %q for the memory engine, error %v", out.String(), err)
+	}
+}
+
+func TestSkipMigrations(t *testing.T) {
+	Config.Database.SkipMigrations = true
+	defer func() { Config.Database.SkipMigrations = false }()
+	file := tempDatabase(t)
+	if err := new(acmedb).Init("sqlite3", file); err == nil || !strings.Contains(err.Error(), "init-db") {
+		t.Errorf("Expected an error for an uninitialized database, got %v", err)
+	}
+	if err := runInitDB("sqlite3", file, &bytes.Buffer{}); err != nil {
+		t.Fatalf("Could not initialize database: %v", err)
+	}
+	d := new(acmedb)
+	if err := d.Init("sqlite3", file); err != nil {
+		t.Fatalf("Expected an initialized database to be accepted, got %v", err)
+	}
+	_, _ = d.DB.Exec("UPDATE acmedns SET Value='1' WHERE Name='db_version'")
+	d.Close()
+	d = new(acmedb)
+	err := d.Init("sqlite3", file)
+	if err == nil || !strings.Contains(err.Error(), "acme-dns migrate") {
+		t.Errorf("Expected an error for an outdated database, got %v", err)
+	}
+	d.Close()
+}
+
+func TestMigrateOnDemand(t *testing.T) {
+	Config.Database.MigrateOnDemand = true
+	defer func() { Config.Database.MigrateOnDemand = false }()
+	file := tempDatabase(t)
+	olddb, err := sql.Open("sqlite3", file)
+	if err != nil {
+		t.Fatalf("Could not open database: %v", err)
+	}
+	for _, stmt := range []string{acmeTable, adminTable, userTable, txtTable, "INSERT INTO acmedns (Name, Value) values('db_version', '1')"} {
+		if _, err = olddb.Exec(stmt); err != nil {
+			t.Fatalf("Could not set up version 1 database: %v", err)
+		}
+	}
+	olddb.Close()
+	d := new(acmedb)
+	if err = d.Init("sqlite3", file); err != nil {
+		t.Fatalf("Expected the outdated database to be accepted, got %v", err)
+	}
+	defer d.Close()
+	oldDB := DB
+	DB = d
+	defer func() { DB = oldDB }()
+
+	rec := httptest.NewRecorder()
+	webAdminDB(rec, httptest.NewRequest(http.MethodGet, "/admin/db", nil), nil)
+	var status schemaStatus
+	_ = json.Unmarshal(rec.Body.Bytes(), &status)
+	if rec.Code != http.StatusOK || status.SchemaVersion != 1 || len(status.Pending) != DBVersion-1 || status.LastMigration != 0 || !status.MigrateOnDemand {
+		t.Errorf("Unexpected status %d %+v", rec.Code, status)
+	}
+
+	rec = httptest.NewRecorder()
+	webAdminDBMigrate(rec, httptest.NewRequest(http.MethodPost, "/admin/db", nil), nil)
+	status = schemaStatus{}
+	_ = json.Unmarshal(rec.Body.Bytes(), &status)
+	if rec.Code != http.StatusOK || status.SchemaVersion != DBVersion || len(status.Pending) != 0 || len(status.Applied) != DBVersion-1 || status.LastMigration == 0 {
+		t.Errorf("Unexpected status after the migration %d %+v", rec.Code, status)
+	}
+	if _, err = d.Register(cidrslice{}, registrationOrigin{}, ACMETxtPost{}); err != nil {
+		t.Errorf("Could not register on the migrated database: %v", err)
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// negativeCacheMaxEntries bounds the memory used by the negative cache when
+// somebody is scanning the zone with random labels.
+const negativeCacheMaxEntries = 10000
+
+// negativeCache remembers subdomains that were recently found not to exist,
+// so that repeated DNS queries for random labels don't all reach the database.
+type negativeCache struct {
+	mutex   sync.Mutex
+	ttl     time.Duration
+	clock   clock
+	entries map[string]time.Time
+}
+
+func newNegativeCache(ttl time.Duration, c clock) *negativeCache {
+	return &negativeCache{
+		ttl:     ttl,
+		clock:   clockOrSystem(c),
+		entries: make(map[string]time.Time),
+	}
+}
+
+func (c *negativeCache) enabled() bool {
+	return c != nil && c.ttl > 0
+}
+
+// has checks if the subdomain is known not to exist
+func (c *negativeCache) has(subdomain string) bool {
+	if !c.enabled() {
+		return false
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	expires, ok := c.entries[subdomain]
+	if !ok {
+		return false
+	}
+	if c.clock.Now().After(expires) {
+		delete(c.entries, subdomain)
+		return false
+	}
+	return true
+}
+
+// add marks the subdomain as nonexistent for the duration of the cache TTL
+func (c *negativeCache) add(subdomain string) {
+	if !c.enabled() {
+		return
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	now := c.clock.Now()
+	if len(c.entries) >= negativeCacheMaxEntries {
+		for k, v := range c.entries {
+			if now.After(v) {
+				delete(c.entries, k)
+			}
+		}
+		if len(c.entries) >= negativeCacheMaxEntries {
+			c.entries = make(map[string]time.Time)
+		}
+	}
+	c.entries[subdomain] = now.Add(c.ttl)
+}
+
+// remove invalidates the cached negative result for the subdomain
+func (c *negativeCache) remove(subdomain string) {
+	if !c.enabled() {
+		return
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	delete(c.entries, subdomain)
+}
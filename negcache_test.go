@@ -0,0 +1,55 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNegativeCache(t *testing.T) {
+	c := newNegativeCache(time.Minute, nil)
+	if c.has("nonexistent") {
+		t.Errorf("Empty cache should not contain entries")
+	}
+	c.add("nonexistent")
+	if !c.has("nonexistent") {
+		t.Errorf("Expected cache to contain the added entry")
+	}
+	c.remove("nonexistent")
+	if c.has("nonexistent") {
+		t.Errorf("Expected entry to be removed from cache")
+	}
+}
+
+func TestNegativeCacheExpiry(t *testing.T) {
+	c := newNegativeCache(time.Minute, nil)
+	c.entries["expired"] = time.Now().Add(-time.Second)
+	if c.has("expired") {
+		t.Errorf("Expired entry should not be returned")
+	}
+	if _, ok := c.entries["expired"]; ok {
+		t.Errorf("Expired entry should have been purged")
+	}
+}
+
+func TestNegativeCacheDisabled(t *testing.T) {
+	var nilCache *negativeCache
+	nilCache.add("whatever")
+	if nilCache.has("whatever") {
+		t.Errorf("Nil cache should never contain entries")
+	}
+	c := newNegativeCache(0, nil)
+	c.add("whatever")
+	if c.has("whatever") {
+		t.Errorf("Cache with zero TTL should never contain entries")
+	}
+}
+
+func TestNegativeCacheBounded(t *testing.T) {
+	c := newNegativeCache(time.Minute, nil)
+	for i := 0; i < negativeCacheMaxEntries+10; i++ {
+		c.add(generatePassword(20))
+	}
+	if len(c.entries) > negativeCacheMaxEntries {
+		t.Errorf("Expected at most %d entries, got %d", negativeCacheMaxEntries, len(c.entries))
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+)
+
+// reverseAddress returns the IP address of a name in the in-addr.arpa or ip6.arpa
+// tree, or nil if the name isn't the reverse name of a complete address
+func reverseAddress(name string) net.IP {
+	name = strings.TrimSuffix(strings.ToLower(name), ".")
+	if labels, ok := reverseLabels(name, ".in-addr.arpa", 4); ok {
+		for _, label := range labels {
+			if n, err := strconv.Atoi(label); err != nil || n < 0 || n > 255 || strconv.Itoa(n) != label {
+				return nil
+			}
+		}
+		return net.ParseIP(strings.Join(labels, ".")).To4()
+	}
+	if labels, ok := reverseLabels(name, ".ip6.arpa", 32); ok {
+		var addr strings.Builder
+		for i, label := range labels {
+			if len(label) != 1 || !strings.Contains("0123456789abcdef", label) {
+				return nil
+			}
+			if i > 0 && i%4 == 0 {
+				addr.WriteByte(':')
+			}
+			addr.WriteString(label)
+		}
+		return net.ParseIP(addr.String())
+	}
+	return nil
+}
+
+// reverseLabels returns the labels in front of the suffix in the address order
+func reverseLabels(name string, suffix string, count int) ([]string, bool) {
+	if !strings.HasSuffix(name, suffix) {
+		return nil, false
+	}
+	labels := strings.Split(strings.TrimSuffix(name, suffix), ".")
+	if len(labels) != count {
+		return nil, false
+	}
+	for i, j := 0, len(labels)-1; i < j; i, j = i+1, j-1 {
+		labels[i], labels[j] = labels[j], labels[i]
+	}
+	return labels, true
+}
+
+// answerPTR answers for the addresses of the A and AAAA records in the hosted reverse
+// zones with the names of the subdomains having them. The PTR records are derived
+// from the stored records, so they follow every update.
+func (d *DNSServer) answerPTR(q dns.Question) ([]dns.RR, error) {
+	var ra []dns.RR
+	if !d.AutoPTR || !d.isAuthoritative(q) {
+		return ra, nil
+	}
+	ip := reverseAddress(q.Name)
+	if ip == nil {
+		return ra, nil
+	}
+	subdomains, err := d.DB.GetSubdomainsForAddress(ip)
+	if err != nil {
+		dnsLog.WithFields(log.Fields{"error": err.Error()}).Debug("Error while trying to get record")
+		return ra, err
+	}
+	for _, subdomain := range subdomains {
+		r := new(dns.PTR)
+		r.Hdr = dns.RR_Header{Name: q.Name, Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: 1}
+		r.Ptr = subdomain + "." + d.Domain
+		ra = append(ra, r)
+	}
+	return ra, nil
+}
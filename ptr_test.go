@@ -0,0 +1,92 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestReverseAddress(t *testing.T) {
+	for i, test := range []struct {
+		name     string
+		expected string
+	}{
+		{"77.2.0.192.in-addr.arpa.", "192.0.2.77"},
+		{"77.2.0.192.IN-ADDR.ARPA", "192.0.2.77"},
+		{"2.0.192.in-addr.arpa.", ""},
+		{"256.2.0.192.in-addr.arpa.", ""},
+		{"07.2.0.192.in-addr.arpa.", ""},
+		{"1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa.", "2001:db8::1"},
+		{"0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa.", "2001:db8::"},
+		{"8.b.d.0.1.0.0.2.ip6.arpa.", ""},
+		{"x.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa.", ""},
+		{"www.example.org.", ""},
+	} {
+		ip := reverseAddress(test.name)
+		got := ""
+		if ip != nil {
+			got = ip.String()
+		}
+		if got != test.expected {
+			t.Errorf("Test %d: Expected %q, got %q", i, test.expected, got)
+		}
+	}
+}
+
+func TestAnswerPTR(t *testing.T) {
+	reg, err := DB.Register(cidrslice{}, registrationOrigin{}, ACMETxtPost{AValues: []string{"100.64.77.1"}, AAAAValues: []string{"2001:db8:77::1"}})
+	if err != nil {
+		t.Fatalf("Registration failed, got error [%v]", err)
+	}
+	config := Config
+	config.General.Domain = "auth.example.org"
+	config.General.StaticRecords = []string{
+		"77.64.100.in-addr.arpa. NS auth.example.org.",
+		"7.7.0.0.8.b.d.0.1.0.0.2.ip6.arpa. NS auth.example.org.",
+	}
+	server := NewDNSServer(DB, "", "udp", config.General.Domain)
+	server.ParseRecords(config)
+	expected := reg.Subdomain + ".auth.example.org."
+
+	for i, test := range []struct {
+		autoPTR bool
+		name    string
+		answer  string
+		rcode   int
+	}{
+		{true, "1.77.64.100.in-addr.arpa.", expected, dns.RcodeSuccess},
+		{true, "1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.7.7.0.0.8.b.d.0.1.0.0.2.ip6.arpa.", expected, dns.RcodeSuccess},
+		{true, "2.77.64.100.in-addr.arpa.", "", dns.RcodeNameError},
+		// Reverse zones that aren't hosted are not answered for
+		{true, "1.77.64.101.in-addr.arpa.", "", dns.RcodeNameError},
+		{false, "1.77.64.100.in-addr.arpa.", "", dns.RcodeNameError},
+	} {
+		server.AutoPTR = test.autoPTR
+		rrs, rcode, _, _ := server.answer(dns.Question{Name: test.name, Qtype: dns.TypePTR, Qclass: dns.ClassINET})
+		if rcode != test.rcode {
+			t.Errorf("Test %d: Expected rcode %s, got %s", i, dns.RcodeToString[test.rcode], dns.RcodeToString[rcode])
+		}
+		if test.answer == "" {
+			if len(rrs) != 0 {
+				t.Errorf("Test %d: Expected no answer, got %v", i, rrs)
+			}
+			continue
+		}
+		if len(rrs) != 1 || rrs[0].(*dns.PTR).Ptr != test.answer {
+			t.Errorf("Test %d: Expected PTR %s, got %v", i, test.answer, rrs)
+		}
+	}
+
+	// The PTR records follow the updates of the A records
+	server.AutoPTR = true
+	_, err = DB.Update(ACMETxtPost{Subdomain: reg.Subdomain, AValues: []string{"100.64.77.2"}})
+	if err != nil {
+		t.Fatalf("Update failed, got error [%v]", err)
+	}
+	if rrs, _, _, _ := server.answer(dns.Question{Name: "1.77.64.100.in-addr.arpa.", Qtype: dns.TypePTR, Qclass: dns.ClassINET}); len(rrs) != 0 {
+		t.Errorf("Expected the PTR record of the old address to be gone, got %v", rrs)
+	}
+	if rrs, _, _, _ := server.answer(dns.Question{Name: "2.77.64.100.in-addr.arpa.", Qtype: dns.TypePTR, Qclass: dns.ClassINET}); len(rrs) != 1 {
+		t.Errorf("Expected a PTR record for the new address, got %v", rrs)
+	}
+}
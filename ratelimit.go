@@ -0,0 +1,175 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+)
+
+// rateLimitSweepInterval is how often the buckets of the clients that went quiet
+// are removed
+const rateLimitSweepInterval = time.Minute
+
+// tokenBucket holds the tokens left to a client, and the number of times it was
+// limited since it last had tokens
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+	limited uint64
+}
+
+// tokenBuckets are token buckets by client, refilled at the same rate up to the
+// same burst
+type tokenBuckets struct {
+	clock   clock
+	rate    float64
+	burst   float64
+	mutex   sync.Mutex
+	buckets map[string]*tokenBucket
+	swept   time.Time
+}
+
+func newTokenBuckets(rate int, burst int, c clock) *tokenBuckets {
+	return &tokenBuckets{
+		clock:   c,
+		rate:    float64(rate),
+		burst:   float64(burst),
+		buckets: make(map[string]*tokenBucket),
+		swept:   clockOrSystem(c).Now(),
+	}
+}
+
+// take takes a token from the bucket of the key. Without tokens left, it returns
+// false and the number of times the key was limited in a row.
+func (t *tokenBuckets) take(key string) (bool, uint64) {
+	now := clockOrSystem(t.clock).Now()
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if now.Sub(t.swept) >= rateLimitSweepInterval {
+		t.sweep(now)
+	}
+	b, ok := t.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: t.burst, updated: now}
+		t.buckets[key] = b
+	}
+	b.tokens = t.refill(b, now)
+	b.updated = now
+	if b.tokens >= 1 {
+		b.tokens--
+		b.limited = 0
+		return true, 0
+	}
+	b.limited++
+	return false, b.limited
+}
+
+// refill returns the tokens of the bucket at the time
+func (t *tokenBuckets) refill(b *tokenBucket, now time.Time) float64 {
+	tokens := b.tokens + now.Sub(b.updated).Seconds()*t.rate
+	if tokens > t.burst {
+		return t.burst
+	}
+	return tokens
+}
+
+// sweep removes the buckets that filled up again, called with the mutex held
+func (t *tokenBuckets) sweep(now time.Time) {
+	for key, b := range t.buckets {
+		if t.refill(b, now) >= t.burst {
+			delete(t.buckets, key)
+		}
+	}
+	t.swept = now
+}
+
+// parseExempt parses the networks exempt from a rate limit
+func parseExempt(option string, cidrs []string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("exempt network %q of %s is not valid CIDR", cidr, option)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// exempted tells if the address is in one of the networks
+func exempted(networks []*net.IPNet, ip net.IP) bool {
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// validateQueryRateLimit checks the query rate limiting configuration and sets the defaults
+func validateQueryRateLimit(conf *queryRateLimitConfig) error {
+	if conf.QueriesPerSecond < 0 {
+		return fmt.Errorf("queries_per_second of query rate limiting can't be negative")
+	}
+	if conf.Burst <= 0 {
+		conf.Burst = conf.QueriesPerSecond
+	}
+	action, err := parseUDPDropPolicy(conf.Action)
+	if err != nil {
+		return fmt.Errorf("unknown action %q of query rate limiting, must be drop, refuse or servfail", conf.Action)
+	}
+	conf.Action = action
+	_, err = parseExempt("query rate limiting", conf.Exempt)
+	return err
+}
+
+// queryRateLimiter limits the queries each client address can send, whatever the
+// transport. Queries over the limit are answered according to the action, like
+// the queries dropped by the UDP worker pool.
+type queryRateLimiter struct {
+	buckets *tokenBuckets
+	action  string
+	exempt  []*net.IPNet
+}
+
+// newQueryRateLimiter returns the rate limiter of the validated configuration
+func newQueryRateLimiter(conf queryRateLimitConfig, c clock) *queryRateLimiter {
+	exempt, _ := parseExempt("query rate limiting", conf.Exempt)
+	return &queryRateLimiter{
+		buckets: newTokenBuckets(conf.QueriesPerSecond, conf.Burst, c),
+		action:  strings.ToLower(conf.Action),
+		exempt:  exempt,
+	}
+}
+
+// Allow tells if the query of the client of w is answered, or answers it
+// according to the action when the client is over the limit
+func (l *queryRateLimiter) Allow(w dns.ResponseWriter, r *dns.Msg, stats *dnsStatistics) bool {
+	if l == nil {
+		return true
+	}
+	ip := addrIP(w.RemoteAddr())
+	if ip == nil || exempted(l.exempt, ip) {
+		return true
+	}
+	ok, limited := l.buckets.take(ip.String())
+	if ok {
+		return true
+	}
+	stats.RecordRateLimited("QryRateLimited")
+	if limited&(limited-1) == 0 {
+		// Log with exponentially decreasing frequency while the client keeps sending
+		dnsLog.WithFields(log.Fields{"remote": ip.String(), "limited": limited}).Warn("Client over the query rate limit")
+	}
+	if rcode := udpDropPolicies[l.action]; rcode >= 0 {
+		m := new(dns.Msg)
+		m.SetRcode(r, rcode)
+		_ = w.WriteMsg(m)
+	}
+	return false
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestValidateQueryRateLimit(t *testing.T) {
+	for i, test := range []struct {
+		conf   queryRateLimitConfig
+		action string
+		valid  bool
+	}{
+		{queryRateLimitConfig{}, "drop", true},
+		{queryRateLimitConfig{QueriesPerSecond: 10, Action: "Refuse", Exempt: []string{"10.0.0.0/8"}}, "refuse", true},
+		{queryRateLimitConfig{QueriesPerSecond: -1}, "", false},
+		{queryRateLimitConfig{QueriesPerSecond: 10, Action: "slip"}, "", false},
+		{queryRateLimitConfig{QueriesPerSecond: 10, Exempt: []string{"10.0.0.0/33"}}, "", false},
+	} {
+		conf := test.conf
+		err := validateQueryRateLimit(&conf)
+		if test.valid != (err == nil) {
+			t.Errorf("Test %d: Expected valid to be %t, got %v", i, test.valid, err)
+		}
+		if err == nil && (conf.Action != test.action || conf.Burst != conf.QueriesPerSecond) {
+			t.Errorf("Test %d: Expected the defaults to be set, got %+v", i, conf)
+		}
+	}
+}
+
+func TestQueryRateLimit(t *testing.T) {
+	config := Config
+	config.General.Domain = "auth.example.org"
+	server := NewDNSServer(DB, "", "udp", config.General.Domain)
+	server.ParseRecords(config)
+	server.Stats = newDNSStatistics(nil)
+	clk := newFrozenClock(time.Unix(1700000000, 0))
+	req := new(dns.Msg)
+	req.SetQuestion("auth.example.org.", dns.TypeSOA)
+	query := func(remote net.Addr) *dns.Msg {
+		w := &addrWriter{remote: remote}
+		w.local = &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53}
+		server.handleRequest(w, req)
+		return w.msg
+	}
+	tcp := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 5353}
+
+	for _, action := range []string{"drop", "refuse"} {
+		conf := queryRateLimitConfig{QueriesPerSecond: 1, Burst: 2, Action: action, Exempt: []string{"198.51.100.0/24"}}
+		server.QueryLimit = newQueryRateLimiter(conf, clk)
+		if query(tcp) == nil || query(tcp) == nil {
+			t.Fatalf("%s: Expected the burst to be answered", action)
+		}
+		limited := query(tcp)
+		switch {
+		case action == "drop" && limited != nil:
+			t.Errorf("%s: Expected the query over the limit to be dropped, got %v", action, limited)
+		case action == "refuse" && (limited == nil || limited.Rcode != dns.RcodeRefused):
+			t.Errorf("%s: Expected the query over the limit to be refused, got %v", action, limited)
+		}
+		// Addresses of the same subnet are limited separately
+		if r := query(&net.UDPAddr{IP: net.ParseIP("192.0.2.2"), Port: 5353}); r == nil || r.Rcode != dns.RcodeSuccess {
+			t.Errorf("%s: Expected another client to be answered, got %v", action, r)
+		}
+		for i := 0; i < 5; i++ {
+			if query(&net.UDPAddr{IP: net.ParseIP("198.51.100.1"), Port: 5353}) == nil {
+				t.Fatalf("%s: Expected the exempt network to be answered", action)
+			}
+		}
+		clk.Advance(time.Second)
+		if r := query(tcp); r == nil || r.Rcode != dns.RcodeSuccess {
+			t.Errorf("%s: Expected the client to be answered again after a second, got %v", action, r)
+		}
+	}
+	if limited := server.Stats.snapshot(statNS)["QryRateLimited"]; limited != 2 {
+		t.Errorf("Expected two limited queries to be counted, got %d", limited)
+	}
+}
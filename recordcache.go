@@ -0,0 +1,164 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// recordCacheMaxEntries bounds the memory used by the record cache
+const recordCacheMaxEntries = 10000
+
+// recordSet holds the record values of a single subdomain
+type recordSet struct {
+	TXT   []string
+	A     []net.IP
+	AAAA  []net.IP
+	CNAME string
+	MX    []mxRecord
+	SRV   []srvRecord
+	CAA   []caaRecord
+	RR    []genericRecord
+	// TTL are the TTL set for the record types
+	TTL map[string]int
+}
+
+// count returns the number of records in the same way CountRecords does
+func (r recordSet) count() int {
+	count := len(r.A) + len(r.AAAA) + len(r.MX) + len(r.SRV) + len(r.CAA) + len(r.RR) + len(servedTXT(r.TXT))
+	if r.CNAME != "" {
+		count++
+	}
+	return count
+}
+
+type cachedRecordSet struct {
+	records recordSet
+	expires time.Time
+}
+
+// recordCache keeps recently served record values in memory, so that repeated
+// DNS queries for the same subdomain don't all reach the database.
+type recordCache struct {
+	mutex   sync.Mutex
+	ttl     time.Duration
+	clock   clock
+	entries map[string]cachedRecordSet
+	// invalidations counts the removals, records loaded before the latest one may
+	// be outdated and aren't cached
+	invalidations uint64
+}
+
+func newRecordCache(ttl time.Duration, c clock) *recordCache {
+	return &recordCache{
+		ttl:     ttl,
+		clock:   clockOrSystem(c),
+		entries: make(map[string]cachedRecordSet),
+	}
+}
+
+func (c *recordCache) enabled() bool {
+	return c != nil && c.ttl > 0
+}
+
+// get returns the cached records of the subdomain
+func (c *recordCache) get(subdomain string) (recordSet, bool) {
+	if !c.enabled() {
+		return recordSet{}, false
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	entry, ok := c.entries[subdomain]
+	if !ok {
+		return recordSet{}, false
+	}
+	if c.clock.Now().After(entry.expires) {
+		delete(c.entries, subdomain)
+		return recordSet{}, false
+	}
+	return entry.records, true
+}
+
+// generation returns the number of invalidations so far, taken before loading the
+// records to add
+func (c *recordCache) generation() uint64 {
+	if !c.enabled() {
+		return 0
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.invalidations
+}
+
+// add caches the records of the subdomain for the duration of the cache TTL, unless
+// the cache was invalidated since the generation the records were loaded at
+func (c *recordCache) add(subdomain string, records recordSet, generation uint64) {
+	if !c.enabled() {
+		return
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if generation != c.invalidations {
+		return
+	}
+	now := c.clock.Now()
+	if _, ok := c.entries[subdomain]; !ok && len(c.entries) >= recordCacheMaxEntries {
+		for k, v := range c.entries {
+			if now.After(v.expires) {
+				delete(c.entries, k)
+			}
+		}
+		if len(c.entries) >= recordCacheMaxEntries {
+			return
+		}
+	}
+	c.entries[subdomain] = cachedRecordSet{records: records, expires: now.Add(c.ttl)}
+}
+
+// remove invalidates the cached records of the subdomain
+func (c *recordCache) remove(subdomain string) {
+	if !c.enabled() {
+		return
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.invalidations++
+	delete(c.entries, subdomain)
+}
+
+// size returns the number of cached subdomains
+func (c *recordCache) size() int {
+	if !c.enabled() {
+		return 0
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return len(c.entries)
+}
+
+// cacheWarmer is implemented by database backends able to preload their record cache
+type cacheWarmer interface {
+	WarmUp(since time.Time) (int, error)
+}
+
+// warmUpCache preloads the records updated during the last period into the
+// record cache, so that a restart doesn't cause a burst of database lookups.
+func warmUpCache(db database, period time.Duration) {
+	w, ok := db.(cacheWarmer)
+	if !ok {
+		dbLog.Warning("Cache warm-up requested, but the database backend doesn't support it")
+		return
+	}
+	if Config.Database.RecordCacheTTL <= 0 {
+		dbLog.Warning("Cache warm-up requested, but the record cache is disabled")
+		return
+	}
+	count, err := w.WarmUp(time.Now().Add(-period))
+	if err != nil {
+		dbLog.WithFields(log.Fields{"error": err.Error()}).Warning("Could not warm up the record cache")
+		return
+	}
+	dbLog.WithFields(log.Fields{"subdomains": count}).Info("Warmed up the record cache")
+}
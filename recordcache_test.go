@@ -0,0 +1,164 @@
+package main
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/erikstmartin/go-testdb"
+)
+
+func TestRecordCache(t *testing.T) {
+	clk := newFrozenClock(time.Unix(1700000000, 0))
+	c := newRecordCache(time.Minute, clk)
+	if _, ok := c.get("cached"); ok {
+		t.Errorf("Empty cache should not contain entries")
+	}
+	c.add("cached", recordSet{TXT: []string{"value", ""}}, c.generation())
+	records, ok := c.get("cached")
+	if !ok || records.count() != 1 {
+		t.Errorf("Expected cache to contain the added entry, got %v", records)
+	}
+	clk.Advance(time.Minute + time.Second)
+	if _, ok = c.get("cached"); ok {
+		t.Errorf("Expired entry should not be returned")
+	}
+	c.add("cached", recordSet{}, c.generation())
+	c.remove("cached")
+	if c.size() != 0 {
+		t.Errorf("Expected entry to be removed from cache")
+	}
+
+	var nilCache *recordCache
+	nilCache.add("whatever", recordSet{}, nilCache.generation())
+	if _, ok = nilCache.get("whatever"); ok {
+		t.Errorf("Nil cache should never contain entries")
+	}
+}
+
+func withRecordCache(t *testing.T) *acmedb {
+	adb := DB.(*acmedb)
+	oldCache := adb.recordCache
+	adb.recordCache = newRecordCache(time.Minute, adb)
+	t.Cleanup(func() { adb.recordCache = oldCache })
+	return adb
+}
+
+func TestRecordCacheLookups(t *testing.T) {
+	adb := withRecordCache(t)
+	reg, err := DB.Register(cidrslice{}, registrationOrigin{}, ACMETxtPost{})
+	if err != nil {
+		t.Fatalf("Registration failed, got error [%v]", err)
+	}
+	reg.Value = "LHDhK3oGRvkiefQnx7OOczTY5Tic_xZ6HcMOc_gmtoM"
+	if _, err = DB.Update(reg.ACMETxtPost); err != nil {
+		t.Fatalf("DB Update failed, got error: [%v]", err)
+	}
+	if count, _ := DB.CountRecords(reg.Subdomain); count != 1 {
+		t.Errorf("Expected 1 record, got %d", count)
+	}
+
+	// Updates invalidate the cached records
+	reg.Value = "___________________________________________"
+	if _, err = DB.Update(reg.ACMETxtPost); err != nil {
+		t.Fatalf("DB Update failed, got error: [%v]", err)
+	}
+	if _, ok := adb.recordCache.get(reg.Subdomain); ok {
+		t.Errorf("Expected update to invalidate the cached records")
+	}
+	if count, _ := DB.CountRecords(reg.Subdomain); count != 2 {
+		t.Errorf("Expected 2 records, got %d", count)
+	}
+
+	// Cached lookups should not touch the database at all
+	testdb.SetQueryWithArgsFunc(func(query string, args []driver.Value) (result driver.Rows, err error) {
+		return nil, errors.New("database should not be queried")
+	})
+	defer testdb.Reset()
+	tdb, _ := sql.Open("testdb", "")
+	oldDb := DB.(*acmedb).GetBackend()
+	DB.(*acmedb).SetBackend(tdb)
+	defer DB.(*acmedb).SetBackend(oldDb)
+	txts, err := DB.GetTXTForDomain(reg.Subdomain)
+	if err != nil {
+		t.Errorf("Expected cached answer, but got error [%v]", err)
+	}
+	if len(txts) != 2 {
+		t.Errorf("Expected 2 cached TXT values, got %v", txts)
+	}
+	if _, err = DB.GetAForDomain(reg.Subdomain); err != nil {
+		t.Errorf("Expected cached answer, but got error [%v]", err)
+	}
+}
+
+func TestRecordCacheLoadDuringUpdate(t *testing.T) {
+	adb := withRecordCache(t)
+	reg, err := DB.Register(cidrslice{}, registrationOrigin{}, ACMETxtPost{})
+	if err != nil {
+		t.Fatalf("Registration failed, got error [%v]", err)
+	}
+	reg.Value = "LHDhK3oGRvkiefQnx7OOczTY5Tic_xZ6HcMOc_gmtoM"
+	if _, err = DB.Update(reg.ACMETxtPost); err != nil {
+		t.Fatalf("DB Update failed, got error: [%v]", err)
+	}
+	adb.recordCache.remove(reg.Subdomain)
+
+	// A lookup loads the records, and an update is applied before it caches them
+	generation := adb.recordCache.generation()
+	old, err := adb.loadRecords(reg.Subdomain)
+	if err != nil {
+		t.Fatalf("Could not load the records: %v", err)
+	}
+	updated := "tnYAy4oX-5tkvfQ6tP6n_4GArtf0Ds5V7gpp_qLsyJo"
+	slot := 0
+	if _, err = DB.Update(ACMETxtPost{Subdomain: reg.Subdomain, Value: updated, Slot: &slot}); err != nil {
+		t.Fatalf("DB Update failed, got error: [%v]", err)
+	}
+	adb.recordCache.add(reg.Subdomain, old, generation)
+	if _, ok := adb.recordCache.get(reg.Subdomain); ok {
+		t.Errorf("Expected the records loaded before the update not to be cached")
+	}
+	txts, err := DB.GetTXTForDomain(reg.Subdomain)
+	if err != nil || len(txts) == 0 || txts[0] != updated {
+		t.Errorf("Expected the updated TXT value, got %v, %v", txts, err)
+	}
+	if _, ok := adb.recordCache.get(reg.Subdomain); !ok {
+		t.Errorf("Expected the records loaded after the update to be cached")
+	}
+}
+
+func TestRecordCacheWarmUp(t *testing.T) {
+	clk := withFrozenClock(t, time.Unix(1800000000, 0))
+	adb := withRecordCache(t)
+	var subdomains []string
+	for i := 0; i < 2; i++ {
+		reg, err := DB.Register(cidrslice{}, registrationOrigin{}, ACMETxtPost{})
+		if err != nil {
+			t.Fatalf("Registration failed, got error [%v]", err)
+		}
+		reg.Value = "LHDhK3oGRvkiefQnx7OOczTY5Tic_xZ6HcMOc_gmtoM"
+		if _, err = DB.Update(reg.ACMETxtPost); err != nil {
+			t.Fatalf("DB Update failed, got error: [%v]", err)
+		}
+		subdomains = append(subdomains, reg.Subdomain)
+		clk.Advance(3 * time.Hour)
+	}
+	adb.recordCache = newRecordCache(time.Hour, adb)
+
+	count, err := adb.WarmUp(clk.Now().Add(-4 * time.Hour))
+	if err != nil {
+		t.Fatalf("Got unexpected error from WarmUp [%v]", err)
+	}
+	if count != 1 {
+		t.Errorf("Expected 1 subdomain to be loaded, got %d", count)
+	}
+	if _, ok := adb.recordCache.get(subdomains[0]); ok {
+		t.Errorf("Subdomain updated before the warm-up period should not be cached")
+	}
+	records, ok := adb.recordCache.get(subdomains[1])
+	if !ok || records.count() != 1 {
+		t.Errorf("Expected recently updated subdomain to be cached, got %v", records)
+	}
+}
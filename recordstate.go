@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+
+	"github.com/julienschmidt/httprouter"
+	log "github.com/sirupsen/logrus"
+)
+
+// recordState is the current state of the records of a registration, as served
+type recordState struct {
+	Subdomain  string           `json:"subdomain"`
+	AllowFrom  []string         `json:"allowfrom"`
+	TXT        []txtSlot        `json:"txt"`
+	A          []string         `json:"a"`
+	AAAA       []string         `json:"aaaa"`
+	CNAME      string           `json:"cname"`
+	MX         []mxRecord       `json:"mx"`
+	SRV        []srvRecord      `json:"srv"`
+	CAA        []caaRecord      `json:"caa"`
+	Records    []genericRecord  `json:"records"`
+	TTL        map[string]int   `json:"ttl"`
+	LastUpdate map[string]int64 `json:"last_update"`
+}
+
+// ipStrings returns the addresses in their text form
+func ipStrings(ips []net.IP) []string {
+	values := []string{}
+	for _, ip := range ips {
+		values = append(values, ip.String())
+	}
+	return values
+}
+
+// loadRecordState reads the current records of the subdomain from the database
+func loadRecordState(db database, user ACMETxt) (recordState, error) {
+	var err error
+	state := recordState{
+		Subdomain: user.Subdomain,
+		AllowFrom: nonNilStrings(user.AllowFrom.ValidEntries()),
+	}
+	if state.TXT, err = db.GetTXTSlots(user.Subdomain); err != nil {
+		return state, err
+	}
+	a, err := db.GetAForDomain(user.Subdomain)
+	if err != nil {
+		return state, err
+	}
+	aaaa, err := db.GetAAAAForDomain(user.Subdomain)
+	if err != nil {
+		return state, err
+	}
+	state.A, state.AAAA = ipStrings(a), ipStrings(aaaa)
+	if state.CNAME, err = db.GetCNAMEForDomain(user.Subdomain); err != nil {
+		return state, err
+	}
+	if state.MX, err = db.GetMXForDomain(user.Subdomain); err != nil {
+		return state, err
+	}
+	if state.SRV, err = db.GetSRVForDomain(user.Subdomain); err != nil {
+		return state, err
+	}
+	if state.CAA, err = db.GetCAAForDomain(user.Subdomain); err != nil {
+		return state, err
+	}
+	if state.Records, err = db.GetRecordsForDomain(user.Subdomain); err != nil {
+		return state, err
+	}
+	if state.TTL, err = db.GetTTLForDomain(user.Subdomain); err != nil {
+		return state, err
+	}
+	if state.LastUpdate, err = db.GetLastUpdates(user.Subdomain); err != nil {
+		return state, err
+	}
+	if state.TXT == nil {
+		state.TXT = []txtSlot{}
+	}
+	if state.MX == nil {
+		state.MX = []mxRecord{}
+	}
+	if state.SRV == nil {
+		state.SRV = []srvRecord{}
+	}
+	if state.CAA == nil {
+		state.CAA = []caaRecord{}
+	}
+	if state.Records == nil {
+		state.Records = []genericRecord{}
+	}
+	if state.TTL == nil {
+		state.TTL = map[string]int{}
+	}
+	return state, nil
+}
+
+// webRecords returns all the current records of the authenticated registration,
+// with their update times, to debug failed challenges without database access
+func webRecords(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	user, ok := r.Context().Value(ACMETxtKey).(ACMETxt)
+	if !ok {
+		apiLog.WithFields(log.Fields{"error": "context"}).Error("Context error")
+		WriteJsonResponse(w, http.StatusInternalServerError, jsonError("context_error"))
+		return
+	}
+	state, err := loadRecordState(DB, user)
+	if err != nil {
+		apiLog.WithFields(log.Fields{"error": err.Error(), "subdomain": user.Subdomain}).Error("Error while getting the records")
+		WriteJsonResponse(w, http.StatusInternalServerError, jsonError("db_error"))
+		return
+	}
+	out, _ := json.Marshal(state)
+	WriteJsonResponse(w, http.StatusOK, out)
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestRecordStateMemoryBackend(t *testing.T) {
+	db, err := openBackend("memory", "")
+	if err != nil {
+		t.Fatalf("Could not open the memory backend: %v", err)
+	}
+	defer db.Close()
+	user, err := db.Register(cidrslice{"10.0.0.0/8"}, registrationOrigin{}, ACMETxtPost{AValues: []string{"192.0.2.1"}, TTL: 300})
+	if err != nil {
+		t.Fatalf("Could not register: %v", err)
+	}
+	state, err := loadRecordState(db, user)
+	if err != nil {
+		t.Fatalf("Could not load the record state: %v", err)
+	}
+	if len(state.A) != 1 || state.A[0] != "192.0.2.1" || len(state.AllowFrom) != 1 || state.TTL["a"] != 300 {
+		t.Errorf("Unexpected record state %+v", state)
+	}
+	if state.LastUpdate["a"] == 0 || state.LastUpdate["txt"] != 0 {
+		t.Errorf("Expected only the A records to have been updated, got %v", state.LastUpdate)
+	}
+
+	if _, err = db.Update(ACMETxtPost{Subdomain: user.Subdomain, Value: "LHDhK3oGRvkiefQnx7OOczTY5Tic_xZ6HcMOc_gmtoM", CNAME: "host.example.net."}); err != nil {
+		t.Fatalf("Could not update: %v", err)
+	}
+	state, err = loadRecordState(db, user)
+	if err != nil {
+		t.Fatalf("Could not load the record state: %v", err)
+	}
+	if len(state.A) != 0 || state.CNAME != "host.example.net." {
+		t.Errorf("Expected the CNAME record to replace the A records, got %+v", state)
+	}
+	if _, ok := state.LastUpdate["a"]; ok || state.LastUpdate["cname"] == 0 || state.LastUpdate["txt"] == 0 {
+		t.Errorf("Unexpected update times %v", state.LastUpdate)
+	}
+}
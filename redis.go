@@ -0,0 +1,296 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+func init() {
+	RegisterBackend("redis", newRedisBackend)
+}
+
+// newRedisBackend returns a database backend storing the data in Redis
+func newRedisBackend() database {
+	return &kvdb{
+		open: func(connection string) (kvStore, error) {
+			return newRedisStore(connection)
+		},
+		txtTTL: time.Duration(Config.Database.TXTExpiry) * time.Second,
+	}
+}
+
+// redisTimeout limits the time a single command may take
+const redisTimeout = 5 * time.Second
+
+// redisError is an error reply from the Redis server
+type redisError string
+
+func (e redisError) Error() string {
+	return "redis: " + string(e)
+}
+
+// redisStore is a kvStore talking the Redis protocol over a single connection
+type redisStore struct {
+	mutex    sync.Mutex
+	addr     string
+	password string
+	db       int
+	conn     net.Conn
+	reader   *bufio.Reader
+}
+
+// parseRedisURL parses a connection string of the form redis://[:password@]host[:port][/db]
+func parseRedisURL(connection string) (*redisStore, error) {
+	u, err := url.Parse(connection)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "redis" || u.Host == "" {
+		return nil, fmt.Errorf("invalid redis connection string %q", connection)
+	}
+	s := &redisStore{addr: u.Host}
+	if u.Port() == "" {
+		s.addr = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	if u.User != nil {
+		s.password, _ = u.User.Password()
+	}
+	if db := strings.TrimPrefix(u.Path, "/"); db != "" {
+		s.db, err = strconv.Atoi(db)
+		if err != nil {
+			return nil, fmt.Errorf("invalid redis database number %q", db)
+		}
+	}
+	return s, nil
+}
+
+// newRedisStore connects to the server given by the connection string
+func newRedisStore(connection string) (*redisStore, error) {
+	s, err := parseRedisURL(connection)
+	if err != nil {
+		return nil, err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if err = s.connect(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// connect opens the connection, authenticates and selects the database
+func (s *redisStore) connect() error {
+	conn, err := net.DialTimeout("tcp", s.addr, redisTimeout)
+	if err != nil {
+		return err
+	}
+	s.conn = conn
+	s.reader = bufio.NewReader(conn)
+	if s.password != "" {
+		if _, err = s.roundTrip("AUTH", s.password); err != nil {
+			s.disconnect()
+			return err
+		}
+	}
+	if s.db != 0 {
+		if _, err = s.roundTrip("SELECT", strconv.Itoa(s.db)); err != nil {
+			s.disconnect()
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *redisStore) disconnect() {
+	if s.conn != nil {
+		_ = s.conn.Close()
+	}
+	s.conn = nil
+	s.reader = nil
+}
+
+// do runs a command, reconnecting once if the connection has been lost
+func (s *redisStore) do(args ...string) (interface{}, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for attempt := 0; ; attempt++ {
+		if s.conn == nil {
+			if err := s.connect(); err != nil {
+				return nil, err
+			}
+		}
+		reply, err := s.roundTrip(args...)
+		if _, ok := err.(redisError); err == nil || ok {
+			return reply, err
+		}
+		// The connection is in an unknown state after I/O errors
+		s.disconnect()
+		if attempt > 0 {
+			return nil, err
+		}
+	}
+}
+
+// roundTrip writes the command and reads its reply
+func (s *redisStore) roundTrip(args ...string) (interface{}, error) {
+	_ = s.conn.SetDeadline(time.Now().Add(redisTimeout))
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := io.WriteString(s.conn, b.String()); err != nil {
+		return nil, err
+	}
+	return readRESP(s.reader)
+}
+
+// readRESP reads a single reply. Bulk strings are returned as []byte, with nil
+// for the null bulk string, integers as int64 and arrays as []interface{}.
+func readRESP(r *bufio.Reader) (interface{}, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || !strings.HasSuffix(line, "\r\n") {
+		return nil, errors.New("redis: malformed reply")
+	}
+	payload := line[1 : len(line)-2]
+	switch line[0] {
+	case '+':
+		return payload, nil
+	case '-':
+		return nil, redisError(payload)
+	case ':':
+		return strconv.ParseInt(payload, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(payload)
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		buf := make([]byte, n+2)
+		if _, err = io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		return buf[:n], nil
+	case '*':
+		n, err := strconv.Atoi(payload)
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		items := make([]interface{}, n)
+		for i := range items {
+			if items[i], err = readRESP(r); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("redis: unknown reply type %q", line[0])
+}
+
+// setArgs returns the arguments of a SET command
+func setArgs(key string, value []byte, ttl time.Duration) []string {
+	args := []string{"SET", key, string(value)}
+	if ttl > 0 {
+		args = append(args, "PX", strconv.FormatInt(ttl.Milliseconds(), 10))
+	}
+	return args
+}
+
+func (s *redisStore) Get(key string) ([]byte, error) {
+	reply, err := s.do("GET", key)
+	if err != nil {
+		return nil, err
+	}
+	value, ok := reply.([]byte)
+	if !ok {
+		return nil, errKeyNotFound
+	}
+	return value, nil
+}
+
+func (s *redisStore) Set(key string, value []byte, ttl time.Duration) error {
+	_, err := s.do(setArgs(key, value, ttl)...)
+	return err
+}
+
+func (s *redisStore) SetNX(key string, value []byte, ttl time.Duration) (bool, error) {
+	reply, err := s.do(append(setArgs(key, value, ttl), "NX")...)
+	return reply != nil, err
+}
+
+// redisSetIfScript sets KEYS[1] to ARGV[2] with the TTL of ARGV[3] milliseconds
+// if it holds ARGV[1]
+const redisSetIfScript = `if redis.call('GET', KEYS[1]) ~= ARGV[1] then return 0 end
+if tonumber(ARGV[3]) > 0 then redis.call('SET', KEYS[1], ARGV[2], 'PX', ARGV[3]) else redis.call('SET', KEYS[1], ARGV[2]) end
+return 1`
+
+// redisDeleteIfScript deletes KEYS[1] if it holds ARGV[1]
+const redisDeleteIfScript = `if redis.call('GET', KEYS[1]) ~= ARGV[1] then return 0 end
+return redis.call('DEL', KEYS[1])`
+
+func (s *redisStore) SetIf(key string, expected []byte, value []byte, ttl time.Duration) (bool, error) {
+	reply, err := s.do("EVAL", redisSetIfScript, "1", key, string(expected), string(value), strconv.FormatInt(ttl.Milliseconds(), 10))
+	return reply == int64(1), err
+}
+
+func (s *redisStore) Delete(key string) error {
+	_, err := s.do("DEL", key)
+	return err
+}
+
+func (s *redisStore) DeleteIf(key string, expected []byte) (bool, error) {
+	reply, err := s.do("EVAL", redisDeleteIfScript, "1", key, string(expected))
+	return reply == int64(1), err
+}
+
+// redisGlobEscaper escapes the special characters of Redis glob patterns
+var redisGlobEscaper = strings.NewReplacer(`\`, `\\`, `*`, `\*`, `?`, `\?`, `[`, `\[`, `]`, `\]`)
+
+func (s *redisStore) Keys(prefix string) ([]string, error) {
+	var keys []string
+	cursor := "0"
+	for {
+		reply, err := s.do("SCAN", cursor, "MATCH", redisGlobEscaper.Replace(prefix)+"*", "COUNT", "1000")
+		if err != nil {
+			return keys, err
+		}
+		items, ok := reply.([]interface{})
+		if !ok || len(items) != 2 {
+			return keys, errors.New("redis: malformed SCAN reply")
+		}
+		next, _ := items[0].([]byte)
+		batch, _ := items[1].([]interface{})
+		for _, key := range batch {
+			if k, ok := key.([]byte); ok {
+				keys = append(keys, string(k))
+			}
+		}
+		cursor = string(next)
+		if cursor == "0" || cursor == "" {
+			return keys, nil
+		}
+	}
+}
+
+func (s *redisStore) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.disconnect()
+	return nil
+}
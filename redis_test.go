@@ -0,0 +1,384 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeRedis is an in-process server implementing the subset of Redis used by redisStore
+type fakeRedis struct {
+	mutex    sync.Mutex
+	listener net.Listener
+	password string
+	values   map[string]string
+	expiry   map[string]time.Time
+}
+
+func newFakeRedis(t *testing.T, password string) *fakeRedis {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Could not listen: %v", err)
+	}
+	f := &fakeRedis{listener: l, password: password, values: map[string]string{}, expiry: map[string]time.Time{}}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(conn)
+		}
+	}()
+	t.Cleanup(func() { _ = l.Close() })
+	return f
+}
+
+func (f *fakeRedis) addr() string {
+	return f.listener.Addr().String()
+}
+
+// expire makes the key expire immediately
+func (f *fakeRedis) expire(key string) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.expiry[key] = time.Now().Add(-time.Second)
+}
+
+func (f *fakeRedis) ttl(key string) time.Duration {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	exp, ok := f.expiry[key]
+	if !ok {
+		return 0
+	}
+	return time.Until(exp)
+}
+
+func (f *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	authenticated := f.password == ""
+	for {
+		reply, err := readRESP(r)
+		if err != nil {
+			return
+		}
+		items, _ := reply.([]interface{})
+		var args []string
+		for _, item := range items {
+			b, _ := item.([]byte)
+			args = append(args, string(b))
+		}
+		if len(args) == 0 {
+			return
+		}
+		cmd := strings.ToUpper(args[0])
+		if cmd == "AUTH" {
+			if len(args) == 2 && args[1] == f.password {
+				authenticated = true
+				fmt.Fprint(conn, "+OK\r\n")
+			} else {
+				fmt.Fprint(conn, "-WRONGPASS invalid password\r\n")
+			}
+			continue
+		}
+		if !authenticated {
+			fmt.Fprint(conn, "-NOAUTH Authentication required.\r\n")
+			continue
+		}
+		fmt.Fprint(conn, f.handle(cmd, args[1:]))
+	}
+}
+
+func bulkString(s string) string {
+	return fmt.Sprintf("$%d\r\n%s\r\n", len(s), s)
+}
+
+func (f *fakeRedis) handle(cmd string, args []string) string {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	for key, exp := range f.expiry {
+		if time.Now().After(exp) {
+			delete(f.values, key)
+			delete(f.expiry, key)
+		}
+	}
+	switch cmd {
+	case "PING", "SELECT":
+		return "+OK\r\n"
+	case "GET":
+		v, ok := f.values[args[0]]
+		if !ok {
+			return "$-1\r\n"
+		}
+		return bulkString(v)
+	case "SET":
+		key, value := args[0], args[1]
+		var ttl time.Duration
+		nx := false
+		for i := 2; i < len(args); i++ {
+			switch strings.ToUpper(args[i]) {
+			case "NX":
+				nx = true
+			case "PX":
+				ms, _ := strconv.Atoi(args[i+1])
+				ttl = time.Duration(ms) * time.Millisecond
+				i++
+			}
+		}
+		if _, exists := f.values[key]; nx && exists {
+			return "$-1\r\n"
+		}
+		f.values[key] = value
+		delete(f.expiry, key)
+		if ttl > 0 {
+			f.expiry[key] = time.Now().Add(ttl)
+		}
+		return "+OK\r\n"
+	case "DEL":
+		_, exists := f.values[args[0]]
+		delete(f.values, args[0])
+		delete(f.expiry, args[0])
+		if exists {
+			return ":1\r\n"
+		}
+		return ":0\r\n"
+	case "EVAL":
+		// Only the scripts of redisStore are understood
+		key, expected := args[2], args[3]
+		if v, ok := f.values[key]; !ok || v != expected {
+			return ":0\r\n"
+		}
+		switch args[0] {
+		case redisSetIfScript:
+			f.values[key] = args[4]
+			delete(f.expiry, key)
+			if ms, _ := strconv.Atoi(args[5]); ms > 0 {
+				f.expiry[key] = time.Now().Add(time.Duration(ms) * time.Millisecond)
+			}
+		case redisDeleteIfScript:
+			delete(f.values, key)
+			delete(f.expiry, key)
+		default:
+			return "-NOSCRIPT unknown script\r\n"
+		}
+		return ":1\r\n"
+	case "SCAN":
+		// Return the matching keys one per page to exercise the cursor
+		prefix := strings.TrimSuffix(args[2], "*")
+		var keys []string
+		for key := range f.values {
+			if strings.HasPrefix(key, prefix) {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+		cursor, _ := strconv.Atoi(args[0])
+		if cursor >= len(keys) {
+			return "*2\r\n" + bulkString("0") + "*0\r\n"
+		}
+		next := strconv.Itoa(cursor + 1)
+		if cursor+1 >= len(keys) {
+			next = "0"
+		}
+		return "*2\r\n" + bulkString(next) + "*1\r\n" + bulkString(keys[cursor])
+	}
+	return "-ERR unknown command '" + cmd + "'\r\n"
+}
+
+func newTestRedisDB(t *testing.T, connection string, ttl time.Duration) *kvdb {
+	db := newRedisBackend().(*kvdb)
+	db.txtTTL = ttl
+	if err := db.Init("redis", connection); err != nil {
+		t.Fatalf("Could not initialize the redis backend: %v", err)
+	}
+	t.Cleanup(db.Close)
+	return db
+}
+
+func TestRedisConnectionString(t *testing.T) {
+	for i, test := range []struct {
+		connection string
+		addr       string
+		password   string
+		db         int
+		valid      bool
+	}{
+		{"redis://localhost:6380/2", "localhost:6380", "", 2, true},
+		{"redis://:secret@localhost", "localhost:6379", "secret", 0, true},
+		{"redis://localhost/db", "", "", 0, false},
+		{"postgres://localhost", "", "", 0, false},
+	} {
+		s, err := parseRedisURL(test.connection)
+		if !test.valid {
+			if err == nil {
+				t.Errorf("Test %d: expected an error for %q", i, test.connection)
+			}
+			continue
+		}
+		if err != nil || s.addr != test.addr || s.password != test.password || s.db != test.db {
+			t.Errorf("Test %d: unexpected result %+v, %v", i, s, err)
+		}
+	}
+}
+
+func TestRedisAuth(t *testing.T) {
+	f := newFakeRedis(t, "secret")
+	if _, err := newRedisStore("redis://:wrong@" + f.addr()); err == nil {
+		t.Errorf("Expected an error with the wrong password")
+	}
+	s, err := newRedisStore("redis://:secret@" + f.addr() + "/1")
+	if err != nil {
+		t.Fatalf("Could not connect: %v", err)
+	}
+	defer s.Close()
+	if err = s.Set("k", []byte("v"), 0); err != nil {
+		t.Errorf("Could not set a key: %v", err)
+	}
+	if v, err := s.Get("k"); err != nil || string(v) != "v" {
+		t.Errorf("Expected to read back the value, got %q, %v", v, err)
+	}
+	if _, err := s.Get("missing"); err != errKeyNotFound {
+		t.Errorf("Expected errKeyNotFound, got %v", err)
+	}
+}
+
+func TestRedisReconnect(t *testing.T) {
+	f := newFakeRedis(t, "")
+	s, err := newRedisStore("redis://" + f.addr())
+	if err != nil {
+		t.Fatalf("Could not connect: %v", err)
+	}
+	defer s.Close()
+	// Break the connection behind the back of the store
+	_ = s.conn.Close()
+	if err = s.Set("k", []byte("v"), 0); err != nil {
+		t.Errorf("Expected the store to reconnect, got %v", err)
+	}
+}
+
+func TestRedisRegisterAndUpdate(t *testing.T) {
+	f := newFakeRedis(t, "")
+	db := newTestRedisDB(t, "redis://"+f.addr(), time.Hour)
+
+	reg, err := db.Register(cidrslice{}, registrationOrigin{CreatedBy: "admin"}, ACMETxtPost{AValues: []string{"192.0.2.1"}})
+	if err != nil {
+		t.Fatalf("Could not register: %v", err)
+	}
+	if _, err = db.GetByUsername(reg.Username); err != nil {
+		t.Errorf("Could not fetch the registration: %v", err)
+	}
+	txts, err := db.GetTXTForDomain(reg.Subdomain)
+	if err != nil || len(txts) != txtSlotCount() {
+		t.Fatalf("Expected %d empty TXT slots, got %v, %v", txtSlotCount(), txts, err)
+	}
+	if txts, _ = db.GetTXTForDomain("unregistered"); txts != nil {
+		t.Errorf("Expected no TXT values for an unregistered subdomain, got %v", txts)
+	}
+
+	validTXT := "______________valid_response_______________"
+	updated, err := db.Update(ACMETxtPost{Subdomain: reg.Subdomain, Value: validTXT})
+	if err != nil || updated.Slot == nil || *updated.Slot != 0 {
+		t.Fatalf("Expected the update to use slot 0, got %v, %v", updated.Slot, err)
+	}
+	if ttl := f.ttl(kvTXTKey(reg.Subdomain, 0)); ttl <= 0 || ttl > time.Hour {
+		t.Errorf("Expected the TXT value to expire within an hour, got %v", ttl)
+	}
+	if count, err := db.CountRecords(reg.Subdomain); err != nil || count != 2 {
+		t.Errorf("Expected 2 records, got %d, %v", count, err)
+	}
+	ips, err := db.GetAForDomain(reg.Subdomain)
+	if err != nil || len(ips) != 1 || ips[0].String() != "192.0.2.1" {
+		t.Errorf("Expected the preset A record, got %v, %v", ips, err)
+	}
+
+	// An expired TXT value is gone and its slot is reused
+	f.expire(kvTXTKey(reg.Subdomain, 0))
+	txts, _ = db.GetTXTForDomain(reg.Subdomain)
+	if txts[0] != "" {
+		t.Errorf("Expected the expired TXT value to be gone, got %q", txts[0])
+	}
+	updated, err = db.Update(ACMETxtPost{Subdomain: reg.Subdomain, Value: validTXT})
+	if err != nil || *updated.Slot != 0 {
+		t.Errorf("Expected the expired slot to be reused, got %v, %v", updated.Slot, err)
+	}
+}
+
+func TestRedisListRegistrations(t *testing.T) {
+	f := newFakeRedis(t, "")
+	db := newTestRedisDB(t, "redis://"+f.addr(), 0)
+	for _, by := range []string{"alice", "bob", "alice"} {
+		if _, err := db.Register(cidrslice{}, registrationOrigin{CreatedBy: by}, ACMETxtPost{}); err != nil {
+			t.Fatalf("Could not register: %v", err)
+		}
+	}
+	all, err := db.ListRegistrations(registrationOrigin{})
+	if err != nil || len(all) != 3 {
+		t.Errorf("Expected 3 registrations, got %d, %v", len(all), err)
+	}
+	alice, err := db.ListRegistrations(registrationOrigin{CreatedBy: "alice"})
+	if err != nil || len(alice) != 2 {
+		t.Errorf("Expected 2 registrations by alice, got %d, %v", len(alice), err)
+	}
+}
+
+func TestRedisLeases(t *testing.T) {
+	f := newFakeRedis(t, "")
+	db := newTestRedisDB(t, "redis://"+f.addr(), 0)
+	if ok, err := db.AcquireLease("primary", "a", time.Minute); !ok || err != nil {
+		t.Fatalf("Expected to acquire the lease, got %v, %v", ok, err)
+	}
+	if ok, _ := db.AcquireLease("primary", "b", time.Minute); ok {
+		t.Errorf("Expected the lease to be held by another instance")
+	}
+	if ok, _ := db.AcquireLease("primary", "a", time.Minute); !ok {
+		t.Errorf("Expected the holder to renew the lease")
+	}
+	if err := db.ReleaseLease("primary", "b"); err != nil {
+		t.Errorf("Could not release the lease: %v", err)
+	}
+	if ok, _ := db.AcquireLease("primary", "b", time.Minute); ok {
+		t.Errorf("Expected only the holder to release the lease")
+	}
+	if err := db.ReleaseLease("primary", "a"); err != nil {
+		t.Errorf("Could not release the lease: %v", err)
+	}
+	if ok, _ := db.AcquireLease("primary", "b", time.Minute); !ok {
+		t.Errorf("Expected to acquire the released lease")
+	}
+}
+
+func TestRedisDisableAndDelete(t *testing.T) {
+	f := newFakeRedis(t, "")
+	db := newTestRedisDB(t, "redis://"+f.addr(), 0)
+	reg, err := db.Register(cidrslice{}, registrationOrigin{}, ACMETxtPost{Value: "______________valid_response_______________"})
+	if err != nil {
+		t.Fatalf("Could not register: %v", err)
+	}
+	if err = db.SetDisabled(reg.Username, true); err != nil {
+		t.Errorf("Could not disable the registration: %v", err)
+	}
+	if err = db.SetPassword(reg.Username, "new password"); err != nil {
+		t.Errorf("Could not set the password: %v", err)
+	}
+	user, err := db.GetByUsername(reg.Username)
+	if err != nil || !user.Disabled || !correctPassword("new password", user.Password) || user.LastUpdate == 0 {
+		t.Errorf("Expected a disabled registration with the new password and a TXT update, got %+v, %v", user, err)
+	}
+	if err = db.DeleteRegistration(reg.Username); err != nil {
+		t.Errorf("Could not delete the registration: %v", err)
+	}
+	if _, err = db.GetByUsername(reg.Username); err == nil {
+		t.Errorf("Expected the registration to be gone")
+	}
+	if keys, _ := db.store.Keys(kvKeyPrefix); len(keys) != 0 {
+		t.Errorf("Expected no keys to remain, got %v", keys)
+	}
+}
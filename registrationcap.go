@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"sync/atomic"
+
+	"github.com/julienschmidt/httprouter"
+	log "github.com/sirupsen/logrus"
+)
+
+// registrationCapMutex serializes the capped registrations, so that concurrent
+// requests can't both take the last free place
+var registrationCapMutex sync.Mutex
+
+// registrationsRefused counts the registrations refused because of the cap
+var registrationsRefused uint64
+
+// countRegistrations returns the number of registrations in the database
+func countRegistrations() (int, error) {
+	registrations, _, err := DB.CountCredentials()
+	if err != nil {
+		return 0, err
+	}
+	total := 0
+	for _, n := range registrations {
+		total += n
+	}
+	return total, nil
+}
+
+// registrationCapReached tells if the max_registrations limit leaves no room for
+// another registration, counting the refusal. Must be called with the
+// registrationCapMutex held.
+func registrationCapReached() (bool, error) {
+	if Config.API.MaxRegistrations <= 0 {
+		return false, nil
+	}
+	total, err := countRegistrations()
+	if err != nil {
+		return false, err
+	}
+	if total < Config.API.MaxRegistrations {
+		return false, nil
+	}
+	refused := atomic.AddUint64(&registrationsRefused, 1)
+	apiLog.WithFields(log.Fields{"registrations": total, "max_registrations": Config.API.MaxRegistrations, "refused": refused}).Warn("Registration refused, maximum number of registrations reached")
+	return true, nil
+}
+
+// webAdminCapacity reports the number of registrations against the cap and the
+// registrations refused because of it
+func webAdminCapacity(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	total, err := countRegistrations()
+	if err != nil {
+		apiLog.WithFields(log.Fields{"error": err.Error()}).Error("Could not count registrations")
+		WriteJsonResponse(w, http.StatusInternalServerError, jsonError("db_error"))
+		return
+	}
+	out, _ := json.Marshal(struct {
+		Registrations    int    `json:"registrations"`
+		MaxRegistrations int    `json:"max_registrations"`
+		Refused          uint64 `json:"refused"`
+	}{total, Config.API.MaxRegistrations, atomic.LoadUint64(&registrationsRefused)})
+	WriteJsonResponse(w, http.StatusOK, out)
+}
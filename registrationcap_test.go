@@ -0,0 +1,50 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+func TestRegistrationCap(t *testing.T) {
+	_ = setupRouter(false, false)
+	api := httprouter.New()
+	api.POST("/register", webRegisterPost)
+	api.GET("/admin/capacity", AuthForAdmin(webAdminCapacity))
+	server := httptest.NewServer(api)
+	defer server.Close()
+	e := getExpect(t, server)
+	if err := DB.CreateAdmin("capacity", "hunter2"); err != nil {
+		t.Fatalf("Could not create admin user [%v]", err)
+	}
+
+	total, err := countRegistrations()
+	if err != nil {
+		t.Fatalf("Could not count registrations: %v", err)
+	}
+	Config.API.MaxRegistrations = total + 1
+	defer func() { Config.API.MaxRegistrations = 0 }()
+
+	e.POST("/register").Expect().Status(http.StatusCreated)
+	e.POST("/register").Expect().
+		Status(http.StatusServiceUnavailable).
+		JSON().Object().
+		ValueEqual("error", "registration_limit_reached")
+	if count, _ := countRegistrations(); count != total+1 {
+		t.Errorf("Expected %d registrations, got %d", total+1, count)
+	}
+
+	report := e.GET("/admin/capacity").
+		WithBasicAuth("capacity", "hunter2").
+		Expect().
+		Status(http.StatusOK).
+		JSON().Object()
+	report.ValueEqual("registrations", total+1)
+	report.ValueEqual("max_registrations", total+1)
+	report.Value("refused").Number().Ge(1)
+
+	Config.API.MaxRegistrations = 0
+	e.POST("/register").Expect().Status(http.StatusCreated)
+}
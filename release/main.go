@@ -0,0 +1,143 @@
+// Command release builds the acme-dns binaries of a release for each target
+// platform, statically linked and stamped with the version, along with their
+// SHA-256 checksums. Run it from the repository root:
+//
+//	go run ./release -version v1.2.3
+//
+// The builds are reproducible: the same source, version and Go toolchain give
+// the same binaries on any host.
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// defaultTargets are the platforms released by default
+const defaultTargets = "linux/amd64,linux/arm64,freebsd/amd64"
+
+// target is a platform to build for
+type target struct {
+	OS   string
+	Arch string
+}
+
+func (t target) String() string {
+	return t.OS + "/" + t.Arch
+}
+
+// parseTargets parses a comma separated list of os/arch platforms
+func parseTargets(list string) ([]target, error) {
+	var targets []target
+	for _, s := range strings.Split(list, ",") {
+		parts := strings.Split(strings.TrimSpace(s), "/")
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("invalid target %q, must be os/arch", s)
+		}
+		targets = append(targets, target{parts[0], parts[1]})
+	}
+	return targets, nil
+}
+
+// buildArgs returns the arguments of go build for a reproducible, statically
+// linked binary stamped with the version. The SQLite driver needs cgo, and is
+// linked statically against the C library when cgo is enabled.
+func buildArgs(version string, output string, cgo bool) []string {
+	ldflags := "-s -w -buildid= -X main.version=" + version
+	tags := "netgo,osusergo"
+	if cgo {
+		ldflags += ` -linkmode external -extldflags "-static"`
+		tags += ",sqlite_omit_load_extension"
+	}
+	return []string{"build", "-trimpath", "-buildvcs=false", "-mod=readonly", "-tags", tags, "-ldflags", ldflags, "-o", output, "."}
+}
+
+// buildEnv returns the environment of go build for the target. With cgo the C
+// compiler of the target is taken from CC_<os>_<arch>, eg. CC_linux_arm64.
+func buildEnv(t target, cgo bool) []string {
+	env := append(os.Environ(), "GOOS="+t.OS, "GOARCH="+t.Arch, "GOFLAGS=")
+	if !cgo {
+		return append(env, "CGO_ENABLED=0")
+	}
+	env = append(env, "CGO_ENABLED=1")
+	if cc := os.Getenv("CC_" + t.OS + "_" + t.Arch); cc != "" {
+		env = append(env, "CC="+cc)
+	}
+	return env
+}
+
+// gitVersion describes the checked out commit, used when no version is given
+func gitVersion() string {
+	out, err := exec.Command("git", "describe", "--tags", "--always", "--dirty").Output()
+	if err != nil {
+		return "dev"
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// sha256File returns the hex encoded SHA-256 checksum of the file
+func sha256File(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err = io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func main() {
+	version := flag.String("version", "", "version stamped in the binaries, git describe by default")
+	targetList := flag.String("targets", defaultTargets, "comma separated os/arch platforms to build for")
+	outDir := flag.String("out", "dist", "directory the binaries and checksums are written to")
+	cgo := flag.Bool("cgo", false, "build with cgo for the SQLite backend, with the C compiler of each target in CC_<os>_<arch>")
+	flag.Parse()
+	if *version == "" {
+		*version = gitVersion()
+	}
+	targets, err := parseTargets(*targetList)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	if err = os.MkdirAll(*outDir, 0o755); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	var sums []string
+	for _, t := range targets {
+		name := fmt.Sprintf("acme-dns_%s_%s_%s", *version, t.OS, t.Arch)
+		output := filepath.Join(*outDir, name)
+		cmd := exec.Command("go", buildArgs(*version, output, *cgo)...)
+		cmd.Env = buildEnv(t, *cgo)
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		fmt.Printf("Building %s for %s\n", *version, t)
+		if err = cmd.Run(); err != nil {
+			fmt.Fprintf(os.Stderr, "Build for %s failed: %v\n", t, err)
+			os.Exit(1)
+		}
+		sum, err := sha256File(output)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		sums = append(sums, sum+"  "+name)
+	}
+	checksums := filepath.Join(*outDir, "acme-dns_"+*version+"_SHA256SUMS")
+	if err = os.WriteFile(checksums, []byte(strings.Join(sums, "\n")+"\n"), 0o644); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	fmt.Printf("Wrote the checksums to %s\n", checksums)
+}
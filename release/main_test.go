@@ -0,0 +1,33 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseTargets(t *testing.T) {
+	targets, err := parseTargets("linux/amd64, freebsd/arm64")
+	if err != nil || len(targets) != 2 || targets[1] != (target{"freebsd", "arm64"}) {
+		t.Errorf("Unexpected targets %v, error %v", targets, err)
+	}
+	for _, list := range []string{"linux", "linux/", "linux/amd64/v2", "linux/amd64,"} {
+		if _, err := parseTargets(list); err == nil {
+			t.Errorf("Expected an error for %q", list)
+		}
+	}
+}
+
+func TestBuildArgs(t *testing.T) {
+	args := strings.Join(buildArgs("v1.2.3", "dist/acme-dns", false), " ")
+	for _, want := range []string{"-trimpath", "-X main.version=v1.2.3", "-buildid=", "-o dist/acme-dns"} {
+		if !strings.Contains(args, want) {
+			t.Errorf("Expected %q in the build arguments %s", want, args)
+		}
+	}
+	if strings.Contains(args, "-linkmode external") {
+		t.Errorf("Expected the internal linker without cgo, got %s", args)
+	}
+	if args = strings.Join(buildArgs("v1.2.3", "dist/acme-dns", true), " "); !strings.Contains(args, `-extldflags "-static"`) {
+		t.Errorf("Expected static external linking with cgo, got %s", args)
+	}
+}
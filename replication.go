@@ -0,0 +1,419 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+)
+
+// changeTable is the table the triggers of the SQLite primary record the changed
+// rows in, until they are copied to the replica
+var changeTable = `
+	CREATE TABLE IF NOT EXISTS replication_changes(
+		Seq INTEGER PRIMARY KEY AUTOINCREMENT,
+		TableName TEXT NOT NULL,
+		RowKey TEXT NOT NULL
+	);`
+
+// captureSetting names the setting of the primary identifying its change table,
+// and positionSetting the one of the replica with the latest change it has
+const (
+	captureSetting  = "replication_capture"
+	positionSetting = "replication_position"
+)
+
+// replicatedTables are the tables copied to the replica, with the column of the
+// rows changed together. The state of the primary instance, like its leases and
+// audit trail, isn't replicated.
+var replicatedTables = []struct {
+	name string
+	key  string
+}{
+	{"admins", "Username"},
+	{"records", "Subdomain"},
+	{"txt", "Subdomain"},
+	{"a", "Subdomain"},
+	{"aaaa", "Subdomain"},
+	{"cname", "Subdomain"},
+	{"mx", "Subdomain"},
+	{"srv", "Subdomain"},
+	{"caa", "Subdomain"},
+	{"rr", "Subdomain"},
+	{"ttl", "Subdomain"},
+}
+
+// enableChangeCapture creates the change table and the triggers filling it on the
+// SQLite database, returning the ID of the change table. A new ID is created along
+// with the table, so that a replica synced from an earlier change table is copied
+// over in full.
+func enableChangeCapture(d *acmedb) (string, error) {
+	var exists int
+	if err := d.DB.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type='table' AND name='replication_changes'").Scan(&exists); err != nil {
+		return "", err
+	}
+	id, found, err := d.GetSetting(captureSetting)
+	if err != nil {
+		return "", err
+	}
+	if exists == 0 || !found || id == "" {
+		id = uuid.New().String()
+	}
+	tx, err := d.DB.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+	statements := []string{changeTable}
+	for _, t := range replicatedTables {
+		statements = append(statements,
+			fmt.Sprintf("CREATE TRIGGER IF NOT EXISTS replicate_%[1]s_insert AFTER INSERT ON %[1]s BEGIN INSERT INTO replication_changes (TableName, RowKey) VALUES ('%[1]s', NEW.%[2]s); END", t.name, t.key),
+			fmt.Sprintf("CREATE TRIGGER IF NOT EXISTS replicate_%[1]s_update AFTER UPDATE ON %[1]s BEGIN INSERT INTO replication_changes (TableName, RowKey) VALUES ('%[1]s', OLD.%[2]s); INSERT INTO replication_changes (TableName, RowKey) SELECT '%[1]s', NEW.%[2]s WHERE NEW.%[2]s IS NOT OLD.%[2]s; END", t.name, t.key),
+			fmt.Sprintf("CREATE TRIGGER IF NOT EXISTS replicate_%[1]s_delete AFTER DELETE ON %[1]s BEGIN INSERT INTO replication_changes (TableName, RowKey) VALUES ('%[1]s', OLD.%[2]s); END", t.name, t.key),
+		)
+	}
+	for _, statement := range statements {
+		if _, err = tx.Exec(statement); err != nil {
+			return "", err
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		return "", err
+	}
+	return id, d.SetSetting(captureSetting, id)
+}
+
+// disableChangeCapture drops the triggers and the change table, so that the
+// changes don't pile up once replication is disabled
+func disableChangeCapture(d *acmedb) error {
+	tx, err := d.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, t := range replicatedTables {
+		for _, op := range []string{"insert", "update", "delete"} {
+			if _, err = tx.Exec(fmt.Sprintf("DROP TRIGGER IF EXISTS replicate_%s_%s", t.name, op)); err != nil {
+				return err
+			}
+		}
+	}
+	if _, err = tx.Exec("DROP TABLE IF EXISTS replication_changes"); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// replicator copies the changes of the SQLite primary to the PostgreSQL replica
+// additional instances serve DNS from. The rows changed since the latest sync are
+// replaced on the replica in a single transaction along with the position in the
+// change table, so that an interrupted sync is simply repeated.
+type replicator struct {
+	source   *acmedb
+	replica  *acmedb
+	capture  string
+	interval time.Duration
+	batch    int
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+// newReplicator returns the replicator of the source database to the replica,
+// enabling the change capture of the source
+func newReplicator(source *acmedb, replica *acmedb, conf replication) (*replicator, error) {
+	capture, err := enableChangeCapture(source)
+	if err != nil {
+		return nil, err
+	}
+	return &replicator{
+		source:   source,
+		replica:  replica,
+		capture:  capture,
+		interval: time.Duration(conf.Interval) * time.Second,
+		batch:    conf.BatchSize,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}, nil
+}
+
+// Run syncs the replica until stopped
+func (r *replicator) Run() {
+	defer close(r.done)
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+	for {
+		if err := r.Sync(); err != nil {
+			dbLog.WithFields(log.Fields{"error": err.Error()}).Error("Could not sync the replica")
+		}
+		select {
+		case <-ticker.C:
+		case <-r.stop:
+			return
+		}
+	}
+}
+
+// Stop ends the sync loop, waiting for a running sync to finish
+func (r *replicator) Stop() {
+	close(r.stop)
+	<-r.done
+}
+
+// Sync copies the pending changes to the replica, or all the replicated tables if
+// the replica wasn't synced from the current change table yet
+func (r *replicator) Sync() error {
+	position, err := r.position()
+	if err != nil {
+		return err
+	}
+	if position < 0 {
+		if position, err = r.copyAll(); err != nil {
+			return err
+		}
+		dbLog.WithFields(log.Fields{"position": position}).Info("Copied the database to the replica")
+	}
+	for {
+		next, count, err := r.copyChanges(position)
+		if err != nil {
+			return err
+		}
+		if count > 0 {
+			dbLog.WithFields(log.Fields{"changes": count, "position": next}).Debug("Synced the replica")
+		}
+		position = next
+		if count < r.batch {
+			break
+		}
+	}
+	// The changes up to the position are on the replica now
+	_, err = r.source.DB.Exec("DELETE FROM replication_changes WHERE Seq <= ?", position)
+	return err
+}
+
+// position returns the latest change the replica has, or -1 if it has none of the
+// current change table
+func (r *replicator) position() (int64, error) {
+	value, found, err := r.replica.GetSetting(positionSetting)
+	if err != nil || !found {
+		return -1, err
+	}
+	capture, seq, ok := strings.Cut(value, ":")
+	if !ok || capture != r.capture {
+		return -1, nil
+	}
+	position, err := strconv.ParseInt(seq, 10, 64)
+	if err != nil {
+		return -1, nil
+	}
+	return position, nil
+}
+
+// copyAll replaces the replicated tables of the replica with the ones of the
+// source, returning the position the replica is synced to. Changes made during
+// the copy are copied again by the next sync.
+func (r *replicator) copyAll() (int64, error) {
+	var position int64
+	if err := r.source.DB.QueryRow("SELECT COALESCE(MAX(Seq), 0) FROM replication_changes").Scan(&position); err != nil {
+		return 0, err
+	}
+	tx, err := r.replica.DB.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	for _, t := range replicatedTables {
+		if _, err = tx.Exec("DELETE FROM " + t.name); err != nil {
+			return 0, err
+		}
+		if err = r.copyRows(tx, t.name, "", ""); err != nil {
+			return 0, err
+		}
+	}
+	if err = r.setPosition(tx, position); err != nil {
+		return 0, err
+	}
+	return position, tx.Commit()
+}
+
+// copyChanges copies the rows of a batch of the changes after the position,
+// returning the position of the latest change copied and the number of changes
+func (r *replicator) copyChanges(position int64) (int64, int, error) {
+	rows, err := r.source.DB.Query("SELECT Seq, TableName, RowKey FROM replication_changes WHERE Seq > ? ORDER BY Seq LIMIT ?", position, r.batch)
+	if err != nil {
+		return position, 0, err
+	}
+	type changed struct {
+		table string
+		key   string
+	}
+	var order []changed
+	seen := make(map[changed]bool)
+	count := 0
+	for rows.Next() {
+		var c changed
+		if err = rows.Scan(&position, &c.table, &c.key); err != nil {
+			rows.Close()
+			return position, 0, err
+		}
+		count++
+		if !seen[c] {
+			seen[c] = true
+			order = append(order, c)
+		}
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil || count == 0 {
+		return position, count, err
+	}
+	keys := make(map[string]string)
+	for _, t := range replicatedTables {
+		keys[t.name] = t.key
+	}
+	tx, err := r.replica.DB.Begin()
+	if err != nil {
+		return position, 0, err
+	}
+	defer tx.Rollback()
+	for _, c := range order {
+		key, ok := keys[c.table]
+		if !ok {
+			continue
+		}
+		if _, err = tx.Exec(r.replica.stmt(fmt.Sprintf("DELETE FROM %s WHERE %s=$1", c.table, key)), c.key); err != nil {
+			return position, 0, err
+		}
+		if err = r.copyRows(tx, c.table, key, c.key); err != nil {
+			return position, 0, err
+		}
+	}
+	if err = r.setPosition(tx, position); err != nil {
+		return position, 0, err
+	}
+	return position, count, tx.Commit()
+}
+
+// copyRows inserts the rows of the source table into the replica, all of them or
+// the ones with the value in the key column. The columns both databases have are
+// copied: SQLite keeps the columns dropped by migrations on PostgreSQL, and the
+// rowid of PostgreSQL is numbered by the replica.
+func (r *replicator) copyRows(tx *sql.Tx, table string, key string, value string) error {
+	columns, err := r.sharedColumns(tx, table)
+	if err != nil {
+		return err
+	}
+	query := fmt.Sprintf("SELECT %s FROM %s", strings.Join(columns, ", "), table)
+	var args []interface{}
+	if key != "" {
+		query += fmt.Sprintf(" WHERE %s=?", key)
+		args = append(args, value)
+	}
+	rows, err := r.source.DB.Query(query+" ORDER BY rowid", args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	placeholders := make([]string, len(columns))
+	for i := range placeholders {
+		placeholders[i] = "$" + strconv.Itoa(i+1)
+	}
+	insert := r.replica.stmt(fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s)", table, strings.Join(columns, ", "), strings.Join(placeholders, ", ")))
+	values := make([]interface{}, len(columns))
+	pointers := make([]interface{}, len(columns))
+	for i := range values {
+		pointers[i] = &values[i]
+	}
+	for rows.Next() {
+		if err = rows.Scan(pointers...); err != nil {
+			return err
+		}
+		if _, err = tx.Exec(insert, values...); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// sharedColumns returns the columns of the table in both the source and the replica
+func (r *replicator) sharedColumns(tx *sql.Tx, table string) ([]string, error) {
+	source, err := tableColumns(r.source.DB.Query, table)
+	if err != nil {
+		return nil, err
+	}
+	replica, err := tableColumns(tx.Query, table)
+	if err != nil {
+		return nil, err
+	}
+	onReplica := make(map[string]bool)
+	for _, c := range replica {
+		onReplica[strings.ToLower(c)] = true
+	}
+	var shared []string
+	for _, c := range source {
+		if onReplica[strings.ToLower(c)] && !strings.EqualFold(c, "rowid") {
+			shared = append(shared, c)
+		}
+	}
+	if len(shared) == 0 {
+		return nil, fmt.Errorf("the %s table of the replica has none of the columns of the source", table)
+	}
+	return shared, nil
+}
+
+// tableColumns returns the column names of the table with the query function
+func tableColumns(query func(string, ...interface{}) (*sql.Rows, error), table string) ([]string, error) {
+	rows, err := query(fmt.Sprintf("SELECT * FROM %s WHERE 1=0", table))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return rows.Columns()
+}
+
+// setPosition stores the position of the replica within its transaction
+func (r *replicator) setPosition(tx *sql.Tx, position int64) error {
+	value := fmt.Sprintf("%s:%d", r.capture, position)
+	res, err := tx.Exec(r.replica.stmt("UPDATE acmedns SET Value=$1 WHERE Name=$2"), value, positionSetting)
+	if err != nil {
+		return err
+	}
+	if affected, err := res.RowsAffected(); err != nil || affected > 0 {
+		return err
+	}
+	_, err = tx.Exec(r.replica.stmt("INSERT INTO acmedns (Name, Value) values($1, $2)"), positionSetting, value)
+	return err
+}
+
+// startReplication enables the change capture of the SQLite database and starts
+// syncing it to the configured replica, or drops the change capture if replication
+// is disabled. The returned function stops the replication.
+func startReplication(db database, conf replication) (func(), error) {
+	source, ok := db.(*acmedb)
+	if !ok || source.engine != "sqlite3" {
+		if conf.Replica != "" {
+			return nil, fmt.Errorf("replication needs the sqlite3 database engine")
+		}
+		return func() {}, nil
+	}
+	if conf.Replica == "" {
+		return func() {}, disableChangeCapture(source)
+	}
+	replica := new(acmedb)
+	if err := replica.Init("postgres", conf.Replica); err != nil {
+		return nil, fmt.Errorf("could not open the replica: %v", err)
+	}
+	r, err := newReplicator(source, replica, conf)
+	if err != nil {
+		replica.Close()
+		return nil, err
+	}
+	dbLog.WithFields(log.Fields{"interval": r.interval.String()}).Info("Replicating the database to PostgreSQL")
+	go r.Run()
+	return func() {
+		r.Stop()
+		replica.Close()
+	}, nil
+}
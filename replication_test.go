@@ -0,0 +1,104 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func openTestSQLite(t *testing.T, name string) *acmedb {
+	db, err := openBackend("sqlite3", filepath.Join(t.TempDir(), name))
+	if err != nil {
+		t.Fatalf("Could not open the %s database: %v", name, err)
+	}
+	t.Cleanup(db.Close)
+	return db.(*acmedb)
+}
+
+func countRows(t *testing.T, d *acmedb, query string, args ...interface{}) int {
+	var count int
+	if err := d.DB.QueryRow(query, args...).Scan(&count); err != nil {
+		t.Fatalf("Could not count the rows: %v", err)
+	}
+	return count
+}
+
+func TestReplication(t *testing.T) {
+	source := openTestSQLite(t, "source.db")
+	replica := openTestSQLite(t, "replica.db")
+	value := "LHDhK3oGRvkiefQnx7OOczTY5Tic_xZ6HcMOc_gmtoM"
+
+	// Registered before replication is enabled, copied with the initial full copy
+	before, err := source.Register(cidrslice{}, registrationOrigin{}, ACMETxtPost{})
+	if err != nil {
+		t.Fatalf("Could not register: %v", err)
+	}
+	r, err := newReplicator(source, replica, replication{Interval: 1, BatchSize: 2})
+	if err != nil {
+		t.Fatalf("Could not start the replication: %v", err)
+	}
+	if err = r.Sync(); err != nil {
+		t.Fatalf("Could not sync: %v", err)
+	}
+	if count := countRows(t, replica, "SELECT COUNT(*) FROM records WHERE Subdomain=?", before.Subdomain); count != 1 {
+		t.Errorf("Expected the registration to be copied to the replica, got %d rows", count)
+	}
+
+	after, _ := source.Register(cidrslice{}, registrationOrigin{}, ACMETxtPost{})
+	if _, err = source.Update(ACMETxtPost{Subdomain: after.Subdomain, Value: value}); err != nil {
+		t.Fatalf("Could not update: %v", err)
+	}
+	if err = source.DeleteRegistration(before.Username); err != nil {
+		t.Fatalf("Could not deregister: %v", err)
+	}
+	// More changes than fit in a batch
+	if err = r.Sync(); err != nil {
+		t.Fatalf("Could not sync: %v", err)
+	}
+	if count := countRows(t, replica, "SELECT COUNT(*) FROM records WHERE Subdomain=?", before.Subdomain); count != 0 {
+		t.Errorf("Expected the deregistration to be replicated, got %d rows", count)
+	}
+	if count := countRows(t, replica, "SELECT COUNT(*) FROM txt WHERE Subdomain=? AND Value=?", after.Subdomain, value); count != 1 {
+		t.Errorf("Expected the TXT update to be replicated, got %d rows", count)
+	}
+	if count := countRows(t, replica, "SELECT COUNT(*) FROM txt WHERE Subdomain=?", after.Subdomain); count != countRows(t, source, "SELECT COUNT(*) FROM txt WHERE Subdomain=?", after.Subdomain) {
+		t.Errorf("Expected the replica to have the TXT slots of the source, got %d", count)
+	}
+	if count := countRows(t, source, "SELECT COUNT(*) FROM replication_changes"); count != 0 {
+		t.Errorf("Expected the synced changes to be removed, %d left", count)
+	}
+}
+
+func TestReplicationNewChangeTable(t *testing.T) {
+	source := openTestSQLite(t, "source.db")
+	replica := openTestSQLite(t, "replica.db")
+	r, err := newReplicator(source, replica, replication{Interval: 1, BatchSize: 10})
+	if err != nil {
+		t.Fatalf("Could not start the replication: %v", err)
+	}
+	if err = r.Sync(); err != nil {
+		t.Fatalf("Could not sync: %v", err)
+	}
+
+	// Changes made while replication is disabled aren't captured, the replica has
+	// to be copied over in full again
+	if err = disableChangeCapture(source); err != nil {
+		t.Fatalf("Could not disable the change capture: %v", err)
+	}
+	reg, _ := source.Register(cidrslice{}, registrationOrigin{}, ACMETxtPost{})
+	if count := countRows(t, source, "SELECT COUNT(*) FROM sqlite_master WHERE name='replicate_records_insert'"); count != 0 {
+		t.Errorf("Expected the triggers to be dropped")
+	}
+	r, err = newReplicator(source, replica, replication{Interval: 1, BatchSize: 10})
+	if err != nil {
+		t.Fatalf("Could not restart the replication: %v", err)
+	}
+	if position, _ := r.position(); position != -1 {
+		t.Errorf("Expected the replica to need a full copy, got position %d", position)
+	}
+	if err = r.Sync(); err != nil {
+		t.Fatalf("Could not sync: %v", err)
+	}
+	if count := countRows(t, replica, "SELECT COUNT(*) FROM records WHERE Subdomain=?", reg.Subdomain); count != 1 {
+		t.Errorf("Expected the registration to be copied in full, got %d rows", count)
+	}
+}
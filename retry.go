@@ -0,0 +1,68 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/lib/pq"
+	log "github.com/sirupsen/logrus"
+)
+
+// errDatabaseBusy is returned when a write still conflicts with concurrent
+// transactions after all the retry attempts.
+var errDatabaseBusy = errors.New("database is busy, please try again later")
+
+// retryBaseDelay is the backoff before the first retry, doubled for every following one
+var retryBaseDelay = 20 * time.Millisecond
+
+// retrySleep waits between the attempts, replaced in tests
+var retrySleep = time.Sleep
+
+// sqlQueryer is satisfied by both *sql.DB and *sql.Tx
+type sqlQueryer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// isRetryableError checks if the error is a transient PostgreSQL conflict, which
+// goes away when the transaction is run again.
+func isRetryableError(err error) bool {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		switch pqErr.Code {
+		case "40001", // serialization_failure
+			"40P01": // deadlock_detected
+			return true
+		}
+	}
+	return false
+}
+
+// retryAttempts returns the number of times a conflicting write is attempted
+func retryAttempts() int {
+	if Config.Database.RetryAttempts > 0 {
+		return Config.Database.RetryAttempts
+	}
+	return 3
+}
+
+// retry runs op until it succeeds, fails with a non retryable error, or the
+// attempts run out, backing off exponentially between the attempts.
+func (d *acmedb) retry(operation string, op func() error) error {
+	delay := retryBaseDelay
+	attempts := retryAttempts()
+	for attempt := 1; ; attempt++ {
+		err := op()
+		if err == nil || !isRetryableError(err) {
+			return err
+		}
+		if attempt >= attempts {
+			dbLog.WithFields(log.Fields{"error": err.Error(), "operation": operation, "attempts": attempt}).Error("Database conflict persisted, giving up")
+			return errDatabaseBusy
+		}
+		dbLog.WithFields(log.Fields{"error": err.Error(), "operation": operation, "attempt": attempt}).Debug("Database conflict, retrying")
+		retrySleep(delay)
+		delay *= 2
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/lib/pq"
+)
+
+// withRecordedSleeps replaces the retry backoff with a recorder for the duration of the test
+func withRecordedSleeps(t *testing.T) *[]time.Duration {
+	var sleeps []time.Duration
+	oldSleep := retrySleep
+	retrySleep = func(d time.Duration) { sleeps = append(sleeps, d) }
+	t.Cleanup(func() { retrySleep = oldSleep })
+	return &sleeps
+}
+
+func TestIsRetryableError(t *testing.T) {
+	for i, test := range []struct {
+		err       error
+		retryable bool
+	}{
+		{&pq.Error{Code: "40001"}, true},
+		{&pq.Error{Code: "40P01"}, true},
+		{fmt.Errorf("wrapped: %w", &pq.Error{Code: "40001"}), true},
+		{&pq.Error{Code: "23505"}, false},
+		{errors.New("serialization failure"), false},
+		{nil, false},
+	} {
+		if isRetryableError(test.err) != test.retryable {
+			t.Errorf("Test %d: Expected retryable to be %t for [%v]", i, test.retryable, test.err)
+		}
+	}
+}
+
+func TestRetry(t *testing.T) {
+	sleeps := withRecordedSleeps(t)
+	adb := DB.(*acmedb)
+
+	calls := 0
+	err := adb.retry("test", func() error {
+		calls++
+		if calls < 3 {
+			return &pq.Error{Code: "40001"}
+		}
+		return nil
+	})
+	if err != nil || calls != 3 {
+		t.Errorf("Expected success on the third attempt, got %d calls [%v]", calls, err)
+	}
+	if len(*sleeps) != 2 || (*sleeps)[1] != 2*(*sleeps)[0] {
+		t.Errorf("Expected exponential backoff between the attempts, got %v", *sleeps)
+	}
+
+	calls = 0
+	err = adb.retry("test", func() error {
+		calls++
+		return &pq.Error{Code: "40P01"}
+	})
+	if err != errDatabaseBusy || calls != retryAttempts() {
+		t.Errorf("Expected errDatabaseBusy after %d attempts, got %d calls [%v]", retryAttempts(), calls, err)
+	}
+
+	calls = 0
+	err = adb.retry("test", func() error {
+		calls++
+		return errors.New("permanent")
+	})
+	if err == nil || err == errDatabaseBusy || calls != 1 {
+		t.Errorf("Expected other errors to be returned without retrying, got %d calls [%v]", calls, err)
+	}
+}
+
+func TestUpdateRetriesSerializationFailure(t *testing.T) {
+	withRecordedSleeps(t)
+	adb := DB.(*acmedb)
+	oldDb := adb.GetBackend()
+	db, mock, _ := sqlmock.New()
+	adb.SetBackend(db)
+	defer adb.SetBackend(oldDb)
+	defer db.Close()
+
+	post := ACMETxtPost{Subdomain: "a097455b-52cc-4569-90c8-7a4b97c6eba8", Value: "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa", Slot: intPtr(0)}
+	mock.ExpectBegin()
+	mock.ExpectExec("UPDATE txt").WillReturnError(&pq.Error{Code: "40001"})
+	mock.ExpectRollback()
+	mock.ExpectBegin()
+	mock.ExpectExec("UPDATE txt").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("DELETE FROM ttl").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectCommit()
+	if _, err := adb.Update(post); err != nil {
+		t.Errorf("Expected update to succeed after a retry, got error [%v]", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unmet database expectations [%v]", err)
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// middleware wraps an API handler, for example to authenticate the request
+// before passing it on
+type middleware func(httprouter.Handle) httprouter.Handle
+
+// RouteKey is a context key for the route of the request, eg. "POST /update"
+const RouteKey key = 2
+
+// apiRouter routes the API requests with httprouter, running the handlers behind
+// chains of middleware. Groups of routes share a path prefix and the middleware
+// of the group.
+type apiRouter struct {
+	router *httprouter.Router
+	prefix string
+	chain  []middleware
+}
+
+// newRouter returns an API router answering requests with a method the path
+// doesn't support with a JSON 405 response
+func newRouter() *apiRouter {
+	router := httprouter.New()
+	router.HandleMethodNotAllowed = true
+	// httprouter sets the Allow header before calling the handler
+	router.MethodNotAllowed = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		WriteJsonResponse(w, http.StatusMethodNotAllowed, jsonError("method_not_allowed"))
+	})
+	return &apiRouter{router: router}
+}
+
+// Use adds middleware to the chain of the routes added after it
+func (a *apiRouter) Use(m ...middleware) {
+	a.chain = append(a.chain, m...)
+}
+
+// Group returns a group of routes under the path prefix, running the middleware
+// after the middleware of this router
+func (a *apiRouter) Group(prefix string, m ...middleware) *apiRouter {
+	chain := make([]middleware, 0, len(a.chain)+len(m))
+	chain = append(chain, a.chain...)
+	chain = append(chain, m...)
+	return &apiRouter{router: a.router, prefix: a.prefix + strings.TrimSuffix(prefix, "/"), chain: chain}
+}
+
+// Handle adds the route with the middleware of the router, followed by the
+// middleware of the route. The first middleware of the chain runs first.
+func (a *apiRouter) Handle(method string, path string, handler httprouter.Handle, m ...middleware) {
+	for i := len(m) - 1; i >= 0; i-- {
+		handler = m[i](handler)
+	}
+	for i := len(a.chain) - 1; i >= 0; i-- {
+		handler = a.chain[i](handler)
+	}
+	route := method + " " + a.prefix + path
+	a.router.Handle(method, a.prefix+path, func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		handler(w, r.WithContext(context.WithValue(r.Context(), RouteKey, route)), p)
+	})
+}
+
+// GET adds a route for GET requests
+func (a *apiRouter) GET(path string, handler httprouter.Handle, m ...middleware) {
+	a.Handle(http.MethodGet, path, handler, m...)
+}
+
+// POST adds a route for POST requests
+func (a *apiRouter) POST(path string, handler httprouter.Handle, m ...middleware) {
+	a.Handle(http.MethodPost, path, handler, m...)
+}
+
+// PATCH adds a route for PATCH requests
+func (a *apiRouter) PATCH(path string, handler httprouter.Handle, m ...middleware) {
+	a.Handle(http.MethodPatch, path, handler, m...)
+}
+
+// DELETE adds a route for DELETE requests
+func (a *apiRouter) DELETE(path string, handler httprouter.Handle, m ...middleware) {
+	a.Handle(http.MethodDelete, path, handler, m...)
+}
+
+// ServeHTTP routes the request to its handler
+func (a *apiRouter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	a.router.ServeHTTP(w, r)
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+func TestRouterMiddlewareOrder(t *testing.T) {
+	var calls []string
+	tag := func(name string) middleware {
+		return func(next httprouter.Handle) httprouter.Handle {
+			return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+				calls = append(calls, name)
+				next(w, r, p)
+			}
+		}
+	}
+	api := newRouter()
+	api.Use(tag("router"))
+	group := api.Group("/v2/", tag("group"))
+	group.GET("/items/:id", func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		calls = append(calls, "handler "+p.ByName("id"))
+	}, tag("route"))
+
+	api.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/v2/items/42", nil))
+	if strings.Join(calls, ", ") != "router, group, route, handler 42" {
+		t.Errorf("Unexpected middleware order %v", calls)
+	}
+}
+
+func TestRouterMethodNotAllowed(t *testing.T) {
+	api := newRouter()
+	handler := func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {}
+	api.GET("/txt", handler)
+	api.PATCH("/txt", handler)
+
+	w := httptest.NewRecorder()
+	api.ServeHTTP(w, httptest.NewRequest("DELETE", "/txt", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected status 405, got %d", w.Code)
+	}
+	if allow := w.Header().Get("Allow"); !strings.Contains(allow, "GET") || !strings.Contains(allow, "PATCH") {
+		t.Errorf("Expected the allowed methods in the Allow header, got %q", allow)
+	}
+	if w.Header().Get("Content-Type") != "application/json" || !strings.Contains(w.Body.String(), "method_not_allowed") {
+		t.Errorf("Expected a JSON error, got %q", w.Body.String())
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// Actions of the response rate limiter
+const (
+	rrlSend = iota
+	rrlSlip
+	rrlDrop
+)
+
+// responseRateLimiter limits the UDP responses sent to each client subnet, so that
+// the nameserver can't be used to reflect and amplify queries with spoofed source
+// addresses. Limited responses are dropped, every slip-th is sent truncated so
+// that genuine clients retry over TCP, and every leak-th is sent in full.
+type responseRateLimiter struct {
+	buckets *tokenBuckets
+	slip    uint64
+	leak    uint64
+	v4mask  net.IPMask
+	v6mask  net.IPMask
+	exempt  []*net.IPNet
+}
+
+// validateRRL checks the response rate limiting configuration and sets the defaults
+func validateRRL(conf *rrlConfig) error {
+	if conf.ResponsesPerSecond < 0 {
+		return fmt.Errorf("responses_per_second of response rate limiting can't be negative")
+	}
+	if conf.Burst <= 0 {
+		conf.Burst = conf.ResponsesPerSecond
+	}
+	if conf.IPv4Prefix == 0 {
+		conf.IPv4Prefix = 24
+	}
+	if conf.IPv6Prefix == 0 {
+		conf.IPv6Prefix = 56
+	}
+	if conf.IPv4Prefix < 1 || conf.IPv4Prefix > 32 || conf.IPv6Prefix < 1 || conf.IPv6Prefix > 128 {
+		return fmt.Errorf("the prefixes of response rate limiting must be between 1 and 32 for IPv4 and 1 and 128 for IPv6")
+	}
+	if conf.Slip < 0 || conf.Leak < 0 {
+		return fmt.Errorf("slip and leak of response rate limiting can't be negative")
+	}
+	_, err := parseExempt("response rate limiting", conf.Exempt)
+	return err
+}
+
+// newResponseRateLimiter returns the rate limiter of the validated configuration
+func newResponseRateLimiter(conf rrlConfig, c clock) *responseRateLimiter {
+	exempt, _ := parseExempt("response rate limiting", conf.Exempt)
+	return &responseRateLimiter{
+		buckets: newTokenBuckets(conf.ResponsesPerSecond, conf.Burst, c),
+		slip:    uint64(conf.Slip),
+		leak:    uint64(conf.Leak),
+		v4mask:  net.CIDRMask(conf.IPv4Prefix, 32),
+		v6mask:  net.CIDRMask(conf.IPv6Prefix, 128),
+		exempt:  exempt,
+	}
+}
+
+// Check returns whether the response to the client of w is sent, sent truncated
+// or dropped. Responses over TCP are always sent, as their clients can't spoof
+// their addresses.
+func (l *responseRateLimiter) Check(w dns.ResponseWriter) int {
+	if l == nil {
+		return rrlSend
+	}
+	addr, ok := w.RemoteAddr().(*net.UDPAddr)
+	if !ok {
+		return rrlSend
+	}
+	if exempted(l.exempt, addr.IP) {
+		return rrlSend
+	}
+	var key string
+	if ip4 := addr.IP.To4(); ip4 != nil {
+		key = ip4.Mask(l.v4mask).String()
+	} else {
+		key = addr.IP.Mask(l.v6mask).String()
+	}
+	ok, limited := l.buckets.take(key)
+	switch {
+	case ok:
+		return rrlSend
+	case l.leak > 0 && limited%l.leak == 0:
+		return rrlSend
+	case l.slip > 0 && limited%l.slip == 0:
+		return rrlSlip
+	}
+	return rrlDrop
+}
+
+// slipResponse turns the response into an empty truncated one, which clients
+// retry over TCP
+func slipResponse(m *dns.Msg) {
+	clearRecords(m)
+	m.Truncated = true
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// addrWriter is a response writer with a remote address
+type addrWriter struct {
+	recordingWriter
+	remote net.Addr
+}
+
+func (w *addrWriter) RemoteAddr() net.Addr {
+	return w.remote
+}
+
+func udpClient(ip string) *addrWriter {
+	return &addrWriter{remote: &net.UDPAddr{IP: net.ParseIP(ip), Port: 5353}}
+}
+
+func TestValidateRRL(t *testing.T) {
+	for i, test := range []struct {
+		conf  rrlConfig
+		valid bool
+	}{
+		{rrlConfig{}, true},
+		{rrlConfig{ResponsesPerSecond: 5, Slip: 2, Exempt: []string{"10.0.0.0/8", "2001:db8::/32"}}, true},
+		{rrlConfig{ResponsesPerSecond: -1}, false},
+		{rrlConfig{ResponsesPerSecond: 5, IPv4Prefix: 33}, false},
+		{rrlConfig{ResponsesPerSecond: 5, Slip: -1}, false},
+		{rrlConfig{ResponsesPerSecond: 5, Exempt: []string{"10.0.0.1"}}, false},
+	} {
+		conf := test.conf
+		err := validateRRL(&conf)
+		if test.valid != (err == nil) {
+			t.Errorf("Test %d: Expected valid to be %t, got %v", i, test.valid, err)
+		}
+		if err == nil && (conf.IPv4Prefix != 24 || conf.IPv6Prefix != 56 || conf.Burst != conf.ResponsesPerSecond) {
+			t.Errorf("Test %d: Expected the defaults to be set, got %+v", i, conf)
+		}
+	}
+}
+
+func TestResponseRateLimiter(t *testing.T) {
+	clk := newFrozenClock(time.Unix(1700000000, 0))
+	conf := rrlConfig{ResponsesPerSecond: 2, Burst: 3, Slip: 2, Leak: 5, Exempt: []string{"198.51.100.0/24"}}
+	if err := validateRRL(&conf); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	l := newResponseRateLimiter(conf, clk)
+
+	// The subnet shares the burst, then every second limited response slips and
+	// every fifth leaks
+	var actions []int
+	for i := 0; i < 3; i++ {
+		actions = append(actions, l.Check(udpClient("192.0.2.1")))
+	}
+	for i := 0; i < 5; i++ {
+		actions = append(actions, l.Check(udpClient("192.0.2.200")))
+	}
+	expected := []int{rrlSend, rrlSend, rrlSend, rrlDrop, rrlSlip, rrlDrop, rrlSlip, rrlSend}
+	for i := range expected {
+		if actions[i] != expected[i] {
+			t.Fatalf("Expected actions %v, got %v", expected, actions)
+		}
+	}
+	if action := l.Check(udpClient("192.0.3.1")); action != rrlSend {
+		t.Errorf("Expected other subnets to have their own limit, got %d", action)
+	}
+	if action := l.Check(&addrWriter{remote: &net.TCPAddr{IP: net.ParseIP("192.0.2.1")}}); action != rrlSend {
+		t.Errorf("Expected TCP responses to be sent, got %d", action)
+	}
+	for i := 0; i < 10; i++ {
+		if action := l.Check(udpClient("198.51.100.7")); action != rrlSend {
+			t.Fatalf("Expected the exempt network to be sent all responses, got %d", action)
+		}
+	}
+
+	// Tokens are refilled at the rate
+	clk.Advance(time.Second)
+	if l.Check(udpClient("192.0.2.1")) != rrlSend || l.Check(udpClient("192.0.2.1")) != rrlSend || l.Check(udpClient("192.0.2.1")) == rrlSend {
+		t.Errorf("Expected two responses to be sent after a second")
+	}
+
+	// Quiet subnets are forgotten
+	clk.Advance(rateLimitSweepInterval)
+	l.Check(udpClient("203.0.113.1"))
+	if len(l.buckets.buckets) != 1 {
+		t.Errorf("Expected the buckets of quiet subnets to be removed, got %d", len(l.buckets.buckets))
+	}
+}
+
+func TestRateLimitedResponses(t *testing.T) {
+	config := Config
+	config.General.Domain = "auth.example.org"
+	server := NewDNSServer(DB, "", "udp", config.General.Domain)
+	server.ParseRecords(config)
+	conf := rrlConfig{ResponsesPerSecond: 1, Slip: 2}
+	_ = validateRRL(&conf)
+	server.RRL = newResponseRateLimiter(conf, newFrozenClock(time.Unix(1700000000, 0)))
+	server.Stats = newDNSStatistics(nil)
+	req := new(dns.Msg)
+	req.SetQuestion("auth.example.org.", dns.TypeSOA)
+
+	var responses []*dns.Msg
+	for i := 0; i < 3; i++ {
+		w := udpClient("192.0.2.1")
+		w.local = &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53}
+		server.handleRequest(w, req)
+		responses = append(responses, w.msg)
+	}
+	if responses[0] == nil || len(responses[0].Answer) != 1 || responses[0].Truncated {
+		t.Errorf("Expected the first response to be sent, got %v", responses[0])
+	}
+	if responses[1] != nil {
+		t.Errorf("Expected the second response to be dropped, got %v", responses[1])
+	}
+	if responses[2] == nil || len(responses[2].Answer) != 0 || !responses[2].Truncated {
+		t.Errorf("Expected the third response to slip, got %v", responses[2])
+	}
+	counters := server.Stats.snapshot(statNS)
+	if counters["RateDropped"] != 1 || counters["RateSlipped"] != 1 {
+		t.Errorf("Expected a dropped and a slipped response to be counted, got %v", counters)
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"encoding/hex"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// genericRecord is a record of a type stored in the generic rr table, with the
+// record data in the zone file format
+type genericRecord struct {
+	Type    string `json:"type"`
+	Content string `json:"content"`
+	TTL     int    `json:"ttl,omitempty"`
+}
+
+// String returns the type and the record data
+func (g genericRecord) String() string {
+	return g.Type + " " + g.Content
+}
+
+// genericStrings returns the types and record data of the records
+func genericStrings(records []genericRecord) []string {
+	var values []string
+	for _, g := range records {
+		values = append(values, g.String())
+	}
+	return values
+}
+
+// rrValidator checks the parsed record of a generic type beyond its syntax,
+// returning the reason it's invalid or an empty string
+type rrValidator func(rr dns.RR) string
+
+// genericTypes are the record types stored in the generic rr table with their
+// validators. Supporting another type only needs an entry here.
+var genericTypes = map[string]rrValidator{
+	"TLSA":  validTLSA,
+	"SSHFP": validSSHFP,
+	"NAPTR": validNAPTR,
+}
+
+// genericTypeNames returns the names of the generic types in lowercase, the way
+// the record types are named in the API
+func genericTypeNames() []string {
+	var names []string
+	for t := range genericTypes {
+		names = append(names, strings.ToLower(t))
+	}
+	sort.Strings(names)
+	return names
+}
+
+// genericQtype returns the type of a question served from the rr table
+func genericQtype(qtype uint16) (string, bool) {
+	name := dns.TypeToString[qtype]
+	_, ok := genericTypes[name]
+	return name, ok
+}
+
+// parseGenericRecord parses and validates the record data of the type, returning
+// the record data in its canonical presentation or the reason it's invalid
+func parseGenericRecord(rtype string, content string) (string, string) {
+	validator, ok := genericTypes[rtype]
+	if !ok {
+		return "", "must be one of " + strings.Join(genericTypeNames(), ", ")
+	}
+	if strings.ContainsAny(content, "\n\r") {
+		return "", "not valid " + rtype + " record data"
+	}
+	rr, err := dns.NewRR(". 1 IN " + rtype + " " + content)
+	if err != nil || rr == nil {
+		return "", "not valid " + rtype + " record data"
+	}
+	if message := validator(rr); message != "" {
+		return "", message
+	}
+	return rrData(rr), ""
+}
+
+// newGenericRR returns the resource record of the stored record with the name
+func newGenericRR(name string, g genericRecord) (dns.RR, error) {
+	ttl := g.TTL
+	if ttl <= 0 {
+		ttl = minTTL()
+	}
+	return dns.NewRR(name + " " + strconv.Itoa(ttl) + " IN " + g.Type + " " + g.Content)
+}
+
+// changedGenericTypes returns the generic types the update replaces or clears
+func changedGenericTypes(a ACMETxtPost) []string {
+	seen := make(map[string]bool)
+	var types []string
+	for _, g := range a.Records {
+		if !seen[g.Type] {
+			seen[g.Type] = true
+			types = append(types, g.Type)
+		}
+	}
+	for _, t := range a.ClearRecords {
+		if !seen[t] {
+			seen[t] = true
+			types = append(types, t)
+		}
+	}
+	return types
+}
+
+// rrData returns the record data of the resource record in the zone file format
+func rrData(rr dns.RR) string {
+	return strings.TrimPrefix(rr.String(), rr.Header().String())
+}
+
+// validTLSA checks the parameters of a TLSA record (RFC 6698)
+func validTLSA(rr dns.RR) string {
+	tlsa := rr.(*dns.TLSA)
+	if tlsa.Usage > 3 {
+		return "certificate usage must be between 0 and 3"
+	}
+	if tlsa.Selector > 1 {
+		return "selector must be 0 or 1"
+	}
+	switch tlsa.MatchingType {
+	case 0:
+	case 1:
+		if len(tlsa.Certificate) != 64 {
+			return "a SHA-256 digest must be 64 hexadecimal characters"
+		}
+	case 2:
+		if len(tlsa.Certificate) != 128 {
+			return "a SHA-512 digest must be 128 hexadecimal characters"
+		}
+	default:
+		return "matching type must be between 0 and 2"
+	}
+	if _, err := hex.DecodeString(tlsa.Certificate); err != nil || tlsa.Certificate == "" {
+		return "certificate association data must be hexadecimal"
+	}
+	return ""
+}
+
+// validSSHFP checks the parameters of a SSHFP record (RFC 4255, RFC 6594, RFC 7479)
+func validSSHFP(rr dns.RR) string {
+	sshfp := rr.(*dns.SSHFP)
+	switch sshfp.Algorithm {
+	case 1, 2, 3, 4, 6:
+	default:
+		return "algorithm must be 1 (RSA), 2 (DSA), 3 (ECDSA), 4 (Ed25519) or 6 (Ed448)"
+	}
+	switch sshfp.Type {
+	case 1:
+		if len(sshfp.FingerPrint) != 40 {
+			return "a SHA-1 fingerprint must be 40 hexadecimal characters"
+		}
+	case 2:
+		if len(sshfp.FingerPrint) != 64 {
+			return "a SHA-256 fingerprint must be 64 hexadecimal characters"
+		}
+	default:
+		return "fingerprint type must be 1 (SHA-1) or 2 (SHA-256)"
+	}
+	if _, err := hex.DecodeString(sshfp.FingerPrint); err != nil {
+		return "fingerprint must be hexadecimal"
+	}
+	return ""
+}
+
+// validNAPTR checks the parameters of a NAPTR record (RFC 3403)
+func validNAPTR(rr dns.RR) string {
+	naptr := rr.(*dns.NAPTR)
+	for _, c := range strings.ToUpper(naptr.Flags) {
+		if (c < 'A' || c > 'Z') && (c < '0' || c > '9') {
+			return "flags must be alphanumeric characters"
+		}
+	}
+	if naptr.Regexp != "" && naptr.Replacement != "." {
+		return "regexp and replacement can't both be set"
+	}
+	return ""
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseGenericRecord(t *testing.T) {
+	digest := "abababababababababababababababababababababababababababababababab"
+	for i, test := range []struct {
+		rtype    string
+		content  string
+		expected string
+		message  string
+	}{
+		{"TLSA", "3 1 1 " + digest, "3 1 1 " + digest, ""},
+		{"TLSA", "3  1 1 " + digest[:32] + " " + digest[32:], "3 1 1 " + digest, ""},
+		{"TLSA", "4 1 1 " + digest, "", "certificate usage must be between 0 and 3"},
+		{"TLSA", "3 1 2 " + digest, "", "a SHA-512 digest must be 128 hexadecimal characters"},
+		{"TLSA", "3 1 1", "", "a SHA-256 digest must be 64 hexadecimal characters"},
+		{"TLSA", "3 1", "", "not valid TLSA record data"},
+		{"SSHFP", "4 2 " + digest, "4 2 " + strings.ToUpper(digest), ""},
+		{"SSHFP", "4 1 " + digest, "", "a SHA-1 fingerprint must be 40 hexadecimal characters"},
+		{"SSHFP", "5 2 " + digest, "", "algorithm must be 1 (RSA), 2 (DSA), 3 (ECDSA), 4 (Ed25519) or 6 (Ed448)"},
+		{"NAPTR", `100 10 "S" "SIP+D2U" "" _sip._udp.example.com.`, `100 10 "S" "SIP+D2U" "" _sip._udp.example.com.`, ""},
+		{"NAPTR", `100 10 "U" "E2U+sip" "!^.*$!sip:info@example.com!" sip.example.com.`, "", "regexp and replacement can't both be set"},
+		{"TLSA", "3 1 1 " + digest + "\n@ IN TLSA 3 1 1 " + digest, "", "not valid TLSA record data"},
+		{"HINFO", "PC Linux", "", "must be one of naptr, sshfp, tlsa"},
+	} {
+		content, message := parseGenericRecord(test.rtype, test.content)
+		if content != test.expected || message != test.message {
+			t.Errorf("Test %d: expected %q %q, got %q %q", i, test.expected, test.message, content, message)
+		}
+	}
+}
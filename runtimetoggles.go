@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/julienschmidt/httprouter"
+	log "github.com/sirupsen/logrus"
+)
+
+// runtimeToggle is a switch admins can flip with the API while acme-dns runs. The
+// value is stored in the database and takes precedence over the configured
+// default on startup, so that it survives restarts.
+type runtimeToggle struct {
+	name    string
+	enabled int32
+}
+
+// Enabled tells if the toggle is switched on
+func (t *runtimeToggle) Enabled() bool {
+	return atomic.LoadInt32(&t.enabled) == 1
+}
+
+func (t *runtimeToggle) set(enabled bool) {
+	var value int32
+	if enabled {
+		value = 1
+	}
+	atomic.StoreInt32(&t.enabled, value)
+}
+
+var (
+	// readOnlyToggle refuses the API requests changing data, for maintenance
+	readOnlyToggle = &runtimeToggle{name: "read_only"}
+	// registrationToggle disables the registration endpoint
+	registrationToggle = &runtimeToggle{name: "disable_registration"}
+)
+
+// runtimeToggles are the toggles by their name in the API and the database
+var runtimeToggles = map[string]*runtimeToggle{
+	readOnlyToggle.name:     readOnlyToggle,
+	registrationToggle.name: registrationToggle,
+}
+
+// toggleDefaults returns the configured values of the toggles
+func toggleDefaults(conf httpapi) map[string]bool {
+	return map[string]bool{
+		readOnlyToggle.name:     conf.ReadOnly,
+		registrationToggle.name: conf.DisableRegistration,
+	}
+}
+
+// loadRuntimeToggles sets the toggles to the values stored in the database, or to
+// the configured defaults if an admin hasn't changed them
+func loadRuntimeToggles(db database, conf httpapi) error {
+	for name, configured := range toggleDefaults(conf) {
+		value, stored, err := db.GetSetting(name)
+		if err != nil {
+			return err
+		}
+		enabled := configured
+		if stored {
+			if enabled, err = strconv.ParseBool(value); err != nil {
+				return err
+			}
+			if enabled != configured {
+				log.WithFields(log.Fields{"toggle": name, "enabled": enabled, "configured": configured}).Warn("Using the runtime toggle stored in the database instead of the configured value")
+			}
+		}
+		runtimeToggles[name].set(enabled)
+	}
+	return nil
+}
+
+// toggleStates returns the current values of the toggles
+func toggleStates() map[string]bool {
+	states := make(map[string]bool)
+	for name, toggle := range runtimeToggles {
+		states[name] = toggle.Enabled()
+	}
+	return states
+}
+
+// readOnlyGate rejects the API requests changing data with 503 while the read-only
+// toggle is on. The admin endpoints stay available, so that the toggle can be
+// switched off again.
+func readOnlyGate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// DNS-over-HTTPS queries are POSTed without changing any data
+		if readOnlyToggle.Enabled() && r.Method != http.MethodGet && r.Method != http.MethodHead && !strings.HasPrefix(r.URL.Path, "/admin/") && r.URL.Path != dohPath {
+			WriteJsonResponse(w, http.StatusServiceUnavailable, jsonError("read_only"))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// registrationGate answers like an unknown endpoint while registration is disabled
+func registrationGate(handler httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		if registrationToggle.Enabled() {
+			http.NotFound(w, r)
+			return
+		}
+		handler(w, r, p)
+	}
+}
+
+// webAdminToggles reports the current values of the runtime toggles
+func webAdminToggles(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	out, _ := json.Marshal(toggleStates())
+	WriteJsonResponse(w, http.StatusOK, out)
+}
+
+// webAdminTogglesPost switches the posted toggles and stores their values
+func webAdminTogglesPost(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	var req map[string]bool
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		WriteJsonResponse(w, http.StatusBadRequest, jsonFieldErrors("malformed_json_payload", decodeErrorDetails(err)))
+		return
+	}
+	var names []string
+	var details []fieldError
+	for name := range req {
+		if _, ok := runtimeToggles[name]; !ok {
+			details = append(details, fieldError{name, "unknown toggle"})
+		}
+		names = append(names, name)
+	}
+	if len(details) > 0 {
+		sort.Slice(details, func(i, j int) bool { return details[i].Field < details[j].Field })
+		WriteJsonResponse(w, http.StatusBadRequest, jsonFieldErrors("unknown_toggle", details))
+		return
+	}
+	sort.Strings(names)
+	admin, _ := r.Context().Value(AdminKey).(string)
+	for _, name := range names {
+		if err := DB.SetSetting(name, strconv.FormatBool(req[name])); err != nil {
+			apiLog.WithFields(log.Fields{"error": err.Error(), "toggle": name}).Error("Could not store the runtime toggle")
+			WriteJsonResponse(w, http.StatusInternalServerError, jsonError("db_error"))
+			return
+		}
+		runtimeToggles[name].set(req[name])
+		apiLog.WithFields(log.Fields{"toggle": name, "enabled": req[name], "admin": admin}).Info("Runtime toggle switched")
+	}
+	out, _ := json.Marshal(toggleStates())
+	WriteJsonResponse(w, http.StatusOK, out)
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+func TestRuntimeToggles(t *testing.T) {
+	_ = setupRouter(false, false)
+	defer func() {
+		readOnlyToggle.set(false)
+		registrationToggle.set(false)
+	}()
+	api := httprouter.New()
+	api.POST("/register", registrationGate(webRegisterPost))
+	api.GET("/admin/toggles", AuthForAdmin(webAdminToggles))
+	api.POST("/admin/toggles", AuthForAdmin(webAdminTogglesPost))
+	server := httptest.NewServer(readOnlyGate(api))
+	defer server.Close()
+	e := getExpect(t, server)
+	if err := DB.CreateAdmin("toggles", "hunter2"); err != nil {
+		t.Fatalf("Could not create admin user [%v]", err)
+	}
+
+	e.POST("/admin/toggles").
+		WithBasicAuth("toggles", "hunter2").
+		WithJSON(map[string]bool{"read_only": true, "maintenance": true}).
+		Expect().
+		Status(http.StatusBadRequest).
+		JSON().Object().
+		ValueEqual("error", "unknown_toggle")
+	if readOnlyToggle.Enabled() {
+		t.Errorf("Expected no toggle to be switched by an invalid request")
+	}
+
+	e.POST("/admin/toggles").
+		WithBasicAuth("toggles", "hunter2").
+		WithJSON(map[string]bool{"read_only": true}).
+		Expect().
+		Status(http.StatusOK).
+		JSON().Object().
+		ValueEqual("read_only", true).
+		ValueEqual("disable_registration", false)
+	e.POST("/register").Expect().
+		Status(http.StatusServiceUnavailable).
+		JSON().Object().
+		ValueEqual("error", "read_only")
+	e.GET("/admin/toggles").
+		WithBasicAuth("toggles", "hunter2").
+		Expect().
+		Status(http.StatusOK).
+		JSON().Object().
+		ValueEqual("read_only", true)
+
+	e.POST("/admin/toggles").
+		WithBasicAuth("toggles", "hunter2").
+		WithJSON(map[string]bool{"read_only": false, "disable_registration": true}).
+		Expect().
+		Status(http.StatusOK)
+	e.POST("/register").Expect().Status(http.StatusNotFound)
+
+	// The stored values take precedence over the configuration on startup
+	if err := loadRuntimeToggles(DB, httpapi{ReadOnly: true}); err != nil {
+		t.Fatalf("Could not load the runtime toggles: %v", err)
+	}
+	if readOnlyToggle.Enabled() || !registrationToggle.Enabled() {
+		t.Errorf("Expected the stored toggles, got %v", toggleStates())
+	}
+}
+
+func TestRuntimeTogglesDefaults(t *testing.T) {
+	db, err := openBackend("memory", "")
+	if err != nil {
+		t.Fatalf("Could not open database: %v", err)
+	}
+	defer db.Close()
+	defer registrationToggle.set(false)
+	if err = loadRuntimeToggles(db, httpapi{DisableRegistration: true}); err != nil {
+		t.Fatalf("Could not load the runtime toggles: %v", err)
+	}
+	if readOnlyToggle.Enabled() || !registrationToggle.Enabled() {
+		t.Errorf("Expected the configured toggles, got %v", toggleStates())
+	}
+	if err = db.SetSetting("disable_registration", "false"); err != nil {
+		t.Fatalf("Could not store setting: %v", err)
+	}
+	if value, stored, err := db.GetSetting("disable_registration"); err != nil || !stored || value != "false" {
+		t.Errorf("Expected the stored setting, got %q, %t, %v", value, stored, err)
+	}
+	_ = loadRuntimeToggles(db, httpapi{DisableRegistration: true})
+	if registrationToggle.Enabled() {
+		t.Errorf("Expected the stored value to override the configuration")
+	}
+}
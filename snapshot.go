@@ -0,0 +1,92 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// staleSnapshotMaxSubdomains bounds the memory used by the last-known-good
+// snapshot of the record data.
+const staleSnapshotMaxSubdomains = 100000
+
+// staleSnapshot is a periodically refreshed in-memory copy of the record data,
+// used to keep answering DNS queries while the database is unreachable.
+type staleSnapshot struct {
+	mutex     sync.RWMutex
+	records   map[string]recordSet
+	refreshed time.Time
+}
+
+func newStaleSnapshot() *staleSnapshot {
+	return &staleSnapshot{records: make(map[string]recordSet)}
+}
+
+func (s *staleSnapshot) enabled() bool {
+	return s != nil
+}
+
+// get returns the last known records of the subdomain
+func (s *staleSnapshot) get(subdomain string) (recordSet, bool) {
+	if !s.enabled() {
+		return recordSet{}, false
+	}
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	r, ok := s.records[subdomain]
+	return r, ok
+}
+
+// replace swaps the snapshot contents with freshly loaded data
+func (s *staleSnapshot) replace(records map[string]recordSet, now time.Time) {
+	if !s.enabled() {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.records = records
+	s.refreshed = now
+}
+
+// age returns the time since the last successful refresh
+func (s *staleSnapshot) age(now time.Time) time.Duration {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return now.Sub(s.refreshed)
+}
+
+// snapshotRefresher is implemented by database backends able to keep a stale snapshot
+type snapshotRefresher interface {
+	RefreshSnapshot() error
+}
+
+// runSnapshotRefresh refreshes the snapshot every interval until the returned
+// channel is closed.
+func runSnapshotRefresh(db database, interval time.Duration) chan struct{} {
+	stop := make(chan struct{})
+	r, ok := db.(snapshotRefresher)
+	if !ok {
+		dbLog.Warning("Serving stale data requested, but the database backend doesn't support it")
+		return stop
+	}
+	refresh := func() {
+		if err := r.RefreshSnapshot(); err != nil {
+			dbLog.WithFields(log.Fields{"error": err.Error()}).Warning("Could not refresh the stale data snapshot")
+		}
+	}
+	refresh()
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				refresh()
+			case <-stop:
+				return
+			}
+		}
+	}()
+	return stop
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"testing"
+
+	"github.com/erikstmartin/go-testdb"
+)
+
+func TestServeStaleOnDBOutage(t *testing.T) {
+	adb := DB.(*acmedb)
+	oldSnapshot := adb.snapshot
+	adb.snapshot = newStaleSnapshot()
+	defer func() { adb.snapshot = oldSnapshot }()
+
+	reg, err := DB.Register(cidrslice{}, registrationOrigin{}, ACMETxtPost{})
+	if err != nil {
+		t.Fatalf("Registration failed, got error [%v]", err)
+	}
+	reg.Value = "LHDhK3oGRvkiefQnx7OOczTY5Tic_xZ6HcMOc_gmtoM"
+	reg.AValues = []string{"192.0.2.1"}
+	reg.AAAAValues = []string{"2001:db8::1"}
+	if _, err = DB.Update(reg.ACMETxtPost); err != nil {
+		t.Fatalf("DB Update failed, got error: [%v]", err)
+	}
+	if err = adb.RefreshSnapshot(); err != nil {
+		t.Fatalf("Could not refresh snapshot [%v]", err)
+	}
+
+	testdb.SetQueryWithArgsFunc(func(query string, args []driver.Value) (result driver.Rows, err error) {
+		return nil, errors.New("database is down")
+	})
+	defer testdb.Reset()
+	tdb, _ := sql.Open("testdb", "")
+	oldDb := DB.(*acmedb).GetBackend()
+	DB.(*acmedb).SetBackend(tdb)
+	defer DB.(*acmedb).SetBackend(oldDb)
+
+	txts, err := DB.GetTXTForDomain(reg.Subdomain)
+	if err != nil {
+		t.Errorf("Expected stale answer, but got error [%v]", err)
+	}
+	if len(txts) != 2 || txts[0] != reg.Value {
+		t.Errorf("Expected stale TXT values, got %v", txts)
+	}
+	a, err := DB.GetAForDomain(reg.Subdomain)
+	if err != nil || len(a) != 1 || a[0].String() != "192.0.2.1" {
+		t.Errorf("Expected stale A values, got %v [%v]", a, err)
+	}
+	aaaa, err := DB.GetAAAAForDomain(reg.Subdomain)
+	if err != nil || len(aaaa) != 1 || aaaa[0].String() != "2001:db8::1" {
+		t.Errorf("Expected stale AAAA values, got %v [%v]", aaaa, err)
+	}
+	count, err := DB.CountRecords(reg.Subdomain)
+	if err != nil || count != 3 {
+		t.Errorf("Expected stale record count 3, got %d [%v]", count, err)
+	}
+
+	// Subdomains missing from the snapshot still report the database error
+	if _, err = DB.GetTXTForDomain("not-in-snapshot"); err == nil {
+		t.Errorf("Expected error for subdomain missing from the snapshot")
+	}
+	// Without the snapshot the database error is returned as before
+	adb.snapshot = nil
+	if _, err = DB.GetTXTForDomain(reg.Subdomain); err == nil {
+		t.Errorf("Expected error when serving stale data is disabled")
+	}
+}
+
+func TestRefreshSnapshotError(t *testing.T) {
+	adb := DB.(*acmedb)
+	oldSnapshot := adb.snapshot
+	adb.snapshot = newStaleSnapshot()
+	defer func() { adb.snapshot = oldSnapshot }()
+	adb.snapshot.replace(map[string]recordSet{"kept": {TXT: []string{"value"}}}, adb.Now())
+
+	testdb.SetQueryWithArgsFunc(func(query string, args []driver.Value) (result driver.Rows, err error) {
+		return nil, errors.New("database is down")
+	})
+	defer testdb.Reset()
+	tdb, _ := sql.Open("testdb", "")
+	oldDb := DB.(*acmedb).GetBackend()
+	DB.(*acmedb).SetBackend(tdb)
+	defer DB.(*acmedb).SetBackend(oldDb)
+
+	if err := adb.RefreshSnapshot(); err == nil {
+		t.Errorf("Expected refresh to fail")
+	}
+	if _, ok := adb.snapshot.get("kept"); !ok {
+		t.Errorf("A failed refresh should keep the last known good snapshot")
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/miekg/dns"
+)
+
+// soaTimers are the timers of the SOA record of a zone, in seconds. The zero
+// values are unset.
+type soaTimers struct {
+	Refresh uint32 `toml:"soa_refresh"`
+	Retry   uint32 `toml:"soa_retry"`
+	Expire  uint32 `toml:"soa_expire"`
+	// Minimum is the TTL of the negative answers of the zone
+	Minimum uint32 `toml:"soa_minimum"`
+}
+
+// defaultSOATimers are the timers of the zones that don't set them. The minimum
+// is the TTL of the SOA record, which resolvers have always cached the negative
+// answers for.
+var defaultSOATimers = soaTimers{Refresh: 28800, Retry: 7200, Expire: 604800, Minimum: 3600}
+
+// or returns the timers with the unset ones taken from fallback
+func (t soaTimers) or(fallback soaTimers) soaTimers {
+	if t.Refresh == 0 {
+		t.Refresh = fallback.Refresh
+	}
+	if t.Retry == 0 {
+		t.Retry = fallback.Retry
+	}
+	if t.Expire == 0 {
+		t.Expire = fallback.Expire
+	}
+	if t.Minimum == 0 {
+		t.Minimum = fallback.Minimum
+	}
+	return t
+}
+
+// validateSOATimers checks that the secondary servers of the zone get to retry a
+// failed refresh before their copy of the zone expires
+func validateSOATimers(zone string, t soaTimers) error {
+	if t.Expire < t.Refresh+t.Retry {
+		return fmt.Errorf("soa_expire of zone %s must be at least soa_refresh + soa_retry", zone)
+	}
+	return nil
+}
+
+// negativeSOA returns the SOA record for the authority section of the negative
+// answers. Its TTL is lowered to the minimum, as resolvers cache the negative
+// answer for the lower of the two (RFC 2308), and some only look at one of them.
+func negativeSOA(soa dns.RR) dns.RR {
+	record, ok := soa.(*dns.SOA)
+	if !ok || record.Hdr.Ttl <= record.Minttl {
+		return soa
+	}
+	negative := dns.Copy(record)
+	negative.Header().Ttl = record.Minttl
+	return negative
+}
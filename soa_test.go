@@ -0,0 +1,77 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestNegativeAnswers(t *testing.T) {
+	reg, err := DB.Register(cidrslice{}, registrationOrigin{}, ACMETxtPost{})
+	if err != nil {
+		t.Fatalf("Registration failed, got error [%v]", err)
+	}
+	if _, err = DB.Update(ACMETxtPost{Subdomain: reg.Subdomain, Value: "LHDhK3oGRvkiefQnx7OOczTY5Tic_xZ6HcMOc_gmtoM"}); err != nil {
+		t.Fatalf("Update failed, got error [%v]", err)
+	}
+	config := Config
+	config.General.Domain = "auth.example.org"
+	config.General.ZoneFiles = nil
+	config.General.StaticRecords = nil
+	config.General.soaTimers = soaTimers{Minimum: 60}
+	config.Zones = nil
+	server := NewDNSServer(DB, "", "udp", config.General.Domain)
+	server.ParseRecords(config)
+	udp := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53}
+	query := func(name string, qtype uint16) *dns.Msg {
+		req := new(dns.Msg)
+		req.SetQuestion(name, qtype)
+		w := &recordingWriter{local: udp}
+		server.handleRequest(w, req)
+		if w.msg == nil {
+			t.Fatalf("No response written for %s", name)
+		}
+		return w.msg
+	}
+
+	for i, test := range []struct {
+		name  string
+		qtype uint16
+		rcode int
+	}{
+		{"nonexistent.auth.example.org.", dns.TypeTXT, dns.RcodeNameError},
+		{reg.Subdomain + ".auth.example.org.", dns.TypeA, dns.RcodeSuccess},
+		{"auth.example.org.", dns.TypeMX, dns.RcodeSuccess},
+	} {
+		m := query(test.name, test.qtype)
+		if m.Rcode != test.rcode || len(m.Answer) != 0 {
+			t.Errorf("Test %d: expected %s without records, got %s %v", i, dns.RcodeToString[test.rcode], dns.RcodeToString[m.Rcode], m.Answer)
+			continue
+		}
+		if len(m.Ns) != 1 {
+			t.Errorf("Test %d: expected the SOA record in the authority section, got %v", i, m.Ns)
+			continue
+		}
+		soa, ok := m.Ns[0].(*dns.SOA)
+		if !ok || soa.Hdr.Ttl != 60 || soa.Minttl != 60 || soa.Refresh != defaultSOATimers.Refresh {
+			t.Errorf("Test %d: expected the SOA record with the negative TTL, got %v", i, m.Ns[0])
+		}
+	}
+	if m := query(reg.Subdomain+".auth.example.org.", dns.TypeTXT); len(m.Answer) != 1 || len(m.Ns) != 0 {
+		t.Errorf("Expected a positive answer without the SOA record, got %v and %v", m.Answer, m.Ns)
+	}
+}
+
+func TestSOATimers(t *testing.T) {
+	timers := soaTimers{Refresh: 3600}.or(defaultSOATimers)
+	if timers.Refresh != 3600 || timers.Retry != defaultSOATimers.Retry || timers.Minimum != defaultSOATimers.Minimum {
+		t.Errorf("Unexpected timers %+v", timers)
+	}
+	if err := validateSOATimers("auth.example.org", timers); err != nil {
+		t.Errorf("Expected the timers to be valid, got %v", err)
+	}
+	if err := validateSOATimers("auth.example.org", soaTimers{Refresh: 3600, Retry: 600, Expire: 1800}); err == nil {
+		t.Errorf("Expected an error for a zone expiring before the refresh")
+	}
+}
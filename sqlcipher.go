@@ -0,0 +1,62 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// sqlcipherDriver is the sqlite3 driver keying each connection with the database
+// key, used when a key is configured
+const sqlcipherDriver = "sqlite3_sqlcipher"
+
+// databaseKeyEnv is the environment variable overriding the configured database key
+const databaseKeyEnv = "ACMEDNS_DATABASE_KEY"
+
+// errNoSQLCipher is returned when a database key is configured but the sqlite3
+// library doesn't support encryption, so that a plain database is never written
+var errNoSQLCipher = errors.New("a database key is configured but acme-dns is not linked against SQLCipher, build it with -tags libsqlite3 against libsqlcipher")
+
+func init() {
+	sql.Register(sqlcipherDriver, &sqlite3.SQLiteDriver{ConnectHook: keySQLiteConn})
+}
+
+// loadDatabaseKey sets the database key from the environment or from the key
+// file, which must not be accessible by other users
+func loadDatabaseKey(conf *dbsettings) error {
+	if key, ok := os.LookupEnv(databaseKeyEnv); ok {
+		conf.Key = key
+	} else if conf.KeyFile != "" {
+		info, err := os.Stat(conf.KeyFile)
+		if err != nil {
+			return fmt.Errorf("could not read the database key file: %v", err)
+		}
+		if info.Mode().Perm()&0o077 != 0 {
+			return fmt.Errorf("%s must not be accessible by other users, its permissions are %v", conf.KeyFile, info.Mode().Perm())
+		}
+		data, err := os.ReadFile(conf.KeyFile)
+		if err != nil {
+			return fmt.Errorf("could not read the database key file: %v", err)
+		}
+		conf.Key = strings.TrimSpace(string(data))
+		if conf.Key == "" {
+			return fmt.Errorf("the database key file %s is empty", conf.KeyFile)
+		}
+	}
+	if conf.Key != "" && conf.Engine != "sqlite3" {
+		return fmt.Errorf("a database key can only be used with the sqlite3 engine")
+	}
+	return nil
+}
+
+// sqliteDriver returns the driver opening the sqlite3 databases of the configuration
+func sqliteDriver(conf dbsettings) string {
+	if conf.Key != "" {
+		return sqlcipherDriver
+	}
+	return "sqlite3"
+}
@@ -0,0 +1,49 @@
+//go:build cgo
+
+package main
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// keySQLiteConn keys a new connection with the configured key, and checks that the
+// library is SQLCipher and the key opens the database
+func keySQLiteConn(conn *sqlite3.SQLiteConn) error {
+	key := strings.ReplaceAll(Config.Database.Key, "'", "''")
+	if _, err := conn.Exec("PRAGMA key = '"+key+"'", nil); err != nil {
+		return err
+	}
+	version, err := queryValue(conn, "PRAGMA cipher_version")
+	if err != nil {
+		return err
+	}
+	if version == nil {
+		return errNoSQLCipher
+	}
+	if _, err = queryValue(conn, "SELECT count(*) FROM sqlite_master"); err != nil {
+		return fmt.Errorf("could not open the encrypted database, is the key right? %v", err)
+	}
+	return nil
+}
+
+// queryValue returns the first column of the first row of the query, or nil if
+// there are no rows
+func queryValue(conn *sqlite3.SQLiteConn, query string) (driver.Value, error) {
+	rows, err := conn.Query(query, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	values := make([]driver.Value, len(rows.Columns()))
+	if err = rows.Next(values); err == io.EOF || len(values) == 0 {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return values[0], nil
+}
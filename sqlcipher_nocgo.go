@@ -0,0 +1,11 @@
+//go:build !cgo
+
+package main
+
+import "github.com/mattn/go-sqlite3"
+
+// keySQLiteConn refuses the keyed connections of the binaries built without cgo,
+// which have no sqlite3 support at all
+func keySQLiteConn(conn *sqlite3.SQLiteConn) error {
+	return errNoSQLCipher
+}
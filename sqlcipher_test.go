@@ -0,0 +1,76 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadDatabaseKey(t *testing.T) {
+	dir := t.TempDir()
+	keyFile := filepath.Join(dir, "key")
+	if err := os.WriteFile(keyFile, []byte("from file\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	openKeyFile := filepath.Join(dir, "open")
+	if err := os.WriteFile(openKeyFile, []byte("secret"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	// Restores the environment after the test
+	t.Setenv(databaseKeyEnv, "")
+	emptyKeyFile := filepath.Join(dir, "empty")
+	if err := os.WriteFile(emptyKeyFile, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	for i, test := range []struct {
+		conf     dbsettings
+		env      string
+		expected string
+		err      bool
+	}{
+		{dbsettings{Engine: "sqlite3", Key: "configured"}, "", "configured", false},
+		{dbsettings{Engine: "sqlite3", Key: "configured", KeyFile: keyFile}, "", "from file", false},
+		{dbsettings{Engine: "sqlite3", KeyFile: keyFile}, "from env", "from env", false},
+		{dbsettings{Engine: "sqlite3", KeyFile: openKeyFile}, "", "", true},
+		{dbsettings{Engine: "sqlite3", KeyFile: emptyKeyFile}, "", "", true},
+		{dbsettings{Engine: "sqlite3", KeyFile: filepath.Join(dir, "missing")}, "", "", true},
+		{dbsettings{Engine: "postgres", Key: "configured"}, "", "", true},
+		{dbsettings{Engine: "postgres"}, "", "", false},
+	} {
+		if test.env != "" {
+			t.Setenv(databaseKeyEnv, test.env)
+		} else {
+			os.Unsetenv(databaseKeyEnv)
+		}
+		err := loadDatabaseKey(&test.conf)
+		if test.err {
+			if err == nil {
+				t.Errorf("Test %d: expected an error", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: unexpected error %v", i, err)
+		} else if test.conf.Key != test.expected {
+			t.Errorf("Test %d: expected key %q, got %q", i, test.expected, test.conf.Key)
+		}
+	}
+}
+
+func TestEncryptedDatabaseWithoutSQLCipher(t *testing.T) {
+	oldConfig := Config
+	defer func() { Config = oldConfig }()
+	Config.Database.Key = "secret"
+	if sqliteDriver(Config.Database) != sqlcipherDriver {
+		t.Fatalf("Expected the keyed driver to be used")
+	}
+	db := new(acmedb)
+	err := db.Init("sqlite3", filepath.Join(t.TempDir(), "acme-dns.db"))
+	if db.DB != nil {
+		defer db.DB.Close()
+	}
+	// The bundled SQLite doesn't support encryption, which must not go unnoticed
+	if err == nil {
+		t.Fatalf("Expected opening a keyed database without SQLCipher to fail")
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+)
+
+// primaryLease is the name of the lease held by the instance accepting API traffic
+const primaryLease = "primary"
+
+// Standby is the warm standby coordinator of this instance, nil if standby mode is disabled
+var Standby *standbyCoordinator
+
+// standbyCoordinator elects a primary instance using a lease in the shared database.
+// Only the primary accepts API traffic, while the others keep serving DNS from the
+// same database and take over once the lease of the primary expires.
+type standbyCoordinator struct {
+	db       database
+	node     string
+	duration time.Duration
+	primary  atomic.Bool
+	stop     chan struct{}
+}
+
+func newStandbyCoordinator(db database, conf standby) *standbyCoordinator {
+	node := conf.NodeName
+	if node == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			hostname = "acme-dns"
+		}
+		node = hostname + "-" + uuid.New().String()[:8]
+	}
+	duration := time.Duration(conf.LeaseDuration) * time.Second
+	if duration <= 0 {
+		duration = 30 * time.Second
+	}
+	return &standbyCoordinator{
+		db:       db,
+		node:     node,
+		duration: duration,
+		stop:     make(chan struct{}),
+	}
+}
+
+// IsPrimary tells if this instance currently holds the primary lease
+func (s *standbyCoordinator) IsPrimary() bool {
+	if s == nil {
+		return true
+	}
+	return s.primary.Load()
+}
+
+// Run keeps trying to acquire or renew the primary lease until stopped
+func (s *standbyCoordinator) Run() {
+	log.WithFields(log.Fields{"node": s.node, "lease": s.duration.String()}).Info("Starting in warm standby mode")
+	// Renew well before the lease expires so a single failed attempt doesn't cause a failover
+	ticker := time.NewTicker(s.duration / 3)
+	defer ticker.Stop()
+	for {
+		s.tick()
+		select {
+		case <-ticker.C:
+		case <-s.stop:
+			if s.primary.Load() {
+				_ = s.db.ReleaseLease(primaryLease, s.node)
+			}
+			s.primary.Store(false)
+			return
+		}
+	}
+}
+
+// Stop ends the election loop and releases the lease if held
+func (s *standbyCoordinator) Stop() {
+	close(s.stop)
+}
+
+func (s *standbyCoordinator) tick() {
+	acquired, err := s.db.AcquireLease(primaryLease, s.node, s.duration)
+	if err != nil {
+		log.WithFields(log.Fields{"error": err.Error(), "node": s.node}).Error("Could not acquire primary lease")
+		// The lease may still be valid, but we can't know it. Stepping down is the safe choice.
+		acquired = false
+	}
+	was := s.primary.Swap(acquired)
+	if acquired && !was {
+		log.WithFields(log.Fields{"node": s.node}).Info("Became the primary instance")
+	} else if !acquired && was {
+		log.WithFields(log.Fields{"node": s.node}).Warning("Lost the primary lease, switching to standby")
+	}
+}
+
+// standbyGate rejects API requests with 503 while this instance is on standby.
+// The health check is always served, as standby instances are healthy DNS servers.
+func standbyGate(s *standbyCoordinator, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The instances on standby serve DNS, also over HTTPS
+		if r.URL.Path != "/health" && r.URL.Path != dohPath && !s.IsPrimary() {
+			w.Header().Set("Retry-After", strconv.Itoa(int(s.duration.Seconds())))
+			WriteJsonResponse(w, http.StatusServiceUnavailable, jsonError("standby"))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
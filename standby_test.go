@@ -0,0 +1,91 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestAcquireLease(t *testing.T) {
+	clk := withFrozenClock(t, time.Unix(1700000000, 0))
+	for i, test := range []struct {
+		advance  time.Duration
+		holder   string
+		acquired bool
+	}{
+		{0, "node-a", true},
+		{0, "node-b", false},
+		{20 * time.Second, "node-a", true},
+		{29 * time.Second, "node-b", false},
+		{2 * time.Second, "node-b", true},
+		{0, "node-a", false},
+	} {
+		clk.Advance(test.advance)
+		acquired, err := DB.AcquireLease("test-lease", test.holder, 30*time.Second)
+		if err != nil {
+			t.Errorf("Test %d: Got unexpected error [%v]", i, err)
+		}
+		if acquired != test.acquired {
+			t.Errorf("Test %d: Expected lease acquired to be %t for %s, got %t", i, test.acquired, test.holder, acquired)
+		}
+	}
+	if err := DB.ReleaseLease("test-lease", "node-a"); err != nil {
+		t.Errorf("Got unexpected error [%v]", err)
+	}
+	if acquired, _ := DB.AcquireLease("test-lease", "node-a", 30*time.Second); acquired {
+		t.Errorf("Lease should not be released by a node not holding it")
+	}
+	_ = DB.ReleaseLease("test-lease", "node-b")
+	if acquired, _ := DB.AcquireLease("test-lease", "node-a", 30*time.Second); !acquired {
+		t.Errorf("Expected released lease to be acquired")
+	}
+}
+
+func TestStandbyFailover(t *testing.T) {
+	clk := withFrozenClock(t, time.Unix(1700000000, 0))
+	a := newStandbyCoordinator(DB, standby{NodeName: "node-a", LeaseDuration: 30})
+	b := newStandbyCoordinator(DB, standby{NodeName: "node-b", LeaseDuration: 30})
+	a.tick()
+	b.tick()
+	if !a.IsPrimary() || b.IsPrimary() {
+		t.Fatalf("Expected node-a to be the only primary")
+	}
+	// node-a stops renewing, node-b takes over after the lease expires
+	clk.Advance(31 * time.Second)
+	b.tick()
+	if !b.IsPrimary() {
+		t.Errorf("Expected node-b to take over the primary lease")
+	}
+	a.tick()
+	if a.IsPrimary() {
+		t.Errorf("Expected node-a to step down")
+	}
+}
+
+func TestStandbyGate(t *testing.T) {
+	s := newStandbyCoordinator(DB, standby{NodeName: "gate-node", LeaseDuration: 30})
+	handler := standbyGate(s, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	for i, test := range []struct {
+		primary bool
+		path    string
+		status  int
+	}{
+		{false, "/update", http.StatusServiceUnavailable},
+		{false, "/health", http.StatusOK},
+		{true, "/update", http.StatusOK},
+	} {
+		s.primary.Store(test.primary)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("POST", test.path, nil))
+		if rec.Code != test.status {
+			t.Errorf("Test %d: Expected status %d, got %d", i, test.status, rec.Code)
+		}
+	}
+	var disabled *standbyCoordinator
+	if !disabled.IsPrimary() {
+		t.Errorf("Instances without standby mode should always be primary")
+	}
+}
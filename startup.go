@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+
+	"github.com/julienschmidt/httprouter"
+	log "github.com/sirupsen/logrus"
+)
+
+// Startup tracks the startup phases of this instance, nil when not started by main
+var Startup *startupTracker
+
+// startupTracker tracks the phases that must complete before the instance can
+// serve the records it accepts through the API, like binding the DNS listeners.
+type startupTracker struct {
+	mutex   sync.Mutex
+	pending map[string]bool
+	done    chan struct{}
+}
+
+// startupPhases returns the phases of the startup with the config: migrating the
+// database and binding every DNS listener
+func startupPhases(config DNSConfig) []string {
+	phases := []string{"database"}
+	for _, listener := range dnsListeners(config) {
+		phases = append(phases, dnsStartupPhase(listener.proto, listener.addr))
+	}
+	return phases
+}
+
+// dnsStartupPhase names the phase of binding a DNS listener
+func dnsStartupPhase(proto string, addr string) string {
+	return "dns " + proto + " " + addr
+}
+
+func newStartupTracker(phases ...string) *startupTracker {
+	s := &startupTracker{pending: make(map[string]bool), done: make(chan struct{})}
+	for _, phase := range phases {
+		s.pending[phase] = true
+	}
+	if len(s.pending) == 0 {
+		close(s.done)
+	}
+	return s
+}
+
+// Complete marks a phase as completed
+func (s *startupTracker) Complete(phase string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if !s.pending[phase] {
+		return
+	}
+	delete(s.pending, phase)
+	log.WithFields(log.Fields{"phase": phase, "remaining": len(s.pending)}).Info("Startup phase completed")
+	if len(s.pending) == 0 {
+		close(s.done)
+	}
+}
+
+// Pending returns the phases not completed yet
+func (s *startupTracker) Pending() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	phases := make([]string, 0, len(s.pending))
+	for phase := range s.pending {
+		phases = append(phases, phase)
+	}
+	sort.Strings(phases)
+	return phases
+}
+
+// Done returns a channel closed once all the phases are completed
+func (s *startupTracker) Done() <-chan struct{} {
+	return s.done
+}
+
+// Ready tells if all the phases are completed
+func (s *startupTracker) Ready() bool {
+	select {
+	case <-s.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// readinessCheck answers 200 once the instance can serve the records registered
+// through it, and 503 with the pending startup phases before that
+func readinessCheck(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	status := struct {
+		Ready   bool     `json:"ready"`
+		Pending []string `json:"pending,omitempty"`
+	}{Ready: true}
+	if Startup != nil && !Startup.Ready() {
+		status.Ready = false
+		status.Pending = Startup.Pending()
+	}
+	resp, _ := json.Marshal(status)
+	if !status.Ready {
+		WriteJsonResponse(w, http.StatusServiceUnavailable, resp)
+		return
+	}
+	WriteJsonResponse(w, http.StatusOK, resp)
+}
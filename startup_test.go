@@ -0,0 +1,101 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestStartupPhases(t *testing.T) {
+	var config DNSConfig
+	config.General.Listen = "127.0.0.1:53"
+	config.General.AdditionalListen = []string{"[::1]:53"}
+	config.General.Proto = "both"
+	config.General.TLSListen = "127.0.0.1:853"
+	expected := []string{"database", "dns udp 127.0.0.1:53", "dns tcp 127.0.0.1:53", "dns udp [::1]:53", "dns tcp [::1]:53", "dns tcp-tls 127.0.0.1:853"}
+	if phases := startupPhases(config); !reflect.DeepEqual(phases, expected) {
+		t.Errorf("Expected phases %v, got %v", expected, phases)
+	}
+}
+
+func TestStartupTracker(t *testing.T) {
+	s := newStartupTracker("database", "dns udp 127.0.0.1:53")
+	if s.Ready() {
+		t.Errorf("Tracker should not be ready before the phases complete")
+	}
+	s.Complete("database")
+	s.Complete("database")
+	s.Complete("unknown")
+	if s.Ready() {
+		t.Errorf("Tracker should not be ready with a pending phase")
+	}
+	if pending := s.Pending(); !reflect.DeepEqual(pending, []string{"dns udp 127.0.0.1:53"}) {
+		t.Errorf("Unexpected pending phases %v", pending)
+	}
+	s.Complete("dns udp 127.0.0.1:53")
+	select {
+	case <-s.Done():
+	case <-time.After(time.Second):
+		t.Fatalf("Done should be closed once all the phases complete")
+	}
+	if !s.Ready() || len(s.Pending()) != 0 {
+		t.Errorf("Tracker should be ready once all the phases complete")
+	}
+	if !newStartupTracker().Ready() {
+		t.Errorf("Tracker without phases should be ready")
+	}
+}
+
+func TestStartupWaitsForDNSListener(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Could not listen [%v]", err)
+	}
+	addr := conn.LocalAddr().String()
+	conn.Close()
+	s := newStartupTracker(dnsStartupPhase("udp", addr))
+	server := NewDNSServer(DB, addr, "udp", "auth.example.org")
+	server.Server.NotifyStartedFunc = func() { s.Complete(dnsStartupPhase("udp", addr)) }
+	go server.Start(make(chan error, 1))
+	defer server.Server.Shutdown()
+	select {
+	case <-s.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatalf("DNS listener startup phase did not complete, pending %v", s.Pending())
+	}
+	// The listener answers as soon as the phase is completed
+	msg := new(dns.Msg)
+	msg.SetQuestion("auth.example.org.", dns.TypeA)
+	if _, _, err := new(dns.Client).Exchange(msg, addr); err != nil {
+		t.Errorf("DNS listener should answer once started [%v]", err)
+	}
+}
+
+func TestReadinessCheck(t *testing.T) {
+	defer func() { Startup = nil }()
+	for i, test := range []struct {
+		tracker  *startupTracker
+		status   int
+		contains string
+	}{
+		{nil, http.StatusOK, `"ready":true`},
+		{newStartupTracker(), http.StatusOK, `"ready":true`},
+		{newStartupTracker("database", "dns udp 127.0.0.1:53"), http.StatusServiceUnavailable, `"pending":["database","dns udp 127.0.0.1:53"]`},
+	} {
+		Startup = test.tracker
+		w := httptest.NewRecorder()
+		readinessCheck(w, httptest.NewRequest("GET", "/readyz", nil), nil)
+		if w.Code != test.status {
+			t.Errorf("Test %d: Expected status %d, got %d", i, test.status, w.Code)
+		}
+		if !strings.Contains(w.Body.String(), test.contains) {
+			t.Errorf("Test %d: Expected body to contain %s, got %s", i, test.contains, w.Body.String())
+		}
+	}
+}
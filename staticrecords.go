@@ -0,0 +1,192 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+)
+
+// staticRecords holds the records served from the configuration and the zone
+// files. Queries read an immutable snapshot without locking, and every change
+// copies the snapshot and swaps the copy in, so that the records and zones can
+// be changed at runtime while the servers are answering.
+type staticRecords struct {
+	current atomic.Pointer[recordSnapshot]
+	// mutex serializes the changes, so that none of them is lost
+	mutex sync.Mutex
+}
+
+// recordSnapshot is a set of static records. It's never modified once published.
+type recordSnapshot struct {
+	domains map[string]Records
+	// zones are the SOA records of the supplementary zones by zone name
+	zones map[string]dns.RR
+	// names are the names with records and their ancestors, the names that exist
+	// when looking for the closest encloser of a wildcard
+	names map[string]struct{}
+}
+
+func newStaticRecords() *staticRecords {
+	s := &staticRecords{}
+	s.current.Store(&recordSnapshot{domains: make(map[string]Records), zones: make(map[string]dns.RR), names: make(map[string]struct{})})
+	return s
+}
+
+// Get returns the records of the name
+func (s *staticRecords) Get(name string) (Records, bool) {
+	records, ok := s.current.Load().domains[strings.ToLower(name)]
+	return records, ok
+}
+
+// Wildcard returns the records synthesized for the name from the wildcard of its
+// closest encloser (RFC 4592), owned by the name, and the closest encloser. Names
+// that exist, even without records of their own, are never synthesized.
+func (s *staticRecords) Wildcard(name string) (Records, string, bool) {
+	snapshot := s.current.Load()
+	name = strings.ToLower(dns.Fqdn(name))
+	if _, ok := snapshot.names[name]; ok {
+		return Records{}, "", false
+	}
+	for off, end := dns.NextLabel(name, 0); !end; off, end = dns.NextLabel(name, off) {
+		encloser := name[off:]
+		if _, ok := snapshot.names[encloser]; !ok {
+			continue
+		}
+		wildcard, ok := snapshot.domains["*."+encloser]
+		if !ok {
+			return Records{}, encloser, false
+		}
+		var records []dns.RR
+		for _, rr := range wildcard.Records {
+			synthesized := dns.Copy(rr)
+			synthesized.Header().Name = name
+			records = append(records, synthesized)
+		}
+		return Records{records}, encloser, true
+	}
+	return Records{}, "", false
+}
+
+// Zone returns the SOA record of the closest supplementary zone the name belongs
+// to, or nil for names outside of them
+func (s *staticRecords) Zone(name string) dns.RR {
+	name = strings.ToLower(dns.Fqdn(name))
+	var closest dns.RR
+	for zone, soa := range s.current.Load().zones {
+		if dns.IsSubDomain(zone, name) && (closest == nil || len(zone) > len(closest.Header().Name)) {
+			closest = soa
+		}
+	}
+	return closest
+}
+
+// Add adds the records
+func (s *staticRecords) Add(rrs ...dns.RR) {
+	s.update(func(next *recordSnapshot) error {
+		next.add(rrs)
+		return nil
+	})
+}
+
+// Within returns the records of the names in the zone
+func (s *staticRecords) Within(zone string) []dns.RR {
+	zone = strings.ToLower(dns.Fqdn(zone))
+	var rrs []dns.RR
+	for name, records := range s.current.Load().domains {
+		if dns.IsSubDomain(zone, name) {
+			rrs = append(rrs, records.Records...)
+		}
+	}
+	return rrs
+}
+
+// AddZone adds a supplementary zone with its SOA record and the records in it
+func (s *staticRecords) AddZone(soa dns.RR, rrs []dns.RR) error {
+	zone := strings.ToLower(soa.Header().Name)
+	return s.update(func(next *recordSnapshot) error {
+		if _, ok := next.zones[zone]; ok {
+			return fmt.Errorf("zone %s is already loaded", zone)
+		}
+		next.zones[zone] = soa
+		next.add(rrs)
+		return nil
+	})
+}
+
+// RemoveZone removes a supplementary zone and all the records in it, and tells
+// if the zone was loaded
+func (s *staticRecords) RemoveZone(zone string) bool {
+	zone = strings.ToLower(dns.Fqdn(zone))
+	err := s.update(func(next *recordSnapshot) error {
+		if _, ok := next.zones[zone]; !ok {
+			return fmt.Errorf("zone %s is not loaded", zone)
+		}
+		delete(next.zones, zone)
+		for name := range next.domains {
+			if dns.IsSubDomain(zone, name) {
+				delete(next.domains, name)
+			}
+		}
+		return nil
+	})
+	return err == nil
+}
+
+// ReplaceSOA replaces the SOA record of the name with soa, keeping the other records
+func (s *staticRecords) ReplaceSOA(soa dns.RR) {
+	name := strings.ToLower(soa.Header().Name)
+	s.update(func(next *recordSnapshot) error {
+		records := []dns.RR{soa}
+		for _, rr := range next.domains[name].Records {
+			if rr.Header().Rrtype != dns.TypeSOA {
+				records = append(records, rr)
+			}
+		}
+		next.domains[name] = Records{records}
+		return nil
+	})
+}
+
+// update applies the change to a copy of the current snapshot, and publishes the
+// copy unless the change fails
+func (s *staticRecords) update(change func(*recordSnapshot) error) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	current := s.current.Load()
+	next := &recordSnapshot{
+		domains: make(map[string]Records, len(current.domains)),
+		zones:   make(map[string]dns.RR, len(current.zones)),
+	}
+	for name, records := range current.domains {
+		next.domains[name] = records
+	}
+	for zone, soa := range current.zones {
+		next.zones[zone] = soa
+	}
+	if err := change(next); err != nil {
+		return err
+	}
+	next.names = make(map[string]struct{}, len(next.domains))
+	for name := range next.domains {
+		for off, end := 0, false; !end; off, end = dns.NextLabel(name, off) {
+			next.names[name[off:]] = struct{}{}
+		}
+	}
+	s.current.Store(next)
+	return nil
+}
+
+// add adds the records to a snapshot being prepared
+func (r *recordSnapshot) add(rrs []dns.RR) {
+	for _, rr := range rrs {
+		name := rr.Header().Name
+		// The slice may be shared with the published snapshots, never append to it in place
+		records := r.domains[name].Records
+		r.domains[name] = Records{append(records[:len(records):len(records)], rr)}
+		dnsLog.WithFields(log.Fields{"recordtype": dns.TypeToString[rr.Header().Rrtype], "domain": name}).Debug("Adding new record to domain")
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestStaticRecordsZones(t *testing.T) {
+	s := newStaticRecords()
+	a, _ := dns.NewRR("auth.example.org. A 192.0.2.1")
+	s.Add(a)
+	soa, _ := dns.NewRR("example.net. SOA ns1.example.net. hostmaster.example.net. 1 7200 3600 1209600 300")
+	www, _ := dns.NewRR("www.example.net. A 192.0.2.80")
+	before := s.current.Load()
+	if err := s.AddZone(soa, []dns.RR{soa, www}); err != nil {
+		t.Fatalf("Could not add zone: %v", err)
+	}
+	if len(before.domains) != 1 || len(before.zones) != 0 {
+		t.Errorf("Expected the published snapshot to be left unchanged")
+	}
+	if err := s.AddZone(soa, nil); err == nil {
+		t.Errorf("Expected an error for a zone added twice")
+	}
+	if zone := s.Zone("WWW.example.net"); zone != soa {
+		t.Errorf("Expected the zone of www.example.net, got %v", zone)
+	}
+	if zone := s.Zone("auth.example.org."); zone != nil {
+		t.Errorf("Expected no zone for auth.example.org, got %v", zone)
+	}
+
+	if !s.RemoveZone("Example.NET") {
+		t.Errorf("Expected the zone to be removed")
+	}
+	if s.RemoveZone("example.net.") {
+		t.Errorf("Expected the zone to be removed once")
+	}
+	if _, ok := s.Get("www.example.net."); ok {
+		t.Errorf("Expected the records of the zone to be removed")
+	}
+	if records, ok := s.Get("AUTH.example.org."); !ok || len(records.Records) != 1 {
+		t.Errorf("Expected the records outside of the zone to be kept, got %v", records)
+	}
+}
+
+func TestStaticRecordsConcurrentChanges(t *testing.T) {
+	s := newStaticRecords()
+	first, _ := dns.NewRR("auth.example.org. A 192.0.2.1")
+	s.Add(first)
+	records, _ := s.Get("auth.example.org.")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				rr, _ := dns.NewRR("auth.example.org. TXT value")
+				s.Add(rr)
+				s.Get("auth.example.org.")
+			}
+		}()
+	}
+	wg.Wait()
+	if len(records.Records) != 1 {
+		t.Errorf("Expected records read earlier to be left unchanged, got %d", len(records.Records))
+	}
+	if current, _ := s.Get("auth.example.org."); len(current.Records) != 401 {
+		t.Errorf("Expected every change to be kept, got %d records", len(current.Records))
+	}
+}
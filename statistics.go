@@ -0,0 +1,298 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+)
+
+// statisticsTimeFormat is the format of the times in the BIND statistics
+const statisticsTimeFormat = "2006-01-02T15:04:05.000Z"
+
+// Counter types, named after the sections of the BIND statistics
+const (
+	statOpcode = "opcode"
+	statRcode  = "rcode"
+	statQtype  = "qtype"
+	statNS     = "nsstat"
+)
+
+// dnsStatistics counts the DNS requests and responses like the statistics channel
+// of BIND does, so that the exporters and monitoring built for BIND can be used.
+type dnsStatistics struct {
+	clock    clock
+	boot     time.Time
+	mutex    sync.Mutex
+	counters map[string]map[string]uint64
+	// sizes and latencies are the response histograms by query type and rcode
+	sizes     map[histogramKey]*histogram
+	latencies map[histogramKey]*histogram
+	// UDPPool is the UDP worker pool whose state is reported, nil if disabled
+	UDPPool *udpWorkerPool
+	// SigningAudit is the DNSSEC audit whose counters are exported, nil if disabled
+	SigningAudit *dnssecAudit
+}
+
+func newDNSStatistics(c clock) *dnsStatistics {
+	return &dnsStatistics{
+		clock:     c,
+		boot:      clockOrSystem(c).Now(),
+		counters:  make(map[string]map[string]uint64),
+		sizes:     make(map[histogramKey]*histogram),
+		latencies: make(map[histogramKey]*histogram),
+	}
+}
+
+// Record counts a request and the response it was answered with after elapsed
+func (s *dnsStatistics) Record(w dns.ResponseWriter, r *dns.Msg, m *dns.Msg, elapsed time.Duration) {
+	if s == nil {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.add(statOpcode, dns.OpcodeToString[r.Opcode])
+	for _, q := range r.Question {
+		s.add(statQtype, dns.TypeToString[q.Qtype])
+	}
+	s.add(statRcode, dns.RcodeToString[m.Rcode])
+	if len(r.Question) > 0 {
+		s.recordHistograms(r.Question[0].Qtype, m.Rcode, m.Len(), elapsed)
+	}
+	// Name server statistics
+	remote := w.RemoteAddr()
+	if ip := addrIP(remote); ip != nil && ip.To4() == nil {
+		s.add(statNS, "Requestv6")
+	} else {
+		s.add(statNS, "Requestv4")
+	}
+	if r.IsEdns0() != nil {
+		s.add(statNS, "ReqEdns0")
+	}
+	if _, ok := remote.(*net.TCPAddr); ok {
+		s.add(statNS, "ReqTCP")
+		s.add(statNS, "QryTCP")
+	} else {
+		s.add(statNS, "QryUDP")
+	}
+	s.add(statNS, "Response")
+	if m.IsEdns0() != nil {
+		s.add(statNS, "RespEDNS0")
+	}
+	if m.Truncated {
+		s.add(statNS, "TruncatedResp")
+	}
+	if m.Authoritative {
+		s.add(statNS, "QryAuthAns")
+	} else {
+		s.add(statNS, "QryNoauthAns")
+	}
+	switch {
+	case m.Rcode == dns.RcodeSuccess && len(m.Answer) > 0:
+		s.add(statNS, "QrySuccess")
+	case m.Rcode == dns.RcodeSuccess:
+		s.add(statNS, "QryNxrrset")
+	case m.Rcode == dns.RcodeNameError:
+		s.add(statNS, "QryNXDOMAIN")
+	default:
+		s.add(statNS, "QryFailure")
+	}
+}
+
+// RecordDropped counts a query dropped without being answered normally
+func (s *dnsStatistics) RecordDropped() {
+	if s == nil {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.add(statNS, "QryDropped")
+}
+
+// RecordTCPRefused counts a TCP connection closed for being over the connection limit
+func (s *dnsStatistics) RecordTCPRefused() {
+	if s == nil {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.add(statNS, "TCPConnRefused")
+}
+
+// RecordRateLimited counts a response dropped or slipped by the response rate limiter
+func (s *dnsStatistics) RecordRateLimited(counter string) {
+	if s == nil {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.add(statNS, counter)
+}
+
+// poolCounters returns the state of the UDP worker pool, nil if it's disabled
+func (s *dnsStatistics) poolCounters() map[string]uint64 {
+	if s.UDPPool == nil {
+		return nil
+	}
+	return s.UDPPool.counters()
+}
+
+func (s *dnsStatistics) add(kind string, name string) {
+	if name == "" {
+		return
+	}
+	if s.counters[kind] == nil {
+		s.counters[kind] = make(map[string]uint64)
+	}
+	s.counters[kind][name]++
+}
+
+// snapshot returns a copy of the counters of the type
+func (s *dnsStatistics) snapshot(kind string) map[string]uint64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	counters := make(map[string]uint64, len(s.counters[kind]))
+	for name, v := range s.counters[kind] {
+		counters[name] = v
+	}
+	return counters
+}
+
+// addrIP returns the IP address of a UDP or TCP address
+func addrIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return a.IP
+	case *net.TCPAddr:
+		return a.IP
+	}
+	return nil
+}
+
+// newStatisticsRouter returns the router of the read-only statistics channel,
+// serving the paths of the JSON and XML v3 statistics of BIND and the response
+// histograms for Prometheus
+func newStatisticsRouter(s *dnsStatistics) *httprouter.Router {
+	router := httprouter.New()
+	for _, path := range []string{"/json", "/json/v1", "/json/v1/server"} {
+		router.GET(path, s.serveJSON)
+	}
+	for _, path := range []string{"/", "/xml", "/xml/v3", "/xml/v3/server", "/xml/v3/status"} {
+		router.GET(path, s.serveXML)
+	}
+	router.GET("/metrics", s.serveMetrics)
+	return router
+}
+
+// serveJSON answers with the statistics in the format of the BIND JSON statistics
+func (s *dnsStatistics) serveJSON(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	boot := s.boot.UTC().Format(statisticsTimeFormat)
+	stats := struct {
+		Version     string            `json:"json-stats-version"`
+		BootTime    string            `json:"boot-time"`
+		ConfigTime  string            `json:"config-time"`
+		CurrentTime string            `json:"current-time"`
+		Server      string            `json:"version"`
+		Opcodes     map[string]uint64 `json:"opcodes"`
+		Rcodes      map[string]uint64 `json:"rcodes"`
+		Qtypes      map[string]uint64 `json:"qtypes"`
+		NSStats     map[string]uint64 `json:"nsstats"`
+		UDPPool     map[string]uint64 `json:"udppool,omitempty"`
+	}{
+		Version:     "1.2",
+		BootTime:    boot,
+		ConfigTime:  boot,
+		CurrentTime: clockOrSystem(s.clock).Now().UTC().Format(statisticsTimeFormat),
+		Server:      "acme-dns",
+		Opcodes:     s.snapshot(statOpcode),
+		Rcodes:      s.snapshot(statRcode),
+		Qtypes:      s.snapshot(statQtype),
+		NSStats:     s.snapshot(statNS),
+		UDPPool:     s.poolCounters(),
+	}
+	resp, _ := json.Marshal(stats)
+	WriteJsonResponse(w, http.StatusOK, resp)
+}
+
+// xmlCounters is a counters element of the BIND XML v3 statistics
+type xmlCounters struct {
+	Type     string       `xml:"type,attr"`
+	Counters []xmlCounter `xml:"counter"`
+}
+
+type xmlCounter struct {
+	Name  string `xml:"name,attr"`
+	Value uint64 `xml:",chardata"`
+}
+
+// serveXML answers with the statistics in the format of the BIND XML v3 statistics
+func (s *dnsStatistics) serveXML(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	boot := s.boot.UTC().Format(statisticsTimeFormat)
+	type server struct {
+		BootTime    string        `xml:"boot-time"`
+		ConfigTime  string        `xml:"config-time"`
+		CurrentTime string        `xml:"current-time"`
+		Version     string        `xml:"version"`
+		Counters    []xmlCounters `xml:"counters"`
+	}
+	stats := struct {
+		XMLName xml.Name `xml:"statistics"`
+		Version string   `xml:"version,attr"`
+		Server  server   `xml:"server"`
+		Views   struct{} `xml:"views"`
+	}{
+		Version: "3.8",
+		Server: server{
+			BootTime:    boot,
+			ConfigTime:  boot,
+			CurrentTime: clockOrSystem(s.clock).Now().UTC().Format(statisticsTimeFormat),
+			Version:     "acme-dns",
+		},
+	}
+	for _, kind := range []string{statOpcode, statRcode, statQtype, statNS} {
+		counters := xmlCounters{Type: kind}
+		for name, v := range s.snapshot(kind) {
+			counters.Counters = append(counters.Counters, xmlCounter{name, v})
+		}
+		sort.Slice(counters.Counters, func(i, j int) bool { return counters.Counters[i].Name < counters.Counters[j].Name })
+		stats.Server.Counters = append(stats.Server.Counters, counters)
+	}
+	if pool := s.poolCounters(); pool != nil {
+		counters := xmlCounters{Type: "udppool"}
+		for name, v := range pool {
+			counters.Counters = append(counters.Counters, xmlCounter{name, v})
+		}
+		sort.Slice(counters.Counters, func(i, j int) bool { return counters.Counters[i].Name < counters.Counters[j].Name })
+		stats.Server.Counters = append(stats.Server.Counters, counters)
+	}
+	out, err := xml.MarshalIndent(stats, "", "  ")
+	if err != nil {
+		apiLog.WithFields(log.Fields{"error": err.Error()}).Error("Could not write statistics")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/xml; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write([]byte(xml.Header))
+	_, _ = w.Write(out)
+}
+
+// startStatistics serves the statistics channel on its own listener
+func startStatistics(errChan chan error, addr string, s *dnsStatistics) {
+	apiLog.WithFields(log.Fields{"addr": addr}).Info("Listening statistics channel")
+	srv := &http.Server{
+		Addr:              addr,
+		Handler:           newStatisticsRouter(s),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	if err := srv.ListenAndServe(); err != nil {
+		errChan <- err
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestStatisticsChannel(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Could not listen [%v]", err)
+	}
+	config := Config
+	config.General.Listen = conn.LocalAddr().String()
+	config.General.AdditionalListen = nil
+	config.General.Proto = "udp"
+	config.General.Domain = "auth.example.org"
+	config.General.StaticRecords = []string{"auth.example.org. A 192.0.2.1"}
+	config.Statistics.Listen = "127.0.0.1:8053"
+	conn.Close()
+	server := newDNSServers(DB, config)[0]
+	if server.Stats == nil {
+		t.Fatalf("Expected the statistics to be enabled")
+	}
+	started := make(chan struct{})
+	server.Server.NotifyStartedFunc = func() { close(started) }
+	go server.Start(make(chan error, 1))
+	defer server.Server.Shutdown()
+	<-started
+
+	for _, name := range []string{"auth.example.org.", "nonexistent.auth.example.org."} {
+		msg := new(dns.Msg)
+		msg.SetQuestion(name, dns.TypeA)
+		if _, _, err := new(dns.Client).Exchange(msg, config.General.Listen); err != nil {
+			t.Fatalf("Got unexpected error [%v]", err)
+		}
+	}
+	router := newStatisticsRouter(server.Stats)
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/json/v1/server", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", w.Code)
+	}
+	var stats struct {
+		Version string            `json:"json-stats-version"`
+		Opcodes map[string]uint64 `json:"opcodes"`
+		Rcodes  map[string]uint64 `json:"rcodes"`
+		Qtypes  map[string]uint64 `json:"qtypes"`
+		NSStats map[string]uint64 `json:"nsstats"`
+	}
+	if err = json.Unmarshal(w.Body.Bytes(), &stats); err != nil {
+		t.Fatalf("Could not parse the JSON statistics [%v]", err)
+	}
+	for _, test := range []struct {
+		counters map[string]uint64
+		name     string
+		value    uint64
+	}{
+		{stats.Opcodes, "QUERY", 2},
+		{stats.Qtypes, "A", 2},
+		{stats.Rcodes, "NOERROR", 1},
+		{stats.Rcodes, "NXDOMAIN", 1},
+		{stats.NSStats, "Requestv4", 2},
+		{stats.NSStats, "QryUDP", 2},
+		{stats.NSStats, "QryAuthAns", 2},
+		{stats.NSStats, "QrySuccess", 1},
+		{stats.NSStats, "QryNXDOMAIN", 1},
+	} {
+		if test.counters[test.name] != test.value {
+			t.Errorf("Expected counter %s to be %d, got %d", test.name, test.value, test.counters[test.name])
+		}
+	}
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/xml/v3/server", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", w.Code)
+	}
+	var doc struct {
+		Version  string        `xml:"version,attr"`
+		Counters []xmlCounters `xml:"server>counters"`
+	}
+	if err = xml.Unmarshal(w.Body.Bytes(), &doc); err != nil {
+		t.Fatalf("Could not parse the XML statistics [%v]", err)
+	}
+	found := false
+	for _, counters := range doc.Counters {
+		for _, c := range counters.Counters {
+			if counters.Type == "rcode" && c.Name == "NXDOMAIN" && c.Value == 1 {
+				found = true
+			}
+		}
+	}
+	if doc.Version != "3.8" || len(doc.Counters) != 4 || !found {
+		t.Errorf("Unexpected XML statistics %s", w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/json/v1/server", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected the statistics channel to be read-only, got %d", w.Code)
+	}
+}
+
+func TestStatisticsHistograms(t *testing.T) {
+	s := newDNSStatistics(nil)
+	s.recordHistograms(dns.TypeTXT, dns.RcodeSuccess, 100, 300*time.Microsecond)
+	s.recordHistograms(dns.TypeTXT, dns.RcodeSuccess, 600, 2*time.Second)
+	s.recordHistograms(dns.TypeA, dns.RcodeNameError, 50, 50*time.Microsecond)
+
+	w := httptest.NewRecorder()
+	newStatisticsRouter(s).ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", w.Code)
+	}
+	body := w.Body.String()
+	for _, line := range []string{
+		"# TYPE acmedns_dns_response_size_bytes histogram",
+		`acmedns_dns_response_size_bytes_bucket{qtype="TXT",rcode="NOERROR",le="64"} 0`,
+		`acmedns_dns_response_size_bytes_bucket{qtype="TXT",rcode="NOERROR",le="128"} 1`,
+		`acmedns_dns_response_size_bytes_bucket{qtype="TXT",rcode="NOERROR",le="1232"} 2`,
+		`acmedns_dns_response_size_bytes_sum{qtype="TXT",rcode="NOERROR"} 700`,
+		`acmedns_dns_response_size_bytes_count{qtype="A",rcode="NXDOMAIN"} 1`,
+		`acmedns_dns_handler_duration_seconds_bucket{qtype="TXT",rcode="NOERROR",le="0.0005"} 1`,
+		// Observations above the highest bucket are only in +Inf
+		`acmedns_dns_handler_duration_seconds_bucket{qtype="TXT",rcode="NOERROR",le="1"} 1`,
+		`acmedns_dns_handler_duration_seconds_bucket{qtype="TXT",rcode="NOERROR",le="+Inf"} 2`,
+		`acmedns_dns_handler_duration_seconds_bucket{qtype="A",rcode="NXDOMAIN",le="0.0001"} 1`,
+	} {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("Expected the line %s in the metrics:\n%s", line, body)
+		}
+	}
+}
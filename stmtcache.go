@@ -0,0 +1,62 @@
+package main
+
+import (
+	"database/sql"
+	"sync"
+)
+
+// stmtCache keeps the prepared statements of the hot query paths keyed by their SQL
+// text. database/sql prepares a cached statement once on each connection it runs on,
+// instead of on every query.
+type stmtCache struct {
+	mutex sync.Mutex
+	db    *sql.DB
+	stmts map[string]*sql.Stmt
+}
+
+// prepare returns the cached statement for the query, preparing it on a miss. The
+// cache is emptied when the database handle is replaced.
+func (c *stmtCache) prepare(db *sql.DB, query string) (*sql.Stmt, error) {
+	c.mutex.Lock()
+	if c.db == db {
+		if stmt, ok := c.stmts[query]; ok {
+			c.mutex.Unlock()
+			return stmt, nil
+		}
+	}
+	c.mutex.Unlock()
+	// Prepare without holding the lock, as it may take a round trip to the database
+	stmt, err := db.Prepare(query)
+	if err != nil {
+		return nil, err
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.db != db {
+		c.reset(db)
+	}
+	if cached, ok := c.stmts[query]; ok {
+		// Prepared concurrently by another caller
+		stmt.Close()
+		return cached, nil
+	}
+	c.stmts[query] = stmt
+	return stmt, nil
+}
+
+// reset closes the cached statements and ties the cache to db, the caller must hold
+// the mutex
+func (c *stmtCache) reset(db *sql.DB) {
+	for _, stmt := range c.stmts {
+		stmt.Close()
+	}
+	c.db = db
+	c.stmts = make(map[string]*sql.Stmt)
+}
+
+// close closes the cached statements
+func (c *stmtCache) close() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.reset(nil)
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"database/sql"
+	"sync"
+	"testing"
+)
+
+func TestStmtCache(t *testing.T) {
+	db, _ := sql.Open("sqlite3", ":memory:")
+	defer db.Close()
+	var c stmtCache
+	first, err := c.prepare(db, "SELECT 1")
+	if err != nil {
+		t.Fatalf("Could not prepare statement: %v", err)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if stmt, _ := c.prepare(db, "SELECT 1"); stmt != first {
+				t.Errorf("Expected the cached statement to be reused")
+			}
+		}()
+	}
+	wg.Wait()
+	if other, _ := c.prepare(db, "SELECT 2"); other == first {
+		t.Errorf("Expected a statement of its own for a different query")
+	}
+	if _, err = c.prepare(db, "SELECT FROM"); err == nil {
+		t.Errorf("Expected an error for an invalid query")
+	}
+
+	// Replacing the database handle empties the cache
+	replaced, _ := sql.Open("sqlite3", ":memory:")
+	defer replaced.Close()
+	stmt, err := c.prepare(replaced, "SELECT 1")
+	if err != nil || stmt == first {
+		t.Errorf("Expected the statement to be prepared on the new handle, got error %v", err)
+	}
+	if len(c.stmts) != 1 {
+		t.Errorf("Expected the statements of the old handle to be dropped, got %d", len(c.stmts))
+	}
+	c.close()
+	var v int
+	if err = stmt.QueryRow().Scan(&v); err == nil {
+		t.Errorf("Expected the statement to be closed")
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"hash/fnv"
+	"sync"
+)
+
+// lockStripes is the number of locks the subdomains are spread over
+const lockStripes = 64
+
+// stripedLock is a set of read-write locks keyed by subdomain. The subdomain is
+// hashed to pick the lock, so operations on unrelated subdomains rarely wait for
+// each other, while operations on the same subdomain are always serialized.
+type stripedLock struct {
+	stripes [lockStripes]sync.RWMutex
+}
+
+// stripe returns the lock for the key
+func (l *stripedLock) stripe(key string) *sync.RWMutex {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(key))
+	return &l.stripes[h.Sum32()%lockStripes]
+}
+
+// Lock locks the stripe of the key for writing
+func (l *stripedLock) Lock(key string) {
+	l.stripe(key).Lock()
+}
+
+// Unlock unlocks the stripe of the key for writing
+func (l *stripedLock) Unlock(key string) {
+	l.stripe(key).Unlock()
+}
+
+// RLock locks the stripe of the key for reading
+func (l *stripedLock) RLock(key string) {
+	l.stripe(key).RLock()
+}
+
+// RUnlock unlocks the stripe of the key for reading
+func (l *stripedLock) RUnlock(key string) {
+	l.stripe(key).RUnlock()
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestStripedLock(t *testing.T) {
+	var l stripedLock
+	if l.stripe("subdomain") != l.stripe("subdomain") {
+		t.Errorf("Expected the same key to always map to the same stripe")
+	}
+	// Find a key living in another stripe
+	other := ""
+	for i := 0; other == ""; i++ {
+		key := fmt.Sprintf("other-%d", i)
+		if l.stripe(key) != l.stripe("subdomain") {
+			other = key
+		}
+	}
+
+	l.Lock("subdomain")
+	done := make(chan struct{})
+	go func() {
+		l.RLock(other)
+		l.RUnlock(other)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("Locking an unrelated key should not block")
+	}
+
+	locked := make(chan struct{})
+	go func() {
+		l.RLock("subdomain")
+		l.RUnlock("subdomain")
+		close(locked)
+	}()
+	select {
+	case <-locked:
+		t.Errorf("Reading the same key should wait for the writer")
+	case <-time.After(50 * time.Millisecond):
+	}
+	l.Unlock("subdomain")
+	<-locked
+}
+
+// benchmarkLocking runs a critical section simulating a database round trip
+// for a set of subdomains in parallel
+func benchmarkLocking(b *testing.B, lock func(string), unlock func(string)) {
+	b.SetParallelism(16)
+	var mu sync.Mutex
+	n := 0
+	b.RunParallel(func(pb *testing.PB) {
+		mu.Lock()
+		n++
+		key := fmt.Sprintf("subdomain-%d", n)
+		mu.Unlock()
+		for pb.Next() {
+			lock(key)
+			time.Sleep(50 * time.Microsecond)
+			unlock(key)
+		}
+	})
+}
+
+func BenchmarkGlobalMutex(b *testing.B) {
+	var mu sync.Mutex
+	benchmarkLocking(b, func(string) { mu.Lock() }, func(string) { mu.Unlock() })
+}
+
+func BenchmarkStripedLock(b *testing.B) {
+	var l stripedLock
+	benchmarkLocking(b, l.Lock, l.Unlock)
+}
+
+// BenchmarkCachedLookupsParallel measures lookups of different subdomains served
+// from the record cache, which no longer wait for each other
+func BenchmarkCachedLookupsParallel(b *testing.B) {
+	adb := DB.(*acmedb)
+	oldCache := adb.recordCache
+	adb.recordCache = newRecordCache(time.Hour, adb)
+	defer func() { adb.recordCache = oldCache }()
+	var subdomains []string
+	for i := 0; i < 64; i++ {
+		reg, err := DB.Register(cidrslice{}, registrationOrigin{}, ACMETxtPost{})
+		if err != nil {
+			b.Fatalf("Registration failed, got error [%v]", err)
+		}
+		subdomains = append(subdomains, reg.Subdomain)
+	}
+	var mu sync.Mutex
+	n := 0
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		mu.Lock()
+		subdomain := subdomains[n%len(subdomains)]
+		n++
+		mu.Unlock()
+		for pb.Next() {
+			_, _ = DB.GetTXTForDomain(subdomain)
+		}
+	})
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// tcpConnLimit bounds the number of connections open at once to the TCP and
+// DNS-over-TLS listeners, which share the limit as they share the file
+// descriptors of the process. Connections arriving over the limit are closed
+// right away, so that a flood of connections held open can't take them all.
+type tcpConnLimit struct {
+	slots   chan struct{}
+	stats   *dnsStatistics
+	refused uint64
+}
+
+func newTCPConnLimit(max int, stats *dnsStatistics) *tcpConnLimit {
+	return &tcpConnLimit{slots: make(chan struct{}, max), stats: stats}
+}
+
+// Listener returns the listener accepting connections within the limit
+func (t *tcpConnLimit) Listener(l net.Listener) net.Listener {
+	return &limitedListener{Listener: l, limit: t}
+}
+
+// Open returns the number of connections open
+func (t *tcpConnLimit) Open() int {
+	return len(t.slots)
+}
+
+// Refused returns the number of connections closed for being over the limit
+func (t *tcpConnLimit) Refused() uint64 {
+	return atomic.LoadUint64(&t.refused)
+}
+
+// refuse closes the connection over the limit
+func (t *tcpConnLimit) refuse(c net.Conn) {
+	_ = c.Close()
+	refused := atomic.AddUint64(&t.refused, 1)
+	t.stats.RecordTCPRefused()
+	if refused&(refused-1) == 0 {
+		// Log with exponentially decreasing frequency during a flood
+		dnsLog.WithFields(log.Fields{"refused": refused, "max": cap(t.slots), "remote": c.RemoteAddr().String()}).Warn("Too many TCP connections, refusing connections")
+	}
+}
+
+type limitedListener struct {
+	net.Listener
+	limit *tcpConnLimit
+}
+
+func (l *limitedListener) Accept() (net.Conn, error) {
+	for {
+		c, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		select {
+		case l.limit.slots <- struct{}{}:
+			return &limitedConn{Conn: c, limit: l.limit}, nil
+		default:
+			l.limit.refuse(c)
+		}
+	}
+}
+
+// limitedConn gives back its slot once closed
+type limitedConn struct {
+	net.Conn
+	limit *tcpConnLimit
+	once  sync.Once
+}
+
+func (c *limitedConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(func() { <-c.limit.slots })
+	return err
+}
+
+// listenLimited listens on the TCP or DNS-over-TLS address of the server with the
+// connection limit, which the DNS library can't do by itself
+func (d *DNSServer) listenLimited() (net.Listener, error) {
+	addr := d.Server.Addr
+	if addr == "" {
+		addr = ":domain"
+	}
+	network := strings.TrimSuffix(d.Server.Net, "-tls")
+	l, err := net.Listen(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	l = d.TCPLimit.Listener(l)
+	if network != d.Server.Net {
+		if d.Server.TLSConfig == nil {
+			_ = l.Close()
+			return nil, errors.New("no TLS certificate for the DNS-over-TLS listener")
+		}
+		l = tls.NewListener(l, d.Server.TLSConfig)
+	}
+	return l, nil
+}
+
+// drainDNSServers stops the servers from accepting queries and waits up to the
+// timeout for the TCP connections to answer the queries they have read. Idle
+// connections are closed right away.
+func drainDNSServers(servers []*DNSServer, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	var wg sync.WaitGroup
+	for _, server := range servers {
+		wg.Add(1)
+		go func(server *DNSServer) {
+			defer wg.Done()
+			if err := server.Server.ShutdownContext(ctx); err != nil {
+				dnsLog.WithFields(log.Fields{"addr": server.Server.Addr, "proto": server.Server.Net, "error": err.Error()}).Warn("DNS listener not drained")
+			}
+		}(server)
+	}
+	wg.Wait()
+}
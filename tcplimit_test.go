@@ -0,0 +1,129 @@
+package main
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestTCPConnLimit(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Could not listen: %v", err)
+	}
+	stats := newDNSStatistics(nil)
+	limit := newTCPConnLimit(1, stats)
+	limited := limit.Listener(l)
+	defer limited.Close()
+	accepted := make(chan net.Conn, 2)
+	go func() {
+		for {
+			c, err := limited.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- c
+		}
+	}()
+
+	first, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("Could not connect: %v", err)
+	}
+	defer first.Close()
+	conn := <-accepted
+	second, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("Could not connect: %v", err)
+	}
+	defer second.Close()
+	_ = second.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err = second.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("Expected the connection over the limit to be closed, got %v", err)
+	}
+	if limit.Open() != 1 || limit.Refused() != 1 || stats.snapshot(statNS)["TCPConnRefused"] != 1 {
+		t.Errorf("Expected 1 open and 1 refused connection, got %d and %d", limit.Open(), limit.Refused())
+	}
+
+	// Closing a connection frees its slot, once
+	_ = conn.Close()
+	_ = conn.Close()
+	if limit.Open() != 0 {
+		t.Errorf("Expected no open connection, got %d", limit.Open())
+	}
+	third, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("Could not connect: %v", err)
+	}
+	defer third.Close()
+	select {
+	case c := <-accepted:
+		_ = c.Close()
+	case <-time.After(5 * time.Second):
+		t.Errorf("Expected the connection to be accepted after a slot was freed")
+	}
+}
+
+func TestDrainDNSServers(t *testing.T) {
+	free, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Could not listen: %v", err)
+	}
+	addr := free.Addr().String()
+	_ = free.Close()
+	server := NewDNSServer(DB, addr, "tcp", "auth.example.org")
+	server.Domains = dnsserver.Domains
+	server.SOA = dnsserver.SOA
+	server.TCPLimit = newTCPConnLimit(4, nil)
+	server.Server.IdleTimeout = func() time.Duration { return time.Minute }
+	started := make(chan struct{})
+	server.Server.NotifyStartedFunc = func() { close(started) }
+	errChan := make(chan error, 1)
+	stopped := make(chan struct{})
+	go func() {
+		server.Start(errChan)
+		close(stopped)
+	}()
+	select {
+	case <-started:
+	case err = <-errChan:
+		t.Fatalf("Could not start the server: %v", err)
+	}
+
+	// An idle connection doesn't hold up the shutdown
+	c, err := dns.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Could not connect: %v", err)
+	}
+	defer c.Close()
+	req := new(dns.Msg)
+	req.SetQuestion("auth.example.org.", dns.TypeSOA)
+	if err = c.WriteMsg(req); err != nil {
+		t.Fatalf("Could not send the query: %v", err)
+	}
+	if m, err := c.ReadMsg(); err != nil || len(m.Answer) != 1 {
+		t.Fatalf("Expected the SOA record, got %v, %v", m, err)
+	}
+	if server.TCPLimit.Open() != 1 {
+		t.Errorf("Expected the connection to be counted, got %d", server.TCPLimit.Open())
+	}
+	start := time.Now()
+	drainDNSServers([]*DNSServer{server}, 5*time.Second)
+	if elapsed := time.Since(start); elapsed > 4*time.Second {
+		t.Errorf("Expected the idle connection to be closed right away, took %v", elapsed)
+	}
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected the server to stop")
+	}
+	if server.TCPLimit.Open() != 0 {
+		t.Errorf("Expected the connection to be closed, got %d open", server.TCPLimit.Open())
+	}
+	if _, err = net.Dial("tcp", addr); err == nil {
+		t.Errorf("Expected the listener to be closed")
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	log "github.com/sirupsen/logrus"
+)
+
+// UpdateThrottle enforces the minimum interval between the updates of a
+// subdomain, nil if disabled
+var UpdateThrottle *updateThrottle
+
+// updateThrottle remembers the time of the latest update of each subdomain, so
+// that clients updating in a tight loop don't load the database and the webhook
+// receivers
+type updateThrottle struct {
+	clock    clock
+	interval time.Duration
+	mutex    sync.Mutex
+	updated  map[string]time.Time
+	swept    time.Time
+}
+
+func newUpdateThrottle(interval time.Duration, c clock) *updateThrottle {
+	return &updateThrottle{
+		clock:    c,
+		interval: interval,
+		updated:  make(map[string]time.Time),
+		swept:    clockOrSystem(c).Now(),
+	}
+}
+
+// Wait returns how long the subdomain has to wait for its next update, zero if
+// it can be updated now
+func (t *updateThrottle) Wait(subdomain string) time.Duration {
+	if t == nil {
+		return 0
+	}
+	now := clockOrSystem(t.clock).Now()
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	last, ok := t.updated[subdomain]
+	if !ok || now.Sub(last) >= t.interval {
+		return 0
+	}
+	return t.interval - now.Sub(last)
+}
+
+// Updated records an update of the subdomain
+func (t *updateThrottle) Updated(subdomain string) {
+	if t == nil {
+		return
+	}
+	now := clockOrSystem(t.clock).Now()
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.updated[subdomain] = now
+	if now.Sub(t.swept) >= rateLimitSweepInterval {
+		// Forget the subdomains that can be updated again
+		for s, last := range t.updated {
+			if now.Sub(last) >= t.interval {
+				delete(t.updated, s)
+			}
+		}
+		t.swept = now
+	}
+}
+
+// throttled returns middleware answering 429 Too Many Requests to updates of a
+// subdomain updated less than the minimum interval ago. It runs after the
+// authentication middleware, and only successful updates start the interval.
+func throttled(handler httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		user, ok := r.Context().Value(ACMETxtKey).(ACMETxt)
+		if UpdateThrottle == nil || !ok {
+			handler(w, r, p)
+			return
+		}
+		if wait := UpdateThrottle.Wait(user.Subdomain); wait > 0 {
+			apiLog.WithFields(log.Fields{"subdomain": user.Subdomain, "wait": wait.String()}).Debug("Update within the minimum update interval")
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			WriteJsonResponse(w, http.StatusTooManyRequests, jsonError("update_too_frequent"))
+			return
+		}
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		handler(sw, r, p)
+		if sw.status < http.StatusBadRequest {
+			UpdateThrottle.Updated(user.Subdomain)
+		}
+	}
+}
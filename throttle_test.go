@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+func TestUpdateThrottle(t *testing.T) {
+	clk := newFrozenClock(time.Unix(1700000000, 0))
+	throttle := newUpdateThrottle(10*time.Second, clk)
+	if wait := throttle.Wait("sub"); wait != 0 {
+		t.Errorf("Expected a subdomain without updates to be updatable, got wait %v", wait)
+	}
+	throttle.Updated("sub")
+	clk.Advance(4 * time.Second)
+	if wait := throttle.Wait("sub"); wait != 6*time.Second {
+		t.Errorf("Expected to wait 6s, got %v", wait)
+	}
+	if wait := throttle.Wait("other"); wait != 0 {
+		t.Errorf("Expected the other subdomains to be updatable, got wait %v", wait)
+	}
+	clk.Advance(6 * time.Second)
+	if wait := throttle.Wait("sub"); wait != 0 {
+		t.Errorf("Expected the subdomain to be updatable after the interval, got wait %v", wait)
+	}
+	clk.Advance(rateLimitSweepInterval)
+	throttle.Updated("other")
+	if _, ok := throttle.updated["sub"]; ok {
+		t.Errorf("Expected the subdomains that can be updated again to be swept")
+	}
+	var nilThrottle *updateThrottle
+	if nilThrottle.Wait("sub") != 0 {
+		t.Errorf("Expected a disabled throttle to allow all updates")
+	}
+}
+
+func TestThrottledMiddleware(t *testing.T) {
+	clk := newFrozenClock(time.Unix(1700000000, 0))
+	oldThrottle := UpdateThrottle
+	UpdateThrottle = newUpdateThrottle(30*time.Second, clk)
+	defer func() { UpdateThrottle = oldThrottle }()
+	status := http.StatusOK
+	handler := throttled(func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		w.WriteHeader(status)
+	})
+	update := func() *httptest.ResponseRecorder {
+		user := ACMETxt{ACMETxtPost: ACMETxtPost{Subdomain: "sub"}}
+		r := httptest.NewRequest("POST", "/update", nil)
+		r = r.WithContext(context.WithValue(r.Context(), ACMETxtKey, user))
+		w := httptest.NewRecorder()
+		handler(w, r, nil)
+		return w
+	}
+
+	// Failed updates don't start the interval
+	status = http.StatusBadRequest
+	if w := update(); w.Code != http.StatusBadRequest {
+		t.Fatalf("Expected the handler to answer, got %d", w.Code)
+	}
+	status = http.StatusOK
+	if w := update(); w.Code != http.StatusOK {
+		t.Fatalf("Expected the update to be allowed, got %d", w.Code)
+	}
+	clk.Advance(20500 * time.Millisecond)
+	w := update()
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("Expected 429 within the interval, got %d", w.Code)
+	}
+	if retry := w.Header().Get("Retry-After"); retry != "10" {
+		t.Errorf("Expected Retry-After to be rounded up to 10, got %q", retry)
+	}
+	clk.Advance(10 * time.Second)
+	if w := update(); w.Code != http.StatusOK {
+		t.Errorf("Expected the update to be allowed after the interval, got %d", w.Code)
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+)
+
+// transactionTypes are the record types a transaction can change, in the order
+// of the change set
+var transactionTypes = []uint16{dns.TypeTXT, dns.TypeA, dns.TypeAAAA}
+
+// errTooManyTXT is returned by the changes of transactions leaving more TXT values
+// than there are TXT slots
+var errTooManyTXT = errors.New("more txt values than txt slots")
+
+// transactionOperation is a change of the records of a type: set replaces all the
+// records of the type with the values, add and remove add or remove the values
+type transactionOperation struct {
+	Op     string   `json:"op"`
+	Type   string   `json:"type"`
+	Values []string `json:"values"`
+}
+
+// transactionRequest is the payload of the transaction endpoint
+type transactionRequest struct {
+	Operations []transactionOperation `json:"operations"`
+}
+
+// recordChange is a record added or removed by a transaction
+type recordChange struct {
+	Change string `json:"change"`
+	Type   string `json:"type"`
+	Value  string `json:"value"`
+}
+
+// transactionType returns the record type of the name in the operations
+func transactionType(name string) (uint16, bool) {
+	for _, rrtype := range transactionTypes {
+		if updateTypes[rrtype] == name {
+			return rrtype, true
+		}
+	}
+	return 0, false
+}
+
+// validateTransaction validates the operations and normalizes their values,
+// returning the error code of the first invalid one with the details of all of them
+func validateTransaction(user ACMETxt, ops []transactionOperation) (int, string, []fieldError) {
+	if len(ops) == 0 || len(ops) > maxBatchUpdates {
+		return http.StatusBadRequest, "bad_request", []fieldError{{"operations", fmt.Sprintf("must have between 1 and %d operations", maxBatchUpdates)}}
+	}
+	status, code := 0, ""
+	var details []fieldError
+	fail := func(s int, c string, d ...fieldError) {
+		if code == "" {
+			status, code = s, c
+		}
+		details = append(details, d...)
+	}
+	for i := range ops {
+		op := &ops[i]
+		field := fmt.Sprintf("operations[%d]", i)
+		switch op.Op {
+		case "set":
+		case "add", "remove":
+			if len(op.Values) == 0 {
+				fail(http.StatusBadRequest, "bad_request", fieldError{field + ".values", "at least one value is required"})
+			}
+		default:
+			fail(http.StatusBadRequest, "bad_request", fieldError{field + ".op", "must be set, add or remove"})
+		}
+		if _, ok := transactionType(op.Type); !ok {
+			fail(http.StatusBadRequest, "bad_request", fieldError{field + ".type", "must be txt, a or aaaa"})
+			continue
+		}
+		if !user.allowedType(op.Type) {
+			fail(http.StatusForbidden, "record_type_not_allowed", fieldError{field + ".type", "record type not allowed for this registration"})
+			continue
+		}
+		for j := range op.Values {
+			post := ACMETxtPost{}
+			switch op.Type {
+			case "txt":
+				post.Value = op.Values[j]
+			case "a":
+				post.AValues = []string{op.Values[j]}
+			case "aaaa":
+				post.AAAAValues = []string{op.Values[j]}
+			}
+			if c, d := validateRecordValues(&post); c != "" {
+				fail(http.StatusBadRequest, c, fieldError{fmt.Sprintf("%s.values[%d]", field, j), d[0].Message})
+				continue
+			}
+			switch op.Type {
+			case "a":
+				op.Values[j] = post.AValues[0]
+			case "aaaa":
+				op.Values[j] = post.AAAAValues[0]
+			}
+		}
+	}
+	return status, code, details
+}
+
+// applyOperations applies the operations in order to the current values and
+// returns the resulting values
+func applyOperations(current map[uint16][]string, ops []transactionOperation) map[uint16][]string {
+	values := copyValues(current)
+	for _, op := range ops {
+		rrtype, _ := transactionType(op.Type)
+		if op.Op == "set" {
+			values[rrtype] = nil
+		}
+		for _, v := range op.Values {
+			if op.Op == "remove" {
+				values[rrtype] = removeString(values[rrtype], v)
+			} else if !containsString(values[rrtype], v) {
+				values[rrtype] = append(values[rrtype], v)
+			}
+		}
+	}
+	return values
+}
+
+// changeSet lists the records removed and added by changing the current values
+func changeSet(current map[uint16][]string, values map[uint16][]string) []recordChange {
+	changes := []recordChange{}
+	for _, rrtype := range transactionTypes {
+		for _, v := range current[rrtype] {
+			if !containsString(values[rrtype], v) {
+				changes = append(changes, recordChange{"remove", updateTypes[rrtype], v})
+			}
+		}
+		for _, v := range values[rrtype] {
+			if !containsString(current[rrtype], v) {
+				changes = append(changes, recordChange{"add", updateTypes[rrtype], v})
+			}
+		}
+	}
+	return changes
+}
+
+// webTransactionPost applies the operations on the records of the authenticated
+// registration in a single transaction, so that either all of them or none take
+// effect, and answers with the records added and removed
+func webTransactionPost(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	user, ok := r.Context().Value(ACMETxtKey).(ACMETxt)
+	if !ok {
+		apiLog.WithFields(log.Fields{"error": "context"}).Error("Context error")
+		WriteJsonResponse(w, http.StatusInternalServerError, jsonError("context_error"))
+		return
+	}
+	var req transactionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		WriteJsonResponse(w, http.StatusBadRequest, jsonFieldErrors("malformed_json_payload", decodeErrorDetails(err)))
+		return
+	}
+	if status, code, details := validateTransaction(user, req.Operations); code != "" {
+		apiLog.WithFields(log.Fields{"error": code, "subdomain": user.Subdomain, "operations": len(req.Operations)}).Debug("Bad transaction data")
+		WriteJsonResponse(w, status, jsonFieldErrors(code, details))
+		return
+	}
+	if isProtected(user.Subdomain) {
+		// Approvals are given to single updates
+		WriteJsonResponse(w, http.StatusForbidden, jsonError("approval_required"))
+		return
+	}
+	var current, values map[uint16][]string
+	updated, err := DB.ChangeValues(user.Subdomain, func(c map[uint16][]string) ([]ACMETxtPost, error) {
+		current, values = c, applyOperations(c, req.Operations)
+		if len(values[dns.TypeTXT]) > txtSlotCount() {
+			return nil, errTooManyTXT
+		}
+		return valueUpdates(user.Subdomain, current, values), nil
+	})
+	if err == errTooManyTXT {
+		WriteJsonResponse(w, http.StatusBadRequest, jsonFieldErrors("bad_txt", []fieldError{{"operations", fmt.Sprintf("at most %d txt values can be served at once", txtSlotCount())}}))
+		return
+	}
+	if err == errDatabaseBusy {
+		w.Header().Set("Retry-After", "1")
+		WriteJsonResponse(w, http.StatusServiceUnavailable, jsonError("database_busy"))
+		return
+	}
+	if err != nil {
+		apiLog.WithFields(log.Fields{"error": err.Error(), "subdomain": user.Subdomain}).Debug("Error while trying to apply a transaction")
+		WriteJsonResponse(w, http.StatusInternalServerError, jsonError("db_error"))
+		return
+	}
+	if len(updated) > 0 {
+		if err = DB.MarkActive(user.Username); err != nil {
+			apiLog.WithFields(log.Fields{"error": err.Error(), "subdomain": user.Subdomain}).Error("Could not update the last active time")
+		}
+		for _, a := range updated {
+			event := webhookEvent{"update", a.Subdomain, a.Value, a.AValues, a.AAAAValues, time.Now().Unix(), "", registrationZone(user)}
+			sendWebhooks(user.Webhooks, event)
+			runHooks(event)
+		}
+		ZoneSerial.Bump("transaction", user.Subdomain)
+	}
+	changes := changeSet(current, values)
+	apiLog.WithFields(log.Fields{"subdomain": user.Subdomain, "changes": len(changes)}).Debug("Transaction applied")
+	resp, _ := json.Marshal(struct {
+		Changes []recordChange `json:"changes"`
+	}{changes})
+	WriteJsonResponse(w, http.StatusOK, resp)
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/miekg/dns"
+)
+
+// tsigAlgorithms are the supported TSIG algorithms by their configured names
+var tsigAlgorithms = map[string]string{
+	"hmac-sha1":   dns.HmacSHA1,
+	"hmac-sha256": dns.HmacSHA256,
+	"hmac-sha384": dns.HmacSHA384,
+	"hmac-sha512": dns.HmacSHA512,
+}
+
+// tsigKeyring holds the TSIG keys the nameserver accepts signed requests with,
+// with the algorithm each key is restricted to and the account it updates
+type tsigKeyring struct {
+	secrets    map[string]string
+	algorithms map[string]string
+	accounts   map[string]uuid.UUID
+}
+
+// newTSIGKeyring validates the configured keys and returns their keyring
+func newTSIGKeyring(keys []tsigKey) (*tsigKeyring, error) {
+	k := &tsigKeyring{secrets: make(map[string]string), algorithms: make(map[string]string), accounts: make(map[string]uuid.UUID)}
+	for _, key := range keys {
+		name := strings.ToLower(dns.Fqdn(key.Name))
+		if _, ok := dns.IsDomainName(name); key.Name == "" || !ok {
+			return nil, fmt.Errorf("TSIG key name %q is not a valid domain name", key.Name)
+		}
+		if _, ok := k.secrets[name]; ok {
+			return nil, fmt.Errorf("TSIG key %s is configured more than once", name)
+		}
+		algorithm := strings.ToLower(strings.TrimSuffix(key.Algorithm, "."))
+		if algorithm == "" {
+			algorithm = "hmac-sha256"
+		}
+		if _, ok := tsigAlgorithms[algorithm]; !ok {
+			return nil, fmt.Errorf("unsupported algorithm %q of TSIG key %s, must be hmac-sha1, hmac-sha256, hmac-sha384 or hmac-sha512", key.Algorithm, name)
+		}
+		if secret, err := base64.StdEncoding.DecodeString(key.Secret); err != nil || len(secret) == 0 {
+			return nil, fmt.Errorf("the secret of TSIG key %s is not valid base64", name)
+		}
+		if key.Account != "" {
+			account, err := uuid.Parse(key.Account)
+			if err != nil {
+				return nil, fmt.Errorf("the account %q of TSIG key %s is not a valid username", key.Account, name)
+			}
+			k.accounts[name] = account
+		}
+		k.secrets[name] = key.Secret
+		k.algorithms[name] = tsigAlgorithms[algorithm]
+	}
+	return k, nil
+}
+
+// account returns the username of the registration the key updates
+func (k *tsigKeyring) account(name string) (uuid.UUID, bool) {
+	if k == nil {
+		return uuid.Nil, false
+	}
+	account, ok := k.accounts[strings.ToLower(name)]
+	return account, ok
+}
+
+// verify returns the TSIG error of the signed request, or RcodeSuccess if it was
+// signed with one of the keys using the algorithm of the key. The signature itself
+// is checked by the server, which knows the secrets.
+func (k *tsigKeyring) verify(w dns.ResponseWriter, t *dns.TSIG) int {
+	if k == nil {
+		return dns.RcodeBadKey
+	}
+	algorithm, ok := k.algorithms[strings.ToLower(t.Hdr.Name)]
+	if !ok || !strings.EqualFold(algorithm, t.Algorithm) {
+		return dns.RcodeBadKey
+	}
+	switch w.TsigStatus() {
+	case nil:
+		return dns.RcodeSuccess
+	case dns.ErrTime:
+		return dns.RcodeBadTime
+	case dns.ErrSecret:
+		return dns.RcodeBadKey
+	}
+	return dns.RcodeBadSig
+}
+
+// tsigLen returns the size of the TSIG record in a message, the size of a response
+// signed with the same key and algorithm
+func tsigLen(t *dns.TSIG) int {
+	// Without the 12 bytes of the message header
+	return (&dns.Msg{Extra: []dns.RR{t}}).Len() - 12
+}
+
+// requiresTSIG tells if the request is only served to the holders of a TSIG key:
+// zone transfers and dynamic updates
+func requiresTSIG(r *dns.Msg) bool {
+	if r.Opcode == dns.OpcodeUpdate {
+		return true
+	}
+	for _, q := range r.Question {
+		if q.Qtype == dns.TypeAXFR || q.Qtype == dns.TypeIXFR {
+			return true
+		}
+	}
+	return false
+}
+
+// writeTSIGError answers a request with a TSIG record that failed verification
+// with NOTAUTH and the TSIG error, unsigned as the key or the signature is unknown
+func writeTSIGError(w dns.ResponseWriter, m *dns.Msg, t *dns.TSIG, tsigError int) {
+	m.Rcode = dns.RcodeNotAuth
+	m.Extra = append(m.Extra, &dns.TSIG{
+		Hdr:        dns.RR_Header{Name: t.Hdr.Name, Rrtype: dns.TypeTSIG, Class: dns.ClassANY},
+		Algorithm:  t.Algorithm,
+		TimeSigned: t.TimeSigned,
+		Fudge:      t.Fudge,
+		OrigId:     m.Id,
+		Error:      uint16(tsigError),
+	})
+	// WriteMsg would sign the response with the key of the TSIG record
+	if packed, err := m.Pack(); err == nil {
+		_, _ = w.Write(packed)
+	}
+}
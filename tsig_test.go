@@ -0,0 +1,102 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const testTSIGSecret = "c2VjcmV0c2VjcmV0c2VjcmV0c2VjcmV0c2VjcmV0MTI="
+
+func TestTSIGKeyring(t *testing.T) {
+	for i, test := range []struct {
+		keys  []tsigKey
+		valid bool
+	}{
+		{[]tsigKey{{"transfer", "", testTSIGSecret, ""}}, true},
+		{[]tsigKey{{"transfer.", "HMAC-SHA512.", testTSIGSecret, ""}}, true},
+		{[]tsigKey{{"", "hmac-sha256", testTSIGSecret, ""}}, false},
+		{[]tsigKey{{"transfer.", "hmac-md5", testTSIGSecret, ""}}, false},
+		{[]tsigKey{{"transfer.", "hmac-sha256", "not base64!", ""}}, false},
+		{[]tsigKey{{"transfer.", "", testTSIGSecret, ""}, {"Transfer", "", testTSIGSecret, ""}}, false},
+		{[]tsigKey{{"router.", "", testTSIGSecret, "c36f50e8-4632-44f0-83fe-e070fef28a10"}}, true},
+		{[]tsigKey{{"router.", "", testTSIGSecret, "router"}}, false},
+	} {
+		_, err := newTSIGKeyring(test.keys)
+		if test.valid && err != nil {
+			t.Errorf("Test %d: Expected the keys to be valid, got %v", i, err)
+		}
+		if !test.valid && err == nil {
+			t.Errorf("Test %d: Expected an error", i)
+		}
+	}
+}
+
+func TestTSIG(t *testing.T) {
+	config := Config
+	config.General.Listen = "127.0.0.1:15357"
+	config.General.AdditionalListen = nil
+	config.General.Proto = "tcp"
+	config.General.Domain = "auth.example.org"
+	config.General.StaticRecords = []string{"auth.example.org. A 192.168.1.100"}
+	config.TSIG.Keys = []tsigKey{
+		{"transfer.", "hmac-sha256", testTSIGSecret, ""},
+		{"legacy.", "hmac-sha1", testTSIGSecret, ""},
+	}
+	servers := newDNSServers(DB, config)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	servers[0].Server.NotifyStartedFunc = wg.Done
+	go servers[0].Start(make(chan error, 1))
+	wg.Wait()
+	defer func() { _ = servers[0].Server.Shutdown() }()
+
+	client := &dns.Client{Net: "tcp", TsigSecret: map[string]string{"transfer.": testTSIGSecret, "legacy.": testTSIGSecret, "unknown.": testTSIGSecret}}
+	for i, test := range []struct {
+		qtype     uint16
+		key       string
+		algorithm string
+		rcode     int
+		tsigError int
+	}{
+		// Signed queries get signed answers
+		{dns.TypeA, "transfer.", dns.HmacSHA256, dns.RcodeSuccess, dns.RcodeSuccess},
+		{dns.TypeA, "", "", dns.RcodeSuccess, dns.RcodeSuccess},
+		{dns.TypeAXFR, "", "", dns.RcodeRefused, dns.RcodeSuccess},
+		{dns.TypeAXFR, "transfer.", dns.HmacSHA256, dns.RcodeNotImplemented, dns.RcodeSuccess},
+		{dns.TypeA, "unknown.", dns.HmacSHA256, dns.RcodeNotAuth, dns.RcodeBadKey},
+		// The keys are restricted to their algorithm
+		{dns.TypeA, "legacy.", dns.HmacSHA256, dns.RcodeNotAuth, dns.RcodeBadKey},
+	} {
+		m := new(dns.Msg)
+		m.SetQuestion("auth.example.org.", test.qtype)
+		if test.key != "" {
+			m.SetTsig(test.key, test.algorithm, 300, time.Now().Unix())
+		}
+		r, _, err := client.Exchange(m, "127.0.0.1:15357")
+		if r == nil {
+			t.Fatalf("Test %d: No response: %v", i, err)
+		}
+		if r.Rcode != test.rcode {
+			t.Errorf("Test %d: Expected rcode %s, got %s", i, dns.RcodeToString[test.rcode], dns.RcodeToString[r.Rcode])
+		}
+		if test.key == "" {
+			if r.IsTsig() != nil {
+				t.Errorf("Test %d: Expected an unsigned response", i)
+			}
+			continue
+		}
+		tsig := r.IsTsig()
+		if tsig == nil {
+			t.Fatalf("Test %d: Expected a TSIG record in the response", i)
+		}
+		if int(tsig.Error) != test.tsigError {
+			t.Errorf("Test %d: Expected TSIG error %s, got %s", i, dns.RcodeToString[test.tsigError], dns.RcodeToString[int(tsig.Error)])
+		}
+		if test.tsigError == dns.RcodeSuccess && err != nil {
+			t.Errorf("Test %d: Expected a valid signature of the response, got %v", i, err)
+		}
+	}
+}
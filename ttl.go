@@ -0,0 +1,73 @@
+package main
+
+// minTTL returns the lowest TTL clients can set for their records, which is also
+// the TTL of the records without one
+func minTTL() int {
+	if Config.General.MinTTL > 0 {
+		return Config.General.MinTTL
+	}
+	return 1
+}
+
+// maxTTL returns the highest TTL clients can set for their records
+func maxTTL() int {
+	if Config.General.MaxTTL > 0 {
+		if Config.General.MaxTTL < minTTL() {
+			return minTTL()
+		}
+		return Config.General.MaxTTL
+	}
+	return 86400
+}
+
+// ttlSetTypes returns the record types the update sets values of. The TTL of the
+// update applies to all of them, as the records of a type share the TTL.
+func ttlSetTypes(a ACMETxtPost) []string {
+	var types []string
+	if a.Value != "" {
+		types = append(types, "txt")
+	}
+	if len(a.AValues) > 0 {
+		types = append(types, "a")
+	}
+	if len(a.AAAAValues) > 0 {
+		types = append(types, "aaaa")
+	}
+	if a.CNAME != "" {
+		types = append(types, "cname")
+	}
+	if len(a.MXValues) > 0 {
+		types = append(types, "mx")
+	}
+	if len(a.SRVValues) > 0 {
+		types = append(types, "srv")
+	}
+	if len(a.CAAValues) > 0 {
+		types = append(types, "caa")
+	}
+	return types
+}
+
+// ttlReplacedTypes returns the record types the update sets, clears or replaces
+// with a CNAME record, whose stored TTL no longer applies
+func ttlReplacedTypes(a ACMETxtPost) []string {
+	types := ttlSetTypes(a)
+	add := func(rtype string, replaced bool) {
+		if !replaced {
+			return
+		}
+		for _, t := range types {
+			if t == rtype {
+				return
+			}
+		}
+		types = append(types, rtype)
+	}
+	add("a", a.ClearA || a.CNAME != "")
+	add("aaaa", a.ClearAAAA || a.CNAME != "")
+	add("mx", a.ClearMX || a.CNAME != "")
+	add("srv", a.ClearSRV || a.CNAME != "")
+	add("caa", a.ClearCAA || a.CNAME != "")
+	add("cname", a.ClearCNAME || len(a.AValues) > 0 || len(a.AAAAValues) > 0 || len(a.MXValues) > 0 || len(a.SRVValues) > 0 || len(a.CAAValues) > 0 || len(a.Records) > 0)
+	return types
+}
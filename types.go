@@ -3,7 +3,7 @@ package main
 import (
 	"database/sql"
 	"net"
-	"sync"
+	"time"
 
 	"github.com/google/uuid"
 )
@@ -16,26 +16,107 @@ var DB database
 
 // DNSConfig holds the config structure
 type DNSConfig struct {
-	General   general
-	Database  dbsettings
-	API       httpapi
-	Logconfig logconfig
+	General     general
+	Database    dbsettings
+	API         httpapi
+	Logconfig   logconfig
+	Standby     standby
+	Approval    approval
+	Hooks       hooks
+	Delegation  delegation
+	Maintenance maintenance
+	Dnstap      dnstapConfig
+	Statistics  statistics
+	Audit       auditConfig
+	DNSSEC      dnssecConfig
+	Replication replication
+	TSIG        tsigConfig
+	RRL         rrlConfig
+	RateLimit   queryRateLimitConfig
+	Zones       []zoneConfig
+}
+
+// txtSlot is a TXT slot of a subdomain with the details of its latest update
+type txtSlot struct {
+	Slot          int    `json:"slot"`
+	Value         string `json:"txt"`
+	LastUpdate    int64  `json:"last_update"`
+	CorrelationID string `json:"correlation_id"`
 }
 
 // Config file general section
 type general struct {
-	Listen        string
-	Proto         string `toml:"protocol"`
-	Domain        string
-	Nsname        string
+	Listen string
+	// AdditionalListen are further addresses served in addition to Listen
+	AdditionalListen []string `toml:"additional_listen"`
+	// TLSListen is the address of the DNS-over-TLS listener, empty if disabled
+	TLSListen string `toml:"tls_listen"`
+	Proto     string `toml:"protocol"`
+	Domain    string
+	Nsname    string
+	// Nameservers are the names served as the NS records of the zone, Nsname if empty
+	Nameservers []string `toml:"nameservers"`
+	// AuthorityNS adds the NS records of the zone to the authority section of the
+	// positive answers
+	AuthorityNS bool `toml:"authority_ns"`
+	// ClientSubnet tailors the A and AAAA answers to the subnet of the client
+	ClientSubnet  bool `toml:"client_subnet"`
 	Nsadmin       string
 	Debug         bool
 	StaticRecords []string `toml:"records"`
+	// StrictTXT serves the TXT values at the exact names of the registrations only
+	StrictTXT bool `toml:"strict_txt"`
+	// RecordsFile is a zone file of further static records of the domain
+	RecordsFile string `toml:"records_file"`
+	soaTimers
+	TXTSlots int `toml:"txt_slots"`
+	// EmptyTXT is how empty TXT slots are served, "omit" or "serve"
+	EmptyTXT   string `toml:"empty_txt"`
+	MaxUDPSize int    `toml:"max_udp_size"`
+	MinTTL     int    `toml:"min_ttl"`
+	MaxTTL     int    `toml:"max_ttl"`
+	AutoPTR    bool   `toml:"auto_ptr"`
+	// Additional are the answer types with the addresses of their targets added
+	// to the additional section
+	Additional []string `toml:"additional"`
+	// ZoneFiles are zone files of other zones served read-only alongside the domain
+	ZoneFiles []string `toml:"zone_files"`
+	// aboutInfo is the operator information of the domain
+	aboutInfo
+	// UDPWorkers answer the UDP queries from a queue of UDPQueueSize queries, zero
+	// answers each query in a goroutine of its own
+	UDPWorkers    int    `toml:"udp_workers"`
+	UDPQueueSize  int    `toml:"udp_queue_size"`
+	UDPDropPolicy string `toml:"udp_drop_policy"`
+	// TCPIdleTimeout is the number of seconds a TCP connection is kept open
+	// waiting for the next query, TCPMaxConnections the number of TCP and
+	// DNS-over-TLS connections open at once, zero for no limit, and
+	// TCPDrainTimeout the number of seconds the connections get to answer their
+	// queries on shutdown
+	TCPIdleTimeout    int `toml:"tcp_idle_timeout"`
+	TCPMaxConnections int `toml:"tcp_max_connections"`
+	TCPDrainTimeout   int `toml:"tcp_drain_timeout"`
 }
 
 type dbsettings struct {
-	Engine     string
-	Connection string
+	Engine           string
+	Connection       string
+	NegativeCacheTTL int  `toml:"negative_cache_ttl"`
+	RecordCacheTTL   int  `toml:"record_cache_ttl"`
+	WarmUpHours      int  `toml:"cache_warmup_hours"`
+	ServeStale       bool `toml:"serve_stale"`
+	StaleRefresh     int  `toml:"stale_refresh_interval"`
+	RetryAttempts    int  `toml:"retry_attempts"`
+	TXTExpiry        int  `toml:"txt_expiry"`
+	MaxOpenConns     int  `toml:"max_open_conns"`
+	MaxIdleConns     int  `toml:"max_idle_conns"`
+	ConnMaxLifetime  int  `toml:"conn_max_lifetime"`
+	SkipMigrations   bool `toml:"skip_migrations"`
+	// MigrateOnDemand starts without migrating a schema that is behind, leaving the
+	// migrations to the admin API
+	MigrateOnDemand bool `toml:"migrate_on_demand"`
+	Key             string
+	KeyFile         string `toml:"key_file"`
 }
 
 // API config
@@ -43,16 +124,155 @@ type httpapi struct {
 	Domain              string `toml:"api_domain"`
 	IP                  string
 	DisableRegistration bool   `toml:"disable_registration"`
+	ReadOnly            bool   `toml:"read_only"`
+	Locale              string `toml:"locale"`
+	MessageCatalogDir   string `toml:"message_catalog_dir"`
 	AutocertPort        string `toml:"autocert_port"`
 	Port                string `toml:"port"`
-	TLS                 string
-	TLSCertPrivkey      string `toml:"tls_cert_privkey"`
-	TLSCertFullchain    string `toml:"tls_cert_fullchain"`
-	ACMECacheDir        string `toml:"acme_cache_dir"`
-	NotificationEmail   string `toml:"notification_email"`
-	CorsOrigins         []string
-	UseHeader           bool   `toml:"use_header"`
-	HeaderName          string `toml:"header_name"`
+	// HTTPRedirectPort is the port of the plain HTTP listener pointing the clients
+	// to the HTTPS API, disabled if empty
+	HTTPRedirectPort string `toml:"http_redirect_port"`
+	// HTTPRedirectMode is how the plain HTTP requests are answered, "redirect" or
+	// "upgrade"
+	HTTPRedirectMode string `toml:"http_redirect_mode"`
+	TLS              string
+	TLSCertPrivkey   string `toml:"tls_cert_privkey"`
+	TLSCertFullchain string `toml:"tls_cert_fullchain"`
+	ACMECacheDir     string `toml:"acme_cache_dir"`
+	// TLSAltNames are the names the API is served under besides the domain
+	TLSAltNames       []string `toml:"tls_alt_names"`
+	NotificationEmail string   `toml:"notification_email"`
+	CorsOrigins       []string
+	UseHeader         bool   `toml:"use_header"`
+	HeaderName        string `toml:"header_name"`
+	AllowWebhooks     bool   `toml:"allow_webhooks"`
+	CanaryWebhook     string `toml:"canary_webhook"`
+	// Alerts on spikes of authentication failures of a single credential
+	AuthAlertWindow      int      `toml:"auth_alert_window"`
+	AuthAlertMinFailures int      `toml:"auth_alert_min_failures"`
+	AuthAlertRatio       float64  `toml:"auth_alert_ratio"`
+	AuthAlertWebhook     string   `toml:"auth_alert_webhook"`
+	UserAgentAllow       []string `toml:"useragent_allow"`
+	UserAgentDeny        []string `toml:"useragent_deny"`
+	DenyEmptyUserAgent   bool     `toml:"deny_empty_useragent"`
+	PublishAddress       bool     `toml:"publish_address"`
+	PublicIPs            []string `toml:"public_ips"`
+	HealthInterval       int      `toml:"health_interval"`
+	DoH                  bool     `toml:"doh"`
+	MaxRegistrations     int      `toml:"max_registrations"`
+	MinUpdateInterval    int      `toml:"min_update_interval"`
+	// VerifyWorkers compare the passwords from a queue of VerifyQueueSize, zero
+	// compares them in the goroutines of the requests
+	VerifyWorkers   int `toml:"verify_workers"`
+	VerifyQueueSize int `toml:"verify_queue_size"`
+}
+
+// Update approval config
+type approval struct {
+	ProtectedSubdomains []string `toml:"protected_subdomains"`
+	Webhook             string
+	Timeout             int
+}
+
+// Hook commands config
+type hooks struct {
+	OnRegister []string `toml:"on_register"`
+	OnUpdate   []string `toml:"on_update"`
+	Timeout    int
+}
+
+// Delegation monitor config
+type delegation struct {
+	Interval int
+	Webhook  string
+}
+
+// Response rate limiting config
+type rrlConfig struct {
+	ResponsesPerSecond int `toml:"responses_per_second"`
+	Burst              int
+	Slip               int
+	Leak               int
+	IPv4Prefix         int `toml:"ipv4_prefix"`
+	IPv6Prefix         int `toml:"ipv6_prefix"`
+	Exempt             []string
+}
+
+// Query rate limiting config
+type queryRateLimitConfig struct {
+	QueriesPerSecond int `toml:"queries_per_second"`
+	Burst            int
+	Action           string
+	Exempt           []string
+}
+
+// Statistics channel config
+type statistics struct {
+	Listen string
+}
+
+// DNSSEC signing config
+type dnssecConfig struct {
+	Enabled           bool
+	KeyDir            string `toml:"key_dir"`
+	KeyStorage        string `toml:"key_storage"`
+	Algorithm         string
+	SignatureValidity int `toml:"signature_validity"`
+	ZSKLifetime       int `toml:"zsk_lifetime"`
+	RolloverDelay     int `toml:"rollover_delay"`
+	// Audit counts the answers that would be signed while signing is disabled
+	Audit bool `toml:"audit"`
+}
+
+// Audit trail config
+type auditConfig struct {
+	Enabled bool
+	File    string
+}
+
+// TSIG keys config
+type tsigConfig struct {
+	Keys []tsigKey
+}
+
+// tsigKey is a shared key for signed DNS requests
+type tsigKey struct {
+	Name      string
+	Algorithm string
+	Secret    string
+	// Account is the username of the registration the key may send dynamic
+	// updates for, empty if the key can't update any records
+	Account string
+}
+
+// SQLite to PostgreSQL replication config
+type replication struct {
+	// Replica is the connection string of the PostgreSQL replica, replication is
+	// disabled if empty
+	Replica   string
+	Interval  int
+	BatchSize int `toml:"batch_size"`
+}
+
+// Dnstap capture config
+type dnstapConfig struct {
+	Output     string
+	Identity   string
+	BufferSize int `toml:"buffer_size"`
+}
+
+// Maintenance config
+type maintenance struct {
+	Interval         int
+	AccountRetention int `toml:"account_retention"`
+	TXTRetention     int `toml:"txt_retention"`
+}
+
+// Warm standby config
+type standby struct {
+	Enabled       bool
+	NodeName      string `toml:"node_name"`
+	LeaseDuration int    `toml:"lease_duration"`
 }
 
 // Logging config
@@ -61,24 +281,76 @@ type logconfig struct {
 	Logtype string `toml:"logtype"`
 	File    string `toml:"logfile"`
 	Format  string `toml:"logformat"`
+	// The log levels of the components, the global level is used if empty
+	APILevel string `toml:"api_level"`
+	DNSLevel string `toml:"dns_level"`
+	DBLevel  string `toml:"db_level"`
 }
 
+// acmedb is the database/sql backend. The operations run concurrently over the
+// connection pool of database/sql, only the operations on the records of a
+// subdomain are serialized with the striped lock.
 type acmedb struct {
-	Mutex sync.Mutex
-	DB    *sql.DB
+	stripes     stripedLock
+	stmts       stmtCache
+	DB          *sql.DB
+	engine      string
+	Clock       clock
+	negCache    *negativeCache
+	recordCache *recordCache
+	snapshot    *staleSnapshot
+	// skipMigrations leaves the schema untouched in Init, used by the migrate and
+	// init-db commands
+	skipMigrations bool
 }
 
+// database is the storage backend interface. Backends other than the SQL ones
+// are added to this package and made available with RegisterBackend.
 type database interface {
 	Init(string, string) error
-	Register(cidrslice) (ACMETxt, error)
-	GetAdminPassByUsername(string) (string, error)
+	Register(cidrslice, registrationOrigin, ACMETxtPost) (ACMETxt, error)
+	GetAdminPassByUsername(string) (string, int, error)
+	CreateAdmin(string, string) error
+	DeleteAdmin(string) error
+	ListAdmins() ([]string, error)
+	UpdateAdminPassword(string, string) error
+	RehashAdminPassword(string, int, string) error
 	GetByUsername(uuid.UUID) (ACMETxt, error)
+	ListRegistrations(registrationOrigin) ([]ACMETxt, error)
+	MarkActive(uuid.UUID) error
+	GetInactiveAccounts(time.Duration) ([]ACMETxt, error)
+	UpdateSettings(uuid.UUID, registrationSettings) error
+	SetDisabled(uuid.UUID, bool) error
+	SetCanary(uuid.UUID, bool) error
+	SetPassword(uuid.UUID, string) error
+	RehashPassword(uuid.UUID, int, string) error
+	CountCredentials() (map[int]int, map[int]int, error)
+	DeleteRegistration(uuid.UUID) error
+	AcquireLease(string, string, time.Duration) (bool, error)
+	ReleaseLease(string, string) error
+	GetSetting(string) (string, bool, error)
+	SetSetting(string, string) error
 	GetTXTForDomain(string) ([]string, error)
 	GetAForDomain(string) ([]net.IP, error)
 	GetAAAAForDomain(string) ([]net.IP, error)
+	GetCNAMEForDomain(string) (string, error)
+	GetWildcardForDomain(string) (bool, error)
+	GetZoneForDomain(string) (string, error)
+	GetSubnetAnswersForDomain(string) ([]subnetAnswer, error)
+	GetMXForDomain(string) ([]mxRecord, error)
+	GetSRVForDomain(string) ([]srvRecord, error)
+	GetCAAForDomain(string) ([]caaRecord, error)
+	GetTXTSlots(string) ([]txtSlot, error)
+	GetTTLForDomain(string) (map[string]int, error)
+	GetLastUpdates(string) (map[string]int64, error)
+	GetRecordsForDomain(string) ([]genericRecord, error)
+	GetSubdomainsForAddress(net.IP) ([]string, error)
 	CountRecords(string) (int, error)
-	Update(ACMETxtPost) error
-	GetBackend() *sql.DB
-	SetBackend(*sql.DB)
+	ClearStaleTXT(time.Duration) (int, error)
+	Update(ACMETxtPost) (ACMETxtPost, error)
+	UpdateBatch(string, []ACMETxtPost) ([]ACMETxtPost, error)
+	ChangeValues(string, valueChange) ([]ACMETxtPost, error)
+	AddAuditEvent(auditEvent) error
+	GetAuditEvents(string, int) ([]auditEvent, error)
 	Close()
 }
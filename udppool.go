@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+)
+
+// udpDropPolicies are the ways queries that don't fit in the queue are answered
+var udpDropPolicies = map[string]int{
+	"drop":     -1,
+	"refuse":   dns.RcodeRefused,
+	"servfail": dns.RcodeServerFailure,
+}
+
+// parseUDPDropPolicy checks the drop policy of the UDP worker pool, "drop" by default
+func parseUDPDropPolicy(policy string) (string, error) {
+	if policy == "" {
+		return "drop", nil
+	}
+	policy = strings.ToLower(policy)
+	if _, ok := udpDropPolicies[policy]; !ok {
+		return "", fmt.Errorf("unknown udp_drop_policy %q, must be drop, refuse or servfail", policy)
+	}
+	return policy, nil
+}
+
+// udpJob is a query waiting for a worker, with the handler of the server it came to
+type udpJob struct {
+	handler dns.HandlerFunc
+	w       dns.ResponseWriter
+	r       *dns.Msg
+}
+
+// udpWorkerPool answers the UDP queries of all the servers with a fixed number of
+// workers. The goroutine of the server reading a query only queues it, so that a
+// flood of queries can't grow the number of goroutines answering them. Queries
+// arriving with the queue full are dropped according to the drop policy.
+type udpWorkerPool struct {
+	workers int
+	queue   chan udpJob
+	policy  string
+	stats   *dnsStatistics
+	dropped uint64
+	done    chan struct{}
+	wg      sync.WaitGroup
+}
+
+func newUDPWorkerPool(workers int, queueSize int, policy string, stats *dnsStatistics) *udpWorkerPool {
+	if queueSize < 0 {
+		queueSize = 0
+	}
+	return &udpWorkerPool{
+		workers: workers,
+		queue:   make(chan udpJob, queueSize),
+		policy:  policy,
+		stats:   stats,
+		done:    make(chan struct{}),
+	}
+}
+
+// Run starts the workers
+func (p *udpWorkerPool) Run() {
+	dnsLog.WithFields(log.Fields{"workers": p.workers, "queue": cap(p.queue), "drop_policy": p.policy}).Info("Starting UDP worker pool")
+	for i := 0; i < p.workers; i++ {
+		p.wg.Add(1)
+		go p.work()
+	}
+}
+
+// Stop stops the workers, leaving the queued queries unanswered
+func (p *udpWorkerPool) Stop() {
+	close(p.done)
+	p.wg.Wait()
+}
+
+func (p *udpWorkerPool) work() {
+	defer p.wg.Done()
+	for {
+		select {
+		case job := <-p.queue:
+			job.handler(job.w, job.r)
+		case <-p.done:
+			return
+		}
+	}
+}
+
+// Handler returns a handler queueing the queries for the workers to answer them
+// with handler
+func (p *udpWorkerPool) Handler(handler dns.HandlerFunc) dns.HandlerFunc {
+	return func(w dns.ResponseWriter, r *dns.Msg) {
+		select {
+		case p.queue <- udpJob{handler, w, r}:
+		default:
+			p.drop(w, r)
+		}
+	}
+}
+
+// drop answers the query that didn't fit in the queue according to the drop policy
+func (p *udpWorkerPool) drop(w dns.ResponseWriter, r *dns.Msg) {
+	dropped := atomic.AddUint64(&p.dropped, 1)
+	p.stats.RecordDropped()
+	if dropped&(dropped-1) == 0 {
+		// Log with exponentially decreasing frequency during a flood
+		dnsLog.WithFields(log.Fields{"dropped": dropped, "queue": cap(p.queue)}).Warn("UDP query queue full, dropping queries")
+	}
+	rcode := udpDropPolicies[p.policy]
+	if rcode < 0 {
+		return
+	}
+	m := new(dns.Msg)
+	m.SetRcode(r, rcode)
+	_ = w.WriteMsg(m)
+}
+
+// QueueLength returns the number of queries waiting for a worker
+func (p *udpWorkerPool) QueueLength() int {
+	return len(p.queue)
+}
+
+// Dropped returns the number of queries dropped because the queue was full
+func (p *udpWorkerPool) Dropped() uint64 {
+	return atomic.LoadUint64(&p.dropped)
+}
+
+// counters returns the state of the pool for the statistics channel
+func (p *udpWorkerPool) counters() map[string]uint64 {
+	return map[string]uint64{
+		"Workers":       uint64(p.workers),
+		"QueueLength":   uint64(p.QueueLength()),
+		"QueueCapacity": uint64(cap(p.queue)),
+		"Dropped":       p.Dropped(),
+	}
+}
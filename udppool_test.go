@@ -0,0 +1,50 @@
+package main
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestUDPWorkerPoolDropPolicy(t *testing.T) {
+	if _, err := parseUDPDropPolicy("discard"); err == nil {
+		t.Errorf("Expected an error for an unknown drop policy")
+	}
+	stats := newDNSStatistics(nil)
+	pool := newUDPWorkerPool(1, 1, "refuse", stats)
+	stats.UDPPool = pool
+	var answered sync.WaitGroup
+	handler := pool.Handler(func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		_ = w.WriteMsg(m)
+		answered.Done()
+	})
+	q := new(dns.Msg)
+	q.SetQuestion("auth.example.org.", dns.TypeA)
+
+	// Without running workers the first query fills the queue
+	queued := &recordingWriter{}
+	handler(queued, q)
+	dropped := &recordingWriter{}
+	handler(dropped, q)
+	if queued.msg != nil {
+		t.Errorf("Expected the queued query to wait for a worker")
+	}
+	if dropped.msg == nil || dropped.msg.Rcode != dns.RcodeRefused {
+		t.Errorf("Expected the dropped query to be refused, got %v", dropped.msg)
+	}
+	counters := pool.counters()
+	if counters["QueueLength"] != 1 || counters["Dropped"] != 1 || stats.snapshot(statNS)["QryDropped"] != 1 {
+		t.Errorf("Unexpected pool counters %v", counters)
+	}
+
+	answered.Add(1)
+	pool.Run()
+	defer pool.Stop()
+	answered.Wait()
+	if queued.msg == nil || queued.msg.Rcode != dns.RcodeSuccess {
+		t.Errorf("Expected the queued query to be answered by a worker, got %v", queued.msg)
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"net/http"
+	"regexp"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// userAgentPolicy decides which clients may use the API by their User-Agent header
+type userAgentPolicy struct {
+	allow     []*regexp.Regexp
+	deny      []*regexp.Regexp
+	denyEmpty bool
+}
+
+// newUserAgentPolicy returns the policy for the configured patterns, or nil if no
+// rules are configured
+func newUserAgentPolicy(conf httpapi) *userAgentPolicy {
+	if len(conf.UserAgentAllow) == 0 && len(conf.UserAgentDeny) == 0 && !conf.DenyEmptyUserAgent {
+		return nil
+	}
+	return &userAgentPolicy{
+		allow:     compileUserAgentPatterns(conf.UserAgentAllow),
+		deny:      compileUserAgentPatterns(conf.UserAgentDeny),
+		denyEmpty: conf.DenyEmptyUserAgent,
+	}
+}
+
+// compileUserAgentPatterns turns the patterns, where * matches any characters, into
+// case-insensitive regular expressions matching the whole header
+func compileUserAgentPatterns(patterns []string) []*regexp.Regexp {
+	var res []*regexp.Regexp
+	for _, pattern := range patterns {
+		parts := strings.Split(pattern, "*")
+		for i, part := range parts {
+			parts[i] = regexp.QuoteMeta(part)
+		}
+		res = append(res, regexp.MustCompile("(?i)^"+strings.Join(parts, ".*")+"$"))
+	}
+	return res
+}
+
+func matchesAny(patterns []*regexp.Regexp, ua string) bool {
+	for _, re := range patterns {
+		if re.MatchString(ua) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowed returns if the client with the User-Agent may use the API. Deny rules take
+// precedence over the allow rules.
+func (p *userAgentPolicy) allowed(ua string) bool {
+	if ua == "" {
+		return !p.denyEmpty && len(p.allow) == 0
+	}
+	if matchesAny(p.deny, ua) {
+		return false
+	}
+	return len(p.allow) == 0 || matchesAny(p.allow, ua)
+}
+
+// userAgentGate refuses the API requests of the clients not allowed by the policy.
+// The health and readiness checks stay available to monitoring.
+func userAgentGate(p *userAgentPolicy, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/health" && r.URL.Path != "/readyz" && !p.allowed(r.UserAgent()) {
+			apiLog.WithFields(log.Fields{"user_agent": r.UserAgent(), "remote": getRequestIP(r), "path": r.URL.Path}).Info("Request refused by the User-Agent rules")
+			WriteJsonResponse(w, http.StatusForbidden, jsonError("forbidden"))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
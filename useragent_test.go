@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestUserAgentPolicy(t *testing.T) {
+	if newUserAgentPolicy(httpapi{}) != nil {
+		t.Errorf("Expected no policy without rules")
+	}
+	for i, test := range []struct {
+		conf    httpapi
+		ua      string
+		allowed bool
+	}{
+		{httpapi{DenyEmptyUserAgent: true}, "", false},
+		{httpapi{DenyEmptyUserAgent: true}, "curl/8.0", true},
+		{httpapi{UserAgentAllow: []string{"certbot*", "lego*"}}, "CertBot/2.7.4 (certbot; Linux)", true},
+		{httpapi{UserAgentAllow: []string{"certbot*", "lego*"}}, "xenolf-acme/4.9.0 lego-cli/4.9.0", false},
+		{httpapi{UserAgentAllow: []string{"certbot*", "*lego*"}}, "xenolf-acme/4.9.0 lego-cli/4.9.0", true},
+		{httpapi{UserAgentAllow: []string{"certbot*"}}, "", false},
+		{httpapi{UserAgentAllow: []string{"certbot/1.*"}}, "certbot/1x0", false},
+		{httpapi{UserAgentDeny: []string{"*python-requests*"}}, "python-requests/2.31", false},
+		{httpapi{UserAgentDeny: []string{"*python-requests*"}}, "", true},
+		{httpapi{UserAgentAllow: []string{"*"}, UserAgentDeny: []string{"curl/*"}}, "curl/8.0", false},
+		{httpapi{UserAgentAllow: []string{"*"}, UserAgentDeny: []string{"curl/*"}}, "acme.sh/3.0", true},
+	} {
+		if got := newUserAgentPolicy(test.conf).allowed(test.ua); got != test.allowed {
+			t.Errorf("Test %d: Expected %q allowed %t, got %t", i, test.ua, test.allowed, got)
+		}
+	}
+}
+
+func TestUserAgentGate(t *testing.T) {
+	handler := userAgentGate(newUserAgentPolicy(httpapi{UserAgentAllow: []string{"certbot*"}}), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	for i, test := range []struct {
+		path   string
+		ua     string
+		status int
+	}{
+		{"/register", "certbot/2.7.4", http.StatusOK},
+		{"/register", "scanner/1.0", http.StatusForbidden},
+		{"/health", "", http.StatusOK},
+	} {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", test.path, nil)
+		req.Header.Set("User-Agent", test.ua)
+		handler.ServeHTTP(rec, req)
+		if rec.Code != test.status {
+			t.Errorf("Test %d: Expected status %d, got %d", i, test.status, rec.Code)
+		}
+	}
+}
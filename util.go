@@ -2,14 +2,17 @@ package main
 
 import (
 	"crypto/rand"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"math/big"
 	"os"
 	"regexp"
 	"strings"
 
 	"github.com/BurntSushi/toml"
+	"github.com/miekg/dns"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -17,6 +20,39 @@ func jsonError(message string) []byte {
 	return []byte(fmt.Sprintf("{\"error\": \"%s\"}", message))
 }
 
+// fieldError describes why a single field of the request payload was rejected
+type fieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// jsonFieldErrors returns an error response body with field level details
+func jsonFieldErrors(message string, details []fieldError) []byte {
+	ret, err := json.Marshal(struct {
+		Error   string       `json:"error"`
+		Details []fieldError `json:"details"`
+	}{message, details})
+	if err != nil {
+		return jsonError(message)
+	}
+	return ret
+}
+
+// decodeErrorDetails translates an error from JSON decoding to field level details
+func decodeErrorDetails(err error) []fieldError {
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &syntaxErr):
+		return []fieldError{{"", fmt.Sprintf("malformed JSON at offset %d: %s", syntaxErr.Offset, syntaxErr.Error())}}
+	case errors.As(err, &typeErr):
+		return []fieldError{{strings.ToLower(typeErr.Field), fmt.Sprintf("expected %s but got %s", typeErr.Type.String(), typeErr.Value)}}
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return []fieldError{{"", "unexpected end of JSON input"}}
+	}
+	return []fieldError{{"", err.Error()}}
+}
+
 func fileIsAccessible(fname string) bool {
 	_, err := os.Stat(fname)
 	if err != nil {
@@ -45,14 +81,134 @@ func prepareConfig(conf DNSConfig) (DNSConfig, error) {
 	if conf.Database.Engine == "" {
 		return conf, errors.New("missing database configuration option \"engine\"")
 	}
-	if conf.Database.Connection == "" {
+	if conf.Database.Connection == "" && conf.Database.Engine != "memory" {
 		return conf, errors.New("missing database configuration option \"connection\"")
 	}
+	if err := loadDatabaseKey(&conf.Database); err != nil {
+		return conf, err
+	}
 
 	// Default values for options added to config to keep backwards compatibility with old config
 	if conf.API.ACMECacheDir == "" {
 		conf.API.ACMECacheDir = "api-certs"
 	}
+	if conf.General.TXTSlots <= 0 {
+		conf.General.TXTSlots = 2
+	}
+	if conf.General.EmptyTXT == "" {
+		conf.General.EmptyTXT = "omit"
+	}
+	if conf.General.EmptyTXT != "omit" && conf.General.EmptyTXT != "serve" {
+		return conf, fmt.Errorf("unknown empty_txt %q, must be omit or serve", conf.General.EmptyTXT)
+	}
+	if conf.General.MaxUDPSize <= 0 {
+		conf.General.MaxUDPSize = 1232
+	}
+	if conf.Database.RetryAttempts <= 0 {
+		conf.Database.RetryAttempts = 3
+	}
+	if conf.Database.StaleRefresh <= 0 {
+		conf.Database.StaleRefresh = 60
+	}
+	if conf.Approval.Timeout <= 0 {
+		conf.Approval.Timeout = 3600
+	}
+	if conf.Hooks.Timeout <= 0 {
+		conf.Hooks.Timeout = 10
+	}
+	if conf.API.VerifyQueueSize <= 0 {
+		conf.API.VerifyQueueSize = 64
+	}
+	if conf.API.AuthAlertWindow <= 0 {
+		conf.API.AuthAlertWindow = 300
+	}
+	if conf.API.AuthAlertMinFailures <= 0 {
+		conf.API.AuthAlertMinFailures = 10
+	}
+	if conf.API.AuthAlertRatio <= 0 || conf.API.AuthAlertRatio > 1 {
+		conf.API.AuthAlertRatio = 0.8
+	}
+	if conf.General.TLSListen != "" && conf.API.TLS != "cert" && conf.API.TLS != "letsencrypt" && conf.API.TLS != "letsencryptstaging" {
+		return conf, errors.New("the DNS-over-TLS listener needs the TLS certificate of the API, tls must be cert, letsencrypt or letsencryptstaging")
+	}
+	mode, err := parseHTTPRedirect(conf.API.HTTPRedirectMode)
+	if err != nil {
+		return conf, err
+	}
+	conf.API.HTTPRedirectMode = mode
+	if conf.API.HTTPRedirectPort != "" && conf.API.TLS != "cert" && conf.API.TLS != "letsencrypt" && conf.API.TLS != "letsencryptstaging" {
+		return conf, errors.New("the HTTP redirect listener points to the HTTPS API, tls must be cert, letsencrypt or letsencryptstaging")
+	}
+	for _, name := range conf.General.Nameservers {
+		if _, ok := dns.IsDomainName(name); name == "" || !ok {
+			return conf, fmt.Errorf("name server %q is not a valid domain name", name)
+		}
+	}
+	if err := validateZones(&conf); err != nil {
+		return conf, err
+	}
+	if _, err := parseAdditional(conf.General.Additional); err != nil {
+		return conf, err
+	}
+	if conf.General.UDPQueueSize <= 0 {
+		conf.General.UDPQueueSize = 1024
+	}
+	if conf.General.TCPIdleTimeout <= 0 {
+		conf.General.TCPIdleTimeout = 8
+	}
+	if conf.General.TCPMaxConnections < 0 {
+		return conf, fmt.Errorf("tcp_max_connections must not be negative")
+	}
+	if conf.General.TCPDrainTimeout <= 0 {
+		conf.General.TCPDrainTimeout = 5
+	}
+	policy, err := parseUDPDropPolicy(conf.General.UDPDropPolicy)
+	if err != nil {
+		return conf, err
+	}
+	conf.General.UDPDropPolicy = policy
+	if err = validateRRL(&conf.RRL); err != nil {
+		return conf, err
+	}
+	if err = validateQueryRateLimit(&conf.RateLimit); err != nil {
+		return conf, err
+	}
+	if conf.DNSSEC.KeyDir == "" {
+		conf.DNSSEC.KeyDir = "dnssec-keys"
+	}
+	if conf.DNSSEC.Algorithm == "" {
+		conf.DNSSEC.Algorithm = "ECDSAP256SHA256"
+	}
+	if _, ok := dnssecAlgorithms[strings.ToUpper(conf.DNSSEC.Algorithm)]; !ok {
+		return conf, fmt.Errorf("unsupported DNSSEC algorithm %q, must be ECDSAP256SHA256, ECDSAP384SHA384 or ED25519", conf.DNSSEC.Algorithm)
+	}
+	if conf.DNSSEC.SignatureValidity <= 0 {
+		conf.DNSSEC.SignatureValidity = 604800
+	}
+	if conf.DNSSEC.KeyStorage == "" {
+		conf.DNSSEC.KeyStorage = "disk"
+	}
+	if conf.DNSSEC.KeyStorage != "disk" && conf.DNSSEC.KeyStorage != "database" {
+		return conf, fmt.Errorf("unknown DNSSEC key_storage %q, must be disk or database", conf.DNSSEC.KeyStorage)
+	}
+	if conf.DNSSEC.ZSKLifetime < 0 {
+		conf.DNSSEC.ZSKLifetime = 0
+	}
+	if conf.DNSSEC.RolloverDelay <= 0 {
+		conf.DNSSEC.RolloverDelay = 172800
+	}
+	if _, err := newTSIGKeyring(conf.TSIG.Keys); err != nil {
+		return conf, err
+	}
+	if conf.Replication.Replica != "" && conf.Database.Engine != "sqlite3" {
+		return conf, errors.New("replication to a PostgreSQL replica needs the sqlite3 database engine")
+	}
+	if conf.Replication.Interval <= 0 {
+		conf.Replication.Interval = 2
+	}
+	if conf.Replication.BatchSize <= 0 {
+		conf.Replication.BatchSize = 500
+	}
 
 	return conf, nil
 }
@@ -90,23 +246,100 @@ func sanitizeDomainQuestion(d string) string {
 	return dom
 }
 
-func setupLogging(format string, level string) {
-	if format == "json" {
-		log.SetFormatter(&log.JSONFormatter{})
+// Loggers of the components that can have their own log level
+var (
+	apiLog = log.WithField("component", "api")
+	dnsLog = log.WithField("component", "dns")
+	dbLog  = log.WithField("component", "db")
+)
+
+// componentLevelFilter drops the entries above the log level of their component.
+// The level of the logger is the most verbose of the configured levels, so the
+// entries of the other components are filtered here.
+type componentLevelFilter struct {
+	log.Formatter
+	level      log.Level
+	components map[string]log.Level
+}
+
+func (f *componentLevelFilter) Format(entry *log.Entry) ([]byte, error) {
+	level := f.level
+	if component, ok := entry.Data["component"].(string); ok {
+		if l, ok := f.components[component]; ok {
+			level = l
+		}
+	}
+	if entry.Level > level {
+		return nil, nil
 	}
+	return f.Formatter.Format(entry)
+}
+
+func parseLogLevel(level string) log.Level {
 	switch level {
-	default:
-		log.SetLevel(log.WarnLevel)
 	case "debug":
-		log.SetLevel(log.DebugLevel)
+		return log.DebugLevel
 	case "info":
-		log.SetLevel(log.InfoLevel)
+		return log.InfoLevel
 	case "error":
-		log.SetLevel(log.ErrorLevel)
+		return log.ErrorLevel
+	}
+	return log.WarnLevel
+}
+
+func setupLogging(config logconfig) {
+	filter := &componentLevelFilter{
+		Formatter:  &log.TextFormatter{},
+		level:      parseLogLevel(config.Level),
+		components: make(map[string]log.Level),
+	}
+	if config.Format == "json" {
+		filter.Formatter = &log.JSONFormatter{}
+	}
+	level := filter.level
+	for component, l := range map[string]string{"api": config.APILevel, "dns": config.DNSLevel, "db": config.DBLevel} {
+		if l == "" {
+			// Components without a level of their own use the global one
+			continue
+		}
+		filter.components[component] = parseLogLevel(l)
+		if filter.components[component] > level {
+			level = filter.components[component]
+		}
 	}
+	log.SetFormatter(filter)
+	log.SetLevel(level)
 	// TODO: file logging
 }
 
+// nonNilStrings returns an empty slice instead of nil, so that it's encoded as a JSON array
+func nonNilStrings(s []string) []string {
+	if s == nil {
+		return []string{}
+	}
+	return s
+}
+
+// mergePatch applies a JSON Merge Patch (RFC 7396) to the decoded JSON document
+func mergePatch(target interface{}, patch interface{}) interface{} {
+	patchObj, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	targetObj, ok := target.(map[string]interface{})
+	if !ok {
+		targetObj = make(map[string]interface{})
+	}
+	for k, v := range patchObj {
+		if v == nil {
+			delete(targetObj, k)
+		} else {
+			targetObj[k] = mergePatch(targetObj[k], v)
+		}
+	}
+	return targetObj
+}
+
 func getIPListFromHeader(header string) []string {
 	iplist := []string{}
 	for _, v := range strings.Split(header, ",") {
@@ -1,7 +1,11 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
+	"io"
 	"os"
+	"strings"
 	"syscall"
 	"testing"
 
@@ -20,13 +24,45 @@ func TestSetupLogging(t *testing.T) {
 		{"json", "error", "error"},
 		{"text", "something", "warning"},
 	} {
-		setupLogging(test.format, test.level)
+		setupLogging(logconfig{Format: test.format, Level: test.level})
 		if log.GetLevel().String() != test.expected {
 			t.Errorf("Test %d: Expected loglevel %s but got %s", i, test.expected, log.GetLevel().String())
 		}
 	}
 }
 
+func TestComponentLogLevels(t *testing.T) {
+	defer setupLogging(logconfig{})
+	defer log.SetOutput(io.Discard)
+	var out bytes.Buffer
+	setupLogging(logconfig{Level: "warning", DNSLevel: "debug", DBLevel: "error"})
+	log.SetOutput(&out)
+	if log.GetLevel() != log.DebugLevel {
+		t.Errorf("Expected the logger at the most verbose level, got %s", log.GetLevel())
+	}
+	dnsLog.Debug("dns debug")
+	apiLog.Debug("api debug")
+	apiLog.Warning("api warning")
+	dbLog.Warning("db warning")
+	dbLog.Error("db error")
+	log.Info("global info")
+	for _, test := range []struct {
+		message string
+		logged  bool
+	}{
+		{"dns debug", true},
+		{"api debug", false},
+		{"api warning", true},
+		{"db warning", false},
+		{"db error", true},
+		{"global info", false},
+	} {
+		if strings.Contains(out.String(), test.message) != test.logged {
+			t.Errorf("Expected %q to be logged: %t, got %q", test.message, test.logged, out.String())
+		}
+	}
+}
+
 func TestReadConfig(t *testing.T) {
 	for i, test := range []struct {
 		inFile []byte
@@ -148,3 +184,60 @@ func TestPrepareConfig(t *testing.T) {
 		}
 	}
 }
+
+func TestDecodeErrorDetails(t *testing.T) {
+	var target ACMETxt
+	for i, test := range []struct {
+		input   string
+		field   string
+		message string
+	}{
+		{`{"allowfrom": "1.1.1.1/32"}`, "allowfrom", "expected main.cidrslice but got string"},
+		{`{"txt": 12}`, "txt", "expected string but got number"},
+		{`{"txt": }`, "", "malformed JSON at offset 9: invalid character '}' looking for beginning of value"},
+	} {
+		err := json.Unmarshal([]byte(test.input), &target)
+		if err == nil {
+			t.Fatalf("Test %d: Expected decoding error", i)
+		}
+		details := decodeErrorDetails(err)
+		if len(details) != 1 {
+			t.Fatalf("Test %d: Expected exactly one field error, got %d", i, len(details))
+		}
+		if details[0].Field != test.field || details[0].Message != test.message {
+			t.Errorf("Test %d: Expected [%s: %s] but got [%s: %s]", i, test.field, test.message, details[0].Field, details[0].Message)
+		}
+	}
+}
+
+func TestMergePatch(t *testing.T) {
+	// Test cases from RFC 7396 appendix A
+	for i, test := range []struct {
+		target string
+		patch  string
+		result string
+	}{
+		{`{"a":"b"}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"b"}`, `{"b":"c"}`, `{"a":"b","b":"c"}`},
+		{`{"a":"b"}`, `{"a":null}`, `{}`},
+		{`{"a":"b","b":"c"}`, `{"a":null}`, `{"b":"c"}`},
+		{`{"a":["b"]}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"c"}`, `{"a":["b"]}`, `{"a":["b"]}`},
+		{`{"a":{"b":"c"}}`, `{"a":{"b":"d","c":null}}`, `{"a":{"b":"d"}}`},
+		{`{"a":[{"b":"c"}]}`, `{"a":[1]}`, `{"a":[1]}`},
+		{`["a","b"]`, `["c","d"]`, `["c","d"]`},
+		{`{"a":"b"}`, `["c"]`, `["c"]`},
+		{`{"a":"foo"}`, `null`, `null`},
+		{`{"e":null}`, `{"a":1}`, `{"a":1,"e":null}`},
+		{`[1,2]`, `{"a":"b","c":null}`, `{"a":"b"}`},
+		{`{}`, `{"a":{"bb":{"ccc":null}}}`, `{"a":{"bb":{}}}`},
+	} {
+		var target, patch interface{}
+		_ = json.Unmarshal([]byte(test.target), &target)
+		_ = json.Unmarshal([]byte(test.patch), &patch)
+		res, _ := json.Marshal(mergePatch(target, patch))
+		if string(res) != test.result {
+			t.Errorf("Test %d: Expected %s but got %s", i, test.result, string(res))
+		}
+	}
+}
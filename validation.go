@@ -1,10 +1,17 @@
 package main
 
 import (
-	"unicode/utf8"
+	"context"
+	"fmt"
+	"net"
+	"net/url"
 	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
 
 	"github.com/google/uuid"
+	"github.com/miekg/dns"
 	"golang.org/x/crypto/bcrypt"
 )
 
@@ -31,6 +38,12 @@ func validSubdomain(s string) bool {
 	return RegExp.MatchString(s)
 }
 
+// validTag checks the format of a registration tag
+func validTag(s string) bool {
+	RegExp := regexp.MustCompile("^[A-Za-z0-9_.:-]{1,64}$")
+	return RegExp.MatchString(s)
+}
+
 func validTXT(s string) bool {
 	sn := sanitizeString(s)
 	if utf8.RuneCountInString(s) == 43 && utf8.RuneCountInString(sn) == 43 {
@@ -46,3 +59,374 @@ func correctPassword(pw string, hash string) bool {
 	}
 	return false
 }
+
+// validateAllowFrom returns details of every invalid CIDR mask in the list
+func validateAllowFrom(c cidrslice) []fieldError {
+	var details []fieldError
+	for i, v := range c {
+		_, _, err := net.ParseCIDR(sanitizeIPv6addr(v))
+		if err != nil {
+			details = append(details, fieldError{fmt.Sprintf("allowfrom[%d]", i), err.Error()})
+		}
+	}
+	return details
+}
+
+// validateUpdatePost checks the posted record values and normalizes the IP addresses
+// in place. It returns the error code of the first problem found, along with details
+// of every invalid field.
+func validateUpdatePost(a *ACMETxtPost) (string, []fieldError) {
+	var code string
+	var details []fieldError
+	fail := func(c string, field string, message string) {
+		if code == "" {
+			code = c
+		}
+		details = append(details, fieldError{field, message})
+	}
+	// NOTE: An invalid subdomain should not happen - the auth handler should
+	// reject POSTs with an invalid subdomain before this handler. Reject any
+	// invalid subdomains anyway as a matter of caution.
+	if !validSubdomain(a.Subdomain) {
+		fail("bad_subdomain", "subdomain", "not a valid subdomain label")
+	}
+	if a.Value == "" && len(a.AValues) < 1 && len(a.AAAAValues) < 1 && a.CNAME == "" && len(a.MXValues) < 1 && len(a.SRVValues) < 1 && len(a.CAAValues) < 1 && len(a.Records) < 1 && !a.ClearA && !a.ClearAAAA && !a.ClearCNAME && !a.ClearMX && !a.ClearSRV && !a.ClearCAA && len(a.ClearRecords) < 1 {
+		fail("bad_txt", "txt", "at least one of txt, a, aaaa, cname, mx, srv, caa, records, clear_a, clear_aaaa, clear_cname, clear_mx, clear_srv, clear_caa or clear_records is required")
+	}
+	if a.ClearA && len(a.AValues) > 0 {
+		fail("bad_a", "clear_a", "can't be combined with a values")
+	}
+	if a.ClearAAAA && len(a.AAAAValues) > 0 {
+		fail("bad_aaaa", "clear_aaaa", "can't be combined with aaaa values")
+	}
+	if a.ClearCNAME && a.CNAME != "" {
+		fail("bad_cname", "clear_cname", "can't be combined with a cname")
+	}
+	if a.ClearMX && len(a.MXValues) > 0 {
+		fail("bad_mx", "clear_mx", "can't be combined with mx values")
+	}
+	if a.ClearSRV && len(a.SRVValues) > 0 {
+		fail("bad_srv", "clear_srv", "can't be combined with srv values")
+	}
+	if a.ClearCAA && len(a.CAAValues) > 0 {
+		fail("bad_caa", "clear_caa", "can't be combined with caa values")
+	}
+	valuesCode, valuesDetails := validateRecordValues(a)
+	if code == "" {
+		code = valuesCode
+	}
+	return code, append(details, valuesDetails...)
+}
+
+// validateRecordValues checks the record values and the TXT slot, normalizing the
+// IP addresses and target names in place. Empty values are allowed.
+func validateRecordValues(a *ACMETxtPost) (string, []fieldError) {
+	var code string
+	var details []fieldError
+	fail := func(c string, field string, message string) {
+		if code == "" {
+			code = c
+		}
+		details = append(details, fieldError{field, message})
+	}
+	if a.Value != "" && !validTXT(a.Value) {
+		fail("bad_txt", "txt", "must be exactly 43 characters of URL safe base64")
+	}
+	if a.Slot != nil && (*a.Slot < 0 || *a.Slot >= txtSlotCount()) {
+		fail("bad_slot", "slot", fmt.Sprintf("must be between 0 and %d", txtSlotCount()-1))
+	}
+	if a.Wildcard != nil {
+		switch {
+		case a.Value == "":
+			fail("bad_wildcard", "wildcard", "requires a txt value")
+		case a.Slot != nil:
+			fail("bad_wildcard", "wildcard", "can't be combined with slot")
+		case txtSlotCount() < 2:
+			fail("bad_wildcard", "wildcard", "requires at least two TXT slots")
+		default:
+			slot := wildcardSlot(*a.Wildcard)
+			a.Slot = &slot
+		}
+	}
+	if a.TTL != 0 {
+		if a.TTL < minTTL() || a.TTL > maxTTL() {
+			fail("bad_ttl", "ttl", fmt.Sprintf("must be between %d and %d", minTTL(), maxTTL()))
+		} else if len(ttlSetTypes(*a)) == 0 {
+			fail("bad_ttl", "ttl", "requires txt, a, aaaa, cname, mx, srv or caa values")
+		}
+	}
+	if a.CorrelationID != "" {
+		if a.Value == "" {
+			fail("bad_correlation_id", "correlation_id", "requires a txt value")
+		} else if !validCorrelationID.MatchString(a.CorrelationID) {
+			fail("bad_correlation_id", "correlation_id", "must be 1 to 128 printable ASCII characters without spaces")
+		}
+	}
+	for i := range a.AValues {
+		ip := net.ParseIP(a.AValues[i])
+		if ip != nil {
+			ip = ip.To4()
+		}
+		if ip == nil {
+			fail("bad_a", fmt.Sprintf("a[%d]", i), "not a valid IPv4 address")
+			continue
+		}
+		a.AValues[i] = ip.String()
+	}
+	for i := range a.AAAAValues {
+		ip6 := net.ParseIP(a.AAAAValues[i])
+		if ip6 == nil || ip6.To4() != nil {
+			fail("bad_aaaa", fmt.Sprintf("aaaa[%d]", i), "not a valid IPv6 address")
+			continue
+		}
+		a.AAAAValues[i] = ip6.String()
+	}
+	for i := range a.MXValues {
+		mx := &a.MXValues[i]
+		if mx.Priority < 0 || mx.Priority > 65535 {
+			fail("bad_mx", fmt.Sprintf("mx[%d].priority", i), "must be between 0 and 65535")
+		}
+		if strings.TrimSpace(mx.Target) == "." {
+			// A null MX tells the subdomain accepts no mail at all (RFC 7505)
+			mx.Target = "."
+			if len(a.MXValues) > 1 {
+				fail("bad_mx", fmt.Sprintf("mx[%d].target", i), "a null MX must be the only mx value")
+			}
+		} else if target, ok := validTargetName(mx.Target); ok {
+			mx.Target = target
+		} else {
+			fail("bad_mx", fmt.Sprintf("mx[%d].target", i), "must be a fully qualified domain name")
+		}
+	}
+	for i := range a.SRVValues {
+		srv := &a.SRVValues[i]
+		for _, field := range []struct {
+			name  string
+			value int
+		}{{"priority", srv.Priority}, {"weight", srv.Weight}, {"port", srv.Port}} {
+			if field.value < 0 || field.value > 65535 {
+				fail("bad_srv", fmt.Sprintf("srv[%d].%s", i, field.name), "must be between 0 and 65535")
+			}
+		}
+		if strings.TrimSpace(srv.Target) == "." {
+			// The service is decidedly not available at the subdomain (RFC 2782)
+			srv.Target = "."
+			if len(a.SRVValues) > 1 {
+				fail("bad_srv", fmt.Sprintf("srv[%d].target", i), "a srv value with the target . must be the only one")
+			}
+		} else if target, ok := validTargetName(srv.Target); ok {
+			srv.Target = target
+		} else {
+			fail("bad_srv", fmt.Sprintf("srv[%d].target", i), "must be a fully qualified domain name")
+		}
+	}
+	for i := range a.CAAValues {
+		caa := &a.CAAValues[i]
+		if caa.Flags < 0 || caa.Flags > 255 {
+			fail("bad_caa", fmt.Sprintf("caa[%d].flags", i), "must be between 0 and 255")
+		}
+		caa.Tag = strings.ToLower(strings.TrimSpace(caa.Tag))
+		caa.Value = strings.TrimSpace(caa.Value)
+		if message := validCAAValue(caa.Tag, caa.Value); message != "" {
+			field := "value"
+			if caa.Tag != "issue" && caa.Tag != "issuewild" && caa.Tag != "iodef" {
+				field = "tag"
+			}
+			fail("bad_caa", fmt.Sprintf("caa[%d].%s", i, field), message)
+		}
+	}
+	for i := range a.Records {
+		g := &a.Records[i]
+		g.Type = strings.ToUpper(strings.TrimSpace(g.Type))
+		if g.TTL == 0 {
+			g.TTL = minTTL()
+		}
+		if g.TTL < minTTL() || g.TTL > maxTTL() {
+			fail("bad_records", fmt.Sprintf("records[%d].ttl", i), fmt.Sprintf("must be between %d and %d", minTTL(), maxTTL()))
+		}
+		content, message := parseGenericRecord(g.Type, strings.TrimSpace(g.Content))
+		if _, ok := genericTypes[g.Type]; !ok {
+			fail("bad_records", fmt.Sprintf("records[%d].type", i), message)
+		} else if message != "" {
+			fail("bad_records", fmt.Sprintf("records[%d].content", i), message)
+		} else {
+			g.Content = content
+		}
+	}
+	for i := range a.ClearRecords {
+		a.ClearRecords[i] = strings.ToUpper(strings.TrimSpace(a.ClearRecords[i]))
+		if _, ok := genericTypes[a.ClearRecords[i]]; !ok {
+			fail("bad_records", fmt.Sprintf("clear_records[%d]", i), "must be one of "+strings.Join(genericTypeNames(), ", "))
+			continue
+		}
+		for _, g := range a.Records {
+			if g.Type == a.ClearRecords[i] {
+				fail("bad_records", fmt.Sprintf("clear_records[%d]", i), "can't be combined with records of the type")
+				break
+			}
+		}
+	}
+	if len(details) == 0 {
+		sort.Slice(a.Records, func(i, j int) bool {
+			if a.Records[i].Type != a.Records[j].Type {
+				return a.Records[i].Type < a.Records[j].Type
+			}
+			return a.Records[i].Content < a.Records[j].Content
+		})
+		sort.Slice(a.CAAValues, func(i, j int) bool {
+			ci, cj := a.CAAValues[i], a.CAAValues[j]
+			if ci.Tag != cj.Tag {
+				return ci.Tag < cj.Tag
+			}
+			if ci.Value != cj.Value {
+				return ci.Value < cj.Value
+			}
+			return ci.Flags < cj.Flags
+		})
+		// Served and stored in the order of preference
+		sort.Slice(a.MXValues, func(i, j int) bool {
+			mi, mj := a.MXValues[i], a.MXValues[j]
+			return mi.Priority < mj.Priority || (mi.Priority == mj.Priority && mi.Target < mj.Target)
+		})
+		sort.Slice(a.SRVValues, func(i, j int) bool {
+			si, sj := a.SRVValues[i], a.SRVValues[j]
+			if si.Priority != sj.Priority {
+				return si.Priority < sj.Priority
+			}
+			if si.Weight != sj.Weight {
+				return si.Weight > sj.Weight
+			}
+			return si.String() < sj.String()
+		})
+	}
+	if a.CNAME != "" {
+		if target, ok := validTargetName(a.CNAME); ok {
+			a.CNAME = target
+		} else {
+			fail("bad_cname", "cname", "must be a fully qualified domain name")
+		}
+		if len(a.AValues) > 0 || len(a.AAAAValues) > 0 || len(a.MXValues) > 0 || len(a.SRVValues) > 0 || len(a.CAAValues) > 0 || len(a.Records) > 0 {
+			fail("bad_cname", "cname", "can't be combined with a, aaaa, mx, srv, caa or records values")
+		}
+	}
+	return code, details
+}
+
+// validTargetName checks the target name of a CNAME, MX or SRV record and returns it
+// in canonical form
+func validTargetName(s string) (string, bool) {
+	s = strings.ToLower(dns.Fqdn(strings.TrimSpace(s)))
+	if _, ok := dns.IsDomainName(s); !ok || dns.CountLabel(s) < 2 || strings.Contains(s, "*") {
+		return "", false
+	}
+	return s, true
+}
+
+// caaIssuer and caaParameter match the issuer domain name and the parameters of
+// the issue and issuewild properties (RFC 8659)
+var caaIssuer = regexp.MustCompile(`^[A-Za-z0-9]([A-Za-z0-9-]*[A-Za-z0-9])?(\.[A-Za-z0-9]([A-Za-z0-9-]*[A-Za-z0-9])?)*$`)
+var caaParameter = regexp.MustCompile(`^[A-Za-z0-9]+=[\x21-\x3A\x3C-\x7E]*$`)
+
+// validCorrelationID matches the correlation IDs clients can store with TXT values
+var validCorrelationID = regexp.MustCompile(`^[\x21-\x7E]{1,128}$`)
+
+// validCAAValue checks the value of a CAA property with the tag, returning the
+// reason it's invalid or an empty string
+func validCAAValue(tag string, value string) string {
+	if len(value) > 255 {
+		return "must be at most 255 characters"
+	}
+	switch tag {
+	case "issue", "issuewild":
+		// An issuer domain name followed by parameters, or only ";" to forbid issuance
+		parts := strings.Split(value, ";")
+		issuer := strings.TrimSpace(parts[0])
+		if issuer != "" && !caaIssuer.MatchString(issuer) {
+			return "must be an issuer domain name, optionally followed by parameters"
+		}
+		for _, param := range parts[1:] {
+			param = strings.TrimSpace(param)
+			if param != "" && !caaParameter.MatchString(param) {
+				return "must be an issuer domain name, optionally followed by parameters"
+			}
+		}
+	case "iodef":
+		u, err := url.Parse(value)
+		if err != nil || (u.Scheme != "mailto" && u.Scheme != "http" && u.Scheme != "https") || (u.Scheme == "mailto" && u.Opaque == "") || (u.Scheme != "mailto" && u.Host == "") {
+			return "must be a mailto:, http: or https: URL"
+		}
+	default:
+		return "must be one of issue, issuewild or iodef"
+	}
+	return ""
+}
+
+// validateSettings checks the registration settings, returning details of every invalid field
+func validateSettings(s registrationSettings) []fieldError {
+	details := validateAllowFrom(s.AllowFrom)
+	if utf8.RuneCountInString(s.Description) > 255 {
+		details = append(details, fieldError{"description", "must be at most 255 characters"})
+	}
+	if len(s.Webhooks) > 0 && !Config.API.AllowWebhooks {
+		details = append(details, fieldError{"webhooks", "webhooks are disabled on this server"})
+	}
+	for i, v := range s.Webhooks {
+		u, err := url.Parse(v)
+		if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			details = append(details, fieldError{fmt.Sprintf("webhooks[%d]", i), "must be an absolute http or https URL"})
+		} else if Config.API.AllowWebhooks {
+			if _, err = resolvePublic(context.Background(), u.Hostname()); err != nil {
+				details = append(details, fieldError{fmt.Sprintf("webhooks[%d]", i), "must resolve to public addresses only"})
+			}
+		}
+	}
+	allowedTypes := append(append([]string{}, recordTypes...), genericTypeNames()...)
+	for i, v := range s.AllowedTypes {
+		known := false
+		for _, t := range allowedTypes {
+			if v == t {
+				known = true
+			}
+		}
+		if !known {
+			details = append(details, fieldError{fmt.Sprintf("allowed_types[%d]", i), fmt.Sprintf("must be one of %s", strings.Join(allowedTypes, ", "))})
+		}
+	}
+	if len(s.Tags) > 32 {
+		details = append(details, fieldError{"tags", "must have at most 32 tags"})
+	}
+	for i, v := range s.Tags {
+		if !validTag(v) {
+			details = append(details, fieldError{fmt.Sprintf("tags[%d]", i), "must be 1-64 characters of letters, digits, '-', '_', '.' and ':'"})
+		}
+	}
+	return append(details, validateSubnetAnswers(s.SubnetAnswers)...)
+}
+
+// validateSubnetAnswers checks the subnets and the addresses answered in them
+func validateSubnetAnswers(answers []subnetAnswer) []fieldError {
+	var details []fieldError
+	if len(answers) > maxSubnetAnswers {
+		details = append(details, fieldError{"subnet_answers", fmt.Sprintf("must have at most %d subnets", maxSubnetAnswers)})
+	}
+	for i, answer := range answers {
+		field := fmt.Sprintf("subnet_answers[%d]", i)
+		if _, _, err := net.ParseCIDR(answer.Subnet); err != nil {
+			details = append(details, fieldError{field + ".subnet", "must be a subnet in the CIDR notation"})
+		}
+		if len(answer.A) == 0 && len(answer.AAAA) == 0 {
+			details = append(details, fieldError{field, "must have a or aaaa addresses"})
+		}
+		for j, v := range answer.A {
+			if ip := net.ParseIP(v); ip == nil || ip.To4() == nil {
+				details = append(details, fieldError{fmt.Sprintf("%s.a[%d]", field, j), "must be an IPv4 address"})
+			}
+		}
+		for j, v := range answer.AAAA {
+			if ip := net.ParseIP(v); ip == nil || ip.To4() != nil {
+				details = append(details, fieldError{fmt.Sprintf("%s.aaaa[%d]", field, j), "must be an IPv6 address"})
+			}
+		}
+	}
+	return details
+}
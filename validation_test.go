@@ -131,3 +131,160 @@ func TestGetValidCIDRMasks(t *testing.T) {
 		}
 	}
 }
+
+func TestValidateUpdatePost(t *testing.T) {
+	validTXT := "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"
+	for i, test := range []struct {
+		post   ACMETxtPost
+		code   string
+		fields []string
+	}{
+		{ACMETxtPost{Subdomain: "valid", Value: validTXT}, "", nil},
+		{ACMETxtPost{Subdomain: "valid", AValues: []string{"::ffff:1.2.3.4"}}, "", nil},
+		{ACMETxtPost{Subdomain: "in.valid", Value: validTXT}, "bad_subdomain", []string{"subdomain"}},
+		{ACMETxtPost{Subdomain: "valid"}, "bad_txt", []string{"txt"}},
+		{ACMETxtPost{Subdomain: "valid", Value: "short"}, "bad_txt", []string{"txt"}},
+		{ACMETxtPost{Subdomain: "valid", Value: validTXT, Slot: intPtr(5)}, "bad_slot", []string{"slot"}},
+		{ACMETxtPost{Subdomain: "valid", Value: validTXT, CorrelationID: "pipeline-run-4711"}, "", nil},
+		{ACMETxtPost{Subdomain: "valid", AValues: []string{"192.0.2.1"}, TTL: 3600}, "", nil},
+		{ACMETxtPost{Subdomain: "valid", AValues: []string{"192.0.2.1"}, TTL: 86401}, "bad_ttl", []string{"ttl"}},
+		{ACMETxtPost{Subdomain: "valid", ClearA: true, TTL: 300}, "bad_ttl", []string{"ttl"}},
+		{ACMETxtPost{Subdomain: "valid", Value: validTXT, CorrelationID: "pipeline run"}, "bad_correlation_id", []string{"correlation_id"}},
+		{ACMETxtPost{Subdomain: "valid", AValues: []string{"192.0.2.1"}, CorrelationID: "run-1"}, "bad_correlation_id", []string{"correlation_id"}},
+		{ACMETxtPost{Subdomain: "valid", AValues: []string{"1.2.3.4", "::1", "bad"}}, "bad_a", []string{"a[1]", "a[2]"}},
+		{ACMETxtPost{Subdomain: "valid", Value: "short", AAAAValues: []string{"1.2.3.4"}}, "bad_txt", []string{"txt", "aaaa[0]"}},
+		{ACMETxtPost{Subdomain: "valid", ClearA: true}, "", nil},
+		{ACMETxtPost{Subdomain: "valid", ClearAAAA: true, AValues: []string{"1.2.3.4"}}, "", nil},
+		{ACMETxtPost{Subdomain: "valid", ClearA: true, AValues: []string{"1.2.3.4"}}, "bad_a", []string{"clear_a"}},
+		{ACMETxtPost{Subdomain: "valid", CNAME: "host.example.net"}, "", nil},
+		{ACMETxtPost{Subdomain: "valid", CNAME: "host"}, "bad_cname", []string{"cname"}},
+		{ACMETxtPost{Subdomain: "valid", CNAME: "host.example.net", AAAAValues: []string{"::1"}}, "bad_cname", []string{"cname"}},
+		{ACMETxtPost{Subdomain: "valid", CNAME: "host.example.net", ClearCNAME: true}, "bad_cname", []string{"clear_cname"}},
+		{ACMETxtPost{Subdomain: "valid", MXValues: []mxRecord{{10, "mail.example.net"}, {20, "backup.example.net."}}}, "", nil},
+		{ACMETxtPost{Subdomain: "valid", MXValues: []mxRecord{{0, "."}}}, "", nil},
+		{ACMETxtPost{Subdomain: "valid", ClearMX: true}, "", nil},
+		{ACMETxtPost{Subdomain: "valid", MXValues: []mxRecord{{65536, "mail.example.net"}, {-1, "mail"}}}, "bad_mx", []string{"mx[0].priority", "mx[1].priority", "mx[1].target"}},
+		{ACMETxtPost{Subdomain: "valid", MXValues: []mxRecord{{0, "."}, {10, "mail.example.net"}}}, "bad_mx", []string{"mx[0].target"}},
+		{ACMETxtPost{Subdomain: "valid", MXValues: []mxRecord{{10, "mail.example.net"}}, ClearMX: true}, "bad_mx", []string{"clear_mx"}},
+		{ACMETxtPost{Subdomain: "valid", MXValues: []mxRecord{{10, "mail.example.net"}}, CNAME: "host.example.net"}, "bad_cname", []string{"cname"}},
+		{ACMETxtPost{Subdomain: "valid", SRVValues: []srvRecord{{10, 5, 5060, "sip.example.net"}, {20, 0, 5060, "backup.example.net"}}}, "", nil},
+		{ACMETxtPost{Subdomain: "valid", SRVValues: []srvRecord{{0, 0, 0, "."}}}, "", nil},
+		{ACMETxtPost{Subdomain: "valid", ClearSRV: true}, "", nil},
+		{ACMETxtPost{Subdomain: "valid", SRVValues: []srvRecord{{-1, 70000, 65536, "sip"}}}, "bad_srv", []string{"srv[0].priority", "srv[0].weight", "srv[0].port", "srv[0].target"}},
+		{ACMETxtPost{Subdomain: "valid", SRVValues: []srvRecord{{0, 0, 0, "."}, {10, 5, 5060, "sip.example.net"}}}, "bad_srv", []string{"srv[0].target"}},
+		{ACMETxtPost{Subdomain: "valid", SRVValues: []srvRecord{{10, 5, 5060, "sip.example.net"}}, ClearSRV: true}, "bad_srv", []string{"clear_srv"}},
+		{ACMETxtPost{Subdomain: "valid", SRVValues: []srvRecord{{10, 5, 5060, "sip.example.net"}}, CNAME: "host.example.net"}, "bad_cname", []string{"cname"}},
+		{ACMETxtPost{Subdomain: "valid", CAAValues: []caaRecord{{0, "issue", "letsencrypt.org"}, {0, "IssueWild", ";"}, {128, "iodef", "https://example.com/report"}}}, "", nil},
+		{ACMETxtPost{Subdomain: "valid", CAAValues: []caaRecord{{0, "issue", "ca.example.net; account=1234; validationmethods=dns-01"}, {0, "iodef", "mailto:security@example.com"}}}, "", nil},
+		{ACMETxtPost{Subdomain: "valid", ClearCAA: true}, "", nil},
+		{ACMETxtPost{Subdomain: "valid", Records: []genericRecord{{"tlsa", "3 1 1 abababababababababababababababababababababababababababababababab", 0}, {"SSHFP", "4 2 abababababababababababababababababababababababababababababababab", 3600}}}, "", nil},
+		{ACMETxtPost{Subdomain: "valid", ClearRecords: []string{"naptr"}}, "", nil},
+		{ACMETxtPost{Subdomain: "valid", Records: []genericRecord{{"HINFO", "PC Linux", 1}, {"TLSA", "9 1 1 abababababababababababababababababababababababababababababababab", 90000}}}, "bad_records", []string{"records[0].type", "records[1].ttl", "records[1].content"}},
+		{ACMETxtPost{Subdomain: "valid", Records: []genericRecord{{"TLSA", "3 1 1 abababababababababababababababababababababababababababababababab", 1}}, ClearRecords: []string{"tlsa", "ptr"}}, "bad_records", []string{"clear_records[0]", "clear_records[1]"}},
+		{ACMETxtPost{Subdomain: "valid", Records: []genericRecord{{"TLSA", "3 1 1 abababababababababababababababababababababababababababababababab", 1}}, CNAME: "host.example.net"}, "bad_cname", []string{"cname"}},
+		{ACMETxtPost{Subdomain: "valid", CAAValues: []caaRecord{{256, "issue", "letsencrypt.org"}, {0, "tbs", "x"}}}, "bad_caa", []string{"caa[0].flags", "caa[1].tag"}},
+		{ACMETxtPost{Subdomain: "valid", CAAValues: []caaRecord{{0, "issue", "letsencrypt.org."}, {0, "issuewild", "ca.example.net; bad param"}, {0, "iodef", "ftp://example.com"}, {0, "iodef", "mailto:"}}}, "bad_caa", []string{"caa[0].value", "caa[1].value", "caa[2].value", "caa[3].value"}},
+		{ACMETxtPost{Subdomain: "valid", CAAValues: []caaRecord{{0, "issue", "letsencrypt.org"}}, ClearCAA: true}, "bad_caa", []string{"clear_caa"}},
+		{ACMETxtPost{Subdomain: "valid", CAAValues: []caaRecord{{0, "issue", "letsencrypt.org"}}, CNAME: "host.example.net"}, "bad_cname", []string{"cname"}},
+	} {
+		code, details := validateUpdatePost(&test.post)
+		if code != test.code {
+			t.Errorf("Test %d: Expected error code [%s] but got [%s]", i, test.code, code)
+		}
+		if len(details) != len(test.fields) {
+			t.Errorf("Test %d: Expected %d field errors but got %d", i, len(test.fields), len(details))
+			continue
+		}
+		for j, field := range test.fields {
+			if details[j].Field != field {
+				t.Errorf("Test %d: Expected error for field [%s] but got [%s]", i, field, details[j].Field)
+			}
+		}
+	}
+}
+
+func TestValidateAllowFrom(t *testing.T) {
+	details := validateAllowFrom(cidrslice{"10.0.0.0/8", "invalid", "[::1]/128", "1.2.3.4/33"})
+	if len(details) != 2 {
+		t.Fatalf("Expected 2 field errors but got %d", len(details))
+	}
+	if details[0].Field != "allowfrom[1]" || details[1].Field != "allowfrom[3]" {
+		t.Errorf("Unexpected field errors %v", details)
+	}
+}
+
+func TestValidateWebhooks(t *testing.T) {
+	Config.API.AllowWebhooks = true
+	defer func() { Config.API.AllowWebhooks = false }()
+	details := validateSettings(registrationSettings{Webhooks: []string{
+		"https://192.0.2.1/acme",
+		"http://127.0.0.1:8080/acme",
+		"http://169.254.169.254/latest/meta-data",
+		"https://[fd00::1]/acme",
+		"ftp://192.0.2.1/acme",
+	}})
+	if len(details) != 4 {
+		t.Fatalf("Expected 4 field errors but got %d: %v", len(details), details)
+	}
+	for i, field := range []string{"webhooks[1]", "webhooks[2]", "webhooks[3]", "webhooks[4]"} {
+		if details[i].Field != field {
+			t.Errorf("Expected field error for [%s] but got [%s]", field, details[i].Field)
+		}
+	}
+}
+
+func TestValidateWildcard(t *testing.T) {
+	base := "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"
+	wildcard := "bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb"
+	yes, no := true, false
+	slot := 1
+	for i, test := range []struct {
+		post ACMETxtPost
+		code string
+		slot int
+	}{
+		{ACMETxtPost{Subdomain: "valid", Value: base, Wildcard: &no}, "", 0},
+		{ACMETxtPost{Subdomain: "valid", Value: wildcard, Wildcard: &yes}, "", 1},
+		{ACMETxtPost{Subdomain: "valid", AValues: []string{"192.0.2.1"}, Wildcard: &yes}, "bad_wildcard", 0},
+		{ACMETxtPost{Subdomain: "valid", Value: wildcard, Wildcard: &yes, Slot: &slot}, "bad_wildcard", 0},
+	} {
+		code, _ := validateUpdatePost(&test.post)
+		if code != test.code {
+			t.Errorf("Test %d: Expected error code [%s] but got [%s]", i, test.code, code)
+		}
+		if code == "" && (test.post.Slot == nil || *test.post.Slot != test.slot) {
+			t.Errorf("Test %d: Expected slot %d, got %v", i, test.slot, test.post.Slot)
+		}
+	}
+
+	Config.General.TXTSlots = 1
+	defer func() { Config.General.TXTSlots = 0 }()
+	post := ACMETxtPost{Subdomain: "valid", Value: base, Wildcard: &no}
+	if code, _ := validateUpdatePost(&post); code != "bad_wildcard" {
+		t.Errorf("Expected the flag to need two TXT slots, got [%s]", code)
+	}
+}
+
+func TestWildcardTokensKeepTheirSlots(t *testing.T) {
+	reg, err := DB.Register(cidrslice{}, registrationOrigin{}, ACMETxtPost{})
+	if err != nil {
+		t.Fatalf("Registration failed, got error [%v]", err)
+	}
+	yes, no := true, false
+	for _, update := range []ACMETxtPost{
+		{Subdomain: reg.Subdomain, Value: "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa", Wildcard: &no},
+		{Subdomain: reg.Subdomain, Value: "bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb", Wildcard: &yes},
+		{Subdomain: reg.Subdomain, Value: "ccccccccccccccccccccccccccccccccccccccccccc", Wildcard: &yes},
+	} {
+		if code, _ := validateUpdatePost(&update); code != "" {
+			t.Fatalf("Unexpected validation error [%s]", code)
+		}
+		if _, err = DB.Update(update); err != nil {
+			t.Fatalf("Update failed, got error [%v]", err)
+		}
+	}
+	txts, _ := DB.GetTXTForDomain(reg.Subdomain)
+	if len(txts) != 2 || txts[0] != "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa" || txts[1] != "ccccccccccccccccccccccccccccccccccccccccccc" {
+		t.Errorf("Expected the base name token to be kept, got %v", txts)
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// zoneMismatch is a difference between the stored records of a subdomain and the
+// answer of the DNS server
+type zoneMismatch struct {
+	Subdomain string
+	Type      string
+	Stored    []string
+	Served    []string
+	Error     error
+}
+
+func (m zoneMismatch) String() string {
+	if m.Error != nil {
+		return fmt.Sprintf("%s %s: query failed: %v", m.Subdomain, m.Type, m.Error)
+	}
+	return fmt.Sprintf("%s %s: stored %v, served %v", m.Subdomain, m.Type, m.Stored, m.Served)
+}
+
+// verifyZone queries the DNS server at addr for the records of every registration
+// and returns the answers that differ from the database, and the number of
+// subdomains checked
+func verifyZone(db database, addr string, domain string) ([]zoneMismatch, int, error) {
+	regs, err := db.ListRegistrations(registrationOrigin{})
+	if err != nil {
+		return nil, 0, err
+	}
+	var mismatches []zoneMismatch
+	for _, reg := range regs {
+		stored, err := storedRecords(db, reg.Subdomain)
+		if err != nil {
+			return mismatches, 0, err
+		}
+		name := dns.Fqdn(reg.Subdomain + "." + domain)
+		qtypes := []uint16{dns.TypeTXT, dns.TypeA, dns.TypeAAAA, dns.TypeMX, dns.TypeSRV, dns.TypeCAA}
+		for _, name := range genericTypeNames() {
+			qtypes = append(qtypes, dns.StringToType[strings.ToUpper(name)])
+		}
+		if _, ok := stored[dns.TypeCNAME]; ok {
+			// The alias is served for every type instead of the other records
+			qtypes = []uint16{dns.TypeCNAME}
+		}
+		for _, qtype := range qtypes {
+			m := zoneMismatch{Subdomain: reg.Subdomain, Type: dns.TypeToString[qtype], Stored: stored[qtype]}
+			m.Served, m.Error = servedRecords(addr, name, qtype)
+			if m.Error != nil || !sameRecords(m.Stored, m.Served) {
+				mismatches = append(mismatches, m)
+			}
+		}
+	}
+	return mismatches, len(regs), nil
+}
+
+// storedRecords returns the values of the records of the subdomain in the database,
+// in the presentation the DNS server answers with
+func storedRecords(db database, subdomain string) (map[uint16][]string, error) {
+	records := make(map[uint16][]string)
+	txts, err := db.GetTXTForDomain(subdomain)
+	if err != nil {
+		return nil, err
+	}
+	records[dns.TypeTXT] = servedTXT(txts)
+	target, err := db.GetCNAMEForDomain(subdomain)
+	if err != nil {
+		return nil, err
+	}
+	if target != "" {
+		records[dns.TypeCNAME] = []string{target}
+	}
+	mxs, err := db.GetMXForDomain(subdomain)
+	if err != nil {
+		return nil, err
+	}
+	records[dns.TypeMX] = mxStrings(mxs)
+	srvs, err := db.GetSRVForDomain(subdomain)
+	if err != nil {
+		return nil, err
+	}
+	records[dns.TypeSRV] = srvStrings(srvs)
+	caas, err := db.GetCAAForDomain(subdomain)
+	if err != nil {
+		return nil, err
+	}
+	records[dns.TypeCAA] = caaStrings(caas)
+	generic, err := db.GetRecordsForDomain(subdomain)
+	if err != nil {
+		return nil, err
+	}
+	for _, g := range generic {
+		qtype := dns.StringToType[g.Type]
+		records[qtype] = append(records[qtype], g.Content)
+	}
+	for qtype, get := range map[uint16]func(string) ([]net.IP, error){
+		dns.TypeA:    db.GetAForDomain,
+		dns.TypeAAAA: db.GetAAAAForDomain,
+	} {
+		ips, err := get(subdomain)
+		if err != nil {
+			return nil, err
+		}
+		for _, ip := range ips {
+			records[qtype] = append(records[qtype], ip.String())
+		}
+	}
+	return records, nil
+}
+
+// servedRecords returns the values of the records the DNS server answers with
+func servedRecords(addr string, name string, qtype uint16) ([]string, error) {
+	msg := new(dns.Msg)
+	msg.SetQuestion(name, qtype)
+	msg.SetEdns0(4096, false)
+	in, err := dns.Exchange(msg, addr)
+	if err == nil && in.Truncated {
+		client := dns.Client{Net: "tcp"}
+		in, _, err = client.Exchange(msg, addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if in.Rcode != dns.RcodeSuccess && in.Rcode != dns.RcodeNameError {
+		return nil, fmt.Errorf("server answered %s", dns.RcodeToString[in.Rcode])
+	}
+	var values []string
+	for _, rr := range in.Answer {
+		switch rec := rr.(type) {
+		case *dns.TXT:
+			values = append(values, strings.Join(rec.Txt, ""))
+		case *dns.A:
+			values = append(values, rec.A.String())
+		case *dns.AAAA:
+			values = append(values, rec.AAAA.String())
+		case *dns.CNAME:
+			values = append(values, rec.Target)
+		case *dns.MX:
+			values = append(values, mxRecord{int(rec.Preference), rec.Mx}.String())
+		case *dns.SRV:
+			values = append(values, srvRecord{int(rec.Priority), int(rec.Weight), int(rec.Port), rec.Target}.String())
+		case *dns.CAA:
+			values = append(values, caaRecord{int(rec.Flag), rec.Tag, rec.Value}.String())
+		default:
+			if _, ok := genericQtype(rr.Header().Rrtype); ok {
+				values = append(values, rrData(rr))
+			}
+		}
+	}
+	return values, nil
+}
+
+// sameRecords returns if the two sets of record values are equal
+func sameRecords(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	a = append([]string(nil), a...)
+	b = append([]string(nil), b...)
+	sort.Strings(a)
+	sort.Strings(b)
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// runVerifyZone runs the verify-zone command, reporting the mismatches to out. It
+// returns an error if the zone data isn't consistent.
+func runVerifyZone(db database, addr string, domain string, out io.Writer) error {
+	mismatches, checked, err := verifyZone(db, addr, domain)
+	for _, m := range mismatches {
+		fmt.Fprintln(out, m)
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "Checked %d subdomains, found %d mismatches\n", checked, len(mismatches))
+	if len(mismatches) > 0 {
+		return fmt.Errorf("the served zone data differs from the database")
+	}
+	return nil
+}
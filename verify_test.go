@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// staleDB answers with an outdated TXT value for one subdomain
+type staleDB struct {
+	database
+	subdomain string
+}
+
+func (s staleDB) GetTXTForDomain(domain string) ([]string, error) {
+	if domain == s.subdomain {
+		return []string{"outdated"}, nil
+	}
+	return s.database.GetTXTForDomain(domain)
+}
+
+func TestVerifyZone(t *testing.T) {
+	consistent, _ := DB.Register(cidrslice{}, registrationOrigin{}, ACMETxtPost{Value: "LHDhK3oGRvkiefQnx7OOczTY5Tic_xZ6HcMOc_gmtoM", AValues: []string{"192.0.2.10"}, AAAAValues: []string{"2001:db8::10"}})
+	stale, _ := DB.Register(cidrslice{}, registrationOrigin{}, ACMETxtPost{Value: "oUQqK3oGRvkiefQnx7OOczTY5Tic_xZ6HcMOc_gmtoM"})
+
+	mismatches, checked, err := verifyZone(staleDB{DB, stale.Subdomain}, dnsserver.Server.Addr, dnsserver.Domain)
+	if err != nil {
+		t.Fatalf("Verification failed: %v", err)
+	}
+	if checked < 2 {
+		t.Errorf("Expected the registrations to be checked, got %d", checked)
+	}
+	var found []zoneMismatch
+	for _, m := range mismatches {
+		if m.Subdomain == consistent.Subdomain || m.Subdomain == stale.Subdomain {
+			found = append(found, m)
+		}
+	}
+	if len(found) != 1 || found[0].Subdomain != stale.Subdomain || found[0].Type != "TXT" {
+		t.Fatalf("Expected a TXT mismatch for the stale subdomain only, got %v", found)
+	}
+	if found[0].Served[0] != "oUQqK3oGRvkiefQnx7OOczTY5Tic_xZ6HcMOc_gmtoM" {
+		t.Errorf("Expected the served value to be reported, got %v", found[0].Served)
+	}
+
+	var out bytes.Buffer
+	if err = runVerifyZone(staleDB{DB, stale.Subdomain}, dnsserver.Server.Addr, dnsserver.Domain, &out); err == nil {
+		t.Errorf("Expected an error for inconsistent zone data")
+	}
+	if !strings.Contains(out.String(), stale.Subdomain+" TXT: stored [outdated]") {
+		t.Errorf("Expected the mismatch in the output, got %q", out.String())
+	}
+}
+
+func TestSameRecords(t *testing.T) {
+	for i, test := range []struct {
+		a, b     []string
+		expected bool
+	}{
+		{nil, nil, true},
+		{[]string{"a", "b"}, []string{"b", "a"}, true},
+		{[]string{"a"}, []string{"a", "a"}, false},
+		{[]string{"a", "b"}, []string{"a", "c"}, false},
+	} {
+		if got := sameRecords(test.a, test.b); got != test.expected {
+			t.Errorf("Test %d: Expected %t, got %t", i, test.expected, got)
+		}
+	}
+}
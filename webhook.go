@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// webhookClient is used for delivering the events to the webhooks of the configuration
+var webhookClient = &http.Client{Timeout: 10 * time.Second, CheckRedirect: noRedirect}
+
+// registrationWebhookClient is used for delivering the events to the webhooks of the
+// registrations, which are set by the clients and may only connect to public addresses
+var registrationWebhookClient = &http.Client{
+	Timeout:       10 * time.Second,
+	CheckRedirect: noRedirect,
+	Transport:     &http.Transport{DialContext: dialPublic},
+}
+
+// noRedirect answers the redirects of webhook receivers as the responses instead of
+// following them
+func noRedirect(req *http.Request, via []*http.Request) error {
+	return http.ErrUseLastResponse
+}
+
+// publicAddress tells if the address is a public unicast address, which excludes
+// the loopback, private, link-local and unspecified addresses
+func publicAddress(ip net.IP) bool {
+	return ip.IsGlobalUnicast() && !ip.IsPrivate()
+}
+
+// resolvePublic resolves the host, failing unless all of its addresses are public
+func resolvePublic(ctx context.Context, host string) ([]net.IP, error) {
+	var ips []net.IP
+	if ip := net.ParseIP(host); ip != nil {
+		ips = []net.IP{ip}
+	} else {
+		addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		for _, addr := range addrs {
+			ips = append(ips, addr.IP)
+		}
+	}
+	for _, ip := range ips {
+		if !publicAddress(ip) {
+			return nil, fmt.Errorf("%s resolves to the non-public address %s", host, ip)
+		}
+	}
+	return ips, nil
+}
+
+// dialPublic connects to the resolved addresses of the host only if they are all
+// public, dialing the checked addresses so that the host can't resolve differently
+// in between
+func dialPublic(ctx context.Context, network string, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := resolvePublic(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	for _, ip := range ips {
+		var conn net.Conn
+		conn, err = dialer.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+	}
+	return nil, err
+}
+
+// webhookEvent is the JSON payload POSTed to webhook URLs
+type webhookEvent struct {
+	Event      string   `json:"event"`
+	Subdomain  string   `json:"subdomain"`
+	TXT        string   `json:"txt,omitempty"`
+	AValues    []string `json:"a,omitempty"`
+	AAAAValues []string `json:"aaaa,omitempty"`
+	Time       int64    `json:"time"`
+	// CorrelationID is the identifier the client stored with the TXT value
+	CorrelationID string `json:"correlation_id,omitempty"`
+	// Zone is the zone of the registration
+	Zone string `json:"zone"`
+}
+
+// sendWebhooks delivers the event to each of the URLs in the background
+func sendWebhooks(urls []string, event webhookEvent) {
+	if !Config.API.AllowWebhooks || len(urls) == 0 {
+		return
+	}
+	body, err := json.Marshal(event)
+	if err != nil {
+		apiLog.WithFields(log.Fields{"error": err.Error()}).Error("Could not marshal webhook event")
+		return
+	}
+	for _, u := range urls {
+		go deliverWebhook(registrationWebhookClient, u, body)
+	}
+}
+
+// postWebhook delivers the event to a webhook of the configuration
+func postWebhook(url string, body []byte) {
+	deliverWebhook(webhookClient, url, body)
+}
+
+func deliverWebhook(client *http.Client, url string, body []byte) {
+	resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		apiLog.WithFields(log.Fields{"error": err.Error(), "url": url}).Warning("Webhook delivery failed")
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		apiLog.WithFields(log.Fields{"status": resp.StatusCode, "url": url}).Warning("Webhook receiver returned an error")
+	}
+}
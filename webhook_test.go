@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestSendWebhooks(t *testing.T) {
+	received := make(chan webhookEvent, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event webhookEvent
+		_ = json.NewDecoder(r.Body).Decode(&event)
+		received <- event
+	}))
+	defer server.Close()
+	// The test receiver listens on a loopback address
+	defer func(client *http.Client) { registrationWebhookClient = client }(registrationWebhookClient)
+	registrationWebhookClient = server.Client()
+
+	// Webhooks are not sent unless enabled in the configuration
+	sendWebhooks([]string{server.URL}, webhookEvent{Event: "update", Subdomain: "disabled"})
+	Config.API.AllowWebhooks = true
+	defer func() { Config.API.AllowWebhooks = false }()
+	sendWebhooks([]string{server.URL}, webhookEvent{Event: "update", Subdomain: "enabled", TXT: "value"})
+
+	select {
+	case event := <-received:
+		if event.Subdomain != "enabled" || event.TXT != "value" {
+			t.Errorf("Unexpected webhook event %v", event)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("Webhook was not delivered")
+	}
+}
+
+func TestRegistrationWebhookAddresses(t *testing.T) {
+	redirected := false
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		redirected = true
+	}))
+	defer target.Close()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, target.URL, http.StatusTemporaryRedirect)
+	}))
+	defer server.Close()
+
+	// The receivers of the registrations may not be on loopback addresses
+	if _, err := registrationWebhookClient.Post(server.URL, "application/json", nil); err == nil {
+		t.Errorf("Expected the connection to a loopback address to be refused")
+	}
+	// Redirects are not followed
+	resp, err := webhookClient.Post(server.URL, "application/json", nil)
+	if err != nil {
+		t.Fatalf("Expected the webhook to be delivered, got %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusTemporaryRedirect || redirected {
+		t.Errorf("Expected the redirect not to be followed, got status %d", resp.StatusCode)
+	}
+
+	for i, test := range []struct {
+		ip     string
+		public bool
+	}{
+		{"127.0.0.1", false},
+		{"::1", false},
+		{"10.1.2.3", false},
+		{"192.168.1.1", false},
+		{"169.254.169.254", false},
+		{"fe80::1", false},
+		{"0.0.0.0", false},
+		{"::", false},
+		{"::ffff:127.0.0.1", false},
+		{"192.0.2.1", true},
+		{"2001:db8::1", true},
+	} {
+		if publicAddress(net.ParseIP(test.ip)) != test.public {
+			t.Errorf("Test %d: expected %s to be public: %t", i, test.ip, test.public)
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+)
+
+// wildcardOwner returns the name of the registration whose records are served
+// for the name below it, or an empty string if the name isn't below a
+// registration with wildcard records. Static records of the name take precedence.
+func (d *DNSServer) wildcardOwner(name string) string {
+	name = strings.ToLower(dns.Fqdn(name))
+	zone := d.extraZone(name)
+	if zone == "" {
+		if !dns.IsSubDomain(d.Domain, name) {
+			return ""
+		}
+		zone = d.Domain
+	}
+	labels := dns.SplitDomainName(name)
+	depth := len(labels) - dns.CountLabel(zone)
+	if depth < 2 || d.DB == nil {
+		return ""
+	}
+	if _, ok := d.Domains.Get(name); ok {
+		return ""
+	}
+	subdomain := labels[depth-1]
+	wildcard, err := d.DB.GetWildcardForDomain(subdomain)
+	if err != nil {
+		dnsLog.WithFields(log.Fields{"error": err.Error(), "subdomain": subdomain}).Debug("Error while trying to get the wildcard flag")
+		return ""
+	}
+	if !wildcard {
+		return ""
+	}
+	return subdomain + "." + zone
+}
+
+// answerWildcard answers the question with the records of the registration,
+// synthesized for the name of the question
+func (d *DNSServer) answerWildcard(q dns.Question, owner string) ([]dns.RR, int, bool, error) {
+	rrs, rcode, authoritative, err := d.answer(dns.Question{Name: owner, Qtype: q.Qtype, Qclass: q.Qclass})
+	for i, rr := range rrs {
+		if strings.EqualFold(rr.Header().Name, owner) {
+			rrs[i] = dns.Copy(rr)
+			rrs[i].Header().Name = q.Name
+		}
+	}
+	dnsLog.WithFields(log.Fields{"qtype": dns.TypeToString[q.Qtype], "domain": q.Name, "owner": owner}).Debug("Answering question from the wildcard records of a subdomain")
+	return rrs, rcode, authoritative, err
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestStaticWildcard(t *testing.T) {
+	records := newStaticRecords()
+	for _, s := range []string{
+		"*.example.auth.example.org. A 192.0.2.1",
+		"exact.example.auth.example.org. A 192.0.2.2",
+		"b.www.example.auth.example.org. A 192.0.2.3",
+	} {
+		rr, _ := dns.NewRR(s)
+		records.Add(rr)
+	}
+	for i, test := range []struct {
+		name        string
+		synthesized bool
+	}{
+		{"a.example.auth.example.org.", true},
+		{"deep.a.example.auth.example.org.", true},
+		{"exact.example.auth.example.org.", false},
+		{"sub.exact.example.auth.example.org.", false},
+		// www exists as the ancestor of b.www, so it's the closest encloser
+		{"www.example.auth.example.org.", false},
+		{"a.www.example.auth.example.org.", false},
+		{"example.auth.example.org.", false},
+		{"other.auth.example.org.", false},
+	} {
+		r, _, ok := records.Wildcard(test.name)
+		if ok != test.synthesized {
+			t.Errorf("Test %d: expected synthesized to be %t for %s", i, test.synthesized, test.name)
+			continue
+		}
+		if ok && (len(r.Records) != 1 || r.Records[0].Header().Name != test.name) {
+			t.Errorf("Test %d: expected a record owned by %s, got %v", i, test.name, r.Records)
+		}
+	}
+	// The records of the wildcard itself are left untouched
+	if r, _ := records.Get("*.example.auth.example.org."); r.Records[0].Header().Name != "*.example.auth.example.org." {
+		t.Errorf("Expected the wildcard record to keep its owner, got %v", r.Records)
+	}
+}
+
+func TestWildcardAnswers(t *testing.T) {
+	reg, err := DB.Register(cidrslice{}, registrationOrigin{}, ACMETxtPost{AValues: []string{"192.0.2.50"}})
+	if err != nil {
+		t.Fatalf("Registration failed, got error [%v]", err)
+	}
+	config := Config
+	config.General.Domain = "auth.example.org"
+	config.General.ZoneFiles = nil
+	config.General.StaticRecords = []string{"*.auth.example.org. A 192.0.2.9", "*.static.auth.example.org. TXT \"static\""}
+	config.Zones = nil
+	server := NewDNSServer(DB, "", "udp", config.General.Domain)
+	server.ParseRecords(config)
+	udp := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53}
+	query := func(name string, qtype uint16) *dns.Msg {
+		req := new(dns.Msg)
+		req.SetQuestion(name, qtype)
+		w := &recordingWriter{local: udp}
+		server.handleRequest(w, req)
+		if w.msg == nil {
+			t.Fatalf("No response written for %s", name)
+		}
+		return w.msg
+	}
+
+	m := query("www.static.auth.example.org.", dns.TypeTXT)
+	if len(m.Answer) != 1 || m.Answer[0].Header().Name != "www.static.auth.example.org." || m.Rcode != dns.RcodeSuccess {
+		t.Errorf("Expected the TXT record synthesized from the static wildcard, got %s %v", dns.RcodeToString[m.Rcode], m.Answer)
+	}
+	m = query("www.static.auth.example.org.", dns.TypeA)
+	if len(m.Answer) != 0 || m.Rcode != dns.RcodeSuccess {
+		t.Errorf("Expected NOERROR without records for the other types of a synthesized name, got %s %v", dns.RcodeToString[m.Rcode], m.Answer)
+	}
+	m = query(reg.Subdomain+".auth.example.org.", dns.TypeA)
+	if len(m.Answer) != 1 || m.Answer[0].(*dns.A).A.String() != "192.0.2.50" {
+		t.Errorf("Expected the registration not to be synthesized from the wildcard of the zone, got %v", m.Answer)
+	}
+
+	below := "_acme-challenge." + reg.Subdomain + ".auth.example.org."
+	m = query(below, dns.TypeA)
+	if len(m.Answer) != 0 {
+		t.Errorf("Expected no records below the registration without wildcard records, got %v", m.Answer)
+	}
+	settings := reg.Settings()
+	settings.WildcardRecords = true
+	if err = DB.UpdateSettings(reg.Username, settings); err != nil {
+		t.Fatalf("Could not update the settings, got error [%v]", err)
+	}
+	m = query(below, dns.TypeA)
+	if len(m.Answer) != 1 || m.Answer[0].Header().Name != below || m.Answer[0].(*dns.A).A.String() != "192.0.2.50" {
+		t.Errorf("Expected the records of the registration synthesized below it, got %v", m.Answer)
+	}
+	if user, err := DB.GetByUsername(reg.Username); err != nil || !user.WildcardRecords {
+		t.Errorf("Expected the wildcard setting to be stored, got %t and error %v", user.WildcardRecords, err)
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// loadRecordsFile parses the static records of the zone from a zone file in the
+// standard master file format, relative names are within the zone. SOA records
+// are skipped, acme-dns serves its own.
+func loadRecordsFile(path string, zone string) ([]dns.RR, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	zone = strings.ToLower(dns.Fqdn(zone))
+	zp := dns.NewZoneParser(f, zone, path)
+	zp.SetDefaultTTL(3600)
+	var rrs []dns.RR
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		rr.Header().Name = strings.ToLower(rr.Header().Name)
+		if !dns.IsSubDomain(zone, rr.Header().Name) {
+			return nil, fmt.Errorf("%s: %s is outside of the zone %s", path, rr.Header().Name, zone)
+		}
+		if rr.Header().Rrtype == dns.TypeSOA {
+			continue
+		}
+		rrs = append(rrs, rr)
+	}
+	if err = zp.Err(); err != nil {
+		return nil, err
+	}
+	return rrs, nil
+}
+
+// zoneRecords returns the static records of the zone and the records of its
+// registrations as served, the SOA and NS records of the apex first
+func zoneRecords(db database, config DNSConfig, zone string) ([]dns.RR, error) {
+	server := NewDNSServer(db, "", "udp", config.General.Domain)
+	server.ParseRecords(config)
+	zone = strings.ToLower(dns.Fqdn(zone))
+	rrs := server.Domains.Within(zone)
+	regs, err := db.ListRegistrations(registrationOrigin{})
+	if err != nil {
+		return nil, err
+	}
+	qtypes := []uint16{dns.TypeTXT, dns.TypeA, dns.TypeAAAA, dns.TypeMX, dns.TypeSRV, dns.TypeCAA}
+	for _, name := range genericTypeNames() {
+		qtypes = append(qtypes, dns.StringToType[strings.ToUpper(name)])
+	}
+	for _, reg := range regs {
+		if dns.Fqdn(registrationZone(reg)) != zone {
+			continue
+		}
+		name := dns.Fqdn(fullDomain(reg))
+		types := qtypes
+		if target, err := db.GetCNAMEForDomain(reg.Subdomain); err != nil {
+			return nil, err
+		} else if target != "" {
+			// The alias is served for every type instead of the other records
+			types = []uint16{dns.TypeCNAME}
+		}
+		for _, qtype := range types {
+			answer, _, _, err := server.answer(dns.Question{Name: name, Qtype: qtype, Qclass: dns.ClassINET})
+			if err != nil {
+				return nil, err
+			}
+			for _, rr := range answer {
+				if rr.Header().Name == name && rr.Header().Rrtype == qtype {
+					rrs = append(rrs, rr)
+				}
+			}
+		}
+	}
+	rank := func(rr dns.RR) int {
+		switch {
+		case rr.Header().Rrtype == dns.TypeSOA:
+			return 0
+		case rr.Header().Rrtype == dns.TypeNS && rr.Header().Name == zone:
+			return 1
+		}
+		return 2
+	}
+	sort.SliceStable(rrs, func(i, j int) bool {
+		a, b := rrs[i], rrs[j]
+		if rank(a) != rank(b) {
+			return rank(a) < rank(b)
+		}
+		if a.Header().Name != b.Header().Name {
+			return a.Header().Name < b.Header().Name
+		}
+		if a.Header().Rrtype != b.Header().Rrtype {
+			return a.Header().Rrtype < b.Header().Rrtype
+		}
+		return a.String() < b.String()
+	})
+	// The same record may be both static and answered for a registration
+	var unique []dns.RR
+	for i, rr := range rrs {
+		if i == 0 || !dns.IsDuplicate(rr, rrs[i-1]) {
+			unique = append(unique, rr)
+		}
+	}
+	return unique, nil
+}
+
+// exportZone writes the records of the zone as a zone file
+func exportZone(db database, config DNSConfig, zone string, out io.Writer) error {
+	rrs, err := zoneRecords(db, config, zone)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "; Zone %s exported by acme-dns\n", dns.Fqdn(zone))
+	fmt.Fprintf(out, "$ORIGIN %s\n", dns.Fqdn(zone))
+	for _, rr := range rrs {
+		fmt.Fprintln(out, rr.String())
+	}
+	return nil
+}
+
+// servedZone returns the served zone of the name, nil if it isn't served
+func servedZone(config DNSConfig, name string) *zoneConfig {
+	for _, zone := range servedZones(config) {
+		if normalizeZone(zone.Domain) == normalizeZone(name) {
+			return &zone
+		}
+	}
+	return nil
+}
+
+// importZone validates the zone file, and installs it as the records file of
+// the zone in place of the previous one
+func importZone(config DNSConfig, zone string, path string, out io.Writer) error {
+	served := servedZone(config, zone)
+	if served == nil {
+		return fmt.Errorf("%s is not a served zone", zone)
+	}
+	target := served.RecordsFile
+	if target == "" {
+		return fmt.Errorf("no records_file configured for the zone %s", normalizeZone(zone))
+	}
+	rrs, err := loadRecordsFile(path, zone)
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	// Replace the file at once, so that a crash never leaves it half written
+	tmp := target + ".tmp"
+	if err = os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	if err = os.Rename(tmp, target); err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "Imported %d records of %s into %s, restart acme-dns to serve them\n", len(rrs), normalizeZone(zone), target)
+	return nil
+}
+
+// runZoneCommand runs the zone export and import commands
+func runZoneCommand(config DNSConfig, args []string, out io.Writer) error {
+	usage := errors.New("usage: acme-dns zone export <domain> | zone import <domain> <file>")
+	if len(args) < 2 {
+		return usage
+	}
+	if servedZone(config, args[1]) == nil {
+		return fmt.Errorf("%s is not a served zone", args[1])
+	}
+	switch {
+	case args[0] == "export" && len(args) == 2:
+		db, err := openBackend(config.Database.Engine, config.Database.Connection)
+		if err != nil {
+			return err
+		}
+		defer db.Close()
+		return exportZone(db, config, args[1], out)
+	case args[0] == "import" && len(args) == 3:
+		return importZone(config, args[1], args[2], out)
+	}
+	return usage
+}
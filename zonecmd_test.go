@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadRecordsFile(t *testing.T) {
+	rrs, err := loadRecordsFile(writeZoneFile(t, `$TTL 300
+@	IN	SOA	ns1.example.net. hostmaster.example.net. 1 7200 3600 1209600 300
+www	IN	A	192.0.2.80
+WWW.Auth.Example.Org.	IN	AAAA	2001:db8::80
+`), "auth.example.org")
+	if err != nil {
+		t.Fatalf("Could not load records file: %v", err)
+	}
+	if len(rrs) != 2 || rrs[0].Header().Name != "www.auth.example.org." || rrs[1].Header().Name != "www.auth.example.org." {
+		t.Errorf("Expected the records within the zone without the SOA record, got %v", rrs)
+	}
+	for i, content := range []string{
+		"www.example.com. IN A 192.0.2.1\n",
+		"www IN A not-an-address\n",
+	} {
+		if _, err := loadRecordsFile(writeZoneFile(t, content), "auth.example.org"); err == nil {
+			t.Errorf("Test %d: Expected an error for an invalid records file", i)
+		}
+	}
+}
+
+func TestExportZone(t *testing.T) {
+	reg, err := DB.Register(cidrslice{}, registrationOrigin{Zone: "export.example.org"}, ACMETxtPost{AValues: []string{"192.0.2.40"}})
+	if err != nil {
+		t.Fatalf("Registration failed, got error [%v]", err)
+	}
+	config := Config
+	config.General.Domain = "export.example.org"
+	config.General.Nsname = "ns.export.example.org"
+	config.General.Nsadmin = "admin.example.org"
+	config.General.Nameservers = nil
+	config.General.StaticRecords = []string{"ns.export.example.org. A 192.0.2.1"}
+	config.General.RecordsFile = writeZoneFile(t, "www 300 IN A 192.0.2.80\n")
+	config.General.ZoneFiles = nil
+	config.General.aboutInfo = aboutInfo{}
+	config.Zones = nil
+	var out bytes.Buffer
+	if err = exportZone(DB, config, "export.example.org", &out); err != nil {
+		t.Fatalf("Could not export zone: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) < 4 || !strings.HasPrefix(lines[2], "export.example.org.\t") || !strings.Contains(lines[2], "SOA") || !strings.Contains(lines[3], "NS\tns.export.example.org.") {
+		t.Fatalf("Expected the SOA and NS records first, got\n%s", out.String())
+	}
+	for _, expected := range []string{
+		"ns.export.example.org.\t3600\tIN\tA\t192.0.2.1",
+		"www.export.example.org.\t300\tIN\tA\t192.0.2.80",
+		reg.Subdomain + ".export.example.org.",
+	} {
+		if !strings.Contains(out.String(), expected) {
+			t.Errorf("Expected %q in the exported zone, got\n%s", expected, out.String())
+		}
+	}
+	// The export is a valid records file of the zone
+	path := filepath.Join(t.TempDir(), "export.zone")
+	if err = os.WriteFile(path, out.Bytes(), 0600); err != nil {
+		t.Fatalf("Could not write zone file: %v", err)
+	}
+	if rrs, err := loadRecordsFile(path, "export.example.org"); err != nil || len(rrs) != len(lines)-3 {
+		t.Errorf("Expected the exported zone to load back, got %d records and error %v", len(rrs), err)
+	}
+}
+
+func TestImportZone(t *testing.T) {
+	config := Config
+	config.General.Domain = "auth.example.org"
+	config.General.RecordsFile = ""
+	config.Zones = nil
+	source := writeZoneFile(t, "www IN A 192.0.2.80\n")
+	var out bytes.Buffer
+	if err := importZone(config, "auth.example.org", source, &out); err == nil {
+		t.Errorf("Expected an error without a records file configured")
+	}
+	config.General.RecordsFile = filepath.Join(t.TempDir(), "records.zone")
+	if err := importZone(config, "example.com", source, &out); err == nil {
+		t.Errorf("Expected an error for a zone that isn't served")
+	}
+	if err := importZone(config, "auth.example.org", writeZoneFile(t, "www.example.com. IN A 192.0.2.1\n"), &out); err == nil {
+		t.Errorf("Expected an error for records outside of the zone")
+	}
+	if _, err := os.Stat(config.General.RecordsFile); !os.IsNotExist(err) {
+		t.Errorf("Expected an invalid zone file not to be installed")
+	}
+	if err := importZone(config, "auth.example.org", source, &out); err != nil {
+		t.Fatalf("Could not import zone: %v", err)
+	}
+	if rrs, err := loadRecordsFile(config.General.RecordsFile, "auth.example.org"); err != nil || len(rrs) != 1 {
+		t.Errorf("Expected the records file to be installed, got %v and error %v", rrs, err)
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+)
+
+// loadZoneFile parses a zone file in the standard master file format and returns
+// its records and the SOA record of the zone. All the records must be within the
+// zone of the SOA record.
+func loadZoneFile(path string) ([]dns.RR, dns.RR, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+	zp := dns.NewZoneParser(f, "", path)
+	var rrs []dns.RR
+	var soa dns.RR
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		rr.Header().Name = strings.ToLower(rr.Header().Name)
+		if rr.Header().Rrtype == dns.TypeSOA {
+			if soa != nil {
+				return nil, nil, fmt.Errorf("%s: more than one SOA record", path)
+			}
+			soa = rr
+		}
+		rrs = append(rrs, rr)
+	}
+	if err = zp.Err(); err != nil {
+		return nil, nil, err
+	}
+	if soa == nil {
+		return nil, nil, fmt.Errorf("%s: no SOA record", path)
+	}
+	for _, rr := range rrs {
+		if !dns.IsSubDomain(soa.Header().Name, rr.Header().Name) {
+			return nil, nil, fmt.Errorf("%s: %s is outside of the zone %s", path, rr.Header().Name, soa.Header().Name)
+		}
+	}
+	return rrs, soa, nil
+}
+
+// loadZoneFiles adds the records of the supplementary zone files to the static
+// records. Zone files that can't be loaded are skipped.
+func (d *DNSServer) loadZoneFiles(paths []string) {
+	for _, path := range paths {
+		rrs, soa, err := loadZoneFile(path)
+		if err != nil {
+			dnsLog.WithFields(log.Fields{"error": err.Error(), "file": path}).Error("Could not load zone file")
+			continue
+		}
+		zone := soa.Header().Name
+		if d.overlapsZones(zone) {
+			dnsLog.WithFields(log.Fields{"file": path, "zone": zone}).Error("Zone file overlaps the acme-dns domain, use records instead")
+			continue
+		}
+		if err = d.Domains.AddZone(soa, rrs); err != nil {
+			dnsLog.WithFields(log.Fields{"error": err.Error(), "file": path}).Error("Could not load zone file")
+			continue
+		}
+		dnsLog.WithFields(log.Fields{"file": path, "zone": zone, "records": len(rrs)}).Info("Loaded zone file")
+	}
+}
+
+// answerZoneFile answers a question in a supplementary zone from its static
+// records only, the registrations of the API are never looked up for it
+func (d *DNSServer) answerZoneFile(q dns.Question) ([]dns.RR, int, bool, error) {
+	rcode := dns.RcodeNameError
+	if d.answeringForDomain(q.Name) {
+		rcode = dns.RcodeSuccess
+	}
+	r, _ := d.getRecord(q)
+	dnsLog.WithFields(log.Fields{"qtype": dns.TypeToString[q.Qtype], "domain": q.Name, "rcode": dns.RcodeToString[rcode]}).Debug("Answering question for zone file domain")
+	return r, rcode, true, nil
+}
+
+// supplementaryZone returns the SOA record of the supplementary zone the name
+// belongs to, or nil for names outside of them
+func (d *DNSServer) supplementaryZone(name string) dns.RR {
+	return d.Domains.Zone(name)
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+const testZoneFile = `$ORIGIN example.net.
+$TTL 3600
+@	IN	SOA	ns1.example.net. hostmaster.example.net. 2024010101 7200 3600 1209600 300
+@	IN	NS	auth.example.org.
+www	IN	A	192.0.2.80
+mail	IN	MX	10 mx.example.net.
+`
+
+func writeZoneFile(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "zone")
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatalf("Could not write zone file: %v", err)
+	}
+	return path
+}
+
+func TestLoadZoneFile(t *testing.T) {
+	rrs, soa, err := loadZoneFile(writeZoneFile(t, testZoneFile))
+	if err != nil {
+		t.Fatalf("Could not load zone file: %v", err)
+	}
+	if len(rrs) != 4 || soa.Header().Name != "example.net." {
+		t.Errorf("Expected 4 records in example.net., got %d in %s", len(rrs), soa.Header().Name)
+	}
+
+	for i, content := range []string{
+		"www.example.net. 3600 IN A 192.0.2.80\n",
+		testZoneFile + "example.com. 3600 IN A 192.0.2.1\n",
+		testZoneFile + "sub.example.net. 3600 IN SOA ns1.example.net. hostmaster.example.net. 1 7200 3600 1209600 300\n",
+		testZoneFile + "bad IN A not-an-address\n",
+	} {
+		if _, _, err := loadZoneFile(writeZoneFile(t, content)); err == nil {
+			t.Errorf("Test %d: Expected an error for an invalid zone file", i)
+		}
+	}
+}
+
+func TestAnswerZoneFile(t *testing.T) {
+	config := Config
+	config.General.Domain = "auth.example.org"
+	config.General.Nsname = "auth.example.org"
+	config.General.Nsadmin = "admin.example.org"
+	config.General.ZoneFiles = []string{
+		writeZoneFile(t, testZoneFile),
+		// Zones overlapping the domain of the API are not loaded
+		writeZoneFile(t, "example.org. 3600 IN SOA ns1.example.org. hostmaster.example.org. 1 7200 3600 1209600 300\nwww.example.org. 3600 IN A 192.0.2.81\n"),
+	}
+	server := NewDNSServer(DB, "", "udp", config.General.Domain)
+	server.ParseRecords(config)
+	if _, ok := server.Domains.Get("www.example.org."); ok {
+		t.Errorf("Expected the zone overlapping the domain not to be loaded")
+	}
+
+	for i, test := range []struct {
+		name    string
+		qtype   uint16
+		answers int
+		rcode   int
+		soa     string
+	}{
+		{"www.example.net.", dns.TypeA, 1, dns.RcodeSuccess, ""},
+		{"WWW.Example.NET.", dns.TypeA, 1, dns.RcodeSuccess, ""},
+		{"www.example.net.", dns.TypeAAAA, 0, dns.RcodeSuccess, ""},
+		{"example.net.", dns.TypeMX, 0, dns.RcodeSuccess, ""},
+		{"mail.example.net.", dns.TypeMX, 1, dns.RcodeSuccess, ""},
+		{"missing.example.net.", dns.TypeTXT, 0, dns.RcodeNameError, "example.net."},
+		{"missing.auth.example.org.", dns.TypeTXT, 0, dns.RcodeNameError, "auth.example.org."},
+	} {
+		m := new(dns.Msg)
+		m.SetQuestion(test.name, test.qtype)
+		server.readQuery(m)
+		if len(m.Answer) != test.answers || m.Rcode != test.rcode {
+			t.Errorf("Test %d: Expected %d answers with %s, got %d with %s", i, test.answers, dns.RcodeToString[test.rcode], len(m.Answer), dns.RcodeToString[m.Rcode])
+		}
+		if !m.Authoritative {
+			t.Errorf("Test %d: Expected an authoritative answer", i)
+		}
+		if test.soa != "" && (len(m.Ns) != 1 || m.Ns[0].Header().Name != test.soa) {
+			t.Errorf("Test %d: Expected the SOA of %s in the authority section, got %v", i, test.soa, m.Ns)
+		}
+	}
+}
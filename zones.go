@@ -0,0 +1,246 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync/atomic"
+
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+)
+
+// zoneConfig is a zone served with the registrations of the API. The domain of the
+// general section is the primary zone, further zones are listed in [[zones]].
+type zoneConfig struct {
+	Domain  string
+	Nsname  string
+	Nsadmin string
+	// Nameservers are the names served as the NS records of the zone, Nsname if empty
+	Nameservers   []string `toml:"nameservers"`
+	StaticRecords []string `toml:"records"`
+	// StrictTXT serves the TXT values of the registrations at their exact names
+	// only, instead of at any name starting with the subdomain
+	StrictTXT bool `toml:"strict_txt"`
+	// RecordsFile is a zone file of further static records of the zone
+	RecordsFile string `toml:"records_file"`
+	soaTimers
+	aboutInfo
+}
+
+// zoneCounter picks the zone of the registrations that don't choose one
+var zoneCounter atomic.Uint64
+
+// normalizeZone returns the zone name as written in the fulldomains, lowercase
+// and without the trailing dot
+func normalizeZone(name string) string {
+	return strings.TrimSuffix(strings.ToLower(name), ".")
+}
+
+// primaryZone returns the zone of the general section
+func primaryZone(config DNSConfig) zoneConfig {
+	return zoneConfig{
+		Domain:        config.General.Domain,
+		Nsname:        config.General.Nsname,
+		Nsadmin:       config.General.Nsadmin,
+		Nameservers:   config.General.Nameservers,
+		StaticRecords: config.General.StaticRecords,
+		StrictTXT:     config.General.StrictTXT,
+		RecordsFile:   config.General.RecordsFile,
+		soaTimers:     config.General.soaTimers,
+		aboutInfo:     config.General.aboutInfo,
+	}
+}
+
+// servedZones returns the zones of the configuration, the primary zone first
+func servedZones(config DNSConfig) []zoneConfig {
+	return append([]zoneConfig{primaryZone(config)}, config.Zones...)
+}
+
+// validateZones checks the further zones, which default to the name server and
+// admin of the primary zone, and can't overlap each other or the primary zone
+func validateZones(conf *DNSConfig) error {
+	if err := validateAbout(conf.General.Domain, conf.General.aboutInfo); err != nil {
+		return err
+	}
+	conf.General.soaTimers = conf.General.soaTimers.or(defaultSOATimers)
+	seen := []string{normalizeZone(conf.General.Domain)}
+	for i := range conf.Zones {
+		zone := &conf.Zones[i]
+		zone.Domain = normalizeZone(zone.Domain)
+		if _, ok := dns.IsDomainName(zone.Domain); zone.Domain == "" || !ok {
+			return fmt.Errorf("zone %q is not a valid domain name", zone.Domain)
+		}
+		for _, other := range seen {
+			if dns.IsSubDomain(dns.Fqdn(other), dns.Fqdn(zone.Domain)) || dns.IsSubDomain(dns.Fqdn(zone.Domain), dns.Fqdn(other)) {
+				return fmt.Errorf("zone %s overlaps the zone %s", zone.Domain, other)
+			}
+		}
+		seen = append(seen, zone.Domain)
+		if zone.Nsname == "" {
+			zone.Nsname = conf.General.Nsname
+		}
+		if zone.Nsadmin == "" {
+			zone.Nsadmin = conf.General.Nsadmin
+		}
+		zone.soaTimers = zone.soaTimers.or(conf.General.soaTimers)
+		for _, name := range zone.Nameservers {
+			if _, ok := dns.IsDomainName(name); name == "" || !ok {
+				return fmt.Errorf("name server %q of zone %s is not a valid domain name", name, zone.Domain)
+			}
+		}
+		if err := validateAbout(zone.Domain, zone.aboutInfo); err != nil {
+			return err
+		}
+	}
+	for _, zone := range servedZones(*conf) {
+		if err := validateSOATimers(normalizeZone(zone.Domain), zone.soaTimers); err != nil {
+			return err
+		}
+		for i, v := range zone.StaticRecords {
+			if _, err := parseStaticRecord(v); err != nil {
+				return fmt.Errorf("record %d of zone %s %q: %v", i+1, normalizeZone(zone.Domain), v, err)
+			}
+		}
+		if zone.RecordsFile != "" {
+			if _, err := loadRecordsFile(zone.RecordsFile, zone.Domain); err != nil {
+				return fmt.Errorf("records_file of zone %s: %v", normalizeZone(zone.Domain), err)
+			}
+		}
+	}
+	return nil
+}
+
+// parseStaticRecord parses an entry of the records in the zone file syntax. The
+// names are relative to the root as they have always been, unlike in the
+// records_file. Only the owner names are lowercased, the data of records like TXT
+// keeps its case.
+func parseStaticRecord(entry string) ([]dns.RR, error) {
+	zp := dns.NewZoneParser(strings.NewReader(entry), ".", "")
+	// Records without a TTL default to that of dns.NewRR, as before
+	zp.SetDefaultTTL(3600)
+	var rrs []dns.RR
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		rr.Header().Name = strings.ToLower(rr.Header().Name)
+		rrs = append(rrs, rr)
+	}
+	if err := zp.Err(); err != nil {
+		return nil, err
+	}
+	if len(rrs) == 0 {
+		return nil, errors.New("no record")
+	}
+	return rrs, nil
+}
+
+// assignZone returns the served zone of the name requested at registration, or
+// the next zone in turn when none was requested
+func assignZone(requested string) (string, bool) {
+	zones := servedZones(Config)
+	if requested == "" {
+		n := zoneCounter.Add(1) - 1
+		return normalizeZone(zones[n%uint64(len(zones))].Domain), true
+	}
+	for _, zone := range zones {
+		if normalizeZone(zone.Domain) == normalizeZone(requested) {
+			return normalizeZone(zone.Domain), true
+		}
+	}
+	return "", false
+}
+
+// registrationZone returns the zone of the registration. Registrations created
+// before zones were recorded are in the primary zone.
+func registrationZone(reg ACMETxt) string {
+	if reg.Origin.Zone != "" {
+		return reg.Origin.Zone
+	}
+	return normalizeZone(Config.General.Domain)
+}
+
+// fullDomain returns the name of the registration in its zone
+func fullDomain(reg ACMETxt) string {
+	return reg.Subdomain + "." + registrationZone(reg)
+}
+
+// extraZone returns the further zone the name belongs to, or an empty string for
+// the names of the primary zone and outside of the served zones
+func (d *DNSServer) extraZone(name string) string {
+	name = strings.ToLower(dns.Fqdn(name))
+	for _, zone := range d.Zones {
+		if dns.IsSubDomain(zone, name) {
+			return zone
+		}
+	}
+	return ""
+}
+
+// servesZone tells if the name is the apex of the primary or of a further zone
+func (d *DNSServer) servesZone(name string) bool {
+	name = strings.ToLower(dns.Fqdn(name))
+	return name == d.Domain || d.extraZone(name) == name
+}
+
+// overlapsZones tells if the zone overlaps the primary or one of the further zones
+func (d *DNSServer) overlapsZones(zone string) bool {
+	for _, served := range append([]string{d.Domain}, d.Zones...) {
+		if dns.IsSubDomain(zone, served) || dns.IsSubDomain(served, zone) {
+			return true
+		}
+	}
+	return false
+}
+
+// soaOf returns the SOA record of the apex of a zone
+func (d *DNSServer) soaOf(zone string) dns.RR {
+	if records, ok := d.Domains.Get(zone); ok {
+		for _, rr := range records.Records {
+			if rr.Header().Rrtype == dns.TypeSOA {
+				return rr
+			}
+		}
+	}
+	return nil
+}
+
+// strictTXT tells if the zone of the name serves the TXT values at the exact
+// names of the registrations only. The names outside of the served zones follow
+// the primary zone.
+func (d *DNSServer) strictTXT(name string) bool {
+	zone := d.extraZone(name)
+	if zone == "" {
+		zone = d.Domain
+	}
+	for _, strict := range d.StrictTXT {
+		if strict == zone {
+			return true
+		}
+	}
+	return false
+}
+
+// inRegistrationZone tells if the name is in the zone of the registration its
+// records are looked up from, the registrations of a zone aren't answered under
+// the other zones
+func (d *DNSServer) inRegistrationZone(name string) bool {
+	if len(d.Zones) == 0 {
+		return true
+	}
+	subdomain := sanitizeDomainQuestion(name)
+	regZone, err := d.DB.GetZoneForDomain(subdomain)
+	if err != nil {
+		dnsLog.WithFields(log.Fields{"error": err.Error(), "subdomain": subdomain}).Debug("Error while trying to get the zone of the registration")
+		return false
+	}
+	return regZone == "" || dns.IsSubDomain(dns.Fqdn(regZone), strings.ToLower(name))
+}
+
+// isRegistrationName tells if the name is directly below one of the zones, where
+// the records of the registrations are served
+func (d *DNSServer) isRegistrationName(name string) bool {
+	zone := d.extraZone(name)
+	if zone == "" {
+		zone = d.Domain
+	}
+	return strings.HasSuffix(name, "."+zone) && dns.CountLabel(name) == dns.CountLabel(zone)+1
+}
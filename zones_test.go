@@ -0,0 +1,217 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestValidateZones(t *testing.T) {
+	for i, test := range []struct {
+		zones []zoneConfig
+		valid bool
+	}{
+		{nil, true},
+		{[]zoneConfig{{Domain: "acme.example.net."}, {Domain: "acme.example.com"}}, true},
+		{[]zoneConfig{{Domain: ""}}, false},
+		{[]zoneConfig{{Domain: "sub.auth.example.org"}}, false},
+		{[]zoneConfig{{Domain: "example.org"}}, false},
+		{[]zoneConfig{{Domain: "acme.example.net"}, {Domain: "ACME.example.net"}}, false},
+		{[]zoneConfig{{Domain: "acme.example.net", Nameservers: []string{""}}}, false},
+	} {
+		conf := DNSConfig{General: general{Domain: "auth.example.org", Nsname: "ns1.auth.example.org", Nsadmin: "admin.example.org"}, Zones: test.zones}
+		err := validateZones(&conf)
+		if test.valid != (err == nil) {
+			t.Errorf("Test %d: expected valid to be %t, got error %v", i, test.valid, err)
+		}
+		if err == nil && len(conf.Zones) > 0 {
+			if conf.Zones[0].Nsname != "ns1.auth.example.org" || conf.Zones[0].Nsadmin != "admin.example.org" {
+				t.Errorf("Test %d: expected the zone to default to the name server and admin of the primary zone, got %+v", i, conf.Zones[0])
+			}
+			if conf.Zones[0].Domain != "acme.example.net" {
+				t.Errorf("Test %d: expected the zone name to be normalized, got %s", i, conf.Zones[0].Domain)
+			}
+		}
+	}
+}
+
+func TestAssignZone(t *testing.T) {
+	oldConfig := Config
+	defer func() { Config = oldConfig }()
+	Config.General.Domain = "auth.example.org"
+	Config.Zones = []zoneConfig{{Domain: "acme.example.net"}}
+	zoneCounter.Store(0)
+	var assigned []string
+	for i := 0; i < 4; i++ {
+		zone, _ := assignZone("")
+		assigned = append(assigned, zone)
+	}
+	expected := []string{"auth.example.org", "acme.example.net", "auth.example.org", "acme.example.net"}
+	for i := range expected {
+		if assigned[i] != expected[i] {
+			t.Errorf("Expected the zones to be assigned in turn %v, got %v", expected, assigned)
+			break
+		}
+	}
+	if zone, ok := assignZone("ACME.example.net."); !ok || zone != "acme.example.net" {
+		t.Errorf("Expected the requested zone to be assigned, got %q", zone)
+	}
+	if _, ok := assignZone("example.com"); ok {
+		t.Errorf("Expected a zone that isn't served to be refused")
+	}
+	if full := fullDomain(ACMETxt{ACMETxtPost: ACMETxtPost{Subdomain: "sub"}}); full != "sub.auth.example.org" {
+		t.Errorf("Expected registrations without a zone to be in the primary zone, got %s", full)
+	}
+}
+
+func TestMultiZoneAnswers(t *testing.T) {
+	reg, err := DB.Register(cidrslice{}, registrationOrigin{Zone: "acme.example.net"}, ACMETxtPost{AValues: []string{"192.0.2.30"}})
+	if err != nil {
+		t.Fatalf("Registration failed, got error [%v]", err)
+	}
+	config := Config
+	config.General.Domain = "auth.example.org"
+	config.General.Nsname = "auth.example.org"
+	config.General.Nsadmin = "admin.example.org"
+	config.General.Nameservers = nil
+	config.General.StaticRecords = []string{"auth.example.org. A 192.0.2.1"}
+	config.General.ZoneFiles = nil
+	config.Zones = []zoneConfig{{Domain: "acme.example.net", Nsname: "ns.acme.example.net", Nsadmin: "hostmaster.example.net", StaticRecords: []string{"ns.acme.example.net. A 192.0.2.2"}}}
+	server := NewDNSServer(DB, "", "udp", config.General.Domain)
+	server.ParseRecords(config)
+	server.AuthorityNS = true
+	udp := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53}
+	query := func(name string, qtype uint16) *dns.Msg {
+		req := new(dns.Msg)
+		req.SetQuestion(name, qtype)
+		w := &recordingWriter{local: udp}
+		server.handleRequest(w, req)
+		if w.msg == nil {
+			t.Fatalf("No response written for %s", name)
+		}
+		return w.msg
+	}
+
+	m := query("acme.example.net.", dns.TypeSOA)
+	if len(m.Answer) != 1 || m.Answer[0].(*dns.SOA).Ns != "ns.acme.example.net." || !m.Authoritative {
+		t.Errorf("Expected the SOA record of the further zone, got %v", m.Answer)
+	}
+	m = query("acme.example.net.", dns.TypeNS)
+	if len(m.Answer) != 1 || m.Answer[0].(*dns.NS).Ns != "ns.acme.example.net." {
+		t.Errorf("Expected the NS record of the further zone, got %v", m.Answer)
+	}
+	m = query(reg.Subdomain+".acme.example.net.", dns.TypeA)
+	if len(m.Answer) != 1 || m.Answer[0].(*dns.A).A.String() != "192.0.2.30" {
+		t.Errorf("Expected the A record of the registration, got %v", m.Answer)
+	}
+	if len(m.Ns) != 1 || m.Ns[0].(*dns.NS).Ns != "ns.acme.example.net." {
+		t.Errorf("Expected the NS records of the further zone in the authority section, got %v", m.Ns)
+	}
+	// The registration isn't answered under the other zones
+	m = query(reg.Subdomain+".auth.example.org.", dns.TypeA)
+	if m.Rcode != dns.RcodeNameError || len(m.Answer) != 0 {
+		t.Errorf("Expected NXDOMAIN for the registration under the primary zone, got %s %v", dns.RcodeToString[m.Rcode], m.Answer)
+	}
+	m = query(reg.Subdomain+".auth.example.org.", dns.TypeTXT)
+	if m.Rcode != dns.RcodeNameError || len(m.Answer) != 0 {
+		t.Errorf("Expected NXDOMAIN for the TXT records of the registration under the primary zone, got %s %v", dns.RcodeToString[m.Rcode], m.Answer)
+	}
+	m = query("missing.acme.example.net.", dns.TypeTXT)
+	if m.Rcode != dns.RcodeNameError || len(m.Ns) != 1 || m.Ns[0].Header().Name != "acme.example.net." {
+		t.Errorf("Expected NXDOMAIN with the SOA record of the further zone, got %s %v", dns.RcodeToString[m.Rcode], m.Ns)
+	}
+	m = query("missing.auth.example.org.", dns.TypeTXT)
+	if m.Rcode != dns.RcodeNameError || len(m.Ns) != 1 || m.Ns[0].Header().Name != "auth.example.org." {
+		t.Errorf("Expected NXDOMAIN with the SOA record of the primary zone, got %s %v", dns.RcodeToString[m.Rcode], m.Ns)
+	}
+	if !server.isRegistrationName(reg.Subdomain+".acme.example.net.") || server.isRegistrationName("a.b.acme.example.net.") {
+		t.Errorf("Expected the names directly below the zones to be registration names")
+	}
+}
+
+func TestParseStaticRecordCase(t *testing.T) {
+	rrs, err := parseStaticRecord(`Auth.Example.ORG. TXT "google-site-verification=AbCdEf"`)
+	if err != nil || len(rrs) != 1 {
+		t.Fatalf("Expected a single record, got %v, %v", rrs, err)
+	}
+	if rrs[0].Header().Name != "auth.example.org." {
+		t.Errorf("Expected the owner name to be lowercased, got %s", rrs[0].Header().Name)
+	}
+	if txt := rrs[0].(*dns.TXT).Txt; len(txt) != 1 || txt[0] != "google-site-verification=AbCdEf" {
+		t.Errorf("Expected the TXT value to keep its case, got %q", txt)
+	}
+}
+
+func TestValidateStaticRecords(t *testing.T) {
+	for i, test := range []struct {
+		general []string
+		zone    []string
+		valid   bool
+	}{
+		{[]string{"auth.example.org. A 192.0.2.1", "auth.example.org. 300 IN HTTPS 1 . alpn=h2"}, nil, true},
+		{nil, []string{"ns.acme.example.net. A 192.0.2.2", "acme.example.net. CAA 0 issue \"letsencrypt.org\""}, true},
+		{[]string{"auth.example.org. A 192.0.2.300"}, nil, false},
+		{nil, []string{"acme.example.net. BOGUS 1"}, false},
+		{[]string{"; only a comment"}, nil, false},
+	} {
+		conf := DNSConfig{
+			General: general{Domain: "auth.example.org", Nsname: "ns1.auth.example.org", Nsadmin: "admin.example.org", StaticRecords: test.general},
+			Zones:   []zoneConfig{{Domain: "acme.example.net", StaticRecords: test.zone}},
+		}
+		if err := validateZones(&conf); test.valid != (err == nil) {
+			t.Errorf("Test %d: expected valid to be %t, got error %v", i, test.valid, err)
+		}
+	}
+	conf := DNSConfig{General: general{Domain: "auth.example.org", RecordsFile: writeZoneFile(t, "www IN A 192.0.2.80\nbad IN A not-an-address\n")}}
+	if err := validateZones(&conf); err == nil || !strings.Contains(err.Error(), "line: 2") {
+		t.Errorf("Expected the line of the malformed record in the error, got %v", err)
+	}
+}
+
+func TestStrictTXT(t *testing.T) {
+	reg, err := DB.Register(cidrslice{}, registrationOrigin{Zone: "acme.example.net"}, ACMETxtPost{})
+	if err != nil {
+		t.Fatalf("Registration failed, got error [%v]", err)
+	}
+	value := "______________strict_txt_challenge_________"
+	if _, err = DB.Update(ACMETxtPost{Subdomain: reg.Subdomain, Value: value}); err != nil {
+		t.Fatalf("Update failed, got error [%v]", err)
+	}
+	config := Config
+	config.General.Domain = "auth.example.org"
+	config.General.ZoneFiles = nil
+	config.General.StrictTXT = false
+	config.Zones = []zoneConfig{{Domain: "acme.example.net", StrictTXT: true}}
+	server := NewDNSServer(DB, "", "udp", config.General.Domain)
+	server.ParseRecords(config)
+	udp := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53}
+	txt := func(name string) int {
+		req := new(dns.Msg)
+		req.SetQuestion(name, dns.TypeTXT)
+		w := &recordingWriter{local: udp}
+		server.handleRequest(w, req)
+		if w.msg == nil {
+			t.Fatalf("No response written for %s", name)
+		}
+		return len(w.msg.Answer)
+	}
+
+	if n := txt(reg.Subdomain + ".acme.example.net."); n != 1 {
+		t.Errorf("Expected the TXT value at the exact name in the strict zone, got %d records", n)
+	}
+	if n := txt(reg.Subdomain + ".other.acme.example.net."); n != 0 {
+		t.Errorf("Expected no TXT values at the deeper names in the strict zone, got %d records", n)
+	}
+	primary, err := DB.Register(cidrslice{}, registrationOrigin{}, ACMETxtPost{})
+	if err != nil {
+		t.Fatalf("Registration failed, got error [%v]", err)
+	}
+	if _, err = DB.Update(ACMETxtPost{Subdomain: primary.Subdomain, Value: value}); err != nil {
+		t.Fatalf("Update failed, got error [%v]", err)
+	}
+	if n := txt(primary.Subdomain + ".other.auth.example.org."); n != 1 {
+		t.Errorf("Expected the TXT value at the deeper names in the zone without strict_txt, got %d records", n)
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+)
+
+// serialHistorySize is the number of serial bumps kept in the history
+const serialHistorySize = 100
+
+// serialBump is a change of the SOA serial of the served zone
+type serialBump struct {
+	Serial    uint32 `json:"serial"`
+	Time      int64  `json:"time"`
+	Cause     string `json:"cause"`
+	Subdomain string `json:"subdomain,omitempty"`
+}
+
+// zoneSerial bumps the SOA serial of the served zone when the data served in it
+// changes, keeping the latest bumps with what caused them. The serial lives in
+// memory, each instance sharing a database counts its own.
+type zoneSerial struct {
+	mutex   sync.Mutex
+	records *staticRecords
+	soa     *dns.SOA
+	clock   clock
+	history []serialBump
+}
+
+// ZoneSerial is the serial of the served zone, nil until the nameserver is set up
+var ZoneSerial *zoneSerial
+
+// newZoneSerial returns the serial of the zone of the SOA record, publishing the
+// bumped SOA records to the static records
+func newZoneSerial(records *staticRecords, soa dns.RR, c clock) *zoneSerial {
+	z := &zoneSerial{records: records, clock: c}
+	if s, ok := soa.(*dns.SOA); ok {
+		z.soa = s
+		z.history = []serialBump{{s.Serial, clockOrSystem(c).Now().Unix(), "startup", ""}}
+	}
+	return z
+}
+
+// Serial returns the current serial
+func (z *zoneSerial) Serial() uint32 {
+	z.mutex.Lock()
+	defer z.mutex.Unlock()
+	if z.soa == nil {
+		return 0
+	}
+	return z.soa.Serial
+}
+
+// Bump increments the serial for a change of the zone data
+func (z *zoneSerial) Bump(cause string, subdomain string) {
+	if z == nil {
+		return
+	}
+	z.mutex.Lock()
+	defer z.mutex.Unlock()
+	if z.soa == nil {
+		return
+	}
+	// The published SOA record may be in use by queries, replace it with a copy
+	soa := dns.Copy(z.soa).(*dns.SOA)
+	soa.Serial++
+	z.records.ReplaceSOA(soa)
+	z.soa = soa
+	z.history = append(z.history, serialBump{soa.Serial, clockOrSystem(z.clock).Now().Unix(), cause, subdomain})
+	if len(z.history) > serialHistorySize {
+		z.history = z.history[len(z.history)-serialHistorySize:]
+	}
+	dnsLog.WithFields(log.Fields{"serial": soa.Serial, "cause": cause, "subdomain": subdomain}).Debug("Bumped the zone serial")
+}
+
+// History returns the latest serial bumps, newest first
+func (z *zoneSerial) History() []serialBump {
+	z.mutex.Lock()
+	defer z.mutex.Unlock()
+	history := make([]serialBump, 0, len(z.history))
+	for i := len(z.history) - 1; i >= 0; i-- {
+		history = append(history, z.history[i])
+	}
+	return history
+}
+
+// webAdminZoneSerial reports the current SOA serial of the served zone and the
+// history of its bumps, optionally the latest ones up to the limit in the query
+func webAdminZoneSerial(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	if ZoneSerial == nil {
+		WriteJsonResponse(w, http.StatusNotFound, jsonError("not_found"))
+		return
+	}
+	history := ZoneSerial.History()
+	if value := r.URL.Query().Get("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit < 1 {
+			WriteJsonResponse(w, http.StatusBadRequest, jsonFieldErrors("bad_request", []fieldError{{"limit", "must be a positive number"}}))
+			return
+		}
+		if limit < len(history) {
+			history = history[:limit]
+		}
+	}
+	out, _ := json.Marshal(struct {
+		Serial  uint32       `json:"serial"`
+		History []serialBump `json:"history"`
+	}{ZoneSerial.Serial(), history})
+	WriteJsonResponse(w, http.StatusOK, out)
+}
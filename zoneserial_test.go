@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestZoneSerialBump(t *testing.T) {
+	clk := newFrozenClock(time.Unix(1700000000, 0))
+	server := NewDNSServer(nil, "", "udp", "auth.example.org")
+	soa, _ := dns.NewRR("auth.example.org. SOA ns1.auth.example.org. admin.example.org. 2023111422 28800 7200 604800 86400")
+	ns, _ := dns.NewRR("auth.example.org. NS ns1.auth.example.org.")
+	server.Domains.Add(soa, ns)
+	server.SOA = soa
+	z := newZoneSerial(server.Domains, soa, clk)
+
+	clk.Advance(time.Minute)
+	z.Bump("update", "sub1")
+	z.Bump("deregister", "sub2")
+	if z.Serial() != 2023111424 {
+		t.Errorf("Expected serial 2023111424, got %d", z.Serial())
+	}
+	if served := server.zoneSOA().(*dns.SOA).Serial; served != 2023111424 {
+		t.Errorf("Expected the bumped serial to be served, got %d", served)
+	}
+	if soa.(*dns.SOA).Serial != 2023111422 {
+		t.Errorf("Expected the original SOA record to be left as is")
+	}
+	records, _ := server.Domains.Get("auth.example.org.")
+	if len(records.Records) != 2 {
+		t.Errorf("Expected the other records of the name to be kept, got %v", records.Records)
+	}
+	history := z.History()
+	if len(history) != 3 || history[0].Cause != "deregister" || history[1].Subdomain != "sub1" || history[2].Cause != "startup" {
+		t.Fatalf("Unexpected history %v", history)
+	}
+	if history[1].Time != 1700000060 || history[2].Serial != 2023111422 {
+		t.Errorf("Unexpected history %v", history)
+	}
+
+	for i := 0; i < serialHistorySize; i++ {
+		z.Bump("update", "sub1")
+	}
+	if history = z.History(); len(history) != serialHistorySize || history[0].Serial != z.Serial() {
+		t.Errorf("Expected the latest %d bumps, got %d", serialHistorySize, len(history))
+	}
+}
+
+func TestAdminZoneSerial(t *testing.T) {
+	soa, _ := dns.NewRR("auth.example.org. SOA ns1.auth.example.org. admin.example.org. 2023111422 28800 7200 604800 86400")
+	records := newStaticRecords()
+	records.Add(soa)
+	ZoneSerial = newZoneSerial(records, soa, nil)
+	defer func() { ZoneSerial = nil }()
+	ZoneSerial.Bump("update", "sub1")
+	ZoneSerial.Bump("update", "sub2")
+
+	rec := httptest.NewRecorder()
+	webAdminZoneSerial(rec, httptest.NewRequest(http.MethodGet, "/admin/zone/serial?limit=1", nil), nil)
+	var resp struct {
+		Serial  uint32       `json:"serial"`
+		History []serialBump `json:"history"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("Invalid response %s: %v", rec.Body.String(), err)
+	}
+	if resp.Serial != 2023111424 || len(resp.History) != 1 || resp.History[0].Subdomain != "sub2" {
+		t.Errorf("Unexpected response %s", rec.Body.String())
+	}
+
+	rec = httptest.NewRecorder()
+	webAdminZoneSerial(rec, httptest.NewRequest(http.MethodGet, "/admin/zone/serial?limit=x", nil), nil)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an invalid limit, got %d", rec.Code)
+	}
+}